@@ -0,0 +1,70 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include <openssl/ssl.h>
+#include "_cgo_export.h"
+
+#if OPENSSL_VERSION_NUMBER >= 0x10002000L
+
+static int alpn_select_cb(SSL *ssl, const unsigned char **out,
+		unsigned char *outlen, const unsigned char *in, unsigned int inlen,
+		void *arg) {
+	return alpn_select_cb_thunk(
+		SSL_CTX_get_ex_data(SSL_get_SSL_CTX(ssl), get_ssl_ctx_idx()),
+		SSL_get_ex_data(ssl, get_ssl_idx()), (unsigned char *)in, inlen,
+		outlen, (unsigned char **)out);
+}
+
+int SSL_CTX_set_alpn(SSL_CTX *ctx, const unsigned char *protos,
+		unsigned int len) {
+	// set_alpn_protos is the odd one out, returning 0 on success
+	return SSL_CTX_set_alpn_protos(ctx, protos, len) == 0;
+}
+
+int SSL_set_alpn(SSL *ssl, const unsigned char *protos, unsigned int len) {
+	return SSL_set_alpn_protos(ssl, protos, len) == 0;
+}
+
+int SSL_CTX_set_alpn_select(SSL_CTX *ctx, int enabled) {
+	SSL_CTX_set_alpn_select_cb(ctx, enabled ? alpn_select_cb : NULL, NULL);
+	return 1;
+}
+
+void SSL_get_alpn_selected(SSL *ssl, const unsigned char **data,
+		unsigned int *len) {
+	SSL_get0_alpn_selected(ssl, data, len);
+}
+
+#else
+
+int SSL_CTX_set_alpn(SSL_CTX *ctx, const unsigned char *protos,
+		unsigned int len) {
+	return -1;
+}
+
+int SSL_set_alpn(SSL *ssl, const unsigned char *protos, unsigned int len) {
+	return -1;
+}
+
+int SSL_CTX_set_alpn_select(SSL_CTX *ctx, int enabled) {
+	return -1;
+}
+
+void SSL_get_alpn_selected(SSL *ssl, const unsigned char **data,
+		unsigned int *len) {
+	*data = NULL;
+	*len = 0;
+}
+
+#endif
@@ -0,0 +1,188 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <openssl/ssl.h>
+
+extern int SSL_CTX_set_alpn(SSL_CTX *ctx, const unsigned char *protos,
+    unsigned int len);
+extern int SSL_CTX_set_alpn_select(SSL_CTX *ctx, int enabled);
+extern int SSL_set_alpn(SSL *ssl, const unsigned char *protos,
+    unsigned int len);
+extern void SSL_get_alpn_selected(SSL *ssl, const unsigned char **data,
+    unsigned int *len);
+*/
+import "C"
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"unsafe"
+)
+
+var alpnUnsupported = errors.New("ALPN requires OpenSSL 1.0.2 or newer")
+
+// AlpnSelectCallback picks the application protocol for a connection from
+// those the client offers, in the client's order of preference. Returning ""
+// or a protocol the client didn't offer carries on without ALPN.
+type AlpnSelectCallback func(offered []string) string
+
+// SetAlpnProtos sets the application protocols negotiated with ALPN (RFC
+// 7301), such as "h2" and "http/1.1". Clients offer protos, and servers pick
+// the first of protos that the client also offers, unless the context has an
+// AlpnSelectCallback. Servers carry on without ALPN if there is none in
+// common. An empty list disables ALPN. The list may be changed while the
+// context is in use, taking effect for new connections.
+func (c *Ctx) SetAlpnProtos(protos []string) error {
+	wire, err := marshalProtocolList(protos)
+	if err != nil {
+		return err
+	}
+	var wire_ptr *C.uchar
+	if len(wire) > 0 {
+		wire_ptr = (*C.uchar)(unsafe.Pointer(&wire[0]))
+	}
+	c.alpn_mtx.Lock()
+	defer c.alpn_mtx.Unlock()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	switch C.SSL_CTX_set_alpn(c.ctx, wire_ptr, C.uint(len(wire))) {
+	case 1:
+	case -1:
+		return alpnUnsupported
+	default:
+		return errorFromErrorQueue()
+	}
+	c.alpn_protos = append([]string(nil), protos...)
+	return c.updateAlpnSelect()
+}
+
+// SetAlpnSelectCallback makes servers using the context choose the protocol
+// of each connection with cb rather than by their own list, e.g. to follow
+// the client's preference or to pick by some other state. A nil cb reverts
+// to the list.
+func (c *Ctx) SetAlpnSelectCallback(cb AlpnSelectCallback) error {
+	c.alpn_mtx.Lock()
+	defer c.alpn_mtx.Unlock()
+	c.alpn_select = cb
+	return c.updateAlpnSelect()
+}
+
+// updateAlpnSelect installs the server's selection callback if there is
+// anything to select with. The caller must hold c.alpn_mtx.
+func (c *Ctx) updateAlpnSelect() error {
+	var enabled C.int
+	if len(c.alpn_protos) > 0 || c.alpn_select != nil || c.alpn_conns {
+		enabled = 1
+	}
+	if C.SSL_CTX_set_alpn_select(c.ctx, enabled) != 1 {
+		return alpnUnsupported
+	}
+	return nil
+}
+
+// enableConnAlpnProtos installs the server's selection callback for a
+// connection with protocols of its own, see Conn.SetAlpnProtos.
+func (c *Ctx) enableConnAlpnProtos() error {
+	c.alpn_mtx.Lock()
+	defer c.alpn_mtx.Unlock()
+	c.alpn_conns = true
+	return c.updateAlpnSelect()
+}
+
+// alpnWire returns the context's protocols in wire format.
+func (c *Ctx) alpnWire() []byte {
+	c.alpn_mtx.Lock()
+	defer c.alpn_mtx.Unlock()
+	// the list was checked when it was set
+	wire, _ := marshalProtocolList(c.alpn_protos)
+	return wire
+}
+
+//export alpn_select_cb_thunk
+func alpn_select_cb_thunk(p unsafe.Pointer, conn_p unsafe.Pointer,
+	in *C.uchar, inlen C.uint, outlen *C.uchar, out **C.uchar) C.int {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Critf("openssl: ALPN select callback panic'd: %v", err)
+			os.Exit(1)
+		}
+	}()
+	ctx := (*Ctx)(p)
+	ctx.alpn_mtx.Lock()
+	protos, cb := ctx.alpn_protos, ctx.alpn_select
+	ctx.alpn_mtx.Unlock()
+	// the handshake holds the connection's lock
+	if conn := (*Conn)(conn_p); conn != nil && conn.alpn_protos != nil {
+		protos, cb = conn.alpn_protos, nil
+	}
+
+	// note where each protocol sits in the client's list, which outlives the
+	// handshake, so that the choice can point into it
+	wire := C.GoBytes(unsafe.Pointer(in), C.int(inlen))
+	var offered []string
+	offsets := make(map[string]int)
+	for i := 0; i < len(wire); {
+		n := int(wire[i])
+		if i+1+n > len(wire) {
+			break
+		}
+		proto := string(wire[i+1 : i+1+n])
+		offered = append(offered, proto)
+		if _, ok := offsets[proto]; !ok {
+			offsets[proto] = i + 1
+		}
+		i += 1 + n
+	}
+
+	choice := ""
+	if cb != nil {
+		choice = cb(offered)
+	} else {
+		for _, proto := range protos {
+			if _, ok := offsets[proto]; ok {
+				choice = proto
+				break
+			}
+		}
+	}
+	offset, ok := offsets[choice]
+	if choice == "" || !ok {
+		// carry on without ALPN rather than failing the handshake
+		return C.SSL_TLSEXT_ERR_NOACK
+	}
+	*out = (*C.uchar)(unsafe.Pointer(uintptr(unsafe.Pointer(in)) +
+		uintptr(offset)))
+	*outlen = C.uchar(len(choice))
+	return C.SSL_TLSEXT_ERR_OK
+}
+
+// NegotiatedProtocol returns the application protocol chosen with ALPN, or ""
+// if none was. It is only meaningful once the handshake has completed.
+func (c *Conn) NegotiatedProtocol() string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	var data *C.uchar
+	var length C.uint
+	C.SSL_get_alpn_selected(c.ssl, &data, &length)
+	if data == nil || length == 0 {
+		return ""
+	}
+	return string(C.GoBytes(unsafe.Pointer(data), C.int(length)))
+}
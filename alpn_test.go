@@ -0,0 +1,138 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"testing"
+)
+
+// negotiateAlpn handshakes a client offering protos with server_ctx and
+// returns the protocol each side sees.
+func negotiateAlpn(t *testing.T, server_ctx *Ctx, protos []string) (string,
+	string) {
+	client_ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client_ctx.SetAlpnProtos(protos); err != nil {
+		t.Fatal(err)
+	}
+	server_conn, client_conn := NetPipe(t)
+	defer server_conn.Close()
+	defer client_conn.Close()
+	server, err := Server(server_conn, server_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := Client(client_conn, client_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	errs := make(chan error, 1)
+	go func() { errs <- server.Handshake() }()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	return client.NegotiatedProtocol(), server.NegotiatedProtocol()
+}
+
+func TestAlpnProtos(t *testing.T) {
+	server_ctx := newTestServerCtx(t)
+	if err := server_ctx.SetAlpnProtos(
+		[]string{"h2", "http/1.1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the server's preference wins
+	client_proto, server_proto := negotiateAlpn(t, server_ctx,
+		[]string{"http/1.1", "h2"})
+	if client_proto != "h2" || server_proto != "h2" {
+		t.Fatalf("unexpected protocols %q and %q", client_proto,
+			server_proto)
+	}
+	client_proto, server_proto = negotiateAlpn(t, server_ctx,
+		[]string{"http/1.1"})
+	if client_proto != "http/1.1" || server_proto != "http/1.1" {
+		t.Fatalf("unexpected protocols %q and %q", client_proto,
+			server_proto)
+	}
+	// with nothing in common the handshake goes ahead without ALPN
+	client_proto, server_proto = negotiateAlpn(t, server_ctx,
+		[]string{"spdy/3.1"})
+	if client_proto != "" || server_proto != "" {
+		t.Fatalf("unexpected protocols %q and %q", client_proto,
+			server_proto)
+	}
+	// nor with a client that doesn't offer any
+	client_proto, server_proto = negotiateAlpn(t, server_ctx, nil)
+	if client_proto != "" || server_proto != "" {
+		t.Fatalf("unexpected protocols %q and %q", client_proto,
+			server_proto)
+	}
+
+	if err := server_ctx.SetAlpnProtos([]string{""}); err == nil {
+		t.Fatal("expected an error for an empty protocol name")
+	}
+}
+
+func TestAlpnSelectCallback(t *testing.T) {
+	server_ctx := newTestServerCtx(t)
+	var offered []string
+	choice := ""
+	if err := server_ctx.SetAlpnSelectCallback(
+		func(protos []string) string {
+			offered = protos
+			return choice
+		}); err != nil {
+		t.Fatal(err)
+	}
+
+	choice = "http/1.1"
+	client_proto, server_proto := negotiateAlpn(t, server_ctx,
+		[]string{"h2", "http/1.1"})
+	if client_proto != "http/1.1" || server_proto != "http/1.1" {
+		t.Fatalf("unexpected protocols %q and %q", client_proto,
+			server_proto)
+	}
+	if len(offered) != 2 || offered[0] != "h2" || offered[1] != "http/1.1" {
+		t.Fatalf("unexpected offered protocols %q", offered)
+	}
+	// choosing something that wasn't offered declines ALPN
+	choice = "spdy/3.1"
+	client_proto, server_proto = negotiateAlpn(t, server_ctx,
+		[]string{"h2"})
+	if client_proto != "" || server_proto != "" {
+		t.Fatalf("unexpected protocols %q and %q", client_proto,
+			server_proto)
+	}
+
+	// removing the callback reverts to the server's list
+	if err := server_ctx.SetAlpnSelectCallback(nil); err != nil {
+		t.Fatal(err)
+	}
+	client_proto, server_proto = negotiateAlpn(t, server_ctx,
+		[]string{"h2"})
+	if client_proto != "" || server_proto != "" {
+		t.Fatalf("unexpected protocols %q and %q", client_proto,
+			server_proto)
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <stdlib.h>
+#include <openssl/asn1.h>
+
+const unsigned char *ASN1_STRING_get0_data_not_a_macro(
+    const ASN1_STRING *s) {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+    return ASN1_STRING_get0_data(s);
+#else
+    return ASN1_STRING_data((ASN1_STRING *)s);
+#endif
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+	"unsafe"
+)
+
+var (
+	// NoWellDefinedExpiration is the GeneralizedTime value 99991231235959Z
+	// that RFC 5280 reserves for certificates that do not expire.
+	NoWellDefinedExpiration = time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
+)
+
+// ParseASN1Time parses the string form of an ASN.1 UTCTime or
+// GeneralizedTime, followed by "Z" or a +hhmm/-hhmm offset. Since the two
+// forms can't always be told apart by their text alone, a value with 10 or 12
+// digits before the zone (YYMMDDHHMM[SS]) is treated as a UTCTime and anything
+// else as a GeneralizedTime (YYYYMMDDHH[MM[SS[.fff]]]), which may also omit
+// the zone to mean UTC. The result is always in UTC.
+func ParseASN1Time(s string) (time.Time, error) {
+	digits := 0
+	for digits < len(s) && s[digits] >= '0' && s[digits] <= '9' {
+		digits++
+	}
+	utc_time := (digits == 10 || digits == 12) &&
+		(digits == len(s) || s[digits] != '.' && s[digits] != ',')
+	return parseASN1Time(s, utc_time)
+}
+
+// FormatASN1Time formats t the way RFC 5280 requires certificate times to be
+// encoded: UTCTime for years 1950 through 2049 and GeneralizedTime otherwise,
+// always in UTC and without fractional seconds.
+func FormatASN1Time(t time.Time) string {
+	t = t.UTC()
+	if t.Year() >= 1950 && t.Year() < 2050 {
+		return t.Format("060102150405Z")
+	}
+	return t.Format("20060102150405Z")
+}
+
+func parseASN1Time(s string, utc_time bool) (time.Time, error) {
+	bad := func() (time.Time, error) {
+		return time.Time{}, fmt.Errorf("invalid asn1 time %q", s)
+	}
+	rest := s
+	digits := func(n int) (int, bool) {
+		if len(rest) < n {
+			return 0, false
+		}
+		for i := 0; i < n; i++ {
+			if rest[i] < '0' || rest[i] > '9' {
+				return 0, false
+			}
+		}
+		v, _ := strconv.Atoi(rest[:n])
+		rest = rest[n:]
+		return v, true
+	}
+	var year, month, day, hour, min, sec, nsec int
+	var ok bool
+	if utc_time {
+		if year, ok = digits(2); !ok {
+			return bad()
+		}
+		if year >= 50 {
+			year += 1900
+		} else {
+			year += 2000
+		}
+	} else if year, ok = digits(4); !ok {
+		return bad()
+	}
+	if month, ok = digits(2); !ok {
+		return bad()
+	}
+	if day, ok = digits(2); !ok {
+		return bad()
+	}
+	if hour, ok = digits(2); !ok {
+		return bad()
+	}
+	if v, ok := digits(2); ok {
+		min = v
+		if v, ok := digits(2); ok {
+			sec = v
+		}
+	} else if utc_time {
+		return bad()
+	}
+	if !utc_time && len(rest) > 1 && (rest[0] == '.' || rest[0] == ',') {
+		rest = rest[1:]
+		frac := 0
+		for frac < len(rest) && rest[frac] >= '0' && rest[frac] <= '9' {
+			frac++
+		}
+		if frac == 0 {
+			return bad()
+		}
+		// keep nanosecond precision, dropping anything finer
+		digits := rest[:frac]
+		for len(digits) < 9 {
+			digits += "0"
+		}
+		nsec, _ = strconv.Atoi(digits[:9])
+		rest = rest[frac:]
+	}
+
+	loc := time.UTC
+	switch {
+	case rest == "Z":
+	case rest == "" && !utc_time:
+	case len(rest) == 5 && (rest[0] == '+' || rest[0] == '-'):
+		sign := rest[0]
+		rest = rest[1:]
+		oh, ok1 := digits(2)
+		om, ok2 := digits(2)
+		if !ok1 || !ok2 || oh > 23 || om > 59 {
+			return bad()
+		}
+		offset := oh*3600 + om*60
+		if sign == '-' {
+			offset = -offset
+		}
+		loc = time.FixedZone("", offset)
+	default:
+		return bad()
+	}
+
+	if month < 1 || month > 12 || day < 1 || day > 31 || hour > 23 ||
+		min > 59 || sec > 60 {
+		return bad()
+	}
+	t := time.Date(year, time.Month(month), day, hour, min, sec, nsec, loc)
+	if t.Day() != day {
+		// time.Date normalizes days like Feb 30th into March
+		return bad()
+	}
+	return t.UTC(), nil
+}
+
+// asn1TimeToTime converts an ASN1_TIME owned by OpenSSL to a time.Time.
+func asn1TimeToTime(t *C.ASN1_TIME) (time.Time, error) {
+	if t == nil {
+		return time.Time{}, errors.New("no asn1 time")
+	}
+	data := C.ASN1_STRING_get0_data_not_a_macro((*C.ASN1_STRING)(t))
+	s := C.GoStringN((*C.char)(unsafe.Pointer(data)),
+		C.ASN1_STRING_length((*C.ASN1_STRING)(t)))
+	switch C.ASN1_STRING_type((*C.ASN1_STRING)(t)) {
+	case C.V_ASN1_UTCTIME:
+		return parseASN1Time(s, true)
+	case C.V_ASN1_GENERALIZEDTIME:
+		return parseASN1Time(s, false)
+	default:
+		return time.Time{}, errors.New("unknown asn1 time type")
+	}
+}
+
+// newASN1Time allocates an ASN1_TIME holding t, encoded per FormatASN1Time.
+// The caller owns the result and must free it with ASN1_TIME_free.
+func newASN1Time(t time.Time) (*C.ASN1_TIME, error) {
+	rv := C.ASN1_TIME_new()
+	if rv == nil {
+		return nil, errors.New("failed to allocate asn1 time")
+	}
+	if err := setASN1Time(rv, t); err != nil {
+		C.ASN1_TIME_free(rv)
+		return nil, err
+	}
+	return rv, nil
+}
+
+// setASN1Time overwrites an existing ASN1_TIME, such as the validity fields
+// of a certificate being built, with t.
+func setASN1Time(dst *C.ASN1_TIME, t time.Time) error {
+	cstr := C.CString(FormatASN1Time(t))
+	defer C.free(unsafe.Pointer(cstr))
+	if C.ASN1_TIME_set_string(dst, cstr) != 1 {
+		return fmt.Errorf("failed to set asn1 time to %s", t)
+	}
+	return nil
+}
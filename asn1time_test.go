@@ -0,0 +1,101 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseASN1Time(t *testing.T) {
+	utc := func(y int, mo time.Month, d, h, mi, s, ns int) time.Time {
+		return time.Date(y, mo, d, h, mi, s, ns, time.UTC)
+	}
+	good := map[string]time.Time{
+		"131217183822Z":         utc(2013, 12, 17, 18, 38, 22, 0),
+		"491231235959Z":         utc(2049, 12, 31, 23, 59, 59, 0),
+		"500101000000Z":         utc(1950, 1, 1, 0, 0, 0, 0),
+		"1312171838Z":           utc(2013, 12, 17, 18, 38, 0, 0),
+		"131217183822+0130":     utc(2013, 12, 17, 17, 8, 22, 0),
+		"20500101000000Z":       utc(2050, 1, 1, 0, 0, 0, 0),
+		"20131217183822.25Z":    utc(2013, 12, 17, 18, 38, 22, 250000000),
+		"20131217183822,5-0200": utc(2013, 12, 17, 20, 38, 22, 500000000),
+		"20131217183822":        utc(2013, 12, 17, 18, 38, 22, 0),
+		"99991231235959Z":       NoWellDefinedExpiration,
+		"20131217183822.1234567891Z": utc(2013, 12, 17, 18, 38, 22,
+			123456789),
+	}
+	for in, expected := range good {
+		out, err := ParseASN1Time(in)
+		if err != nil {
+			t.Fatalf("%s: %s", in, err)
+		}
+		if !out.Equal(expected) {
+			t.Fatalf("%s: expected %s, got %s", in, expected, out)
+		}
+	}
+	for _, in := range []string{"", "Z", "1312171838", "131317183822Z",
+		"20130230000000Z", "20131217183822.Z", "131217183822+01"} {
+		if _, err := ParseASN1Time(in); err == nil {
+			t.Fatalf("%q: expected an error", in)
+		}
+	}
+}
+
+func TestFormatASN1Time(t *testing.T) {
+	cases := map[time.Time]string{
+		time.Date(2013, 12, 17, 18, 38, 22, 999, time.UTC): "131217183822Z",
+		time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC):        "20500101000000Z",
+		time.Date(1949, 12, 31, 23, 59, 59, 0, time.UTC):   "19491231235959Z",
+		NoWellDefinedExpiration:                            "99991231235959Z",
+	}
+	for in, expected := range cases {
+		if out := FormatASN1Time(in); out != expected {
+			t.Fatalf("expected %s, got %s", expected, out)
+		}
+		back, err := newASN1Time(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := asn1TimeToTime(back)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !parsed.Equal(in.Truncate(time.Second)) {
+			t.Fatalf("expected %s, got %s", in, parsed)
+		}
+	}
+}
+
+func TestCertificateValidity(t *testing.T) {
+	cert, err := LoadCertificateFromPEM(certBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	not_before, err := cert.NotBefore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	not_after, err := cert.NotAfter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !not_before.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)) ||
+		!not_after.Equal(time.Date(2124, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected validity %s - %s", not_before, not_after)
+	}
+}
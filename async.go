@@ -0,0 +1,312 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <stdint.h>
+#include <openssl/crypto.h>
+#include <openssl/ssl.h>
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L && !defined(OPENSSL_NO_ASYNC)
+#include <openssl/async.h>
+#define OUR_HAVE_ASYNC
+#endif
+
+// OpenSSL runs async jobs on stacks of its own, which Go can't be called
+// back on, so connections in async mode can't use the Go BIOs. Instead they
+// use a memory BIO behind a lock, which Go fills and drains from outside the
+// connection's lock.
+
+#ifdef OUR_HAVE_ASYNC
+
+typedef struct {
+    CRYPTO_RWLOCK *lock;
+    BIO *mem;
+} locked_bio;
+
+static int locked_bio_read(BIO *b, char *buf, int size) {
+    locked_bio *l = BIO_get_data(b);
+    int n;
+    BIO_clear_retry_flags(b);
+    CRYPTO_THREAD_write_lock(l->lock);
+    n = BIO_read(l->mem, buf, size);
+    if (n <= 0 && BIO_should_retry(l->mem))
+        BIO_set_retry_read(b);
+    CRYPTO_THREAD_unlock(l->lock);
+    return n;
+}
+
+static int locked_bio_write(BIO *b, const char *buf, int size) {
+    locked_bio *l = BIO_get_data(b);
+    int n;
+    BIO_clear_retry_flags(b);
+    CRYPTO_THREAD_write_lock(l->lock);
+    n = BIO_write(l->mem, buf, size);
+    CRYPTO_THREAD_unlock(l->lock);
+    return n;
+}
+
+static long locked_bio_ctrl(BIO *b, int cmd, long num, void *ptr) {
+    locked_bio *l = BIO_get_data(b);
+    long rv;
+    switch (cmd) {
+    case BIO_CTRL_PENDING:
+    case BIO_CTRL_WPENDING:
+    case BIO_CTRL_EOF:
+        CRYPTO_THREAD_write_lock(l->lock);
+        rv = BIO_ctrl(l->mem, cmd, num, ptr);
+        CRYPTO_THREAD_unlock(l->lock);
+        return rv;
+    case BIO_CTRL_DUP:
+    case BIO_CTRL_FLUSH:
+        return 1;
+    default:
+        return 0;
+    }
+}
+
+static int locked_bio_destroy(BIO *b) {
+    locked_bio *l = BIO_get_data(b);
+    if (l != NULL) {
+        BIO_free(l->mem);
+        CRYPTO_THREAD_lock_free(l->lock);
+        OPENSSL_free(l);
+        BIO_set_data(b, NULL);
+    }
+    return 1;
+}
+
+// only called once, under a sync.Once
+static BIO_METHOD *BIO_s_locked() {
+    BIO_METHOD *m = BIO_meth_new(BIO_TYPE_SOURCE_SINK, "Go Locked BIO");
+    if (m == NULL)
+        return NULL;
+    BIO_meth_set_read(m, locked_bio_read);
+    BIO_meth_set_write(m, locked_bio_write);
+    BIO_meth_set_ctrl(m, locked_bio_ctrl);
+    BIO_meth_set_destroy(m, locked_bio_destroy);
+    return m;
+}
+
+static BIO *OUR_locked_bio_new(BIO_METHOD *method) {
+    locked_bio *l;
+    BIO *b = BIO_new(method);
+    if (b == NULL)
+        return NULL;
+    l = OPENSSL_zalloc(sizeof(*l));
+    if (l == NULL) {
+        BIO_free(b);
+        return NULL;
+    }
+    BIO_set_data(b, l);
+    BIO_set_init(b, 1);
+    l->lock = CRYPTO_THREAD_lock_new();
+    l->mem = BIO_new(BIO_s_mem());
+    if (l->lock == NULL || l->mem == NULL) {
+        BIO_free(b);
+        return NULL;
+    }
+    // empty means retry, until the end of the input is marked
+    BIO_set_mem_eof_return(l->mem, -1);
+    return b;
+}
+
+static int OUR_locked_bio_write(BIO *b, const void *buf, int size) {
+    return locked_bio_write(b, buf, size);
+}
+
+static int OUR_locked_bio_read(BIO *b, void *buf, int size) {
+    locked_bio *l = BIO_get_data(b);
+    int n;
+    CRYPTO_THREAD_write_lock(l->lock);
+    n = BIO_read(l->mem, buf, size);
+    CRYPTO_THREAD_unlock(l->lock);
+    return n;
+}
+
+static void OUR_locked_bio_set_eof(BIO *b) {
+    locked_bio *l = BIO_get_data(b);
+    CRYPTO_THREAD_write_lock(l->lock);
+    BIO_set_mem_eof_return(l->mem, 0);
+    CRYPTO_THREAD_unlock(l->lock);
+}
+
+#else
+
+static BIO_METHOD *BIO_s_locked() { return NULL; }
+static BIO *OUR_locked_bio_new(BIO_METHOD *method) { return NULL; }
+static int OUR_locked_bio_write(BIO *b, const void *buf, int size) {
+    return -1;
+}
+static int OUR_locked_bio_read(BIO *b, void *buf, int size) { return -1; }
+static void OUR_locked_bio_set_eof(BIO *b) {}
+
+#endif
+
+// copies up to max of the fds engines signal paused jobs' progress on into
+// fds, returning how many there are
+static int OUR_SSL_get_async_fds(SSL *ssl, intptr_t *fds, int max) {
+#ifdef OUR_HAVE_ASYNC
+    OSSL_ASYNC_FD *all;
+    size_t n = 0, i;
+    if (SSL_get_all_async_fds(ssl, NULL, &n) != 1 || n == 0)
+        return 0;
+    all = OPENSSL_malloc(n * sizeof(*all));
+    if (all == NULL)
+        return -1;
+    if (SSL_get_all_async_fds(ssl, all, &n) != 1) {
+        OPENSSL_free(all);
+        return -1;
+    }
+    for (i = 0; i < n && i < (size_t)max; i++)
+        fds[i] = (intptr_t)all[i];
+    OPENSSL_free(all);
+    return (int)i;
+#else
+    return 0;
+#endif
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+const (
+	// asyncPollInterval is how often paused async jobs are retried when
+	// their engine gives no fds to wait on
+	asyncPollInterval = 100 * time.Microsecond
+	// asyncJobRetryInterval is how long to wait for an async job to free
+	// up when all of them are in use
+	asyncJobRetryInterval = time.Millisecond
+	// maxAsyncFds bounds the fds waited on at once
+	maxAsyncFds = 16
+)
+
+var (
+	locked_bio_method      *C.BIO_METHOD
+	locked_bio_method_once sync.Once
+)
+
+func newLockedBio() *C.BIO {
+	locked_bio_method_once.Do(func() {
+		locked_bio_method = C.BIO_s_locked()
+	})
+	if locked_bio_method == nil {
+		return nil
+	}
+	return C.OUR_locked_bio_new(locked_bio_method)
+}
+
+// MakeLockedCBIO is MakeCBIO for connections in async mode.
+func (b *readBio) MakeLockedCBIO() *C.BIO {
+	b.locked = newLockedBio()
+	return b.locked
+}
+
+// pushLocked moves the buffered input into the locked BIO. The caller must
+// hold b.data_mtx.
+func (b *readBio) pushLocked() {
+	if b.locked == nil || len(b.buf) == 0 {
+		return
+	}
+	if C.OUR_locked_bio_write(b.locked, unsafe.Pointer(&b.buf[0]),
+		C.int(len(b.buf))) != C.int(len(b.buf)) {
+		logger.Critf("openssl: failed to buffer %d bytes of input",
+			len(b.buf))
+	}
+	b.buf = b.buf[:0]
+	if b.release_buffers {
+		b.buf = nil
+	}
+}
+
+// markLockedEOF makes the locked BIO report the end of the input once it
+// runs dry.
+func (b *readBio) markLockedEOF() {
+	if b.locked != nil {
+		C.OUR_locked_bio_set_eof(b.locked)
+	}
+}
+
+// MakeLockedCBIO is MakeCBIO for connections in async mode.
+func (b *writeBio) MakeLockedCBIO() *C.BIO {
+	b.locked = newLockedBio()
+	return b.locked
+}
+
+// drainLocked moves the locked BIO's output into the buffer. The caller
+// must hold b.data_mtx.
+func (b *writeBio) drainLocked() {
+	if b.locked == nil {
+		return
+	}
+	var chunk [SSLRecordSize]byte
+	for {
+		n := C.OUR_locked_bio_read(b.locked, unsafe.Pointer(&chunk[0]),
+			C.int(len(chunk)))
+		if n <= 0 {
+			return
+		}
+		b.buf = append(b.buf, chunk[:n]...)
+	}
+}
+
+// EnableAsync sets the Async mode, so that connections made afterwards
+// offload crypto to an asynchronous engine, usually made the default with
+// Engine.SetDefault, such as Intel QAT's. A connection waiting for the
+// engine parks its goroutine in the runtime's poller on the engine's fds,
+// rather than blocking an OS thread, and resumes the paused operation once
+// they're readable. Without such an engine connections work as usual.
+//
+// Async jobs run on stacks of their own, which Go code can't be called back
+// on, so contexts in async mode must not use any of the Go callbacks this
+// package offers, for verification, SNI, ALPN or NPN selection, sessions,
+// key logging, PSK, OCSP stapling, info or messages: calling one from an
+// async job crashes the process.
+func (c *Ctx) EnableAsync() error {
+	if Async == 0 {
+		return errors.New("async mode requires OpenSSL 1.1.0 or newer, " +
+			"built with async support")
+	}
+	c.SetMode(Async)
+	return nil
+}
+
+// waitAsync waits until the connection's paused async job can make
+// progress.
+func (c *Conn) waitAsync() error {
+	var cfds [maxAsyncFds]C.intptr_t
+	c.mtx.Lock()
+	n := C.OUR_SSL_get_async_fds(c.ssl, &cfds[0], maxAsyncFds)
+	c.mtx.Unlock()
+	if n < 0 {
+		return errors.New("failed to get async fds")
+	}
+	if n == 0 {
+		time.Sleep(asyncPollInterval)
+		return nil
+	}
+	fds := make([]uintptr, n)
+	for i := range fds {
+		fds[i] = uintptr(cfds[i])
+	}
+	return waitAsyncFds(fds)
+}
@@ -0,0 +1,64 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !windows
+
+package openssl
+
+import (
+	"os"
+	"syscall"
+)
+
+// waitAsyncFds waits for any of fds, which belong to an engine, to become
+// readable. The fds are duplicated into the runtime's poller, so that the
+// goroutine parks rather than blocking a thread; this makes them
+// non-blocking, which engines only reading them once signalled don't notice.
+func waitAsyncFds(fds []uintptr) error {
+	files := make([]*os.File, 0, len(fds))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	done := make(chan error, len(fds))
+	for _, fd := range fds {
+		dup, err := syscall.Dup(int(fd))
+		if err != nil {
+			return err
+		}
+		if err := syscall.SetNonblock(dup, true); err != nil {
+			syscall.Close(dup)
+			return err
+		}
+		f := os.NewFile(uintptr(dup), "async")
+		files = append(files, f)
+		raw, err := f.SyscallConn()
+		if err != nil {
+			return err
+		}
+		go func() {
+			// the first call finds nothing to do, so the second comes once
+			// the fd is readable
+			waited := false
+			done <- raw.Read(func(uintptr) bool {
+				ready := waited
+				waited = true
+				return ready
+			})
+		}()
+	}
+	// closing the files when done wakes the other waiters
+	return <-done
+}
@@ -0,0 +1,125 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"io"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestAsyncMode(t *testing.T) {
+	key, err := LoadPrivateKeyFromPEM(keyBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := LoadCertificateFromPEM(certBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server_ctx := newSharedCtx(t, key, cert, cert)
+	if err := server_ctx.EnableAsync(); err != nil {
+		t.Skip(err)
+	}
+	if server_ctx.GetMode()&Async == 0 {
+		t.Fatal("expected the async mode to be set")
+	}
+	client_ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client_ctx.EnableAsync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// with no async engine the jobs never pause, but still run as jobs
+	server_conn, client_conn := NetPipe(t)
+	defer server_conn.Close()
+	defer client_conn.Close()
+	server, err := Server(server_conn, server_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := Client(client_conn, client_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	errs := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(server, buf); err != nil {
+			errs <- err
+			return
+		}
+		_, err := server.Write(buf)
+		errs <- err
+	}()
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("expected hello, got %q", buf)
+	}
+}
+
+func TestWaitAsyncFds(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("async fds are event handles on windows")
+	}
+	r1, w1, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r1.Close()
+	defer w1.Close()
+	r2, w2, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r2.Close()
+	defer w2.Close()
+
+	done := make(chan error, 1)
+	go func() { done <- waitAsyncFds([]uintptr{r1.Fd(), r2.Fd()}) }()
+	select {
+	case err := <-done:
+		t.Fatalf("expected to wait, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err := w2.Write([]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the fd")
+	}
+}
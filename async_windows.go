@@ -0,0 +1,29 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build windows
+
+package openssl
+
+import (
+	"syscall"
+)
+
+// waitAsyncFds waits for the first of fds, which are event handles belonging
+// to an engine, to be signalled. This blocks the calling thread.
+func waitAsyncFds(fds []uintptr) error {
+	_, err := syscall.WaitForSingleObject(syscall.Handle(fds[0]),
+		syscall.INFINITE)
+	return err
+}
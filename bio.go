@@ -20,11 +20,6 @@ package openssl
 #include <string.h>
 #include <openssl/bio.h>
 
-extern int cbioNew(BIO *b);
-static int cbioFree(BIO *b) {
-	return 1;
-}
-
 extern int writeBioWrite(BIO *b, char *buf, int size);
 extern long writeBioCtrl(BIO *b, int cmd, long arg1, void *arg2);
 static int writeBioPuts(BIO *b, const char *str) {
@@ -34,6 +29,86 @@ static int writeBioPuts(BIO *b, const char *str) {
 extern int readBioRead(BIO *b, char *buf, int size);
 extern long readBioCtrl(BIO *b, int cmd, long arg1, void *arg2);
 
+static int cbioNew(BIO *b) {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+    BIO_set_shutdown(b, 1);
+    BIO_set_init(b, 1);
+    BIO_set_data(b, NULL);
+    BIO_clear_flags(b, ~0);
+#else
+    b->shutdown = 1;
+    b->init = 1;
+    b->num = -1;
+    b->ptr = NULL;
+    b->flags = 0;
+#endif
+    return 1;
+}
+
+static int cbioFree(BIO *b) {
+    return 1;
+}
+
+static void *OUR_BIO_get_data(BIO *b) {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+    return BIO_get_data(b);
+#else
+    return b->ptr;
+#endif
+}
+
+static void OUR_BIO_set_data(BIO *b, void *ptr) {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+    BIO_set_data(b, ptr);
+#else
+    b->ptr = ptr;
+#endif
+}
+
+static void BIO_clear_retry_flags_not_a_macro(BIO *b) {
+    BIO_clear_retry_flags(b);
+}
+
+static void BIO_set_retry_read_not_a_macro(BIO *b) {
+    BIO_set_retry_read(b);
+}
+
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+
+// these are only called once each, during package initialization
+
+static BIO_METHOD *BIO_s_writeBio() {
+    static BIO_METHOD *m;
+    if (m == NULL) {
+        m = BIO_meth_new(BIO_TYPE_SOURCE_SINK, "Go Write BIO");
+        if (m == NULL)
+            return NULL;
+        BIO_meth_set_write(m,
+            (int (*)(BIO *, const char *, int))writeBioWrite);
+        BIO_meth_set_puts(m, writeBioPuts);
+        BIO_meth_set_ctrl(m, writeBioCtrl);
+        BIO_meth_set_create(m, cbioNew);
+        BIO_meth_set_destroy(m, cbioFree);
+    }
+    return m;
+}
+
+static BIO_METHOD *BIO_s_readBio() {
+    static BIO_METHOD *m;
+    if (m == NULL) {
+        m = BIO_meth_new(BIO_TYPE_SOURCE_SINK, "Go Read BIO");
+        if (m == NULL)
+            return NULL;
+        BIO_meth_set_read(m, readBioRead);
+        BIO_meth_set_ctrl(m, readBioCtrl);
+        BIO_meth_set_create(m, cbioNew);
+        BIO_meth_set_destroy(m, cbioFree);
+    }
+    return m;
+}
+
+#else
+
 static BIO_METHOD writeBioMethod = {
     BIO_TYPE_SOURCE_SINK,
     "Go Write BIO",
@@ -61,6 +136,8 @@ static BIO_METHOD readBioMethod = {
     NULL};
 
 static BIO_METHOD* BIO_s_readBio() { return &readBioMethod; }
+
+#endif
 */
 import "C"
 
@@ -76,6 +153,11 @@ const (
 	SSLRecordSize = 16 * 1024
 )
 
+var (
+	write_bio_method = C.BIO_s_writeBio()
+	read_bio_method  = C.BIO_s_readBio()
+)
+
 func nonCopyGoBytes(ptr uintptr, length int) []byte {
 	var slice []byte
 	header := (*reflect.SliceHeader)(unsafe.Pointer(&slice))
@@ -89,35 +171,25 @@ func nonCopyCString(data *C.char, size C.int) []byte {
 	return nonCopyGoBytes(uintptr(unsafe.Pointer(data)), int(size))
 }
 
-//export cbioNew
-func cbioNew(b *C.BIO) C.int {
-	b.shutdown = 1
-	b.init = 1
-	b.num = -1
-	b.ptr = nil
-	b.flags = 0
-	return 1
-}
-
 type writeBio struct {
 	data_mtx        sync.Mutex
 	op_mtx          sync.Mutex
 	buf             []byte
 	release_buffers bool
+	// locked replaces the Go BIO for connections in async mode, see async.go
+	locked *C.BIO
 }
 
 func loadWritePtr(b *C.BIO) *writeBio {
-	return (*writeBio)(unsafe.Pointer(b.ptr))
+	return (*writeBio)(C.OUR_BIO_get_data(b))
 }
 
 func bioClearRetryFlags(b *C.BIO) {
-	// from BIO_clear_retry_flags and BIO_clear_flags
-	b.flags &= ^(C.BIO_FLAGS_RWS | C.BIO_FLAGS_SHOULD_RETRY)
+	C.BIO_clear_retry_flags_not_a_macro(b)
 }
 
 func bioSetRetryRead(b *C.BIO) {
-	// from BIO_set_retry_read and BIO_set_flags
-	b.flags |= (C.BIO_FLAGS_READ | C.BIO_FLAGS_SHOULD_RETRY)
+	C.BIO_set_retry_read_not_a_macro(b)
 }
 
 //export writeBioWrite
@@ -174,6 +246,7 @@ func (b *writeBio) WriteTo(w io.Writer) (rv int64, err error) {
 
 	// write whatever data we currently have
 	b.data_mtx.Lock()
+	b.drainLocked()
 	data := b.buf
 	b.data_mtx.Unlock()
 
@@ -193,15 +266,44 @@ func (b *writeBio) WriteTo(w io.Writer) (rv int64, err error) {
 	return int64(n), err
 }
 
+// Read moves up to len(p) bytes of the buffered output into p.
+func (b *writeBio) Read(p []byte) int {
+	b.op_mtx.Lock()
+	defer b.op_mtx.Unlock()
+	b.data_mtx.Lock()
+	defer b.data_mtx.Unlock()
+	b.drainLocked()
+	n := copy(p, b.buf)
+	b.buf = b.buf[:copy(b.buf, b.buf[n:])]
+	if b.release_buffers && len(b.buf) == 0 {
+		b.buf = nil
+	}
+	return n
+}
+
+// Buffered returns how many bytes of output are waiting to be sent.
+func (b *writeBio) Buffered() int {
+	b.data_mtx.Lock()
+	defer b.data_mtx.Unlock()
+	b.drainLocked()
+	return len(b.buf)
+}
+
 func (self *writeBio) Disconnect(b *C.BIO) {
+	if self.locked == b {
+		self.locked = nil
+		return
+	}
 	if loadWritePtr(b) == self {
-		b.ptr = nil
+		C.OUR_BIO_set_data(b, nil)
 	}
 }
 
 func (b *writeBio) MakeCBIO() *C.BIO {
-	rv := C.BIO_new(C.BIO_s_writeBio())
-	rv.ptr = unsafe.Pointer(b)
+	rv := C.BIO_new(write_bio_method)
+	if rv != nil {
+		C.OUR_BIO_set_data(rv, unsafe.Pointer(b))
+	}
 	return rv
 }
 
@@ -211,10 +313,12 @@ type readBio struct {
 	buf             []byte
 	eof             bool
 	release_buffers bool
+	// locked replaces the Go BIO for connections in async mode, see async.go
+	locked *C.BIO
 }
 
 func loadReadPtr(b *C.BIO) *readBio {
-	return (*readBio)(unsafe.Pointer(b.ptr))
+	return (*readBio)(C.OUR_BIO_get_data(b))
 }
 
 //export readBioRead
@@ -305,19 +409,36 @@ func (b *readBio) ReadFromOnce(r io.Reader) (n int, err error) {
 			copy(b.buf[len(b.buf):len(b.buf)+n], dst)
 		}
 		b.buf = b.buf[:len(b.buf)+n]
+		b.pushLocked()
 	}
 	return n, err
 }
 
+// Write appends p to the buffered input.
+func (b *readBio) Write(p []byte) {
+	b.op_mtx.Lock()
+	defer b.op_mtx.Unlock()
+	b.data_mtx.Lock()
+	defer b.data_mtx.Unlock()
+	b.buf = append(b.buf, p...)
+	b.pushLocked()
+}
+
 func (b *readBio) MakeCBIO() *C.BIO {
-	rv := C.BIO_new(C.BIO_s_readBio())
-	rv.ptr = unsafe.Pointer(b)
+	rv := C.BIO_new(read_bio_method)
+	if rv != nil {
+		C.OUR_BIO_set_data(rv, unsafe.Pointer(b))
+	}
 	return rv
 }
 
 func (self *readBio) Disconnect(b *C.BIO) {
+	if self.locked == b {
+		self.locked = nil
+		return
+	}
 	if loadReadPtr(b) == self {
-		b.ptr = nil
+		C.OUR_BIO_set_data(b, nil)
 	}
 }
 
@@ -325,6 +446,7 @@ func (b *readBio) MarkEOF() {
 	b.data_mtx.Lock()
 	defer b.data_mtx.Unlock()
 	b.eof = true
+	b.markLockedEOF()
 }
 
 type anyBio C.BIO
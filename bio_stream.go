@@ -0,0 +1,218 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <stdint.h>
+#include <openssl/bio.h>
+
+extern int streamBioRead(BIO *b, char *buf, int size);
+extern int streamBioWrite(BIO *b, char *buf, int size);
+
+static long streamBioCtrl(BIO *b, int cmd, long num, void *ptr) {
+    return cmd == BIO_CTRL_FLUSH ? 1 : 0;
+}
+
+static int streamBioCreate(BIO *b) {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+    BIO_set_init(b, 1);
+#else
+    b->init = 1;
+#endif
+    return 1;
+}
+
+static int streamBioDestroy(BIO *b) {
+    return 1;
+}
+
+// only called once, under a sync.Once
+static BIO_METHOD *BIO_s_streamBio() {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+    static BIO_METHOD *m;
+    if (m == NULL) {
+        m = BIO_meth_new(BIO_TYPE_SOURCE_SINK, "Go Stream BIO");
+        if (m == NULL)
+            return NULL;
+        BIO_meth_set_read(m, streamBioRead);
+        BIO_meth_set_write(m, (int (*)(BIO *, const char *, int))streamBioWrite);
+        BIO_meth_set_ctrl(m, streamBioCtrl);
+        BIO_meth_set_create(m, streamBioCreate);
+        BIO_meth_set_destroy(m, streamBioDestroy);
+    }
+    return m;
+#else
+    static BIO_METHOD m = {
+        BIO_TYPE_SOURCE_SINK,
+        "Go Stream BIO",
+        (int (*)(BIO *, const char *, int))streamBioWrite,
+        streamBioRead,
+        NULL,
+        NULL,
+        streamBioCtrl,
+        streamBioCreate,
+        streamBioDestroy,
+        NULL};
+    return &m;
+#endif
+}
+
+// the stream's state is found by token, as C can't hold on to Go pointers
+static BIO *BIO_new_stream(BIO_METHOD *method, uintptr_t token) {
+    BIO *b = BIO_new(method);
+    if (b == NULL)
+        return NULL;
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+    BIO_set_data(b, (void *)token);
+#else
+    b->ptr = (void *)token;
+#endif
+    return b;
+}
+
+static uintptr_t BIO_get_stream_token(BIO *b) {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+    return (uintptr_t)BIO_get_data(b);
+#else
+    return (uintptr_t)b->ptr;
+#endif
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// streamBio is a BIO reading from r or writing to w as OpenSSL asks, so that
+// payloads too large to hold in memory can be passed through functions
+// taking BIOs. Unlike readBio and writeBio it never asks to retry, so the
+// call using it blocks on r or w.
+type streamBio struct {
+	bio   *C.BIO
+	token uintptr
+	r     io.Reader
+	w     io.Writer
+	// the first error from r or w, which OpenSSL only sees as a failure
+	err error
+}
+
+var (
+	stream_bio_method      *C.BIO_METHOD
+	stream_bio_method_once sync.Once
+
+	stream_bios_mtx  sync.Mutex
+	stream_bios      = map[uintptr]*streamBio{}
+	stream_bios_next uintptr
+)
+
+// newStreamBio returns a BIO reading from r or writing to w, either of which
+// may be nil. It must be freed with free.
+func newStreamBio(r io.Reader, w io.Writer) (*streamBio, error) {
+	stream_bio_method_once.Do(func() {
+		stream_bio_method = C.BIO_s_streamBio()
+	})
+	if stream_bio_method == nil {
+		return nil, errors.New("failed to allocate stream BIO method")
+	}
+	s := &streamBio{r: r, w: w}
+	stream_bios_mtx.Lock()
+	stream_bios_next++
+	s.token = stream_bios_next
+	stream_bios[s.token] = s
+	stream_bios_mtx.Unlock()
+	s.bio = C.BIO_new_stream(stream_bio_method, C.uintptr_t(s.token))
+	if s.bio == nil {
+		s.free()
+		return nil, errors.New("failed to allocate stream BIO")
+	}
+	return s, nil
+}
+
+func (s *streamBio) free() {
+	if s.bio != nil {
+		C.BIO_free(s.bio)
+		s.bio = nil
+	}
+	stream_bios_mtx.Lock()
+	delete(stream_bios, s.token)
+	stream_bios_mtx.Unlock()
+}
+
+func loadStreamBio(b *C.BIO) *streamBio {
+	stream_bios_mtx.Lock()
+	defer stream_bios_mtx.Unlock()
+	return stream_bios[uintptr(C.BIO_get_stream_token(b))]
+}
+
+//export streamBioRead
+func streamBioRead(b *C.BIO, data *C.char, size C.int) (rc C.int) {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Critf("openssl: streamBioRead panic'd: %v", err)
+			os.Exit(1)
+		}
+	}()
+	s := loadStreamBio(b)
+	if s == nil || s.r == nil || s.err != nil || size < 0 {
+		return -1
+	}
+	if size == 0 {
+		return 0
+	}
+	buf := nonCopyCString(data, size)
+	for {
+		n, err := s.r.Read(buf)
+		if err != nil && err != io.EOF {
+			s.err = err
+		}
+		if n > 0 {
+			return C.int(n)
+		}
+		switch {
+		case err == io.EOF:
+			return 0
+		case err != nil:
+			return -1
+		}
+	}
+}
+
+//export streamBioWrite
+func streamBioWrite(b *C.BIO, data *C.char, size C.int) (rc C.int) {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Critf("openssl: streamBioWrite panic'd: %v", err)
+			os.Exit(1)
+		}
+	}()
+	s := loadStreamBio(b)
+	if s == nil || s.w == nil || s.err != nil || size < 0 {
+		return -1
+	}
+	if size == 0 {
+		return 0
+	}
+	if _, err := s.w.Write(nonCopyCString(data, size)); err != nil {
+		s.err = err
+		return -1
+	}
+	return size
+}
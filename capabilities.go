@@ -0,0 +1,158 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <openssl/bio.h>
+#include <openssl/ec.h>
+#include <openssl/evp.h>
+#include <openssl/objects.h>
+#if OPENSSL_VERSION_NUMBER >= 0x30000000L
+#include <openssl/provider.h>
+#endif
+
+// the list functions write one name per line to bio
+
+#if OPENSSL_VERSION_NUMBER >= 0x30000000L
+
+static void list_name(const char *name, void *bio) {
+    // skip the dotted OIDs algorithms are also known by
+    if (name[0] < '0' || name[0] > '9')
+        BIO_printf(bio, "%s\n", name);
+}
+
+static void list_cipher(EVP_CIPHER *cipher, void *bio) {
+    EVP_CIPHER_names_do_all(cipher, list_name, bio);
+}
+
+static void list_digest(EVP_MD *md, void *bio) {
+    EVP_MD_names_do_all(md, list_name, bio);
+}
+
+static int list_provider(OSSL_PROVIDER *prov, void *bio) {
+    BIO_printf(bio, "%s\n", OSSL_PROVIDER_get0_name(prov));
+    return 1;
+}
+
+static void list_ciphers(BIO *bio) {
+    EVP_CIPHER_do_all_provided(NULL, list_cipher, bio);
+}
+
+static void list_digests(BIO *bio) {
+    EVP_MD_do_all_provided(NULL, list_digest, bio);
+}
+
+static void list_providers(BIO *bio) {
+    OSSL_PROVIDER_do_all(NULL, list_provider, bio);
+}
+
+#else
+
+// aliases are passed with a NULL cipher or digest, and listed too
+
+static void list_cipher(const EVP_CIPHER *cipher, const char *from,
+        const char *to, void *bio) {
+    BIO_printf(bio, "%s\n", from);
+}
+
+static void list_digest(const EVP_MD *md, const char *from, const char *to,
+        void *bio) {
+    BIO_printf(bio, "%s\n", from);
+}
+
+static void list_ciphers(BIO *bio) {
+    EVP_CIPHER_do_all(list_cipher, bio);
+}
+
+static void list_digests(BIO *bio) {
+    EVP_MD_do_all(list_digest, bio);
+}
+
+static void list_providers(BIO *bio) {
+}
+
+#endif
+
+static void list_curves(BIO *bio) {
+    size_t i, n = EC_get_builtin_curves(NULL, 0);
+    EC_builtin_curve *curves = OPENSSL_malloc(n * sizeof(*curves));
+    if (curves == NULL)
+        return;
+    n = EC_get_builtin_curves(curves, n);
+    for (i = 0; i < n; i++)
+        BIO_printf(bio, "%s\n", OBJ_nid2sn(curves[i].nid));
+    OPENSSL_free(curves);
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// ListCiphers returns the names of the symmetric ciphers the linked OpenSSL
+// offers, aliases included, sorted. With OpenSSL 3.0 and newer these are the ciphers the loaded
+// providers implement; some, such as the legacy ones, are only available once
+// their provider is loaded.
+func ListCiphers() ([]string, error) {
+	return listNames(func(bio *C.BIO) { C.list_ciphers(bio) })
+}
+
+// ListDigests returns the names of the message digests the linked OpenSSL
+// offers, sorted, as for ListCiphers.
+func ListDigests() ([]string, error) {
+	return listNames(func(bio *C.BIO) { C.list_digests(bio) })
+}
+
+// ListCurves returns the short names of the elliptic curves the linked
+// OpenSSL has built in, sorted, e.g. prime256v1 and secp384r1.
+func ListCurves() ([]string, error) {
+	return listNames(func(bio *C.BIO) { C.list_curves(bio) })
+}
+
+// ListProviders returns the names of the loaded providers, sorted. Providers
+// were introduced in OpenSSL 3.0, so for older versions the list is empty.
+func ListProviders() ([]string, error) {
+	return listNames(func(bio *C.BIO) { C.list_providers(bio) })
+}
+
+// listNames collects the names list writes to a BIO, one per line, sorting
+// them and dropping duplicates.
+func listNames(list func(bio *C.BIO)) ([]string, error) {
+	bio := C.BIO_new(C.BIO_s_mem())
+	if bio == nil {
+		return nil, errors.New("failed to allocate memory BIO")
+	}
+	defer C.BIO_free(bio)
+	list(bio)
+	out, err := ioutil.ReadAll(asAnyBio(bio))
+	if err != nil {
+		return nil, err
+	}
+	names := strings.Fields(string(out))
+	sort.Strings(names)
+	rv := names[:0]
+	for _, name := range names {
+		if len(rv) == 0 || name != rv[len(rv)-1] {
+			rv = append(rv, name)
+		}
+	}
+	return rv, nil
+}
@@ -0,0 +1,91 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func containsFold(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestListCapabilities(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		list func() ([]string, error)
+		want string
+	}{
+		{"ciphers", ListCiphers, "AES-128-GCM"},
+		{"digests", ListDigests, "SHA256"},
+		{"curves", ListCurves, "prime256v1"},
+	} {
+		names, err := test.list()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !containsFold(names, test.want) {
+			t.Fatalf("%s %q lack %s", test.name, names, test.want)
+		}
+		for i := 1; i < len(names); i++ {
+			if names[i-1] >= names[i] {
+				t.Fatalf("%s not sorted and unique: %q", test.name, names)
+			}
+		}
+	}
+	if _, err := GetCipherByName("AES-128-GCM"); err != nil {
+		t.Fatal(err)
+	}
+
+	providers, err := ListProviders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(providers) > 0 && !containsFold(providers, "default") {
+		t.Fatalf("providers %q lack the default provider", providers)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	version := Version()
+	if !strings.Contains(version, "SSL") {
+		t.Fatalf("unexpected version %q", version)
+	}
+	lib := LinkedLibrary()
+	if !strings.HasPrefix(version, lib.String()) {
+		t.Fatalf("version %q isn't %s's", version, lib)
+	}
+	num := VersionNumber()
+	if num < 0x00908000 {
+		t.Fatalf("unexpected version number %#x", num)
+	}
+	if lib != LibraryOpenSSL {
+		return
+	}
+	// the major version leads both
+	major := num >> 28
+	if !strings.Contains(version, fmt.Sprintf(" %d.", major)) {
+		t.Fatalf("version %q doesn't match number %#x", version, num)
+	}
+}
@@ -0,0 +1,430 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <stdlib.h>
+#include <openssl/bn.h>
+#include <openssl/err.h>
+#include <openssl/x509.h>
+#include <openssl/x509v3.h>
+
+extern ASN1_TIME *X509_get_notBefore_not_a_macro(X509 *x);
+extern ASN1_TIME *X509_get_notAfter_not_a_macro(X509 *x);
+extern const unsigned char *ASN1_STRING_get0_data_not_a_macro(
+    const ASN1_STRING *s);
+
+static ASN1_OCTET_STRING *X509_EXTENSION_get_data_not_a_macro(
+    X509_EXTENSION *ext) {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+    return X509_EXTENSION_get_data(ext);
+#else
+    return ext->value;
+#endif
+}
+*/
+import "C"
+
+import (
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"runtime"
+	"time"
+	"unsafe"
+)
+
+// CertificateInfo describes a certificate to be issued with NewCertificate.
+type CertificateInfo struct {
+	Serial *big.Int
+	// NotBefore defaults to now. NotAfter is required and must be later.
+	NotBefore    time.Time
+	NotAfter     time.Time
+	Country      string
+	Organization string
+	CommonName   string
+
+	// DNSNames, EmailAddresses, IPAddresses and URIs make up the subject
+	// alternative names, which TLS clients check hostnames against rather
+	// than CommonName.
+	DNSNames       []string
+	EmailAddresses []string
+	IPAddresses    []net.IP
+	URIs           []string
+	// KeyUsage and ExtKeyUsage restrict what the key may be used for. Their
+	// extensions are left out if they're empty.
+	KeyUsage    KeyUsage
+	ExtKeyUsage []ExtKeyUsage
+	// IsCA marks the certificate as a CA with a critical basic constraints
+	// extension. MaxPathLen, if positive, limits how many intermediate CAs
+	// may follow it in a chain; set MaxPathLenZero for none at all.
+	IsCA           bool
+	MaxPathLen     int
+	MaxPathLenZero bool
+	// SubjectKeyId identifies the certificate's key. It defaults to the
+	// SHA-1 hash of the key for CAs, and is left out otherwise. SetIssuer
+	// copies the issuer's into the authority key identifier.
+	SubjectKeyId []byte
+	// CRLDistributionPoints are the URIs of the CRLs covering the
+	// certificate.
+	CRLDistributionPoints []string
+	// ExtraExtensions are added after the others, as they are.
+	ExtraExtensions []CertificateExtension
+}
+
+// NewCertificate builds an unsigned X509v3 certificate for key described by
+// info. The certificate is self-issued until SetIssuer is called, and must be
+// signed with Sign before use.
+func NewCertificate(info *CertificateInfo, key PublicKey) (*Certificate, error) {
+	not_before := info.NotBefore
+	if not_before.IsZero() {
+		not_before = time.Now()
+	}
+	if info.NotAfter.IsZero() {
+		return nil, errors.New("certificate has no expiration time")
+	}
+	if !info.NotAfter.After(not_before) {
+		return nil, errors.New("certificate expires before it becomes valid")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	x := C.X509_new()
+	if x == nil {
+		return nil, errors.New("failed to allocate certificate")
+	}
+	c := newCertificate(x)
+
+	if C.X509_set_version(x, 2) != 1 {
+		return nil, errorFromErrorQueue()
+	}
+	if info.Serial != nil {
+		if err := setSerial(x, info.Serial); err != nil {
+			return nil, err
+		}
+	}
+	if err := setASN1Time(C.X509_get_notBefore_not_a_macro(x),
+		not_before); err != nil {
+		return nil, err
+	}
+	if err := setASN1Time(C.X509_get_notAfter_not_a_macro(x),
+		info.NotAfter); err != nil {
+		return nil, err
+	}
+
+	name := C.X509_get_subject_name(x)
+	for _, entry := range []struct{ field, value string }{
+		{"C", info.Country},
+		{"O", info.Organization},
+		{"CN", info.CommonName}} {
+		if entry.value == "" {
+			continue
+		}
+		if err := addNameEntry(name, entry.field, entry.value); err != nil {
+			return nil, err
+		}
+	}
+	if C.X509_set_issuer_name(x, name) != 1 {
+		return nil, errorFromErrorQueue()
+	}
+	pkey := key.acquirePKey()
+	if pkey == nil {
+		return nil, keyFreed
+	}
+	defer C.EVP_PKEY_free(pkey)
+	if C.X509_set_pubkey(x, pkey) != 1 {
+		return nil, errorFromErrorQueue()
+	}
+	if err := c.addInfoExtensions(info, key); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func addNameEntry(name *C.X509_NAME, field, value string) error {
+	cfield := C.CString(field)
+	defer C.free(unsafe.Pointer(cfield))
+	cvalue := C.CString(value)
+	defer C.free(unsafe.Pointer(cvalue))
+	if C.X509_NAME_add_entry_by_txt(name, cfield, C.MBSTRING_UTF8,
+		(*C.uchar)(unsafe.Pointer(cvalue)), -1, -1, 0) != 1 {
+		return fmt.Errorf("failed to add %s to name", field)
+	}
+	return nil
+}
+
+func setSerial(x *C.X509, serial *big.Int) error {
+	asn1_i, err := newASN1Integer(serial)
+	if err != nil {
+		return err
+	}
+	defer C.ASN1_INTEGER_free(asn1_i)
+	if C.X509_set_serialNumber(x, asn1_i) != 1 {
+		return errors.New("failed to set serial number")
+	}
+	return nil
+}
+
+// newASN1Integer converts serial, a certificate serial number, to an
+// ASN1_INTEGER, which the caller must free.
+func newASN1Integer(serial *big.Int) (*C.ASN1_INTEGER, error) {
+	if serial.Sign() < 0 {
+		return nil, errors.New("serial number must not be negative")
+	}
+	bytes := serial.Bytes()
+	if len(bytes) == 0 {
+		bytes = []byte{0}
+	}
+	bn := C.BN_bin2bn((*C.uchar)(&bytes[0]), C.int(len(bytes)), nil)
+	if bn == nil {
+		return nil, errors.New("failed to allocate serial number")
+	}
+	defer C.BN_free(bn)
+	asn1_i := C.BN_to_ASN1_INTEGER(bn, nil)
+	if asn1_i == nil {
+		return nil, errors.New("failed to convert serial number")
+	}
+	return asn1_i, nil
+}
+
+// asn1IntegerToBig converts a non-negative ASN1_INTEGER owned by OpenSSL,
+// such as a serial number, to a big.Int.
+func asn1IntegerToBig(i *C.ASN1_INTEGER) (*big.Int, error) {
+	bn := C.ASN1_INTEGER_to_BN(i, nil)
+	if bn == nil {
+		return nil, errors.New("failed to convert asn1 integer")
+	}
+	defer C.BN_free(bn)
+	buf := make([]byte, (int(C.BN_num_bits(bn))+7)/8+1)
+	n := C.BN_bn2bin(bn, (*C.uchar)(&buf[0]))
+	return new(big.Int).SetBytes(buf[:n]), nil
+}
+
+// SetIssuer sets the issuer name of the certificate to the subject of issuer,
+// and its authority key identifier to issuer's subject key identifier, if
+// issuer has one. Remember to sign the certificate with issuer's private key.
+func (c *Certificate) SetIssuer(issuer *Certificate) error {
+	x := c.acquireX509()
+	if x == nil {
+		return certificateFreed
+	}
+	defer C.X509_free(x)
+	issuer_x := issuer.acquireX509()
+	if issuer_x == nil {
+		return certificateFreed
+	}
+	defer C.X509_free(issuer_x)
+	if C.X509_set_issuer_name(x, C.X509_get_subject_name(issuer_x)) != 1 {
+		return errors.New("failed to set issuer name")
+	}
+	return c.setAuthorityKeyId(issuer)
+}
+
+// Sign signs the certificate with the issuer's private key using the given
+// digest, e.g. SHA256_Method. The digest is ignored for Ed25519 and Ed448
+// keys, which hash what they sign themselves. Any changes made after signing
+// require signing again.
+func (c *Certificate) Sign(key PrivateKey, digest Method) error {
+	if isEdDSAKey(key) {
+		digest = nil
+	}
+	x := c.acquireX509()
+	if x == nil {
+		return certificateFreed
+	}
+	defer C.X509_free(x)
+	pkey := key.acquirePKey()
+	if pkey == nil {
+		return keyFreed
+	}
+	defer C.EVP_PKEY_free(pkey)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.X509_sign(x, pkey, digest) <= 0 {
+		return errorFromErrorQueue()
+	}
+	return nil
+}
+
+// MatchesKey reports whether key is the private key for the certificate's
+// public key.
+func (c *Certificate) MatchesKey(key PrivateKey) (bool, error) {
+	x := c.acquireX509()
+	if x == nil {
+		return false, certificateFreed
+	}
+	defer C.X509_free(x)
+	pkey := key.acquirePKey()
+	if pkey == nil {
+		return false, keyFreed
+	}
+	defer C.EVP_PKEY_free(pkey)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.X509_check_private_key(x, pkey) != 1 {
+		// a mismatch is reported through the error queue as well
+		C.ERR_clear_error()
+		return false, nil
+	}
+	return true, nil
+}
+
+// AddExtensionDER adds an extension identified by its dotted OID string with
+// the given DER-encoded value.
+func (c *Certificate) AddExtensionDER(oid string, critical bool,
+	value []byte) error {
+	ext, err := newX509Extension(oid, critical, value)
+	if err != nil {
+		return err
+	}
+	defer C.X509_EXTENSION_free(ext)
+	x := c.acquireX509()
+	if x == nil {
+		return certificateFreed
+	}
+	defer C.X509_free(x)
+	if C.X509_add_ext(x, ext, -1) != 1 {
+		return errors.New("failed to add extension")
+	}
+	return nil
+}
+
+// newX509Extension creates an extension identified by its dotted OID string
+// with the given DER-encoded value, which the caller must free.
+func newX509Extension(oid string, critical bool, value []byte) (
+	*C.X509_EXTENSION, error) {
+	if len(value) == 0 {
+		return nil, errors.New("empty extension value")
+	}
+	coid := C.CString(oid)
+	defer C.free(unsafe.Pointer(coid))
+	obj := C.OBJ_txt2obj(coid, 1)
+	if obj == nil {
+		return nil, fmt.Errorf("invalid oid %s", oid)
+	}
+	defer C.ASN1_OBJECT_free(obj)
+	data := C.ASN1_OCTET_STRING_new()
+	if data == nil {
+		return nil, errors.New("failed to allocate extension value")
+	}
+	defer C.ASN1_OCTET_STRING_free(data)
+	if C.ASN1_OCTET_STRING_set(data, (*C.uchar)(&value[0]),
+		C.int(len(value))) != 1 {
+		return nil, errors.New("failed to set extension value")
+	}
+	var crit C.int
+	if critical {
+		crit = 1
+	}
+	ext := C.X509_EXTENSION_create_by_OBJ(nil, obj, crit, data)
+	if ext == nil {
+		return nil, errors.New("failed to create extension")
+	}
+	return ext, nil
+}
+
+// ExtensionDER returns the DER-encoded value of the extension identified by
+// the dotted OID string, or nil if the certificate doesn't carry it.
+func (c *Certificate) ExtensionDER(oid string) ([]byte, error) {
+	coid := C.CString(oid)
+	defer C.free(unsafe.Pointer(coid))
+	obj := C.OBJ_txt2obj(coid, 1)
+	if obj == nil {
+		return nil, fmt.Errorf("invalid oid %s", oid)
+	}
+	defer C.ASN1_OBJECT_free(obj)
+	x := c.acquireX509()
+	if x == nil {
+		return nil, certificateFreed
+	}
+	defer C.X509_free(x)
+	idx := C.X509_get_ext_by_OBJ(x, obj, -1)
+	if idx < 0 {
+		return nil, nil
+	}
+	data := C.X509_EXTENSION_get_data_not_a_macro(C.X509_get_ext(x, idx))
+	return C.GoBytes(unsafe.Pointer(C.ASN1_STRING_get0_data_not_a_macro(
+		(*C.ASN1_STRING)(data))),
+		C.ASN1_STRING_length((*C.ASN1_STRING)(data))), nil
+}
+
+// TLSFeature is a TLS extension number that may be listed in the TLS Feature
+// certificate extension (RFC 7633).
+type TLSFeature int
+
+const (
+	TLSFeatureStatusRequest   TLSFeature = 5
+	TLSFeatureStatusRequestV2 TLSFeature = 17
+)
+
+const tlsFeatureOid = "1.3.6.1.5.5.7.1.24"
+
+// AddTLSFeatureExtension adds the TLS Feature extension listing features, which
+// peers must see negotiated for the certificate to be accepted. Passing
+// TLSFeatureStatusRequest produces a so-called Must-Staple certificate.
+func (c *Certificate) AddTLSFeatureExtension(features ...TLSFeature) error {
+	if len(features) == 0 {
+		return errors.New("no tls features provided")
+	}
+	ints := make([]int, 0, len(features))
+	for _, feature := range features {
+		ints = append(ints, int(feature))
+	}
+	der, err := asn1.Marshal(ints)
+	if err != nil {
+		return err
+	}
+	return c.AddExtensionDER(tlsFeatureOid, false, der)
+}
+
+// TLSFeatures returns the features listed in the certificate's TLS Feature
+// extension, if any.
+func (c *Certificate) TLSFeatures() ([]TLSFeature, error) {
+	der, err := c.ExtensionDER(tlsFeatureOid)
+	if err != nil || der == nil {
+		return nil, err
+	}
+	var ints []int
+	rest, err := asn1.Unmarshal(der, &ints)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, errors.New("trailing data in tls feature extension")
+	}
+	features := make([]TLSFeature, 0, len(ints))
+	for _, i := range ints {
+		features = append(features, TLSFeature(i))
+	}
+	return features, nil
+}
+
+// MustStaple reports whether the certificate requires an OCSP staple, i.e.
+// whether its TLS Feature extension lists status_request.
+func (c *Certificate) MustStaple() (bool, error) {
+	features, err := c.TLSFeatures()
+	if err != nil {
+		return false, err
+	}
+	for _, feature := range features {
+		if feature == TLSFeatureStatusRequest {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,312 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"crypto/sha1"
+	"encoding/asn1"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	subjectKeyIdOid     = "2.5.29.14"
+	keyUsageOid         = "2.5.29.15"
+	subjectAltNameOid   = "2.5.29.17"
+	basicConstraintsOid = "2.5.29.19"
+	crlDistPointsOid    = "2.5.29.31"
+	authorityKeyIdOid   = "2.5.29.35"
+	extKeyUsageOid      = "2.5.29.37"
+)
+
+// KeyUsage is a set of the key usage bits of RFC 5280, which restrict what a
+// certificate's key may be used for.
+type KeyUsage int
+
+const (
+	KeyUsageDigitalSignature KeyUsage = 1 << iota
+	KeyUsageContentCommitment
+	KeyUsageKeyEncipherment
+	KeyUsageDataEncipherment
+	KeyUsageKeyAgreement
+	KeyUsageCertSign
+	KeyUsageCRLSign
+	KeyUsageEncipherOnly
+	KeyUsageDecipherOnly
+)
+
+// ExtKeyUsage is the dotted OID of an extended key usage, the purpose a
+// certificate may be used for. Any OID may be given, beside these.
+type ExtKeyUsage string
+
+const (
+	ExtKeyUsageServerAuth      ExtKeyUsage = "1.3.6.1.5.5.7.3.1"
+	ExtKeyUsageClientAuth      ExtKeyUsage = "1.3.6.1.5.5.7.3.2"
+	ExtKeyUsageCodeSigning     ExtKeyUsage = "1.3.6.1.5.5.7.3.3"
+	ExtKeyUsageEmailProtection ExtKeyUsage = "1.3.6.1.5.5.7.3.4"
+	ExtKeyUsageTimeStamping    ExtKeyUsage = "1.3.6.1.5.5.7.3.8"
+	ExtKeyUsageOCSPSigning     ExtKeyUsage = "1.3.6.1.5.5.7.3.9"
+)
+
+// CertificateExtension is an extension identified by its dotted OID, with a
+// DER-encoded value, as taken by AddExtensionDER.
+type CertificateExtension struct {
+	OID      string
+	Critical bool
+	Value    []byte
+}
+
+// addInfoExtensions adds the extensions info asks for to the certificate for
+// key.
+func (c *Certificate) addInfoExtensions(info *CertificateInfo,
+	key PublicKey) error {
+	if info.KeyUsage != 0 {
+		der, err := marshalKeyUsage(info.KeyUsage)
+		if err != nil {
+			return err
+		}
+		if err := c.AddExtensionDER(keyUsageOid, true, der); err != nil {
+			return err
+		}
+	}
+	if len(info.ExtKeyUsage) > 0 {
+		oids := make([]asn1.ObjectIdentifier, 0, len(info.ExtKeyUsage))
+		for _, usage := range info.ExtKeyUsage {
+			oid, err := parseOID(string(usage))
+			if err != nil {
+				return err
+			}
+			oids = append(oids, oid)
+		}
+		der, err := asn1.Marshal(oids)
+		if err != nil {
+			return err
+		}
+		if err := c.AddExtensionDER(extKeyUsageOid, false, der); err != nil {
+			return err
+		}
+	}
+	if info.IsCA {
+		der, err := marshalBasicConstraints(info.MaxPathLen,
+			info.MaxPathLenZero)
+		if err != nil {
+			return err
+		}
+		err = c.AddExtensionDER(basicConstraintsOid, true, der)
+		if err != nil {
+			return err
+		}
+	}
+	ski := info.SubjectKeyId
+	if ski == nil && info.IsCA {
+		var err error
+		ski, err = subjectKeyId(key)
+		if err != nil {
+			return err
+		}
+	}
+	if ski != nil {
+		der, err := asn1.Marshal(ski)
+		if err != nil {
+			return err
+		}
+		if err := c.AddExtensionDER(subjectKeyIdOid, false, der); err != nil {
+			return err
+		}
+	}
+	if len(info.DNSNames) > 0 || len(info.EmailAddresses) > 0 ||
+		len(info.IPAddresses) > 0 || len(info.URIs) > 0 {
+		der, err := marshalSubjectAltNames(info.DNSNames,
+			info.EmailAddresses, info.IPAddresses, info.URIs)
+		if err != nil {
+			return err
+		}
+		// critical if the subject is empty, as RFC 5280 requires
+		err = c.AddExtensionDER(subjectAltNameOid, info.Country == "" &&
+			info.Organization == "" && info.CommonName == "", der)
+		if err != nil {
+			return err
+		}
+	}
+	if len(info.CRLDistributionPoints) > 0 {
+		der, err := marshalCRLDistributionPoints(info.CRLDistributionPoints)
+		if err != nil {
+			return err
+		}
+		if err := c.AddExtensionDER(crlDistPointsOid, false, der); err != nil {
+			return err
+		}
+	}
+	for _, ext := range info.ExtraExtensions {
+		err := c.AddExtensionDER(ext.OID, ext.Critical, ext.Value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setAuthorityKeyId points the certificate at its issuer's subject key
+// identifier, if it has one, so that chains can be built by key as well as
+// by name.
+func (c *Certificate) setAuthorityKeyId(issuer *Certificate) error {
+	existing, err := c.ExtensionDER(authorityKeyIdOid)
+	if err != nil || existing != nil {
+		return err
+	}
+	der, err := marshalAuthorityKeyId(issuer)
+	if err != nil || der == nil {
+		return err
+	}
+	return c.AddExtensionDER(authorityKeyIdOid, false, der)
+}
+
+// marshalAuthorityKeyId returns an authority key identifier extension value
+// naming issuer's subject key identifier, or nil if issuer has none.
+func marshalAuthorityKeyId(issuer *Certificate) ([]byte, error) {
+	issuer_ski, err := issuer.ExtensionDER(subjectKeyIdOid)
+	if err != nil || issuer_ski == nil {
+		return nil, err
+	}
+	var key_id []byte
+	if _, err := asn1.Unmarshal(issuer_ski, &key_id); err != nil {
+		return nil, err
+	}
+	// AuthorityKeyIdentifier ::= SEQUENCE { keyIdentifier [0] IMPLICIT
+	// OCTET STRING OPTIONAL, ... }
+	return asn1.Marshal(struct {
+		KeyId []byte `asn1:"optional,tag:0"`
+	}{key_id})
+}
+
+func marshalKeyUsage(usage KeyUsage) ([]byte, error) {
+	var bits [2]byte
+	length := 0
+	for i := 0; i < 9; i++ {
+		if usage&(1<<uint(i)) != 0 {
+			// bit 0 is the most significant bit of the first byte
+			bits[i/8] |= 0x80 >> uint(i%8)
+			length = i + 1
+		}
+	}
+	return asn1.Marshal(asn1.BitString{Bytes: bits[:(length+7)/8],
+		BitLength: length})
+}
+
+func marshalBasicConstraints(max_path_len int, max_path_len_zero bool) (
+	[]byte, error) {
+	constraints := struct {
+		IsCA       bool `asn1:"optional"`
+		MaxPathLen int  `asn1:"optional,default:-1"`
+	}{IsCA: true, MaxPathLen: -1}
+	if max_path_len > 0 || max_path_len_zero {
+		constraints.MaxPathLen = max_path_len
+	}
+	return asn1.Marshal(constraints)
+}
+
+func marshalSubjectAltNames(dns_names, email_addresses []string,
+	ip_addresses []net.IP, uris []string) ([]byte, error) {
+	var names []asn1.RawValue
+	for _, name := range email_addresses {
+		names = append(names, asn1.RawValue{Class: asn1.ClassContextSpecific,
+			Tag: 1, Bytes: []byte(name)})
+	}
+	for _, name := range dns_names {
+		names = append(names, asn1.RawValue{Class: asn1.ClassContextSpecific,
+			Tag: 2, Bytes: []byte(name)})
+	}
+	for _, uri := range uris {
+		names = append(names, asn1.RawValue{Class: asn1.ClassContextSpecific,
+			Tag: 6, Bytes: []byte(uri)})
+	}
+	for _, ip := range ip_addresses {
+		raw := ip.To4()
+		if raw == nil {
+			raw = ip.To16()
+		}
+		if raw == nil {
+			return nil, fmt.Errorf("invalid IP address %v", ip)
+		}
+		names = append(names, asn1.RawValue{Class: asn1.ClassContextSpecific,
+			Tag: 7, Bytes: raw})
+	}
+	return asn1.Marshal(names)
+}
+
+func marshalCRLDistributionPoints(uris []string) ([]byte, error) {
+	// DistributionPoint ::= SEQUENCE { distributionPoint [0] { fullName
+	// [0] IMPLICIT GeneralNames } }
+	type distributionPoint struct {
+		Name asn1.RawValue
+	}
+	points := make([]distributionPoint, 0, len(uris))
+	for _, uri := range uris {
+		general_name, err := asn1.Marshal(asn1.RawValue{
+			Class: asn1.ClassContextSpecific, Tag: 6, Bytes: []byte(uri)})
+		if err != nil {
+			return nil, err
+		}
+		full_name, err := asn1.Marshal(asn1.RawValue{
+			Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true,
+			Bytes: general_name})
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, distributionPoint{asn1.RawValue{
+			Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true,
+			Bytes: full_name}})
+	}
+	return asn1.Marshal(points)
+}
+
+// subjectKeyId derives a key identifier from the SHA-1 hash of key, per
+// method 1 of RFC 5280 section 4.2.1.2.
+func subjectKeyId(key PublicKey) ([]byte, error) {
+	der, err := key.MarshalPKIXPublicKeyDER()
+	if err != nil {
+		return nil, err
+	}
+	var spki struct {
+		Algorithm asn1.RawValue
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(der, &spki); err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum(spki.PublicKey.Bytes)
+	return sum[:], nil
+}
+
+// parseOID parses a dotted OID string.
+func parseOID(oid string) (asn1.ObjectIdentifier, error) {
+	parts := strings.Split(oid, ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid oid %s", oid)
+	}
+	rv := make(asn1.ObjectIdentifier, 0, len(parts))
+	for _, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid oid %s", oid)
+		}
+		rv = append(rv, n)
+	}
+	return rv, nil
+}
@@ -0,0 +1,411 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// testCert describes a certificate for issueTestCert. The zero value is a
+// self-signed certificate for localhost, valid for an hour either side of
+// now.
+type testCert struct {
+	// Serial defaults to 42 and Name, the common name, to localhost, or
+	// Test CA for CAs.
+	Serial int64
+	Name   string
+	// Issuer and IssuerKey sign the certificate, which is self-signed if
+	// Issuer is nil.
+	Issuer    *Certificate
+	IssuerKey PrivateKey
+	// CA makes the certificate a CA, allowed to sign certificates and CRLs.
+	CA bool
+	// OCSPServer and CAIssuers are named in the authority information
+	// access extension, if set.
+	OCSPServer            string
+	CAIssuers             string
+	CRLDistributionPoints []string
+	DNSNames              []string
+	ExtKeyUsage           []ExtKeyUsage
+	// Modify, if set, is called on the certificate before it's signed.
+	Modify func(*Certificate)
+}
+
+// issueTestCert issues the certificate described by opts for key.
+func issueTestCert(t testing.TB, key PrivateKey, opts testCert) *Certificate {
+	serial, name := opts.Serial, opts.Name
+	if serial == 0 {
+		serial = 42
+	}
+	if name == "" && opts.CA {
+		name = "Test CA"
+	} else if name == "" {
+		name = "localhost"
+	}
+	info := &CertificateInfo{
+		Serial:                big.NewInt(serial),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		Country:               "US",
+		Organization:          "Test",
+		CommonName:            name,
+		DNSNames:              opts.DNSNames,
+		ExtKeyUsage:           opts.ExtKeyUsage,
+		IsCA:                  opts.CA,
+		CRLDistributionPoints: opts.CRLDistributionPoints,
+	}
+	if opts.CA {
+		info.KeyUsage = KeyUsageCertSign | KeyUsageCRLSign
+	}
+	cert, err := NewCertificate(info, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer_key := opts.IssuerKey
+	if opts.Issuer == nil {
+		issuer_key = key
+	} else if err := cert.SetIssuer(opts.Issuer); err != nil {
+		t.Fatal(err)
+	}
+	type accessDescription struct {
+		Method   asn1.ObjectIdentifier
+		Location asn1.RawValue
+	}
+	var access []accessDescription
+	if opts.OCSPServer != "" {
+		access = append(access, accessDescription{
+			Method: asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1},
+			Location: asn1.RawValue{Class: 2, Tag: 6,
+				Bytes: []byte(opts.OCSPServer)}})
+	}
+	if opts.CAIssuers != "" {
+		access = append(access, accessDescription{
+			Method: asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 2},
+			Location: asn1.RawValue{Class: 2, Tag: 6,
+				Bytes: []byte(opts.CAIssuers)}})
+	}
+	if len(access) > 0 {
+		aia, err := asn1.Marshal(access)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cert.AddExtensionDER("1.3.6.1.5.5.7.1.1", false,
+			aia); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if opts.Modify != nil {
+		opts.Modify(cert)
+	}
+	if err := cert.Sign(issuer_key, SHA256_Method); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func parseWithStdlib(t testing.TB, cert *Certificate) *x509.Certificate {
+	pem_block, err := cert.MarshalPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(pem_block)
+	std, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return std
+}
+
+func TestNewCertificate(t *testing.T) {
+	key := generateTestRSAKey(t)
+	cert := issueTestCert(t, key, testCert{})
+	std := parseWithStdlib(t, cert)
+	if std.Subject.CommonName != "localhost" || std.SerialNumber.Int64() != 42 {
+		t.Fatalf("unexpected subject %s / serial %s", std.Subject,
+			std.SerialNumber)
+	}
+	if err := std.CheckSignature(std.SignatureAlgorithm,
+		std.RawTBSCertificate, std.Signature); err != nil {
+		t.Fatal(err)
+	}
+	must_staple, err := cert.MustStaple()
+	if err != nil || must_staple {
+		t.Fatalf("unexpected must-staple %v, %v", must_staple, err)
+	}
+}
+
+func TestNewCertificateValidity(t *testing.T) {
+	key := generateTestRSAKey(t)
+	now := time.Now()
+	for _, info := range []*CertificateInfo{
+		{CommonName: "localhost"},
+		{CommonName: "localhost", NotBefore: now, NotAfter: now},
+		{CommonName: "localhost", NotAfter: now.Add(-time.Hour)},
+	} {
+		if _, err := NewCertificate(info, key); err == nil {
+			t.Fatalf("expected validity %s to %s to be refused",
+				info.NotBefore, info.NotAfter)
+		}
+	}
+}
+
+func TestCertificateExtensions(t *testing.T) {
+	ca_key := generateTestRSAKey(t)
+	ca, err := NewCertificate(&CertificateInfo{
+		Serial:         big.NewInt(1),
+		NotAfter:       time.Now().Add(time.Hour),
+		CommonName:     "Test CA",
+		KeyUsage:       KeyUsageCertSign | KeyUsageCRLSign,
+		IsCA:           true,
+		MaxPathLenZero: true,
+	}, ca_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.Sign(ca_key, SHA256_Method); err != nil {
+		t.Fatal(err)
+	}
+
+	key := generateTestRSAKey(t)
+	extra, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagNull})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := NewCertificate(&CertificateInfo{
+		Serial:         big.NewInt(2),
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		DNSNames:       []string{"www.example.com", "*.example.org"},
+		EmailAddresses: []string{"admin@example.com"},
+		IPAddresses:    []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+		URIs:           []string{"spiffe://example.com/service"},
+		KeyUsage: KeyUsageDigitalSignature |
+			KeyUsageKeyEncipherment,
+		ExtKeyUsage: []ExtKeyUsage{ExtKeyUsageServerAuth,
+			ExtKeyUsageClientAuth},
+		CRLDistributionPoints: []string{"http://crl.example.com/ca.crl"},
+		ExtraExtensions: []CertificateExtension{
+			{OID: "1.2.3.4.5", Value: extra}},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := leaf.SetIssuer(ca); err != nil {
+		t.Fatal(err)
+	}
+	if err := leaf.Sign(ca_key, SHA256_Method); err != nil {
+		t.Fatal(err)
+	}
+
+	std_ca := parseWithStdlib(t, ca)
+	if !std_ca.IsCA || !std_ca.BasicConstraintsValid ||
+		std_ca.MaxPathLen != 0 || !std_ca.MaxPathLenZero {
+		t.Fatalf("unexpected basic constraints %v/%d", std_ca.IsCA,
+			std_ca.MaxPathLen)
+	}
+	if std_ca.KeyUsage != x509.KeyUsageCertSign|x509.KeyUsageCRLSign {
+		t.Fatalf("unexpected CA key usage %b", std_ca.KeyUsage)
+	}
+	if len(std_ca.SubjectKeyId) != 20 {
+		t.Fatalf("unexpected subject key id %x", std_ca.SubjectKeyId)
+	}
+
+	std := parseWithStdlib(t, leaf)
+	if !bytes.Equal(std.AuthorityKeyId, std_ca.SubjectKeyId) {
+		t.Fatalf("expected authority key id %x, got %x",
+			std_ca.SubjectKeyId, std.AuthorityKeyId)
+	}
+	if len(std.DNSNames) != 2 || std.DNSNames[1] != "*.example.org" ||
+		len(std.EmailAddresses) != 1 || len(std.IPAddresses) != 2 ||
+		!std.IPAddresses[1].Equal(net.ParseIP("::1")) ||
+		len(std.URIs) != 1 || std.URIs[0].Host != "example.com" {
+		t.Fatalf("unexpected subject alternative names %q %q %v %v",
+			std.DNSNames, std.EmailAddresses, std.IPAddresses, std.URIs)
+	}
+	if std.KeyUsage != x509.KeyUsageDigitalSignature|
+		x509.KeyUsageKeyEncipherment || len(std.ExtKeyUsage) != 2 ||
+		std.ExtKeyUsage[1] != x509.ExtKeyUsageClientAuth {
+		t.Fatalf("unexpected key usage %b / %v", std.KeyUsage,
+			std.ExtKeyUsage)
+	}
+	if len(std.CRLDistributionPoints) != 1 ||
+		std.CRLDistributionPoints[0] != "http://crl.example.com/ca.crl" {
+		t.Fatalf("unexpected distribution points %q",
+			std.CRLDistributionPoints)
+	}
+	// the subject is empty, so the SANs must be critical
+	for _, ext := range std.Extensions {
+		if ext.Id.String() == "2.5.29.17" && !ext.Critical {
+			t.Fatal("expected critical subject alternative names")
+		}
+	}
+	if ext, err := leaf.ExtensionDER("1.2.3.4.5"); err != nil ||
+		!bytes.Equal(ext, extra) {
+		t.Fatalf("unexpected extra extension %x, %v", ext, err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(std_ca)
+	_, err = std.Verify(x509.VerifyOptions{
+		DNSName: "www.example.com",
+		Roots:   roots,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMustStaple(t *testing.T) {
+	key := generateTestRSAKey(t)
+	cert := issueTestCert(t, key, testCert{Modify: func(c *Certificate) {
+		err := c.AddTLSFeatureExtension(TLSFeatureStatusRequest)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}})
+	must_staple, err := cert.MustStaple()
+	if err != nil || !must_staple {
+		t.Fatalf("expected must-staple, got %v, %v", must_staple, err)
+	}
+
+	oid := asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24}
+	for _, ext := range parseWithStdlib(t, cert).Extensions {
+		if ext.Id.Equal(oid) {
+			if !bytes.Equal(ext.Value, []byte{0x30, 0x03, 0x02, 0x01, 0x05}) {
+				t.Fatalf("unexpected tls feature value %x", ext.Value)
+			}
+			return
+		}
+	}
+	t.Fatal("tls feature extension not found")
+}
+
+func TestPrecertificate(t *testing.T) {
+	key := generateTestRSAKey(t)
+	precert := issueTestCert(t, key, testCert{Modify: func(c *Certificate) {
+		if err := c.AddCTPoisonExtension(); err != nil {
+			t.Fatal(err)
+		}
+	}})
+	is_precert, err := precert.IsPrecertificate()
+	if err != nil || !is_precert {
+		t.Fatalf("expected a precertificate, got %v, %v", is_precert, err)
+	}
+
+	sct := &SignedCertificateTimestamp{
+		Timestamp: 1234,
+		Signature: []byte{4, 3, 0, 2, 0xaa, 0xbb}}
+	sct.LogID[0] = 0x42
+	sct_bytes, err := sct.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	final, err := precert.FinalizePrecertificate(key, SHA256_Method, sct_bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	is_precert, err = final.IsPrecertificate()
+	if err != nil || is_precert {
+		t.Fatalf("expected a final certificate, got %v, %v", is_precert, err)
+	}
+	scts, err := final.SCTList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scts) != 1 || !bytes.Equal(scts[0], sct_bytes) {
+		t.Fatalf("unexpected scts %x", scts)
+	}
+	std := parseWithStdlib(t, final)
+	if err := std.CheckSignature(std.SignatureAlgorithm,
+		std.RawTBSCertificate, std.Signature); err != nil {
+		t.Fatal(err)
+	}
+	if len(std.UnhandledCriticalExtensions) != 0 {
+		t.Fatal("final certificate still has critical extensions")
+	}
+}
+
+func TestDelegatedCredential(t *testing.T) {
+	cert_key := generateTestRSAKey(t)
+	cert := issueTestCert(t, cert_key, testCert{Modify: func(c *Certificate) {
+		if err := c.AddDelegationUsageExtension(); err != nil {
+			t.Fatal(err)
+		}
+	}})
+	dc_key := generateTestRSAKey(t)
+	_, err := NewDelegatedCredential(cert, cert_key, PSSWithSHA256, dc_key,
+		PSSWithSHA256, 2*time.Hour)
+	if err == nil {
+		t.Fatal("expected credential outliving the certificate to be refused")
+	}
+	dc, err := NewDelegatedCredential(cert, cert_key, PSSWithSHA256, dc_key,
+		PSSWithSHA256, 30*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := dc.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseDelegatedCredential(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := parsed.Verify(cert, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := parsed.Verify(cert, time.Now().Add(2*time.Hour)); err == nil {
+		t.Fatal("expected expired credential to fail verification")
+	}
+	parsed.Signature[0] ^= 1
+	if err := parsed.Verify(cert, time.Now()); err == nil {
+		t.Fatal("expected corrupted credential to fail verification")
+	}
+
+	plain := issueTestCert(t, cert_key, testCert{})
+	_, err = NewDelegatedCredential(plain, cert_key, PSSWithSHA256, dc_key,
+		PSSWithSHA256, time.Hour)
+	if err == nil {
+		t.Fatal("expected certificate without delegation usage to be refused")
+	}
+}
+
+func TestMatchesKey(t *testing.T) {
+	key := generateTestRSAKey(t)
+	cert := issueTestCert(t, key, testCert{})
+	matches, err := cert.MatchesKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !matches {
+		t.Fatal("expected the certificate to match its key")
+	}
+	matches, err = cert.MatchesKey(generateTestRSAKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matches {
+		t.Fatal("expected the certificate not to match another key")
+	}
+}
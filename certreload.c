@@ -0,0 +1,60 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include <openssl/ssl.h>
+#include "_cgo_export.h"
+
+#if OPENSSL_VERSION_NUMBER >= 0x10002000L
+
+static int cert_reload_cb(SSL *ssl, void *arg) {
+	return cert_reload_cb_thunk(SSL_get_ex_data(ssl, get_ssl_idx()), ssl);
+}
+
+int SSL_CTX_set_cert_reload_cb(SSL_CTX *ctx, int enabled) {
+	SSL_CTX_set_cert_cb(ctx, (enabled ? cert_reload_cb : NULL), NULL);
+	return 1;
+}
+
+// sets the chain of the connection's certificate, taking references of its
+// own
+int SSL_set1_cert_reload_chain(SSL *ssl, X509 **chain, int n) {
+	STACK_OF(X509) *sk;
+	int i, rv = 0;
+	// no chain falls back on the context's extra chain certificates
+	if (n == 0)
+		return SSL_set1_chain(ssl, NULL);
+	sk = sk_X509_new_null();
+	if (sk == NULL)
+		return 0;
+	for (i = 0; i < n; i++) {
+		if (sk_X509_push(sk, chain[i]) <= 0)
+			goto done;
+	}
+	rv = SSL_set1_chain(ssl, sk);
+done:
+	sk_X509_free(sk);
+	return rv;
+}
+
+#else
+
+int SSL_CTX_set_cert_reload_cb(SSL_CTX *ctx, int enabled) {
+	return -1;
+}
+
+int SSL_set1_cert_reload_chain(SSL *ssl, X509 **chain, int n) {
+	return -1;
+}
+
+#endif
@@ -0,0 +1,313 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <openssl/ssl.h>
+
+extern int SSL_CTX_set_cert_reload_cb(SSL_CTX *ctx, int enabled);
+extern int SSL_set1_cert_reload_chain(SSL *ssl, X509 **chain, int n);
+*/
+import "C"
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// CertReloader keeps the certificate and private key that contexts present
+// in line with a pair of files, so that a certificate renewed on disk, say by
+// a Let's Encrypt client, is picked up without restarting listeners. Each
+// handshake presents the credentials current when it starts; connections
+// already established keep the ones they were made with.
+//
+// A reload only takes effect if both files load and the key matches the
+// certificate, so a renewal caught halfway through, with only one file
+// rewritten, leaves the previous credentials in place until the next try.
+// Certificate reloading requires OpenSSL 1.0.2 or later.
+type CertReloader struct {
+	cert_file string
+	key_file  string
+
+	mtx   sync.Mutex
+	creds *reloadedCreds
+	// the state of the files when creds were loaded from them
+	cert_stamp fileStamp
+	key_stamp  fileStamp
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+type reloadedCreds struct {
+	cert  *Certificate
+	key   PrivateKey
+	chain []*Certificate
+}
+
+type fileStamp struct {
+	mod_time time.Time
+	size     int64
+}
+
+func statFile(path string) (fileStamp, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{mod_time: info.ModTime(), size: info.Size()}, nil
+}
+
+// NewCertReloader loads the certificate chain in cert_file, leaf first, and
+// the private key in key_file, which may be the same file. If poll_interval
+// is positive, the files are checked for changes that often and reloaded
+// when they change; otherwise they are only reloaded by Reload. Install the
+// reloader in contexts with Ctx.SetCertReloader.
+func NewCertReloader(cert_file, key_file string,
+	poll_interval time.Duration) (*CertReloader, error) {
+	r := &CertReloader{
+		cert_file: cert_file,
+		key_file:  key_file,
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{})}
+	err := r.Reload()
+	if err != nil {
+		return nil, err
+	}
+	if poll_interval > 0 {
+		go r.run(poll_interval)
+	} else {
+		close(r.stopped)
+	}
+	return r, nil
+}
+
+// Reload loads the files again and, if they check out, has subsequent
+// handshakes present the new credentials. If they don't, the error is
+// returned and the previous credentials stay in use.
+func (r *CertReloader) Reload() error {
+	cert_stamp, err := statFile(r.cert_file)
+	if err != nil {
+		return err
+	}
+	key_stamp, err := statFile(r.key_file)
+	if err != nil {
+		return err
+	}
+	creds, err := loadReloadedCreds(r.cert_file, r.key_file)
+	if err != nil {
+		return err
+	}
+	r.mtx.Lock()
+	r.creds = creds
+	r.cert_stamp = cert_stamp
+	r.key_stamp = key_stamp
+	r.mtx.Unlock()
+	return nil
+}
+
+func loadReloadedCreds(cert_file, key_file string) (*reloadedCreds, error) {
+	cert_bytes, err := ioutil.ReadFile(cert_file)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := LoadCertificateChainFromPEM(cert_bytes)
+	if err != nil {
+		return nil, err
+	}
+	key_bytes, err := ioutil.ReadFile(key_file)
+	if err != nil {
+		return nil, err
+	}
+	key, err := LoadPrivateKeyFromPEM(key_bytes)
+	if err != nil {
+		return nil, err
+	}
+	matches, err := chain[0].MatchesKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if !matches {
+		return nil, errors.New("private key does not match the certificate")
+	}
+	return &reloadedCreds{cert: chain[0], key: key, chain: chain[1:]}, nil
+}
+
+// Certificate returns the certificate currently presented.
+func (r *CertReloader) Certificate() *Certificate {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.creds.cert
+}
+
+// Close stops checking the files for changes. The credentials last loaded
+// stay in use.
+func (r *CertReloader) Close() error {
+	select {
+	case <-r.done:
+		return nil
+	default:
+	}
+	close(r.done)
+	<-r.stopped
+	return nil
+}
+
+func (r *CertReloader) run(poll_interval time.Duration) {
+	defer close(r.stopped)
+	ticker := time.NewTicker(poll_interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		}
+		if !r.changed() {
+			continue
+		}
+		err := r.Reload()
+		if err != nil {
+			logger.Errorf("openssl: failed to reload certificate from %s: %v",
+				r.cert_file, err)
+		}
+	}
+}
+
+// changed reports whether either file differs from when it was last loaded.
+func (r *CertReloader) changed() bool {
+	cert_stamp, err := statFile(r.cert_file)
+	if err != nil {
+		return false
+	}
+	key_stamp, err := statFile(r.key_file)
+	if err != nil {
+		return false
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return cert_stamp != r.cert_stamp || key_stamp != r.key_stamp
+}
+
+func (r *CertReloader) current() *reloadedCreds {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.creds
+}
+
+// SetCertReloader makes connections using the context present the
+// certificate, key and chain r has loaded last, in place of any set with
+// UseCertificate and friends. Client connections present them when the
+// server asks for a certificate. A nil r goes back to the context's own
+// certificate.
+func (c *Ctx) SetCertReloader(r *CertReloader) error {
+	c.cert_reloader = r
+	return c.updateCertCallback()
+}
+
+// updateCertCallback installs the certificate callback if there is a
+// CertReloader or a ClientCertificateCallback for it to use.
+func (c *Ctx) updateCertCallback() error {
+	var enabled C.int
+	if c.cert_reloader != nil || c.client_cert_cb != nil {
+		enabled = 1
+	}
+	if C.SSL_CTX_set_cert_reload_cb(c.ctx, enabled) < 0 {
+		c.cert_reloader, c.client_cert_cb = nil, nil
+		return errors.New("choosing certificates during the handshake " +
+			"requires OpenSSL 1.0.2 or newer")
+	}
+	return nil
+}
+
+//export cert_reload_cb_thunk
+func cert_reload_cb_thunk(p unsafe.Pointer, ssl *C.SSL) C.int {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Critf("openssl: certificate reload callback panic'd: %v",
+				err)
+			os.Exit(1)
+		}
+	}()
+	conn := (*Conn)(p)
+	if conn == nil {
+		return 1
+	}
+	// the handshake holds conn.mtx, and conn.ctx is the context picked by
+	// the server name callback, if any
+	if conn.ctx.client_cert_cb != nil && C.SSL_is_server(ssl) == 0 {
+		err := conn.selectClientCertificate(ssl)
+		if err != nil {
+			logger.Errorf("openssl: failed to select client certificate: %v",
+				err)
+			return 0
+		}
+		return 1
+	}
+	if conn.ctx.cert_reloader == nil {
+		return 1
+	}
+	err := useReloadedCreds(ssl, conn.ctx.cert_reloader.current())
+	if err != nil {
+		logger.Errorf("openssl: failed to use reloaded certificate: %v", err)
+		return 0
+	}
+	return 1
+}
+
+func useReloadedCreds(ssl *C.SSL, creds *reloadedCreds) error {
+	x := creds.cert.acquireX509()
+	if x == nil {
+		return certificateFreed
+	}
+	defer C.X509_free(x)
+	pkey := creds.key.acquirePKey()
+	if pkey == nil {
+		return keyFreed
+	}
+	defer C.EVP_PKEY_free(pkey)
+	xs := make([]*C.X509, 0, len(creds.chain))
+	defer func() {
+		for _, x := range xs {
+			C.X509_free(x)
+		}
+	}()
+	for _, cert := range creds.chain {
+		x := cert.acquireX509()
+		if x == nil {
+			return certificateFreed
+		}
+		xs = append(xs, x)
+	}
+	var xs_ptr **C.X509
+	if len(xs) > 0 {
+		xs_ptr = &xs[0]
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.SSL_use_certificate(ssl, x) != 1 ||
+		C.SSL_use_PrivateKey(ssl, pkey) != 1 ||
+		C.SSL_set1_cert_reload_chain(ssl, xs_ptr, C.int(len(xs))) != 1 {
+		return errorFromErrorQueue()
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "openssl-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert_file := filepath.Join(dir, "cert.pem")
+	key_file := filepath.Join(dir, "key.pem")
+	write := func(key PrivateKey, cert *Certificate) {
+		cert_pem, err := cert.MarshalPEM()
+		if err != nil {
+			t.Fatal(err)
+		}
+		key_pem, err := key.MarshalPKCS1PrivateKeyPEM()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(cert_file, cert_pem, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(key_file, key_pem, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old_key := generateTestRSAKey(t)
+	old_cert := issueTestCert(t, old_key, testCert{Serial: 1, Name: "old"})
+	write(old_key, old_cert)
+
+	r, err := NewCertReloader(cert_file, key_file, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	server_ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server_ctx.SetCertReloader(r); err != nil {
+		t.Skip(err)
+	}
+	client_ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handshake := func() *Conn {
+		server_conn, client_conn := NetPipe(t)
+		server, err := Server(server_conn, server_ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			server.Handshake()
+			server.Write([]byte("hi"))
+		}()
+		client, err := Client(client_conn, client_ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+	peerSerial := func(conn *Conn) string {
+		cert, err := conn.PeerCertificate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert.GetSerialNumberHex()
+	}
+	old_serial := old_cert.GetSerialNumberHex()
+
+	established := handshake()
+	defer established.Close()
+	if serial := peerSerial(established); serial != old_serial {
+		t.Fatalf("expected the old certificate, got serial %s", serial)
+	}
+
+	// a key that doesn't match the certificate is refused
+	new_key := generateTestRSAKey(t)
+	new_cert := issueTestCert(t, new_key, testCert{Serial: 2, Name: "new"})
+	new_serial := new_cert.GetSerialNumberHex()
+	write(old_key, new_cert)
+	if err := r.Reload(); err == nil {
+		t.Fatal("expected a mismatched key to fail to reload")
+	}
+	client := handshake()
+	if serial := peerSerial(client); serial != old_serial {
+		t.Fatalf("expected the old certificate to stay, got serial %s",
+			serial)
+	}
+	client.Close()
+
+	write(new_key, new_cert)
+	// make sure the change shows whatever the file system's time resolution
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(cert_file, future, future); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for r.Certificate().GetSerialNumberHex() != new_serial &&
+		time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	client = handshake()
+	if serial := peerSerial(client); serial != new_serial {
+		t.Fatalf("expected the new certificate, got serial %s", serial)
+	}
+	client.Close()
+
+	// the connection made before the reload carries on
+	buf := make([]byte, 2)
+	if _, err := established.Read(buf); err != nil || string(buf) != "hi" {
+		t.Fatalf("unexpected read %q: %v", buf, err)
+	}
+}
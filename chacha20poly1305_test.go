@@ -0,0 +1,102 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+// +build cgo
+
+package openssl
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/hex"
+	"testing"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestHChaCha20(t *testing.T) {
+	// draft-irtf-cfrg-xchacha-03, section 2.2.1
+	var key [chachaKeySize]byte
+	copy(key[:], unhex(t, "000102030405060708090a0b0c0d0e0f"+
+		"101112131415161718191a1b1c1d1e1f"))
+	subkey := hChaCha20(&key, unhex(t, "000000090000004a0000000031415927"))
+	expected := unhex(t, "82413b4227b27bfed30e42508a877d73"+
+		"a0f9e4d58a74a853c12ec41326d3ecdc")
+	if !bytes.Equal(subkey[:], expected) {
+		t.Fatalf("exp:%x got:%x", expected, subkey)
+	}
+}
+
+func TestChaCha20Poly1305(t *testing.T) {
+	// RFC 8439, section 2.8.2, and draft-irtf-cfrg-xchacha-03, section
+	// A.3.1, which share everything but the nonce
+	key := unhex(t, "808182838485868788898a8b8c8d8e8f"+
+		"909192939495969798999a9b9c9d9e9f")
+	aad := unhex(t, "50515253c0c1c2c3c4c5c6c7")
+	plaintext := []byte("Ladies and Gentlemen of the class of '99: If I " +
+		"could offer you only one tip for the future, sunscreen would be it.")
+
+	chacha, err := NewChaCha20Poly1305(key)
+	if err != nil {
+		t.Skip(err)
+	}
+	xchacha, err := NewXChaCha20Poly1305(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		aead   cipher.AEAD
+		nonce  string
+		prefix string
+		tag    string
+	}{
+		{"ChaCha20-Poly1305", chacha, "070000004041424344454647",
+			"d31a8d34648e60db7b86afbc53ef7ec2", "1ae10b594f09e26a7e902ecbd0600691"},
+		{"XChaCha20-Poly1305", xchacha,
+			"404142434445464748494a4b4c4d4e4f5051525354555657",
+			"bd6d179d3e83d43b9576579493c0e939", "c0875924c1c7987947deafd8780acf49"},
+	}
+	for _, test := range tests {
+		nonce := unhex(t, test.nonce)
+		if test.aead.NonceSize() != len(nonce) || test.aead.Overhead() != 16 {
+			t.Fatalf("%s: unexpected sizes", test.name)
+		}
+		sealed := test.aead.Seal(nil, nonce, plaintext, aad)
+		if len(sealed) != len(plaintext)+16 ||
+			!bytes.HasPrefix(sealed, unhex(t, test.prefix)) ||
+			!bytes.HasSuffix(sealed, unhex(t, test.tag)) {
+			t.Fatalf("%s: unexpected ciphertext %x", test.name, sealed)
+		}
+		opened, err := test.aead.Open(nil, nonce, sealed, aad)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(opened, plaintext) {
+			t.Fatalf("%s: open mismatch", test.name)
+		}
+		sealed[0] ^= 1
+		if _, err := test.aead.Open(nil, nonce, sealed,
+			aad); err != AuthenticationFailed {
+			t.Fatalf("%s: expected tampering to fail, got %v", test.name, err)
+		}
+	}
+}
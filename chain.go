@@ -0,0 +1,391 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <openssl/ssl.h>
+#include <openssl/err.h>
+#include <openssl/x509v3.h>
+
+extern int sk_X509_num_not_a_macro(STACK_OF(X509) *sk);
+extern X509 *sk_X509_value_not_a_macro(STACK_OF(X509)* sk, int i);
+
+static void sk_X509_pop_free_not_a_macro(STACK_OF(X509) *sk) {
+    sk_X509_pop_free(sk, X509_free);
+}
+
+// records the first missing issuer and carries on, so that the chain is
+// built as far as it goes and nothing else about it is held against it
+static int chain_verify_cb(int ok, X509_STORE_CTX *ctx) {
+    int *missing = X509_STORE_CTX_get_app_data(ctx);
+    int err;
+    if (ok)
+        return 1;
+    err = X509_STORE_CTX_get_error(ctx);
+    if (*missing == X509_V_OK && (
+            err == X509_V_ERR_UNABLE_TO_GET_ISSUER_CERT ||
+            err == X509_V_ERR_UNABLE_TO_GET_ISSUER_CERT_LOCALLY ||
+            err == X509_V_ERR_UNABLE_TO_VERIFY_LEAF_SIGNATURE))
+        *missing = err;
+    return 1;
+}
+
+// builds the chain of leaf from the certificates in pool, trusting those that
+// are self-signed as roots
+static STACK_OF(X509) *build_cert_chain(X509 *leaf, X509 **pool, int n,
+        int *missing) {
+    X509_STORE *store = X509_STORE_new();
+    STACK_OF(X509) *untrusted = sk_X509_new_null();
+    X509_STORE_CTX *ctx = X509_STORE_CTX_new();
+    STACK_OF(X509) *chain = NULL;
+    int i;
+    *missing = X509_V_OK;
+    if (store == NULL || untrusted == NULL || ctx == NULL)
+        goto done;
+    for (i = 0; i < n; i++) {
+        if (X509_check_issued(pool[i], pool[i]) == X509_V_OK) {
+            // older versions refuse duplicates, which is harmless
+            X509_STORE_add_cert(store, pool[i]);
+            ERR_clear_error();
+        } else if (sk_X509_push(untrusted, pool[i]) <= 0) {
+            goto done;
+        }
+    }
+    if (X509_STORE_CTX_init(ctx, store, leaf, untrusted) != 1)
+        goto done;
+    X509_STORE_CTX_set_verify_cb(ctx, chain_verify_cb);
+    X509_STORE_CTX_set_app_data(ctx, missing);
+    if (X509_verify_cert(ctx) == 1)
+        chain = X509_STORE_CTX_get1_chain(ctx);
+done:
+    X509_STORE_CTX_free(ctx);
+    sk_X509_free(untrusted);
+    X509_STORE_free(store);
+    return chain;
+}
+
+// returns the certificates of a certs-only PKCS#7 message, as .p7c files
+// hold, taking references to them
+static STACK_OF(X509) *d2i_PKCS7_certs(const unsigned char *der, long len) {
+    PKCS7 *p7 = d2i_PKCS7(NULL, &der, len);
+    STACK_OF(X509) *certs = NULL;
+    if (p7 == NULL)
+        return NULL;
+    if (PKCS7_type_is_signed(p7) && p7->d.sign != NULL &&
+            p7->d.sign->cert != NULL)
+        certs = X509_chain_up_ref(p7->d.sign->cert);
+    PKCS7_free(p7);
+    return certs;
+}
+
+static int X509_is_issued_by(X509 *issuer, X509 *x) {
+    return X509_check_issued(issuer, x) == X509_V_OK;
+}
+
+static long OUR_SSL_CTX_clear_extra_chain_certs(SSL_CTX *ctx) {
+    return SSL_CTX_clear_extra_chain_certs(ctx);
+}
+
+static int X509_print_issuer(BIO *bio, X509 *x) {
+    return X509_NAME_print_ex(bio, X509_get_issuer_name(x), 0,
+        XN_FLAG_RFC2253);
+}
+*/
+import "C"
+
+import (
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"runtime"
+	"strings"
+	"unsafe"
+)
+
+const (
+	authorityInfoAccessOid = "1.3.6.1.5.5.7.1.1"
+	// maxIssuerFetches bounds the issuers FetchChain downloads for a chain.
+	maxIssuerFetches = 8
+	// maxIssuerSize bounds the downloads we are willing to read.
+	maxIssuerSize = 1 << 20
+)
+
+var caIssuersMethod = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 2}
+
+// IncompleteChainError is returned by BuildChain when the pool holds no
+// issuer for the last certificate it could place in the chain.
+type IncompleteChainError struct {
+	// Chain is the chain as far as it could be built, starting with the
+	// leaf.
+	Chain []*Certificate
+	// Issuer is the missing issuer's name, in RFC 2253 form.
+	Issuer string
+}
+
+func (e *IncompleteChainError) Error() string {
+	return fmt.Sprintf("openssl: incomplete certificate chain: no "+
+		"certificate found for issuer %s", e.Issuer)
+}
+
+// BuildChain puts together the chain of leaf from pool, a set of candidate
+// intermediates and roots in any order, using OpenSSL's chain building. The
+// chain starts with leaf and ends with a self-signed root from pool.
+// Certificates in pool that aren't part of the chain are left out. Servers
+// usually leave the root out of the chain they present.
+//
+// Building stops short when no certificate in pool issued the last one
+// placed. BuildChain then returns the chain as far as it goes along with an
+// *IncompleteChainError naming the missing issuer. Only the issuer relation
+// and signatures are considered, not validity periods or usage constraints.
+func BuildChain(leaf *Certificate, pool []*Certificate) ([]*Certificate,
+	error) {
+	x := leaf.acquireX509()
+	if x == nil {
+		return nil, certificateFreed
+	}
+	defer C.X509_free(x)
+	xs := make([]*C.X509, 0, len(pool))
+	defer func() {
+		for _, x := range xs {
+			C.X509_free(x)
+		}
+	}()
+	for _, cert := range pool {
+		x := cert.acquireX509()
+		if x == nil {
+			return nil, certificateFreed
+		}
+		xs = append(xs, x)
+	}
+	var xs_ptr **C.X509
+	if len(xs) > 0 {
+		xs_ptr = &xs[0]
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	var missing C.int
+	sk := C.build_cert_chain(x, xs_ptr, C.int(len(xs)), &missing)
+	if sk == nil {
+		return nil, errorFromErrorQueue()
+	}
+	defer C.sk_X509_pop_free_not_a_macro(sk)
+	n := int(C.sk_X509_num_not_a_macro(sk))
+	if n == 0 {
+		return nil, errors.New("failed to build certificate chain")
+	}
+	chain := make([]*Certificate, 0, n)
+	for i := 0; i < n; i++ {
+		chain = append(chain, refCertificate(
+			C.sk_X509_value_not_a_macro(sk, C.int(i))))
+	}
+	if missing == C.X509_V_OK {
+		return chain, nil
+	}
+	issuer, err := issuerName(C.sk_X509_value_not_a_macro(sk, C.int(n-1)))
+	if err != nil {
+		return nil, err
+	}
+	return chain, &IncompleteChainError{Chain: chain, Issuer: issuer}
+}
+
+func issuerName(x *C.X509) (string, error) {
+	bio := C.BIO_new(C.BIO_s_mem())
+	if bio == nil {
+		return "", errors.New("failed to allocate memory BIO")
+	}
+	defer C.BIO_free(bio)
+	if C.X509_print_issuer(bio, x) < 0 {
+		return "", errors.New("failed to print issuer name")
+	}
+	name, err := ioutil.ReadAll(asAnyBio(bio))
+	return string(name), err
+}
+
+// CAIssuers returns the URLs listed as caIssuers in the certificate's
+// Authority Information Access extension, where its issuer's certificate
+// can be downloaded.
+func (c *Certificate) CAIssuers() ([]string, error) {
+	der, err := c.ExtensionDER(authorityInfoAccessOid)
+	if err != nil || der == nil {
+		return nil, err
+	}
+	var descs []struct {
+		Method   asn1.ObjectIdentifier
+		Location asn1.RawValue
+	}
+	if _, err := asn1.Unmarshal(der, &descs); err != nil {
+		return nil, err
+	}
+	var urls []string
+	for _, desc := range descs {
+		// a uniformResourceIdentifier GeneralName
+		if desc.Method.Equal(caIssuersMethod) &&
+			desc.Location.Class == asn1.ClassContextSpecific &&
+			desc.Location.Tag == 6 {
+			urls = append(urls, string(desc.Location.Bytes))
+		}
+	}
+	return urls, nil
+}
+
+// FetchChain builds the chain of leaf from pool as BuildChain does, but
+// when no certificate in pool issued the last one placed, it downloads the
+// issuer from the last one's caIssuers URLs with client, or
+// http.DefaultClient if it is nil, and tries again. It only fetches over
+// HTTP and HTTPS, and gives up with an *IncompleteChainError once the URLs
+// run out or fail, or after a few downloads. A download may hold a DER or
+// PEM certificate, or a certs-only PKCS#7 message as .p7c files do.
+func FetchChain(leaf *Certificate, pool []*Certificate,
+	client *http.Client) ([]*Certificate, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	pool = append([]*Certificate(nil), pool...)
+	fetched := make(map[string]bool)
+	for {
+		chain, err := BuildChain(leaf, pool)
+		incomplete, ok := err.(*IncompleteChainError)
+		if !ok {
+			return chain, err
+		}
+		urls, err := chain[len(chain)-1].CAIssuers()
+		if err != nil {
+			return nil, err
+		}
+		var issuers []*Certificate
+		for _, url := range urls {
+			if fetched[url] || len(fetched) >= maxIssuerFetches ||
+				!(strings.HasPrefix(url, "http://") ||
+					strings.HasPrefix(url, "https://")) {
+				continue
+			}
+			fetched[url] = true
+			issuers, err = fetchIssuers(client, url)
+			if err == nil {
+				break
+			}
+			logger.Warnf("openssl: failed to fetch issuer from %s: %v",
+				url, err)
+		}
+		if len(issuers) == 0 {
+			return chain, incomplete
+		}
+		pool = append(pool, issuers...)
+	}
+}
+
+func fetchIssuers(client *http.Client, url string) ([]*Certificate, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned %s", resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxIssuerSize))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("empty response")
+	}
+	if cert, err := LoadCertificateFromDER(data); err == nil {
+		return []*Certificate{cert}, nil
+	}
+	if cert, err := LoadCertificateFromPEM(data); err == nil {
+		return []*Certificate{cert}, nil
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	// the failed attempts above leave their errors on the queue
+	C.ERR_clear_error()
+	sk := C.d2i_PKCS7_certs((*C.uchar)(unsafe.Pointer(&data[0])),
+		C.long(len(data)))
+	if sk == nil {
+		return nil, errors.New("response holds no certificate")
+	}
+	defer C.sk_X509_pop_free_not_a_macro(sk)
+	n := int(C.sk_X509_num_not_a_macro(sk))
+	certs := make([]*Certificate, 0, n)
+	for i := 0; i < n; i++ {
+		certs = append(certs, refCertificate(
+			C.sk_X509_value_not_a_macro(sk, C.int(i))))
+	}
+	return certs, nil
+}
+
+// UseCertificateChain configures the context to present chain, starting
+// with its certificate and followed by its issuers in order, as BuildChain
+// and FetchChain return them, with key as its private key. It checks that
+// key matches the certificate and that each certificate is issued by the
+// next, and replaces any chain added with AddChainCertificate. A
+// self-signed root at the end is left out of the chain presented, as
+// clients must already have it.
+func (c *Ctx) UseCertificateChain(chain []*Certificate, key PrivateKey) error {
+	if len(chain) == 0 {
+		return errors.New("empty certificate chain")
+	}
+	matches, err := chain[0].MatchesKey(key)
+	if err != nil {
+		return err
+	}
+	if !matches {
+		return errors.New("private key does not match the certificate")
+	}
+	xs := make([]*C.X509, 0, len(chain))
+	defer func() {
+		for _, x := range xs {
+			C.X509_free(x)
+		}
+	}()
+	for _, cert := range chain {
+		x := cert.acquireX509()
+		if x == nil {
+			return certificateFreed
+		}
+		xs = append(xs, x)
+	}
+	for i := 1; i < len(xs); i++ {
+		if C.X509_is_issued_by(xs[i], xs[i-1]) != 1 {
+			return fmt.Errorf("certificate at depth %d is not issued by "+
+				"the one after it", i-1)
+		}
+	}
+	intermediates := chain[1:]
+	if n := len(xs); n > 1 && C.X509_is_issued_by(xs[n-1], xs[n-1]) == 1 {
+		intermediates = intermediates[:len(intermediates)-1]
+	}
+
+	if err := c.UseCertificate(chain[0]); err != nil {
+		return err
+	}
+	if err := c.UsePrivateKey(key); err != nil {
+		return err
+	}
+	C.OUR_SSL_CTX_clear_extra_chain_certs(c.ctx)
+	for _, cert := range intermediates {
+		if err := c.AddChainCertificate(cert); err != nil {
+			return err
+		}
+	}
+	return c.CheckPrivateKey()
+}
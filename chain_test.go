@@ -0,0 +1,199 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func checkChain(t *testing.T, chain []*Certificate, expected ...*Certificate) {
+	if len(chain) != len(expected) {
+		t.Fatalf("expected a chain of %d, got %d", len(expected), len(chain))
+	}
+	for i := range chain {
+		got, err := chain[i].MarshalDER()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := expected[i].MarshalDER()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("unexpected certificate at depth %d", i)
+		}
+	}
+}
+
+func TestBuildChain(t *testing.T) {
+	root_key := generateTestRSAKey(t)
+	root := issueTestCert(t, root_key, testCert{Serial: 1, Name: "Test Root",
+		CA: true})
+	inter_key := generateTestRSAKey(t)
+	inter := issueTestCert(t, inter_key, testCert{Serial: 2,
+		Name: "Test Intermediate", Issuer: root, IssuerKey: root_key, CA: true})
+	leaf := issueTestCert(t, generateTestRSAKey(t), testCert{Serial: 3,
+		Name: "localhost", Issuer: inter, IssuerKey: inter_key})
+	other_key := generateTestRSAKey(t)
+	other := issueTestCert(t, other_key, testCert{Serial: 4, Name: "Other Root",
+		CA: true})
+
+	chain, err := BuildChain(leaf, []*Certificate{other, root, inter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkChain(t, chain, leaf, inter, root)
+
+	chain, err = BuildChain(leaf, []*Certificate{inter, other})
+	incomplete, ok := err.(*IncompleteChainError)
+	if !ok {
+		t.Fatalf("expected an incomplete chain, got %v", err)
+	}
+	checkChain(t, chain, leaf, inter)
+	checkChain(t, incomplete.Chain, leaf, inter)
+	if !strings.Contains(incomplete.Issuer, "CN=Test Root") {
+		t.Fatalf("unexpected missing issuer %q", incomplete.Issuer)
+	}
+
+	chain, err = BuildChain(leaf, nil)
+	incomplete, ok = err.(*IncompleteChainError)
+	if !ok {
+		t.Fatalf("expected an incomplete chain, got %v", err)
+	}
+	checkChain(t, chain, leaf)
+	if !strings.Contains(incomplete.Issuer, "CN=Test Intermediate") {
+		t.Fatalf("unexpected missing issuer %q", incomplete.Issuer)
+	}
+}
+
+// marshalTestP7C wraps certs in a certs-only PKCS#7 message.
+func marshalTestP7C(t *testing.T, certs ...*Certificate) []byte {
+	var set []byte
+	for _, cert := range certs {
+		der, err := cert.MarshalDER()
+		if err != nil {
+			t.Fatal(err)
+		}
+		set = append(set, der...)
+	}
+	empty_set := asn1.RawValue{Tag: asn1.TagSet, IsCompound: true}
+	signed_data, err := asn1.Marshal(struct {
+		Version          int
+		DigestAlgorithms asn1.RawValue
+		ContentInfo      struct{ ContentType asn1.ObjectIdentifier }
+		Certificates     asn1.RawValue
+		SignerInfos      asn1.RawValue
+	}{
+		Version:          1,
+		DigestAlgorithms: empty_set,
+		ContentInfo: struct{ ContentType asn1.ObjectIdentifier }{
+			asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}},
+		Certificates: asn1.RawValue{Class: asn1.ClassContextSpecific,
+			Tag: 0, IsCompound: true, Bytes: set},
+		SignerInfos: empty_set,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := asn1.Marshal(struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue
+	}{
+		ContentType: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2},
+		Content: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0,
+			IsCompound: true, Bytes: signed_data},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestFetchChain(t *testing.T) {
+	downloads := make(map[string][]byte)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			data, ok := downloads[req.URL.Path]
+			if !ok {
+				http.NotFound(w, req)
+				return
+			}
+			w.Write(data)
+		}))
+	defer server.Close()
+
+	root_key := generateTestRSAKey(t)
+	root := issueTestCert(t, root_key, testCert{Serial: 1, Name: "Test Root",
+		CA: true})
+	inter_key := generateTestRSAKey(t)
+	inter := issueTestCert(t, inter_key, testCert{Serial: 2,
+		Name: "Test Intermediate", Issuer: root, IssuerKey: root_key, CA: true,
+		CAIssuers: server.URL + "/root.p7c"})
+	leaf_key := generateTestRSAKey(t)
+	leaf := issueTestCert(t, leaf_key, testCert{Serial: 3, Name: "localhost",
+		Issuer: inter, IssuerKey: inter_key,
+		CAIssuers: server.URL + "/inter.cer"})
+	inter_der, err := inter.MarshalDER()
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloads["/inter.cer"] = inter_der
+	downloads["/root.p7c"] = marshalTestP7C(t, root)
+
+	urls, err := leaf.CAIssuers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(urls) != 1 || urls[0] != server.URL+"/inter.cer" {
+		t.Fatalf("unexpected caIssuers URLs %v", urls)
+	}
+	chain, err := FetchChain(leaf, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkChain(t, chain, leaf, inter, root)
+
+	// without the root to download, the chain stops at the intermediate
+	delete(downloads, "/root.p7c")
+	chain, err = FetchChain(leaf, nil, nil)
+	if _, ok := err.(*IncompleteChainError); !ok {
+		t.Fatalf("expected an incomplete chain, got %v", err)
+	}
+	checkChain(t, chain, leaf, inter)
+
+	ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.UseCertificateChain([]*Certificate{leaf, root, inter},
+		leaf_key); err == nil {
+		t.Fatal("expected a misordered chain to fail")
+	}
+	if err := ctx.UseCertificateChain([]*Certificate{leaf, inter, root},
+		inter_key); err == nil {
+		t.Fatal("expected a mismatched key to fail")
+	}
+	if err := ctx.UseCertificateChain([]*Certificate{leaf, inter, root},
+		leaf_key); err != nil {
+		t.Fatal(err)
+	}
+}
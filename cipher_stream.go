@@ -0,0 +1,140 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"errors"
+	"io"
+)
+
+const cipherStreamBufferSize = 32 * 1024
+
+type encryptingWriter struct {
+	w   io.Writer
+	ctx EncryptionCipherCtx
+	err error
+}
+
+// NewEncryptingWriter returns a writer that encrypts what is written to it
+// with c as it goes, writing the ciphertext to w, so that payloads too large
+// to hold in memory can be encrypted. Close writes out the final block, with
+// its padding for block ciphers, but doesn't close w. The output is the same
+// as that of a single EncryptUpdate and EncryptFinal over the whole payload.
+func NewEncryptingWriter(w io.Writer, c *Cipher, key, iv []byte) (
+	io.WriteCloser, error) {
+	ctx, err := NewEncryptionCipherCtx(c, nil, key, iv)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptingWriter{w: w, ctx: ctx}, nil
+}
+
+func (e *encryptingWriter) Write(p []byte) (n int, err error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	for len(p) > 0 {
+		// bounds the ciphertext held in memory for large writes
+		chunk := p
+		if len(chunk) > cipherStreamBufferSize {
+			chunk = chunk[:cipherStreamBufferSize]
+		}
+		out, err := e.ctx.EncryptUpdate(chunk)
+		if err == nil {
+			_, err = e.w.Write(out)
+		}
+		if err != nil {
+			e.err = err
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+func (e *encryptingWriter) Close() error {
+	if e.err != nil {
+		return e.err
+	}
+	e.err = errors.New("openssl: cipher: writer closed")
+	out, err := e.ctx.EncryptFinal()
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(out)
+	return err
+}
+
+type decryptingReader struct {
+	r     io.Reader
+	ctx   DecryptionCipherCtx
+	buf   []byte
+	plain []byte
+	err   error
+}
+
+// NewDecryptingReader returns a reader that decrypts the output of
+// NewEncryptingWriter, or of EncryptUpdate and EncryptFinal, read from r as
+// it goes. Once r is exhausted, the final block is decrypted and checked, and
+// Read returns io.EOF, or an error if the padding is bad.
+func NewDecryptingReader(r io.Reader, c *Cipher, key, iv []byte) (io.Reader,
+	error) {
+	ctx, err := NewDecryptionCipherCtx(c, nil, key, iv)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptingReader{
+		r:   r,
+		ctx: ctx,
+		buf: make([]byte, cipherStreamBufferSize)}, nil
+}
+
+func (d *decryptingReader) Read(p []byte) (n int, err error) {
+	for len(d.plain) == 0 && d.err == nil {
+		d.fill()
+	}
+	if len(d.plain) > 0 {
+		n = copy(p, d.plain)
+		d.plain = d.plain[n:]
+		return n, nil
+	}
+	return 0, d.err
+}
+
+// fill decrypts the next read from r into plain, or finishes decryption once
+// r ends.
+func (d *decryptingReader) fill() {
+	n, err := d.r.Read(d.buf)
+	if n > 0 {
+		d.plain, d.err = d.ctx.DecryptUpdate(d.buf[:n])
+		if d.err != nil {
+			return
+		}
+	}
+	if err == io.EOF {
+		out, err := d.ctx.DecryptFinal()
+		if err != nil {
+			d.err = err
+			return
+		}
+		d.plain = append(d.plain, out...)
+		d.err = io.EOF
+	} else if err != nil {
+		d.err = err
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+// +build cgo
+
+package openssl
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+)
+
+func TestCipherStream(t *testing.T) {
+	for _, name := range []string{"aes-128-cbc", "aes-256-ctr"} {
+		c, err := GetCipherByName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := randomBytes(t, c.KeySize())
+		iv := randomBytes(t, c.IVSize())
+		for _, size := range []int{0, 1, 16, 1000, 100000} {
+			plaintext := randomBytes(t, size)
+
+			ctx, err := NewEncryptionCipherCtx(c, nil, key, iv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var expected []byte
+			if size > 0 {
+				expected, err = ctx.EncryptUpdate(plaintext)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			final, err := ctx.EncryptFinal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected = append(expected, final...)
+
+			var ciphertext bytes.Buffer
+			w, err := NewEncryptingWriter(&ciphertext, c, key, iv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// written in uneven pieces, across block boundaries
+			for rest := plaintext; len(rest) > 0; {
+				n := 7777
+				if n > len(rest) {
+					n = len(rest)
+				}
+				if _, err := w.Write(rest[:n]); err != nil {
+					t.Fatal(err)
+				}
+				rest = rest[n:]
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(ciphertext.Bytes(), expected) {
+				t.Fatalf("%s, %d bytes: streamed ciphertext differs", name,
+					size)
+			}
+
+			r, err := NewDecryptingReader(
+				iotest.OneByteReader(bytes.NewReader(expected)), c, key, iv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decrypted, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decrypted, plaintext) {
+				t.Fatalf("%s, %d bytes: decrypted plaintext differs", name,
+					size)
+			}
+		}
+	}
+}
+
+func TestCipherStreamBadPadding(t *testing.T) {
+	c, err := GetCipherByName("aes-128-cbc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := randomBytes(t, c.KeySize())
+	iv := randomBytes(t, c.IVSize())
+	var ciphertext bytes.Buffer
+	w, err := NewEncryptingWriter(&ciphertext, c, key, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("hello, world")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("more")); err == nil {
+		t.Fatal("expected an error writing after Close")
+	}
+
+	// truncated to a partial block
+	truncated := ciphertext.Bytes()[:ciphertext.Len()-1]
+	r, err := NewDecryptingReader(bytes.NewReader(truncated), c, key, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(r); err == nil || err == io.EOF {
+		t.Fatal("expected truncated ciphertext to fail to decrypt")
+	}
+}
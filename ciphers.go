@@ -153,7 +153,8 @@ func (ctx *cipherCtx) applyKeyAndIV(key, iv []byte) error {
 		iptr = (*C.uchar)(&iv[0])
 	}
 	if kptr != nil || iptr != nil {
-		if 1 != C.EVP_EncryptInit_ex(ctx.ctx, nil, nil, kptr, iptr) {
+		// -1 keeps the direction the ctx was initialized with
+		if 1 != C.EVP_CipherInit_ex(ctx.ctx, nil, nil, kptr, iptr, -1) {
 			return errors.New("failed to apply key/IV")
 		}
 	}
@@ -13,6 +13,7 @@
 // limitations under the License.
 
 // +build !darwin
+// +build cgo
 
 package openssl
 
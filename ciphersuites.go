@@ -0,0 +1,248 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <stdint.h>
+#include <stdlib.h>
+#include <openssl/ssl.h>
+
+extern int OUR_SSL_CTX_set_ciphersuites(SSL_CTX *ctx, const char *str);
+extern int OUR_SSL_CTX_set1_groups_list(SSL_CTX *ctx, char *list);
+
+static int sk_SSL_CIPHER_num_not_a_macro(STACK_OF(SSL_CIPHER) *sk) {
+    return sk_SSL_CIPHER_num(sk);
+}
+
+static const SSL_CIPHER *sk_SSL_CIPHER_value_not_a_macro(
+        STACK_OF(SSL_CIPHER) *sk, int i) {
+    return sk_SSL_CIPHER_value(sk, i);
+}
+
+static const char *OUR_SSL_CIPHER_standard_name(const SSL_CIPHER *c) {
+#if OPENSSL_VERSION_NUMBER >= 0x10101000L
+    return SSL_CIPHER_standard_name(c);
+#else
+    return NULL;
+#endif
+}
+
+static uint16_t OUR_SSL_CIPHER_get_protocol_id(const SSL_CIPHER *c) {
+#if OPENSSL_VERSION_NUMBER >= 0x10101000L
+    return SSL_CIPHER_get_protocol_id(c);
+#else
+    return SSL_CIPHER_get_id(c) & 0xffff;
+#endif
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"unsafe"
+)
+
+// CipherSuite describes a TLS cipher suite offered by the linked OpenSSL.
+type CipherSuite struct {
+	// Name is OpenSSL's name for the suite, as used in cipher lists, e.g.
+	// ECDHE-RSA-AES128-GCM-SHA256. TLS 1.3 suites go by their IANA names.
+	Name string
+	// StandardName is the IANA name, e.g.
+	// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. It is empty before OpenSSL
+	// 1.1.1.
+	StandardName string
+	// ID is the suite's two byte IANA value.
+	ID uint16
+	// Version is the protocol version the suite was introduced in, e.g.
+	// TLSv1.2.
+	Version string
+	// Bits is the strength of the suite's symmetric cipher.
+	Bits int
+	// KeyExchange, Authentication, Encryption and MAC describe the suite's
+	// parts as OpenSSL's ciphers tool does, e.g. ECDH, RSA, AESGCM(128) and
+	// AEAD. TLS 1.3 suites leave the key exchange and authentication to the
+	// handshake, so give "any" for both.
+	KeyExchange    string
+	Authentication string
+	Encryption     string
+	MAC            string
+}
+
+func newCipherSuite(cipher *C.SSL_CIPHER) CipherSuite {
+	suite := CipherSuite{
+		Name:    C.GoString(C.SSL_CIPHER_get_name(cipher)),
+		ID:      uint16(C.OUR_SSL_CIPHER_get_protocol_id(cipher)),
+		Version: C.GoString(C.SSL_CIPHER_get_version(cipher)),
+		Bits:    int(C.SSL_CIPHER_get_bits(cipher, nil))}
+	if name := C.OUR_SSL_CIPHER_standard_name(cipher); name != nil {
+		suite.StandardName = C.GoString(name)
+	}
+	// e.g. "ECDHE-RSA-AES128-GCM-SHA256 TLSv1.2 Kx=ECDH Au=RSA
+	// Enc=AESGCM(128) Mac=AEAD"
+	var buf [256]C.char
+	desc := C.SSL_CIPHER_description(cipher, &buf[0], C.int(len(buf)))
+	if desc != nil {
+		for _, field := range strings.Fields(C.GoString(desc)) {
+			switch {
+			case strings.HasPrefix(field, "Kx="):
+				suite.KeyExchange = field[3:]
+			case strings.HasPrefix(field, "Au="):
+				suite.Authentication = field[3:]
+			case strings.HasPrefix(field, "Enc="):
+				suite.Encryption = field[4:]
+			case strings.HasPrefix(field, "Mac="):
+				suite.MAC = field[4:]
+			}
+		}
+	}
+	return suite
+}
+
+// CipherSuites returns the cipher suites the context offers, in order of
+// preference. TLS 1.3 suites come first.
+func (c *Ctx) CipherSuites() []CipherSuite {
+	sk := C.SSL_CTX_get_ciphers(c.ctx)
+	if sk == nil {
+		return nil
+	}
+	n := int(C.sk_SSL_CIPHER_num_not_a_macro(sk))
+	rv := make([]CipherSuite, 0, n)
+	for i := 0; i < n; i++ {
+		rv = append(rv, newCipherSuite(
+			C.sk_SSL_CIPHER_value_not_a_macro(sk, C.int(i))))
+	}
+	return rv
+}
+
+// ParseCipherList checks a cipher list, for Ctx.SetCipherList, and a TLS 1.3
+// ciphersuites list, as for the -ciphersuites option of OpenSSL's tools,
+// against the linked library, and returns the cipher suites a context
+// configured with them would offer, in order of preference. An empty list
+// leaves the library's default in place.
+//
+// OpenSSL itself accepts lists that name unknown ciphers so long as something
+// else in them matches; ParseCipherList instead fails if any element that
+// adds ciphers matches none, so that typos are caught when the configuration
+// is loaded.
+func ParseCipherList(list, ciphersuites string) ([]CipherSuite, error) {
+	ctx, err := NewCtx()
+	if err != nil {
+		return nil, err
+	}
+	if list != "" {
+		for _, elem := range splitCipherList(list) {
+			switch elem[0] {
+			case '!', '-', '+', '@':
+				// these only remove, reorder or filter ciphers
+				continue
+			}
+			if ctx.SetCipherList(elem) != nil {
+				return nil, fmt.Errorf("cipher list element %q matches no "+
+					"cipher", elem)
+			}
+		}
+		err = ctx.SetCipherList(list)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if ciphersuites != "" {
+		err = ctx.SetCipherSuites(ciphersuites)
+		if err != nil {
+			return nil, err
+		}
+	}
+	suites := ctx.CipherSuites()
+	if ciphersuites != "" {
+	outer:
+		for _, name := range splitCipherList(ciphersuites) {
+			for _, suite := range suites {
+				if suite.Name == name {
+					continue outer
+				}
+			}
+			return nil, fmt.Errorf("unknown TLS 1.3 ciphersuite %q", name)
+		}
+	}
+	return suites, nil
+}
+
+// SetCipherSuites sets the TLS 1.3 ciphersuites the context offers, in order
+// of preference, as a colon separated list of standard names such as
+// "TLS_AES_256_GCM_SHA384:TLS_CHACHA20_POLY1305_SHA256". TLS 1.3 suites are
+// configured apart from SetCipherList, which only covers older versions. See
+// ParseCipherList to check a list before using it.
+func (c *Ctx) SetCipherSuites(ciphersuites string) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	cstr := C.CString(ciphersuites)
+	defer C.free(unsafe.Pointer(cstr))
+	switch C.OUR_SSL_CTX_set_ciphersuites(c.ctx, cstr) {
+	case 1:
+		if c.require_fips {
+			return c.checkFIPS()
+		}
+		return nil
+	case -1:
+		return errors.New("TLS 1.3 ciphersuites require OpenSSL 1.1.1 or " +
+			"newer, and are fixed in BoringSSL")
+	default:
+		return errorFromErrorQueue()
+	}
+}
+
+// splitCipherList splits a list at the separators OpenSSL accepts.
+func splitCipherList(list string) []string {
+	return strings.FieldsFunc(list, func(r rune) bool {
+		return r == ':' || r == ',' || r == ' '
+	})
+}
+
+// CurrentCipherSuite returns the cipher suite the handshake settled on.
+func (c *Conn) CurrentCipherSuite() (CipherSuite, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	cipher := C.SSL_get_current_cipher(c.ssl)
+	if cipher == nil {
+		return CipherSuite{}, errors.New("Session not established")
+	}
+	return newCipherSuite(cipher), nil
+}
+
+// SetCurvesList sets the groups, elliptic curves and, from OpenSSL 1.1.1 on,
+// finite field groups, offered for key exchange, in order of preference, as
+// a colon separated list of names such as "X25519:P-256:P-384". Servers go
+// by their own order if the context has CipherServerPreference, and by the
+// client's otherwise. Naming groups requires OpenSSL 1.0.2 or newer.
+func (c *Ctx) SetCurvesList(list string) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	cstr := C.CString(list)
+	defer C.free(unsafe.Pointer(cstr))
+	switch C.OUR_SSL_CTX_set1_groups_list(c.ctx, cstr) {
+	case 1:
+		return nil
+	case -1:
+		return errors.New("naming key exchange groups requires OpenSSL " +
+			"1.0.2 or newer")
+	default:
+		return errorFromErrorQueue()
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseCipherList(t *testing.T) {
+	suites, err := ParseCipherList(
+		"ECDHE-RSA-AES128-GCM-SHA256:AES256-SHA:!aNULL", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, suite := range suites {
+		if suite.Version != "TLSv1.3" {
+			names = append(names, suite.Name)
+		}
+	}
+	if strings.Join(names, ":") != "ECDHE-RSA-AES128-GCM-SHA256:AES256-SHA" {
+		t.Fatalf("unexpected cipher suites %q", names)
+	}
+	for _, suite := range suites {
+		if suite.Name != "ECDHE-RSA-AES128-GCM-SHA256" {
+			continue
+		}
+		if suite.ID != 0xc02f || suite.Bits != 128 {
+			t.Fatalf("unexpected suite %+v", suite)
+		}
+		if suite.StandardName != "" &&
+			suite.StandardName != "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256" {
+			t.Fatalf("unexpected standard name %q", suite.StandardName)
+		}
+		if suite.KeyExchange != "ECDH" || suite.Authentication != "RSA" ||
+			suite.Encryption != "AESGCM(128)" || suite.MAC != "AEAD" {
+			t.Fatalf("unexpected description %+v", suite)
+		}
+	}
+
+	_, err = ParseCipherList("ECDHE-RSA-AES128-GCM-SHA256:ECDHE-RSA-AES128-"+
+		"GCM-SHA265", "")
+	if err == nil || !strings.Contains(err.Error(), "GCM-SHA265") {
+		t.Fatalf("expected an error naming the typo, got %v", err)
+	}
+}
+
+func TestParseCipherListTLS13(t *testing.T) {
+	suites, err := ParseCipherList("", "TLS_AES_256_GCM_SHA384")
+	if err != nil {
+		if strings.Contains(err.Error(), "1.1.1") {
+			t.Skip(err)
+		}
+		t.Fatal(err)
+	}
+	if len(suites) == 0 || suites[0].Name != "TLS_AES_256_GCM_SHA384" ||
+		suites[0].ID != 0x1302 {
+		t.Fatalf("unexpected cipher suites %+v", suites)
+	}
+	for _, suite := range suites[1:] {
+		if suite.Version == "TLSv1.3" {
+			t.Fatalf("unexpected TLS 1.3 suite %q", suite.Name)
+		}
+	}
+
+	_, err = ParseCipherList("", "TLS_AES_256_GCM_SHA384:TLS_AES_512")
+	if err == nil {
+		t.Fatal("expected an error for an unknown ciphersuite")
+	}
+}
+
+func TestCurrentCipherSuite(t *testing.T) {
+	server_ctx := newTestServerCtx(t)
+	client_ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ctx := range []*Ctx{server_ctx, client_ctx} {
+		if err := ctx.SetCurvesList("P-256"); err != nil {
+			t.Skip(err)
+		}
+	}
+	if err := client_ctx.SetCurvesList("P-256:no-such-group"); err == nil {
+		t.Fatal("expected an error for an unknown group")
+	}
+	server_conn, client_conn := NetPipe(t)
+	defer server_conn.Close()
+	defer client_conn.Close()
+	server, err := Server(server_conn, server_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go server.Handshake()
+	client, err := Client(client_conn, client_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.CurrentCipherSuite(); err == nil {
+		t.Fatal("expected no cipher suite before the handshake")
+	}
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	suite, err := client.CurrentCipherSuite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, err := client.CurrentCipher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if suite.Name != name || suite.ID == 0 || suite.Bits == 0 ||
+		suite.Encryption == "" {
+		t.Fatalf("unexpected cipher suite %+v", suite)
+	}
+}
@@ -0,0 +1,278 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <stdlib.h>
+#include <openssl/ssl.h>
+#include <openssl/x509.h>
+
+extern int sk_X509_num_not_a_macro(STACK_OF(X509) *sk);
+extern X509 *sk_X509_value_not_a_macro(STACK_OF(X509)* sk, int i);
+
+static void sk_X509_pop_free_store_chain(STACK_OF(X509) *sk) {
+    sk_X509_pop_free(sk, X509_free);
+}
+
+static int SSL_CTX_set_client_CA_certs(SSL_CTX *ctx, X509 **certs, int n) {
+    STACK_OF(X509_NAME) *names = sk_X509_NAME_new_null();
+    X509_NAME *name;
+    int i;
+    if (names == NULL)
+        return 0;
+    for (i = 0; i < n; i++) {
+        name = X509_NAME_dup(X509_get_subject_name(certs[i]));
+        if (name == NULL || !sk_X509_NAME_push(names, name)) {
+            X509_NAME_free(name);
+            sk_X509_NAME_pop_free(names, X509_NAME_free);
+            return 0;
+        }
+    }
+    SSL_CTX_set_client_CA_list(ctx, names);
+    return 1;
+}
+
+static int SSL_CTX_load_client_CA_file(SSL_CTX *ctx, const char *file) {
+    STACK_OF(X509_NAME) *names = SSL_load_client_CA_file(file);
+    if (names == NULL)
+        return 0;
+    SSL_CTX_set_client_CA_list(ctx, names);
+    return 1;
+}
+
+static int SSL_get_client_CA_num(const SSL *ssl) {
+    STACK_OF(X509_NAME) *names = SSL_get_client_CA_list(ssl);
+    return names == NULL ? 0 : sk_X509_NAME_num(names);
+}
+
+// writes the DER of the ith name to out, if it isn't NULL, returning its
+// length
+static int SSL_get_client_CA_der(const SSL *ssl, int i, unsigned char *out) {
+    X509_NAME *name = sk_X509_NAME_value(SSL_get_client_CA_list(ssl), i);
+    return i2d_X509_NAME(name, out == NULL ? NULL : &out);
+}
+*/
+import "C"
+
+import (
+	"bytes"
+	"errors"
+	"runtime"
+	"unsafe"
+)
+
+// VerifyChainCallback decides whether a peer certificate chain that passed
+// OpenSSL's checks is acceptable, returning an error to reject it. chain
+// starts with the peer's certificate and ends with the trusted root.
+type VerifyChainCallback func(chain []*Certificate) error
+
+// SetVerifyChainCallback makes connections using the context hand the
+// verified chain of the peer's certificate to cb once OpenSSL has checked it
+// against the trusted certificates, for authorization OpenSSL doesn't know
+// about, such as checking the SPIFFE ID in the URI name of a client
+// certificate. Rejected chains fail the handshake, with Conn.VerifyResult
+// reporting ApplicationVerification. It runs after the
+// SetVerifyErrorOverride override and before any VerifyCallback, and is
+// only called when the verify mode asks for the peer's certificate. The
+// handshake holds the connection's lock while it runs. A nil cb removes it.
+func (c *Ctx) SetVerifyChainCallback(cb VerifyChainCallback) {
+	c.verify_chain_cb = cb
+	c.SetVerify(c.VerifyMode(), c.verify_cb)
+}
+
+// Chain returns the chain built so far for the certificate being verified,
+// starting with the peer's certificate. Once verification reaches depth 0
+// it runs up to the trusted root.
+func (self *CertificateStoreCtx) Chain() []*Certificate {
+	sk := C.X509_STORE_CTX_get1_chain(self.ctx)
+	if sk == nil {
+		return nil
+	}
+	defer C.sk_X509_pop_free_store_chain(sk)
+	sk_num := int(C.sk_X509_num_not_a_macro(sk))
+	rv := make([]*Certificate, 0, sk_num)
+	for i := 0; i < sk_num; i++ {
+		rv = append(rv, refCertificate(
+			C.sk_X509_value_not_a_macro(sk, C.int(i))))
+	}
+	return rv
+}
+
+// AddClientCA adds the subject of cert to the names of the certificate
+// authorities servers using the context send when they ask clients for a
+// certificate, which clients use to pick one. It doesn't make cert trusted;
+// add it to the certificate store for that.
+func (c *Ctx) AddClientCA(cert *Certificate) error {
+	x := cert.acquireX509()
+	if x == nil {
+		return certificateFreed
+	}
+	defer C.X509_free(x)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.SSL_CTX_add_client_CA(c.ctx, x) != 1 {
+		return errorFromErrorQueue()
+	}
+	return nil
+}
+
+// SetClientCAList replaces the names of the certificate authorities servers
+// using the context send when they ask clients for a certificate with the
+// subjects of certs. See AddClientCA.
+func (c *Ctx) SetClientCAList(certs []*Certificate) error {
+	xs := make([]*C.X509, 0, len(certs))
+	defer func() {
+		for _, x := range xs {
+			C.X509_free(x)
+		}
+	}()
+	for _, cert := range certs {
+		x := cert.acquireX509()
+		if x == nil {
+			return certificateFreed
+		}
+		xs = append(xs, x)
+	}
+	var xs_ptr **C.X509
+	if len(xs) > 0 {
+		xs_ptr = &xs[0]
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.SSL_CTX_set_client_CA_certs(c.ctx, xs_ptr, C.int(len(xs))) != 1 {
+		return errorFromErrorQueue()
+	}
+	return nil
+}
+
+// LoadClientCAFile is SetClientCAList with the certificates in the PEM file
+// ca_file, typically the same file given to LoadVerifyLocations.
+func (c *Ctx) LoadClientCAFile(ca_file string) error {
+	cfile := C.CString(ca_file)
+	defer C.free(unsafe.Pointer(cfile))
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.SSL_CTX_load_client_CA_file(c.ctx, cfile) != 1 {
+		return errorFromErrorQueue()
+	}
+	return nil
+}
+
+// AcceptableCAs returns the DER-encoded names of the certificate authorities
+// the server listed when it asked for a client certificate, as for
+// crypto/tls's CertificateRequestInfo. They can be parsed with
+// crypto/x509/pkix. On servers it returns those set with SetClientCAList.
+func (c *Conn) AcceptableCAs() [][]byte {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.acceptableCAs()
+}
+
+// acceptableCAs is AcceptableCAs for callers holding c.mtx.
+func (c *Conn) acceptableCAs() [][]byte {
+	num := int(C.SSL_get_client_CA_num(c.ssl))
+	rv := make([][]byte, 0, num)
+	for i := 0; i < num; i++ {
+		size := C.SSL_get_client_CA_der(c.ssl, C.int(i), nil)
+		if size <= 0 {
+			continue
+		}
+		der := make([]byte, int(size))
+		C.SSL_get_client_CA_der(c.ssl, C.int(i),
+			(*C.uchar)(unsafe.Pointer(&der[0])))
+		rv = append(rv, der)
+	}
+	return rv
+}
+
+// ClientCertificate is a certificate for a client to present, with its key
+// and the chain presented along with it.
+type ClientCertificate struct {
+	Certificate *Certificate
+	Key         PrivateKey
+	// Chain falls back on the context's chain certificates if empty.
+	Chain []*Certificate
+}
+
+// ClientCertificateCallback picks the certificate a client presents when
+// the server asks for one, given the DER-encoded names of the certificate
+// authorities the server accepts, as AcceptableCAs returns them. Returning
+// nil presents the context's certificate, if any, and an error fails the
+// handshake. The handshake holds the connection's lock while it runs.
+type ClientCertificateCallback func(
+	acceptable_cas [][]byte) (*ClientCertificate, error)
+
+// SetClientCertificateCallback makes client connections using the context
+// pick their certificate with cb once the server asks for one, e.g. from a
+// keystore holding several identities; see SelectClientCertificate. It
+// takes precedence over a CertReloader for client connections. It requires
+// OpenSSL 1.0.2 or newer. A nil cb removes it.
+func (c *Ctx) SetClientCertificateCallback(
+	cb ClientCertificateCallback) error {
+	c.client_cert_cb = cb
+	return c.updateCertCallback()
+}
+
+// selectClientCertificate uses the certificate the connection's
+// ClientCertificateCallback picks. The caller must hold c.mtx.
+func (c *Conn) selectClientCertificate(ssl *C.SSL) error {
+	identity, err := c.ctx.client_cert_cb(c.acceptableCAs())
+	if err != nil || identity == nil {
+		return err
+	}
+	if identity.Certificate == nil || identity.Key == nil {
+		return errors.New("client certificate has no certificate or key")
+	}
+	return useReloadedCreds(ssl, &reloadedCreds{
+		cert:  identity.Certificate,
+		key:   identity.Key,
+		chain: identity.Chain})
+}
+
+// SelectClientCertificate returns the first of identities that was issued,
+// directly or through its chain, by one of the certificate authorities named
+// in acceptable_cas, for picking one in a ClientCertificateCallback. As
+// servers listing no authorities accept any, it returns the first identity
+// if acceptable_cas is empty. It returns nil if none is acceptable.
+func SelectClientCertificate(identities []*ClientCertificate,
+	acceptable_cas [][]byte) *ClientCertificate {
+	for _, identity := range identities {
+		if len(acceptable_cas) == 0 || identity.issuedByAny(acceptable_cas) {
+			return identity
+		}
+	}
+	return nil
+}
+
+func (identity *ClientCertificate) issuedByAny(names [][]byte) bool {
+	certs := append([]*Certificate{identity.Certificate}, identity.Chain...)
+	for _, cert := range certs {
+		if cert == nil {
+			continue
+		}
+		x, err := ToStdlibCertificate(cert)
+		if err != nil {
+			continue
+		}
+		for _, name := range names {
+			if bytes.Equal(x.RawIssuer, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
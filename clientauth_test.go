@@ -0,0 +1,220 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestClientCertificateAuthorization(t *testing.T) {
+	root_key := generateTestRSAKey(t)
+	root := issueTestCert(t, root_key, testCert{Serial: 1, Name: "root",
+		CA: true})
+	inter_key := generateTestRSAKey(t)
+	inter := issueTestCert(t, inter_key, testCert{Serial: 2,
+		Name: "intermediate", Issuer: root, IssuerKey: root_key, CA: true})
+	client_key := generateTestRSAKey(t)
+	allowed := issueTestCert(t, client_key, testCert{Serial: 3, Name: "allowed",
+		Issuer: inter, IssuerKey: inter_key})
+	denied := issueTestCert(t, client_key, testCert{Serial: 4, Name: "denied",
+		Issuer: inter, IssuerKey: inter_key})
+
+	server_ctx := newTestServerCtx(t)
+	if err := server_ctx.GetCertificateStore().AddCertificate(root); err != nil {
+		t.Fatal(err)
+	}
+	if err := server_ctx.SetClientCAList([]*Certificate{root}); err != nil {
+		t.Fatal(err)
+	}
+	server_ctx.SetVerifyMode(VerifyPeer | VerifyFailIfNoPeerCert)
+	var chain []*Certificate
+	server_ctx.SetVerifyChainCallback(func(c []*Certificate) error {
+		chain = c
+		std, err := ToStdlibCertificate(c[0])
+		if err != nil {
+			return err
+		}
+		if std.Subject.CommonName != "allowed" {
+			return errors.New("not authorized")
+		}
+		return nil
+	})
+
+	// handshake connects with the client using cert, if any
+	handshake := func(cert *Certificate) (*Conn, *Conn, error) {
+		client_ctx, err := NewCtx()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cert != nil {
+			client_ctx = newSharedCtx(t, client_key, cert, inter)
+		}
+		server_conn, client_conn := NetPipe(t)
+		server_conn.SetDeadline(time.Now().Add(10 * time.Second))
+		client_conn.SetDeadline(time.Now().Add(10 * time.Second))
+		server, err := Server(server_conn, server_ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := Client(client_conn, client_ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		errs := make(chan error, 1)
+		go func() {
+			err := client.Handshake()
+			if err == nil {
+				// TLS 1.3 clients finish before the server checks them
+				_, err = client.Read(make([]byte, 1))
+			}
+			errs <- err
+		}()
+		err = server.Handshake()
+		if err == nil {
+			_, err = server.Write([]byte("x"))
+		}
+		if client_err := <-errs; err == nil {
+			err = client_err
+		}
+		return server, client, err
+	}
+
+	server, client, err := handshake(allowed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkChain(t, chain, allowed, inter, root)
+	root_std, err := ToStdlibCertificate(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cas := client.AcceptableCAs()
+	if len(cas) != 1 || !bytes.Equal(cas[0], root_std.RawSubject) {
+		t.Fatalf("unexpected acceptable CAs %x", cas)
+	}
+	server.Close()
+	client.Close()
+
+	server, client, err = handshake(denied)
+	if err == nil {
+		t.Fatal("expected the denied certificate to be refused")
+	}
+	if result := server.VerifyResult(); result != ApplicationVerification {
+		t.Fatalf("expected ApplicationVerification, got %d", result)
+	}
+	server.Close()
+	client.Close()
+
+	server, client, err = handshake(nil)
+	if err == nil {
+		t.Fatal("expected a client without a certificate to be refused")
+	}
+	server.Close()
+	client.Close()
+}
+
+func TestClientCertificateCallback(t *testing.T) {
+	root_a_key := generateTestRSAKey(t)
+	root_a := issueTestCert(t, root_a_key, testCert{Serial: 1, Name: "root a",
+		CA: true})
+	root_b_key := generateTestRSAKey(t)
+	root_b := issueTestCert(t, root_b_key, testCert{Serial: 2, Name: "root b",
+		CA: true})
+	client_key := generateTestRSAKey(t)
+	identities := []*ClientCertificate{
+		{Certificate: issueTestCert(t, client_key, testCert{Serial: 3,
+			Name: "a", Issuer: root_a, IssuerKey: root_a_key}),
+			Key: client_key},
+		{Certificate: issueTestCert(t, client_key, testCert{Serial: 4,
+			Name: "b", Issuer: root_b, IssuerKey: root_b_key}),
+			Key: client_key},
+	}
+
+	server_ctx := newTestServerCtx(t)
+	if err := server_ctx.GetCertificateStore().AddCertificate(root_b); err != nil {
+		t.Fatal(err)
+	}
+	if err := server_ctx.SetClientCAList([]*Certificate{root_b}); err != nil {
+		t.Fatal(err)
+	}
+	server_ctx.SetVerifyMode(VerifyPeer | VerifyFailIfNoPeerCert)
+
+	client_ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var offered [][]byte
+	err = client_ctx.SetClientCertificateCallback(
+		func(acceptable_cas [][]byte) (*ClientCertificate, error) {
+			offered = acceptable_cas
+			return SelectClientCertificate(identities, acceptable_cas), nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server_conn, client_conn := NetPipe(t)
+	server_conn.SetDeadline(time.Now().Add(10 * time.Second))
+	client_conn.SetDeadline(time.Now().Add(10 * time.Second))
+	server, err := Server(server_conn, server_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := Client(client_conn, client_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	errs := make(chan error, 1)
+	go func() {
+		err := client.Handshake()
+		if err == nil {
+			_, err = client.Read(make([]byte, 1))
+		}
+		errs <- err
+	}()
+	err = server.Handshake()
+	if err == nil {
+		_, err = server.Write([]byte("x"))
+	}
+	if client_err := <-errs; err == nil {
+		err = client_err
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(offered) != 1 {
+		t.Fatalf("expected one acceptable CA, got %d", len(offered))
+	}
+	peer, err := server.PeerCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameCertificate(t, peer, identities[1].Certificate) {
+		t.Fatal("client didn't present the certificate issued by root b")
+	}
+	if SelectClientCertificate(identities[:1], offered) != nil {
+		t.Fatal("expected no certificate issued by root b")
+	}
+	if SelectClientCertificate(identities, nil) != identities[0] {
+		t.Fatal("expected the first certificate without acceptable CAs")
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <openssl/cmac.h>
+#include <openssl/evp.h>
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"runtime"
+	"unsafe"
+)
+
+type cmacHash struct {
+	ctx *C.CMAC_CTX
+	// sum finalizes a copy of ctx, so that Sum leaves the hash running
+	sum        *C.CMAC_CTX
+	block_size int
+}
+
+// NewCMAC returns a hash.Hash computing the AES-CMAC of RFC 4493 of what is
+// written to it. The key is 16, 24 or 32 bytes long, for AES-128, AES-192 or
+// AES-256. Like other hash.Hash implementations, it is not safe for
+// concurrent use.
+func NewCMAC(key []byte) (hash.Hash, error) {
+	c, err := GetCipherByName(fmt.Sprintf("aes-%d-cbc", len(key)*8))
+	if err != nil {
+		return nil, fmt.Errorf("openssl: cmac: bad AES key size (%d bytes)",
+			len(key))
+	}
+	return NewCMACWithCipher(key, c)
+}
+
+// NewCMACWithCipher is like NewCMAC, but computes the CMAC of the block
+// cipher c, given in CBC mode, e.g. SM4-CBC or DES-EDE3-CBC.
+func NewCMACWithCipher(key []byte, c *Cipher) (hash.Hash, error) {
+	if c == nil {
+		return nil, errors.New("openssl: cmac: no cipher provided")
+	}
+	if len(key) != c.KeySize() {
+		return nil, fmt.Errorf("openssl: cmac: bad key size (%d bytes "+
+			"instead of %d)", len(key), c.KeySize())
+	}
+	h := &cmacHash{
+		ctx:        C.CMAC_CTX_new(),
+		sum:        C.CMAC_CTX_new(),
+		block_size: c.BlockSize(),
+	}
+	runtime.SetFinalizer(h, func(h *cmacHash) {
+		if h.ctx != nil {
+			C.CMAC_CTX_free(h.ctx)
+		}
+		if h.sum != nil {
+			C.CMAC_CTX_free(h.sum)
+		}
+	})
+	if h.ctx == nil || h.sum == nil {
+		return nil, errors.New("openssl: cmac: cannot allocate ctx")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.CMAC_Init(h.ctx, unsafe.Pointer(&key[0]), C.size_t(len(key)), c.ptr,
+		nil) != 1 {
+		return nil, errorFromErrorQueue()
+	}
+	return h, nil
+}
+
+func (h *cmacHash) Write(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	defer runtime.KeepAlive(h)
+	if C.CMAC_Update(h.ctx, unsafe.Pointer(&p[0]), C.size_t(len(p))) != 1 {
+		return 0, errors.New("openssl: cmac: cannot update ctx")
+	}
+	return len(p), nil
+}
+
+func (h *cmacHash) Sum(b []byte) []byte {
+	defer runtime.KeepAlive(h)
+	if C.CMAC_CTX_copy(h.sum, h.ctx) != 1 {
+		panic("openssl: cmac: cannot copy ctx")
+	}
+	var result [C.EVP_MAX_BLOCK_LENGTH]byte
+	var length C.size_t
+	if C.CMAC_Final(h.sum, (*C.uchar)(unsafe.Pointer(&result[0])),
+		&length) != 1 {
+		panic("openssl: cmac: cannot finalize ctx")
+	}
+	return append(b, result[:length]...)
+}
+
+func (h *cmacHash) Reset() {
+	defer runtime.KeepAlive(h)
+	// keeps the key and cipher
+	if C.CMAC_Init(h.ctx, nil, 0, nil, nil) != 1 {
+		panic("openssl: cmac: cannot reset ctx")
+	}
+}
+
+// Size is the block size, as the whole final block is the MAC.
+func (h *cmacHash) Size() int { return h.block_size }
+
+func (h *cmacHash) BlockSize() int { return h.block_size }
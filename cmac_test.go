@@ -0,0 +1,60 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestCMAC(t *testing.T) {
+	// RFC 4493 section 4
+	key, _ := hex.DecodeString("2b7e151628aed2a6abf7158809cf4f3c")
+	message, _ := hex.DecodeString("6bc1bee22e409f96e93d7e117393172a" +
+		"ae2d8a571e03ac9c9eb76fac45af8e5130c81c46a35ce411")
+	vectors := []struct {
+		length   int
+		expected string
+	}{
+		{0, "bb1d6929e95937287fa37d129b756746"},
+		{16, "070a16b46b4d4144f79bdd9dd04a287c"},
+		{40, "dfa66747de9ae63030ca32611497c827"},
+	}
+	mac, err := NewCMAC(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mac.Size() != 16 || mac.BlockSize() != 16 {
+		t.Fatalf("expected sizes 16/16, got %d/%d", mac.Size(),
+			mac.BlockSize())
+	}
+	for _, v := range vectors {
+		mac.Reset()
+		mac.Write(message[:v.length/2])
+		mac.Write(message[v.length/2 : v.length])
+		// summed twice to check Sum leaves the hash running
+		for i := 0; i < 2; i++ {
+			if sum := hex.EncodeToString(mac.Sum(nil)); sum != v.expected {
+				t.Fatalf("%d bytes: expected %s, got %s", v.length,
+					v.expected, sum)
+			}
+		}
+	}
+	if _, err := NewCMAC(key[:10]); err == nil {
+		t.Fatal("expected an error for a bad key size")
+	}
+}
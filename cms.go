@@ -0,0 +1,497 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <openssl/cms.h>
+#include <openssl/err.h>
+
+extern int sk_X509_num_not_a_macro(STACK_OF(X509) *sk);
+extern X509 *sk_X509_value_not_a_macro(STACK_OF(X509)* sk, int i);
+
+static STACK_OF(X509) *OUR_sk_X509_new_from(X509 **pool, int n) {
+    STACK_OF(X509) *sk = sk_X509_new_null();
+    int i;
+    if (sk == NULL)
+        return NULL;
+    for (i = 0; i < n; i++) {
+        if (sk_X509_push(sk, pool[i]) <= 0) {
+            sk_X509_free(sk);
+            return NULL;
+        }
+    }
+    return sk;
+}
+
+static void sk_X509_free_cms(STACK_OF(X509) *sk) {
+    sk_X509_free(sk);
+}
+
+// with CMS_STREAM, in is only read as out is written, for the structure
+// returned by CMS_sign or CMS_encrypt is left for the content to be
+// streamed through
+static int OUR_CMS_write(BIO *out, CMS_ContentInfo *cms, BIO *in,
+        unsigned int flags) {
+    if (flags & CMS_STREAM)
+        return i2d_CMS_bio_stream(out, cms, in, flags);
+    return i2d_CMS_bio(out, cms);
+}
+
+static int OUR_CMS_sign(BIO *out, BIO *in, X509 *signer, EVP_PKEY *key,
+        X509 **pool, int n, unsigned int flags) {
+    STACK_OF(X509) *certs = OUR_sk_X509_new_from(pool, n);
+    CMS_ContentInfo *cms = NULL;
+    int rv = 0;
+    if (certs == NULL)
+        return 0;
+    cms = CMS_sign(signer, key, certs, in, flags);
+    if (cms != NULL)
+        rv = OUR_CMS_write(out, cms, in, flags);
+    CMS_ContentInfo_free(cms);
+    sk_X509_free(certs);
+    return rv;
+}
+
+static int OUR_CMS_encrypt(BIO *out, BIO *in, X509 **pool, int n,
+        const EVP_CIPHER *cipher, unsigned int flags) {
+    STACK_OF(X509) *certs = OUR_sk_X509_new_from(pool, n);
+    CMS_ContentInfo *cms = NULL;
+    int rv = 0;
+    if (certs == NULL)
+        return 0;
+    cms = CMS_encrypt(certs, in, cipher, flags);
+    if (cms != NULL)
+        rv = OUR_CMS_write(out, cms, in, flags);
+    CMS_ContentInfo_free(cms);
+    sk_X509_free(certs);
+    return rv;
+}
+
+// on success, signers holds the certificates that signed, which stay cms's
+static int OUR_CMS_verify(CMS_ContentInfo *cms, X509_STORE *store,
+        X509 **pool, int n, BIO *content, BIO *out, unsigned int flags,
+        STACK_OF(X509) **signers) {
+    STACK_OF(X509) *certs = OUR_sk_X509_new_from(pool, n);
+    int rv = 0;
+    *signers = NULL;
+    if (certs == NULL)
+        return 0;
+    rv = CMS_verify(cms, certs, store, content, out, flags);
+    if (rv == 1) {
+        *signers = CMS_get0_signers(cms);
+        if (*signers == NULL)
+            rv = 0;
+    }
+    sk_X509_free(certs);
+    return rv;
+}
+
+static CMS_ContentInfo *OUR_d2i_CMS(const unsigned char *der, long len) {
+    return d2i_CMS_ContentInfo(NULL, &der, len);
+}
+*/
+import "C"
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"unsafe"
+)
+
+// CMSFlags change how CMS messages are signed and verified.
+type CMSFlags int
+
+const (
+	// CMSDetached leaves the content out of signed messages, to be passed
+	// along with them to verify them.
+	CMSDetached CMSFlags = C.CMS_DETACHED
+	// CMSNoCerts leaves the signer's certificate out of signed messages,
+	// so that it must be among those passed to verify them. The chain is
+	// still included.
+	CMSNoCerts CMSFlags = C.CMS_NOCERTS
+	// CMSNoSignerCertVerify checks only the signatures of messages, without
+	// verifying the signers' certificates, for which no store is needed.
+	CMSNoSignerCertVerify CMSFlags = C.CMS_NO_SIGNER_CERT_VERIFY
+)
+
+// content is always treated as binary, as OpenSSL would otherwise convert
+// line endings as S/MIME does for text
+const cmsBinary = C.CMS_BINARY
+
+type x509Array []*C.X509
+
+func acquireX509Array(certs []*Certificate) (x509Array, error) {
+	xs := make(x509Array, 0, len(certs))
+	for _, cert := range certs {
+		x := cert.acquireX509()
+		if x == nil {
+			xs.free()
+			return nil, certificateFreed
+		}
+		xs = append(xs, x)
+	}
+	return xs, nil
+}
+
+func (xs x509Array) ptr() **C.X509 {
+	if len(xs) == 0 {
+		return nil
+	}
+	return &xs[0]
+}
+
+func (xs x509Array) free() {
+	for _, x := range xs {
+		C.X509_free(x)
+	}
+}
+
+// newMemBio returns a read-only BIO on data, which must outlive it.
+func newMemBio(data []byte) (*C.BIO, error) {
+	var bio *C.BIO
+	if len(data) == 0 {
+		bio = C.BIO_new(C.BIO_s_mem())
+	} else {
+		bio = C.BIO_new_mem_buf(unsafe.Pointer(&data[0]), C.int(len(data)))
+	}
+	if bio == nil {
+		return nil, errors.New("failed to allocate memory BIO")
+	}
+	return bio, nil
+}
+
+// streamError returns the error of whichever of streams failed, if any.
+// OpenSSL doesn't always fail when a stream does: content is copied until a
+// read fails as though it had ended.
+func streamError(streams ...*streamBio) error {
+	for _, s := range streams {
+		if s != nil && s.err != nil {
+			C.ERR_clear_error()
+			return s.err
+		}
+	}
+	return nil
+}
+
+// cmsError returns the error of a failed call, that of a stream if one
+// failed, as the error queue then only holds its symptoms.
+func cmsError(streams ...*streamBio) error {
+	if err := streamError(streams...); err != nil {
+		return err
+	}
+	return errorFromErrorQueue()
+}
+
+// CMSSign signs data with key, the private key of signer, returning the
+// DER-encoded CMS SignedData message. chain holds the certificates from the
+// signer's issuer up, to include for verifying it. Messages are signed with
+// the default digest for the key, which is SHA-256 for RSA and EC keys.
+func CMSSign(data []byte, signer *Certificate, key PrivateKey,
+	chain []*Certificate, flags CMSFlags) ([]byte, error) {
+	in, err := newMemBio(data)
+	if err != nil {
+		return nil, err
+	}
+	defer C.BIO_free(in)
+	out := C.BIO_new(C.BIO_s_mem())
+	if out == nil {
+		return nil, errors.New("failed to allocate memory BIO")
+	}
+	defer C.BIO_free(out)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	err = cmsSign(out, in, signer, key, chain, C.uint(flags)|cmsBinary)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(asAnyBio(out))
+}
+
+// CMSSignStream signs the content read from r as CMSSign does, writing the
+// message to w as it goes, so that payloads too large to hold in memory can
+// be signed. The message is BER-encoded, with indefinite lengths, rather
+// than DER-encoded.
+func CMSSignStream(w io.Writer, r io.Reader, signer *Certificate,
+	key PrivateKey, chain []*Certificate, flags CMSFlags) error {
+	in, err := newStreamBio(r, nil)
+	if err != nil {
+		return err
+	}
+	defer in.free()
+	out, err := newStreamBio(nil, w)
+	if err != nil {
+		return err
+	}
+	defer out.free()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	return cmsSign(out.bio, in.bio, signer, key, chain,
+		C.uint(flags)|cmsBinary|C.CMS_STREAM, in, out)
+}
+
+// cmsSign, like the other helpers, fails with the error of any of streams
+// that failed.
+func cmsSign(out, in *C.BIO, signer *Certificate, key PrivateKey,
+	chain []*Certificate, flags C.uint, streams ...*streamBio) error {
+	signer_x := signer.acquireX509()
+	if signer_x == nil {
+		return certificateFreed
+	}
+	defer C.X509_free(signer_x)
+	pkey := key.acquirePKey()
+	if pkey == nil {
+		return keyFreed
+	}
+	defer C.EVP_PKEY_free(pkey)
+	xs, err := acquireX509Array(chain)
+	if err != nil {
+		return err
+	}
+	defer xs.free()
+	if C.OUR_CMS_sign(out, in, signer_x, pkey, xs.ptr(), C.int(len(xs)),
+		flags) != 1 {
+		return cmsError(streams...)
+	}
+	return streamError(streams...)
+}
+
+// CMSVerify verifies sig, a DER or BER-encoded CMS SignedData message, with
+// content as its content if it is detached, and returns the content and the
+// certificates that signed it. The signers' certificates are verified
+// against store, with intermediates, as well as any certificates in the
+// message, as untrusted candidates for building their chains. They are
+// checked for S/MIME signing, unless the store's purpose says otherwise.
+func CMSVerify(sig, content []byte, store *CertificateStore,
+	intermediates []*Certificate, flags CMSFlags) ([]byte,
+	[]*Certificate, error) {
+	var in *C.BIO
+	if content != nil {
+		var err error
+		in, err = newMemBio(content)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer C.BIO_free(in)
+	}
+	out := C.BIO_new(C.BIO_s_mem())
+	if out == nil {
+		return nil, nil, errors.New("failed to allocate memory BIO")
+	}
+	defer C.BIO_free(out)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	signers, err := cmsVerify(sig, in, out, store, intermediates, flags)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := ioutil.ReadAll(asAnyBio(out))
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, signers, nil
+}
+
+// CMSVerifyStream verifies sig as CMSVerify does, reading detached content
+// from content as it goes, so that payloads too large to hold in memory can
+// be verified. The content is written to w, if it isn't nil, as it is
+// verified, and must not be trusted unless verification succeeds.
+func CMSVerifyStream(w io.Writer, sig []byte, content io.Reader,
+	store *CertificateStore, intermediates []*Certificate,
+	flags CMSFlags) ([]*Certificate, error) {
+	var in, out *streamBio
+	var in_bio, out_bio *C.BIO
+	var err error
+	if content != nil {
+		in, err = newStreamBio(content, nil)
+		if err != nil {
+			return nil, err
+		}
+		defer in.free()
+		in_bio = in.bio
+	}
+	if w != nil {
+		out, err = newStreamBio(nil, w)
+		if err != nil {
+			return nil, err
+		}
+		defer out.free()
+		out_bio = out.bio
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	return cmsVerify(sig, in_bio, out_bio, store, intermediates, flags, in,
+		out)
+}
+
+func cmsVerify(sig []byte, in, out *C.BIO, store *CertificateStore,
+	intermediates []*Certificate, flags CMSFlags,
+	streams ...*streamBio) ([]*Certificate, error) {
+	defer runtime.KeepAlive(store)
+	if len(sig) == 0 {
+		return nil, errors.New("empty CMS message")
+	}
+	xs, err := acquireX509Array(intermediates)
+	if err != nil {
+		return nil, err
+	}
+	defer xs.free()
+	var c_store *C.X509_STORE
+	if store != nil {
+		c_store = store.store
+	}
+	cms := C.OUR_d2i_CMS((*C.uchar)(unsafe.Pointer(&sig[0])),
+		C.long(len(sig)))
+	if cms == nil {
+		return nil, errorFromErrorQueue()
+	}
+	defer C.CMS_ContentInfo_free(cms)
+	var sk *C.struct_stack_st_X509
+	if C.OUR_CMS_verify(cms, c_store, xs.ptr(), C.int(len(xs)), in, out,
+		C.uint(flags)|cmsBinary, &sk) != 1 {
+		return nil, cmsError(streams...)
+	}
+	defer C.sk_X509_free_cms(sk)
+	if err := streamError(streams...); err != nil {
+		return nil, err
+	}
+	n := int(C.sk_X509_num_not_a_macro(sk))
+	signers := make([]*Certificate, 0, n)
+	for i := 0; i < n; i++ {
+		signers = append(signers, refCertificate(
+			C.sk_X509_value_not_a_macro(sk, C.int(i))))
+	}
+	return signers, nil
+}
+
+// CMSEncrypt encrypts data with cipher, e.g. the one named "aes-256-cbc",
+// for each of recipients, returning the DER-encoded CMS EnvelopedData
+// message. Any recipient can decrypt it with their private key.
+func CMSEncrypt(data []byte, recipients []*Certificate,
+	cipher *Cipher) ([]byte, error) {
+	in, err := newMemBio(data)
+	if err != nil {
+		return nil, err
+	}
+	defer C.BIO_free(in)
+	out := C.BIO_new(C.BIO_s_mem())
+	if out == nil {
+		return nil, errors.New("failed to allocate memory BIO")
+	}
+	defer C.BIO_free(out)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := cmsEncrypt(out, in, recipients, cipher, cmsBinary); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(asAnyBio(out))
+}
+
+// CMSEncryptStream encrypts the content read from r as CMSEncrypt does,
+// writing the message to w as it goes, so that payloads too large to hold
+// in memory can be encrypted. The message is BER-encoded, with indefinite
+// lengths, rather than DER-encoded.
+func CMSEncryptStream(w io.Writer, r io.Reader, recipients []*Certificate,
+	cipher *Cipher) error {
+	in, err := newStreamBio(r, nil)
+	if err != nil {
+		return err
+	}
+	defer in.free()
+	out, err := newStreamBio(nil, w)
+	if err != nil {
+		return err
+	}
+	defer out.free()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	return cmsEncrypt(out.bio, in.bio, recipients, cipher,
+		cmsBinary|C.CMS_STREAM, in, out)
+}
+
+func cmsEncrypt(out, in *C.BIO, recipients []*Certificate, cipher *Cipher,
+	flags C.uint, streams ...*streamBio) error {
+	if cipher == nil {
+		return errors.New("no cipher given")
+	}
+	if len(recipients) == 0 {
+		return errors.New("no recipients given")
+	}
+	xs, err := acquireX509Array(recipients)
+	if err != nil {
+		return err
+	}
+	defer xs.free()
+	if C.OUR_CMS_encrypt(out, in, xs.ptr(), C.int(len(xs)), cipher.ptr,
+		flags) != 1 {
+		return cmsError(streams...)
+	}
+	return streamError(streams...)
+}
+
+// CMSDecrypt decrypts msg, a DER or BER-encoded CMS EnvelopedData message,
+// with key, the private key of cert, which picks the recipient to decrypt
+// as. If cert is nil, each recipient the key could be for is tried.
+func CMSDecrypt(msg []byte, cert *Certificate, key PrivateKey) ([]byte,
+	error) {
+	var buf bytes.Buffer
+	if err := CMSDecryptStream(&buf, msg, cert, key); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// CMSDecryptStream decrypts msg as CMSDecrypt does, writing the content to w
+// as it goes.
+func CMSDecryptStream(w io.Writer, msg []byte, cert *Certificate,
+	key PrivateKey) error {
+	if len(msg) == 0 {
+		return errors.New("empty CMS message")
+	}
+	var cert_x *C.X509
+	if cert != nil {
+		cert_x = cert.acquireX509()
+		if cert_x == nil {
+			return certificateFreed
+		}
+		defer C.X509_free(cert_x)
+	}
+	pkey := key.acquirePKey()
+	if pkey == nil {
+		return keyFreed
+	}
+	defer C.EVP_PKEY_free(pkey)
+	out, err := newStreamBio(nil, w)
+	if err != nil {
+		return err
+	}
+	defer out.free()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	cms := C.OUR_d2i_CMS((*C.uchar)(unsafe.Pointer(&msg[0])),
+		C.long(len(msg)))
+	if cms == nil {
+		return errorFromErrorQueue()
+	}
+	defer C.CMS_ContentInfo_free(cms)
+	if C.CMS_decrypt(cms, pkey, cert_x, nil, out.bio, cmsBinary) != 1 {
+		return cmsError(out)
+	}
+	return streamError(out)
+}
@@ -0,0 +1,209 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("read failed")
+}
+
+func TestCMSSignVerify(t *testing.T) {
+	ca_key := generateTestRSAKey(t)
+	ca := issueTestCert(t, ca_key, testCert{CA: true})
+	key := generateTestRSAKey(t)
+	signer := issueTestCert(t, key, testCert{Serial: 2, Issuer: ca,
+		IssuerKey: ca_key})
+	store, err := NewCertificateStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddCertificate(ca); err != nil {
+		t.Fatal(err)
+	}
+	manifest := []byte("firmware v1.2.3\nsha256 0123456789abcdef\n")
+
+	sig, err := CMSSign(manifest, signer, key, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, signers, err := CMSVerify(sig, nil, store, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, manifest) {
+		t.Fatalf("unexpected content %q", content)
+	}
+	if len(signers) != 1 || !sameCertificate(t, signers[0], signer) {
+		t.Fatalf("unexpected signers %v", signers)
+	}
+
+	sig, err = CMSSign(manifest, signer, key, nil, CMSDetached)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := CMSVerify(sig, manifest, store, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	tampered := append([]byte(nil), manifest...)
+	tampered[0] ^= 1
+	if _, _, err := CMSVerify(sig, tampered, store, nil, 0); err == nil {
+		t.Fatal("expected tampered content to fail verification")
+	}
+	empty_store, err := NewCertificateStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := CMSVerify(sig, manifest, empty_store, nil,
+		0); err == nil {
+		t.Fatal("expected an untrusted signer to fail verification")
+	}
+	if _, _, err := CMSVerify(sig, manifest, nil, nil,
+		CMSNoSignerCertVerify); err != nil {
+		t.Fatal(err)
+	}
+
+	// without its certificate in the message, the signer must be supplied
+	sig, err = CMSSign(manifest, signer, key, nil, CMSDetached|CMSNoCerts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := CMSVerify(sig, manifest, store, nil, 0); err == nil {
+		t.Fatal("expected verification without the signer to fail")
+	}
+	if _, _, err := CMSVerify(sig, manifest, store, []*Certificate{signer},
+		0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCMSStream(t *testing.T) {
+	ca_key := generateTestRSAKey(t)
+	ca := issueTestCert(t, ca_key, testCert{CA: true})
+	key := generateTestRSAKey(t)
+	signer := issueTestCert(t, key, testCert{Serial: 2, Issuer: ca,
+		IssuerKey: ca_key})
+	store, err := NewCertificateStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddCertificate(ca); err != nil {
+		t.Fatal(err)
+	}
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 256*1024)
+
+	var sig bytes.Buffer
+	if err := CMSSignStream(&sig, bytes.NewReader(payload), signer, key,
+		nil, CMSDetached); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	signers, err := CMSVerifyStream(&out, sig.Bytes(),
+		bytes.NewReader(payload), store, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signers) != 1 || !bytes.Equal(out.Bytes(), payload) {
+		t.Fatal("unexpected verification result")
+	}
+	if _, _, err := CMSVerify(sig.Bytes(), payload, store, nil,
+		0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CMSVerifyStream(nil, sig.Bytes(), failingReader{}, store,
+		nil, 0); err == nil || err.Error() != "read failed" {
+		t.Fatalf("expected the reader's error, got %v", err)
+	}
+
+	// attached, the content is read back out of the message
+	sig.Reset()
+	if err := CMSSignStream(&sig, bytes.NewReader(payload), signer, key,
+		nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if _, err := CMSVerifyStream(&out, sig.Bytes(), nil, store, nil,
+		0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), payload) {
+		t.Fatal("content changed in the round trip")
+	}
+}
+
+func TestCMSEncryptDecrypt(t *testing.T) {
+	ca_key := generateTestRSAKey(t)
+	ca := issueTestCert(t, ca_key, testCert{CA: true})
+	alice_key := generateTestRSAKey(t)
+	alice := issueTestCert(t, alice_key, testCert{Serial: 2, Issuer: ca,
+		IssuerKey: ca_key})
+	bob_key := generateTestRSAKey(t)
+	bob := issueTestCert(t, bob_key, testCert{Serial: 3, Issuer: ca,
+		IssuerKey: ca_key})
+	cipher, err := GetCipherByName("aes-256-cbc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("the launch codes")
+
+	msg, err := CMSEncrypt(secret, []*Certificate{alice, bob}, cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, recipient := range []struct {
+		cert *Certificate
+		key  PrivateKey
+	}{{alice, alice_key}, {bob, bob_key}, {nil, bob_key}} {
+		plaintext, err := CMSDecrypt(msg, recipient.cert, recipient.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(plaintext, secret) {
+			t.Fatalf("unexpected plaintext %q", plaintext)
+		}
+	}
+	if _, err := CMSDecrypt(msg, alice, bob_key); err == nil {
+		t.Fatal("expected decryption with the wrong key to fail")
+	}
+
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 256*1024)
+	var buf bytes.Buffer
+	if err := CMSEncryptStream(&buf, bytes.NewReader(payload),
+		[]*Certificate{alice}, cipher); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := CMSDecryptStream(&out, buf.Bytes(), alice,
+		alice_key); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), payload) {
+		t.Fatal("payload changed in the round trip")
+	}
+	err = CMSEncryptStream(&buf, io.MultiReader(bytes.NewReader(payload),
+		failingReader{}), []*Certificate{alice}, cipher)
+	if err == nil || err.Error() != "read failed" {
+		t.Fatalf("expected the reader's error, got %v", err)
+	}
+}
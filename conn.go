@@ -31,14 +31,79 @@ package openssl
 // const char * SSL_get_cipher_name_not_a_macro(const SSL *ssl) {
 //    return SSL_get_cipher_name(ssl);
 // }
+// int OUR_SSL_key_update(SSL *ssl, int request_peer) {
+// #if OPENSSL_VERSION_NUMBER >= 0x10101000L
+//    return SSL_key_update(ssl, request_peer ?
+//        SSL_KEY_UPDATE_REQUESTED : SSL_KEY_UPDATE_NOT_REQUESTED);
+// #else
+//    return -1;
+// #endif
+// }
+// unsigned long OUR_SSL_get_cipher_id(const SSL *ssl) {
+//    const SSL_CIPHER *cipher = SSL_get_current_cipher(ssl);
+//    return cipher == NULL ? 0 : SSL_CIPHER_get_id(cipher) & 0xffff;
+// }
+// int SSL_is_init_finished_not_a_macro(const SSL *ssl) {
+//    return SSL_is_init_finished(ssl);
+// }
+// #ifndef TLS1_3_VERSION
+// #define TLS1_3_VERSION 0x0304
+// #endif
+// long SSL_set_mode_not_a_macro(SSL *ssl, long modes) {
+//    return SSL_set_mode(ssl, modes);
+// }
+// #if !defined(SSL_ERROR_WANT_ASYNC) || defined(OPENSSL_NO_ASYNC)
+// #undef SSL_ERROR_WANT_ASYNC
+// #undef SSL_ERROR_WANT_ASYNC_JOB
+// #define SSL_ERROR_WANT_ASYNC -100
+// #define SSL_ERROR_WANT_ASYNC_JOB -101
+// #endif
+// #ifndef SSL_R_INAPPROPRIATE_FALLBACK
+// #define SSL_R_INAPPROPRIATE_FALLBACK -1
+// #endif
+// #ifndef SSL_R_TLSV1_ALERT_INAPPROPRIATE_FALLBACK
+// #define SSL_R_TLSV1_ALERT_INAPPROPRIATE_FALLBACK -1
+// #endif
+// int ERR_peek_inappropriate_fallback() {
+//    unsigned long err = ERR_peek_last_error();
+//    return ERR_GET_LIB(err) == ERR_LIB_SSL &&
+//        (ERR_GET_REASON(err) == SSL_R_INAPPROPRIATE_FALLBACK ||
+//        ERR_GET_REASON(err) == SSL_R_TLSV1_ALERT_INAPPROPRIATE_FALLBACK);
+// }
+// #ifndef X509_V_ERR_NO_VALID_SCTS
+// #define X509_V_ERR_NO_VALID_SCTS 71
+// #endif
+// #ifndef X509_V_ERR_HOSTNAME_MISMATCH
+// #define X509_V_ERR_HOSTNAME_MISMATCH 62
+// #define X509_V_ERR_EMAIL_MISMATCH 63
+// #define X509_V_ERR_IP_ADDRESS_MISMATCH 64
+// #endif
+// STACK_OF(X509) *OUR_SSL_get0_verified_chain(const SSL *ssl) {
+// #if OPENSSL_VERSION_NUMBER >= 0x10100000L
+//    return SSL_get0_verified_chain(ssl);
+// #else
+//    return NULL;
+// #endif
+// }
+// int OUR_SSL_verify_client_post_handshake(SSL *ssl) {
+// #if OPENSSL_VERSION_NUMBER >= 0x10101000L
+//    return SSL_verify_client_post_handshake(ssl);
+// #else
+//    return -1;
+// #endif
+// }
 import "C"
 
 import (
+	"bytes"
+	"crypto/x509"
 	"errors"
 	"io"
 	"net"
 	"runtime"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 	"unsafe"
 
@@ -50,19 +115,79 @@ var (
 	wantRead   = errors.New("want read")
 	wantWrite  = errors.New("want write")
 	tryAgain   = errors.New("try again")
+
+	wantAsync    = errors.New("want async")
+	wantAsyncJob = errors.New("want async job")
+
+	// DowngradeDetected is returned by handshakes that fail because a
+	// protocol downgrade was detected: a server supporting a newer version
+	// than the client offered received its fallback SCSV (see
+	// SendFallbackSCSV), or a client found the downgrade sentinel a TLS 1.3
+	// server puts in its ServerHello when negotiating an older version (RFC
+	// 8446 section 4.1.3). Clients retrying with older versions must treat it
+	// as final rather than fall back further.
+	DowngradeDetected = errors.New("openssl: protocol downgrade detected")
+
+	tls13Unsupported = errors.New(
+		"TLS 1.3 features require OpenSSL 1.1.1 or newer")
 )
 
+// Conn is an SSL connection over an underlying net.Conn. As with tls.Conn,
+// one goroutine may Read while another Writes, including across
+// renegotiations and KeyUpdates: calls into OpenSSL are serialized on the
+// connection, and whichever goroutine OpenSSL needs input for waits on a
+// single read of the underlying connection that any other such goroutine
+// shares. Any method may be called concurrently with Read and Write, and
+// Close unblocks them.
 type Conn struct {
-	conn             net.Conn
-	ssl              *C.SSL
-	ctx              *Ctx // for gc
-	into_ssl         *readBio
-	from_ssl         *writeBio
-	is_shutdown      bool
-	mtx              sync.Mutex
-	want_read_future *utils.Future
+	conn            net.Conn
+	ssl             *C.SSL
+	ctx             *Ctx   // for gc
+	ctxs            []*Ctx // released when the SSL object is freed
+	into_ssl        *readBio
+	from_ssl        *writeBio
+	into_ssl_cbio   *C.BIO
+	from_ssl_cbio   *C.BIO
+	is_shutdown     bool
+	write_closed    bool
+	handshake_done  bool
+	early_data_sent bool
+	early_data_done bool
+	ocsp_err        error
+	psk_identity    string
+	peer_exts       map[uint16][]byte
+	msg_cb          MessageCallback
+	padding_cb      RecordPaddingCallback
+	mtx             sync.Mutex
+	dynamic_records bool
+	ktls            bool
+	ktls_tried      bool
+	ktls_tx         bool
+	ktls_secret     []byte
+	records_sent    int
+	bytes_sent      int
+	last_write      time.Time
+	input           *inputFiller
+	deadline_mtx    sync.Mutex
+	write_deadline  time.Time
+	// metrics is the context's when the connection was created, see
+	// Ctx.SetMetrics
+	metrics          Metrics
+	handshake_start  time.Time
+	handshake_failed bool
+	// alpn_protos overrides the context's, see SetAlpnProtos
+	alpn_protos []string
+	// handshake_timer closes conn if the handshake takes longer than the
+	// context's handshake timeout
+	handshake_timer     *time.Timer
+	handshake_timed_out bool
 }
 
+// closeNotifyTimeout bounds sending close_notify in Close when no earlier
+// write deadline is set, so that a peer that stops reading can't keep Close
+// from returning.
+var closeNotifyTimeout = 5 * time.Second
+
 type VerifyResult int
 
 const (
@@ -120,20 +245,39 @@ const (
 	UnsupportedNameSyntax         VerifyResult = C.X509_V_ERR_UNSUPPORTED_NAME_SYNTAX
 	CrlPathValidationError        VerifyResult = C.X509_V_ERR_CRL_PATH_VALIDATION_ERROR
 	ApplicationVerification       VerifyResult = C.X509_V_ERR_APPLICATION_VERIFICATION
+	// HostnameMismatch, EmailMismatch and IPAddressMismatch are only
+	// reported with OpenSSL 1.0.2 or newer, see Ctx.SetVerifyHostname.
+	HostnameMismatch  VerifyResult = C.X509_V_ERR_HOSTNAME_MISMATCH
+	EmailMismatch     VerifyResult = C.X509_V_ERR_EMAIL_MISMATCH
+	IPAddressMismatch VerifyResult = C.X509_V_ERR_IP_ADDRESS_MISMATCH
+	// NoValidSCTs is reported by clients enforcing certificate transparency,
+	// see Ctx.EnableCT.
+	NoValidSCTs VerifyResult = C.X509_V_ERR_NO_VALID_SCTS
 )
 
-func newSSL(ctx *C.SSL_CTX) (*C.SSL, error) {
+// newSSL makes an SSL object from ctx, which it keeps a reference to until
+// the SSL object is freed with freeSSL.
+func newSSL(ctx *Ctx) (*C.SSL, error) {
+	if err := ctx.retain(); err != nil {
+		return nil, err
+	}
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
-	ssl := C.SSL_new(ctx)
+	ssl := C.SSL_new(ctx.ctx)
 	if ssl == nil {
+		ctx.release()
 		return nil, errorFromErrorQueue()
 	}
 	return ssl, nil
 }
 
+func freeSSL(ssl *C.SSL, ctx *Ctx) {
+	C.SSL_free(ssl)
+	ctx.release()
+}
+
 func newConn(conn net.Conn, ctx *Ctx) (*Conn, error) {
-	ssl, err := newSSL(ctx.ctx)
+	ssl, err := newSSL(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -146,33 +290,90 @@ func newConn(conn net.Conn, ctx *Ctx) (*Conn, error) {
 		from_ssl.release_buffers = true
 	}
 
-	into_ssl_cbio := into_ssl.MakeCBIO()
-	from_ssl_cbio := from_ssl.MakeCBIO()
+	var into_ssl_cbio, from_ssl_cbio *C.BIO
+	if ctx.GetMode()&Async != 0 {
+		into_ssl_cbio = into_ssl.MakeLockedCBIO()
+		from_ssl_cbio = from_ssl.MakeLockedCBIO()
+	} else {
+		into_ssl_cbio = into_ssl.MakeCBIO()
+		from_ssl_cbio = from_ssl.MakeCBIO()
+	}
 	if into_ssl_cbio == nil || from_ssl_cbio == nil {
 		// these frees are null safe
 		C.BIO_free(into_ssl_cbio)
 		C.BIO_free(from_ssl_cbio)
-		C.SSL_free(ssl)
+		freeSSL(ssl, ctx)
 		return nil, errors.New("failed to allocate memory BIO")
 	}
 
 	// the ssl object takes ownership of these objects now
 	C.SSL_set_bio(ssl, into_ssl_cbio, from_ssl_cbio)
 
-	c := &Conn{
+	// cgo only lets the SSL object hold c while c holds no Go pointers
+	c := new(Conn)
+	setConnExData(ssl, c)
+	*c = Conn{
 		conn:     conn,
 		ssl:      ssl,
 		ctx:      ctx,
+		ctxs:     []*Ctx{ctx},
 		into_ssl: into_ssl,
-		from_ssl: from_ssl}
-	runtime.SetFinalizer(c, func(c *Conn) {
-		c.into_ssl.Disconnect(into_ssl_cbio)
-		c.from_ssl.Disconnect(from_ssl_cbio)
-		C.SSL_free(c.ssl)
-	})
+		from_ssl: from_ssl,
+
+		into_ssl_cbio: into_ssl_cbio,
+		from_ssl_cbio: from_ssl_cbio,
+
+		input: newInputFiller(),
+
+		padding_cb:      ctx.record_padding_cb,
+		dynamic_records: ctx.dynamic_records,
+		ktls:            ctx.ktls}
+	c.setMetrics(ctx.metrics)
+	c.startHandshakeTimer(ctx.handshake_timeout)
+	atomic.AddInt64(&statActiveConns, 1)
+	atomic.AddInt64(&statSSLs, 1)
+	trackObject(unsafe.Pointer(c), "Conn")
+	runtime.SetFinalizer(c, (*Conn).free)
+	if len(ctx.expected_peer_keys) > 0 {
+		if err := c.AddExpectedPeerKeys(ctx.expected_peer_keys); err != nil {
+			c.Free()
+			return nil, err
+		}
+	}
 	return c, nil
 }
 
+// Free releases the connection's SSL object and BIOs without waiting for the
+// garbage collector, along with its references to the contexts it used. It
+// is meant for after Close, once nothing else uses the Conn: unlike Close, it
+// must not be called while other methods are in progress, and the Conn must
+// not be used afterwards. Calling Free again is harmless.
+func (c *Conn) Free() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.ssl == nil {
+		return
+	}
+	runtime.SetFinalizer(c, nil)
+	c.free()
+}
+
+func (c *Conn) free() {
+	untrackObject(unsafe.Pointer(c))
+	c.into_ssl.Disconnect(c.into_ssl_cbio)
+	c.from_ssl.Disconnect(c.from_ssl_cbio)
+	C.SSL_free(c.ssl)
+	c.ssl = nil
+	for _, ctx := range c.ctxs {
+		ctx.release()
+	}
+	c.ctxs = nil
+	if !c.is_shutdown {
+		atomic.AddInt64(&statActiveConns, -1)
+	}
+	atomic.AddInt64(&statSSLs, -1)
+}
+
 // Client wraps an existing stream connection and puts it in the connect state
 // for any subsequent handshakes.
 //
@@ -180,7 +381,8 @@ func newConn(conn net.Conn, ctx *Ctx) (*Conn, error) {
 // connection, you are responsible for verifying the peer's hostname.
 // Otherwise, you are vulnerable to MITM attacks.
 //
-// Client also does not set up SNI for you like Dial does.
+// Client also does not set up SNI for you like Dial does, unless the context
+// came from NewCtxFromTLSConfig with a ServerName.
 //
 // Client connections probably won't work for you unless you set a verify
 // location or add some certs to the certificate store of the client context
@@ -192,6 +394,17 @@ func Client(conn net.Conn, ctx *Ctx) (*Conn, error) {
 		return nil, err
 	}
 	C.SSL_set_connect_state(c.ssl)
+	if ctx.verify_servers {
+		C.SSL_set_verify(c.ssl, C.SSL_get_verify_mode(c.ssl)|C.SSL_VERIFY_PEER,
+			C.SSL_get_verify_callback(c.ssl))
+	}
+	if ctx.server_name != "" {
+		err = c.SetTlsExtHostName(ctx.server_name)
+		if err != nil {
+			c.Free()
+			return nil, err
+		}
+	}
 	return c, nil
 }
 
@@ -207,6 +420,8 @@ func Server(conn net.Conn, ctx *Ctx) (*Conn, error) {
 }
 
 func (c *Conn) CurrentCipher() (string, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
 	p := C.SSL_get_cipher_name_not_a_macro(c.ssl)
 	if p == nil {
 		return "", errors.New("Session not established")
@@ -229,51 +444,88 @@ func (c *Conn) fillInputBuffer() error {
 	}
 }
 
+// inputFiller lets one goroutine at a time fill the input buffer, with any
+// others that need input waiting for that fill rather than reading past it.
+// It lives apart from Conn so that the cond's pointer to its lock doesn't make
+// the Conn point to itself, which would keep its finalizer from running.
+type inputFiller struct {
+	mtx     sync.Mutex
+	cond    sync.Cond
+	filling bool
+	gen     uint64
+	err     error
+}
+
+func newInputFiller() *inputFiller {
+	f := new(inputFiller)
+	f.cond.L = &f.mtx
+	return f
+}
+
+// fill calls fill_buffer unless another goroutine is already filling, in
+// which case it waits for that fill and returns its error.
+func (f *inputFiller) fill(fill_buffer func() error) error {
+	f.mtx.Lock()
+	if f.filling {
+		gen := f.gen
+		for f.gen == gen {
+			f.cond.Wait()
+		}
+		err := f.err
+		f.mtx.Unlock()
+		return err
+	}
+	f.filling = true
+	f.mtx.Unlock()
+	err := fill_buffer()
+	f.mtx.Lock()
+	f.filling = false
+	f.err = err
+	f.gen++
+	f.cond.Broadcast()
+	f.mtx.Unlock()
+	return err
+}
+
 func (c *Conn) flushOutputBuffer() error {
+	if ktls, err := c.ktlsFlush(); ktls {
+		return err
+	}
 	_, err := c.from_ssl.WriteTo(c.conn)
 	return err
 }
 
 func (c *Conn) getErrorHandler(rv C.int, errno error) func() error {
+	if err := c.ocsp_err; err != nil {
+		// the handshake failed on the OCSP staple, see Ctx.RequestOCSPStaple
+		C.ERR_clear_error()
+		c.flushOutputBufferAsync()
+		return func() error { return err }
+	}
 	errcode := C.SSL_get_error(c.ssl, rv)
 	switch errcode {
 	case C.SSL_ERROR_ZERO_RETURN:
+		if c.write_closed {
+			// both sides have sent close_notify, see CloseWrite, and Close
+			// just closes the underlying connection
+			return func() error { return io.ErrUnexpectedEOF }
+		}
 		return func() error {
 			c.Close()
 			return io.ErrUnexpectedEOF
 		}
 	case C.SSL_ERROR_WANT_READ:
-		go c.flushOutputBuffer()
-		if c.want_read_future != nil {
-			want_read_future := c.want_read_future
-			return func() error {
-				_, err := want_read_future.Get()
-				return err
-			}
-		}
-		c.want_read_future = utils.NewFuture()
-		want_read_future := c.want_read_future
-		return func() (err error) {
-			defer func() {
-				c.mtx.Lock()
-				c.want_read_future = nil
-				c.mtx.Unlock()
-				want_read_future.Set(nil, err)
-			}()
-			err = c.fillInputBuffer()
-			if err != nil {
-				return err
-			}
-			return tryAgain
-		}
+		c.flushOutputBufferAsync()
+		// neither closure captures anything, so they cost no allocation on
+		// the hot path; handleError does the work
+		return func() error { return wantRead }
 	case C.SSL_ERROR_WANT_WRITE:
-		return func() error {
-			err := c.flushOutputBuffer()
-			if err != nil {
-				return err
-			}
-			return tryAgain
-		}
+		return func() error { return wantWrite }
+	case C.SSL_ERROR_WANT_ASYNC:
+		c.flushOutputBufferAsync()
+		return func() error { return wantAsync }
+	case C.SSL_ERROR_WANT_ASYNC_JOB:
+		return func() error { return wantAsyncJob }
 	case C.SSL_ERROR_SYSCALL:
 		var err error
 		if C.ERR_peek_error() == 0 {
@@ -283,23 +535,66 @@ func (c *Conn) getErrorHandler(rv C.int, errno error) func() error {
 			case -1:
 				err = errno
 			default:
-				err = errorFromErrorQueue()
+				err = c.errorFromErrorQueue()
 			}
 		} else {
-			err = errorFromErrorQueue()
+			err = c.errorFromErrorQueue()
 		}
 		return func() error { return err }
 	default:
-		err := errorFromErrorQueue()
+		err := c.errorFromErrorQueue()
 		return func() error { return err }
 	}
 }
 
 func (c *Conn) handleError(errcb func() error) error {
-	if errcb != nil {
-		return errcb()
+	err := c.retryError(errcb)
+	if err != nil && err != tryAgain && c.metrics != nil {
+		c.reportHandshakeFailure(err)
+	}
+	return err
+}
+
+// retryError waits for what errcb asks for, if anything, returning tryAgain
+// once the operation can be retried.
+func (c *Conn) retryError(errcb func() error) error {
+	if errcb == nil {
+		return nil
+	}
+	switch err := errcb(); err {
+	case wantRead:
+		err = c.input.fill(c.fillInputBuffer)
+		if err != nil {
+			return err
+		}
+		return tryAgain
+	case wantWrite:
+		err = c.flushOutputBuffer()
+		if err != nil {
+			return err
+		}
+		return tryAgain
+	case wantAsync:
+		err = c.waitAsync()
+		if err != nil {
+			return err
+		}
+		return tryAgain
+	case wantAsyncJob:
+		// every async job is in use; wait for one to finish
+		time.Sleep(asyncJobRetryInterval)
+		return tryAgain
+	default:
+		return err
+	}
+}
+
+// flushOutputBufferAsync flushes the output buffer in the background, if
+// there is anything in it.
+func (c *Conn) flushOutputBufferAsync() {
+	if c.from_ssl.Buffered() > 0 {
+		go c.flushOutputBuffer()
 	}
-	return nil
 }
 
 func (c *Conn) handshake() func() error {
@@ -308,26 +603,194 @@ func (c *Conn) handshake() func() error {
 	if c.is_shutdown {
 		return func() error { return io.ErrUnexpectedEOF }
 	}
+	if err := c.renegotiationError(); err != nil {
+		return func() error { return err }
+	}
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
 	rv, errno := C.SSL_do_handshake(c.ssl)
+	if err := c.renegotiationError(); err != nil {
+		// sending the no_renegotiation alert OpenSSL may have queued
+		c.flushOutputBufferAsync()
+		return func() error { return err }
+	}
 	if rv > 0 {
+		c.countHandshake()
 		return nil
 	}
+	if C.ERR_peek_inappropriate_fallback() == 1 {
+		C.ERR_clear_error()
+		return func() error { return DowngradeDetected }
+	}
 	return c.getErrorHandler(rv, errno)
 }
 
+// countHandshake counts the first handshake of the connection once the SSL
+// object has made progress past it. The caller must hold c.mtx.
+func (c *Conn) countHandshake() {
+	if !c.handshake_done {
+		c.handshake_done = true
+		c.stopHandshakeTimer()
+		c.ctx.logMasterSecret(c.ssl)
+		atomic.AddInt64(&statHandshakes, 1)
+		if c.metrics != nil {
+			c.metrics.HandshakeCompleted(c, c.handshakeInfo())
+		}
+	}
+}
+
 // Handshake performs an SSL handshake. If a handshake is not manually
 // triggered, it will run before the first I/O on the encrypted stream.
+//
+// With TLS 1.3 a client's handshake completes before the server has checked
+// its certificate, so a server rejecting it shows up as an error from the
+// client's first Read instead. Session tickets likewise arrive after the
+// handshake, and are only processed once the client reads.
 func (c *Conn) Handshake() error {
 	err := tryAgain
 	for err == tryAgain {
 		err = c.handleError(c.handshake())
 	}
-	go c.flushOutputBuffer()
+	c.flushOutputBufferAsync()
+	if err != nil && c.handshakeTimedOut() {
+		return HandshakeTimeoutError
+	}
 	return err
 }
 
+// KeyUpdate replaces the keys protecting the data this side sends on a TLS 1.3
+// connection, and if request_peer is true, asks the peer to do the same for
+// its direction. It returns once the KeyUpdate message has been written to the
+// underlying connection. KeyUpdates sent by the peer are processed during Read
+// without any help.
+func (c *Conn) KeyUpdate(request_peer bool) error {
+	c.mtx.Lock()
+	if c.is_shutdown {
+		c.mtx.Unlock()
+		return errors.New("connection closed")
+	}
+	var request C.int
+	if request_peer {
+		request = 1
+	}
+	runtime.LockOSThread()
+	rv := C.OUR_SSL_key_update(c.ssl, request)
+	var err error
+	if rv < 0 {
+		err = tls13Unsupported
+	} else if rv != 1 {
+		err = errorFromErrorQueue()
+	} else {
+		c.ktlsKeyUpdated()
+	}
+	runtime.UnlockOSThread()
+	c.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// the update is only queued; a handshake step makes OpenSSL send it
+	err = tryAgain
+	for err == tryAgain {
+		err = c.handleError(c.handshake())
+	}
+	if err != nil {
+		return err
+	}
+	return c.flushOutputBuffer()
+}
+
+// VerifyClientPostHandshake asks the client of a TLS 1.3 server connection
+// for its certificate after the handshake, e.g. once it requests a protected
+// resource. The client must have enabled this with
+// Ctx.SetPostHandshakeAuth, and the server context's verify mode must include
+// VerifyPostHandshake. The certificate is received and verified during
+// subsequent Reads, after which PeerCertificate returns it.
+func (c *Conn) VerifyClientPostHandshake() error {
+	c.mtx.Lock()
+	if c.is_shutdown {
+		c.mtx.Unlock()
+		return errors.New("connection closed")
+	}
+	runtime.LockOSThread()
+	rv := C.OUR_SSL_verify_client_post_handshake(c.ssl)
+	var err error
+	if rv < 0 {
+		err = tls13Unsupported
+	} else if rv != 1 {
+		err = errorFromErrorQueue()
+	}
+	runtime.UnlockOSThread()
+	c.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// like KeyUpdate, the CertificateRequest goes out with a handshake step
+	err = tryAgain
+	for err == tryAgain {
+		err = c.handleError(c.handshake())
+	}
+	if err != nil {
+		return err
+	}
+	return c.flushOutputBuffer()
+}
+
+// ExportKeyingMaterial derives length bytes of keying material from the
+// connection's master secret, as described by RFC 5705, or RFC 8446 section
+// 7.5 for TLS 1.3, with the same label and context giving the same bytes on
+// both ends. Up to TLS 1.2 a nil context differs from an empty one. As with
+// crypto/tls, the labels the TLS key schedule itself uses are refused. Only
+// valid after a handshake.
+func (c *Conn) ExportKeyingMaterial(label string, context []byte,
+	length int) ([]byte, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.is_shutdown {
+		return nil, errors.New("connection closed")
+	}
+	return exportKeyingMaterial(c.ssl, label, context, length)
+}
+
+func exportKeyingMaterial(ssl *C.SSL, label string, context []byte,
+	length int) ([]byte, error) {
+	switch label {
+	case "client finished", "server finished", "master secret",
+		"key expansion":
+		return nil, errors.New("reserved ExportKeyingMaterial label")
+	}
+	if length < 0 {
+		return nil, errors.New("negative ExportKeyingMaterial length")
+	}
+	if C.SSL_is_init_finished_not_a_macro(ssl) != 1 {
+		return nil, errors.New("handshake not complete")
+	}
+	clabel := C.CString(label)
+	defer C.free(unsafe.Pointer(clabel))
+	var context_ptr *C.uchar
+	var use_context C.int
+	if context != nil {
+		use_context = 1
+		if len(context) > 0 {
+			context_ptr = (*C.uchar)(unsafe.Pointer(&context[0]))
+		}
+	}
+	out := make([]byte, length)
+	var out_ptr *C.uchar
+	if length > 0 {
+		out_ptr = (*C.uchar)(unsafe.Pointer(&out[0]))
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.SSL_export_keying_material(ssl, out_ptr, C.size_t(length),
+		clabel, C.size_t(len(label)), context_ptr, C.size_t(len(context)),
+		use_context) != 1 {
+		return nil, errorFromErrorQueue()
+	}
+	return out, nil
+}
+
 // PeerCertificate returns the Certificate of the peer with which you're
 // communicating. Only valid after a handshake.
 func (c *Conn) PeerCertificate() (*Certificate, error) {
@@ -340,11 +803,7 @@ func (c *Conn) PeerCertificate() (*Certificate, error) {
 	if x == nil {
 		return nil, errors.New("no peer certificate found")
 	}
-	cert := &Certificate{x: x}
-	runtime.SetFinalizer(cert, func(cert *Certificate) {
-		C.X509_free(cert.x)
-	})
-	return cert, nil
+	return newCertificate(x), nil
 }
 
 // PeerCertificateChain returns the certificate chain of the peer. If called on
@@ -364,27 +823,145 @@ func (c *Conn) PeerCertificateChain() (rv []*Certificate, err error) {
 	sk_num := int(C.sk_X509_num_not_a_macro(sk))
 	rv = make([]*Certificate, 0, sk_num)
 	for i := 0; i < sk_num; i++ {
-		x := C.sk_X509_value_not_a_macro(sk, C.int(i))
-		// ref holds on to the underlying connection memory so we don't need to
-		// worry about incrementing refcounts manually or freeing the X509
-		rv = append(rv, &Certificate{x: x, ref: c})
+		// the stack belongs to the connection, so take our own references to
+		// keep the certificates valid after it goes away
+		rv = append(rv, refCertificate(
+			C.sk_X509_value_not_a_macro(sk, C.int(i))))
 	}
 	return rv, nil
 }
 
+// VerifiedChain returns the chain OpenSSL built and verified for the peer
+// certificate during the handshake, from the peer's certificate up to the
+// trusted root, unlike PeerCertificateChain which holds what the peer sent.
+// It is only set when the peer's certificate was verified successfully, and
+// requires OpenSSL 1.1.0 or newer.
+func (c *Conn) VerifiedChain() (rv []*Certificate, err error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.is_shutdown {
+		return nil, errors.New("connection closed")
+	}
+	sk := C.OUR_SSL_get0_verified_chain(c.ssl)
+	if sk == nil {
+		return nil, errors.New("no verified chain found")
+	}
+	sk_num := int(C.sk_X509_num_not_a_macro(sk))
+	rv = make([]*Certificate, 0, sk_num)
+	for i := 0; i < sk_num; i++ {
+		rv = append(rv, refCertificate(
+			C.sk_X509_value_not_a_macro(sk, C.int(i))))
+	}
+	return rv, nil
+}
+
+// Version returns the protocol version negotiated on the connection, or 0
+// before the handshake has completed.
+func (c *Conn) Version() SSLVersion {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.version()
+}
+
+// version is Version for callers holding c.mtx.
+func (c *Conn) version() SSLVersion {
+	if C.SSL_is_init_finished_not_a_macro(c.ssl) != 1 {
+		return 0
+	}
+	switch C.SSL_version(c.ssl) {
+	case C.SSL3_VERSION:
+		return SSLv3
+	case C.TLS1_VERSION:
+		return TLSv1
+	case C.TLS1_1_VERSION:
+		return TLSv1_1
+	case C.TLS1_2_VERSION:
+		return TLSv1_2
+	case C.TLS1_3_VERSION:
+		return TLSv1_3
+	}
+	return 0
+}
+
 type ConnectionState struct {
 	Certificate           *Certificate
 	CertificateError      error
 	CertificateChain      []*Certificate
 	CertificateChainError error
+
+	// The rest are as for crypto/tls's ConnectionState, to ease porting.
+
+	// Version is the protocol version on the wire, such as
+	// tls.VersionTLS13, or 0 before the handshake has completed.
+	Version           uint16
+	HandshakeComplete bool
+	DidResume         bool
+	// CipherSuite is the IANA number of the cipher suite, such
+	// as tls.TLS_AES_128_GCM_SHA256.
+	CipherSuite        uint16
+	ServerName         string
+	NegotiatedProtocol string
+	// PeerCertificates holds the peer's certificate followed by the rest of
+	// the chain it sent, as parsed by crypto/x509. PeerCertificatesError
+	// says why it is empty when the peer sent certificates that crypto/x509
+	// rejects.
+	PeerCertificates      []*x509.Certificate
+	PeerCertificatesError error
+	OCSPResponse          []byte
 }
 
+// ConnectionState returns details about the connection.
 func (c *Conn) ConnectionState() (rv ConnectionState) {
 	rv.Certificate, rv.CertificateError = c.PeerCertificate()
 	rv.CertificateChain, rv.CertificateChainError = c.PeerCertificateChain()
+	c.mtx.Lock()
+	rv.HandshakeComplete = C.SSL_is_init_finished_not_a_macro(c.ssl) == 1
+	if rv.HandshakeComplete {
+		rv.Version = uint16(C.SSL_version(c.ssl))
+		rv.CipherSuite = uint16(C.OUR_SSL_get_cipher_id(c.ssl))
+	}
+	c.mtx.Unlock()
+	rv.DidResume = c.DidResume()
+	rv.ServerName = c.ServerName()
+	rv.NegotiatedProtocol = c.NegotiatedProtocol()
+	rv.OCSPResponse = c.OCSPResponse()
+	rv.PeerCertificates, rv.PeerCertificatesError = stdlibPeerCertificates(
+		rv.Certificate, rv.CertificateChain)
 	return
 }
 
+// stdlibPeerCertificates parses leaf and chain with crypto/x509, leaving out
+// the leaf from the chain where clients see it there.
+func stdlibPeerCertificates(leaf *Certificate, chain []*Certificate) (
+	rv []*x509.Certificate, err error) {
+	var ders [][]byte
+	if leaf != nil {
+		der, err := leaf.MarshalDER()
+		if err != nil {
+			return nil, err
+		}
+		ders = append(ders, der)
+	}
+	for _, cert := range chain {
+		der, err := cert.MarshalDER()
+		if err != nil {
+			return nil, err
+		}
+		if len(ders) > 0 && bytes.Equal(der, ders[0]) {
+			continue
+		}
+		ders = append(ders, der)
+	}
+	for _, der := range ders {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, cert)
+	}
+	return rv, nil
+}
+
 func (c *Conn) shutdown() func() error {
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
@@ -430,7 +1007,8 @@ func (c *Conn) shutdownLoop() error {
 }
 
 // Close shuts down the SSL connection and closes the underlying wrapped
-// connection.
+// connection. Sending close_notify is bounded by the write deadline, or by
+// five seconds if there is none or it is later.
 func (c *Conn) Close() error {
 	c.mtx.Lock()
 	if c.is_shutdown {
@@ -438,13 +1016,76 @@ func (c *Conn) Close() error {
 		return nil
 	}
 	c.is_shutdown = true
+	write_closed := c.write_closed
+	c.stopHandshakeTimer()
 	c.mtx.Unlock()
+	atomic.AddInt64(&statActiveConns, -1)
+	if write_closed {
+		// close_notify was sent already, and shutting down again would wait
+		// for the peer's
+		return c.conn.Close()
+	}
+	deadline := time.Now().Add(closeNotifyTimeout)
+	c.deadline_mtx.Lock()
+	if !c.write_deadline.IsZero() && c.write_deadline.Before(deadline) {
+		deadline = c.write_deadline
+	}
+	c.deadline_mtx.Unlock()
+	// also cuts short writes still pending from earlier calls
+	c.conn.SetWriteDeadline(deadline)
 	var errs utils.ErrorGroup
-	errs.Add(c.shutdownLoop())
+	if ktls, err := c.ktlsClose(); ktls {
+		errs.Add(err)
+	} else {
+		errs.Add(c.shutdownLoop())
+	}
 	errs.Add(c.conn.Close())
 	return errs.Finalize()
 }
 
+// CloseWrite sends close_notify, telling the peer that no more data will be
+// written, but keeps the connection open for reading until the peer closes
+// its side too, like TCP's half-close. If the underlying connection supports
+// it, as *net.TCPConn does, its write side is shut down as well. Write fails
+// after CloseWrite, and Close then just closes the underlying connection.
+//
+// Peers only keep writing after close_notify if they support half-closed
+// connections, as TLS 1.3 requires; TLS 1.2 peers commonly close at once, as
+// does a Conn that hasn't called CloseWrite itself.
+func (c *Conn) CloseWrite() error {
+	c.mtx.Lock()
+	if c.is_shutdown {
+		c.mtx.Unlock()
+		return errors.New("connection closed")
+	}
+	if c.write_closed {
+		c.mtx.Unlock()
+		return nil
+	}
+	c.write_closed = true
+	c.mtx.Unlock()
+	if ktls, err := c.ktlsClose(); ktls {
+		if err != nil {
+			return err
+		}
+	} else {
+		err := c.handleError(c.shutdown())
+		if err != nil {
+			return err
+		}
+		err = c.flushOutputBuffer()
+		if err != nil {
+			return err
+		}
+	}
+	if cw, ok := c.conn.(interface {
+		CloseWrite() error
+	}); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
 func (c *Conn) read(b []byte) (int, func() error) {
 	if len(b) == 0 {
 		return 0, nil
@@ -454,10 +1095,19 @@ func (c *Conn) read(b []byte) (int, func() error) {
 	if c.is_shutdown {
 		return 0, func() error { return io.EOF }
 	}
+	if err := c.renegotiationError(); err != nil {
+		return 0, func() error { return err }
+	}
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
 	rv, errno := C.SSL_read(c.ssl, unsafe.Pointer(&b[0]), C.int(len(b)))
+	if err := c.renegotiationError(); err != nil {
+		// sending the no_renegotiation alert OpenSSL may have queued
+		c.flushOutputBufferAsync()
+		return 0, func() error { return err }
+	}
 	if rv > 0 {
+		c.countHandshake()
 		return int(rv), nil
 	}
 	return 0, c.getErrorHandler(rv, errno)
@@ -465,17 +1115,21 @@ func (c *Conn) read(b []byte) (int, func() error) {
 
 // Read reads up to len(b) bytes into b. It returns the number of bytes read
 // and an error if applicable. io.EOF is returned when the caller can expect
-// to see no more data.
+// to see no more data. A peer's close_notify closes the connection, unless
+// CloseWrite was called, when it is left for the caller to close.
 func (c *Conn) Read(b []byte) (n int, err error) {
 	if len(b) == 0 {
 		return 0, nil
 	}
+	if err := c.finishEarlyData(); err != nil {
+		return 0, err
+	}
 	err = tryAgain
 	for err == tryAgain {
 		n, errcb := c.read(b)
 		err = c.handleError(errcb)
 		if err == nil {
-			go c.flushOutputBuffer()
+			c.flushOutputBufferAsync()
 			return n, nil
 		}
 		if err == io.ErrUnexpectedEOF {
@@ -495,10 +1149,24 @@ func (c *Conn) write(b []byte) (int, func() error) {
 		err := errors.New("connection closed")
 		return 0, func() error { return err }
 	}
+	if c.write_closed {
+		err := errors.New("connection closed for writing")
+		return 0, func() error { return err }
+	}
+	if err := c.renegotiationError(); err != nil {
+		return 0, func() error { return err }
+	}
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
 	rv, errno := C.SSL_write(c.ssl, unsafe.Pointer(&b[0]), C.int(len(b)))
+	if err := c.renegotiationError(); err != nil {
+		// sending the no_renegotiation alert OpenSSL may have queued
+		c.flushOutputBufferAsync()
+		return 0, func() error { return err }
+	}
 	if rv > 0 {
+		c.countHandshake()
+		c.countRecord(int(rv))
 		return int(rv), nil
 	}
 	return 0, c.getErrorHandler(rv, errno)
@@ -506,16 +1174,153 @@ func (c *Conn) write(b []byte) (int, func() error) {
 
 // Write will encrypt the contents of b and write it to the underlying stream.
 // Performance will be vastly improved if the size of b is a multiple of
-// SSLRecordSize.
+// SSLRecordSize. See also WriteBuffers.
 func (c *Conn) Write(b []byte) (written int, err error) {
-	if len(b) == 0 {
-		return 0, nil
+	return c.writeAll(b, true)
+}
+
+// recordBuffers holds the buffers WriteBuffers gathers records in.
+var recordBuffers = sync.Pool{
+	New: func() interface{} { return new([SSLRecordSize]byte) }}
+
+// WriteBuffers writes the contents of bufs, as one Write of them joined
+// together would. Runs of buffers smaller than SSLRecordSize are gathered
+// into whole records first, so that many small writes, such as a header and
+// a body, cost one record rather than one each, and all of the records go to
+// the underlying connection in a single write. It returns how many bytes of
+// bufs were written.
+func (c *Conn) WriteBuffers(bufs [][]byte) (written int, err error) {
+	scratch := recordBuffers.Get().(*[SSLRecordSize]byte)
+	defer recordBuffers.Put(scratch)
+	pending := scratch[:0]
+	for _, b := range bufs {
+		for len(b) > 0 {
+			whole := len(b) - len(b)%SSLRecordSize
+			if len(pending) == 0 && whole > 0 {
+				// whole records need no gathering
+				n, err := c.writeAll(b[:whole], false)
+				written += n
+				if err != nil {
+					return written, err
+				}
+				b = b[whole:]
+				continue
+			}
+			n := copy(scratch[len(pending):], b)
+			pending = scratch[:len(pending)+n]
+			b = b[n:]
+			if len(pending) == SSLRecordSize {
+				n, err := c.writeAll(pending, false)
+				written += n
+				if err != nil {
+					return written, err
+				}
+				pending = scratch[:0]
+			}
+		}
 	}
-	err = tryAgain
+	if len(pending) > 0 {
+		n, err := c.writeAll(pending, false)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, c.flushOutputBuffer()
+}
+
+// copyBufferSize is the size of the buffers ReadFrom and WriteTo copy
+// through, several records so that each full buffer is written as whole
+// records.
+const copyBufferSize = 4 * SSLRecordSize
+
+// copyBuffers holds the buffers ReadFrom and WriteTo copy through, rather
+// than each io.Copy allocating its own.
+var copyBuffers = sync.Pool{
+	New: func() interface{} { return new([copyBufferSize]byte) }}
+
+// readFrom writes everything read from r to the connection.
+func (c *Conn) readFrom(r io.Reader) (int64, error) {
+	buf := copyBuffers.Get().(*[copyBufferSize]byte)
+	defer copyBuffers.Put(buf)
+	var written int64
+	for {
+		n, err := r.Read(buf[:])
+		if n > 0 {
+			m, err := c.Write(buf[:n])
+			written += int64(m)
+			if err != nil {
+				return written, err
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// WriteTo writes what is read from the connection to w until the peer
+// closes it, as with io.Copy, through a pooled buffer several records long
+// rather than a buffer per call.
+func (c *Conn) WriteTo(w io.Writer) (int64, error) {
+	buf := copyBuffers.Get().(*[copyBufferSize]byte)
+	defer copyBuffers.Put(buf)
+	var written int64
+	for {
+		n, err := c.Read(buf[:])
+		if n > 0 {
+			m, err := w.Write(buf[:n])
+			written += int64(m)
+			if err != nil {
+				return written, err
+			}
+			if m < n {
+				return written, io.ErrShortWrite
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// writeAll encrypts all of b, flushing the output buffer after each SSL
+// write if flush is set.
+func (c *Conn) writeAll(b []byte, flush bool) (written int, err error) {
+	if ktls, n, err := c.ktlsWrite(b); ktls {
+		return n, err
+	}
+	for len(b) > 0 {
+		// with EnablePartialWrite, each write may only take some of b
+		n, err := c.writeOnce(b, flush)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (c *Conn) writeOnce(b []byte, flush bool) (int, error) {
+	// retries must repeat the same write, so size it once
+	c.mtx.Lock()
+	b = b[:c.nextRecordSize(len(b))]
+	c.mtx.Unlock()
+	err := tryAgain
 	for err == tryAgain {
 		n, errcb := c.write(b)
 		err = c.handleError(errcb)
 		if err == nil {
+			if !flush {
+				return n, nil
+			}
 			return n, c.flushOutputBuffer()
 		}
 	}
@@ -542,18 +1347,30 @@ func (c *Conn) RemoteAddr() net.Addr {
 	return c.conn.RemoteAddr()
 }
 
-// SetDeadline calls SetDeadline on the underlying connection.
+// SetDeadline calls SetDeadline on the underlying connection. Handshake, Read,
+// Write and Close all read from and write to the underlying connection, so
+// the deadlines bound each of them, and a call that runs out of time returns
+// the underlying connection's timeout error, a net.Error. The connection can
+// be used again after a timeout once the deadline is extended.
 func (c *Conn) SetDeadline(t time.Time) error {
+	c.deadline_mtx.Lock()
+	defer c.deadline_mtx.Unlock()
+	c.write_deadline = t
 	return c.conn.SetDeadline(t)
 }
 
-// SetReadDeadline calls SetReadDeadline on the underlying connection.
+// SetReadDeadline calls SetReadDeadline on the underlying connection. See
+// SetDeadline.
 func (c *Conn) SetReadDeadline(t time.Time) error {
 	return c.conn.SetReadDeadline(t)
 }
 
-// SetWriteDeadline calls SetWriteDeadline on the underlying connection.
+// SetWriteDeadline calls SetWriteDeadline on the underlying connection. See
+// SetDeadline.
 func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.deadline_mtx.Lock()
+	defer c.deadline_mtx.Unlock()
+	c.write_deadline = t
 	return c.conn.SetWriteDeadline(t)
 }
 
@@ -561,17 +1378,49 @@ func (c *Conn) UnderlyingConn() net.Conn {
 	return c.conn
 }
 
+// SyscallConn returns a raw network connection for the underlying
+// connection, for setting socket options such as TCP_NODELAY or keepalive,
+// or reaching its file descriptor. It implements syscall.Conn, and fails if
+// the underlying connection doesn't. Reading or writing through the raw
+// connection bypasses TLS and breaks the session.
+func (c *Conn) SyscallConn() (syscall.RawConn, error) {
+	sc, ok := c.conn.(syscall.Conn)
+	if !ok {
+		return nil, errors.New("underlying connection has no file descriptor")
+	}
+	return sc.SyscallConn()
+}
+
+// SetMode sets modes for this connection, in addition to those it inherited
+// from its context, and returns the resulting modes. It must be called before
+// the handshake. See Ctx.SetMode.
+func (c *Conn) SetMode(modes Modes) Modes {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return Modes(C.SSL_set_mode_not_a_macro(c.ssl, C.long(modes)))
+}
+
+// SetTlsExtHostName sets the server name a client sends with SNI, in place
+// of the ServerName of a context made by NewCtxFromTLSConfig. It must be
+// called before the handshake.
 func (c *Conn) SetTlsExtHostName(name string) error {
 	cname := C.CString(name)
 	defer C.free(unsafe.Pointer(cname))
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
 	if C.SSL_set_tlsext_host_name_not_a_macro(c.ssl, cname) == 0 {
 		return errorFromErrorQueue()
 	}
+	if c.ctx.verify_hostname {
+		return c.setVerifyHostname(name)
+	}
 	return nil
 }
 
 func (c *Conn) VerifyResult() VerifyResult {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
 	return VerifyResult(C.SSL_get_verify_result(c.ssl))
 }
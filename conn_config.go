@@ -0,0 +1,212 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <stdlib.h>
+#include <openssl/ssl.h>
+
+extern int SSL_set_alpn(SSL *ssl, const unsigned char *protos,
+    unsigned int len);
+
+// return -1 before OpenSSL 1.1.0, which has no version bounds
+static int OUR_SSL_set_min_proto_version(SSL *ssl, int version) {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+    return SSL_set_min_proto_version(ssl, version);
+#else
+    return -1;
+#endif
+}
+
+static int OUR_SSL_set_max_proto_version(SSL *ssl, int version) {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+    return SSL_set_max_proto_version(ssl, version);
+#else
+    return -1;
+#endif
+}
+
+static int OUR_SSL_set_ciphersuites(SSL *ssl, const char *str) {
+#if OPENSSL_VERSION_NUMBER >= 0x10101000L && !defined(OPENSSL_IS_BORINGSSL)
+    return SSL_set_ciphersuites(ssl, str);
+#else
+    return -1;
+#endif
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"runtime"
+	"unsafe"
+)
+
+// SetVerifyMode sets the verify mode of the connection in place of its
+// context's, keeping the context's verify callback, so that connections
+// with different needs can share a context. It overrides even the
+// verification of servers that contexts from NewCtxWithProfile and
+// NewCtxFromTLSConfig always do. It must be called before the handshake.
+func (c *Conn) SetVerifyMode(options VerifyOptions) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	C.SSL_set_verify(c.ssl, C.int(options), C.SSL_get_verify_callback(c.ssl))
+}
+
+// VerifyMode returns the verify mode of the connection.
+func (c *Conn) VerifyMode() VerifyOptions {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return VerifyOptions(C.SSL_get_verify_mode(c.ssl))
+}
+
+// SetCipherList sets the TLS 1.2 and older ciphers the connection may use
+// in place of its context's, see Ctx.SetCipherList. It must be called
+// before the handshake.
+func (c *Conn) SetCipherList(list string) error {
+	clist := C.CString(list)
+	defer C.free(unsafe.Pointer(clist))
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.SSL_set_cipher_list(c.ssl, clist) == 0 {
+		return errorFromErrorQueue()
+	}
+	if c.ctx.require_fips {
+		return c.checkFIPS()
+	}
+	return nil
+}
+
+// SetCipherSuites sets the TLS 1.3 cipher suites the connection may use in
+// place of its context's, see Ctx.SetCipherSuites. It must be called before
+// the handshake.
+func (c *Conn) SetCipherSuites(ciphersuites string) error {
+	cstr := C.CString(ciphersuites)
+	defer C.free(unsafe.Pointer(cstr))
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	switch C.OUR_SSL_set_ciphersuites(c.ssl, cstr) {
+	case 1:
+		if c.ctx.require_fips {
+			return c.checkFIPS()
+		}
+		return nil
+	case -1:
+		return errors.New("TLS 1.3 ciphersuites require OpenSSL 1.1.1 or " +
+			"newer, and are fixed in BoringSSL")
+	default:
+		return errorFromErrorQueue()
+	}
+}
+
+// SetAlpnProtos sets the application protocols the connection negotiates
+// with ALPN in place of its context's: clients offer protos, and servers
+// pick the first of them that the client also offers, ahead of the
+// context's list and AlpnSelectCallback. An empty list goes back to the
+// context's. It must be called before the handshake.
+func (c *Conn) SetAlpnProtos(protos []string) error {
+	wire, err := marshalProtocolList(protos)
+	if err != nil {
+		return err
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.SSL_is_server(c.ssl) != 0 {
+		// servers select through the context's callback, which then has to
+		// be installed
+		if err := c.ctx.enableConnAlpnProtos(); err != nil {
+			return err
+		}
+	} else if len(wire) == 0 {
+		// SSL_set_alpn_protos can't go back to the context's list
+		return c.setAlpnWire(c.ctx.alpnWire())
+	} else if err := c.setAlpnWire(wire); err != nil {
+		return err
+	}
+	c.alpn_protos = append([]string(nil), protos...)
+	if len(protos) == 0 {
+		c.alpn_protos = nil
+	}
+	return nil
+}
+
+func (c *Conn) setAlpnWire(wire []byte) error {
+	var wire_ptr *C.uchar
+	if len(wire) > 0 {
+		wire_ptr = (*C.uchar)(unsafe.Pointer(&wire[0]))
+	}
+	switch C.SSL_set_alpn(c.ssl, wire_ptr, C.uint(len(wire))) {
+	case 1:
+		return nil
+	case -1:
+		return alpnUnsupported
+	default:
+		return errorFromErrorQueue()
+	}
+}
+
+var connProtoVersionsUnsupported = errors.New(
+	"per-connection protocol versions require OpenSSL 1.1.0 or newer")
+
+// SetMinProtoVersion sets the oldest protocol version the connection
+// accepts, in place of its context's, with AnyVersion for the oldest the
+// library supports. It requires OpenSSL 1.1.0 or newer, and must be called
+// before the handshake.
+func (c *Conn) SetMinProtoVersion(version SSLVersion) error {
+	return c.setProtoVersion(version, func(wire C.int) C.int {
+		return C.OUR_SSL_set_min_proto_version(c.ssl, wire)
+	})
+}
+
+// SetMaxProtoVersion sets the newest protocol version the connection
+// accepts, in place of its context's, with AnyVersion for the newest the
+// library supports. See SetMinProtoVersion.
+func (c *Conn) SetMaxProtoVersion(version SSLVersion) error {
+	return c.setProtoVersion(version, func(wire C.int) C.int {
+		return C.OUR_SSL_set_max_proto_version(c.ssl, wire)
+	})
+}
+
+func (c *Conn) setProtoVersion(version SSLVersion,
+	set func(wire C.int) C.int) error {
+	i, err := protoVersionIndex(version)
+	if err != nil {
+		return err
+	}
+	var wire C.int
+	if i >= 0 {
+		wire = protoVersions[i].wire
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	switch set(wire) {
+	case 1:
+		return nil
+	case -1:
+		return connProtoVersionsUnsupported
+	default:
+		return errorFromErrorQueue()
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConnOverrides(t *testing.T) {
+	key := generateTestRSAKey(t)
+	ca := issueTestCert(t, key, testCert{})
+	server_ctx := newSharedCtx(t, key, ca, ca)
+	// the client would reject the server, which it doesn't trust
+	client_ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client_ctx.SetVerifyMode(VerifyPeer)
+	for _, ctx := range []*Ctx{server_ctx, client_ctx} {
+		if err := ctx.SetAlpnProtos([]string{"http/1.1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server_conn, client_conn := NetPipe(t)
+	defer server_conn.Close()
+	defer client_conn.Close()
+	server_conn.SetDeadline(time.Now().Add(10 * time.Second))
+	client_conn.SetDeadline(time.Now().Add(10 * time.Second))
+	server, err := Server(server_conn, server_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := Client(client_conn, client_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetVerifyMode(VerifyNone)
+	if client.VerifyMode() != VerifyNone {
+		t.Fatalf("unexpected verify mode %d", client.VerifyMode())
+	}
+	if err := client.SetMaxProtoVersion(TLSv1_2); err != nil {
+		t.Fatal(err)
+	}
+	cipher := "ECDHE-RSA-AES128-GCM-SHA256"
+	if err := client.SetCipherList(cipher); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetAlpnProtos([]string{"h2", "http/1.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.SetAlpnProtos([]string{"h2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	server_errs := make(chan error, 1)
+	go func() { server_errs <- server.Handshake() }()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-server_errs; err != nil {
+		t.Fatal(err)
+	}
+	if client.Version() != TLSv1_2 {
+		t.Fatalf("unexpected version %v", client.Version())
+	}
+	if name, _ := client.CurrentCipher(); name != cipher {
+		t.Fatalf("unexpected cipher %s", name)
+	}
+	if client.NegotiatedProtocol() != "h2" {
+		t.Fatalf("unexpected protocol %q", client.NegotiatedProtocol())
+	}
+}
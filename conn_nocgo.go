@@ -0,0 +1,310 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !cgo
+
+package openssl
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	SSLRecordSize = 16 * 1024
+)
+
+type Conn struct {
+	conn   net.Conn
+	tls    *tls.Conn
+	ctx    *Ctx
+	config *tls.Config
+
+	mtx         sync.Mutex
+	verify_host string
+	counted     bool
+	is_shutdown bool
+}
+
+// newConn wraps conn with a copy of ctx's configuration, verifying peers
+// the way ctx says.
+func newConn(conn net.Conn, ctx *Ctx, is_server bool) *Conn {
+	ctx.mtx.Lock()
+	config := ctx.config.Clone()
+	ctx.mtx.Unlock()
+	if !ctx.from_config {
+		config.RootCAs = ctx.store.pool
+		config.ClientCAs = ctx.store.pool
+	}
+	c := &Conn{conn: conn, ctx: ctx, config: config}
+	next := config.VerifyConnection
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		if err := c.verifyPeer(state, is_server); err != nil {
+			return err
+		}
+		if next != nil {
+			return next(state)
+		}
+		return nil
+	}
+	if is_server {
+		c.tls = tls.Server(conn, config)
+	} else {
+		c.tls = tls.Client(conn, config)
+	}
+	atomic.AddInt64(&statActiveConns, 1)
+	return c
+}
+
+// verifyPeer checks the peer's certificate as OpenSSL would with the
+// context's verify mode, and against the name set with SetVerifyHostname.
+// Contexts from NewCtxFromTLSConfig have crypto/tls verify the chain.
+func (c *Conn) verifyPeer(state tls.ConnectionState, is_server bool) error {
+	c.mtx.Lock()
+	host := c.verify_host
+	c.mtx.Unlock()
+	var raw [][]byte
+	for _, cert := range state.PeerCertificates {
+		raw = append(raw, cert.Raw)
+	}
+	if c.ctx.from_config || c.ctx.verify_mode&VerifyPeer == 0 ||
+		(is_server && len(raw) == 0) {
+		if host == "" || len(raw) == 0 {
+			return nil
+		}
+		return (&Certificate{x509: state.PeerCertificates[0]}).
+			VerifyHostname(host)
+	}
+	usage := x509.ExtKeyUsageServerAuth
+	if is_server {
+		usage = x509.ExtKeyUsageClientAuth
+	}
+	err := verifyChain(raw, c.config.RootCAs, usage, host)
+	verify_cb := c.ctx.verify_cb
+	if verify_cb == nil {
+		return err
+	}
+	for depth := len(raw) - 1; depth >= 0; depth-- {
+		store := &CertificateStoreCtx{
+			cert:  &Certificate{x509: state.PeerCertificates[depth]},
+			depth: depth,
+			err:   err}
+		if !verify_cb(err == nil, store) {
+			if err == nil {
+				err = errors.New("certificate rejected by verify callback")
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Client wraps an existing stream connection and puts it in the connect state
+// for any subsequent handshakes. Like Client in the cgo build, it doesn't set
+// up SNI for you like Dial does, unless the context came from
+// NewCtxFromTLSConfig with a ServerName.
+func Client(conn net.Conn, ctx *Ctx) (*Conn, error) {
+	return newConn(conn, ctx, false), nil
+}
+
+// Server wraps an existing stream connection and puts it in the accept state
+// for any subsequent handshakes.
+func Server(conn net.Conn, ctx *Ctx) (*Conn, error) {
+	return newConn(conn, ctx, true), nil
+}
+
+// Handshake performs an SSL handshake. If a handshake is not manually
+// triggered, it will run before the first I/O on the encrypted stream.
+func (c *Conn) Handshake() error {
+	err := c.tls.Handshake()
+	if err == nil {
+		c.countHandshake()
+	}
+	return err
+}
+
+// countHandshake counts the connection's handshake once it has completed,
+// whether Handshake or the first Read or Write performed it.
+func (c *Conn) countHandshake() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if !c.counted {
+		c.counted = true
+		atomic.AddInt64(&statHandshakes, 1)
+	}
+}
+
+// PeerCertificate returns the Certificate of the peer with which you're
+// communicating. Only valid after a handshake.
+func (c *Conn) PeerCertificate() (*Certificate, error) {
+	certs := c.tls.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, errors.New("no peer certificate found")
+	}
+	return &Certificate{x509: certs[0]}, nil
+}
+
+// PeerCertificateChain returns the certificate chain of the peer, its own
+// certificate first.
+func (c *Conn) PeerCertificateChain() (rv []*Certificate, err error) {
+	certs := c.tls.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, errors.New("no peer certificates found")
+	}
+	for _, cert := range certs {
+		rv = append(rv, &Certificate{x509: cert})
+	}
+	return rv, nil
+}
+
+// Version returns the protocol version negotiated on the connection, or 0
+// before the handshake has completed.
+func (c *Conn) Version() SSLVersion {
+	state := c.tls.ConnectionState()
+	if !state.HandshakeComplete {
+		return 0
+	}
+	for version, wire := range tlsVersions {
+		if wire == state.Version {
+			return version
+		}
+	}
+	return 0
+}
+
+// NegotiatedProtocol returns the application protocol chosen with ALPN, or ""
+// if none was. It is only meaningful once the handshake has completed.
+func (c *Conn) NegotiatedProtocol() string {
+	return c.tls.ConnectionState().NegotiatedProtocol
+}
+
+// Close shuts down the SSL connection and closes the underlying wrapped
+// connection.
+func (c *Conn) Close() error {
+	c.mtx.Lock()
+	if !c.is_shutdown {
+		c.is_shutdown = true
+		atomic.AddInt64(&statActiveConns, -1)
+	}
+	c.mtx.Unlock()
+	return c.tls.Close()
+}
+
+// CloseWrite sends close_notify, telling the peer no more data follows,
+// while leaving the connection open for reading.
+func (c *Conn) CloseWrite() error {
+	return c.tls.CloseWrite()
+}
+
+// Read reads up to len(b) bytes into b. It returns the number of bytes read
+// and an error if applicable. io.EOF is returned when the caller can expect
+// to see no more data.
+func (c *Conn) Read(b []byte) (n int, err error) {
+	n, err = c.tls.Read(b)
+	if err == nil {
+		c.countHandshake()
+	}
+	return n, err
+}
+
+// Write will encrypt the contents of b and write it to the underlying stream.
+func (c *Conn) Write(b []byte) (written int, err error) {
+	written, err = c.tls.Write(b)
+	if err == nil {
+		c.countHandshake()
+	}
+	return written, err
+}
+
+// VerifyHostname pulls the PeerCertificate and calls VerifyHostname on the
+// certificate.
+func (c *Conn) VerifyHostname(host string) error {
+	cert, err := c.PeerCertificate()
+	if err != nil {
+		return err
+	}
+	return cert.VerifyHostname(host)
+}
+
+// SetVerifyHostname sets the name or IP address the peer certificate must
+// be issued for, checked while it is verified during the handshake. Call it
+// before the handshake.
+func (c *Conn) SetVerifyHostname(host string) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.verify_host = host
+	return nil
+}
+
+// SetTlsExtHostName sets the server name sent with SNI. Call it before the
+// handshake.
+func (c *Conn) SetTlsExtHostName(name string) error {
+	c.config.ServerName = name
+	return nil
+}
+
+// SetSessionKey is accepted for compatibility with the cgo build; crypto/tls
+// files client sessions under the server name, or else the address, itself.
+func (c *Conn) SetSessionKey(key string) error {
+	if key == "" {
+		return errors.New("empty session key")
+	}
+	return nil
+}
+
+// LocalAddr returns the underlying connection's local address
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the underlying connection's remote address
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// SetDeadline calls SetDeadline on the underlying connection.
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+// SetReadDeadline calls SetReadDeadline on the underlying connection.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline calls SetWriteDeadline on the underlying connection.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+func (c *Conn) UnderlyingConn() net.Conn {
+	return c.conn
+}
+
+// SyscallConn returns a raw network connection for the underlying
+// connection, for setting socket options. It fails if the underlying
+// connection doesn't implement syscall.Conn.
+func (c *Conn) SyscallConn() (syscall.RawConn, error) {
+	sc, ok := c.conn.(syscall.Conn)
+	if !ok {
+		return nil, errors.New("underlying connection has no file descriptor")
+	}
+	return sc.SyscallConn()
+}
@@ -0,0 +1,151 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+)
+
+// FromStdlibPrivateKey converts a private key from the standard library
+// (*rsa.PrivateKey, *ecdsa.PrivateKey or ed25519.PrivateKey) into a
+// PrivateKey that can be handed to Ctx.UsePrivateKey.
+func FromStdlibPrivateKey(key crypto.PrivateKey) (PrivateKey, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey:
+	case *ed25519.PrivateKey:
+		key = *k
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return LoadPrivateKeyFromDER(der)
+}
+
+// FromStdlibPublicKey converts a public key from the standard library
+// (*rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey) into a PublicKey.
+func FromStdlibPublicKey(pub crypto.PublicKey) (PublicKey, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	return LoadPublicKeyFromDER(der)
+}
+
+// ToStdlibPublicKey converts a PublicKey into the equivalent standard
+// library type, one of *rsa.PublicKey, *ecdsa.PublicKey or
+// ed25519.PublicKey depending on the algorithm of the key.
+func ToStdlibPublicKey(key PublicKey) (crypto.PublicKey, error) {
+	der, err := key.MarshalPKIXPublicKeyDER()
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParsePKIXPublicKey(der)
+}
+
+// FromStdlibCertificate converts a certificate parsed by crypto/x509 into a
+// Certificate.
+func FromStdlibCertificate(cert *x509.Certificate) (*Certificate, error) {
+	return LoadCertificateFromDER(cert.Raw)
+}
+
+// ToStdlibCertificate parses cert with crypto/x509, so policy checks,
+// logging or pinning written against the standard library can be reused on
+// certificates from a Conn, such as those of PeerCertificateChain or
+// VerifiedChain.
+func ToStdlibCertificate(cert *Certificate) (*x509.Certificate, error) {
+	der, err := cert.MarshalDER()
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// ToStdlibCertificates is ToStdlibCertificate for a whole chain.
+func ToStdlibCertificates(certs []*Certificate) ([]*x509.Certificate,
+	error) {
+	rv := make([]*x509.Certificate, 0, len(certs))
+	for _, cert := range certs {
+		std, err := ToStdlibCertificate(cert)
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, std)
+	}
+	return rv, nil
+}
+
+// ToStdlibPrivateKey converts a PrivateKey into the equivalent standard
+// library type. The result is one of *rsa.PrivateKey, *ecdsa.PrivateKey or
+// ed25519.PrivateKey depending on the algorithm of the key.
+func ToStdlibPrivateKey(key PrivateKey) (crypto.PrivateKey, error) {
+	der, err := key.MarshalPKCS8PrivateKeyDER()
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParsePKCS8PrivateKey(der)
+}
+
+// ToRSAPrivateKey converts an RSA PrivateKey into the standard library type,
+// failing for keys of other types.
+func ToRSAPrivateKey(key PrivateKey) (*rsa.PrivateKey, error) {
+	std, err := ToStdlibPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	rsa_key, ok := std.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is %T, not an RSA key", std)
+	}
+	return rsa_key, nil
+}
+
+// ToECDSAPrivateKey converts an EC PrivateKey into the standard library
+// type, failing for keys of other types and for curves crypto/elliptic
+// doesn't implement.
+func ToECDSAPrivateKey(key PrivateKey) (*ecdsa.PrivateKey, error) {
+	std, err := ToStdlibPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	ec_key, ok := std.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is %T, not an ECDSA key", std)
+	}
+	return ec_key, nil
+}
+
+// ToEd25519PrivateKey converts an Ed25519 PrivateKey into the standard
+// library type, failing for keys of other types.
+func ToEd25519PrivateKey(key PrivateKey) (ed25519.PrivateKey, error) {
+	std, err := ToStdlibPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	ed_key, ok := std.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is %T, not an Ed25519 key", std)
+	}
+	return ed_key, nil
+}
@@ -0,0 +1,252 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStdlibPrivateKeyRoundTrip(t *testing.T) {
+	rsa_key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec_key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed_key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, std := range []interface{}{rsa_key, ec_key, ed_key} {
+		key, err := FromStdlibPrivateKey(std)
+		if err != nil {
+			t.Fatalf("%T: %s", std, err)
+		}
+		back, err := ToStdlibPrivateKey(key)
+		if err != nil {
+			t.Fatalf("%T: %s", std, err)
+		}
+		if reflect.TypeOf(back) != reflect.TypeOf(std) {
+			t.Fatalf("expected %T, got %T", std, back)
+		}
+		if !back.(interface {
+			Equal(x crypto.PrivateKey) bool
+		}).Equal(std) {
+			t.Fatalf("%T: keys differ after round trip", std)
+		}
+	}
+}
+
+func TestStdlibPrivateKeyInCtx(t *testing.T) {
+	tls_cert, err := tls.X509KeyPair(certBytes, keyBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := FromStdlibPrivateKey(tls_cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := LoadCertificateFromPEM(certBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ctx.UseCertificate(cert); err != nil {
+		t.Fatal(err)
+	}
+	if err = ctx.UsePrivateKey(key); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = FromStdlibPrivateKey("not a key")
+	if err == nil {
+		t.Fatal("expected an error converting an unsupported type")
+	}
+}
+
+func TestStdlibVerifiedChain(t *testing.T) {
+	root_key := generateTestRSAKey(t)
+	root := issueTestCert(t, root_key, testCert{Serial: 1, Name: "root",
+		CA: true})
+	inter_key := generateTestRSAKey(t)
+	inter := issueTestCert(t, inter_key, testCert{Serial: 2,
+		Name: "intermediate", Issuer: root, IssuerKey: root_key, CA: true})
+	leaf_key := generateTestRSAKey(t)
+	leaf := issueTestCert(t, leaf_key, testCert{Serial: 3, Name: "leaf",
+		Issuer: inter, IssuerKey: inter_key})
+	server_ctx := newSharedCtx(t, leaf_key, leaf, inter)
+	client_ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client_ctx.GetCertificateStore().AddCertificate(root); err != nil {
+		t.Fatal(err)
+	}
+	client_ctx.SetVerifyMode(VerifyPeer)
+
+	server_conn, client_conn := NetPipe(t)
+	defer server_conn.Close()
+	defer client_conn.Close()
+	server_conn.SetDeadline(time.Now().Add(10 * time.Second))
+	client_conn.SetDeadline(time.Now().Add(10 * time.Second))
+	server, err := Server(server_conn, server_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := Client(client_conn, client_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	go server.Handshake()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+
+	chain, err := client.VerifiedChain()
+	if err != nil {
+		t.Skip(err)
+	}
+	checkChain(t, chain, leaf, inter, root)
+	std, err := ToStdlibCertificates(chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range []string{"leaf", "intermediate", "root"} {
+		if std[i].Subject.CommonName != name {
+			t.Fatalf("expected %q at depth %d, got %q", name, i,
+				std[i].Subject.CommonName)
+		}
+	}
+	if err := std[0].CheckSignatureFrom(std[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	back, err := FromStdlibCertificate(std[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkChain(t, []*Certificate{back}, leaf)
+}
+
+func TestTypedKeyConverters(t *testing.T) {
+	rsa_key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec_key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed_key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := FromStdlibPrivateKey(rsa_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsa_back, err := ToRSAPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rsa_back.Equal(rsa_key) {
+		t.Fatal("RSA keys differ after round trip")
+	}
+	if _, err := ToECDSAPrivateKey(key); err == nil {
+		t.Fatal("expected an error converting an RSA key to ECDSA")
+	}
+	pub, err := ToStdlibPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rsa_key.PublicKey.Equal(pub) {
+		t.Fatal("RSA public keys differ")
+	}
+
+	key, err = FromStdlibPrivateKey(ec_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec_back, err := ToECDSAPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ec_back.Equal(ec_key) {
+		t.Fatal("ECDSA keys differ after round trip")
+	}
+	if _, err := ToEd25519PrivateKey(key); err == nil {
+		t.Fatal("expected an error converting an ECDSA key to Ed25519")
+	}
+
+	key, err = FromStdlibPrivateKey(ed_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed_back, err := ToEd25519PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ed_back.Equal(ed_key) {
+		t.Fatal("Ed25519 keys differ after round trip")
+	}
+	if _, err := ToRSAPrivateKey(key); err == nil {
+		t.Fatal("expected an error converting an Ed25519 key to RSA")
+	}
+	ed_pub, err := FromStdlibPublicKey(ed_key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err = ToStdlibPublicKey(ed_pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ed_key.Public().(ed25519.PublicKey).Equal(pub) {
+		t.Fatal("Ed25519 public keys differ")
+	}
+
+	cert, err := LoadCertificateFromPEM(certBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	std, err := ToStdlibCertificate(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	back, err := FromStdlibCertificate(std)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkChain(t, []*Certificate{back}, cert)
+}
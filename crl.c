@@ -0,0 +1,72 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+#include <openssl/ssl.h>
+#include <openssl/x509.h>
+#include "_cgo_export.h"
+
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+
+#if OPENSSL_VERSION_NUMBER >= 0x30000000L
+static STACK_OF(X509_CRL) *lookup_crls_cb(const X509_STORE_CTX *store,
+		const X509_NAME *name) {
+#else
+static STACK_OF(X509_CRL) *lookup_crls_cb(X509_STORE_CTX *store,
+		X509_NAME *name) {
+#endif
+	// start with whatever the store itself holds
+	STACK_OF(X509_CRL) *crls = X509_STORE_CTX_get1_crls(store, name);
+	SSL *ssl = X509_STORE_CTX_get_ex_data((X509_STORE_CTX *)store,
+		SSL_get_ex_data_X509_STORE_CTX_idx());
+	if (ssl == NULL)
+		return crls;
+	if (crls == NULL) {
+		crls = sk_X509_CRL_new_null();
+		if (crls == NULL)
+			return NULL;
+	}
+	crl_lookup_thunk(SSL_CTX_get_ex_data(SSL_get_SSL_CTX(ssl),
+		get_ssl_ctx_idx()), (X509_NAME *)name, crls);
+	return crls;
+}
+
+int X509_STORE_set_crl_lookup(X509_STORE *store) {
+	X509_STORE_set_lookup_crls(store, lookup_crls_cb);
+	return 1;
+}
+
+int sk_X509_CRL_push_if_issuer(STACK_OF(X509_CRL) *crls, X509_CRL *crl,
+		X509_NAME *name) {
+	if (X509_NAME_cmp(X509_CRL_get_issuer(crl), name) != 0)
+		return 0;
+	if (sk_X509_CRL_push(crls, crl) <= 0)
+		return 0;
+	// the stack is freed with X509_CRL_free by the verifier
+	X509_CRL_up_ref(crl);
+	return 1;
+}
+
+#else
+
+int X509_STORE_set_crl_lookup(X509_STORE *store) {
+	return -1;
+}
+
+int sk_X509_CRL_push_if_issuer(STACK_OF(X509_CRL) *crls, X509_CRL *crl,
+		X509_NAME *name) {
+	return 0;
+}
+
+#endif
@@ -0,0 +1,699 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <stdlib.h>
+#include <string.h>
+#include <openssl/err.h>
+#include <openssl/ssl.h>
+#include <openssl/pem.h>
+#include <openssl/x509v3.h>
+
+extern int X509_STORE_set_crl_lookup(X509_STORE *store);
+extern int sk_X509_CRL_push_if_issuer(STACK_OF(X509_CRL) *crls,
+    X509_CRL *crl, X509_NAME *name);
+extern const unsigned char *ASN1_STRING_get0_data_not_a_macro(
+    const ASN1_STRING *s);
+extern const ASN1_TIME *OUR_X509_CRL_get0_lastUpdate(const X509_CRL *crl);
+extern const ASN1_TIME *OUR_X509_CRL_get0_nextUpdate(const X509_CRL *crl);
+extern int X509_CRL_check_issuer(X509_CRL *crl, X509 *issuer);
+
+static int OUR_X509_CRL_get0_by_cert(X509_CRL *crl, X509 *x) {
+    X509_REVOKED *revoked;
+    return X509_CRL_get0_by_cert(crl, &revoked, x);
+}
+
+static void OUR_X509_CRL_up_ref(X509_CRL *crl) {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+    X509_CRL_up_ref(crl);
+#else
+    CRYPTO_add(&crl->references, 1, CRYPTO_LOCK_X509_CRL);
+#endif
+}
+
+static STACK_OF(DIST_POINT) *X509_get_crl_dist_points(X509 *x) {
+    return X509_get_ext_d2i(x, NID_crl_distribution_points, NULL, NULL);
+}
+
+// returns the idx'th URI among the full names of dps, or NULL
+static const char *DIST_POINTS_get_uri(STACK_OF(DIST_POINT) *dps, int idx,
+        int *len) {
+    int i, j;
+    for (i = 0; i < sk_DIST_POINT_num(dps); i++) {
+        DIST_POINT *dp = sk_DIST_POINT_value(dps, i);
+        GENERAL_NAMES *names;
+        if (dp->distpoint == NULL || dp->distpoint->type != 0)
+            continue;
+        names = dp->distpoint->name.fullname;
+        for (j = 0; j < sk_GENERAL_NAME_num(names); j++) {
+            GENERAL_NAME *gn = sk_GENERAL_NAME_value(names, j);
+            if (gn->type != GEN_URI || idx-- > 0)
+                continue;
+            *len = ASN1_STRING_length(gn->d.uniformResourceIdentifier);
+            return (const char *)ASN1_STRING_get0_data_not_a_macro(
+                gn->d.uniformResourceIdentifier);
+        }
+    }
+    return NULL;
+}
+
+// parses a CRL in either DER or PEM form
+static X509_CRL *X509_CRL_from_buf(const unsigned char *buf, long len) {
+    BIO *bio;
+    X509_CRL *crl;
+    if (len < 5 || memcmp(buf, "-----", 5) != 0)
+        return d2i_X509_CRL(NULL, &buf, len);
+    bio = BIO_new_mem_buf((void *)buf, len);
+    if (bio == NULL)
+        return NULL;
+    crl = PEM_read_bio_X509_CRL(bio, NULL, NULL, NULL);
+    BIO_free(bio);
+    return crl;
+}
+*/
+import "C"
+
+import (
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+var (
+	// CRLRetryInterval is how long a CRLManager waits before trying again
+	// after failing to refresh a CRL.
+	CRLRetryInterval = time.Minute
+	// CRLDefaultRefreshInterval is how often a CRLManager refreshes CRLs that
+	// don't say when the next update is due.
+	CRLDefaultRefreshInterval = time.Hour
+)
+
+// CRLRevoked is returned by CRLManager.Check when a CRL lists a certificate
+// as revoked.
+var CRLRevoked = errors.New("openssl: certificate is revoked by its CRL")
+
+// maxCRLSize bounds the CRLs we are willing to read. Large CAs publish CRLs
+// of several megabytes.
+const maxCRLSize = 32 << 20
+
+// CRL is a certificate revocation list, which can be added to a
+// CertificateStore to check peer certificates against it.
+type CRL struct {
+	crl *C.X509_CRL
+}
+
+func newCRL(crl *C.X509_CRL) *CRL {
+	c := &CRL{crl: crl}
+	runtime.SetFinalizer(c, func(c *CRL) {
+		C.X509_CRL_free(c.crl)
+	})
+	return c
+}
+
+// LoadCRLFromPEM loads the first CRL in a PEM-encoded block.
+func LoadCRLFromPEM(pem_block []byte) (*CRL, error) {
+	if len(pem_block) == 0 {
+		return nil, errors.New("empty pem block")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	bio := C.BIO_new_mem_buf(unsafe.Pointer(&pem_block[0]),
+		C.int(len(pem_block)))
+	crl := C.PEM_read_bio_X509_CRL(bio, nil, nil, nil)
+	C.BIO_free(bio)
+	if crl == nil {
+		return nil, errorFromErrorQueue()
+	}
+	return newCRL(crl), nil
+}
+
+// LoadCRLFromDER loads a DER-encoded CRL.
+func LoadCRLFromDER(der_block []byte) (*CRL, error) {
+	if len(der_block) == 0 {
+		return nil, errors.New("empty der block")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	bio := C.BIO_new_mem_buf(unsafe.Pointer(&der_block[0]),
+		C.int(len(der_block)))
+	crl := C.d2i_X509_CRL_bio(bio, nil)
+	C.BIO_free(bio)
+	if crl == nil {
+		return nil, errorFromErrorQueue()
+	}
+	return newCRL(crl), nil
+}
+
+// MarshalPEM converts the CRL to PEM-encoded format.
+func (c *CRL) MarshalPEM() (pem_block []byte, err error) {
+	defer runtime.KeepAlive(c)
+	bio := C.BIO_new(C.BIO_s_mem())
+	if bio == nil {
+		return nil, errors.New("failed to allocate memory BIO")
+	}
+	defer C.BIO_free(bio)
+	if C.PEM_write_bio_X509_CRL(bio, c.crl) != 1 {
+		return nil, errors.New("failed dumping crl pem")
+	}
+	return ioutil.ReadAll(asAnyBio(bio))
+}
+
+// MarshalDER converts the CRL to DER-encoded format.
+func (c *CRL) MarshalDER() (der_block []byte, err error) {
+	defer runtime.KeepAlive(c)
+	bio := C.BIO_new(C.BIO_s_mem())
+	if bio == nil {
+		return nil, errors.New("failed to allocate memory BIO")
+	}
+	defer C.BIO_free(bio)
+	if C.i2d_X509_CRL_bio(bio, c.crl) != 1 {
+		return nil, errors.New("failed dumping crl der")
+	}
+	return ioutil.ReadAll(asAnyBio(bio))
+}
+
+// AddCRL adds crl to the store. Peer certificates are only checked against
+// it once CRL checking is turned on with SetFlags.
+func (s *CertificateStore) AddCRL(crl *CRL) error {
+	defer runtime.KeepAlive(s)
+	defer runtime.KeepAlive(crl)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.X509_STORE_add_crl(s.store, crl.crl) != 1 {
+		return errorFromErrorQueue()
+	}
+	return nil
+}
+
+// LoadCRLFile adds the CRLs in the file at path, either every CRL in a PEM
+// file or a single DER-encoded one, to the context's certificate store. Like
+// AddCRL, it doesn't turn on CRL checking; call
+// GetCertificateStore().SetFlags(CRLCheck) for that.
+func (c *Ctx) LoadCRLFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var crls []*CRL
+	if strings.HasPrefix(string(data), "-----") {
+		for {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				break
+			}
+			if block.Type != "X509 CRL" {
+				continue
+			}
+			crl, err := LoadCRLFromDER(block.Bytes)
+			if err != nil {
+				return err
+			}
+			crls = append(crls, crl)
+		}
+		if len(crls) == 0 {
+			return fmt.Errorf("no CRL found in %s", path)
+		}
+	} else {
+		crl, err := LoadCRLFromDER(data)
+		if err != nil {
+			return err
+		}
+		crls = append(crls, crl)
+	}
+	store := c.GetCertificateStore()
+	for _, crl := range crls {
+		if err := store.AddCRL(crl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// enableCRLLookup makes the context check peer certificates against the CRLs
+// installed with setCRLs, in addition to any in its certificate store.
+func (c *Ctx) enableCRLLookup() error {
+	c.crl_mtx.Lock()
+	defer c.crl_mtx.Unlock()
+	if c.crl_lookup_set {
+		return nil
+	}
+	store := C.SSL_CTX_get_cert_store(c.ctx)
+	if C.X509_STORE_set_crl_lookup(store) != 1 {
+		return errors.New("CRL lookup requires OpenSSL 1.1.0 or later")
+	}
+	C.X509_STORE_set_flags(store, C.X509_V_FLAG_CRL_CHECK)
+	c.crl_lookup_set = true
+	return nil
+}
+
+// setCRLs replaces the CRLs installed in the context. The context takes its
+// own references, so the caller may free crls afterwards. Handshakes already
+// verifying keep the CRLs they looked up.
+func (c *Ctx) setCRLs(crls []*C.X509_CRL) {
+	for _, crl := range crls {
+		C.OUR_X509_CRL_up_ref(crl)
+	}
+	c.crl_mtx.Lock()
+	old := c.crls
+	c.crls = append([]*C.X509_CRL(nil), crls...)
+	c.crl_mtx.Unlock()
+	for _, crl := range old {
+		C.X509_CRL_free(crl)
+	}
+}
+
+func (c *Ctx) freeCRLs() {
+	for _, crl := range c.crls {
+		C.X509_CRL_free(crl)
+	}
+	c.crls = nil
+}
+
+//export crl_lookup_thunk
+func crl_lookup_thunk(p unsafe.Pointer, name *C.X509_NAME,
+	crls *C.struct_stack_st_X509_CRL) {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Critf("openssl: CRL lookup callback panic'd: %v", err)
+			os.Exit(1)
+		}
+	}()
+	ctx := (*Ctx)(p)
+	ctx.crl_mtx.Lock()
+	defer ctx.crl_mtx.Unlock()
+	for _, crl := range ctx.crls {
+		C.sk_X509_CRL_push_if_issuer(crls, crl, name)
+	}
+}
+
+// CRLDistributionPoints returns the URIs of the CRLs covering the certificate,
+// as listed in its CRL Distribution Points extension.
+func (c *Certificate) CRLDistributionPoints() ([]string, error) {
+	x := c.acquireX509()
+	if x == nil {
+		return nil, certificateFreed
+	}
+	defer C.X509_free(x)
+	dps := C.X509_get_crl_dist_points(x)
+	if dps == nil {
+		return nil, nil
+	}
+	defer C.CRL_DIST_POINTS_free(dps)
+	var uris []string
+	for i := 0; ; i++ {
+		var n C.int
+		uri := C.DIST_POINTS_get_uri(dps, C.int(i), &n)
+		if uri == nil {
+			return uris, nil
+		}
+		uris = append(uris, C.GoStringN(uri, n))
+	}
+}
+
+// CRLManager keeps the CRLs a context checks peer certificates against
+// current. It downloads each CRL it is given, checks that it is signed by its
+// issuer, and refreshes it halfway to its next update, installing new CRLs
+// without disturbing handshakes in progress. If a refresh fails, the previous
+// CRL stays installed and the refresh is retried every CRLRetryInterval.
+//
+// Creating a CRLManager turns on CRL checking for the context's peer
+// verification, so a peer whose certificate's issuer has no CRL installed
+// fails verification with UnableToGetCrl. Only the peer certificate itself
+// is checked, not the rest of its chain. CRL management requires OpenSSL
+// 1.1.0 or later.
+//
+// A manager with no context only keeps its CRLs current for Check, as used
+// by RevocationTransport.
+type CRLManager struct {
+	ctx    *Ctx
+	client *http.Client
+
+	mtx     sync.Mutex
+	sources []*crlSource
+
+	wake    chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+type crlSource struct {
+	url    string
+	issuer *Certificate
+
+	// protected by the manager's mtx
+	crl         *C.X509_CRL
+	last_update time.Time
+	next_update time.Time
+	fetched     time.Time
+	err         error
+}
+
+// NewCRLManager starts managing the CRLs of ctx, fetching them with client,
+// or http.DefaultClient if it is nil. Add CRLs with AddURL or
+// AddCertificate. ctx may be nil, leaving CRL checking to Check.
+func NewCRLManager(ctx *Ctx, client *http.Client) (*CRLManager, error) {
+	if ctx != nil {
+		err := ctx.enableCRLLookup()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	m := &CRLManager{
+		ctx:     ctx,
+		client:  client,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{})}
+	go m.run()
+	return m, nil
+}
+
+// AddURL adds the CRL published at url, which must be issued by issuer. It is
+// fetched before AddURL returns; if that fails, the error is returned and the
+// fetch is retried in the background.
+func (m *CRLManager) AddURL(url string, issuer *Certificate) error {
+	src := &crlSource{url: url, issuer: issuer}
+	m.mtx.Lock()
+	m.sources = append(m.sources, src)
+	m.mtx.Unlock()
+	err := m.refresh(src)
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+	return err
+}
+
+// AddCertificate adds the CRLs named in the HTTP distribution points of cert,
+// whose issuer is issuer. Add a certificate issued by each CA whose
+// certificates peers may present; for intermediate CAs, their own
+// certificate names the CRL of the CA above. The first error from fetching
+// the CRLs is returned, as for AddURL.
+func (m *CRLManager) AddCertificate(cert, issuer *Certificate) error {
+	uris, err := cert.CRLDistributionPoints()
+	if err != nil {
+		return err
+	}
+	var first_err error
+	added := false
+	for _, uri := range uris {
+		if !strings.HasPrefix(uri, "http://") &&
+			!strings.HasPrefix(uri, "https://") {
+			continue
+		}
+		added = true
+		err := m.AddURL(uri, issuer)
+		if err != nil && first_err == nil {
+			first_err = err
+		}
+	}
+	if !added {
+		return errors.New("certificate names no HTTP CRL distribution point")
+	}
+	return first_err
+}
+
+// Refresh fetches, checks and installs every CRL right away, returning the
+// first error.
+func (m *CRLManager) Refresh() error {
+	m.mtx.Lock()
+	sources := append([]*crlSource(nil), m.sources...)
+	m.mtx.Unlock()
+	var first_err error
+	for _, src := range sources {
+		err := m.refresh(src)
+		if err != nil && first_err == nil {
+			first_err = err
+		}
+	}
+	return first_err
+}
+
+// Check returns nil if a current CRL issued by issuer covers leaf without
+// listing it, CRLRevoked if one lists it, and otherwise an error saying that
+// no CRL covers it.
+func (m *CRLManager) Check(leaf, issuer *Certificate) error {
+	leaf_x := leaf.acquireX509()
+	if leaf_x == nil {
+		return certificateFreed
+	}
+	defer C.X509_free(leaf_x)
+	issuer_x := issuer.acquireX509()
+	if issuer_x == nil {
+		return certificateFreed
+	}
+	defer C.X509_free(issuer_x)
+	now := time.Now()
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	covered := false
+	for _, src := range m.sources {
+		if src.crl == nil ||
+			(!src.next_update.IsZero() && !now.Before(src.next_update)) ||
+			C.X509_CRL_check_issuer(src.crl, issuer_x) != 1 {
+			continue
+		}
+		// a removeFromCRL entry (2) unrevokes the certificate
+		if C.OUR_X509_CRL_get0_by_cert(src.crl, leaf_x) == 1 {
+			return CRLRevoked
+		}
+		covered = true
+	}
+	C.ERR_clear_error()
+	if !covered {
+		return errors.New("no current CRL covers the certificate")
+	}
+	return nil
+}
+
+// Close stops refreshing. The CRLs last installed stay in place, and CRL
+// checking stays on.
+func (m *CRLManager) Close() error {
+	select {
+	case <-m.done:
+		return nil
+	default:
+	}
+	close(m.done)
+	<-m.stopped
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for _, src := range m.sources {
+		if src.crl != nil {
+			C.X509_CRL_free(src.crl)
+			src.crl = nil
+		}
+	}
+	m.sources = nil
+	return nil
+}
+
+func (m *CRLManager) run() {
+	defer close(m.stopped)
+	for {
+		timer := time.NewTimer(m.wait(time.Now()))
+		select {
+		case <-m.done:
+			timer.Stop()
+			return
+		case <-m.wake:
+			timer.Stop()
+			continue
+		case <-timer.C:
+		}
+		for _, src := range m.due(time.Now()) {
+			err := m.refresh(src)
+			if err != nil {
+				logger.Errorf("openssl: failed to refresh CRL from %s: %v",
+					src.url, err)
+			}
+		}
+	}
+}
+
+// refreshAt returns when src is next due to be refreshed. Called with mtx
+// held.
+func (src *crlSource) refreshAt() time.Time {
+	switch {
+	case src.err != nil || src.crl == nil:
+		return src.fetched.Add(CRLRetryInterval)
+	case src.next_update.IsZero():
+		return src.fetched.Add(CRLDefaultRefreshInterval)
+	default:
+		return src.fetched.Add(src.next_update.Sub(src.fetched) / 2)
+	}
+}
+
+// wait returns how long to wait until the next refresh is due.
+func (m *CRLManager) wait(now time.Time) time.Duration {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if len(m.sources) == 0 {
+		return CRLDefaultRefreshInterval
+	}
+	var until time.Duration
+	for i, src := range m.sources {
+		d := src.refreshAt().Sub(now)
+		if i == 0 || d < until {
+			until = d
+		}
+	}
+	if until < 0 {
+		until = 0
+	}
+	return until
+}
+
+func (m *CRLManager) due(now time.Time) (rv []*crlSource) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for _, src := range m.sources {
+		if !now.Before(src.refreshAt()) {
+			rv = append(rv, src)
+		}
+	}
+	return rv
+}
+
+// refresh fetches src's CRL and, if it checks out and is no older than the
+// one installed, installs it.
+func (m *CRLManager) refresh(src *crlSource) error {
+	crl, last_update, next_update, err := fetchCRL(m.client, src.url,
+		src.issuer)
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	src.fetched = time.Now()
+	if err == nil && src.crl != nil && last_update.Before(src.last_update) {
+		C.X509_CRL_free(crl)
+		err = errors.New("CRL is older than the one installed")
+	}
+	src.err = err
+	if err != nil {
+		return err
+	}
+	old := src.crl
+	src.crl = crl
+	src.last_update = last_update
+	src.next_update = next_update
+	var crls []*C.X509_CRL
+	for _, s := range m.sources {
+		if s.crl != nil {
+			crls = append(crls, s.crl)
+		}
+	}
+	if m.ctx != nil {
+		m.ctx.setCRLs(crls)
+	}
+	if old != nil {
+		C.X509_CRL_free(old)
+	}
+	return nil
+}
+
+// fetchCRL downloads the CRL at url and returns it after checking it, along
+// with when it was issued and when it is next due to be updated.
+func fetchCRL(client *http.Client, url string, issuer *Certificate) (
+	crl *C.X509_CRL, last_update, next_update time.Time, err error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, time.Time{}, time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, time.Time{}, time.Time{}, fmt.Errorf(
+			"CRL distribution point returned %s", resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxCRLSize))
+	if err != nil {
+		return nil, time.Time{}, time.Time{}, err
+	}
+	crl, err = parseCRL(data)
+	if err != nil {
+		return nil, time.Time{}, time.Time{}, err
+	}
+	last_update, next_update, err = checkCRL(crl, issuer, time.Now())
+	if err != nil {
+		C.X509_CRL_free(crl)
+		return nil, time.Time{}, time.Time{}, err
+	}
+	return crl, last_update, next_update, nil
+}
+
+func parseCRL(data []byte) (*C.X509_CRL, error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty CRL")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	crl := C.X509_CRL_from_buf((*C.uchar)(&data[0]), C.long(len(data)))
+	if crl == nil {
+		return nil, errorFromErrorQueue()
+	}
+	return crl, nil
+}
+
+// checkCRL checks that crl is signed by issuer and hasn't expired, and
+// returns its update times. next_update is the zero time if the CRL doesn't
+// say.
+func checkCRL(crl *C.X509_CRL, issuer *Certificate, now time.Time) (
+	last_update, next_update time.Time, err error) {
+	issuer_x := issuer.acquireX509()
+	if issuer_x == nil {
+		return time.Time{}, time.Time{}, certificateFreed
+	}
+	defer C.X509_free(issuer_x)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	switch C.X509_CRL_check_issuer(crl, issuer_x) {
+	case 1:
+	case 0:
+		return time.Time{}, time.Time{}, errors.New(
+			"CRL is not issued by the expected issuer")
+	default:
+		return time.Time{}, time.Time{}, errorFromErrorQueue()
+	}
+	last_update, err = asn1TimeToTime(C.OUR_X509_CRL_get0_lastUpdate(crl))
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if t := C.OUR_X509_CRL_get0_nextUpdate(crl); t != nil {
+		next_update, err = asn1TimeToTime(t)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		if !now.Before(next_update) {
+			return time.Time{}, time.Time{}, errors.New("CRL has expired")
+		}
+	}
+	return last_update, next_update, nil
+}
@@ -0,0 +1,430 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <openssl/err.h>
+#include <openssl/x509.h>
+#include <openssl/x509v3.h>
+
+const ASN1_TIME *OUR_X509_CRL_get0_lastUpdate(const X509_CRL *crl) {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+    return X509_CRL_get0_lastUpdate(crl);
+#else
+    return X509_CRL_get_lastUpdate(crl);
+#endif
+}
+
+const ASN1_TIME *OUR_X509_CRL_get0_nextUpdate(const X509_CRL *crl) {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+    return X509_CRL_get0_nextUpdate(crl);
+#else
+    return X509_CRL_get_nextUpdate(crl);
+#endif
+}
+
+// checks that crl was issued and signed by issuer
+int X509_CRL_check_issuer(X509_CRL *crl, X509 *issuer) {
+    EVP_PKEY *pkey;
+    int rv;
+    if (X509_NAME_cmp(X509_CRL_get_issuer(crl),
+            X509_get_subject_name(issuer)) != 0)
+        return 0;
+    pkey = X509_get_pubkey(issuer);
+    if (pkey == NULL)
+        return -1;
+    rv = X509_CRL_verify(crl, pkey);
+    EVP_PKEY_free(pkey);
+    return rv;
+}
+
+static int sk_X509_REVOKED_num_not_a_macro(STACK_OF(X509_REVOKED) *sk) {
+    return sk_X509_REVOKED_num(sk);
+}
+
+static X509_REVOKED *sk_X509_REVOKED_value_not_a_macro(
+        STACK_OF(X509_REVOKED) *sk, int i) {
+    return sk_X509_REVOKED_value(sk, i);
+}
+
+static ASN1_INTEGER *OUR_X509_REVOKED_get0_serialNumber(X509_REVOKED *r) {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+    return (ASN1_INTEGER *)X509_REVOKED_get0_serialNumber(r);
+#else
+    return r->serialNumber;
+#endif
+}
+
+static ASN1_TIME *OUR_X509_REVOKED_get0_revocationDate(X509_REVOKED *r) {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+    return (ASN1_TIME *)X509_REVOKED_get0_revocationDate(r);
+#else
+    return r->revocationDate;
+#endif
+}
+
+// returns the entry's reason code, -1 if it has none or -2 if it is invalid
+static long OUR_X509_REVOKED_get_reason(X509_REVOKED *r) {
+    int crit;
+    long rv;
+    ASN1_ENUMERATED *reason = X509_REVOKED_get_ext_d2i(r, NID_crl_reason,
+        &crit, NULL);
+    if (reason == NULL)
+        return crit == -1 ? -1 : -2;
+    rv = ASN1_ENUMERATED_get(reason);
+    ASN1_ENUMERATED_free(reason);
+    return rv;
+}
+
+static int OUR_X509_CRL_set_updates(X509_CRL *crl, ASN1_TIME *last,
+        ASN1_TIME *next) {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+    return X509_CRL_set1_lastUpdate(crl, last) &&
+        (next == NULL || X509_CRL_set1_nextUpdate(crl, next));
+#else
+    return X509_CRL_set_lastUpdate(crl, last) &&
+        (next == NULL || X509_CRL_set_nextUpdate(crl, next));
+#endif
+}
+
+static ASN1_INTEGER *OUR_X509_CRL_get_number(X509_CRL *crl) {
+    return X509_CRL_get_ext_d2i(crl, NID_crl_number, NULL, NULL);
+}
+
+// the entry takes copies of serial, date and reason, which stay the caller's
+static int OUR_X509_CRL_add_revoked(X509_CRL *crl, ASN1_INTEGER *serial,
+        ASN1_TIME *date, X509_EXTENSION *reason) {
+    X509_REVOKED *r = X509_REVOKED_new();
+    if (r == NULL)
+        return 0;
+    if (X509_REVOKED_set_serialNumber(r, serial) != 1 ||
+            X509_REVOKED_set_revocationDate(r, date) != 1 ||
+            (reason != NULL && X509_REVOKED_add_ext(r, reason, -1) != 1) ||
+            X509_CRL_add0_revoked(crl, r) != 1) {
+        X509_REVOKED_free(r);
+        return 0;
+    }
+    return 1;
+}
+
+static int X509_CRL_print_issuer(BIO *bio, X509_CRL *crl) {
+    return X509_NAME_print_ex(bio, X509_CRL_get_issuer(crl), 0,
+        XN_FLAG_RFC2253);
+}
+*/
+import "C"
+
+import (
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"runtime"
+	"time"
+)
+
+const (
+	crlNumberOid = "2.5.29.20"
+	crlReasonOid = "2.5.29.21"
+)
+
+// RevocationReason is the reason code of RFC 5280 section 5.3.1 for revoking
+// a certificate.
+type RevocationReason int
+
+const (
+	ReasonUnspecified          RevocationReason = 0
+	ReasonKeyCompromise        RevocationReason = 1
+	ReasonCACompromise         RevocationReason = 2
+	ReasonAffiliationChanged   RevocationReason = 3
+	ReasonSuperseded           RevocationReason = 4
+	ReasonCessationOfOperation RevocationReason = 5
+	ReasonCertificateHold      RevocationReason = 6
+	ReasonRemoveFromCRL        RevocationReason = 8
+	ReasonPrivilegeWithdrawn   RevocationReason = 9
+	ReasonAACompromise         RevocationReason = 10
+)
+
+// RevokedCertificate is an entry of a CRL.
+type RevokedCertificate struct {
+	Serial         *big.Int
+	RevocationTime time.Time
+	// Reason is ReasonUnspecified for entries without a reason code.
+	Reason RevocationReason
+}
+
+// CRLInfo describes a CRL to be issued with NewCRL.
+type CRLInfo struct {
+	// Number is the CRL's sequence number, which should increase with every
+	// CRL the issuer publishes. It is left out if nil.
+	Number *big.Int
+	// ThisUpdate defaults to now. NextUpdate, when the next CRL is due, is
+	// left out if zero.
+	ThisUpdate time.Time
+	NextUpdate time.Time
+}
+
+// NewCRL builds an empty, unsigned X509v2 CRL issued by issuer. Add entries
+// with AddRevoked and sign it with Sign before use.
+func NewCRL(info *CRLInfo, issuer *Certificate) (*CRL, error) {
+	this_update := info.ThisUpdate
+	if this_update.IsZero() {
+		this_update = time.Now()
+	}
+	if !info.NextUpdate.IsZero() && !info.NextUpdate.After(this_update) {
+		return nil, errors.New("next update is not after this update")
+	}
+	issuer_x := issuer.acquireX509()
+	if issuer_x == nil {
+		return nil, certificateFreed
+	}
+	defer C.X509_free(issuer_x)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	crl := C.X509_CRL_new()
+	if crl == nil {
+		return nil, errors.New("failed to allocate crl")
+	}
+	c := newCRL(crl)
+
+	if C.X509_CRL_set_version(crl, 1) != 1 {
+		return nil, errorFromErrorQueue()
+	}
+	if C.X509_CRL_set_issuer_name(crl,
+		C.X509_get_subject_name(issuer_x)) != 1 {
+		return nil, errorFromErrorQueue()
+	}
+	last, err := newASN1Time(this_update)
+	if err != nil {
+		return nil, err
+	}
+	defer C.ASN1_TIME_free(last)
+	var next *C.ASN1_TIME
+	if !info.NextUpdate.IsZero() {
+		next, err = newASN1Time(info.NextUpdate)
+		if err != nil {
+			return nil, err
+		}
+		defer C.ASN1_TIME_free(next)
+	}
+	if C.OUR_X509_CRL_set_updates(crl, last, next) != 1 {
+		return nil, errorFromErrorQueue()
+	}
+
+	if info.Number != nil {
+		if info.Number.Sign() < 0 {
+			return nil, errors.New("crl number must not be negative")
+		}
+		der, err := asn1.Marshal(info.Number)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.addExtensionDER(crlNumberOid, false, der); err != nil {
+			return nil, err
+		}
+	}
+	// so that relying parties can find the issuer by key as well as by name
+	aki, err := marshalAuthorityKeyId(issuer)
+	if err != nil {
+		return nil, err
+	}
+	if aki != nil {
+		if err := c.addExtensionDER(authorityKeyIdOid, false,
+			aki); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *CRL) addExtensionDER(oid string, critical bool,
+	value []byte) error {
+	defer runtime.KeepAlive(c)
+	ext, err := newX509Extension(oid, critical, value)
+	if err != nil {
+		return err
+	}
+	defer C.X509_EXTENSION_free(ext)
+	if C.X509_CRL_add_ext(c.crl, ext, -1) != 1 {
+		return errorFromErrorQueue()
+	}
+	return nil
+}
+
+// AddRevoked adds an entry revoking the certificate with serial at
+// revocation_time for reason. Entries with ReasonUnspecified have no reason
+// code, as RFC 5280 asks. Adding entries requires signing again.
+func (c *CRL) AddRevoked(serial *big.Int, revocation_time time.Time,
+	reason RevocationReason) error {
+	defer runtime.KeepAlive(c)
+	if reason < ReasonUnspecified || reason > ReasonAACompromise ||
+		reason == 7 {
+		return fmt.Errorf("invalid revocation reason %d", reason)
+	}
+	asn1_serial, err := newASN1Integer(serial)
+	if err != nil {
+		return err
+	}
+	defer C.ASN1_INTEGER_free(asn1_serial)
+	date, err := newASN1Time(revocation_time)
+	if err != nil {
+		return err
+	}
+	defer C.ASN1_TIME_free(date)
+	var ext *C.X509_EXTENSION
+	if reason != ReasonUnspecified {
+		der, err := asn1.Marshal(asn1.Enumerated(reason))
+		if err != nil {
+			return err
+		}
+		ext, err = newX509Extension(crlReasonOid, false, der)
+		if err != nil {
+			return err
+		}
+		defer C.X509_EXTENSION_free(ext)
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.OUR_X509_CRL_add_revoked(c.crl, asn1_serial, date, ext) != 1 {
+		return errorFromErrorQueue()
+	}
+	return nil
+}
+
+// Sign sorts the CRL's entries by serial number and signs it with the
+// issuer's private key using the given digest, e.g. SHA256_Method. The
+// digest is ignored for Ed25519 and Ed448 keys.
+func (c *CRL) Sign(key PrivateKey, digest Method) error {
+	defer runtime.KeepAlive(c)
+	if isEdDSAKey(key) {
+		digest = nil
+	}
+	pkey := key.acquirePKey()
+	if pkey == nil {
+		return keyFreed
+	}
+	defer C.EVP_PKEY_free(pkey)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.X509_CRL_sort(c.crl) != 1 {
+		return errorFromErrorQueue()
+	}
+	if C.X509_CRL_sign(c.crl, pkey, digest) <= 0 {
+		return errorFromErrorQueue()
+	}
+	return nil
+}
+
+// CheckSignature checks that the CRL was issued and signed by issuer.
+func (c *CRL) CheckSignature(issuer *Certificate) error {
+	defer runtime.KeepAlive(c)
+	issuer_x := issuer.acquireX509()
+	if issuer_x == nil {
+		return certificateFreed
+	}
+	defer C.X509_free(issuer_x)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	switch C.X509_CRL_check_issuer(c.crl, issuer_x) {
+	case 1:
+		return nil
+	case 0:
+		C.ERR_clear_error()
+		return errors.New("CRL is not issued by the expected issuer")
+	default:
+		return errorFromErrorQueue()
+	}
+}
+
+// Issuer returns the CRL's issuer name, in RFC 2253 form.
+func (c *CRL) Issuer() (string, error) {
+	defer runtime.KeepAlive(c)
+	bio := C.BIO_new(C.BIO_s_mem())
+	if bio == nil {
+		return "", errors.New("failed to allocate memory BIO")
+	}
+	defer C.BIO_free(bio)
+	if C.X509_CRL_print_issuer(bio, c.crl) < 0 {
+		return "", errors.New("failed to print issuer name")
+	}
+	name, err := ioutil.ReadAll(asAnyBio(bio))
+	return string(name), err
+}
+
+// ThisUpdate returns when the CRL was issued.
+func (c *CRL) ThisUpdate() (time.Time, error) {
+	defer runtime.KeepAlive(c)
+	return asn1TimeToTime(C.OUR_X509_CRL_get0_lastUpdate(c.crl))
+}
+
+// NextUpdate returns when the next CRL is due, or the zero time if the CRL
+// doesn't say.
+func (c *CRL) NextUpdate() (time.Time, error) {
+	defer runtime.KeepAlive(c)
+	t := C.OUR_X509_CRL_get0_nextUpdate(c.crl)
+	if t == nil {
+		return time.Time{}, nil
+	}
+	return asn1TimeToTime(t)
+}
+
+// Number returns the CRL's sequence number, or nil if it has none.
+func (c *CRL) Number() (*big.Int, error) {
+	defer runtime.KeepAlive(c)
+	number := C.OUR_X509_CRL_get_number(c.crl)
+	if number == nil {
+		return nil, nil
+	}
+	defer C.ASN1_INTEGER_free(number)
+	return asn1IntegerToBig(number)
+}
+
+// Revoked returns the CRL's entries, in order.
+func (c *CRL) Revoked() ([]RevokedCertificate, error) {
+	defer runtime.KeepAlive(c)
+	sk := C.X509_CRL_get_REVOKED(c.crl)
+	if sk == nil {
+		return nil, nil
+	}
+	n := int(C.sk_X509_REVOKED_num_not_a_macro(sk))
+	rv := make([]RevokedCertificate, 0, n)
+	for i := 0; i < n; i++ {
+		r := C.sk_X509_REVOKED_value_not_a_macro(sk, C.int(i))
+		serial, err := asn1IntegerToBig(
+			C.OUR_X509_REVOKED_get0_serialNumber(r))
+		if err != nil {
+			return nil, err
+		}
+		revocation_time, err := asn1TimeToTime(
+			C.OUR_X509_REVOKED_get0_revocationDate(r))
+		if err != nil {
+			return nil, err
+		}
+		entry := RevokedCertificate{Serial: serial,
+			RevocationTime: revocation_time}
+		switch reason := C.OUR_X509_REVOKED_get_reason(r); {
+		case reason == -2:
+			return nil, fmt.Errorf("invalid reason code for serial %s",
+				serial)
+		case reason >= 0:
+			entry.Reason = RevocationReason(reason)
+		}
+		rv = append(rv, entry)
+	}
+	return rv, nil
+}
@@ -0,0 +1,409 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// testCRLServer publishes a CRL generated by the openssl command line tool on
+// each request, from an index file in the format of openssl ca.
+type testCRLServer struct {
+	t      *testing.T
+	dir    string
+	server *httptest.Server
+}
+
+func newTestCRLServer(t *testing.T, ca *Certificate,
+	ca_key PrivateKey) *testCRLServer {
+	if _, err := exec.LookPath("openssl"); err != nil {
+		t.Skip("openssl command line tool not available")
+	}
+	dir, err := ioutil.TempDir("", "openssl-crl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca_pem, err := ca.MarshalPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key_pem, err := ca_key.MarshalPKCS1PrivateKeyPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := fmt.Sprintf("[ca]\ndefault_ca = test_ca\n[test_ca]\n"+
+		"database = %s/index.txt\ndefault_md = sha256\n"+
+		"default_crl_days = 1\n", dir)
+	for name, data := range map[string][]byte{
+		"ca.pem": ca_pem, "ca.key": key_pem, "ca.cnf": []byte(config),
+		"index.txt": nil} {
+		err := ioutil.WriteFile(dir+"/"+name, data, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &testCRLServer{t: t, dir: dir}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+func (s *testCRLServer) URL() string { return s.server.URL + "/ca.crl" }
+
+func (s *testCRLServer) Close() {
+	s.server.Close()
+	os.RemoveAll(s.dir)
+}
+
+// Revoke adds serial to the CRL.
+func (s *testCRLServer) Revoke(serial int) {
+	line := fmt.Sprintf("R\t%s\t%s\t%02X\tunknown\t/CN=localhost\n",
+		time.Now().Add(time.Hour).UTC().Format("060102150405Z"),
+		time.Now().UTC().Format("060102150405Z"), serial)
+	err := ioutil.WriteFile(s.dir+"/index.txt", []byte(line), 0600)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+// Generate returns a new PEM-encoded CRL.
+func (s *testCRLServer) Generate() ([]byte, error) {
+	out, err := exec.Command("openssl", "ca", "-gencrl", "-batch",
+		"-config", s.dir+"/ca.cnf", "-cert", s.dir+"/ca.pem",
+		"-keyfile", s.dir+"/ca.key", "-out", s.dir+"/ca.crl").
+		CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, out)
+	}
+	return ioutil.ReadFile(s.dir + "/ca.crl")
+}
+
+func (s *testCRLServer) serve(w http.ResponseWriter, req *http.Request) {
+	crl, err := s.Generate()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(crl)
+}
+
+func TestCRLManager(t *testing.T) {
+	ca_key := generateTestRSAKey(t)
+	ca := issueTestCert(t, ca_key, testCert{CA: true})
+	crl_server := newTestCRLServer(t, ca, ca_key)
+	defer crl_server.Close()
+
+	key := generateTestRSAKey(t)
+	leaf := issueTestCert(t, key, testCert{Serial: 7, Issuer: ca,
+		IssuerKey:             ca_key,
+		CRLDistributionPoints: []string{crl_server.URL()}})
+	uris, err := leaf.CRLDistributionPoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uris) != 1 || uris[0] != crl_server.URL() {
+		t.Fatalf("unexpected distribution points %q", uris)
+	}
+	server_ctx := newSharedCtx(t, key, leaf, ca)
+
+	client_ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client_ctx.GetCertificateStore().AddCertificate(
+		ca); err != nil {
+		t.Fatal(err)
+	}
+	client_ctx.SetVerifyMode(VerifyPeer)
+	manager, err := NewCRLManager(client_ctx, crl_server.server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+
+	handshake := func() VerifyResult {
+		server_conn, client_conn := NetPipe(t)
+		defer server_conn.Close()
+		defer client_conn.Close()
+		server, err := Server(server_conn, server_ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+		go server.Handshake()
+		client, err := Client(client_conn, client_ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		client.Handshake()
+		return client.VerifyResult()
+	}
+
+	// with checking on but no CRL for the issuer, verification fails
+	if rv := handshake(); rv != UnableToGetCrl {
+		t.Fatalf("expected verification to fail without a CRL, got %d", rv)
+	}
+	if err := manager.AddCertificate(leaf, ca); err != nil {
+		t.Fatal(err)
+	}
+	if rv := handshake(); rv != Ok {
+		t.Fatalf("verification failed: %d", rv)
+	}
+
+	// the CRL must be signed by the issuer
+	other_key := generateTestRSAKey(t)
+	other := issueTestCert(t, other_key, testCert{CA: true})
+	if err := manager.AddURL(crl_server.URL(), other); err == nil {
+		t.Fatal("expected an error for a CRL from another issuer")
+	}
+
+	crl_server.Revoke(7)
+	if err := manager.Refresh(); err == nil {
+		t.Fatal("expected the source with the wrong issuer to fail")
+	}
+	if rv := handshake(); rv != CertRevoked {
+		t.Fatalf("expected a revoked certificate, got %d", rv)
+	}
+}
+
+func TestCRLFile(t *testing.T) {
+	ca_key := generateTestRSAKey(t)
+	ca := issueTestCert(t, ca_key, testCert{CA: true})
+	crl_server := newTestCRLServer(t, ca, ca_key)
+	defer crl_server.Close()
+	key := generateTestRSAKey(t)
+	leaf := issueTestCert(t, key, testCert{Serial: 7, Issuer: ca,
+		IssuerKey: ca_key})
+	server_ctx := newSharedCtx(t, key, leaf, ca)
+
+	newClientCtx := func() *Ctx {
+		ctx, err := NewCtx()
+		if err != nil {
+			t.Fatal(err)
+		}
+		store := ctx.GetCertificateStore()
+		if err := store.AddCertificate(ca); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.SetFlags(CRLCheck); err != nil {
+			t.Fatal(err)
+		}
+		ctx.SetVerifyMode(VerifyPeer)
+		return ctx
+	}
+	handshake := func(client_ctx *Ctx) VerifyResult {
+		server_conn, client_conn := NetPipe(t)
+		defer server_conn.Close()
+		defer client_conn.Close()
+		server, err := Server(server_conn, server_ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+		go server.Handshake()
+		client, err := Client(client_conn, client_ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		client.Handshake()
+		return client.VerifyResult()
+	}
+
+	client_ctx := newClientCtx()
+	if rv := handshake(client_ctx); rv != UnableToGetCrl {
+		t.Fatalf("expected verification to fail without a CRL, got %d", rv)
+	}
+	crl_pem, err := crl_server.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, err := LoadCRLFromPEM(crl_pem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client_ctx.GetCertificateStore().AddCRL(crl); err != nil {
+		t.Fatal(err)
+	}
+	if rv := handshake(client_ctx); rv != Ok {
+		t.Fatalf("verification failed: %d", rv)
+	}
+
+	// a DER file with the certificate revoked
+	crl_server.Revoke(7)
+	crl_pem, err = crl_server.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(crl_pem)
+	if block == nil {
+		t.Fatal("failed to decode the CRL")
+	}
+	if _, err := LoadCRLFromDER(block.Bytes); err != nil {
+		t.Fatal(err)
+	}
+	file, err := ioutil.TempFile("", "openssl-crl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(block.Bytes); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	client_ctx = newClientCtx()
+	if err := client_ctx.LoadCRLFile(file.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if rv := handshake(client_ctx); rv != CertRevoked {
+		t.Fatalf("expected a revoked certificate, got %d", rv)
+	}
+}
+
+func TestNewCRL(t *testing.T) {
+	ca_key := generateTestRSAKey(t)
+	ca, err := NewCertificate(&CertificateInfo{
+		Serial:     big.NewInt(1),
+		NotBefore:  time.Now().Add(-time.Hour),
+		NotAfter:   time.Now().Add(time.Hour),
+		CommonName: "Test CA",
+		IsCA:       true,
+	}, ca_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.Sign(ca_key, SHA256_Method); err != nil {
+		t.Fatal(err)
+	}
+	this_update := time.Now().Add(-time.Minute).Truncate(time.Second)
+	crl, err := NewCRL(&CRLInfo{
+		Number:     big.NewInt(7),
+		ThisUpdate: this_update,
+		NextUpdate: this_update.Add(time.Hour),
+	}, ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked_at := this_update.Add(-time.Hour)
+	if err := crl.AddRevoked(big.NewInt(3), revoked_at,
+		ReasonKeyCompromise); err != nil {
+		t.Fatal(err)
+	}
+	if err := crl.AddRevoked(big.NewInt(2), revoked_at,
+		ReasonUnspecified); err != nil {
+		t.Fatal(err)
+	}
+	if err := crl.AddRevoked(big.NewInt(4), revoked_at, 7); err == nil {
+		t.Fatal("expected an invalid reason to fail")
+	}
+	if err := crl.Sign(ca_key, SHA256_Method); err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := crl.MarshalDER()
+	if err != nil {
+		t.Fatal(err)
+	}
+	std, err := x509.ParseRevocationList(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := std.CheckSignatureFrom(parseWithStdlib(t, ca)); err != nil {
+		t.Fatal(err)
+	}
+	if std.Number.Int64() != 7 || len(std.RevokedCertificateEntries) != 2 ||
+		len(std.AuthorityKeyId) == 0 {
+		t.Fatalf("unexpected crl %+v", std)
+	}
+
+	loaded, err := LoadCRLFromDER(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.CheckSignature(ca); err != nil {
+		t.Fatal(err)
+	}
+	other := issueTestCert(t, ca_key, testCert{CA: true})
+	if loaded.CheckSignature(other) == nil {
+		t.Fatal("expected another issuer to fail")
+	}
+	issuer, err := loaded.Issuer()
+	if err != nil || issuer != "CN=Test CA" {
+		t.Fatalf("unexpected issuer %q, %v", issuer, err)
+	}
+	number, err := loaded.Number()
+	if err != nil || number.Int64() != 7 {
+		t.Fatalf("unexpected number %v, %v", number, err)
+	}
+	got_this_update, err := loaded.ThisUpdate()
+	if err != nil || !got_this_update.Equal(this_update) {
+		t.Fatalf("unexpected this update %v, %v", got_this_update, err)
+	}
+	next_update, err := loaded.NextUpdate()
+	if err != nil || !next_update.Equal(this_update.Add(time.Hour)) {
+		t.Fatalf("unexpected next update %v, %v", next_update, err)
+	}
+	revoked, err := loaded.Revoked()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sorted by serial when signed
+	if len(revoked) != 2 || revoked[0].Serial.Int64() != 2 ||
+		revoked[0].Reason != ReasonUnspecified ||
+		revoked[1].Serial.Int64() != 3 ||
+		revoked[1].Reason != ReasonKeyCompromise ||
+		!revoked[1].RevocationTime.Equal(revoked_at) {
+		t.Fatalf("unexpected entries %+v", revoked)
+	}
+
+	store, err := NewCertificateStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddCertificate(ca); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddCRL(loaded); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetFlags(CRLCheck); err != nil {
+		t.Fatal(err)
+	}
+	for serial, result := range map[int]VerifyResult{3: CertRevoked, 4: Ok} {
+		leaf := issueTestCert(t, generateTestRSAKey(t), testCert{
+			Serial: int64(serial), Issuer: ca, IssuerKey: ca_key})
+		_, err := store.Verify(leaf, nil)
+		if verify_err, ok := err.(VerifyError); ok {
+			if verify_err.Result != result {
+				t.Fatalf("expected %d for serial %d, got %v", result, serial,
+					err)
+			}
+		} else if err != nil || result != Ok {
+			t.Fatalf("expected %d for serial %d, got %v", result, serial, err)
+		}
+	}
+}
@@ -0,0 +1,491 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <stdlib.h>
+#include <openssl/err.h>
+#include <openssl/objects.h>
+#include <openssl/pem.h>
+#include <openssl/x509.h>
+#include <openssl/x509v3.h>
+
+extern const unsigned char *ASN1_STRING_get0_data_not_a_macro(
+    const ASN1_STRING *s);
+
+static STACK_OF(X509_EXTENSION) *sk_X509_EXTENSION_new_null_not_a_macro() {
+    return sk_X509_EXTENSION_new_null();
+}
+
+static int sk_X509_EXTENSION_push_not_a_macro(STACK_OF(X509_EXTENSION) *sk,
+        X509_EXTENSION *ext) {
+    return sk_X509_EXTENSION_push(sk, ext);
+}
+
+static int sk_X509_EXTENSION_num_not_a_macro(STACK_OF(X509_EXTENSION) *sk) {
+    return sk_X509_EXTENSION_num(sk);
+}
+
+static X509_EXTENSION *sk_X509_EXTENSION_value_not_a_macro(
+        STACK_OF(X509_EXTENSION) *sk, int i) {
+    return sk_X509_EXTENSION_value(sk, i);
+}
+
+static void sk_X509_EXTENSION_pop_free_not_a_macro(
+        STACK_OF(X509_EXTENSION) *sk) {
+    sk_X509_EXTENSION_pop_free(sk, X509_EXTENSION_free);
+}
+
+static X509_NAME *X509_REQ_get_subject_name_not_a_macro(X509_REQ *req) {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+    return X509_REQ_get_subject_name(req);
+#else
+    return req->req_info->subject;
+#endif
+}
+
+static int X509_REQ_print_subject(BIO *bio, X509_REQ *req) {
+    return X509_NAME_print_ex(bio, X509_REQ_get_subject_name_not_a_macro(req),
+        0, XN_FLAG_RFC2253);
+}
+
+// returns the string value of the first attribute identified by obj, or
+// NULL if there is none or it isn't a string
+static ASN1_STRING *OUR_X509_REQ_get_attr_string(X509_REQ *req,
+        ASN1_OBJECT *obj) {
+    ASN1_TYPE *value;
+    int idx = X509_REQ_get_attr_by_OBJ(req, obj, -1);
+    if (idx < 0)
+        return NULL;
+    value = X509_ATTRIBUTE_get0_type(X509_REQ_get_attr(req, idx), 0);
+    if (value == NULL)
+        return NULL;
+    switch (value->type) {
+    case V_ASN1_UTF8STRING:
+    case V_ASN1_PRINTABLESTRING:
+    case V_ASN1_IA5STRING:
+    case V_ASN1_T61STRING:
+    case V_ASN1_BMPSTRING:
+        return value->value.asn1_string;
+    }
+    return NULL;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"unsafe"
+)
+
+// ChallengePasswordOid identifies the PKCS#9 challenge password attribute,
+// which CAs may use to authenticate revocation requests.
+const ChallengePasswordOid = "1.2.840.113549.1.9.7"
+
+// X509RequestInfo describes a certificate signing request to be created with
+// NewX509Request.
+type X509RequestInfo struct {
+	Country      string
+	Organization string
+	CommonName   string
+	// DNSNames, EmailAddresses, IPAddresses and URIs are requested as
+	// subject alternative names.
+	DNSNames       []string
+	EmailAddresses []string
+	IPAddresses    []net.IP
+	URIs           []string
+	// ExtraExtensions are requested as they are, after the subject
+	// alternative names.
+	ExtraExtensions []CertificateExtension
+	// Attributes are added to the request as UTF-8 strings, e.g. a
+	// challenge password under ChallengePasswordOid.
+	Attributes []X509RequestAttribute
+}
+
+// X509RequestAttribute is a request attribute identified by its dotted OID.
+type X509RequestAttribute struct {
+	OID   string
+	Value string
+}
+
+// X509Request is a PKCS#10 certificate signing request.
+type X509Request struct {
+	req *C.X509_REQ
+}
+
+func newX509Request(req *C.X509_REQ) *X509Request {
+	r := &X509Request{req: req}
+	runtime.SetFinalizer(r, func(r *X509Request) {
+		C.X509_REQ_free(r.req)
+	})
+	return r
+}
+
+// NewX509Request creates a certificate signing request described by info for
+// key, signed by key using the given digest, e.g. SHA256_Method. The digest
+// is ignored for Ed25519 and Ed448 keys.
+func NewX509Request(info *X509RequestInfo, key PrivateKey, digest Method) (
+	*X509Request, error) {
+	if isEdDSAKey(key) {
+		digest = nil
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	req := C.X509_REQ_new()
+	if req == nil {
+		return nil, errors.New("failed to allocate request")
+	}
+	r := newX509Request(req)
+	defer runtime.KeepAlive(r)
+	if C.X509_REQ_set_version(req, 0) != 1 {
+		return nil, errorFromErrorQueue()
+	}
+
+	name := C.X509_REQ_get_subject_name_not_a_macro(req)
+	for _, entry := range []struct{ field, value string }{
+		{"C", info.Country},
+		{"O", info.Organization},
+		{"CN", info.CommonName}} {
+		if entry.value == "" {
+			continue
+		}
+		if err := addNameEntry(name, entry.field, entry.value); err != nil {
+			return nil, err
+		}
+	}
+
+	exts := info.ExtraExtensions
+	if len(info.DNSNames) > 0 || len(info.EmailAddresses) > 0 ||
+		len(info.IPAddresses) > 0 || len(info.URIs) > 0 {
+		der, err := marshalSubjectAltNames(info.DNSNames,
+			info.EmailAddresses, info.IPAddresses, info.URIs)
+		if err != nil {
+			return nil, err
+		}
+		exts = append([]CertificateExtension{{OID: subjectAltNameOid,
+			Value: der}}, exts...)
+	}
+	if len(exts) > 0 {
+		if err := addRequestExtensions(req, exts); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, attr := range info.Attributes {
+		if err := addRequestAttribute(req, attr); err != nil {
+			return nil, err
+		}
+	}
+
+	pkey := key.acquirePKey()
+	if pkey == nil {
+		return nil, keyFreed
+	}
+	defer C.EVP_PKEY_free(pkey)
+	if C.X509_REQ_set_pubkey(req, pkey) != 1 {
+		return nil, errorFromErrorQueue()
+	}
+	if C.X509_REQ_sign(req, pkey, digest) <= 0 {
+		return nil, errorFromErrorQueue()
+	}
+	return r, nil
+}
+
+func addRequestExtensions(req *C.X509_REQ, exts []CertificateExtension) error {
+	sk := C.sk_X509_EXTENSION_new_null_not_a_macro()
+	if sk == nil {
+		return errors.New("failed to allocate extensions")
+	}
+	defer C.sk_X509_EXTENSION_pop_free_not_a_macro(sk)
+	for _, ext := range exts {
+		x509_ext, err := newX509Extension(ext.OID, ext.Critical, ext.Value)
+		if err != nil {
+			return err
+		}
+		if C.sk_X509_EXTENSION_push_not_a_macro(sk, x509_ext) <= 0 {
+			C.X509_EXTENSION_free(x509_ext)
+			return errors.New("failed to add extension")
+		}
+	}
+	if C.X509_REQ_add_extensions(req, sk) != 1 {
+		return errorFromErrorQueue()
+	}
+	return nil
+}
+
+func addRequestAttribute(req *C.X509_REQ, attr X509RequestAttribute) error {
+	coid := C.CString(attr.OID)
+	defer C.free(unsafe.Pointer(coid))
+	obj := C.OBJ_txt2obj(coid, 1)
+	if obj == nil {
+		return fmt.Errorf("invalid oid %s", attr.OID)
+	}
+	defer C.ASN1_OBJECT_free(obj)
+	cvalue := C.CString(attr.Value)
+	defer C.free(unsafe.Pointer(cvalue))
+	if C.X509_REQ_add1_attr_by_OBJ(req, obj, C.MBSTRING_UTF8,
+		(*C.uchar)(unsafe.Pointer(cvalue)), C.int(len(attr.Value))) != 1 {
+		return fmt.Errorf("failed to add attribute %s", attr.OID)
+	}
+	return nil
+}
+
+// LoadX509RequestFromPEM loads a PEM-encoded certificate signing request. Its
+// signature isn't checked; see CheckSignature.
+func LoadX509RequestFromPEM(pem_block []byte) (*X509Request, error) {
+	if len(pem_block) == 0 {
+		return nil, errors.New("empty pem block")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	bio := C.BIO_new_mem_buf(unsafe.Pointer(&pem_block[0]),
+		C.int(len(pem_block)))
+	req := C.PEM_read_bio_X509_REQ(bio, nil, nil, nil)
+	C.BIO_free(bio)
+	if req == nil {
+		return nil, errorFromErrorQueue()
+	}
+	return newX509Request(req), nil
+}
+
+// LoadX509RequestFromDER loads a DER-encoded certificate signing request. Its
+// signature isn't checked; see CheckSignature.
+func LoadX509RequestFromDER(der_block []byte) (*X509Request, error) {
+	if len(der_block) == 0 {
+		return nil, errors.New("empty der block")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	bio := C.BIO_new_mem_buf(unsafe.Pointer(&der_block[0]),
+		C.int(len(der_block)))
+	req := C.d2i_X509_REQ_bio(bio, nil)
+	C.BIO_free(bio)
+	if req == nil {
+		return nil, errorFromErrorQueue()
+	}
+	return newX509Request(req), nil
+}
+
+// MarshalPEM converts the request to PEM-encoded format.
+func (r *X509Request) MarshalPEM() (pem_block []byte, err error) {
+	defer runtime.KeepAlive(r)
+	bio := C.BIO_new(C.BIO_s_mem())
+	if bio == nil {
+		return nil, errors.New("failed to allocate memory BIO")
+	}
+	defer C.BIO_free(bio)
+	if C.PEM_write_bio_X509_REQ(bio, r.req) != 1 {
+		return nil, errors.New("failed dumping request")
+	}
+	return ioutil.ReadAll(asAnyBio(bio))
+}
+
+// MarshalDER converts the request to DER-encoded format.
+func (r *X509Request) MarshalDER() (der_block []byte, err error) {
+	defer runtime.KeepAlive(r)
+	bio := C.BIO_new(C.BIO_s_mem())
+	if bio == nil {
+		return nil, errors.New("failed to allocate memory BIO")
+	}
+	defer C.BIO_free(bio)
+	if C.i2d_X509_REQ_bio(bio, r.req) != 1 {
+		return nil, errors.New("failed dumping request der")
+	}
+	return ioutil.ReadAll(asAnyBio(bio))
+}
+
+// PublicKey returns the public key the request is for.
+func (r *X509Request) PublicKey() (PublicKey, error) {
+	defer runtime.KeepAlive(r)
+	pkey := C.X509_REQ_get_pubkey(r.req)
+	if pkey == nil {
+		return nil, errors.New("no public key found")
+	}
+	return newPKey(pkey), nil
+}
+
+// CheckSignature checks that the request is signed by the key it is for,
+// proving its sender holds the private key.
+func (r *X509Request) CheckSignature() error {
+	defer runtime.KeepAlive(r)
+	pkey := C.X509_REQ_get_pubkey(r.req)
+	if pkey == nil {
+		return errors.New("no public key found")
+	}
+	defer C.EVP_PKEY_free(pkey)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.X509_REQ_verify(r.req, pkey) != 1 {
+		C.ERR_clear_error()
+		return errors.New("request signature is invalid")
+	}
+	return nil
+}
+
+// Subject returns the requested subject name, in RFC 2253 form.
+func (r *X509Request) Subject() (string, error) {
+	defer runtime.KeepAlive(r)
+	bio := C.BIO_new(C.BIO_s_mem())
+	if bio == nil {
+		return "", errors.New("failed to allocate memory BIO")
+	}
+	defer C.BIO_free(bio)
+	if C.X509_REQ_print_subject(bio, r.req) < 0 {
+		return "", errors.New("failed to print subject name")
+	}
+	name, err := ioutil.ReadAll(asAnyBio(bio))
+	return string(name), err
+}
+
+// Extensions returns the extensions requested, in order.
+func (r *X509Request) Extensions() ([]CertificateExtension, error) {
+	defer runtime.KeepAlive(r)
+	sk := C.X509_REQ_get_extensions(r.req)
+	if sk == nil {
+		return nil, nil
+	}
+	defer C.sk_X509_EXTENSION_pop_free_not_a_macro(sk)
+	n := int(C.sk_X509_EXTENSION_num_not_a_macro(sk))
+	rv := make([]CertificateExtension, 0, n)
+	for i := 0; i < n; i++ {
+		ext := C.sk_X509_EXTENSION_value_not_a_macro(sk, C.int(i))
+		var buf [128]C.char
+		length := C.OBJ_obj2txt(&buf[0], C.int(len(buf)),
+			C.X509_EXTENSION_get_object(ext), 1)
+		if length <= 0 || int(length) >= len(buf) {
+			return nil, errors.New("failed to read extension oid")
+		}
+		data := (*C.ASN1_STRING)(C.X509_EXTENSION_get_data(ext))
+		rv = append(rv, CertificateExtension{
+			OID:      C.GoStringN(&buf[0], length),
+			Critical: C.X509_EXTENSION_get_critical(ext) == 1,
+			Value: C.GoBytes(unsafe.Pointer(
+				C.ASN1_STRING_get0_data_not_a_macro(data)),
+				C.ASN1_STRING_length(data)),
+		})
+	}
+	return rv, nil
+}
+
+// Attribute returns the string value of the attribute identified by the
+// dotted OID string, and whether the request carries it.
+func (r *X509Request) Attribute(oid string) (string, bool, error) {
+	defer runtime.KeepAlive(r)
+	coid := C.CString(oid)
+	defer C.free(unsafe.Pointer(coid))
+	obj := C.OBJ_txt2obj(coid, 1)
+	if obj == nil {
+		return "", false, fmt.Errorf("invalid oid %s", oid)
+	}
+	defer C.ASN1_OBJECT_free(obj)
+	value := C.OUR_X509_REQ_get_attr_string(r.req, obj)
+	if value == nil {
+		return "", false, nil
+	}
+	return C.GoStringN((*C.char)(unsafe.Pointer(
+		C.ASN1_STRING_get0_data_not_a_macro(value))),
+		C.ASN1_STRING_length(value)), true, nil
+}
+
+// ExtensionCopyPolicy says which of the extensions requested in a CSR
+// IssueCertificate copies into the certificate.
+type ExtensionCopyPolicy int
+
+const (
+	// CopyNoExtensions ignores the requested extensions, leaving the
+	// certificate's contents entirely up to the CA.
+	CopyNoExtensions ExtensionCopyPolicy = iota
+	// CopySubjectAltNames copies only the subject alternative names, as
+	// ACME CAs do once they have validated them.
+	CopySubjectAltNames
+	// CopyAllExtensions copies every requested extension the CA didn't set
+	// itself. It must only be used for requests from trusted parties, who
+	// could otherwise ask for, say, a CA certificate.
+	CopyAllExtensions
+)
+
+// IssueCertificate issues a certificate for the subject and key of req,
+// signed by the CA ca with ca_key using the given digest. info supplies the
+// serial number, validity and the extensions the CA sets, and its subject
+// name fields are ignored. Requested extensions are then copied according to
+// policy, except those info already set. The request's signature is checked
+// first.
+func IssueCertificate(req *X509Request, info *CertificateInfo,
+	ca *Certificate, ca_key PrivateKey, digest Method,
+	policy ExtensionCopyPolicy) (*Certificate, error) {
+	if err := req.CheckSignature(); err != nil {
+		return nil, err
+	}
+	key, err := req.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := NewCertificate(info, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := cert.setSubjectFromRequest(req); err != nil {
+		return nil, err
+	}
+	if policy != CopyNoExtensions {
+		exts, err := req.Extensions()
+		if err != nil {
+			return nil, err
+		}
+		for _, ext := range exts {
+			if policy == CopySubjectAltNames && ext.OID != subjectAltNameOid {
+				continue
+			}
+			existing, err := cert.ExtensionDER(ext.OID)
+			if err != nil {
+				return nil, err
+			}
+			if existing != nil {
+				continue
+			}
+			err = cert.AddExtensionDER(ext.OID, ext.Critical, ext.Value)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := cert.SetIssuer(ca); err != nil {
+		return nil, err
+	}
+	if err := cert.Sign(ca_key, digest); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+func (c *Certificate) setSubjectFromRequest(req *X509Request) error {
+	defer runtime.KeepAlive(req)
+	x := c.acquireX509()
+	if x == nil {
+		return certificateFreed
+	}
+	defer C.X509_free(x)
+	if C.X509_set_subject_name(x,
+		C.X509_REQ_get_subject_name_not_a_macro(req.req)) != 1 {
+		return errors.New("failed to set subject name")
+	}
+	return nil
+}
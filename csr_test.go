@@ -0,0 +1,245 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestX509Request(t *testing.T, key PrivateKey) *X509Request {
+	null, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagNull})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// asks to be a CA, which only CopyAllExtensions lets through
+	basic_constraints, err := asn1.Marshal(struct{ IsCA bool }{true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := NewX509Request(&X509RequestInfo{
+		Organization: "Test",
+		CommonName:   "www.example.com",
+		DNSNames:     []string{"www.example.com", "example.com"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtraExtensions: []CertificateExtension{
+			{OID: "1.2.3.4.5", Value: null},
+			{OID: basicConstraintsOid, Critical: true,
+				Value: basic_constraints}},
+		Attributes: []X509RequestAttribute{
+			{OID: ChallengePasswordOid, Value: "hunter2"}},
+	}, key, SHA256_Method)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestX509Request(t *testing.T) {
+	key := generateTestRSAKey(t)
+	req := newTestX509Request(t, key)
+
+	pem_block, err := req.MarshalPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(pem_block)
+	std, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := std.CheckSignature(); err != nil {
+		t.Fatal(err)
+	}
+	if std.Subject.CommonName != "www.example.com" ||
+		len(std.DNSNames) != 2 || len(std.IPAddresses) != 1 {
+		t.Fatalf("unexpected request %s %q %v", std.Subject, std.DNSNames,
+			std.IPAddresses)
+	}
+
+	loaded, err := LoadX509RequestFromPEM(pem_block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.CheckSignature(); err != nil {
+		t.Fatal(err)
+	}
+	subject, err := loaded.Subject()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != "CN=www.example.com,O=Test" {
+		t.Fatalf("unexpected subject %q", subject)
+	}
+	exts, err := loaded.Extensions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exts) != 3 || exts[0].OID != subjectAltNameOid ||
+		exts[1].OID != "1.2.3.4.5" || !exts[2].Critical {
+		t.Fatalf("unexpected extensions %v", exts)
+	}
+	password, ok, err := loaded.Attribute(ChallengePasswordOid)
+	if err != nil || !ok || password != "hunter2" {
+		t.Fatalf("unexpected challenge password %q, %v, %v", password, ok,
+			err)
+	}
+	if _, ok, _ := loaded.Attribute("1.2.3.4"); ok {
+		t.Fatal("expected a missing attribute")
+	}
+
+	// the signature covers the whole request
+	der, err := req.MarshalDER()
+	if err != nil {
+		t.Fatal(err)
+	}
+	der[len(der)-1] ^= 1
+	tampered, err := LoadX509RequestFromDER(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tampered.CheckSignature() == nil {
+		t.Fatal("expected a tampered request to fail")
+	}
+}
+
+func TestX509RequestFromStdlib(t *testing.T) {
+	key := generateTestRSAKey(t)
+	std_key, err := ToStdlibPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader,
+		&x509.CertificateRequest{
+			Subject:  pkix.Name{CommonName: "stdlib"},
+			DNSNames: []string{"stdlib.example.com"},
+		}, std_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := LoadX509RequestFromDER(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := req.CheckSignature(); err != nil {
+		t.Fatal(err)
+	}
+	exts, err := req.Extensions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exts) != 1 || exts[0].OID != subjectAltNameOid {
+		t.Fatalf("unexpected extensions %v", exts)
+	}
+}
+
+func TestIssueCertificate(t *testing.T) {
+	ca_key := generateTestRSAKey(t)
+	ca, err := NewCertificate(&CertificateInfo{
+		Serial:     big.NewInt(1),
+		NotAfter:   time.Now().Add(time.Hour),
+		CommonName: "Test CA",
+		KeyUsage:   KeyUsageCertSign,
+		IsCA:       true,
+	}, ca_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.Sign(ca_key, SHA256_Method); err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(parseWithStdlib(t, ca))
+
+	key := generateTestRSAKey(t)
+	req := newTestX509Request(t, key)
+	issue := func(policy ExtensionCopyPolicy) *x509.Certificate {
+		cert, err := IssueCertificate(req, &CertificateInfo{
+			Serial:      big.NewInt(2),
+			NotBefore:   time.Now().Add(-time.Hour),
+			NotAfter:    time.Now().Add(time.Hour),
+			CommonName:  "ignored",
+			ExtKeyUsage: []ExtKeyUsage{ExtKeyUsageServerAuth},
+			DNSNames:    []string{"ca-chosen.example.com"},
+		}, ca, ca_key, SHA256_Method, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		matches, err := cert.MatchesKey(key)
+		if err != nil || !matches {
+			t.Fatalf("expected the certificate to be for the request's "+
+				"key, got %v, %v", matches, err)
+		}
+		return parseWithStdlib(t, cert)
+	}
+
+	std := issue(CopyNoExtensions)
+	if std.Subject.CommonName != "www.example.com" ||
+		std.Issuer.CommonName != "Test CA" {
+		t.Fatalf("unexpected subject %s or issuer %s", std.Subject,
+			std.Issuer)
+	}
+	if len(std.DNSNames) != 1 || std.DNSNames[0] != "ca-chosen.example.com" {
+		t.Fatalf("unexpected names %q", std.DNSNames)
+	}
+
+	// the CA's own names win
+	std = issue(CopySubjectAltNames)
+	if len(std.DNSNames) != 1 || std.IsCA {
+		t.Fatalf("unexpected names %q or CA %v", std.DNSNames, std.IsCA)
+	}
+	_, err = std.Verify(x509.VerifyOptions{
+		DNSName: "ca-chosen.example.com",
+		Roots:   roots,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// without names of its own, the CA takes the requested ones
+	cert, err := IssueCertificate(req, &CertificateInfo{
+		Serial:   big.NewInt(3),
+		NotAfter: time.Now().Add(time.Hour),
+	}, ca, ca_key, SHA256_Method, CopySubjectAltNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	std = parseWithStdlib(t, cert)
+	if len(std.DNSNames) != 2 || std.DNSNames[1] != "example.com" ||
+		std.IsCA {
+		t.Fatalf("unexpected names %q or CA %v", std.DNSNames, std.IsCA)
+	}
+
+	std = issue(CopyAllExtensions)
+	if !std.IsCA {
+		t.Fatal("expected the requested basic constraints to be copied")
+	}
+	found := false
+	for _, ext := range std.Extensions {
+		found = found || ext.Id.String() == "1.2.3.4.5"
+	}
+	if !found {
+		t.Fatal("expected the requested extension to be copied")
+	}
+}
@@ -0,0 +1,376 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <stdlib.h>
+#include <openssl/ssl.h>
+#include <openssl/x509.h>
+
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L && !defined(OPENSSL_NO_CT)
+#include <openssl/ct.h>
+#define HAVE_CT 1
+#else
+#define SSL_CT_VALIDATION_PERMISSIVE 0
+#define SSL_CT_VALIDATION_STRICT 1
+#define SCT_SOURCE_UNKNOWN 0
+#define SCT_SOURCE_TLS_EXTENSION 1
+#define SCT_SOURCE_X509V3_EXTENSION 2
+#define SCT_SOURCE_OCSP_STAPLED_RESPONSE 3
+#define SCT_VALIDATION_STATUS_NOT_SET 0
+#define SCT_VALIDATION_STATUS_UNKNOWN_LOG 1
+#define SCT_VALIDATION_STATUS_VALID 2
+#define SCT_VALIDATION_STATUS_INVALID 3
+#define SCT_VALIDATION_STATUS_UNVERIFIED 4
+#define SCT_VALIDATION_STATUS_UNKNOWN_VERSION 5
+#endif
+
+static int OUR_SSL_CTX_enable_ct(SSL_CTX *ctx, int mode) {
+#ifdef HAVE_CT
+    return SSL_CTX_enable_ct(ctx, mode);
+#else
+    return -1;
+#endif
+}
+
+static void OUR_SSL_CTX_disable_ct(SSL_CTX *ctx) {
+#ifdef HAVE_CT
+    SSL_CTX_set_ct_validation_callback(ctx, NULL, NULL);
+#endif
+}
+
+// loads the default log list if path is NULL
+static int OUR_SSL_CTX_set_ctlog_list_file(SSL_CTX *ctx, const char *path) {
+#ifdef HAVE_CT
+    if (path == NULL)
+        return SSL_CTX_set_default_ctlog_list_file(ctx);
+    return SSL_CTX_set_ctlog_list_file(ctx, path);
+#else
+    return -1;
+#endif
+}
+
+static int SSL_get_peer_sct_num(SSL *ssl) {
+#ifdef HAVE_CT
+    const STACK_OF(SCT) *scts = SSL_get0_peer_scts(ssl);
+    return scts == NULL ? 0 : sk_SCT_num(scts);
+#else
+    return 0;
+#endif
+}
+
+// writes the TLS serialization of the ith SCT to out, if it isn't NULL,
+// returning its length
+static int SSL_get_peer_sct(SSL *ssl, int i, unsigned char *out,
+        int *source, int *status) {
+#ifdef HAVE_CT
+    SCT *sct = sk_SCT_value(SSL_get0_peer_scts(ssl), i);
+    *source = SCT_get_source(sct);
+    *status = SCT_get_validation_status(sct);
+    return i2o_SCT(sct, out == NULL ? NULL : &out);
+#else
+    return -1;
+#endif
+}
+*/
+import "C"
+
+import (
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"runtime"
+	"unsafe"
+)
+
+const (
+	ctPoisonOid  = "1.3.6.1.4.1.11129.2.4.3"
+	ctSCTListOid = "1.3.6.1.4.1.11129.2.4.2"
+)
+
+// SignedCertificateTimestamp is an SCT as returned by a Certificate
+// Transparency log (RFC 6962, section 3.2).
+type SignedCertificateTimestamp struct {
+	Version    uint8
+	LogID      [32]byte
+	Timestamp  uint64 // milliseconds since the epoch
+	Extensions []byte
+	// Signature is the TLS DigitallySigned structure exactly as returned by
+	// the log, including the hash and signature algorithm bytes.
+	Signature []byte
+}
+
+// Marshal returns the TLS serialization of the SCT, as embedded in
+// certificates and sent in the signed_certificate_timestamp extension.
+func (s *SignedCertificateTimestamp) Marshal() ([]byte, error) {
+	if len(s.Extensions) > 0xffff {
+		return nil, errors.New("sct extensions too long")
+	}
+	rv := make([]byte, 0, 1+32+8+2+len(s.Extensions)+len(s.Signature))
+	rv = append(rv, s.Version)
+	rv = append(rv, s.LogID[:]...)
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], s.Timestamp)
+	rv = append(rv, buf[:]...)
+	binary.BigEndian.PutUint16(buf[:2], uint16(len(s.Extensions)))
+	rv = append(rv, buf[:2]...)
+	rv = append(rv, s.Extensions...)
+	rv = append(rv, s.Signature...)
+	return rv, nil
+}
+
+// CTValidationMode says how clients act on the SCTs servers provide, see
+// Ctx.EnableCT.
+type CTValidationMode int
+
+const (
+	// CTPermissive checks the SCTs but carries on without valid ones, so
+	// Conn.PeerSCTs can report on them.
+	CTPermissive CTValidationMode = C.SSL_CT_VALIDATION_PERMISSIVE
+	// CTStrict fails the handshake unless at least one SCT is valid.
+	CTStrict CTValidationMode = C.SSL_CT_VALIDATION_STRICT
+)
+
+// SCTSource says where a server provided an SCT.
+type SCTSource int
+
+const (
+	SCTSourceUnknown          SCTSource = C.SCT_SOURCE_UNKNOWN
+	SCTSourceTLSExtension     SCTSource = C.SCT_SOURCE_TLS_EXTENSION
+	SCTSourceX509Extension    SCTSource = C.SCT_SOURCE_X509V3_EXTENSION
+	SCTSourceOCSPStapledReply SCTSource = C.SCT_SOURCE_OCSP_STAPLED_RESPONSE
+)
+
+// SCTStatus is the outcome of checking an SCT.
+type SCTStatus int
+
+const (
+	SCTStatusNotSet SCTStatus = C.SCT_VALIDATION_STATUS_NOT_SET
+	// SCTStatusUnknownLog means the SCT comes from a log missing from the
+	// context's log list.
+	SCTStatusUnknownLog     SCTStatus = C.SCT_VALIDATION_STATUS_UNKNOWN_LOG
+	SCTStatusValid          SCTStatus = C.SCT_VALIDATION_STATUS_VALID
+	SCTStatusInvalid        SCTStatus = C.SCT_VALIDATION_STATUS_INVALID
+	SCTStatusUnverified     SCTStatus = C.SCT_VALIDATION_STATUS_UNVERIFIED
+	SCTStatusUnknownVersion SCTStatus = C.SCT_VALIDATION_STATUS_UNKNOWN_VERSION
+)
+
+var ctUnsupported = errors.New(
+	"certificate transparency requires OpenSSL 1.1.0 or newer built with CT")
+
+// EnableCT makes clients using the context check the SCTs servers provide
+// for their certificate, whether embedded in it, stapled in an OCSP
+// response or sent in the TLS extension, against the logs loaded with
+// LoadCTLogList or LoadCTLogListFile. Clients ask servers for OCSP staples
+// to that end. SCTs are only checked once the certificate has been verified,
+// so the verify mode must include VerifyPeer. In CTStrict mode, handshakes
+// without a valid SCT fail with Conn.VerifyResult reporting NoValidSCTs.
+func (c *Ctx) EnableCT(mode CTValidationMode) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	switch C.OUR_SSL_CTX_enable_ct(c.ctx, C.int(mode)) {
+	case 1:
+		return nil
+	case -1:
+		return ctUnsupported
+	default:
+		return errorFromErrorQueue()
+	}
+}
+
+// DisableCT stops checking SCTs.
+func (c *Ctx) DisableCT() {
+	C.OUR_SSL_CTX_disable_ct(c.ctx)
+}
+
+// LoadCTLogListFile loads the CT logs SCTs are checked against from path, a
+// log list in the format of OpenSSL's ct_log_list.cnf.
+func (c *Ctx) LoadCTLogListFile(path string) error {
+	cpath := C.CString(path)
+	defer C.free(unsafe.Pointer(cpath))
+	return c.loadCTLogList(cpath)
+}
+
+// LoadCTLogList loads the default CT log list, the ct_log_list.cnf in
+// OpenSSL's directory unless the CTLOG_FILE environment variable names
+// another.
+func (c *Ctx) LoadCTLogList() error {
+	return c.loadCTLogList(nil)
+}
+
+func (c *Ctx) loadCTLogList(path *C.char) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	switch C.OUR_SSL_CTX_set_ctlog_list_file(c.ctx, path) {
+	case 1:
+		return nil
+	case -1:
+		return ctUnsupported
+	default:
+		return errorFromErrorQueue()
+	}
+}
+
+// PeerSCT is an SCT the server provided, as checked by the client.
+type PeerSCT struct {
+	// SCT is the TLS serialization of the SCT.
+	SCT    []byte
+	Source SCTSource
+	Status SCTStatus
+}
+
+// PeerSCTs returns the SCTs the server provided, once the handshake has
+// completed on a client with CT enabled.
+func (c *Conn) PeerSCTs() []PeerSCT {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	num := int(C.SSL_get_peer_sct_num(c.ssl))
+	rv := make([]PeerSCT, 0, num)
+	for i := 0; i < num; i++ {
+		var source, status C.int
+		size := C.SSL_get_peer_sct(c.ssl, C.int(i), nil, &source, &status)
+		if size <= 0 {
+			continue
+		}
+		sct := make([]byte, int(size))
+		C.SSL_get_peer_sct(c.ssl, C.int(i),
+			(*C.uchar)(unsafe.Pointer(&sct[0])), &source, &status)
+		rv = append(rv, PeerSCT{
+			SCT:    sct,
+			Source: SCTSource(source),
+			Status: SCTStatus(status)})
+	}
+	return rv
+}
+
+// AddCTPoisonExtension adds the critical precertificate poison extension,
+// turning the certificate into a precertificate that can be submitted to CT
+// logs but will be rejected by TLS clients.
+func (c *Certificate) AddCTPoisonExtension() error {
+	null, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagNull})
+	if err != nil {
+		return err
+	}
+	return c.AddExtensionDER(ctPoisonOid, true, null)
+}
+
+// IsPrecertificate reports whether the certificate carries the CT poison
+// extension.
+func (c *Certificate) IsPrecertificate() (bool, error) {
+	der, err := c.ExtensionDER(ctPoisonOid)
+	return der != nil, err
+}
+
+// AddSCTListExtension embeds the given TLS-serialized SCTs (see
+// SignedCertificateTimestamp.Marshal) into the certificate.
+func (c *Certificate) AddSCTListExtension(scts ...[]byte) error {
+	if len(scts) == 0 {
+		return errors.New("no scts provided")
+	}
+	list := []byte{0, 0}
+	for _, sct := range scts {
+		if len(sct) == 0 || len(sct) > 0xffff {
+			return fmt.Errorf("invalid sct length %d", len(sct))
+		}
+		list = append(list, byte(len(sct)>>8), byte(len(sct)))
+		list = append(list, sct...)
+	}
+	if len(list)-2 > 0xffff {
+		return errors.New("sct list too long")
+	}
+	binary.BigEndian.PutUint16(list, uint16(len(list)-2))
+	der, err := asn1.Marshal(list)
+	if err != nil {
+		return err
+	}
+	return c.AddExtensionDER(ctSCTListOid, false, der)
+}
+
+// SCTList returns the TLS-serialized SCTs embedded in the certificate, if any.
+func (c *Certificate) SCTList() ([][]byte, error) {
+	der, err := c.ExtensionDER(ctSCTListOid)
+	if err != nil || der == nil {
+		return nil, err
+	}
+	var list []byte
+	if _, err := asn1.Unmarshal(der, &list); err != nil {
+		return nil, err
+	}
+	return parseSCTList(list)
+}
+
+func parseSCTList(list []byte) ([][]byte, error) {
+	if len(list) < 2 ||
+		int(binary.BigEndian.Uint16(list)) != len(list)-2 {
+		return nil, errors.New("malformed sct list")
+	}
+	list = list[2:]
+	var scts [][]byte
+	for len(list) > 0 {
+		if len(list) < 2 {
+			return nil, errors.New("malformed sct list")
+		}
+		n := int(binary.BigEndian.Uint16(list))
+		if n == 0 || len(list) < 2+n {
+			return nil, errors.New("malformed sct list")
+		}
+		scts = append(scts, list[2:2+n])
+		list = list[2+n:]
+	}
+	return scts, nil
+}
+
+// FinalizePrecertificate produces the final certificate for a precertificate
+// created with AddCTPoisonExtension: a copy without the poison extension but
+// with the SCTs received from the logs embedded, signed again by the issuer.
+func (c *Certificate) FinalizePrecertificate(key PrivateKey, digest Method,
+	scts ...[]byte) (*Certificate, error) {
+	orig := c.acquireX509()
+	if orig == nil {
+		return nil, certificateFreed
+	}
+	defer C.X509_free(orig)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	x := C.X509_dup(orig)
+	if x == nil {
+		return nil, errorFromErrorQueue()
+	}
+	final := newCertificate(x)
+
+	coid := C.CString(ctPoisonOid)
+	defer C.free(unsafe.Pointer(coid))
+	obj := C.OBJ_txt2obj(coid, 1)
+	if obj == nil {
+		return nil, errors.New("failed to allocate poison oid")
+	}
+	defer C.ASN1_OBJECT_free(obj)
+	idx := C.X509_get_ext_by_OBJ(x, obj, -1)
+	if idx < 0 {
+		return nil, errors.New("certificate is not a precertificate")
+	}
+	C.X509_EXTENSION_free(C.X509_delete_ext(x, idx))
+
+	if err := final.AddSCTListExtension(scts...); err != nil {
+		return nil, err
+	}
+	if err := final.Sign(key, digest); err != nil {
+		return nil, err
+	}
+	return final, nil
+}
@@ -0,0 +1,109 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestEnableCT(t *testing.T) {
+	log_key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log_pub, err := x509.MarshalPKIXPublicKey(&log_key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := ioutil.TempFile("", "openssl-ctlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	_, err = fmt.Fprintf(file, "enabled_logs = test\n[test]\n"+
+		"description = Test Log\nkey = %s\n",
+		base64.StdEncoding.EncodeToString(log_pub))
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// clients don't look for SCTs on certificates they trust directly
+	ca_key := generateTestRSAKey(t)
+	ca := issueTestCert(t, ca_key, testCert{CA: true})
+	key := generateTestRSAKey(t)
+	leaf := issueTestCert(t, key, testCert{Serial: 7, Issuer: ca,
+		IssuerKey: ca_key})
+	server_ctx := newSharedCtx(t, key, leaf, ca)
+	handshake := func(mode CTValidationMode) ([]PeerSCT, VerifyResult,
+		error) {
+		client_ctx, err := NewCtx()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := client_ctx.GetCertificateStore().AddCertificate(
+			ca); err != nil {
+			t.Fatal(err)
+		}
+		client_ctx.SetVerifyMode(VerifyPeer)
+		if err := client_ctx.EnableCT(mode); err == ctUnsupported {
+			t.Skip(err)
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if err := client_ctx.LoadCTLogListFile(file.Name()); err != nil {
+			t.Fatal(err)
+		}
+		server_conn, client_conn := NetPipe(t)
+		defer server_conn.Close()
+		defer client_conn.Close()
+		server, err := Server(server_conn, server_ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+		go server.Handshake()
+		client, err := Client(client_conn, client_ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		err = client.Handshake()
+		return client.PeerSCTs(), client.VerifyResult(), err
+	}
+
+	// the server has no SCTs to offer
+	scts, rv, err := handshake(CTPermissive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scts) != 0 || rv != Ok {
+		t.Fatalf("unexpected SCTs %v, verify result %d", scts, rv)
+	}
+	if _, rv, err = handshake(CTStrict); err == nil || rv != NoValidSCTs {
+		t.Fatalf("expected the handshake to fail with NoValidSCTs, got "+
+			"%d: %v", rv, err)
+	}
+}
@@ -21,6 +21,7 @@ package openssl
 #include <openssl/ssl.h>
 #include <openssl/err.h>
 #include <openssl/conf.h>
+#include <openssl/x509.h>
 
 static long SSL_CTX_set_options_not_a_macro(SSL_CTX* ctx, long options) {
    return SSL_CTX_set_options(ctx, options);
@@ -38,12 +39,12 @@ static long SSL_CTX_get_mode_not_a_macro(SSL_CTX* ctx) {
    return SSL_CTX_get_mode(ctx);
 }
 
-static long SSL_CTX_set_session_cache_mode_not_a_macro(SSL_CTX* ctx, long modes) {
-   return SSL_CTX_set_session_cache_mode(ctx, modes);
+static long SSL_CTX_clear_mode_not_a_macro(SSL_CTX* ctx, long modes) {
+   return SSL_CTX_clear_mode(ctx, modes);
 }
 
-static int CRYPTO_add_not_a_macro(int *pointer,int amount,int type) {
-   return CRYPTO_add(pointer, amount, type);
+static long SSL_CTX_set_session_cache_mode_not_a_macro(SSL_CTX* ctx, long modes) {
+   return SSL_CTX_set_session_cache_mode(ctx, modes);
 }
 
 static long SSL_CTX_add_extra_chain_cert_not_a_macro(SSL_CTX* ctx, X509 *cert) {
@@ -58,10 +59,107 @@ static long SSL_CTX_set_tmp_ecdh_not_a_macro(SSL_CTX* ctx, EC_KEY *key) {
 #define SSL_MODE_RELEASE_BUFFERS 0
 #endif
 
+#ifndef SSL_MODE_SEND_FALLBACK_SCSV
+#define SSL_MODE_SEND_FALLBACK_SCSV 0
+#endif
+
+#if !defined(SSL_MODE_ASYNC) || defined(OPENSSL_NO_ASYNC)
+#undef SSL_MODE_ASYNC
+#define SSL_MODE_ASYNC 0
+#endif
+
 #ifndef SSL_OP_NO_COMPRESSION
 #define SSL_OP_NO_COMPRESSION 0
 #endif
 
+#ifndef X509_V_FLAG_PARTIAL_CHAIN
+#define X509_V_FLAG_PARTIAL_CHAIN 0
+#endif
+
+#ifndef SSL_VERIFY_POST_HANDSHAKE
+#define SSL_VERIFY_POST_HANDSHAKE 0
+#endif
+
+static int OUR_SSL_CTX_set_post_handshake_auth(SSL_CTX *ctx, int val) {
+#if OPENSSL_VERSION_NUMBER >= 0x10101000L
+    SSL_CTX_set_post_handshake_auth(ctx, val);
+    return 1;
+#else
+    return -1;
+#endif
+}
+
+#ifndef SSL_OP_NO_RENEGOTIATION
+#define SSL_OP_NO_RENEGOTIATION 0
+#endif
+
+#ifndef SSL_OP_NO_TLSv1_3
+#define SSL_OP_NO_TLSv1_3 0
+#endif
+
+#ifndef SSL_OP_ENABLE_MIDDLEBOX_COMPAT
+#define SSL_OP_ENABLE_MIDDLEBOX_COMPAT 0
+#endif
+
+#ifndef SSL_OP_NO_ANTI_REPLAY
+#define SSL_OP_NO_ANTI_REPLAY 0
+#endif
+
+static int OUR_SSL_CTX_set_tls13_only(SSL_CTX *ctx) {
+#ifdef TLS1_3_VERSION
+    return SSL_CTX_set_min_proto_version(ctx, TLS1_3_VERSION) &&
+        SSL_CTX_set_max_proto_version(ctx, TLS1_3_VERSION);
+#else
+    return -1;
+#endif
+}
+
+// return -1 before OpenSSL 1.1.0, which has no version bounds
+static int OUR_SSL_CTX_set_min_proto_version(SSL_CTX *ctx, int version) {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+    return SSL_CTX_set_min_proto_version(ctx, version);
+#else
+    return -1;
+#endif
+}
+
+static int OUR_SSL_CTX_set_max_proto_version(SSL_CTX *ctx, int version) {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+    return SSL_CTX_set_max_proto_version(ctx, version);
+#else
+    return -1;
+#endif
+}
+
+static int OUR_SSL_CTX_set_security_level(SSL_CTX *ctx, int level) {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+    SSL_CTX_set_security_level(ctx, level);
+    return 1;
+#else
+    return -1;
+#endif
+}
+
+static int OUR_SSL_CTX_get_security_level(SSL_CTX *ctx) {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+    return SSL_CTX_get_security_level(ctx);
+#else
+    return 0;
+#endif
+}
+
+static const SSL_METHOD *OUR_SSLv3_method() {
+#ifndef OPENSSL_NO_SSL3_METHOD
+    return SSLv3_method();
+#else
+    return NULL;
+#endif
+}
+
+static int SSL_CTX_get_ex_new_index_not_a_macro() {
+    return SSL_CTX_get_ex_new_index(0, NULL, NULL, NULL, NULL);
+}
+
 static const SSL_METHOD *OUR_TLSv1_1_method() {
 #ifdef TLS1_1_VERSION
     return TLSv1_1_method();
@@ -78,30 +176,147 @@ static const SSL_METHOD *OUR_TLSv1_2_method() {
 #endif
 }
 
+// NULL if properties need OpenSSL 3.0
+static SSL_CTX *OUR_SSL_CTX_new_ex(const SSL_METHOD *method,
+        const char *propq) {
+#if OPENSSL_VERSION_NUMBER >= 0x30000000L
+    return SSL_CTX_new_ex(NULL, propq, method);
+#else
+    return NULL;
+#endif
+}
+
+// sets the chain of the certificate last loaded, taking references of its own
+static int OUR_SSL_CTX_set1_chain(SSL_CTX *ctx, X509 **chain, int n) {
+#if OPENSSL_VERSION_NUMBER >= 0x10002000L
+    STACK_OF(X509) *sk;
+    int i, rv = 0;
+    // no chain falls back on the extra chain certificates
+    if (n == 0)
+        return SSL_CTX_set1_chain(ctx, NULL);
+    sk = sk_X509_new_null();
+    if (sk == NULL)
+        return 0;
+    for (i = 0; i < n; i++) {
+        if (sk_X509_push(sk, chain[i]) <= 0)
+            goto done;
+    }
+    rv = SSL_CTX_set1_chain(ctx, sk);
+done:
+    sk_X509_free(sk);
+    return rv;
+#else
+    return n == 0 ? 1 : -1;
+#endif
+}
+
+extern int OUR_X509_up_ref(X509 *x);
 extern int verify_cb(int ok, X509_STORE_CTX* store);
+extern int record_verify_cb(int ok, X509_STORE_CTX* store);
 */
 import "C"
 
 import (
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"github.com/spacemonkeygo/spacelog"
 )
 
 var (
-	ssl_ctx_idx = C.SSL_CTX_get_ex_new_index(0, nil, nil, nil, nil)
+	ssl_ctx_idx = C.SSL_CTX_get_ex_new_index_not_a_macro()
 
 	logger = spacelog.GetLogger()
 )
 
 type Ctx struct {
-	ctx       *C.SSL_CTX
-	verify_cb VerifyCallback
+	ctx           *C.SSL_CTX
+	verify_cb     VerifyCallback
+	session_store SessionStore
+	// verify_servers makes client connections verify the peer regardless of
+	// the verify mode, which then only applies to servers
+	verify_servers bool
+	// min_version and max_version are emulated with options before OpenSSL
+	// 1.1.0
+	min_version SSLVersion
+	max_version SSLVersion
+	// server_name is the SNI host name clients send unless told otherwise
+	server_name string
+	// verify_override decides which verification errors to let through
+	verify_override func(VerifyError) bool
+	verify_chain_cb VerifyChainCallback
+	spki_pins       map[string]bool
+	// verify_hostname checks the SNI host name during verification
+	verify_hostname bool
+	hostname_flags  CheckFlags
+	// expected_peer_keys are added to each connection, see
+	// SetExpectedPeerKeys
+	expected_peer_keys []PublicKey
+
+	ocsp_mtx          sync.Mutex
+	ocsp_staple       []byte
+	ocsp_cb_set       bool
+	ocsp_client_flags OCSPStapleFlags
+	ocsp_checker      *OCSPChecker
+
+	crl_mtx        sync.Mutex
+	crls           []*C.X509_CRL
+	crl_lookup_set bool
+
+	// the C copy of the NPN protocol list, see npn.go
+	npn_protos unsafe.Pointer
+
+	alpn_mtx    sync.Mutex
+	alpn_protos []string
+	alpn_select AlpnSelectCallback
+	// alpn_conns is set once a server connection has protocols of its own
+	alpn_conns bool
+
+	servername_cb  TLSExtServerNameCallback
+	cert_reloader  *CertReloader
+	client_cert_cb ClientCertificateCallback
+
+	info_cb           InfoCallback
+	msg_cb            MessageCallback
+	metrics           Metrics
+	record_padding_cb RecordPaddingCallback
+
+	handshake_timeout time.Duration
+
+	psk_client_cb PSKClientCallback
+	psk_server_cb PSKServerCallback
+
+	keylog_mtx      sync.Mutex
+	keylog_writer   io.Writer
+	keylog_fallback bool
+	ktls            bool
+
+	custom_ext_mtx sync.Mutex
+	custom_exts    map[uint16]CustomExtension
+
+	dynamic_records bool
+	// require_fips checks cipher configuration, see RequireFIPS
+	require_fips bool
+
+	ticket_mtx      sync.Mutex
+	ticket_keys     [][48]byte
+	ticket_rotation time.Duration
+	ticket_keep     int
+	ticket_rotated  time.Time
+
+	// refs counts the context's own reference, dropped by Free, and one for
+	// each SSL object made from it, see retain
+	refs_mtx sync.Mutex
+	refs     int
+	freed    bool
 }
 
 //export get_ssl_ctx_idx
@@ -110,20 +325,84 @@ func get_ssl_ctx_idx() C.int {
 }
 
 func newCtx(method *C.SSL_METHOD) (*Ctx, error) {
+	return newCtxWithProperties(method, "")
+}
+
+// newCtxWithProperties creates a context fetching its algorithms with the
+// property query propq, if not empty, see NewCtxWithProperties.
+func newCtxWithProperties(method *C.SSL_METHOD, propq string) (*Ctx, error) {
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
-	ctx := C.SSL_CTX_new(method)
+	var ctx *C.SSL_CTX
+	if propq == "" {
+		ctx = C.SSL_CTX_new(method)
+	} else if !providersSupported {
+		return nil, providersUnsupported
+	} else {
+		cpropq := C.CString(propq)
+		defer C.free(unsafe.Pointer(cpropq))
+		ctx = C.OUR_SSL_CTX_new_ex(method, cpropq)
+	}
 	if ctx == nil {
 		return nil, errorFromErrorQueue()
 	}
-	c := &Ctx{ctx: ctx}
+	c := &Ctx{ctx: ctx, refs: 1}
 	C.SSL_CTX_set_ex_data(ctx, get_ssl_ctx_idx(), unsafe.Pointer(c))
-	runtime.SetFinalizer(c, func(c *Ctx) {
-		C.SSL_CTX_free(c.ctx)
-	})
+	atomic.AddInt64(&statContexts, 1)
+	trackObject(unsafe.Pointer(c), "Ctx")
+	setFinalizer(unsafe.Pointer(c), c, (*Ctx).Free)
 	return c, nil
 }
 
+var ctxFreed = errors.New("context has been freed")
+
+// Free releases the context without waiting for the garbage collector.
+// Connections already made with it hold references of their own, so the
+// OpenSSL objects behind it are freed once the last of them is freed too.
+// New connections can't be made with the context afterwards, and it must
+// not be configured any further. Calling Free again is harmless.
+func (c *Ctx) Free() {
+	c.refs_mtx.Lock()
+	if c.freed {
+		c.refs_mtx.Unlock()
+		return
+	}
+	c.freed = true
+	c.refs_mtx.Unlock()
+	runtime.SetFinalizer(c, nil)
+	untrackObject(unsafe.Pointer(c))
+	c.release()
+}
+
+// retain adds a reference to the context for an SSL object made from it,
+// which must be dropped with release once the SSL object is freed. It fails
+// once the context has been freed.
+func (c *Ctx) retain() error {
+	c.refs_mtx.Lock()
+	defer c.refs_mtx.Unlock()
+	if c.freed {
+		return ctxFreed
+	}
+	c.refs++
+	return nil
+}
+
+// release drops a reference to the context, freeing it with the last one.
+func (c *Ctx) release() {
+	c.refs_mtx.Lock()
+	c.refs--
+	last := c.refs == 0
+	c.refs_mtx.Unlock()
+	if !last {
+		return
+	}
+	C.SSL_CTX_free(c.ctx)
+	c.ctx = nil
+	c.freeCRLs()
+	c.freeNextProtos()
+	atomic.AddInt64(&statContexts, -1)
+}
+
 type SSLVersion int
 
 const (
@@ -132,28 +411,183 @@ const (
 	TLSv1_1    SSLVersion = 0x04
 	TLSv1_2    SSLVersion = 0x05
 	AnyVersion SSLVersion = 0x06
+	// TLSv1_3 is only valid if you are using OpenSSL 1.1.1 or newer.
+	TLSv1_3 SSLVersion = 0x07
 )
 
+// String returns the version's name as OpenSSL spells it, e.g. "TLSv1.3".
+func (v SSLVersion) String() string {
+	switch v {
+	case SSLv3:
+		return "SSLv3"
+	case TLSv1:
+		return "TLSv1"
+	case TLSv1_1:
+		return "TLSv1.1"
+	case TLSv1_2:
+		return "TLSv1.2"
+	case TLSv1_3:
+		return "TLSv1.3"
+	case AnyVersion:
+		return "any"
+	}
+	return fmt.Sprintf("SSLVersion(%d)", int(v))
+}
+
 // NewCtxWithVersion creates an SSL context that is specific to the provided
 // SSL version. See http://www.openssl.org/docs/ssl/SSL_CTX_new.html for more.
 func NewCtxWithVersion(version SSLVersion) (*Ctx, error) {
 	var method *C.SSL_METHOD
 	switch version {
 	case SSLv3:
-		method = C.SSLv3_method()
+		method = C.OUR_SSLv3_method()
 	case TLSv1:
 		method = C.TLSv1_method()
 	case TLSv1_1:
 		method = C.OUR_TLSv1_1_method()
 	case TLSv1_2:
 		method = C.OUR_TLSv1_2_method()
-	case AnyVersion:
+	case AnyVersion, TLSv1_3:
 		method = C.SSLv23_method()
 	}
 	if method == nil {
 		return nil, errors.New("unknown ssl/tls version")
 	}
-	return newCtx(method)
+	c, err := newCtx(method)
+	if err != nil || version != TLSv1_3 {
+		return c, err
+	}
+	// there is no TLS 1.3 specific method, only version bounds
+	switch C.OUR_SSL_CTX_set_tls13_only(c.ctx) {
+	case 1:
+		return c, nil
+	case -1:
+		return nil, tls13Unsupported
+	default:
+		return nil, errorFromErrorQueue()
+	}
+}
+
+// protoVersions are the versions SetMinProtoVersion and SetMaxProtoVersion
+// take, oldest first, with their wire values and the options turning them
+// off.
+var protoVersions = []struct {
+	version SSLVersion
+	wire    C.int
+	option  Options
+}{
+	{SSLv3, 0x0300, NoSSLv3},
+	{TLSv1, 0x0301, NoTLSv1},
+	{TLSv1_1, 0x0302, NoTLSv1_1},
+	{TLSv1_2, 0x0303, NoTLSv1_2},
+	{TLSv1_3, 0x0304, NoTLSv1_3},
+}
+
+// protoVersionIndex returns the position of version in protoVersions, or -1
+// for AnyVersion.
+func protoVersionIndex(version SSLVersion) (int, error) {
+	if version == AnyVersion {
+		return -1, nil
+	}
+	for i, v := range protoVersions {
+		if v.version == version {
+			return i, nil
+		}
+	}
+	return 0, errors.New("unknown ssl/tls version")
+}
+
+// SetMinProtoVersion sets the oldest protocol version connections using the
+// context accept, with AnyVersion for the oldest the library supports. Unlike
+// turning versions off with options, bounds keep covering versions added to
+// OpenSSL later. Before OpenSSL 1.1.0, the bounds are emulated with the
+// NoSSLv3 to NoTLSv1_3 options, which they then take over; SSLv3 stays off
+// unless it is the minimum.
+func (c *Ctx) SetMinProtoVersion(version SSLVersion) error {
+	return c.setProtoVersion(version, &c.min_version,
+		func(wire C.int) C.int {
+			return C.OUR_SSL_CTX_set_min_proto_version(c.ctx, wire)
+		})
+}
+
+// SetMaxProtoVersion sets the newest protocol version connections using the
+// context accept, with AnyVersion for the newest the library supports. See
+// SetMinProtoVersion.
+func (c *Ctx) SetMaxProtoVersion(version SSLVersion) error {
+	return c.setProtoVersion(version, &c.max_version,
+		func(wire C.int) C.int {
+			return C.OUR_SSL_CTX_set_max_proto_version(c.ctx, wire)
+		})
+}
+
+func (c *Ctx) setProtoVersion(version SSLVersion, bound *SSLVersion,
+	set func(wire C.int) C.int) error {
+	i, err := protoVersionIndex(version)
+	if err != nil {
+		return err
+	}
+	var wire C.int
+	if i >= 0 {
+		wire = protoVersions[i].wire
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	switch set(wire) {
+	case 1:
+		return nil
+	case -1:
+	default:
+		return errorFromErrorQueue()
+	}
+	if version == TLSv1_3 && NoTLSv1_3 == 0 {
+		return tls13Unsupported
+	}
+	*bound = version
+	c.emulateProtoVersions()
+	return nil
+}
+
+// emulateProtoVersions turns versions on and off with options to stay within
+// min_version and max_version, where OpenSSL has no bounds of its own.
+func (c *Ctx) emulateProtoVersions() {
+	min_i, err := protoVersionIndex(c.min_version)
+	if err != nil || min_i < 0 {
+		min_i = 0
+	}
+	max_i, err := protoVersionIndex(c.max_version)
+	if err != nil || max_i < 0 {
+		max_i = len(protoVersions) - 1
+	}
+	for i, v := range protoVersions {
+		switch {
+		case i < min_i || i > max_i:
+			c.SetOptions(v.option)
+		case v.version != SSLv3 || c.min_version == SSLv3:
+			c.ClearOptions(v.option)
+		}
+	}
+}
+
+// SetSecurityLevel sets OpenSSL's security level, from 0 to 5, which rules
+// out keys, signature algorithms, ciphers and protocol versions weaker than
+// the level allows, e.g. RSA keys under 2048 bits at level 2. Before
+// OpenSSL 1.1.0 there are no security levels, which is level 0, and setting
+// any other fails.
+func (c *Ctx) SetSecurityLevel(level int) error {
+	if level < 0 || level > 5 {
+		return fmt.Errorf("invalid security level %d", level)
+	}
+	if C.OUR_SSL_CTX_set_security_level(c.ctx, C.int(level)) < 0 &&
+		level != 0 {
+		return errors.New("security levels require OpenSSL 1.1.0 or newer")
+	}
+	return nil
+}
+
+// SecurityLevel returns the security level set with SetSecurityLevel, or the
+// library's default, which is 1 unless OpenSSL was configured otherwise.
+func (c *Ctx) SecurityLevel() int {
+	return int(C.OUR_SSL_CTX_get_security_level(c.ctx))
 }
 
 // NewCtx creates a context that supports any TLS version 1.0 and newer.
@@ -165,6 +599,18 @@ func NewCtx() (*Ctx, error) {
 	return c, err
 }
 
+// NewCtxWithProperties is NewCtx for a context fetching the algorithms it
+// uses with the OpenSSL 3.0 property query propq, e.g. "provider=default"
+// or "fips=yes", in place of the process wide default properties, see
+// SetDefaultProperties.
+func NewCtxWithProperties(propq string) (*Ctx, error) {
+	c, err := newCtxWithProperties(C.SSLv23_method(), propq)
+	if err == nil {
+		c.SetOptions(NoSSLv2 | NoSSLv3)
+	}
+	return c, err
+}
+
 // NewCtxFromFiles calls NewCtx, loads the provided files, and configures the
 // context to use them.
 func NewCtxFromFiles(cert_file string, key_file string) (*Ctx, error) {
@@ -206,6 +652,51 @@ func NewCtxFromFiles(cert_file string, key_file string) (*Ctx, error) {
 	return ctx, nil
 }
 
+// NewCtxFromMemory calls NewCtx and configures the context with the
+// certificate chain in chain_pem, leaf first, and the private key in key_pem,
+// decrypting it with password if it is encrypted. Unlike NewCtxFromFiles, the
+// secrets need not be written to disk, e.g. when fetched from a key
+// management service.
+func NewCtxFromMemory(chain_pem, key_pem []byte, password string) (*Ctx,
+	error) {
+	chain, err := LoadCertificateChainFromPEM(chain_pem)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, cert := range chain {
+			cert.Free()
+		}
+	}()
+	key, err := LoadPrivateKeyFromPEMWithPassword(key_pem, password)
+	if err != nil {
+		return nil, err
+	}
+	ctx, err := NewCtx()
+	if err != nil {
+		return nil, err
+	}
+	err = ctx.UseCertificate(chain[0])
+	if err != nil {
+		return nil, err
+	}
+	for _, cert := range chain[1:] {
+		err = ctx.AddChainCertificate(cert)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = ctx.UsePrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	err = ctx.CheckPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	return ctx, nil
+}
+
 // EllipticCurve repesents the ASN.1 OID of an elliptic curve.
 // see https://www.openssl.org/docs/apps/ecparam.html for a list of implemented curves.
 type EllipticCurve int
@@ -215,6 +706,8 @@ const (
 	Prime256v1 EllipticCurve = C.NID_X9_62_prime256v1
 	// P-384: NIST/SECG curve over a 384 bit prime field
 	Secp384r1 EllipticCurve = C.NID_secp384r1
+	// P-521: NIST/SECG curve over a 521 bit prime field
+	Secp521r1 EllipticCurve = C.NID_secp521r1
 )
 
 // SetEllipticCurve sets the elliptic curve used by the SSL context to
@@ -239,9 +732,14 @@ func (c *Ctx) SetEllipticCurve(curve EllipticCurve) error {
 // UseCertificate configures the context to present the given certificate to
 // peers.
 func (c *Ctx) UseCertificate(cert *Certificate) error {
+	x := cert.acquireX509()
+	if x == nil {
+		return certificateFreed
+	}
+	defer C.X509_free(x)
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
-	if int(C.SSL_CTX_use_certificate(c.ctx, cert.x)) != 1 {
+	if int(C.SSL_CTX_use_certificate(c.ctx, x)) != 1 {
 		return errorFromErrorQueue()
 	}
 	return nil
@@ -250,9 +748,16 @@ func (c *Ctx) UseCertificate(cert *Certificate) error {
 // AddChainCertificate adds a certificate to the chain presented in the
 // handshake.
 func (c *Ctx) AddChainCertificate(cert *Certificate) error {
+	// the context takes over the reference it is given, so hand it one of
+	// its own rather than the one owned by cert
+	x := cert.acquireX509()
+	if x == nil {
+		return certificateFreed
+	}
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
-	if int(C.SSL_CTX_add_extra_chain_cert_not_a_macro(c.ctx, cert.x)) != 1 {
+	if int(C.SSL_CTX_add_extra_chain_cert_not_a_macro(c.ctx, x)) != 1 {
+		C.X509_free(x)
 		return errorFromErrorQueue()
 	}
 	return nil
@@ -261,9 +766,83 @@ func (c *Ctx) AddChainCertificate(cert *Certificate) error {
 // UsePrivateKey configures the context to use the given private key for SSL
 // handshakes.
 func (c *Ctx) UsePrivateKey(key PrivateKey) error {
+	pkey := key.acquirePKey()
+	if pkey == nil {
+		return keyFreed
+	}
+	defer C.EVP_PKEY_free(pkey)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if int(C.SSL_CTX_use_PrivateKey(c.ctx, pkey)) != 1 {
+		return errorFromErrorQueue()
+	}
+	return nil
+}
+
+// AddKeyPair adds cert and key, along with the chain presented with cert,
+// alongside the context's other certificates. OpenSSL keeps one
+// certificate per key type, so a server can have an ECDSA certificate for
+// clients that support it and an RSA one for the rest, picking between them
+// by what each client offers. Adding a pair of a type the context already
+// has replaces it. Certificates without a chain of their own are presented
+// with those added by AddChainCertificate. A chain requires OpenSSL 1.0.2 or
+// newer.
+func (c *Ctx) AddKeyPair(cert *Certificate, key PrivateKey,
+	chain []*Certificate) error {
+	// the key goes in the slot of its own type whatever cert is, so
+	// CheckPrivateKey could miss a mismatch
+	matches, err := cert.MatchesKey(key)
+	if err != nil {
+		return err
+	}
+	if !matches {
+		return errors.New("private key does not match the certificate")
+	}
+	if err := c.UseCertificate(cert); err != nil {
+		return err
+	}
+	if err := c.UsePrivateKey(key); err != nil {
+		return err
+	}
+	xs := make([]*C.X509, 0, len(chain))
+	defer func() {
+		for _, x := range xs {
+			C.X509_free(x)
+		}
+	}()
+	for _, cert := range chain {
+		x := cert.acquireX509()
+		if x == nil {
+			return certificateFreed
+		}
+		xs = append(xs, x)
+	}
+	var xs_ptr **C.X509
+	if len(xs) > 0 {
+		xs_ptr = &xs[0]
+	}
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
-	if int(C.SSL_CTX_use_PrivateKey(c.ctx, key.evpPKey())) != 1 {
+	switch C.OUR_SSL_CTX_set1_chain(c.ctx, xs_ptr, C.int(len(xs))) {
+	case 1:
+		return nil
+	case -1:
+		return errors.New("per-certificate chains require OpenSSL 1.0.2 " +
+			"or newer")
+	default:
+		return errorFromErrorQueue()
+	}
+}
+
+// CheckPrivateKey checks that the context's private key matches the public
+// key of its certificate, so that a mismatched pair is caught when the
+// context is set up rather than by failing handshakes. It fails if either is
+// missing. UseCertificate drops a private key that doesn't match the new
+// certificate, so the mismatch then shows up here as a missing key.
+func (c *Ctx) CheckPrivateKey() error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.SSL_CTX_check_private_key(c.ctx) != 1 {
 		return errorFromErrorQueue()
 	}
 	return nil
@@ -287,9 +866,42 @@ func (c *Ctx) GetCertificateStore() *CertificateStore {
 // AddCertificate marks the provided Certificate as a trusted certificate in
 // the given CertificateStore.
 func (s *CertificateStore) AddCertificate(cert *Certificate) error {
+	defer runtime.KeepAlive(s)
+	x := cert.acquireX509()
+	if x == nil {
+		return certificateFreed
+	}
+	defer C.X509_free(x)
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
-	if int(C.X509_STORE_add_cert(s.store, cert.x)) != 1 {
+	if int(C.X509_STORE_add_cert(s.store, x)) != 1 {
+		return errorFromErrorQueue()
+	}
+	return nil
+}
+
+// VerifyFlags adjust how peer certificates are verified.
+type VerifyFlags int
+
+const (
+	// CRLCheck checks the peer's certificate against the CRLs of its
+	// issuer, failing verification with UnableToGetCrl if there are none.
+	CRLCheck VerifyFlags = C.X509_V_FLAG_CRL_CHECK
+	// CRLCheckAll, together with CRLCheck, checks every certificate in the
+	// chain rather than just the peer's.
+	CRLCheckAll VerifyFlags = C.X509_V_FLAG_CRL_CHECK_ALL
+	// X509Strict turns off workarounds for broken certificates.
+	X509Strict VerifyFlags = C.X509_V_FLAG_X509_STRICT
+	// PartialChain lets intermediates in the store act as trust anchors.
+	// It is only valid if you are using OpenSSL 1.0.2 or newer.
+	PartialChain VerifyFlags = C.X509_V_FLAG_PARTIAL_CHAIN
+)
+
+// SetFlags turns on flags for verifying peer certificates against the
+// store, in addition to those already set.
+func (s *CertificateStore) SetFlags(flags VerifyFlags) error {
+	defer runtime.KeepAlive(s)
+	if C.X509_STORE_set_flags(s.store, C.ulong(flags)) != 1 {
 		return errorFromErrorQueue()
 	}
 	return nil
@@ -309,26 +921,33 @@ func (self *CertificateStoreCtx) Err() error {
 		C.GoString(C.X509_verify_cert_error_string(C.long(code))))
 }
 
+// ErrorCode returns the result of the check that failed for the certificate
+// being verified, or Ok.
+func (self *CertificateStoreCtx) ErrorCode() VerifyResult {
+	return VerifyResult(C.X509_STORE_CTX_get_error(self.ctx))
+}
+
+// SetErrorCode changes the result Conn.VerifyResult will report. A
+// VerifyCallback accepting a failed check should set it to Ok, or the
+// handshake succeeds with the connection still reporting the error.
+func (self *CertificateStoreCtx) SetErrorCode(result VerifyResult) {
+	C.X509_STORE_CTX_set_error(self.ctx, C.int(result))
+}
+
+// Depth returns the position in the chain of the certificate being
+// verified, 0 being the peer's own.
 func (self *CertificateStoreCtx) Depth() int {
 	return int(C.X509_STORE_CTX_get_error_depth(self.ctx))
 }
 
-// the certicate returned is only valid for the lifetime of the underlying
-// X509_STORE_CTX
+// GetCurrentCert returns the certificate being verified. It holds its own
+// reference, so it remains valid after the X509_STORE_CTX is gone.
 func (self *CertificateStoreCtx) GetCurrentCert() *Certificate {
 	x509 := C.X509_STORE_CTX_get_current_cert(self.ctx)
 	if x509 == nil {
 		return nil
 	}
-	// add a ref
-	C.CRYPTO_add_not_a_macro(&x509.references, 1, C.CRYPTO_LOCK_X509)
-	cert := &Certificate{
-		x: x509,
-	}
-	runtime.SetFinalizer(cert, func(cert *Certificate) {
-		C.X509_free(cert.x)
-	})
-	return cert
+	return refCertificate(x509)
 }
 
 // LoadVerifyLocations tells the context to trust all certificate authorities
@@ -353,24 +972,82 @@ func (c *Ctx) LoadVerifyLocations(ca_file string, ca_path string) error {
 	return nil
 }
 
+// SetDefaultVerifyPaths tells the context to trust the certificate
+// authorities in the locations the linked OpenSSL was configured with,
+// usually the distribution's CA bundle. The SSL_CERT_FILE and SSL_CERT_DIR
+// environment variables override them; see DefaultVerifyPaths.
+func (c *Ctx) SetDefaultVerifyPaths() error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.SSL_CTX_set_default_verify_paths(c.ctx) != 1 {
+		return errorFromErrorQueue()
+	}
+	return nil
+}
+
+// DefaultVerifyPaths returns the CA file and directory SetDefaultVerifyPaths
+// loads, taking the environment into account.
+func DefaultVerifyPaths() (ca_file string, ca_path string) {
+	ca_file = os.Getenv(C.GoString(C.X509_get_default_cert_file_env()))
+	if ca_file == "" {
+		ca_file = C.GoString(C.X509_get_default_cert_file())
+	}
+	ca_path = os.Getenv(C.GoString(C.X509_get_default_cert_dir_env()))
+	if ca_path == "" {
+		ca_path = C.GoString(C.X509_get_default_cert_dir())
+	}
+	return ca_file, ca_path
+}
+
 type Options int
 
 const (
-	// NoCompression is only valid if you are using OpenSSL 1.0.1 or newer
+	// NoCompression is only valid if you are using OpenSSL 1.0.1 or newer,
+	// and NoTLSv1_3 if you are using OpenSSL 1.1.1 or newer
 	NoCompression                      Options = C.SSL_OP_NO_COMPRESSION
 	NoSSLv2                            Options = C.SSL_OP_NO_SSLv2
 	NoSSLv3                            Options = C.SSL_OP_NO_SSLv3
 	NoTLSv1                            Options = C.SSL_OP_NO_TLSv1
 	NoTLSv1_1                          Options = C.SSL_OP_NO_TLSv1_1
 	NoTLSv1_2                          Options = C.SSL_OP_NO_TLSv1_2
+	NoTLSv1_3                          Options = C.SSL_OP_NO_TLSv1_3
 	CipherServerPreference             Options = C.SSL_OP_CIPHER_SERVER_PREFERENCE
 	NoSessionResumptionOrRenegotiation Options = C.SSL_OP_NO_SESSION_RESUMPTION_ON_RENEGOTIATION
 	NoTicket                           Options = C.SSL_OP_NO_TICKET
+	// NoRenegotiation is only valid if you are using OpenSSL 1.1.0h or newer.
+	// See Ctx.DisableRenegotiation for something that works everywhere.
+	// Either fails connections with a *RenegotiationError once a
+	// renegotiation is declined.
+	NoRenegotiation Options = C.SSL_OP_NO_RENEGOTIATION
+	// AllowUnsafeLegacyRenegotiation allows renegotiation with peers that
+	// don't support secure renegotiation, which exposes connections to
+	// prefix injection (CVE-2009-3555). See
+	// Conn.SecureRenegotiationSupported.
+	AllowUnsafeLegacyRenegotiation Options = C.SSL_OP_ALLOW_UNSAFE_LEGACY_RENEGOTIATION
+	// LegacyServerConnect lets clients connect to servers that don't support
+	// secure renegotiation. It is the default before OpenSSL 3.0.
+	LegacyServerConnect Options = C.SSL_OP_LEGACY_SERVER_CONNECT
+	// EnableMiddleboxCompat makes TLS 1.3 handshakes look more like TLS 1.2
+	// resumptions, with a session ID and ChangeCipherSpec records, which
+	// gets them past middleboxes that would otherwise break them. It is on
+	// by default; clear it to save the extra bytes with peers known to be
+	// reachable without it. It is only valid if you are using OpenSSL 1.1.1
+	// or newer.
+	EnableMiddleboxCompat Options = C.SSL_OP_ENABLE_MIDDLEBOX_COMPAT
+	// NoAntiReplay turns off the check servers make, with their internal
+	// session cache on, that TLS 1.3 early data is only accepted once per
+	// session, e.g. for servers that protect against replay themselves. See
+	// SetMaxEarlyData. It is only valid if you are using OpenSSL 1.1.1 or
+	// newer.
+	NoAntiReplay Options = C.SSL_OP_NO_ANTI_REPLAY
 )
 
 // SetOptions sets context options. See
 // http://www.openssl.org/docs/ssl/SSL_CTX_set_options.html
 func (c *Ctx) SetOptions(options Options) Options {
+	if options&NoRenegotiation != 0 {
+		c.watchRenegotiations()
+	}
 	return Options(C.SSL_CTX_set_options_not_a_macro(
 		c.ctx, C.long(options)))
 }
@@ -383,16 +1060,51 @@ func (c *Ctx) ClearOptions(options Options) Options {
 type Modes int
 
 const (
-	// ReleaseBuffers is only valid if you are using OpenSSL 1.0.1 or newer
+	// ReleaseBuffers frees a connection's read and write buffers, both in
+	// OpenSSL and in this package, whenever they empty, rather than keeping
+	// them for the life of the connection. That saves about 34KB per idle
+	// connection at the cost of reallocating them on activity. It is only
+	// valid if you are using OpenSSL 1.0.1 or newer.
 	ReleaseBuffers Modes = C.SSL_MODE_RELEASE_BUFFERS
+	// AutoRetry makes OpenSSL read past handshake messages, such as TLS 1.3
+	// session tickets, to the application data behind them rather than
+	// returning to retry. It is the default as of OpenSSL 1.1.1.
+	AutoRetry Modes = C.SSL_MODE_AUTO_RETRY
+	// EnablePartialWrite lets OpenSSL write a large buffer a record at a
+	// time. Conn.Write still writes all of its argument before returning,
+	// but only buffers a record's worth of ciphertext at once.
+	EnablePartialWrite Modes = C.SSL_MODE_ENABLE_PARTIAL_WRITE
+	// AcceptMovingWriteBuffer allows a write that has to be retried to be
+	// retried from a different buffer with the same contents.
+	AcceptMovingWriteBuffer Modes = C.SSL_MODE_ACCEPT_MOVING_WRITE_BUFFER
+	// SendFallbackSCSV marks a client's ClientHello as a fallback retry
+	// (RFC 7507), for clients that retry failed handshakes with older
+	// protocol versions. Servers supporting a newer version than offered
+	// then refuse the handshake, so an attacker can't force a downgrade by
+	// disrupting the first attempts, and the handshake fails with
+	// DowngradeDetected. Set it, usually with Conn.SetMode, only on retries
+	// that offer less than the client supports. It is only valid if you are
+	// using OpenSSL 1.0.1j or newer.
+	SendFallbackSCSV Modes = C.SSL_MODE_SEND_FALLBACK_SCSV
+	// Async runs handshakes and record encryption as OpenSSL async jobs,
+	// which engines offloading crypto to hardware, such as Intel QAT's, can
+	// pause while the hardware works. See Ctx.EnableAsync. It is only valid
+	// if you are using OpenSSL 1.1.0 or newer.
+	Async Modes = C.SSL_MODE_ASYNC
 )
 
-// SetMode sets context modes. See
+// SetMode sets context modes, in addition to those already set, and returns
+// the resulting modes. Modes apply to connections created afterwards. See
 // http://www.openssl.org/docs/ssl/SSL_CTX_set_mode.html
 func (c *Ctx) SetMode(modes Modes) Modes {
 	return Modes(C.SSL_CTX_set_mode_not_a_macro(c.ctx, C.long(modes)))
 }
 
+// ClearMode clears context modes and returns the remaining ones.
+func (c *Ctx) ClearMode(modes Modes) Modes {
+	return Modes(C.SSL_CTX_clear_mode_not_a_macro(c.ctx, C.long(modes)))
+}
+
 // GetMode returns context modes. See
 // http://www.openssl.org/docs/ssl/SSL_CTX_set_mode.html
 func (c *Ctx) GetMode() Modes {
@@ -402,12 +1114,27 @@ func (c *Ctx) GetMode() Modes {
 type VerifyOptions int
 
 const (
-	VerifyNone             VerifyOptions = C.SSL_VERIFY_NONE
-	VerifyPeer             VerifyOptions = C.SSL_VERIFY_PEER
+	VerifyNone VerifyOptions = C.SSL_VERIFY_NONE
+	// VerifyPeer makes clients verify the server's certificate. Servers
+	// request a certificate from clients and verify any they send, but
+	// carry on without one.
+	VerifyPeer VerifyOptions = C.SSL_VERIFY_PEER
+	// VerifyFailIfNoPeerCert, together with VerifyPeer, makes servers
+	// require a client certificate.
 	VerifyFailIfNoPeerCert VerifyOptions = C.SSL_VERIFY_FAIL_IF_NO_PEER_CERT
 	VerifyClientOnce       VerifyOptions = C.SSL_VERIFY_CLIENT_ONCE
+	// VerifyPostHandshake is only valid if you are using OpenSSL 1.1.1 or
+	// newer. See Conn.VerifyClientPostHandshake.
+	VerifyPostHandshake VerifyOptions = C.SSL_VERIFY_POST_HANDSHAKE
 )
 
+// VerifyCallback is called for each certificate in the peer's chain, from
+// the root down to the peer's own, and again for each failed check. ok says
+// whether OpenSSL's checks passed so far; store gives the certificate, its
+// depth and the failure. The callback returns whether to carry on, so
+// returning true for a failure accepts it, such as the
+// DepthZeroSelfSignedCert of a known self-signed certificate. The handshake
+// holds the connection's lock while it runs.
 type VerifyCallback func(ok bool, store *CertificateStoreCtx) bool
 
 //export verify_cb_thunk
@@ -418,7 +1145,28 @@ func verify_cb_thunk(p unsafe.Pointer, ok C.int, ctx *C.X509_STORE_CTX) C.int {
 			os.Exit(1)
 		}
 	}()
-	verify_cb := (*Ctx)(p).verify_cb
+	c := (*Ctx)(p)
+	if ok == 0 && c.verify_override != nil {
+		store := &CertificateStoreCtx{ctx: ctx}
+		verify_err := VerifyError{
+			Result:      VerifyResult(C.X509_STORE_CTX_get_error(ctx)),
+			Depth:       store.Depth(),
+			Certificate: store.GetCurrentCert()}
+		if c.verify_override(verify_err) {
+			// so the connection's VerifyResult doesn't report it either
+			C.X509_STORE_CTX_set_error(ctx, C.X509_V_OK)
+			ok = 1
+		}
+	}
+	if ok == 1 && c.checksVerifiedChain() &&
+		C.X509_STORE_CTX_get_error_depth(ctx) == 0 {
+		store := &CertificateStoreCtx{ctx: ctx}
+		if result := c.checkVerifiedChain(store.Chain()); result != Ok {
+			store.SetErrorCode(result)
+			ok = 0
+		}
+	}
+	verify_cb := c.verify_cb
 	// set up defaults just in case verify_cb is nil
 	if verify_cb != nil {
 		store := &CertificateStoreCtx{ctx: ctx}
@@ -431,14 +1179,38 @@ func verify_cb_thunk(p unsafe.Pointer, ok C.int, ctx *C.X509_STORE_CTX) C.int {
 	return ok
 }
 
+// checksVerifiedChain says whether the context has checks of its own to run
+// once OpenSSL has verified the peer's chain.
+func (c *Ctx) checksVerifiedChain() bool {
+	return c.spki_pins != nil || c.ocspChecker() != nil ||
+		c.verify_chain_cb != nil
+}
+
+// checkVerifiedChain runs the context's checks on the peer's verified chain,
+// returning the verify result to fail verification with, or Ok.
+func (c *Ctx) checkVerifiedChain(chain []*Certificate) VerifyResult {
+	if c.spki_pins != nil && !c.matchesSPKIPin(chain) {
+		return ApplicationVerification
+	}
+	if result := c.checkOCSP(chain); result != Ok {
+		return result
+	}
+	if c.verify_chain_cb != nil && c.verify_chain_cb(chain) != nil {
+		return ApplicationVerification
+	}
+	return Ok
+}
+
 // SetVerify controls peer verification settings. See
 // http://www.openssl.org/docs/ssl/SSL_CTX_set_verify.html
 func (c *Ctx) SetVerify(options VerifyOptions, verify_cb VerifyCallback) {
 	c.verify_cb = verify_cb
-	if verify_cb != nil {
+	if verify_cb != nil || c.verify_override != nil ||
+		c.checksVerifiedChain() {
 		C.SSL_CTX_set_verify(c.ctx, C.int(options), (*[0]byte)(C.verify_cb))
 	} else {
-		C.SSL_CTX_set_verify(c.ctx, C.int(options), nil)
+		C.SSL_CTX_set_verify(c.ctx, C.int(options),
+			(*[0]byte)(C.record_verify_cb))
 	}
 }
 
@@ -446,14 +1218,82 @@ func (c *Ctx) SetVerifyMode(options VerifyOptions) {
 	c.SetVerify(options, c.verify_cb)
 }
 
+// SetVerifyCallback sets the callback deciding on peer certificates, keeping
+// the verify mode. A nil verify_cb removes it. For accepting specific
+// errors, SetVerifyErrorOverride is simpler.
 func (c *Ctx) SetVerifyCallback(verify_cb VerifyCallback) {
 	c.SetVerify(c.VerifyMode(), verify_cb)
 }
 
+// VerifyError describes a failed check during peer certificate verification.
+// Connections whose handshake fails verification return one, with a Depth of
+// -1 and no Certificate where the failing certificate isn't known, as with
+// OpenSSL before 1.1.0.
+type VerifyError struct {
+	// Result is the failed check.
+	Result VerifyResult
+	// Depth is the position in the chain of the certificate that failed it,
+	// 0 being the peer's own.
+	Depth int
+	// Certificate is the certificate that failed it.
+	Certificate *Certificate
+
+	err *Error
+}
+
+func (e VerifyError) Error() string {
+	if e.Depth < 0 {
+		return fmt.Sprintf("openssl: %s", C.GoString(
+			C.X509_verify_cert_error_string(C.long(e.Result))))
+	}
+	return fmt.Sprintf("openssl: %s at depth %d",
+		C.GoString(C.X509_verify_cert_error_string(C.long(e.Result))),
+		e.Depth)
+}
+
+func (e VerifyError) Is(target error) bool {
+	return target == ErrVerification
+}
+
+// Unwrap returns the Error a connection's handshake failed with, for
+// VerifyErrors returned by Conn.
+func (e VerifyError) Unwrap() error {
+	if e.err == nil {
+		return nil
+	}
+	return e.err
+}
+
+// SetVerifyErrorOverride lets override accept specific verification errors,
+// such as CertHasExpired for peers on an isolated network, while every other
+// check still applies. It is called for each error found, and returning true
+// lets verification carry on as if the check had passed. Errors it accepts
+// are not reported by Conn.VerifyResult. It runs before any VerifyCallback,
+// which then sees the error as accepted. A nil override removes it.
+// Verification must still be turned on with the verify mode.
+func (c *Ctx) SetVerifyErrorOverride(override func(VerifyError) bool) {
+	c.verify_override = override
+	c.SetVerify(c.VerifyMode(), c.verify_cb)
+}
+
 func (c *Ctx) VerifyMode() VerifyOptions {
 	return VerifyOptions(C.SSL_CTX_get_verify_mode(c.ctx))
 }
 
+// SetPostHandshakeAuth controls whether clients using this context offer to
+// send a certificate after a TLS 1.3 handshake when the server asks for one
+// with Conn.VerifyClientPostHandshake. It is off by default.
+func (c *Ctx) SetPostHandshakeAuth(enabled bool) error {
+	var val C.int
+	if enabled {
+		val = 1
+	}
+	if C.OUR_SSL_CTX_set_post_handshake_auth(c.ctx, val) < 0 {
+		return tls13Unsupported
+	}
+	return nil
+}
+
 // SetVerifyDepth controls how many certificates deep the certificate
 // verification logic is willing to follow a certificate chain. See
 // https://www.openssl.org/docs/ssl/SSL_CTX_set_verify.html
@@ -486,6 +1326,9 @@ func (c *Ctx) SetCipherList(list string) error {
 	if int(C.SSL_CTX_set_cipher_list(c.ctx, clist)) == 0 {
 		return errorFromErrorQueue()
 	}
+	if c.require_fips {
+		return c.checkFIPS()
+	}
 	return nil
 }
 
@@ -508,3 +1351,85 @@ func (c *Ctx) SetSessionCacheMode(modes SessionCacheModes) SessionCacheModes {
 	return SessionCacheModes(
 		C.SSL_CTX_set_session_cache_mode_not_a_macro(c.ctx, C.long(modes)))
 }
+
+// SessionCacheMode returns the session caching modes in effect.
+func (c *Ctx) SessionCacheMode() SessionCacheModes {
+	return SessionCacheModes(C.SSL_CTX_ctrl(c.ctx,
+		C.SSL_CTRL_GET_SESS_CACHE_MODE, 0, nil))
+}
+
+// SetSessionCacheSize limits the number of sessions the server keeps in its
+// internal cache, returning the previous limit. Once full, expired sessions
+// are flushed to make room, and failing that new sessions aren't cached. 0
+// means no limit; OpenSSL defaults to 20480. See
+// http://www.openssl.org/docs/ssl/SSL_CTX_sess_set_cache_size.html
+func (c *Ctx) SetSessionCacheSize(size int) int {
+	return int(C.SSL_CTX_ctrl(c.ctx, C.SSL_CTRL_SET_SESS_CACHE_SIZE,
+		C.long(size), nil))
+}
+
+// SessionCacheSize returns the limit set with SetSessionCacheSize.
+func (c *Ctx) SessionCacheSize() int {
+	return int(C.SSL_CTX_ctrl(c.ctx, C.SSL_CTRL_GET_SESS_CACHE_SIZE, 0, nil))
+}
+
+// SetSessionTimeout sets how long new sessions can be resumed for, to the
+// second, returning the previous timeout. OpenSSL defaults to 300 seconds.
+// It also bounds the lifetime of session tickets.
+func (c *Ctx) SetSessionTimeout(timeout time.Duration) time.Duration {
+	prev := C.SSL_CTX_set_timeout(c.ctx, C.long(timeout/time.Second))
+	return time.Duration(prev) * time.Second
+}
+
+// SessionTimeout returns the timeout set with SetSessionTimeout.
+func (c *Ctx) SessionTimeout() time.Duration {
+	return time.Duration(C.SSL_CTX_get_timeout(c.ctx)) * time.Second
+}
+
+// SessionCacheStats are the counters OpenSSL keeps for a context's sessions,
+// since the context was created. Resumptions through session tickets count
+// as hits too.
+type SessionCacheStats struct {
+	// Sessions is the number of sessions in the internal cache.
+	Sessions int64
+	// Connects and Accepts are the number of handshakes started as client
+	// and server, and ConnectsGood and AcceptsGood the number completed.
+	Connects     int64
+	ConnectsGood int64
+	Accepts      int64
+	AcceptsGood  int64
+	// Hits is the number of sessions resumed, and CallbackHits the number
+	// of those found by a SessionStore rather than in the internal cache.
+	Hits         int64
+	CallbackHits int64
+	// Misses is the number of sessions clients asked to resume that
+	// weren't found, and Timeouts the number found but expired, which
+	// count as misses too.
+	Misses   int64
+	Timeouts int64
+	// CacheFull is the number of sessions dropped because the cache
+	// reached its size limit.
+	CacheFull int64
+}
+
+// SessionCacheStats returns the context's session counters, e.g. to tune the
+// cache size and timeout of a busy server from its resumption rate. They
+// are read one at a time, so they may be slightly inconsistent with each
+// other.
+func (c *Ctx) SessionCacheStats() SessionCacheStats {
+	stat := func(cmd C.int) int64 {
+		return int64(C.SSL_CTX_ctrl(c.ctx, cmd, 0, nil))
+	}
+	return SessionCacheStats{
+		Sessions:     stat(C.SSL_CTRL_SESS_NUMBER),
+		Connects:     stat(C.SSL_CTRL_SESS_CONNECT),
+		ConnectsGood: stat(C.SSL_CTRL_SESS_CONNECT_GOOD),
+		Accepts:      stat(C.SSL_CTRL_SESS_ACCEPT),
+		AcceptsGood:  stat(C.SSL_CTRL_SESS_ACCEPT_GOOD),
+		Hits:         stat(C.SSL_CTRL_SESS_HIT),
+		CallbackHits: stat(C.SSL_CTRL_SESS_CB_HIT),
+		Misses:       stat(C.SSL_CTRL_SESS_MISSES),
+		Timeouts:     stat(C.SSL_CTRL_SESS_TIMEOUTS),
+		CacheFull:    stat(C.SSL_CTRL_SESS_CACHE_FULL),
+	}
+}
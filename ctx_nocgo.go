@@ -0,0 +1,512 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !cgo
+
+package openssl
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Without cgo, Ctx and Conn are backed by crypto/tls, so that code using
+// Dial, Listen and ListenAndServeTLS still builds and works, e.g. when
+// cross-compiling. Options are mapped to tls.Config where crypto/tls has an
+// equivalent and ignored otherwise, and only the core of the API is
+// provided.
+
+type Ctx struct {
+	mtx         sync.Mutex
+	config      *tls.Config
+	store       *CertificateStore
+	cert        *Certificate
+	chain       []*Certificate
+	key         PrivateKey
+	options     Options
+	modes       Modes
+	verify_mode VerifyOptions
+	verify_cb   VerifyCallback
+	// from_config is set for contexts from NewCtxFromTLSConfig, which
+	// verify peers as config does
+	from_config bool
+	// session_store is the client session cache, enabled with
+	// SetSessionCacheMode; crypto/tls files sessions by server name
+	session_store tls.ClientSessionCache
+}
+
+type SSLVersion int
+
+const (
+	SSLv3      SSLVersion = 0x02
+	TLSv1      SSLVersion = 0x03
+	TLSv1_1    SSLVersion = 0x04
+	TLSv1_2    SSLVersion = 0x05
+	AnyVersion SSLVersion = 0x06
+	TLSv1_3    SSLVersion = 0x07
+)
+
+// wire versions of the SSLVersions, as crypto/tls numbers them
+var tlsVersions = map[SSLVersion]uint16{
+	TLSv1:   tls.VersionTLS10,
+	TLSv1_1: tls.VersionTLS11,
+	TLSv1_2: tls.VersionTLS12,
+	TLSv1_3: tls.VersionTLS13,
+}
+
+// NewCtxWithVersion creates a context speaking only version, or any version
+// crypto/tls supports for AnyVersion. SSLv3 is not supported.
+func NewCtxWithVersion(version SSLVersion) (*Ctx, error) {
+	c := &Ctx{
+		config: &tls.Config{
+			// verification follows the context's verify mode instead
+			InsecureSkipVerify: true},
+		store: &CertificateStore{pool: x509.NewCertPool()}}
+	if version == AnyVersion {
+		return c, nil
+	}
+	wire, ok := tlsVersions[version]
+	if !ok {
+		return nil, errors.New("unknown ssl/tls version")
+	}
+	c.config.MinVersion = wire
+	c.config.MaxVersion = wire
+	return c, nil
+}
+
+// NewCtx creates a context that supports any TLS version crypto/tls does.
+func NewCtx() (*Ctx, error) {
+	return NewCtxWithVersion(AnyVersion)
+}
+
+// NewCtxFromFiles calls NewCtx, loads the provided files, and configures the
+// context to use them.
+func NewCtxFromFiles(cert_file string, key_file string) (*Ctx, error) {
+	ctx, err := NewCtx()
+	if err != nil {
+		return nil, err
+	}
+	cert_bytes, err := ioutil.ReadFile(cert_file)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := LoadCertificateFromPEM(cert_bytes)
+	if err != nil {
+		return nil, err
+	}
+	err = ctx.UseCertificate(cert)
+	if err != nil {
+		return nil, err
+	}
+	key_bytes, err := ioutil.ReadFile(key_file)
+	if err != nil {
+		return nil, err
+	}
+	key, err := LoadPrivateKeyFromPEM(key_bytes)
+	if err != nil {
+		return nil, err
+	}
+	err = ctx.UsePrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return ctx, nil
+}
+
+// NewCtxFromTLSConfig creates a context configured like config, to ease
+// moving code from crypto/tls. Peers are verified as config says rather than
+// by the context's verify mode, and Dial replaces ServerName with the host
+// dialed.
+func NewCtxFromTLSConfig(config *tls.Config) (*Ctx, error) {
+	if config == nil {
+		return nil, errors.New("nil tls.Config")
+	}
+	c := &Ctx{
+		config:      config.Clone(),
+		store:       &CertificateStore{pool: config.RootCAs},
+		from_config: true}
+	if c.store.pool == nil {
+		c.store.pool = x509.NewCertPool()
+	}
+	c.config.RootCAs = c.store.pool
+	return c, nil
+}
+
+// UseCertificate configures the context to present the given certificate to
+// peers.
+func (c *Ctx) UseCertificate(cert *Certificate) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.cert = cert
+	return c.updateCertificate()
+}
+
+// AddChainCertificate adds a certificate to the chain presented in the
+// handshake.
+func (c *Ctx) AddChainCertificate(cert *Certificate) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.chain = append(c.chain, cert)
+	return c.updateCertificate()
+}
+
+// UsePrivateKey configures the context to use the given private key for SSL
+// handshakes.
+func (c *Ctx) UsePrivateKey(key PrivateKey) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.key = key
+	return c.updateCertificate()
+}
+
+// updateCertificate sets the config's certificate once both it and its key
+// are known. The caller must hold c.mtx.
+func (c *Ctx) updateCertificate() error {
+	if c.cert == nil || c.key == nil {
+		return nil
+	}
+	if !keysMatch(c.cert, c.key) {
+		return errors.New("private key does not match the certificate")
+	}
+	tls_cert := tls.Certificate{
+		Certificate: [][]byte{c.cert.x509.Raw},
+		PrivateKey:  c.key.(*pKey).key,
+		Leaf:        c.cert.x509}
+	for _, cert := range c.chain {
+		tls_cert.Certificate = append(tls_cert.Certificate, cert.x509.Raw)
+	}
+	c.config.Certificates = []tls.Certificate{tls_cert}
+	return nil
+}
+
+// CertificateStore holds the certificates peers are verified against.
+type CertificateStore struct {
+	pool *x509.CertPool
+}
+
+// GetCertificateStore returns the context's certificate store that will be
+// used for peer validation.
+func (c *Ctx) GetCertificateStore() *CertificateStore {
+	return c.store
+}
+
+// AddCertificate marks the provided Certificate as a trusted certificate in
+// the given CertificateStore.
+func (s *CertificateStore) AddCertificate(cert *Certificate) error {
+	s.pool.AddCert(cert.x509)
+	return nil
+}
+
+// LoadVerifyLocations tells the context to trust all certificate authorities
+// provided in either the ca_file or the ca_path, which hold PEM
+// certificates.
+func (c *Ctx) LoadVerifyLocations(ca_file string, ca_path string) error {
+	if ca_file == "" && ca_path == "" {
+		return errors.New("no verify location given")
+	}
+	var files []string
+	if ca_file != "" {
+		files = append(files, ca_file)
+	}
+	if ca_path != "" {
+		matches, err := filepath.Glob(filepath.Join(ca_path, "*"))
+		if err != nil {
+			return err
+		}
+		files = append(files, matches...)
+	}
+	for _, file := range files {
+		pem, err := ioutil.ReadFile(file)
+		if err != nil {
+			if ca_path != "" && file != ca_file {
+				continue
+			}
+			return err
+		}
+		if !c.store.pool.AppendCertsFromPEM(pem) && file == ca_file {
+			return errors.New("no PEM certificate found in '" + file + "'")
+		}
+	}
+	return nil
+}
+
+// SetDefaultVerifyPaths trusts the certificate authorities of the operating
+// system, as crypto/x509 finds them.
+func (c *Ctx) SetDefaultVerifyPaths() error {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		return err
+	}
+	c.store.pool = pool
+	return nil
+}
+
+type Options int
+
+// the values are OpenSSL's
+const (
+	NoCompression                      Options = 0x00020000
+	NoSSLv2                            Options = 0
+	NoSSLv3                            Options = 0x02000000
+	NoTLSv1                            Options = 0x04000000
+	NoTLSv1_1                          Options = 0x10000000
+	NoTLSv1_2                          Options = 0x08000000
+	NoTLSv1_3                          Options = 0x20000000
+	CipherServerPreference             Options = 0x00400000
+	NoSessionResumptionOrRenegotiation Options = 0x00010000
+	NoTicket                           Options = 0x00004000
+)
+
+// SetOptions sets context options, returning the new set. crypto/tls never
+// compresses and picks cipher suites itself, so only the version options
+// and NoTicket have an effect.
+func (c *Ctx) SetOptions(options Options) Options {
+	c.options |= options
+	c.applyOptions()
+	return c.options
+}
+
+// ClearOptions clears context options, returning the new set.
+func (c *Ctx) ClearOptions(options Options) Options {
+	c.options &^= options
+	c.applyOptions()
+	return c.options
+}
+
+// applyOptions narrows the config's versions to those not turned off.
+func (c *Ctx) applyOptions() {
+	c.config.SessionTicketsDisabled = c.options&NoTicket != 0
+	var min, max uint16
+	for _, v := range []struct {
+		wire   uint16
+		option Options
+	}{
+		{tls.VersionTLS10, NoTLSv1},
+		{tls.VersionTLS11, NoTLSv1_1},
+		{tls.VersionTLS12, NoTLSv1_2},
+		{tls.VersionTLS13, NoTLSv1_3},
+	} {
+		if c.options&v.option != 0 {
+			continue
+		}
+		if min == 0 {
+			min = v.wire
+		}
+		max = v.wire
+	}
+	if min == 0 {
+		// everything is off; let the handshake fail
+		min, max = tls.VersionTLS13, tls.VersionTLS12
+	}
+	if c.config.MinVersion < min {
+		c.config.MinVersion = min
+	}
+	if c.config.MaxVersion == 0 || c.config.MaxVersion > max {
+		c.config.MaxVersion = max
+	}
+}
+
+type Modes int
+
+const (
+	ReleaseBuffers Modes = 0x00000010
+)
+
+// SetMode sets context modes, returning the new set. Modes have no effect
+// with crypto/tls.
+func (c *Ctx) SetMode(modes Modes) Modes {
+	c.modes |= modes
+	return c.modes
+}
+
+// GetMode returns context modes.
+func (c *Ctx) GetMode() Modes {
+	return c.modes
+}
+
+type VerifyOptions int
+
+const (
+	VerifyNone             VerifyOptions = 0x00
+	VerifyPeer             VerifyOptions = 0x01
+	VerifyFailIfNoPeerCert VerifyOptions = 0x02
+	VerifyClientOnce       VerifyOptions = 0x04
+)
+
+// CertificateStoreCtx describes the certificate a VerifyCallback is asked
+// about. crypto/x509 verifies the chain as a whole, so a failure is reported
+// for every certificate in it.
+type CertificateStoreCtx struct {
+	cert  *Certificate
+	depth int
+	err   error
+}
+
+// Err returns why verification failed, or nil.
+func (self *CertificateStoreCtx) Err() error {
+	return self.err
+}
+
+// Depth returns the position in the chain of the certificate being
+// verified, 0 being the peer's own.
+func (self *CertificateStoreCtx) Depth() int {
+	return self.depth
+}
+
+// GetCurrentCert returns the certificate being verified.
+func (self *CertificateStoreCtx) GetCurrentCert() *Certificate {
+	return self.cert
+}
+
+// VerifyCallback is called for each certificate in the peer's chain, from
+// the last the peer sent down to the peer's own. ok says whether
+// verification passed; store gives the certificate, its depth and the
+// failure. The callback returns whether to carry on, so returning true for
+// every certificate accepts a failure.
+type VerifyCallback func(ok bool, store *CertificateStoreCtx) bool
+
+// SetVerify controls peer verification. Clients with VerifyPeer check the
+// server's certificate against the certificate store; servers with it ask
+// for client certificates, and with VerifyFailIfNoPeerCert too, require
+// them. verify_cb, if not nil, decides on the peer's certificates.
+func (c *Ctx) SetVerify(options VerifyOptions, verify_cb VerifyCallback) {
+	c.verify_mode = options
+	c.verify_cb = verify_cb
+	switch {
+	case options&VerifyPeer == 0:
+		c.config.ClientAuth = tls.NoClientCert
+	case options&VerifyFailIfNoPeerCert != 0:
+		c.config.ClientAuth = tls.RequireAnyClientCert
+	default:
+		c.config.ClientAuth = tls.RequestClientCert
+	}
+}
+
+// SetVerifyMode sets the verify mode, keeping the verify callback.
+func (c *Ctx) SetVerifyMode(options VerifyOptions) {
+	c.SetVerify(options, c.verify_cb)
+}
+
+// SetVerifyCallback sets the callback deciding on peer certificates, keeping
+// the verify mode. A nil verify_cb removes it.
+func (c *Ctx) SetVerifyCallback(verify_cb VerifyCallback) {
+	c.SetVerify(c.verify_mode, verify_cb)
+}
+
+// VerifyMode returns the options set with SetVerify.
+func (c *Ctx) VerifyMode() VerifyOptions {
+	return c.verify_mode
+}
+
+// SetVerifyDepth is accepted for compatibility; crypto/x509 bounds chains
+// itself.
+func (c *Ctx) SetVerifyDepth(depth int) {
+}
+
+// SetSessionId is accepted for compatibility; crypto/tls servers keep no
+// session cache to partition.
+func (c *Ctx) SetSessionId(session_id []byte) error {
+	return nil
+}
+
+// SetCipherList restricts the TLS 1.2 and older cipher suites to those named
+// in list, in OpenSSL's format, that crypto/tls implements. Aliases such as
+// HIGH, and exclusions, are ignored, and if nothing in the list is known,
+// crypto/tls's defaults are kept. TLS 1.3 suites aren't configurable.
+func (c *Ctx) SetCipherList(list string) error {
+	var suites []uint16
+	for _, name := range strings.FieldsFunc(list, func(r rune) bool {
+		return r == ':' || r == ',' || r == ' '
+	}) {
+		if id, ok := cipherSuiteIDs[name]; ok {
+			suites = append(suites, id)
+		}
+	}
+	if len(suites) > 0 {
+		c.config.CipherSuites = suites
+	}
+	return nil
+}
+
+// the cipher suites crypto/tls implements, by their OpenSSL names
+var cipherSuiteIDs = map[string]uint16{
+	"ECDHE-ECDSA-AES128-GCM-SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"ECDHE-RSA-AES128-GCM-SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"ECDHE-ECDSA-AES256-GCM-SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"ECDHE-RSA-AES256-GCM-SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"ECDHE-ECDSA-CHACHA20-POLY1305": tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	"ECDHE-RSA-CHACHA20-POLY1305":   tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"ECDHE-ECDSA-AES128-SHA":        tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"ECDHE-RSA-AES128-SHA":          tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"ECDHE-ECDSA-AES256-SHA":        tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"ECDHE-RSA-AES256-SHA":          tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"ECDHE-ECDSA-AES128-SHA256":     tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+	"ECDHE-RSA-AES128-SHA256":       tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+	"AES128-GCM-SHA256":             tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"AES256-GCM-SHA384":             tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"AES128-SHA":                    tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"AES256-SHA":                    tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"AES128-SHA256":                 tls.TLS_RSA_WITH_AES_128_CBC_SHA256,
+	"DES-CBC3-SHA":                  tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+	"ECDHE-RSA-DES-CBC3-SHA":        tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA,
+}
+
+type SessionCacheModes int
+
+const (
+	SessionCacheOff    SessionCacheModes = 0x0000
+	SessionCacheClient SessionCacheModes = 0x0001
+	SessionCacheServer SessionCacheModes = 0x0002
+	SessionCacheBoth   SessionCacheModes = 0x0003
+	NoAutoClear        SessionCacheModes = 0x0080
+	NoInternalLookup   SessionCacheModes = 0x0100
+	NoInternalStore    SessionCacheModes = 0x0200
+	NoInternal         SessionCacheModes = 0x0300
+)
+
+// SetSessionCacheMode enables a client session cache for SessionCacheClient,
+// returning the previous modes. Servers resume sessions with tickets unless
+// NoTicket is set.
+func (c *Ctx) SetSessionCacheMode(modes SessionCacheModes) SessionCacheModes {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	var prev SessionCacheModes = SessionCacheServer
+	if c.session_store != nil {
+		prev |= SessionCacheClient
+	}
+	if modes&SessionCacheClient == 0 {
+		c.session_store = nil
+	} else if c.session_store == nil {
+		c.session_store = tls.NewLRUClientSessionCache(0)
+	}
+	c.config.ClientSessionCache = c.session_store
+	return prev
+}
+
+// SetAlpnProtos sets the protocols offered with ALPN, in order of
+// preference.
+func (c *Ctx) SetAlpnProtos(protos []string) error {
+	for _, proto := range protos {
+		if len(proto) == 0 || len(proto) > 255 {
+			return errors.New("invalid ALPN protocol name")
+		}
+	}
+	c.config.NextProtos = append([]string(nil), protos...)
+	return nil
+}
@@ -0,0 +1,203 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !cgo
+
+package openssl
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// issueNoCgoCert issues a certificate for cn signed by issuer and
+// issuer_key, or self-signed if issuer is nil, returning it with its key.
+func issueNoCgoCert(t *testing.T, cn string, is_ca bool,
+	issuer *x509.Certificate, issuer_key *ecdsa.PrivateKey) (
+	*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  is_ca,
+		BasicConstraintsValid: true,
+		KeyUsage: x509.KeyUsageDigitalSignature |
+			x509.KeyUsageCertSign}
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	if issuer == nil {
+		issuer, issuer_key = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer,
+		&key.PublicKey, issuer_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// verifyNoCgoHandshake handshakes with a server presenting a leaf issued by
+// a CA, from a client set up by setup, returning the client's handshake
+// error.
+func verifyNoCgoHandshake(t *testing.T, setup func(client_ctx *Ctx,
+	ca *Certificate)) error {
+	ca_x509, ca_key := issueNoCgoCert(t, "ca", true, nil, nil)
+	leaf_x509, leaf_key := issueNoCgoCert(t, "leaf", false, ca_x509, ca_key)
+	key_der, err := x509.MarshalPKCS8PrivateKey(leaf_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := LoadPrivateKeyFromPEM(pem.EncodeToMemory(
+		&pem.Block{Type: "PRIVATE KEY", Bytes: key_der}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server_ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server_ctx.UseCertificate(
+		&Certificate{x509: leaf_x509}); err != nil {
+		t.Fatal(err)
+	}
+	if err := server_ctx.UsePrivateKey(key); err != nil {
+		t.Fatal(err)
+	}
+	client_ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	setup(client_ctx, &Certificate{x509: ca_x509})
+
+	// net.Pipe is unbuffered, so would stall the client's alert while the
+	// server writes its flight
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client_conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client_conn.Close()
+	server_conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server_conn.Close()
+	server_conn.SetDeadline(time.Now().Add(10 * time.Second))
+	client_conn.SetDeadline(time.Now().Add(10 * time.Second))
+	server, err := Server(server_conn, server_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := Client(client_conn, client_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		server.Handshake()
+		server.Close()
+	}()
+	return client.Handshake()
+}
+
+func TestNoCgoVerifyCallback(t *testing.T) {
+	var depths []int
+	err := verifyNoCgoHandshake(t, func(client_ctx *Ctx, ca *Certificate) {
+		client_ctx.GetCertificateStore().AddCertificate(ca)
+		client_ctx.SetVerify(VerifyPeer,
+			func(ok bool, store *CertificateStoreCtx) bool {
+				if !ok || store.Err() != nil ||
+					store.GetCurrentCert() == nil {
+					t.Errorf("unexpected failure at depth %d: %v",
+						store.Depth(), store.Err())
+				}
+				depths = append(depths, store.Depth())
+				return ok
+			})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(depths) != 1 || depths[0] != 0 {
+		t.Fatalf("expected the callback for the leaf, got depths %v", depths)
+	}
+}
+
+func TestNoCgoVerifyCallbackAcceptsFailure(t *testing.T) {
+	// the CA isn't trusted, but the callback accepts the failure
+	err := verifyNoCgoHandshake(t, func(client_ctx *Ctx, ca *Certificate) {
+		client_ctx.SetVerify(VerifyPeer,
+			func(ok bool, store *CertificateStoreCtx) bool {
+				if ok || store.Err() == nil {
+					t.Error("expected verification to fail")
+				}
+				return true
+			})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNoCgoVerifyCallbackRejects(t *testing.T) {
+	err := verifyNoCgoHandshake(t, func(client_ctx *Ctx, ca *Certificate) {
+		client_ctx.GetCertificateStore().AddCertificate(ca)
+		client_ctx.SetVerifyCallback(
+			func(ok bool, store *CertificateStoreCtx) bool {
+				return false
+			})
+		client_ctx.SetVerifyMode(VerifyPeer)
+		if client_ctx.VerifyMode() != VerifyPeer {
+			t.Fatalf("unexpected verify mode %d", client_ctx.VerifyMode())
+		}
+	})
+	if err == nil {
+		t.Fatal("expected the callback to fail the handshake")
+	}
+}
+
+func TestNoCgoVerifyPeer(t *testing.T) {
+	err := verifyNoCgoHandshake(t, func(client_ctx *Ctx, ca *Certificate) {
+		client_ctx.SetVerify(VerifyPeer, nil)
+	})
+	if err == nil {
+		t.Fatal("expected verification against an untrusted CA to fail")
+	}
+	err = verifyNoCgoHandshake(t, func(client_ctx *Ctx, ca *Certificate) {
+		client_ctx.GetCertificateStore().AddCertificate(ca)
+		client_ctx.SetVerify(VerifyPeer, nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <stdlib.h>
+#include <openssl/ssl.h>
+
+static int OUR_SSL_CTX_dane_enable(SSL_CTX *ctx) {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+    return SSL_CTX_dane_enable(ctx);
+#else
+    return -2;
+#endif
+}
+
+// as RFC 7672 has SMTP do, a certificate matching a DANE-EE record need not
+// carry base_domain too
+static int OUR_SSL_dane_enable(SSL *ssl, const char *base_domain) {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+    int rv = SSL_dane_enable(ssl, base_domain);
+    if (rv > 0)
+        SSL_dane_set_flags(ssl, DANE_FLAG_NO_DANE_EE_NAMECHECKS);
+    return rv;
+#else
+    return -2;
+#endif
+}
+
+static int OUR_SSL_dane_tlsa_add(SSL *ssl, unsigned char usage,
+        unsigned char selector, unsigned char mtype, unsigned char *data,
+        size_t dlen) {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+    return SSL_dane_tlsa_add(ssl, usage, selector, mtype, data, dlen);
+#else
+    return -2;
+#endif
+}
+
+// returns the depth of the certificate the matched record applies to, or -1
+static int OUR_SSL_get0_dane_tlsa(SSL *ssl, unsigned char *usage,
+        unsigned char *selector, unsigned char *mtype,
+        const unsigned char **data, size_t *dlen) {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+    return SSL_get0_dane_tlsa(ssl, usage, selector, mtype, data, dlen);
+#else
+    return -1;
+#endif
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"unsafe"
+)
+
+// TLSA record fields, see RFC 6698 and RFC 7218.
+const (
+	// PKIXTA records match a trust anchor in the chain, which must also
+	// pass the usual verification against the context's trust store.
+	PKIXTA uint8 = 0
+	// PKIXEE records match the peer's certificate, which must also pass the
+	// usual verification.
+	PKIXEE uint8 = 1
+	// DANETA records match a trust anchor for the peer's chain, whether or
+	// not the context trusts it.
+	DANETA uint8 = 2
+	// DANEEE records match the peer's certificate alone. Its names and
+	// validity period aren't checked.
+	DANEEE uint8 = 3
+
+	// SelectorCert records match the whole certificate.
+	SelectorCert uint8 = 0
+	// SelectorSPKI records match the certificate's public key.
+	SelectorSPKI uint8 = 1
+
+	MatchFull   uint8 = 0
+	MatchSHA256 uint8 = 1
+	MatchSHA512 uint8 = 2
+)
+
+// TLSARecord is a DNS TLSA record giving a certificate or public key a
+// server must present, or must chain up to.
+type TLSARecord struct {
+	Usage        uint8
+	Selector     uint8
+	MatchingType uint8
+	// Data is the certificate association data, the DER of what the
+	// selector picks or its digest.
+	Data []byte
+}
+
+var daneUnsupported = errors.New("DANE requires OpenSSL 1.1.0 or newer")
+
+// EnableDANE lets connections using the context verify peers against TLSA
+// records with Conn.EnableDANE.
+func (c *Ctx) EnableDANE() error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	switch rv := C.OUR_SSL_CTX_dane_enable(c.ctx); {
+	case rv == -2:
+		return daneUnsupported
+	case rv <= 0:
+		return errorFromErrorQueue()
+	}
+	return nil
+}
+
+// EnableDANE makes the handshake verify the peer against records, TLSA
+// records the caller looked up with DNSSEC, such as those of
+// _25._tcp.mx.example.com for an SMTP client, instead of or as well as
+// against the context's trust store, depending on their usage (RFC 7671).
+// base_domain is the name the records were looked up for; it is checked
+// against the names in the certificate, unless the certificate matched a
+// DANEEE record (RFC 7672), and sent with SNI unless SetTlsExtHostName sets
+// another name. Records this
+// OpenSSL can't use, such as ones with an unknown matching type, are
+// skipped; if none are usable the peer is verified against the trust store
+// alone. The context must have DANE enabled with Ctx.EnableDANE, and its
+// verify mode must include VerifyPeer for a mismatch to fail the
+// handshake. Call it before the handshake.
+func (c *Conn) EnableDANE(base_domain string, records []TLSARecord) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	cdomain := C.CString(base_domain)
+	defer C.free(unsafe.Pointer(cdomain))
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	switch rv := C.OUR_SSL_dane_enable(c.ssl, cdomain); {
+	case rv == -2:
+		return daneUnsupported
+	case rv <= 0:
+		return errorFromErrorQueue()
+	}
+	for _, record := range records {
+		var data *C.uchar
+		if len(record.Data) > 0 {
+			data = (*C.uchar)(unsafe.Pointer(&record.Data[0]))
+		}
+		if C.OUR_SSL_dane_tlsa_add(c.ssl, C.uchar(record.Usage),
+			C.uchar(record.Selector), C.uchar(record.MatchingType), data,
+			C.size_t(len(record.Data))) < 0 {
+			return fmt.Errorf("bad TLSA record %d %d %d: %v", record.Usage,
+				record.Selector, record.MatchingType, errorFromErrorQueue())
+		}
+	}
+	return nil
+}
+
+// DANEMatch returns the TLSA record the peer's chain matched during the
+// handshake, and the depth in the chain of the certificate it matched, 0
+// being the peer's own. ok is false if no record matched.
+func (c *Conn) DANEMatch() (record TLSARecord, depth int, ok bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	var usage, selector, mtype C.uchar
+	var data *C.uchar
+	var dlen C.size_t
+	rv := C.OUR_SSL_get0_dane_tlsa(c.ssl, &usage, &selector, &mtype, &data,
+		&dlen)
+	if rv < 0 {
+		return TLSARecord{}, 0, false
+	}
+	return TLSARecord{
+		Usage:        uint8(usage),
+		Selector:     uint8(selector),
+		MatchingType: uint8(mtype),
+		Data:         C.GoBytes(unsafe.Pointer(data), C.int(dlen)),
+	}, int(rv), true
+}
@@ -0,0 +1,94 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+)
+
+func TestDANE(t *testing.T) {
+	key := generateTestRSAKey(t)
+	cert := issueTestCert(t, key, testCert{})
+	server_ctx := newSharedCtx(t, key, cert, cert)
+	std, err := ToStdlibCertificate(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spki_hash := sha256.Sum256(std.RawSubjectPublicKeyInfo)
+
+	// the client doesn't otherwise trust the server's certificate
+	client_ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client_ctx.EnableDANE(); err == daneUnsupported {
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	client_ctx.SetVerifyMode(VerifyPeer)
+
+	handshake := func(records ...TLSARecord) (*Conn, error) {
+		server_conn, client_conn := NetPipe(t)
+		server, err := Server(server_conn, server_ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			server.Handshake()
+			server.Close()
+		}()
+		client, err := Client(client_conn, client_ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = client.EnableDANE("mx.example.com", records)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client, client.Handshake()
+	}
+
+	record := TLSARecord{
+		Usage:        DANEEE,
+		Selector:     SelectorSPKI,
+		MatchingType: MatchSHA256,
+		Data:         spki_hash[:]}
+	client, err := handshake(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	matched, depth, ok := client.DANEMatch()
+	if !ok || depth != 0 || matched.Usage != DANEEE ||
+		!bytes.Equal(matched.Data, spki_hash[:]) {
+		t.Fatalf("unexpected match %+v at depth %d", matched, depth)
+	}
+	client.Close()
+
+	other := record
+	other.Data = make([]byte, len(spki_hash))
+	client, err = handshake(other)
+	if err == nil {
+		t.Fatal("expected a certificate not matching the record to fail")
+	}
+	if _, _, ok := client.DANEMatch(); ok {
+		t.Fatal("expected no record to match")
+	}
+	client.Close()
+}
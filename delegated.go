@@ -0,0 +1,317 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// SignatureScheme is a TLS 1.3 signature algorithm identifier (RFC 8446,
+// section 4.2.3).
+type SignatureScheme uint16
+
+const (
+	ECDSAWithP256AndSHA256 SignatureScheme = 0x0403
+	ECDSAWithP384AndSHA384 SignatureScheme = 0x0503
+	ECDSAWithP521AndSHA512 SignatureScheme = 0x0603
+	PSSWithSHA256          SignatureScheme = 0x0804
+	PSSWithSHA384          SignatureScheme = 0x0805
+	PSSWithSHA512          SignatureScheme = 0x0806
+	Ed25519Scheme          SignatureScheme = 0x0807
+)
+
+type signatureSchemeInfo struct {
+	hash      crypto.Hash
+	pss       bool
+	algorithm x509.SignatureAlgorithm
+}
+
+var signatureSchemes = map[SignatureScheme]signatureSchemeInfo{
+	ECDSAWithP256AndSHA256: {crypto.SHA256, false, x509.ECDSAWithSHA256},
+	ECDSAWithP384AndSHA384: {crypto.SHA384, false, x509.ECDSAWithSHA384},
+	ECDSAWithP521AndSHA512: {crypto.SHA512, false, x509.ECDSAWithSHA512},
+	PSSWithSHA256:          {crypto.SHA256, true, x509.SHA256WithRSAPSS},
+	PSSWithSHA384:          {crypto.SHA384, true, x509.SHA384WithRSAPSS},
+	PSSWithSHA512:          {crypto.SHA512, true, x509.SHA512WithRSAPSS},
+	Ed25519Scheme:          {0, false, x509.PureEd25519},
+}
+
+const (
+	delegationUsageOid = "1.3.6.1.4.1.44363.44"
+	dcContext          = "TLS, server delegated credentials"
+
+	// MaxDelegatedCredentialValidity is the longest a delegated credential
+	// may remain valid, counted from when it is checked.
+	MaxDelegatedCredentialValidity = 7 * 24 * time.Hour
+)
+
+// AddDelegationUsageExtension marks the certificate as allowed to issue
+// delegated credentials (RFC 9345). The certificate also needs the
+// digitalSignature key usage if it carries a key usage extension.
+func (c *Certificate) AddDelegationUsageExtension() error {
+	null, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagNull})
+	if err != nil {
+		return err
+	}
+	return c.AddExtensionDER(delegationUsageOid, false, null)
+}
+
+// HasDelegationUsage reports whether the certificate carries the
+// DelegationUsage extension.
+func (c *Certificate) HasDelegationUsage() (bool, error) {
+	der, err := c.ExtensionDER(delegationUsageOid)
+	return der != nil, err
+}
+
+// DelegatedCredential is a short-lived key an edge server can present in
+// place of its certificate's key, signed by that key (RFC 9345).
+type DelegatedCredential struct {
+	// ValidTime is counted from the NotBefore time of the delegating
+	// certificate.
+	ValidTime time.Duration
+	// CertVerifyAlgorithm is the scheme the holder of the delegated key will
+	// sign handshakes with.
+	CertVerifyAlgorithm SignatureScheme
+	// PublicKey is the DER-encoded PKIX delegated public key.
+	PublicKey []byte
+	// Algorithm is the scheme the certificate's key signed the credential
+	// with.
+	Algorithm SignatureScheme
+	Signature []byte
+}
+
+// NewDelegatedCredential issues a credential for the delegated key dc_key,
+// valid for valid_for from now and to be used with dc_algorithm. It is signed
+// by cert_key, the private key of cert, using algorithm. The credential may
+// not outlive cert.
+func NewDelegatedCredential(cert *Certificate, cert_key PrivateKey,
+	algorithm SignatureScheme, dc_key PublicKey, dc_algorithm SignatureScheme,
+	valid_for time.Duration) (*DelegatedCredential, error) {
+	if valid_for <= 0 || valid_for > MaxDelegatedCredentialValidity {
+		return nil, fmt.Errorf("delegated credential validity %s out of range",
+			valid_for)
+	}
+	if _, ok := signatureSchemes[dc_algorithm]; !ok {
+		return nil, fmt.Errorf("unsupported signature scheme %#04x",
+			uint16(dc_algorithm))
+	}
+	info, ok := signatureSchemes[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported signature scheme %#04x",
+			uint16(algorithm))
+	}
+	if ok, err := cert.HasDelegationUsage(); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, errors.New("certificate lacks the delegation usage " +
+			"extension")
+	}
+	not_before, err := cert.NotBefore()
+	if err != nil {
+		return nil, err
+	}
+	not_after, err := cert.NotAfter()
+	if err != nil {
+		return nil, err
+	}
+	expires := time.Now().Add(valid_for)
+	if expires.After(not_after) {
+		return nil, errors.New("delegated credential would outlive the " +
+			"certificate")
+	}
+	spki, err := dc_key.MarshalPKIXPublicKeyDER()
+	if err != nil {
+		return nil, err
+	}
+	dc := &DelegatedCredential{
+		ValidTime:           expires.Sub(not_before),
+		CertVerifyAlgorithm: dc_algorithm,
+		PublicKey:           spki,
+		Algorithm:           algorithm,
+	}
+	msg, err := dc.signedMessage(cert)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := NewSigner(cert_key)
+	if err != nil {
+		return nil, err
+	}
+	var opts crypto.SignerOpts = info.hash
+	if info.pss {
+		opts = &rsa.PSSOptions{
+			SaltLength: rsa.PSSSaltLengthEqualsHash,
+			Hash:       info.hash}
+	}
+	digest := msg
+	if info.hash != 0 {
+		h := info.hash.New()
+		h.Write(msg)
+		digest = h.Sum(nil)
+	}
+	dc.Signature, err = signer.Sign(rand.Reader, digest, opts)
+	if err != nil {
+		return nil, err
+	}
+	return dc, nil
+}
+
+func (dc *DelegatedCredential) marshalCredential() ([]byte, error) {
+	if dc.ValidTime < 0 || dc.ValidTime/time.Second > 0xffffffff {
+		return nil, errors.New("delegated credential valid time out of range")
+	}
+	if len(dc.PublicKey) == 0 || len(dc.PublicKey) > 0xffffff {
+		return nil, errors.New("invalid delegated public key length")
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(dc.ValidTime/time.Second))
+	binary.Write(&buf, binary.BigEndian, uint16(dc.CertVerifyAlgorithm))
+	n := len(dc.PublicKey)
+	buf.Write([]byte{byte(n >> 16), byte(n >> 8), byte(n)})
+	buf.Write(dc.PublicKey)
+	return buf.Bytes(), nil
+}
+
+// signedMessage builds the input of the credential's signature, which binds
+// it to the delegating certificate.
+func (dc *DelegatedCredential) signedMessage(cert *Certificate) ([]byte,
+	error) {
+	der, err := cert.MarshalDER()
+	if err != nil {
+		return nil, err
+	}
+	cred, err := dc.marshalCredential()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.Write(bytes.Repeat([]byte{0x20}, 64))
+	buf.WriteString(dcContext)
+	buf.WriteByte(0)
+	buf.Write(der)
+	buf.Write(cred)
+	binary.Write(&buf, binary.BigEndian, uint16(dc.Algorithm))
+	return buf.Bytes(), nil
+}
+
+// Marshal returns the wire encoding of the credential, as carried in the
+// delegated_credential TLS extension.
+func (dc *DelegatedCredential) Marshal() ([]byte, error) {
+	cred, err := dc.marshalCredential()
+	if err != nil {
+		return nil, err
+	}
+	if len(dc.Signature) == 0 || len(dc.Signature) > 0xffff {
+		return nil, errors.New("invalid delegated credential signature length")
+	}
+	buf := bytes.NewBuffer(cred)
+	binary.Write(buf, binary.BigEndian, uint16(dc.Algorithm))
+	binary.Write(buf, binary.BigEndian, uint16(len(dc.Signature)))
+	buf.Write(dc.Signature)
+	return buf.Bytes(), nil
+}
+
+// ParseDelegatedCredential decodes a credential produced by Marshal.
+func ParseDelegatedCredential(data []byte) (*DelegatedCredential, error) {
+	bad := errors.New("malformed delegated credential")
+	if len(data) < 9 {
+		return nil, bad
+	}
+	dc := &DelegatedCredential{
+		ValidTime: time.Duration(
+			binary.BigEndian.Uint32(data)) * time.Second,
+		CertVerifyAlgorithm: SignatureScheme(binary.BigEndian.Uint16(data[4:])),
+	}
+	n := int(data[6])<<16 | int(data[7])<<8 | int(data[8])
+	data = data[9:]
+	if n == 0 || len(data) < n+4 {
+		return nil, bad
+	}
+	dc.PublicKey = data[:n]
+	data = data[n:]
+	dc.Algorithm = SignatureScheme(binary.BigEndian.Uint16(data))
+	n = int(binary.BigEndian.Uint16(data[2:]))
+	data = data[4:]
+	if n == 0 || len(data) != n {
+		return nil, bad
+	}
+	dc.Signature = data
+	return dc, nil
+}
+
+// Expires returns when the credential stops being valid, given the
+// certificate that delegated it.
+func (dc *DelegatedCredential) Expires(cert *Certificate) (time.Time, error) {
+	not_before, err := cert.NotBefore()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return not_before.Add(dc.ValidTime), nil
+}
+
+// Verify checks, as a client would, that the credential was issued by cert,
+// which must carry the delegation usage extension, and that it is valid at
+// now.
+func (dc *DelegatedCredential) Verify(cert *Certificate, now time.Time) error {
+	if ok, err := cert.HasDelegationUsage(); err != nil {
+		return err
+	} else if !ok {
+		return errors.New("certificate lacks the delegation usage extension")
+	}
+	expires, err := dc.Expires(cert)
+	if err != nil {
+		return err
+	}
+	if !now.Before(expires) {
+		return errors.New("delegated credential has expired")
+	}
+	if expires.Sub(now) > MaxDelegatedCredentialValidity {
+		return errors.New("delegated credential is valid for too long")
+	}
+	if _, ok := signatureSchemes[dc.CertVerifyAlgorithm]; !ok {
+		return fmt.Errorf("unsupported signature scheme %#04x",
+			uint16(dc.CertVerifyAlgorithm))
+	}
+	info, ok := signatureSchemes[dc.Algorithm]
+	if !ok {
+		return fmt.Errorf("unsupported signature scheme %#04x",
+			uint16(dc.Algorithm))
+	}
+	msg, err := dc.signedMessage(cert)
+	if err != nil {
+		return err
+	}
+	der, err := cert.MarshalDER()
+	if err != nil {
+		return err
+	}
+	std, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	return std.CheckSignature(info.algorithm, msg, dc.Signature)
+}
@@ -0,0 +1,85 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <openssl/evp.h>
+
+// derives the shared secret of key and peer into secret, or just sets
+// secret_len to its length if secret is NULL
+static int OUR_EVP_PKEY_derive(EVP_PKEY *key, EVP_PKEY *peer,
+    unsigned char *secret, size_t *secret_len) {
+    int ret = 0;
+    EVP_PKEY_CTX *ctx = EVP_PKEY_CTX_new(key, NULL);
+    if (ctx == NULL)
+        return 0;
+    if (EVP_PKEY_derive_init(ctx) <= 0)
+        goto end;
+    if (EVP_PKEY_derive_set_peer(ctx, peer) <= 0)
+        goto end;
+    ret = EVP_PKEY_derive(ctx, secret, secret_len) > 0;
+end:
+    EVP_PKEY_CTX_free(ctx);
+    return ret;
+}
+*/
+import "C"
+
+import (
+	"runtime"
+)
+
+// Derive computes the shared secret of priv and the peer's public key peer,
+// both EC keys on the same curve (ECDH), or both X25519 or X448 keys. The
+// secret is the raw x-coordinate or u-coordinate, not uniformly random, so
+// run it through a KDF such as HKDF before using it as a key.
+func Derive(priv PrivateKey, peer PublicKey) ([]byte, error) {
+	pkey := priv.acquirePKey()
+	if pkey == nil {
+		return nil, keyFreed
+	}
+	defer C.EVP_PKEY_free(pkey)
+	peer_pkey := peer.acquirePKey()
+	if peer_pkey == nil {
+		return nil, keyFreed
+	}
+	defer C.EVP_PKEY_free(peer_pkey)
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	var secret_len C.size_t
+	if C.OUR_EVP_PKEY_derive(pkey, peer_pkey, nil, &secret_len) != 1 {
+		return nil, errorFromErrorQueue()
+	}
+	secret := make([]byte, secret_len)
+	if C.OUR_EVP_PKEY_derive(pkey, peer_pkey, (*C.uchar)(&secret[0]),
+		&secret_len) != 1 {
+		return nil, errorFromErrorQueue()
+	}
+	return secret[:secret_len], nil
+}
+
+// GenerateX25519Key generates a new X25519 key, e.g. an ephemeral key for a
+// single Derive. It requires OpenSSL 1.1.0.
+func GenerateX25519Key() (PrivateKey, error) {
+	return generateKey(KeyTypeX25519)
+}
+
+// GenerateX448Key generates a new X448 key. It requires OpenSSL 1.1.1.
+func GenerateX448Key() (PrivateKey, error) {
+	return generateKey(KeyTypeX448)
+}
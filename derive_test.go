@@ -0,0 +1,115 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestDeriveX25519(t *testing.T) {
+	// RFC 7748, section 6.1
+	raw := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	alice, err := newRawKey(KeyTypeX25519, true, raw(
+		"77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a"))
+	if err != nil {
+		t.Skip(err)
+	}
+	bob_pub, err := newRawKey(KeyTypeX25519, false, raw(
+		"de9edb7d7b7dc1b4d35b61c2ece435373f8343c85b78674dadfc7e146f882b4f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := Derive(alice, bob_pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := raw(
+		"4a5d9d5ba4ce2de1728e3bf480350f25e07e21c947d19e3376f09b3c1e161742")
+	if !bytes.Equal(secret, expected) {
+		t.Fatalf("exp:%x got:%x", expected, secret)
+	}
+}
+
+func TestDerive(t *testing.T) {
+	generators := []struct {
+		name     string
+		generate func() (PrivateKey, error)
+		size     int
+	}{
+		{"X25519", GenerateX25519Key, 32},
+		{"X448", GenerateX448Key, 56},
+		{"P-256", func() (PrivateKey, error) {
+			return GenerateECKey(Prime256v1)
+		}, 32},
+		{"P-521", func() (PrivateKey, error) {
+			return GenerateECKey(Secp521r1)
+		}, 66},
+	}
+	for _, g := range generators {
+		alice, err := g.generate()
+		if err != nil {
+			t.Logf("skipping %s: %v", g.name, err)
+			continue
+		}
+		bob, err := g.generate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// only the public half of the peer's key is needed
+		der, err := bob.MarshalPKIXPublicKeyDER()
+		if err != nil {
+			t.Fatal(err)
+		}
+		bob_pub, err := LoadPublicKeyFromDER(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		alice_secret, err := Derive(alice, bob_pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bob_secret, err := Derive(bob, alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(alice_secret) != g.size ||
+			!bytes.Equal(alice_secret, bob_secret) {
+			t.Fatalf("%s: expected matching %d byte secrets, got %x and %x",
+				g.name, g.size, alice_secret, bob_secret)
+		}
+	}
+
+	x25519, err := GenerateX25519Key()
+	if err != nil {
+		t.Skip(err)
+	}
+	p256, err := GenerateECKey(Prime256v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Derive(x25519, p256); err == nil {
+		t.Fatal("expected deriving across key types to fail")
+	}
+}
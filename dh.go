@@ -0,0 +1,245 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <openssl/ssl.h>
+#include <openssl/dh.h>
+#include <openssl/pem.h>
+
+// return -1 before OpenSSL 1.1.0, which cannot pick parameters itself
+static int OUR_SSL_CTX_set_dh_auto(SSL_CTX *ctx, int onoff) {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+    return SSL_CTX_set_dh_auto(ctx, onoff);
+#else
+    return -1;
+#endif
+}
+
+// return -1 where the automatic curve selection cannot be switched as asked:
+// before OpenSSL 1.0.2 it does not exist, and from 1.1.0 on it is always on
+static int OUR_SSL_CTX_set_ecdh_auto(SSL_CTX *ctx, int onoff) {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+    return onoff ? 1 : -1;
+#elif OPENSSL_VERSION_NUMBER >= 0x10002000L
+    return SSL_CTX_set_ecdh_auto(ctx, onoff);
+#else
+    return -1;
+#endif
+}
+
+static long SSL_CTX_set_tmp_dh_not_a_macro(SSL_CTX* ctx, DH *dh) {
+    return SSL_CTX_set_tmp_dh(ctx, dh);
+}
+
+// d2i_DHparams_bio and i2d_DHparams_bio are macros
+static DH *OUR_d2i_DHparams(const unsigned char *der, long len) {
+    return d2i_DHparams(NULL, &der, len);
+}
+
+static int OUR_i2d_DHparams_bio(BIO *bio, DH *dh) {
+    unsigned char *der = NULL;
+    int n = i2d_DHparams(dh, &der);
+    int rv;
+    if (n <= 0)
+        return 0;
+    rv = BIO_write(bio, der, n) == n;
+    OPENSSL_free(der);
+    return rv;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"io/ioutil"
+	"runtime"
+	"unsafe"
+)
+
+// DHParameters are Diffie-Hellman parameters, as used by the DHE cipher
+// suites.
+type DHParameters struct {
+	dh *C.DH
+}
+
+func newDHParameters(dh *C.DH) *DHParameters {
+	p := &DHParameters{dh: dh}
+	runtime.SetFinalizer(p, func(p *DHParameters) {
+		C.DH_free(p.dh)
+	})
+	return p
+}
+
+// LoadDHParametersFromPEM loads Diffie-Hellman parameters from a PEM-encoded
+// "DH PARAMETERS" block, such as the output of GenerateDHParametersPEM or
+// openssl dhparam.
+func LoadDHParametersFromPEM(pem_block []byte) (*DHParameters, error) {
+	if len(pem_block) == 0 {
+		return nil, errors.New("empty pem block")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	bio := C.BIO_new_mem_buf(unsafe.Pointer(&pem_block[0]),
+		C.int(len(pem_block)))
+	if bio == nil {
+		return nil, errors.New("failed creating bio")
+	}
+	defer C.BIO_free(bio)
+	dh := C.PEM_read_bio_DHparams(bio, nil, nil, nil)
+	if dh == nil {
+		return nil, errors.New("failed reading dh parameters")
+	}
+	return newDHParameters(dh), nil
+}
+
+// LoadDHParametersFromDER loads DER-encoded PKCS#3 Diffie-Hellman
+// parameters.
+func LoadDHParametersFromDER(der_block []byte) (*DHParameters, error) {
+	if len(der_block) == 0 {
+		return nil, errors.New("empty der block")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	dh := C.OUR_d2i_DHparams((*C.uchar)(unsafe.Pointer(&der_block[0])),
+		C.long(len(der_block)))
+	if dh == nil {
+		return nil, errorFromErrorQueue()
+	}
+	return newDHParameters(dh), nil
+}
+
+// MarshalPEM converts the parameters to a PEM-encoded "DH PARAMETERS"
+// block.
+func (p *DHParameters) MarshalPEM() (pem_block []byte, err error) {
+	defer runtime.KeepAlive(p)
+	bio := C.BIO_new(C.BIO_s_mem())
+	if bio == nil {
+		return nil, errors.New("failed to allocate memory BIO")
+	}
+	defer C.BIO_free(bio)
+	if int(C.PEM_write_bio_DHparams(bio, p.dh)) != 1 {
+		return nil, errors.New("failed dumping dh parameters")
+	}
+	return ioutil.ReadAll(asAnyBio(bio))
+}
+
+// MarshalDER converts the parameters to DER-encoded PKCS#3 format.
+func (p *DHParameters) MarshalDER() (der_block []byte, err error) {
+	defer runtime.KeepAlive(p)
+	bio := C.BIO_new(C.BIO_s_mem())
+	if bio == nil {
+		return nil, errors.New("failed to allocate memory BIO")
+	}
+	defer C.BIO_free(bio)
+	if C.OUR_i2d_DHparams_bio(bio, p.dh) != 1 {
+		return nil, errors.New("failed dumping dh parameters der")
+	}
+	return ioutil.ReadAll(asAnyBio(bio))
+}
+
+// SetDHParameters sets the Diffie-Hellman parameters for the DHE cipher
+// suites. Without parameters, or automatic ones from SetDHAuto, servers
+// never negotiate DHE suites. Setting parameters turns SetDHAuto off, and
+// parameters too small for the security level are refused.
+func (c *Ctx) SetDHParameters(params *DHParameters) error {
+	defer runtime.KeepAlive(params)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if int(C.SSL_CTX_set_tmp_dh_not_a_macro(c.ctx, params.dh)) != 1 {
+		return errorFromErrorQueue()
+	}
+	C.OUR_SSL_CTX_set_dh_auto(c.ctx, 0)
+	return nil
+}
+
+// SetDHParametersFromPEM is SetDHParameters with parameters loaded by
+// LoadDHParametersFromPEM.
+func (c *Ctx) SetDHParametersFromPEM(pem_block []byte) error {
+	params, err := LoadDHParametersFromPEM(pem_block)
+	if err != nil {
+		return err
+	}
+	return c.SetDHParameters(params)
+}
+
+// SetDHAuto makes servers pick built-in Diffie-Hellman parameters matching
+// the strength of their certificate's key, taking precedence over any set
+// with SetDHParameters. It requires OpenSSL 1.1.0 or newer.
+func (c *Ctx) SetDHAuto(on bool) error {
+	onoff := C.int(0)
+	if on {
+		onoff = 1
+	}
+	if C.OUR_SSL_CTX_set_dh_auto(c.ctx, onoff) < 0 && on {
+		return errors.New("automatic dh parameters require OpenSSL 1.1.0 " +
+			"or newer")
+	}
+	return nil
+}
+
+// SetECDHAuto makes servers pick the ECDHE curve from those both sides
+// support rather than only the one set with SetEllipticCurve. It requires
+// OpenSSL 1.0.2, and from OpenSSL 1.1.0 on it is always on and cannot be
+// turned off; SetCurvesList limits the curves instead.
+func (c *Ctx) SetECDHAuto(on bool) error {
+	onoff := C.int(0)
+	if on {
+		onoff = 1
+	}
+	switch C.OUR_SSL_CTX_set_ecdh_auto(c.ctx, onoff) {
+	case 1:
+		return nil
+	case -1:
+		if on {
+			return errors.New("automatic ecdh curves require OpenSSL " +
+				"1.0.2 or newer")
+		}
+		return errors.New("automatic ecdh curves are always on from " +
+			"OpenSSL 1.1.0")
+	default:
+		return errors.New("failed setting automatic ecdh curves")
+	}
+}
+
+// GenerateDHParametersPEM generates bits long Diffie-Hellman parameters with
+// generator 2 and returns them PEM-encoded for LoadDHParametersFromPEM. This
+// takes from seconds to minutes for 2048 bits and more, so generate them
+// ahead of time rather than at startup.
+func GenerateDHParametersPEM(bits int) (pem_block []byte, err error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	dh := C.DH_new()
+	if dh == nil {
+		return nil, errors.New("failed allocating dh parameters")
+	}
+	defer C.DH_free(dh)
+	if int(C.DH_generate_parameters_ex(dh, C.int(bits), C.DH_GENERATOR_2,
+		nil)) != 1 {
+		return nil, errorFromErrorQueue()
+	}
+
+	bio := C.BIO_new(C.BIO_s_mem())
+	if bio == nil {
+		return nil, errors.New("failed to allocate memory BIO")
+	}
+	defer C.BIO_free(bio)
+	if int(C.PEM_write_bio_DHparams(bio, dh)) != 1 {
+		return nil, errors.New("failed dumping dh parameters")
+	}
+	return ioutil.ReadAll(asAnyBio(bio))
+}
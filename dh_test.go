@@ -0,0 +1,140 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"bytes"
+	"testing"
+)
+
+// ffdhe2048 is the RFC 7919 group of the same name.
+var ffdhe2048 = []byte(`-----BEGIN DH PARAMETERS-----
+MIIBCAKCAQEA//////////+t+FRYortKmq/cViAnPTzx2LnFg84tNpWp4TZBFGQz
++8yTnc4kmz75fS/jY2MMddj2gbICrsRhetPfHtXV/WVhJDP1H18GbtCFY2VVPe0a
+87VXE15/V8k1mE8McODmi3fipona8+/och3xWKE2rec1MKzKT0g6eXq8CrGCsyT7
+YdEIqUuyyOP7uWrat2DX9GgdT0Kj3jlN9K5W7edjcrsZCwenyO4KbXCeAvzhzffi
+7MA0BM0oNC9hkXL+nOmFg/+OTxIy7vKBg8P+OxtMb61zO7X8vC7CIAXFjvGDfRaD
+ssbzSibBsu/6iGtCOGEoXJf//////////wIBAg==
+-----END DH PARAMETERS-----
+`)
+
+func TestDHParameters(t *testing.T) {
+	ctx := newTestServerCtx(t)
+	if err := ctx.SetDHParametersFromPEM(ffdhe2048); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.SetDHParametersFromPEM(certBytes); err == nil {
+		t.Fatal("expected an error for a certificate")
+	}
+	if err := ctx.SetCipherList("DHE-RSA-AES128-GCM-SHA256"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.SetMaxProtoVersion(TLSv1_2); err != nil {
+		t.Fatal(err)
+	}
+
+	server_conn, client_conn := NetPipe(t)
+	defer server_conn.Close()
+	defer client_conn.Close()
+	server, err := Server(server_conn, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client_ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := Client(client_conn, client_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	errs := make(chan error, 1)
+	go func() { errs <- server.Handshake() }()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	cipher, err := client.CurrentCipher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cipher != "DHE-RSA-AES128-GCM-SHA256" {
+		t.Fatalf("unexpected cipher %q", cipher)
+	}
+}
+
+func TestGenerateDHParametersPEM(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping parameter generation in short mode")
+	}
+	pem_block, err := GenerateDHParametersPEM(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(pem_block, []byte("-----BEGIN DH PARAMETERS-----")) {
+		t.Fatalf("unexpected pem block %q", pem_block)
+	}
+	ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 1024 bit parameters are refused above security level 1
+	ctx.SetSecurityLevel(1)
+	if err := ctx.SetDHParametersFromPEM(pem_block); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDHParametersMarshal(t *testing.T) {
+	params, err := LoadDHParametersFromPEM(ffdhe2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pem_block, err := params.MarshalPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pem_block, ffdhe2048) {
+		t.Fatalf("unexpected pem %s", pem_block)
+	}
+	der, err := params.MarshalDER()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadDHParametersFromDER(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der2, err := loaded.MarshalDER()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(der, der2) {
+		t.Fatal("parameters changed in the round trip")
+	}
+	if _, err := LoadDHParametersFromDER(der[:len(der)-1]); err == nil {
+		t.Fatal("expected truncated parameters to fail")
+	}
+	ctx := newTestServerCtx(t)
+	if err := ctx.SetDHParameters(loaded); err != nil {
+		t.Fatal(err)
+	}
+}
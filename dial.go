@@ -0,0 +1,258 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openssl
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// ConnectionAttemptDelay is how long DialContext waits on a TCP connection
+// attempt before starting one to the next resolved address, per RFC 8305.
+// A failed attempt starts the next one immediately.
+var ConnectionAttemptDelay = 250 * time.Millisecond
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn,
+	error)
+
+// dialHappyEyeballs connects to addr, racing the resolved addresses with
+// staggered starts as described by RFC 8305. Only the TCP connection is
+// raced; the caller handshakes on whichever connection wins.
+func dialHappyEyeballs(ctx context.Context, network, addr string,
+	flags DialFlags) (net.Conn, error) {
+	dialer := net.Dialer{
+		// leave the racing to us
+		FallbackDelay: -1,
+		Control:       dialControl(flags)}
+	targets, err := resolveTargets(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if len(targets) == 1 {
+		return dialer.DialContext(ctx, network, targets[0])
+	}
+	return dialParallel(ctx, network, targets, ConnectionAttemptDelay,
+		dialer.DialContext)
+}
+
+// dialFastOpen connects to addr with TCP Fast Open. A fast open connect
+// returns before anything is sent, so racing the resolved addresses would
+// always pick the first; instead they are tried one at a time, each with a
+// handshake, which sends the first bytes along with the SYN. ctx bounds the
+// handshakes too.
+func dialFastOpen(ctx context.Context, network, addr string, flags DialFlags,
+	handshake func(c net.Conn) (*Conn, error)) (*Conn, error) {
+	dialer := net.Dialer{
+		FallbackDelay: -1,
+		Control:       dialControl(flags)}
+	targets, err := resolveTargets(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return dialSequential(ctx, network, targets, dialer.DialContext,
+		handshake)
+}
+
+// dialSequential returns the first connection to targets on which handshake
+// succeeds, or the first error if none does.
+func dialSequential(ctx context.Context, network string, targets []string,
+	dial dialFunc, handshake func(c net.Conn) (*Conn, error)) (*Conn,
+	error) {
+	var first_err error
+	for _, target := range targets {
+		c, err := dial(ctx, network, target)
+		if err == nil {
+			var conn *Conn
+			conn, err = handshakeContext(ctx, c, handshake)
+			if err == nil {
+				return conn, nil
+			}
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if first_err == nil {
+			first_err = err
+		}
+	}
+	return nil, first_err
+}
+
+// handshakeContext runs handshake on c, giving up when ctx is done, in which
+// case ctx's error is returned.
+func handshakeContext(ctx context.Context, c net.Conn,
+	handshake func(c net.Conn) (*Conn, error)) (*Conn, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			c.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	conn, err := handshake(c)
+	close(done)
+	// the deadline can't be cleared before the goroutine stops setting it
+	<-stopped
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	err = c.SetDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// resolveTargets returns the addresses to try for addr, alternating between
+// IPv6 and IPv4. Addresses that need no resolving, and networks other than
+// TCP, are returned as is.
+func resolveTargets(ctx context.Context, network, addr string) ([]string,
+	error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return []string{addr}, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return []string{addr}, nil
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []net.IP
+	for _, ip := range ips {
+		is_v4 := ip.IP.To4() != nil
+		if (network == "tcp4" && !is_v4) || (network == "tcp6" && is_v4) {
+			continue
+		}
+		addrs = append(addrs, ip.IP)
+	}
+	if len(addrs) == 0 {
+		return nil, &net.AddrError{Err: "no suitable address found", Addr: host}
+	}
+	targets := make([]string, 0, len(addrs))
+	for _, ip := range interleaveFamilies(addrs) {
+		targets = append(targets, net.JoinHostPort(ip.String(), port))
+	}
+	return targets, nil
+}
+
+// interleaveFamilies reorders addresses to alternate between IPv6 and IPv4,
+// starting with the family of the first address, while otherwise keeping
+// the resolver's order.
+func interleaveFamilies(addrs []net.IP) []net.IP {
+	var first, second []net.IP
+	first_v4 := addrs[0].To4() != nil
+	for _, ip := range addrs {
+		if (ip.To4() != nil) == first_v4 {
+			first = append(first, ip)
+		} else {
+			second = append(second, ip)
+		}
+	}
+	rv := make([]net.IP, 0, len(addrs))
+	for len(first) > 0 || len(second) > 0 {
+		if len(first) > 0 {
+			rv = append(rv, first[0])
+			first = first[1:]
+		}
+		if len(second) > 0 {
+			rv = append(rv, second[0])
+			second = second[1:]
+		}
+	}
+	return rv
+}
+
+// dialParallel starts a connection attempt to each target in order, waiting
+// up to delay between starts, and returns the first to succeed. The rest
+// are canceled, and closed if they connect anyway.
+func dialParallel(ctx context.Context, network string, targets []string,
+	delay time.Duration, dial dialFunc) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan result, len(targets))
+	start := func(target string) {
+		go func() {
+			conn, err := dial(ctx, network, target)
+			results <- result{conn: conn, err: err}
+		}()
+	}
+
+	// closes connections from attempts still running once we return
+	drain := func(pending int) {
+		for ; pending > 0; pending-- {
+			if res := <-results; res.err == nil {
+				res.conn.Close()
+			}
+		}
+	}
+
+	start(targets[0])
+	next, pending := 1, 1
+	var first_err error
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	for pending > 0 {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				go drain(pending)
+				return res.conn, nil
+			}
+			if first_err == nil {
+				first_err = res.err
+			}
+			if next < len(targets) {
+				start(targets[next])
+				next++
+				pending++
+				timer.Reset(delay)
+			}
+		case <-timer.C:
+			if next < len(targets) {
+				start(targets[next])
+				next++
+				pending++
+				timer.Reset(delay)
+			}
+		case <-ctx.Done():
+			go drain(pending)
+			return nil, ctx.Err()
+		}
+	}
+	return nil, first_err
+}
@@ -0,0 +1,254 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInterleaveFamilies(t *testing.T) {
+	var addrs []net.IP
+	for _, s := range []string{"::1", "::2", "::3", "10.0.0.1", "10.0.0.2"} {
+		addrs = append(addrs, net.ParseIP(s))
+	}
+	var got []string
+	for _, ip := range interleaveFamilies(addrs) {
+		got = append(got, ip.String())
+	}
+	expected := []string{"::1", "10.0.0.1", "::2", "10.0.0.2", "::3"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("got %v, expected %v", got, expected)
+	}
+}
+
+func TestDialParallel(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	var mtx sync.Mutex
+	var started []string
+	dial := func(ctx context.Context, network, addr string) (net.Conn,
+		error) {
+		mtx.Lock()
+		started = append(started, addr)
+		mtx.Unlock()
+		switch addr {
+		case "blackhole":
+			<-ctx.Done()
+			return nil, ctx.Err()
+		case "refused":
+			return nil, errors.New("connection refused")
+		}
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	// a hanging attempt is overtaken after the delay, and a failed one
+	// immediately
+	begin := time.Now()
+	conn, err := dialParallel(context.Background(), "tcp",
+		[]string{"blackhole", "refused", l.Addr().String()},
+		50*time.Millisecond, dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if elapsed := time.Since(begin); elapsed < 50*time.Millisecond ||
+		elapsed > time.Second {
+		t.Fatalf("unexpected dial time %v", elapsed)
+	}
+	mtx.Lock()
+	if len(started) != 3 {
+		t.Fatalf("expected three attempts, got %v", started)
+	}
+	mtx.Unlock()
+
+	// all attempts failing reports the first failure
+	_, err = dialParallel(context.Background(), "tcp",
+		[]string{"refused", "refused"}, time.Second, dial)
+	if err == nil || err.Error() != "connection refused" {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		20*time.Millisecond)
+	defer cancel()
+	_, err = dialParallel(ctx, "tcp", []string{"blackhole"}, time.Second,
+		dial)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected a deadline error, got %v", err)
+	}
+}
+
+func TestDialSequential(t *testing.T) {
+	l, err := Listen("tcp", "127.0.0.1:0", newTestServerCtx(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.(*Conn).Handshake()
+			c.Close()
+		}
+	}()
+	// accepts connections but never speaks TLS, like a fast open connect
+	// to an address that turns out to be unreachable
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dead.Close()
+	go func() {
+		for {
+			c, err := dead.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handshake := func(c net.Conn) (*Conn, error) {
+		conn, err := Client(c, ctx)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		if err := conn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+	var started []string
+	dial := func(ctx context.Context, network, addr string) (net.Conn,
+		error) {
+		started = append(started, addr)
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, addr)
+	}
+	targets := []string{dead.Addr().String(), l.Addr().String()}
+	conn, err := dialSequential(context.Background(), "tcp", targets, dial,
+		handshake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if !reflect.DeepEqual(started, targets) {
+		t.Fatalf("expected attempts %v, got %v", targets, started)
+	}
+
+	_, err = dialSequential(context.Background(), "tcp",
+		[]string{dead.Addr().String()}, dial, handshake)
+	if err == nil {
+		t.Fatal("expected the handshake failure to be reported")
+	}
+}
+
+func TestDialContextLocalhost(t *testing.T) {
+	// localhost commonly resolves to ::1 as well, which nothing listens on
+	l, err := Listen("tcp", "127.0.0.1:0", newTestServerCtx(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.Write([]byte("hi"))
+	}()
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := DialContext(context.Background(), "tcp",
+		net.JoinHostPort("localhost", port), nil,
+		InsecureSkipHostVerification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 2)
+	if _, err := conn.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDialContextStalledHandshake(t *testing.T) {
+	// accepts connections but never answers the ClientHello
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		100*time.Millisecond)
+	defer cancel()
+	_, err = DialContext(ctx, "tcp", l.Addr().String(), nil,
+		InsecureSkipHostVerification)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected the deadline to pass, got %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	_, err = DialContext(ctx, "tcp", l.Addr().String(), nil,
+		InsecureSkipHostVerification)
+	if err != context.Canceled {
+		t.Fatalf("expected the dial to be canceled, got %v", err)
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <stdlib.h>
+#include <openssl/evp.h>
+
+extern int OUR_EVP_MD_size(const EVP_MD *md);
+extern int OUR_EVP_MD_block_size(const EVP_MD *md);
+
+// shared with sha1.go, sha256.go and pem.go
+EVP_MD_CTX *OUR_EVP_MD_CTX_new() {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+    return EVP_MD_CTX_new();
+#else
+    return EVP_MD_CTX_create();
+#endif
+}
+
+void OUR_EVP_MD_CTX_free(EVP_MD_CTX *ctx) {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+    EVP_MD_CTX_free(ctx);
+#else
+    EVP_MD_CTX_destroy(ctx);
+#endif
+}
+
+// the SHA-3 and BLAKE2 digests are NULL before OpenSSL 1.1.1
+#if OPENSSL_VERSION_NUMBER >= 0x10101000L
+static const EVP_MD *OUR_EVP_sha3_256() { return EVP_sha3_256(); }
+static const EVP_MD *OUR_EVP_sha3_512() { return EVP_sha3_512(); }
+static const EVP_MD *OUR_EVP_shake128() { return EVP_shake128(); }
+static const EVP_MD *OUR_EVP_shake256() { return EVP_shake256(); }
+#else
+static const EVP_MD *OUR_EVP_sha3_256() { return NULL; }
+static const EVP_MD *OUR_EVP_sha3_512() { return NULL; }
+static const EVP_MD *OUR_EVP_shake128() { return NULL; }
+static const EVP_MD *OUR_EVP_shake256() { return NULL; }
+#endif
+
+#if OPENSSL_VERSION_NUMBER >= 0x10101000L && !defined(OPENSSL_NO_BLAKE2)
+static const EVP_MD *OUR_EVP_blake2b512() { return EVP_blake2b512(); }
+static const EVP_MD *OUR_EVP_blake2s256() { return EVP_blake2s256(); }
+#else
+static const EVP_MD *OUR_EVP_blake2b512() { return NULL; }
+static const EVP_MD *OUR_EVP_blake2s256() { return NULL; }
+#endif
+
+static int OUR_EVP_DigestFinalXOF(EVP_MD_CTX *ctx, unsigned char *md,
+        size_t len) {
+#if OPENSSL_VERSION_NUMBER >= 0x10101000L
+    return EVP_DigestFinalXOF(ctx, md, len);
+#else
+    return 0;
+#endif
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"runtime"
+	"unsafe"
+)
+
+// These are nil if the linked OpenSSL lacks them; NewDigest then returns an
+// error. SHA-3 and BLAKE2 require OpenSSL 1.1.1.
+var (
+	SHA3_256_Method   Method = C.OUR_EVP_sha3_256()
+	SHA3_512_Method   Method = C.OUR_EVP_sha3_512()
+	BLAKE2b512_Method Method = C.OUR_EVP_blake2b512()
+	BLAKE2s256_Method Method = C.OUR_EVP_blake2s256()
+)
+
+type digestHash struct {
+	md  Method
+	ctx *C.EVP_MD_CTX
+	// sum finalizes a copy of ctx, so that Sum leaves the hash running
+	sum        *C.EVP_MD_CTX
+	size       int
+	block_size int
+	// xof is set for SHAKE, whose output of size bytes is squeezed out
+	xof bool
+}
+
+// NewDigest returns a hash.Hash computing the digest method, such as
+// SHA3_256_Method or BLAKE2b512_Method, of what is written to it, using
+// OpenSSL's implementation. Like other hash.Hash implementations, it is not
+// safe for concurrent use.
+func NewDigest(method Method) (hash.Hash, error) {
+	if method == nil {
+		return nil, errors.New("openssl: digest: not supported by this " +
+			"version of OpenSSL")
+	}
+	return newDigestHash(method, int(C.OUR_EVP_MD_size(method)), false)
+}
+
+// GetDigestByName returns the digest called name, such as SHA512-256 or
+// md_gost12_256, for NewDigest and signing. Unlike the fixed methods, this
+// also finds digests added by engines once they are loaded, see
+// EngineById; with OpenSSL 3.0 providers use FetchDigest.
+func GetDigestByName(name string) (Method, error) {
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	md := C.EVP_get_digestbyname(cname)
+	if md == nil {
+		return nil, fmt.Errorf("digest %s not found", name)
+	}
+	return md, nil
+}
+
+// NewSHAKE128 returns a hash.Hash computing SHAKE128 of what is written to
+// it, with size bytes of output. It requires OpenSSL 1.1.1.
+func NewSHAKE128(size int) (hash.Hash, error) {
+	return newSHAKE(C.OUR_EVP_shake128(), size)
+}
+
+// NewSHAKE256 returns a hash.Hash computing SHAKE256 of what is written to
+// it, with size bytes of output. It requires OpenSSL 1.1.1.
+func NewSHAKE256(size int) (hash.Hash, error) {
+	return newSHAKE(C.OUR_EVP_shake256(), size)
+}
+
+func newSHAKE(method Method, size int) (hash.Hash, error) {
+	if method == nil {
+		return nil, errors.New("openssl: digest: SHAKE is not supported by " +
+			"this version of OpenSSL")
+	}
+	if size <= 0 {
+		return nil, errors.New("openssl: digest: SHAKE output size must be " +
+			"positive")
+	}
+	return newDigestHash(method, size, true)
+}
+
+func newDigestHash(method Method, size int, xof bool) (*digestHash, error) {
+	h := &digestHash{
+		md:         method,
+		ctx:        C.OUR_EVP_MD_CTX_new(),
+		sum:        C.OUR_EVP_MD_CTX_new(),
+		size:       size,
+		block_size: int(C.OUR_EVP_MD_block_size(method)),
+		xof:        xof,
+	}
+	runtime.SetFinalizer(h, func(h *digestHash) {
+		if h.ctx != nil {
+			C.OUR_EVP_MD_CTX_free(h.ctx)
+		}
+		if h.sum != nil {
+			C.OUR_EVP_MD_CTX_free(h.sum)
+		}
+	})
+	if h.ctx == nil || h.sum == nil {
+		return nil, errors.New("openssl: digest: cannot allocate ctx")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.EVP_DigestInit_ex(h.ctx, method, nil) != 1 {
+		return nil, errorFromErrorQueue()
+	}
+	return h, nil
+}
+
+func (h *digestHash) Write(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	defer runtime.KeepAlive(h)
+	if C.EVP_DigestUpdate(h.ctx, unsafe.Pointer(&p[0]),
+		C.size_t(len(p))) != 1 {
+		return 0, errors.New("openssl: digest: cannot update ctx")
+	}
+	return len(p), nil
+}
+
+func (h *digestHash) Sum(b []byte) []byte {
+	defer runtime.KeepAlive(h)
+	if C.EVP_MD_CTX_copy_ex(h.sum, h.ctx) != 1 {
+		panic("openssl: digest: cannot copy ctx")
+	}
+	out := make([]byte, h.size)
+	if h.xof {
+		if C.OUR_EVP_DigestFinalXOF(h.sum, (*C.uchar)(&out[0]),
+			C.size_t(h.size)) != 1 {
+			panic("openssl: digest: cannot finalize ctx")
+		}
+		return append(b, out...)
+	}
+	if C.EVP_DigestFinal_ex(h.sum, (*C.uchar)(&out[0]), nil) != 1 {
+		panic("openssl: digest: cannot finalize ctx")
+	}
+	return append(b, out...)
+}
+
+func (h *digestHash) Reset() {
+	defer runtime.KeepAlive(h)
+	if C.EVP_DigestInit_ex(h.ctx, h.md, nil) != 1 {
+		panic("openssl: digest: cannot reset ctx")
+	}
+}
+
+func (h *digestHash) Size() int { return h.size }
+
+func (h *digestHash) BlockSize() int { return h.block_size }
@@ -0,0 +1,126 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"testing"
+)
+
+func TestDigests(t *testing.T) {
+	shake128 := func() (hash.Hash, error) { return NewSHAKE128(32) }
+	shake256 := func() (hash.Hash, error) { return NewSHAKE256(64) }
+	digest := func(method Method) func() (hash.Hash, error) {
+		return func() (hash.Hash, error) { return NewDigest(method) }
+	}
+	vectors := []struct {
+		name     string
+		new      func() (hash.Hash, error)
+		input    string
+		expected string
+	}{
+		{"sha3-256", digest(SHA3_256_Method), "abc",
+			"3a985da74fe225b2045c172d6bd390bd855f086e3e9d525b46bfe24511431532"},
+		{"sha3-512", digest(SHA3_512_Method), "abc",
+			"b751850b1a57168a5693cd924b6b096e08f621827444f70d884f5d0240d2712e" +
+				"10e116e9192af3c91a7ec57647e3934057340b4cf408d5a56592f8274eec53f0"},
+		{"shake128", shake128, "",
+			"7f9c2ba4e88f827d616045507605853ed73b8093f6efbc88eb1a6eacfa66ef26"},
+		{"shake256", shake256, "",
+			"46b9dd2b0ba88d13233b3feb743eeb243fcd52ea62b81b82b50c27646ed5762f" +
+				"d75dc4ddd8c0f200cb05019d67b592f6fc821c49479ab48640292eacb3b7c4be"},
+		{"blake2b512", digest(BLAKE2b512_Method), "abc",
+			"ba80a53f981c4d0d6a2797b69f12f6e94c212f14685ac4b74b12bb6fdbffa2d1" +
+				"7d87c5392aab792dc252d5de4533cc9518d38aa8dbf1925ab92386edd4009923"},
+		{"blake2s256", digest(BLAKE2s256_Method), "abc",
+			"508c5e8c327c14e2e1a72ba34eeb452f37458b209ed63a294d999b4c86675982"},
+	}
+	for _, v := range vectors {
+		h, err := v.new()
+		if err != nil {
+			t.Fatalf("%s: %s", v.name, err)
+		}
+		if h.Size() != len(v.expected)/2 {
+			t.Fatalf("%s: expected size %d, got %d", v.name,
+				len(v.expected)/2, h.Size())
+		}
+		// written a byte at a time, and summed twice to check Sum leaves the
+		// hash running
+		for i := range v.input {
+			h.Write([]byte{v.input[i]})
+		}
+		for i := 0; i < 2; i++ {
+			if sum := hex.EncodeToString(h.Sum(nil)); sum != v.expected {
+				t.Fatalf("%s: expected %s, got %s", v.name, v.expected, sum)
+			}
+		}
+		h.Write([]byte("more"))
+		h.Reset()
+		h.Write([]byte(v.input))
+		if sum := hex.EncodeToString(h.Sum([]byte{})); sum != v.expected {
+			t.Fatalf("%s: after Reset, expected %s, got %s", v.name,
+				v.expected, sum)
+		}
+	}
+}
+
+func TestSHAKEOutputSize(t *testing.T) {
+	short, err := NewSHAKE256(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	long, err := NewSHAKE256(200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	short.Write([]byte("hello"))
+	long.Write([]byte("hello"))
+	short_sum, long_sum := short.Sum(nil), long.Sum(nil)
+	if len(short_sum) != 16 || len(long_sum) != 200 {
+		t.Fatalf("expected 16 and 200 bytes, got %d and %d", len(short_sum),
+			len(long_sum))
+	}
+	// SHAKE's output is a prefix of any longer output
+	if hex.EncodeToString(long_sum[:16]) != hex.EncodeToString(short_sum) {
+		t.Fatal("expected the short output to prefix the long one")
+	}
+	if _, err := NewSHAKE128(0); err == nil {
+		t.Fatal("expected an error for an empty output size")
+	}
+}
+
+func TestGetDigestByName(t *testing.T) {
+	md, err := GetDigestByName("SHA256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewDigest(md)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Write([]byte("abc"))
+	want := sha256.Sum256([]byte("abc"))
+	if !bytes.Equal(h.Sum(nil), want[:]) {
+		t.Fatal("digest found by name doesn't match SHA-256")
+	}
+	if _, err := GetDigestByName("nonexistent"); err == nil {
+		t.Fatal("expected an error for an unknown digest")
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include <string.h>
+#include <openssl/bio.h>
+#include <openssl/ssl.h>
+#include "_cgo_export.h"
+
+// datagram BIOs hand OpenSSL one datagram per read, and send one per write,
+// through the DTLSConn that owns them
+
+static int dtls_bio_write(BIO *b, const char *data, int size) {
+	BIO_clear_retry_flags(b);
+	return dtls_bio_write_thunk(b, (char *)data, size);
+}
+
+static int dtls_bio_read(BIO *b, char *buf, int size) {
+	int rv;
+	BIO_clear_retry_flags(b);
+	rv = dtls_bio_read_thunk(b, buf, size);
+	if (rv < 0)
+		BIO_set_retry_read(b);
+	return rv;
+}
+
+static long dtls_bio_ctrl(BIO *b, int cmd, long num, void *ptr) {
+	switch (cmd) {
+	case BIO_CTRL_FLUSH:
+		return 1;
+	default:
+		// the MTU is set explicitly, see dtls_set_mtu
+		return 0;
+	}
+}
+
+static int dtls_bio_create(BIO *b) {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+	BIO_set_init(b, 1);
+#else
+	b->init = 1;
+	b->num = 0;
+	b->ptr = NULL;
+	b->flags = 0;
+#endif
+	return 1;
+}
+
+static int dtls_bio_destroy(BIO *b) {
+	return 1;
+}
+
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+static BIO_METHOD *dtls_bio_method;
+#else
+static BIO_METHOD dtls_bio_method_static = {
+	BIO_TYPE_SOURCE_SINK,
+	"Go DTLS BIO",
+	dtls_bio_write,
+	dtls_bio_read,
+	NULL,
+	NULL,
+	dtls_bio_ctrl,
+	dtls_bio_create,
+	dtls_bio_destroy,
+	NULL
+};
+static BIO_METHOD *dtls_bio_method = &dtls_bio_method_static;
+#endif
+
+int dtls_init_bio_method() {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+	dtls_bio_method = BIO_meth_new(BIO_TYPE_SOURCE_SINK, "Go DTLS BIO");
+	if (dtls_bio_method == NULL)
+		return 0;
+	BIO_meth_set_write(dtls_bio_method, dtls_bio_write);
+	BIO_meth_set_read(dtls_bio_method, dtls_bio_read);
+	BIO_meth_set_ctrl(dtls_bio_method, dtls_bio_ctrl);
+	BIO_meth_set_create(dtls_bio_method, dtls_bio_create);
+	BIO_meth_set_destroy(dtls_bio_method, dtls_bio_destroy);
+#endif
+	return 1;
+}
+
+BIO *dtls_bio_new() {
+	if (dtls_bio_method == NULL)
+		return NULL;
+	return BIO_new(dtls_bio_method);
+}
+
+const SSL_METHOD *OUR_DTLS_method() {
+#if OPENSSL_VERSION_NUMBER >= 0x10002000L
+	return DTLS_method();
+#else
+	return NULL;
+#endif
+}
+
+static int dtls_cookie_generate_cb(SSL *ssl, unsigned char *cookie,
+		unsigned int *cookie_len) {
+	return dtls_cookie_generate_thunk(SSL_get_rbio(ssl), cookie,
+		cookie_len);
+}
+
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+static int dtls_cookie_verify_cb(SSL *ssl, const unsigned char *cookie,
+		unsigned int cookie_len) {
+#else
+static int dtls_cookie_verify_cb(SSL *ssl, unsigned char *cookie,
+		unsigned int cookie_len) {
+#endif
+	return dtls_cookie_verify_thunk(SSL_get_rbio(ssl),
+		(unsigned char *)cookie, cookie_len);
+}
+
+void dtls_ctx_setup(SSL_CTX *ctx) {
+	// DTLS records must be read a datagram at a time
+	SSL_CTX_set_read_ahead(ctx, 1);
+	SSL_CTX_set_cookie_generate_cb(ctx, dtls_cookie_generate_cb);
+	SSL_CTX_set_cookie_verify_cb(ctx, dtls_cookie_verify_cb);
+}
+
+// dtls_listen reports whether the datagram waiting in ssl's BIO was a
+// ClientHello carrying a valid cookie, having answered it with a
+// HelloVerifyRequest if it had none.
+int dtls_listen(SSL *ssl) {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+	int rv;
+	BIO_ADDR *peer = BIO_ADDR_new();
+	if (peer == NULL)
+		return -1;
+	rv = DTLSv1_listen(ssl, peer);
+	BIO_ADDR_free(peer);
+	return rv;
+#else
+	struct sockaddr_storage peer;
+	SSL_set_options(ssl, SSL_OP_COOKIE_EXCHANGE);
+	return DTLSv1_listen(ssl, &peer);
+#endif
+}
+
+// dtls_get_timeout returns the microseconds left until ssl next retransmits,
+// or -1 if it is not waiting on a reply.
+long dtls_get_timeout(SSL *ssl) {
+	struct timeval tv;
+	if (DTLSv1_get_timeout(ssl, &tv) != 1)
+		return -1;
+	return tv.tv_sec * 1000000 + tv.tv_usec;
+}
+
+int dtls_handle_timeout(SSL *ssl) {
+	return DTLSv1_handle_timeout(ssl);
+}
+
+long dtls_set_mtu(SSL *ssl, long mtu) {
+	SSL_set_options(ssl, SSL_OP_NO_QUERY_MTU);
+	return SSL_set_mtu(ssl, mtu);
+}
+
+X509 *dtls_get_peer_certificate(SSL *ssl) {
+#if OPENSSL_VERSION_NUMBER >= 0x30000000L
+	return SSL_get1_peer_certificate(ssl);
+#else
+	return SSL_get_peer_certificate(ssl);
+#endif
+}
@@ -0,0 +1,810 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <stdlib.h>
+#include <openssl/err.h>
+#include <openssl/ssl.h>
+
+extern int dtls_init_bio_method();
+extern BIO *dtls_bio_new();
+extern const SSL_METHOD *OUR_DTLS_method();
+extern void dtls_ctx_setup(SSL_CTX *ctx);
+extern int dtls_listen(SSL *ssl);
+extern long dtls_get_timeout(SSL *ssl);
+extern int dtls_handle_timeout(SSL *ssl);
+extern long dtls_set_mtu(SSL *ssl, long mtu);
+extern X509 *dtls_get_peer_certificate(SSL *ssl);
+extern int SSL_is_init_finished_not_a_macro(const SSL *ssl);
+extern long SSL_set_tlsext_host_name_not_a_macro(SSL *ssl, const char *name);
+*/
+import "C"
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/spacemonkeygo/openssl/utils"
+)
+
+// DefaultDTLSMTU is the largest datagram DTLS connections send until
+// SetMTU says otherwise. It fits in the minimum IPv6 MTU once the IP and UDP
+// headers are added.
+const DefaultDTLSMTU = 1232
+
+var (
+	dtls_bio_method_ok = C.dtls_init_bio_method() == 1
+
+	// BIOs of live DTLS connections, for the BIO and cookie callbacks
+	dtls_conns_mtx sync.Mutex
+	dtls_conns     = map[*C.BIO]*DTLSConn{}
+
+	dtlsUnsupported = errors.New("DTLS requires OpenSSL 1.0.2 or newer")
+	dtlsClosed      = errors.New("connection closed")
+
+	// DTLSListenerClosed is returned by connections accepted from a DTLS
+	// listener once the listener is closed, since they share its socket.
+	DTLSListenerClosed = errors.New("openssl: DTLS listener closed")
+)
+
+// NewDTLSCtx creates a context for DTLS connections, see DialDTLS,
+// ListenDTLS and DTLSClientSCTP. It negotiates the highest version of DTLS
+// both sides support.
+func NewDTLSCtx() (*Ctx, error) {
+	method := C.OUR_DTLS_method()
+	if method == nil {
+		return nil, dtlsUnsupported
+	}
+	c, err := newCtx(method)
+	if err != nil {
+		return nil, err
+	}
+	C.dtls_ctx_setup(c.ctx)
+	return c, nil
+}
+
+// dtlsTransport carries the datagrams of a single DTLS connection.
+type dtlsTransport interface {
+	// recv returns the next datagram, or a timeout error once deadline
+	// passes.
+	recv(deadline time.Time) ([]byte, error)
+	send(b []byte) error
+	close() error
+	localAddr() net.Addr
+	remoteAddr() net.Addr
+}
+
+// DTLSConn is a DTLS connection over datagrams, such as a UDP socket. Unlike
+// Conn, each Write is sent as a single record, and each Read returns a single
+// record, so message boundaries are kept and lost records are simply never
+// read. Writes should therefore fit within the MTU, see SetMTU. One
+// goroutine may Read while another Writes.
+//
+// OpenSSL retransmits handshake messages that go unanswered on a timer that
+// backs off up to a minute. Connections wait for these timers while reading,
+// so deadlines bound the whole handshake, retransmissions included, rather
+// than any single datagram.
+type DTLSConn struct {
+	transport dtlsTransport
+	ssl       *C.SSL
+	bio       *C.BIO
+	ctx       *Ctx // for gc
+	// listener is set on connections accepted from ListenDTLS, for cookies
+	listener *dtlsListener
+
+	mtx            sync.Mutex
+	is_shutdown    bool
+	in             [][]byte
+	out            [][]byte
+	read_deadline  time.Time
+	write_deadline time.Time
+
+	// recv_mtx lets a single goroutine wait on the transport at a time
+	recv_mtx sync.Mutex
+}
+
+func newDTLSConn(transport dtlsTransport, ctx *Ctx) (*DTLSConn, error) {
+	if !dtls_bio_method_ok {
+		return nil, errors.New("failed to allocate DTLS BIO method")
+	}
+	ssl, err := newSSL(ctx)
+	if err != nil {
+		return nil, err
+	}
+	bio := C.dtls_bio_new()
+	if bio == nil {
+		freeSSL(ssl, ctx)
+		return nil, errors.New("failed to allocate DTLS BIO")
+	}
+	// the ssl object takes ownership of the BIO, for both directions
+	C.SSL_set_bio(ssl, bio, bio)
+	C.dtls_set_mtu(ssl, DefaultDTLSMTU)
+	c := &DTLSConn{
+		transport: transport,
+		ssl:       ssl,
+		bio:       bio,
+		ctx:       ctx}
+	dtls_conns_mtx.Lock()
+	dtls_conns[bio] = c
+	dtls_conns_mtx.Unlock()
+	return c, nil
+}
+
+func dtlsConnFor(bio *C.BIO) *DTLSConn {
+	dtls_conns_mtx.Lock()
+	defer dtls_conns_mtx.Unlock()
+	return dtls_conns[bio]
+}
+
+// free releases the SSL object. The caller must hold c.mtx.
+func (c *DTLSConn) free() {
+	c.is_shutdown = true
+	dtls_conns_mtx.Lock()
+	delete(dtls_conns, c.bio)
+	dtls_conns_mtx.Unlock()
+	freeSSL(c.ssl, c.ctx)
+	c.in, c.out = nil, nil
+}
+
+// DTLSClient wraps an existing datagram connection, such as a connected
+// *net.UDPConn, and puts it in the connect state for the handshake. Each
+// Read of conn must return a single datagram. As with Client, you are
+// responsible for verifying the peer's hostname, and for setting up SNI.
+func DTLSClient(conn net.Conn, ctx *Ctx) (*DTLSConn, error) {
+	c, err := newDTLSConn(&dtlsNetConn{conn: conn}, ctx)
+	if err != nil {
+		return nil, err
+	}
+	C.SSL_set_connect_state(c.ssl)
+	return c, nil
+}
+
+// DialDTLS connects to addr over network, which must be "udp", "udp4" or
+// "udp6", and performs the handshake of a DTLS client connection using ctx,
+// which should come from NewDTLSCtx. A nil ctx uses a fresh one. flags are
+// as for Dial.
+func DialDTLS(network, addr string, ctx *Ctx, flags DialFlags) (*DTLSConn,
+	error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ctx == nil {
+		ctx, err = NewDTLSCtx()
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, errors.New("DTLS requires a udp network")
+	}
+	udp, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := DTLSClient(udp, ctx)
+	if err != nil {
+		udp.Close()
+		return nil, err
+	}
+	if flags&DisableSNI == 0 {
+		err = conn.SetTlsExtHostName(host)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	err = conn.Handshake()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if flags&InsecureSkipHostVerification == 0 {
+		err = conn.VerifyHostname(host)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// flush sends the datagrams OpenSSL has written. The caller must hold c.mtx.
+func (c *DTLSConn) flush() error {
+	var errs utils.ErrorGroup
+	for _, b := range c.out {
+		errs.Add(c.transport.send(b))
+	}
+	c.out = nil
+	return errs.Finalize()
+}
+
+// do calls op, an SSL function on c.ssl, until it succeeds, sending whatever
+// it writes, and waiting for datagrams and retransmissions until the deadline
+// returns passes.
+func (c *DTLSConn) do(op func() C.int, deadline func() time.Time) (int,
+	error) {
+	for {
+		c.mtx.Lock()
+		if c.is_shutdown {
+			c.mtx.Unlock()
+			return 0, dtlsClosed
+		}
+		runtime.LockOSThread()
+		rv := op()
+		var err error
+		errcode := C.int(C.SSL_ERROR_NONE)
+		if rv <= 0 {
+			errcode = C.SSL_get_error(c.ssl, rv)
+			switch errcode {
+			case C.SSL_ERROR_WANT_READ, C.SSL_ERROR_WANT_WRITE:
+			case C.SSL_ERROR_ZERO_RETURN:
+				err = io.EOF
+			case C.SSL_ERROR_SYSCALL:
+				if C.ERR_peek_error() == 0 {
+					err = errors.New("protocol-violating EOF")
+				} else {
+					err = errorFromErrorQueue()
+				}
+			default:
+				err = errorFromErrorQueue()
+			}
+		}
+		runtime.UnlockOSThread()
+		flush_err := c.flush()
+		c.mtx.Unlock()
+		switch {
+		case rv > 0:
+			return int(rv), flush_err
+		case err != nil:
+			return 0, err
+		case flush_err != nil:
+			return 0, flush_err
+		case errcode == C.SSL_ERROR_WANT_READ:
+			err = c.wait(deadline())
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+}
+
+// wait waits for a datagram until deadline, retransmitting when OpenSSL's
+// timer runs out first.
+func (c *DTLSConn) wait(deadline time.Time) error {
+	c.recv_mtx.Lock()
+	defer c.recv_mtx.Unlock()
+	c.mtx.Lock()
+	if c.is_shutdown {
+		c.mtx.Unlock()
+		return dtlsClosed
+	}
+	if len(c.in) > 0 {
+		// another goroutine received while we waited on it
+		c.mtx.Unlock()
+		return nil
+	}
+	timer := time.Duration(C.dtls_get_timeout(c.ssl)) * time.Microsecond
+	c.mtx.Unlock()
+	retransmit := false
+	if timer >= 0 {
+		if at := time.Now().Add(timer); deadline.IsZero() ||
+			at.Before(deadline) {
+			deadline = at
+			retransmit = true
+		}
+	}
+	b, err := c.transport.recv(deadline)
+	if err != nil {
+		if net_err, ok := err.(net.Error); ok && net_err.Timeout() &&
+			retransmit {
+			return c.handleTimeout()
+		}
+		return err
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if !c.is_shutdown {
+		c.in = append(c.in, b)
+	}
+	return nil
+}
+
+func (c *DTLSConn) handleTimeout() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.is_shutdown {
+		return dtlsClosed
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.dtls_handle_timeout(c.ssl) < 0 {
+		return errorFromErrorQueue()
+	}
+	return c.flush()
+}
+
+func (c *DTLSConn) readDeadline() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.read_deadline
+}
+
+func (c *DTLSConn) writeDeadline() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.write_deadline
+}
+
+// Handshake performs the DTLS handshake, until the read deadline. If it is
+// not manually triggered, it will run before the first Read or Write.
+func (c *DTLSConn) Handshake() error {
+	_, err := c.do(func() C.int { return C.SSL_do_handshake(c.ssl) },
+		c.readDeadline)
+	return err
+}
+
+// Read reads the next record into b, discarding whatever of it does not
+// fit.
+func (c *DTLSConn) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	return c.do(func() C.int {
+		return C.SSL_read(c.ssl, unsafe.Pointer(&b[0]), C.int(len(b)))
+	}, c.readDeadline)
+}
+
+// Write sends b as a single record. The write deadline bounds any
+// handshake it has to complete first.
+func (c *DTLSConn) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	return c.do(func() C.int {
+		return C.SSL_write(c.ssl, unsafe.Pointer(&b[0]), C.int(len(b)))
+	}, c.writeDeadline)
+}
+
+// Close sends the peer a close_notify alert if the handshake completed, and
+// closes the underlying transport. For connections accepted from a DTLS
+// listener, the listener's socket stays open.
+func (c *DTLSConn) Close() error {
+	c.mtx.Lock()
+	if c.is_shutdown {
+		c.mtx.Unlock()
+		return nil
+	}
+	var errs utils.ErrorGroup
+	if C.SSL_is_init_finished_not_a_macro(c.ssl) == 1 {
+		C.SSL_shutdown(c.ssl)
+		C.ERR_clear_error()
+		errs.Add(c.flush())
+	}
+	c.free()
+	c.mtx.Unlock()
+	errs.Add(c.transport.close())
+	return errs.Finalize()
+}
+
+// SetMTU sets the largest datagram the connection sends, which must be at
+// least 256 bytes, in place of DefaultDTLSMTU. Handshake messages are
+// fragmented to fit, but records passed to Write are not.
+func (c *DTLSConn) SetMTU(mtu int) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.is_shutdown {
+		return dtlsClosed
+	}
+	if C.dtls_set_mtu(c.ssl, C.long(mtu)) <= 0 {
+		return errors.New("openssl: MTU too small for DTLS")
+	}
+	return nil
+}
+
+// SetTlsExtHostName sets the host name a client sends with SNI.
+func (c *DTLSConn) SetTlsExtHostName(name string) error {
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.is_shutdown {
+		return dtlsClosed
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.SSL_set_tlsext_host_name_not_a_macro(c.ssl, cname) == 0 {
+		return errorFromErrorQueue()
+	}
+	return nil
+}
+
+// PeerCertificate returns the Certificate of the peer. Only valid after a
+// handshake.
+func (c *DTLSConn) PeerCertificate() (*Certificate, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.is_shutdown {
+		return nil, dtlsClosed
+	}
+	x := C.dtls_get_peer_certificate(c.ssl)
+	if x == nil {
+		return nil, errors.New("no peer certificate found")
+	}
+	return newCertificate(x), nil
+}
+
+// VerifyHostname pulls the PeerCertificate and calls VerifyHostname on the
+// certificate.
+func (c *DTLSConn) VerifyHostname(host string) error {
+	cert, err := c.PeerCertificate()
+	if err != nil {
+		return err
+	}
+	return cert.VerifyHostname(host)
+}
+
+// LocalAddr returns the underlying transport's local address
+func (c *DTLSConn) LocalAddr() net.Addr {
+	return c.transport.localAddr()
+}
+
+// RemoteAddr returns the address of the peer
+func (c *DTLSConn) RemoteAddr() net.Addr {
+	return c.transport.remoteAddr()
+}
+
+// SetDeadline sets both the read and write deadlines.
+func (c *DTLSConn) SetDeadline(t time.Time) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.read_deadline = t
+	c.write_deadline = t
+	return nil
+}
+
+// SetReadDeadline sets the deadline for Read and Handshake.
+func (c *DTLSConn) SetReadDeadline(t time.Time) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.read_deadline = t
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for Write, which only waits while it
+// completes the handshake.
+func (c *DTLSConn) SetWriteDeadline(t time.Time) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.write_deadline = t
+	return nil
+}
+
+//export dtls_bio_write_thunk
+func dtls_bio_write_thunk(b *C.BIO, data *C.char, size C.int) (rc C.int) {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Critf("openssl: dtls_bio_write_thunk panic'd: %v", err)
+			rc = -1
+		}
+	}()
+	// the caller holds c.mtx
+	c := dtlsConnFor(b)
+	if c == nil || data == nil || size < 0 {
+		return -1
+	}
+	c.out = append(c.out, C.GoBytes(unsafe.Pointer(data), size))
+	return size
+}
+
+//export dtls_bio_read_thunk
+func dtls_bio_read_thunk(b *C.BIO, buf *C.char, size C.int) (rc C.int) {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Critf("openssl: dtls_bio_read_thunk panic'd: %v", err)
+			rc = -1
+		}
+	}()
+	// the caller holds c.mtx
+	c := dtlsConnFor(b)
+	if c == nil || buf == nil || size < 0 || len(c.in) == 0 {
+		return -1
+	}
+	datagram := c.in[0]
+	c.in = c.in[1:]
+	return C.int(copy(nonCopyCString(buf, size), datagram))
+}
+
+// dtlsNetConn is the transport of a connection that has a net.Conn to
+// itself.
+type dtlsNetConn struct {
+	conn net.Conn
+	buf  []byte
+}
+
+func (t *dtlsNetConn) recv(deadline time.Time) ([]byte, error) {
+	err := t.conn.SetReadDeadline(deadline)
+	if err != nil {
+		return nil, err
+	}
+	if t.buf == nil {
+		t.buf = make([]byte, 65536)
+	}
+	n, err := t.conn.Read(t.buf)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), t.buf[:n]...), nil
+}
+
+func (t *dtlsNetConn) send(b []byte) error {
+	_, err := t.conn.Write(b)
+	return err
+}
+
+func (t *dtlsNetConn) close() error         { return t.conn.Close() }
+func (t *dtlsNetConn) localAddr() net.Addr  { return t.conn.LocalAddr() }
+func (t *dtlsNetConn) remoteAddr() net.Addr { return t.conn.RemoteAddr() }
+
+// dtlsListener demultiplexes the datagrams arriving on one socket between
+// the connections accepted from it, by their peer's address.
+type dtlsListener struct {
+	pc     net.PacketConn
+	ctx    *Ctx
+	secret [32]byte
+
+	mtx     sync.Mutex
+	peers   map[string]*dtlsPeer
+	err     error
+	accepts chan *DTLSConn
+	closed  chan struct{}
+}
+
+// ListenDTLS listens for DTLS connections on the UDP address laddr, using
+// ctx, which should come from NewDTLSCtx and hold the server's certificate.
+// Before it keeps any state for a client, the client must echo back a cookie
+// the listener sends it, which proves that it can receive datagrams at the
+// address it sends from, see DTLSv1_listen. Accepted connections are
+// *DTLSConns whose handshakes complete on the first Handshake, Read or
+// Write. They share the listener's socket, so closing the listener ends them
+// too.
+func ListenDTLS(network, laddr string, ctx *Ctx) (net.Listener, error) {
+	if ctx == nil {
+		return nil, errors.New("no ssl context provided")
+	}
+	if C.OUR_DTLS_method() == nil {
+		return nil, dtlsUnsupported
+	}
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, errors.New("DTLS requires a udp network")
+	}
+	C.dtls_ctx_setup(ctx.ctx)
+	pc, err := net.ListenPacket(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	l := &dtlsListener{
+		pc:      pc,
+		ctx:     ctx,
+		peers:   make(map[string]*dtlsPeer),
+		accepts: make(chan *DTLSConn, 16),
+		closed:  make(chan struct{})}
+	_, err = rand.Read(l.secret[:])
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	go l.serve()
+	return l, nil
+}
+
+func (l *dtlsListener) serve() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := l.pc.ReadFrom(buf)
+		if err != nil {
+			l.close(err)
+			return
+		}
+		datagram := append([]byte(nil), buf[:n]...)
+		l.mtx.Lock()
+		peer := l.peers[addr.String()]
+		l.mtx.Unlock()
+		if peer == nil {
+			l.listen(addr, datagram)
+			continue
+		}
+		select {
+		case peer.in <- datagram:
+		default:
+			// the connection is behind, so drop the datagram as the
+			// network might have
+		}
+	}
+}
+
+// listen sets up a connection for a datagram from an unknown peer if it is
+// a ClientHello with a valid cookie, and answers it with a cookie otherwise.
+func (l *dtlsListener) listen(addr net.Addr, datagram []byte) {
+	peer := &dtlsPeer{
+		listener: l,
+		addr:     addr,
+		in:       make(chan []byte, 32),
+		done:     make(chan struct{})}
+	c, err := newDTLSConn(peer, l.ctx)
+	if err != nil {
+		logger.Errorf("openssl: failed to set up DTLS connection: %v", err)
+		return
+	}
+	c.listener = l
+	c.mtx.Lock()
+	C.SSL_set_accept_state(c.ssl)
+	c.in = append(c.in, datagram)
+	rv := C.dtls_listen(c.ssl)
+	C.ERR_clear_error()
+	c.flush()
+	if rv <= 0 {
+		c.free()
+		c.mtx.Unlock()
+		return
+	}
+	c.mtx.Unlock()
+	l.mtx.Lock()
+	if l.err != nil {
+		l.mtx.Unlock()
+		c.Close()
+		return
+	}
+	l.peers[addr.String()] = peer
+	l.mtx.Unlock()
+	select {
+	case l.accepts <- c:
+	default:
+		// nobody is accepting, so let the client try again later
+		c.Close()
+	}
+}
+
+// cookie returns the cookie the peer at addr must echo back.
+func (l *dtlsListener) cookie(addr net.Addr) []byte {
+	mac := hmac.New(sha256.New, l.secret[:])
+	mac.Write([]byte(addr.String()))
+	return mac.Sum(nil)
+}
+
+//export dtls_cookie_generate_thunk
+func dtls_cookie_generate_thunk(b *C.BIO, cookie *C.uchar,
+	cookie_len *C.uint) C.int {
+	c := dtlsConnFor(b)
+	if c == nil || c.listener == nil {
+		return 0
+	}
+	mac := c.listener.cookie(c.RemoteAddr())
+	copy(nonCopyCString((*C.char)(unsafe.Pointer(cookie)), C.int(len(mac))),
+		mac)
+	*cookie_len = C.uint(len(mac))
+	return 1
+}
+
+//export dtls_cookie_verify_thunk
+func dtls_cookie_verify_thunk(b *C.BIO, cookie *C.uchar,
+	cookie_len C.uint) C.int {
+	c := dtlsConnFor(b)
+	if c == nil || c.listener == nil {
+		return 0
+	}
+	if !hmac.Equal(C.GoBytes(unsafe.Pointer(cookie), C.int(cookie_len)),
+		c.listener.cookie(c.RemoteAddr())) {
+		return 0
+	}
+	return 1
+}
+
+// Accept waits for the next connection whose client passed the cookie
+// exchange, and returns it as a *DTLSConn.
+func (l *dtlsListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accepts:
+		return c, nil
+	case <-l.closed:
+		l.mtx.Lock()
+		defer l.mtx.Unlock()
+		return nil, l.err
+	}
+}
+
+func (l *dtlsListener) close(err error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.err != nil {
+		return
+	}
+	l.err = err
+	close(l.closed)
+}
+
+// Close closes the listener's socket, ending the connections accepted from
+// it.
+func (l *dtlsListener) Close() error {
+	l.close(DTLSListenerClosed)
+	return l.pc.Close()
+}
+
+func (l *dtlsListener) Addr() net.Addr {
+	return l.pc.LocalAddr()
+}
+
+// dtlsPeer is the transport of a connection accepted from a dtlsListener.
+type dtlsPeer struct {
+	listener  *dtlsListener
+	addr      net.Addr
+	in        chan []byte
+	done      chan struct{}
+	done_once sync.Once
+}
+
+func (p *dtlsPeer) recv(deadline time.Time) ([]byte, error) {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case b := <-p.in:
+		return b, nil
+	case <-p.done:
+		return nil, dtlsClosed
+	case <-p.listener.closed:
+		return nil, DTLSListenerClosed
+	case <-timeout:
+		return nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (p *dtlsPeer) send(b []byte) error {
+	_, err := p.listener.pc.WriteTo(b, p.addr)
+	return err
+}
+
+func (p *dtlsPeer) close() error {
+	p.done_once.Do(func() { close(p.done) })
+	l := p.listener
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.peers[p.addr.String()] == p {
+		delete(l.peers, p.addr.String())
+	}
+	return nil
+}
+
+func (p *dtlsPeer) localAddr() net.Addr  { return p.listener.pc.LocalAddr() }
+func (p *dtlsPeer) remoteAddr() net.Addr { return p.addr }
@@ -0,0 +1,295 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <openssl/err.h>
+#include <openssl/ssl.h>
+
+extern X509 *dtls_get_peer_certificate(SSL *ssl);
+extern int SSL_is_init_finished_not_a_macro(const SSL *ssl);
+
+static int OUR_SCTP_supported() {
+#ifndef OPENSSL_NO_SCTP
+    return 1;
+#else
+    return 0;
+#endif
+}
+
+// the BIO turns on SCTP-AUTH for DATA chunks on fd, and fails if the stack
+// can't, which RFC 6083 requires; the socket stays the caller's to close
+static BIO *OUR_BIO_new_dgram_sctp(int fd) {
+#ifndef OPENSSL_NO_SCTP
+    return BIO_new_dgram_sctp(fd, BIO_NOCLOSE);
+#else
+    return NULL;
+#endif
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// DTLSOverSCTPUnsupported is returned when OpenSSL was built without SCTP
+// support (OPENSSL_NO_SCTP), as most distribution builds are; it needs
+// enable-sctp.
+var DTLSOverSCTPUnsupported = errors.New(
+	"openssl: DTLS over SCTP requires OpenSSL built with enable-sctp")
+
+// DTLSSCTPConn is a DTLS connection over an SCTP association (RFC 6083), as
+// telecom signaling stacks such as Diameter require. Unlike DTLSConn, SCTP
+// delivers records reliably and in order, so there are no retransmission
+// timers or MTU to manage, and records may be up to 16KB. OpenSSL drives the
+// socket itself, and uses keys exported from the handshake for SCTP-AUTH, so
+// the host's SCTP stack must support it (on Linux, the sysctl
+// net.sctp.auth_enable=1). One goroutine may Read while another Writes.
+type DTLSSCTPConn struct {
+	file *os.File
+	raw  syscall.RawConn
+	ssl  *C.SSL
+	ctx  *Ctx // for gc
+
+	mtx         sync.Mutex
+	is_shutdown bool
+}
+
+// DTLSClientSCTP wraps fd, a connected one-to-one style SCTP socket
+// (SOCK_STREAM, IPPROTO_SCTP), in a DTLS client connection using ctx, which
+// should come from NewDTLSCtx. On success the connection owns fd and puts it
+// in non-blocking mode; on failure fd is left to the caller. As with Client,
+// you are responsible for verifying the peer's hostname.
+func DTLSClientSCTP(fd int, ctx *Ctx) (*DTLSSCTPConn, error) {
+	c, err := newDTLSSCTPConn(fd, ctx)
+	if err != nil {
+		return nil, err
+	}
+	C.SSL_set_connect_state(c.ssl)
+	return c, nil
+}
+
+// DTLSServerSCTP is like DTLSClientSCTP for the server side of an
+// association, such as one accepted from a listening SCTP socket. ctx must
+// hold the server's certificate.
+func DTLSServerSCTP(fd int, ctx *Ctx) (*DTLSSCTPConn, error) {
+	c, err := newDTLSSCTPConn(fd, ctx)
+	if err != nil {
+		return nil, err
+	}
+	C.SSL_set_accept_state(c.ssl)
+	return c, nil
+}
+
+func newDTLSSCTPConn(fd int, ctx *Ctx) (*DTLSSCTPConn, error) {
+	if C.OUR_SCTP_supported() == 0 {
+		return nil, DTLSOverSCTPUnsupported
+	}
+	if ctx == nil {
+		return nil, errors.New("no ssl context provided")
+	}
+	ssl, err := newSSL(ctx)
+	if err != nil {
+		return nil, err
+	}
+	runtime.LockOSThread()
+	bio := C.OUR_BIO_new_dgram_sctp(C.int(fd))
+	if bio == nil {
+		err = fmt.Errorf("failed to set up SCTP BIO, is SCTP-AUTH "+
+			"enabled? %s", errorFromErrorQueue())
+	}
+	runtime.UnlockOSThread()
+	if err != nil {
+		freeSSL(ssl, ctx)
+		return nil, err
+	}
+	// the ssl object takes ownership of the BIO, for both directions
+	C.SSL_set_bio(ssl, bio, bio)
+	// SCTP keeps message boundaries, so records are read one at a time
+	C.SSL_set_read_ahead(ssl, 0)
+	// the os.File must come last, as its finalizer would close fd
+	err = syscall.SetNonblock(fd, true)
+	if err != nil {
+		freeSSL(ssl, ctx)
+		return nil, err
+	}
+	file := os.NewFile(uintptr(fd), "sctp")
+	raw, err := file.SyscallConn()
+	if err != nil {
+		freeSSL(ssl, ctx)
+		file.Close()
+		return nil, err
+	}
+	return &DTLSSCTPConn{
+		file: file,
+		raw:  raw,
+		ssl:  ssl,
+		ctx:  ctx}, nil
+}
+
+// step calls op, an SSL function on c.ssl, once, returning its result, or
+// the SSL error if it didn't succeed.
+func (c *DTLSSCTPConn) step(op func() C.int) (int, C.int, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.is_shutdown {
+		return 0, C.SSL_ERROR_NONE, dtlsClosed
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	rv := op()
+	if rv > 0 {
+		return int(rv), C.SSL_ERROR_NONE, nil
+	}
+	errcode := C.SSL_get_error(c.ssl, rv)
+	switch errcode {
+	case C.SSL_ERROR_WANT_READ, C.SSL_ERROR_WANT_WRITE:
+		return 0, errcode, nil
+	case C.SSL_ERROR_ZERO_RETURN:
+		return 0, errcode, io.EOF
+	case C.SSL_ERROR_SYSCALL:
+		if C.ERR_peek_error() == 0 {
+			return 0, errcode, errors.New("protocol-violating EOF")
+		}
+	}
+	return 0, errcode, errorFromErrorQueue()
+}
+
+// do calls op until it succeeds or fails, waiting for the socket as it asks
+// in between, until the file's deadlines.
+func (c *DTLSSCTPConn) do(op func() C.int) (int, error) {
+	var n int
+	var err error
+	errcode := C.int(C.SSL_ERROR_WANT_READ)
+	attempt := func(want C.int) func(uintptr) bool {
+		return func(uintptr) bool {
+			n, errcode, err = c.step(op)
+			return errcode != want
+		}
+	}
+	for {
+		var wait_err error
+		switch errcode {
+		case C.SSL_ERROR_WANT_READ:
+			wait_err = c.raw.Read(attempt(C.SSL_ERROR_WANT_READ))
+		case C.SSL_ERROR_WANT_WRITE:
+			wait_err = c.raw.Write(attempt(C.SSL_ERROR_WANT_WRITE))
+		default:
+			return n, err
+		}
+		if wait_err != nil {
+			return 0, wait_err
+		}
+	}
+}
+
+// Handshake performs the DTLS handshake, until the read deadline. If it is
+// not manually triggered, it will run before the first Read or Write.
+func (c *DTLSSCTPConn) Handshake() error {
+	_, err := c.do(func() C.int { return C.SSL_do_handshake(c.ssl) })
+	return err
+}
+
+// Read reads the next record into b, discarding whatever of it does not
+// fit.
+func (c *DTLSSCTPConn) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	return c.do(func() C.int {
+		return C.SSL_read(c.ssl, unsafe.Pointer(&b[0]), C.int(len(b)))
+	})
+}
+
+// Write sends b as a single record, which must fit in 16KB.
+func (c *DTLSSCTPConn) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	return c.do(func() C.int {
+		return C.SSL_write(c.ssl, unsafe.Pointer(&b[0]), C.int(len(b)))
+	})
+}
+
+// Close sends the peer a close_notify alert if the handshake completed, and
+// closes the socket.
+func (c *DTLSSCTPConn) Close() error {
+	c.mtx.Lock()
+	if c.is_shutdown {
+		c.mtx.Unlock()
+		return nil
+	}
+	c.is_shutdown = true
+	if C.SSL_is_init_finished_not_a_macro(c.ssl) == 1 {
+		C.SSL_shutdown(c.ssl)
+		C.ERR_clear_error()
+	}
+	freeSSL(c.ssl, c.ctx)
+	c.mtx.Unlock()
+	return c.file.Close()
+}
+
+// PeerCertificate returns the Certificate of the peer. Only valid after a
+// handshake.
+func (c *DTLSSCTPConn) PeerCertificate() (*Certificate, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.is_shutdown {
+		return nil, dtlsClosed
+	}
+	x := C.dtls_get_peer_certificate(c.ssl)
+	if x == nil {
+		return nil, errors.New("no peer certificate found")
+	}
+	return newCertificate(x), nil
+}
+
+// VerifyHostname pulls the PeerCertificate and calls VerifyHostname on the
+// certificate.
+func (c *DTLSSCTPConn) VerifyHostname(host string) error {
+	cert, err := c.PeerCertificate()
+	if err != nil {
+		return err
+	}
+	return cert.VerifyHostname(host)
+}
+
+// SetDeadline sets both the read and write deadlines.
+func (c *DTLSSCTPConn) SetDeadline(t time.Time) error {
+	return c.file.SetDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for waiting on the peer, in Read and
+// Handshake.
+func (c *DTLSSCTPConn) SetReadDeadline(t time.Time) error {
+	return c.file.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline for waiting on the socket to accept
+// more data.
+func (c *DTLSSCTPConn) SetWriteDeadline(t time.Time) error {
+	return c.file.SetWriteDeadline(t)
+}
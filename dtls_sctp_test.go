@@ -0,0 +1,133 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+// sctpPair returns the fds of both ends of an SCTP association over
+// loopback, skipping the test if the host has no SCTP.
+func sctpPair(t *testing.T) (client, server int) {
+	l, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM,
+		syscall.IPPROTO_SCTP)
+	if err != nil {
+		t.Skipf("SCTP not available: %v", err)
+	}
+	defer syscall.Close(l)
+	err = syscall.Bind(l, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}})
+	if err == nil {
+		err = syscall.Listen(l, 1)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := syscall.Getsockname(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err = syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM,
+		syscall.IPPROTO_SCTP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Connect(client, addr); err != nil {
+		syscall.Close(client)
+		t.Fatal(err)
+	}
+	server, _, err = syscall.Accept(l)
+	if err != nil {
+		syscall.Close(client)
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func TestDTLSOverSCTP(t *testing.T) {
+	client_ctx, err := NewDTLSCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = DTLSClientSCTP(-1, client_ctx)
+	if err == DTLSOverSCTPUnsupported {
+		t.Skip(err)
+	}
+	if err == nil {
+		t.Fatal("expected an error for an invalid socket")
+	}
+
+	client_fd, server_fd := sctpPair(t)
+	server_ctx, err := NewDTLSCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	useTestCertificate(t, server_ctx)
+	server, err := DTLSServerSCTP(server_fd, server_ctx)
+	if err != nil {
+		syscall.Close(client_fd)
+		syscall.Close(server_fd)
+		// BIO_new_dgram_sctp fails without SCTP-AUTH
+		t.Skip(err)
+	}
+	defer server.Close()
+	client, err := DTLSClientSCTP(client_fd, client_ctx)
+	if err != nil {
+		syscall.Close(client_fd)
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server.SetDeadline(time.Now().Add(10 * time.Second))
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, err := server.Read(buf)
+			if err != nil {
+				return
+			}
+			if _, err := server.Write(buf[:n]); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.PeerCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	// records keep their boundaries
+	for _, msg := range []string{"one", "two"} {
+		if _, err := client.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf := make([]byte, 2048)
+	for _, msg := range []string{"one", "two"} {
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != msg {
+			t.Fatalf("read %q, expected %q", buf[:n], msg)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestDTLSServer(t testing.TB) net.Listener {
+	ctx, err := NewDTLSCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	useTestCertificate(t, ctx)
+	l, err := ListenDTLS("udp", "127.0.0.1:0", ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// echoDTLS echoes each record of the next connection accepted from l.
+func echoDTLS(t testing.TB, l net.Listener, mtu int) {
+	conn, err := l.Accept()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+	if mtu > 0 {
+		if err := conn.(*DTLSConn).SetMTU(mtu); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	buf := make([]byte, 2048)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err := conn.Write(buf[:n]); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+}
+
+func TestDTLS(t *testing.T) {
+	l := newTestDTLSServer(t)
+	defer l.Close()
+	go echoDTLS(t, l, 0)
+
+	conn, err := DialDTLS("udp", l.Addr().String(), nil,
+		InsecureSkipHostVerification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.PeerCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	// records keep their boundaries
+	for _, msg := range []string{"one", "two"} {
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf := make([]byte, 2048)
+	for _, msg := range []string{"one", "two"} {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != msg {
+			t.Fatalf("read %q, expected %q", buf[:n], msg)
+		}
+	}
+}
+
+// lossyDTLSProxy relays datagrams between one client and server, dropping
+// the first one from the client.
+type lossyDTLSProxy struct {
+	pc     net.PacketConn
+	server net.Addr
+
+	mtx          sync.Mutex
+	dropped      bool
+	first_server []byte
+	largest      int
+}
+
+func (p *lossyDTLSProxy) run() {
+	var client net.Addr
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := p.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		p.mtx.Lock()
+		if n > p.largest {
+			p.largest = n
+		}
+		to := p.server
+		if addr.String() == p.server.String() {
+			to = client
+			if p.first_server == nil {
+				p.first_server = append([]byte(nil), buf[:n]...)
+			}
+		} else {
+			client = addr
+			if !p.dropped {
+				p.dropped = true
+				p.mtx.Unlock()
+				continue
+			}
+		}
+		p.mtx.Unlock()
+		p.pc.WriteTo(buf[:n], to)
+	}
+}
+
+func TestDTLSCookieRetransmitMTU(t *testing.T) {
+	l := newTestDTLSServer(t)
+	defer l.Close()
+	go echoDTLS(t, l, 512)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	proxy := &lossyDTLSProxy{pc: pc, server: l.Addr()}
+	go proxy.run()
+
+	udp, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, err := NewDTLSCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := DTLSClient(udp, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.SetMTU(512); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.SetMTU(100); err == nil {
+		t.Fatal("expected an error for a tiny MTU")
+	}
+	conn.SetDeadline(time.Now().Add(20 * time.Second))
+	// the dropped ClientHello is only answered once it is retransmitted
+	start := time.Now()
+	if err := conn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) < 500*time.Millisecond {
+		t.Fatal("handshake completed without retransmitting")
+	}
+	msg := bytes.Repeat([]byte("x"), 300)
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2048)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], msg) {
+		t.Fatal("echo mismatch")
+	}
+
+	proxy.mtx.Lock()
+	defer proxy.mtx.Unlock()
+	// a handshake record whose first message is a HelloVerifyRequest
+	first := proxy.first_server
+	if len(first) < 14 || first[0] != 22 || first[13] != 3 {
+		t.Fatalf("server did not start with a HelloVerifyRequest: %x",
+			first)
+	}
+	if proxy.largest > 512 {
+		t.Fatalf("sent a %d byte datagram over a 512 byte MTU",
+			proxy.largest)
+	}
+}
+
+func TestDTLSHandshakeDeadline(t *testing.T) {
+	// a server that never answers
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	hellos := make(chan struct{}, 16)
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			if _, _, err := pc.ReadFrom(buf); err != nil {
+				return
+			}
+			hellos <- struct{}{}
+		}
+	}()
+
+	udp, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, err := NewDTLSCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := DTLSClient(udp, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(1500 * time.Millisecond))
+	err = conn.Handshake()
+	net_err, ok := err.(net.Error)
+	if !ok || !net_err.Timeout() {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("handshake gave up after %v", elapsed)
+	}
+	time.Sleep(100 * time.Millisecond)
+	// the first retransmission is due a second in
+	if len(hellos) < 2 {
+		t.Fatalf("sent %d ClientHellos, expected a retransmission",
+			len(hellos))
+	}
+}
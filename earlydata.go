@@ -0,0 +1,264 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <stdint.h>
+#include <openssl/ssl.h>
+
+#if OPENSSL_VERSION_NUMBER < 0x10101000L
+#define SSL_EARLY_DATA_NOT_SENT 0
+#define SSL_EARLY_DATA_REJECTED 1
+#define SSL_EARLY_DATA_ACCEPTED 2
+#define SSL_READ_EARLY_DATA_ERROR 0
+#define SSL_READ_EARLY_DATA_SUCCESS 1
+#define SSL_READ_EARLY_DATA_FINISH 2
+#endif
+
+static int OUR_SSL_CTX_set_max_early_data(SSL_CTX *ctx, uint32_t max) {
+#if OPENSSL_VERSION_NUMBER >= 0x10101000L
+    return SSL_CTX_set_max_early_data(ctx, max);
+#else
+    return -1;
+#endif
+}
+
+static uint32_t OUR_SSL_get_session_max_early_data(SSL *ssl) {
+#if OPENSSL_VERSION_NUMBER >= 0x10101000L
+    SSL_SESSION *session = SSL_get_session(ssl);
+    return session == NULL ? 0 : SSL_SESSION_get_max_early_data(session);
+#else
+    return 0;
+#endif
+}
+
+static int OUR_SSL_write_early_data(SSL *ssl, const void *buf, size_t num,
+        size_t *written) {
+#if OPENSSL_VERSION_NUMBER >= 0x10101000L
+    return SSL_write_early_data(ssl, buf, num, written);
+#else
+    return -1;
+#endif
+}
+
+static int OUR_SSL_read_early_data(SSL *ssl, void *buf, size_t num,
+        size_t *readbytes) {
+#if OPENSSL_VERSION_NUMBER >= 0x10101000L
+    return SSL_read_early_data(ssl, buf, num, readbytes);
+#else
+    return -1;
+#endif
+}
+
+static int OUR_SSL_get_early_data_status(const SSL *ssl) {
+#if OPENSSL_VERSION_NUMBER >= 0x10101000L
+    return SSL_get_early_data_status(ssl);
+#else
+    return SSL_EARLY_DATA_NOT_SENT;
+#endif
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"unsafe"
+)
+
+var (
+	// EarlyDataUnavailable is returned by WriteEarlyData when the client
+	// connection has no session to resume that the server allowed early
+	// data on. Send the data with Write instead.
+	EarlyDataUnavailable = errors.New(
+		"openssl: session does not allow early data")
+)
+
+// EarlyDataStatus says what became of TLS 1.3 early data (0-RTT) on a
+// connection.
+type EarlyDataStatus int
+
+const (
+	// EarlyDataNotSent means the client sent no early data, or the handshake
+	// has yet to say whether the server accepted it.
+	EarlyDataNotSent EarlyDataStatus = C.SSL_EARLY_DATA_NOT_SENT
+	// EarlyDataRejected means the server discarded the client's early data.
+	// The connection carries on as if it had never been sent, so the client
+	// must send it again with Write if it still wants to.
+	EarlyDataRejected EarlyDataStatus = C.SSL_EARLY_DATA_REJECTED
+	// EarlyDataAccepted means the server received the client's early data.
+	EarlyDataAccepted EarlyDataStatus = C.SSL_EARLY_DATA_ACCEPTED
+)
+
+func (s EarlyDataStatus) String() string {
+	switch s {
+	case EarlyDataNotSent:
+		return "not sent"
+	case EarlyDataRejected:
+		return "rejected"
+	case EarlyDataAccepted:
+		return "accepted"
+	}
+	return fmt.Sprintf("EarlyDataStatus(%d)", int(s))
+}
+
+// SetMaxEarlyData sets how many bytes of early data servers using the
+// context accept from clients resuming TLS 1.3 sessions, and tells clients
+// through the session tickets they are issued. It is 0, accepting none, by
+// default. Servers only accept early data on connections that read it with
+// Conn.ReadEarlyData.
+//
+// Early data isn't protected against replay: an attacker can record it and
+// send it again on another connection. OpenSSL accepts early data only once
+// per session as long as the server's internal session cache is on, but
+// that can't cover other servers sharing the ticket keys, nor a restarted
+// one. Only act on early data that is safe to repeat, such as idempotent
+// requests, and leave anything else until the handshake has completed.
+func (c *Ctx) SetMaxEarlyData(max uint32) error {
+	switch C.OUR_SSL_CTX_set_max_early_data(c.ctx, C.uint32_t(max)) {
+	case 1:
+		return nil
+	case -1:
+		return tls13Unsupported
+	default:
+		return errorFromErrorQueue()
+	}
+}
+
+// WriteEarlyData sends b as TLS 1.3 early data along with the ClientHello of
+// a client connection resuming a session, before the handshake has
+// completed, saving the server's response a round trip. Call it before the
+// handshake, after SetSession or SetSessionKey; it returns
+// EarlyDataUnavailable if the session doesn't allow early data, or not
+// enough of it. It may be called several times, but all writes must come
+// before Handshake, Read or Write.
+//
+// The server may reject early data, which then must be sent again: check
+// EarlyDataStatus once the handshake has completed. See
+// Ctx.SetMaxEarlyData for the replay risks.
+func (c *Conn) WriteEarlyData(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	c.mtx.Lock()
+	if c.is_shutdown {
+		c.mtx.Unlock()
+		return 0, errors.New("connection closed")
+	}
+	if uint64(C.OUR_SSL_get_session_max_early_data(c.ssl)) <
+		uint64(len(b)) {
+		c.mtx.Unlock()
+		return 0, EarlyDataUnavailable
+	}
+	runtime.LockOSThread()
+	var written C.size_t
+	rv := C.OUR_SSL_write_early_data(c.ssl, unsafe.Pointer(&b[0]),
+		C.size_t(len(b)), &written)
+	var err error
+	if rv < 0 {
+		err = tls13Unsupported
+	} else if rv != 1 {
+		err = errorFromErrorQueue()
+	}
+	if err == nil {
+		c.early_data_sent = true
+	}
+	runtime.UnlockOSThread()
+	c.mtx.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return int(written), c.flushOutputBuffer()
+}
+
+// finishEarlyData completes the handshake of a client connection that wrote
+// early data. OpenSSL's client only sends EndOfEarlyData and its Finished
+// from SSL_do_handshake or SSL_write, so under SSL_read it would wait on a
+// server that is waiting on it.
+func (c *Conn) finishEarlyData() error {
+	c.mtx.Lock()
+	pending := c.early_data_sent && !c.handshake_done
+	c.mtx.Unlock()
+	if !pending {
+		return nil
+	}
+	return c.Handshake()
+}
+
+func (c *Conn) readEarlyData(b []byte) (int, func() error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.is_shutdown || c.early_data_done {
+		return 0, func() error { return io.EOF }
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	var readbytes C.size_t
+	rv, errno := C.OUR_SSL_read_early_data(c.ssl, unsafe.Pointer(&b[0]),
+		C.size_t(len(b)), &readbytes)
+	switch rv {
+	case -1:
+		return 0, func() error { return tls13Unsupported }
+	case C.SSL_READ_EARLY_DATA_ERROR:
+		return 0, c.getErrorHandler(rv, errno)
+	case C.SSL_READ_EARLY_DATA_FINISH:
+		c.early_data_done = true
+		if readbytes == 0 {
+			return 0, func() error { return io.EOF }
+		}
+	}
+	if readbytes == 0 {
+		return 0, func() error { return tryAgain }
+	}
+	return int(readbytes), nil
+}
+
+// ReadEarlyData reads the TLS 1.3 early data a client sent on a server
+// connection, which is where its handshake should start if the context
+// accepts early data, see Ctx.SetMaxEarlyData. It returns io.EOF once there
+// is no more, whether the client sent none, the server rejected it, or it
+// has all been read, after which the handshake carries on as usual with
+// Handshake, Read or Write. Handshakes started without ReadEarlyData reject
+// early data. See Ctx.SetMaxEarlyData for the replay risks.
+func (c *Conn) ReadEarlyData(b []byte) (n int, err error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	err = tryAgain
+	for err == tryAgain {
+		n, errcb := c.readEarlyData(b)
+		err = c.handleError(errcb)
+		if err == nil {
+			c.flushOutputBufferAsync()
+			return n, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+	}
+	return 0, err
+}
+
+// EarlyDataStatus reports whether the server accepted the client's early
+// data. It is only meaningful once the handshake has completed.
+func (c *Conn) EarlyDataStatus() EarlyDataStatus {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return EarlyDataStatus(C.OUR_SSL_get_early_data_status(c.ssl))
+}
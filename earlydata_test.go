@@ -0,0 +1,145 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestEarlyData(t *testing.T) {
+	server_ctx := newTestServerCtx(t)
+	err := server_ctx.SetMaxEarlyData(1024)
+	if err == tls13Unsupported {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	client_ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// connect resumes session, if any, sending early as early data, and
+	// returns the client's next session, the early data the server read and
+	// what each side made of it
+	connect := func(server_ctx *Ctx, session []byte, early string) (
+		next []byte, got string, client_status, server_status EarlyDataStatus) {
+		server_conn, client_conn := NetPipe(t)
+		defer server_conn.Close()
+		defer client_conn.Close()
+		server_conn.SetDeadline(time.Now().Add(10 * time.Second))
+		client_conn.SetDeadline(time.Now().Add(10 * time.Second))
+		server, err := Server(server_conn, server_ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+		client, err := Client(client_conn, client_ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+
+		var early_buf bytes.Buffer
+		errs := make(chan error, 1)
+		go func() {
+			buf := make([]byte, 16)
+			for {
+				n, err := server.ReadEarlyData(buf)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+				early_buf.Write(buf[:n])
+			}
+			_, err := server.Write([]byte("hi"))
+			errs <- err
+		}()
+		if session != nil {
+			if err := client.SetSession(session); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if early != "" {
+			if _, err := client.WriteEarlyData([]byte(early)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// the ticket arrives ahead of the data in TLS 1.3
+		buf := make([]byte, 2)
+		if _, err := io.ReadFull(client, buf); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+		next, err = client.GetSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return next, early_buf.String(), client.EarlyDataStatus(),
+			server.EarlyDataStatus()
+	}
+
+	session, _, status, _ := connect(server_ctx, nil, "")
+	if status != EarlyDataNotSent {
+		t.Fatalf("expected no early data, got %v", status)
+	}
+	_, got, client_status, server_status := connect(server_ctx, session,
+		"early")
+	if got != "early" {
+		t.Fatalf("server read early data %q", got)
+	}
+	if client_status != EarlyDataAccepted ||
+		server_status != EarlyDataAccepted {
+		t.Fatalf("expected early data to be accepted, client says %v, "+
+			"server says %v", client_status, server_status)
+	}
+
+	// the server's session cache catches the replay
+	_, got, client_status, server_status = connect(server_ctx, session,
+		"early")
+	if got != "" {
+		t.Fatalf("server read replayed early data %q", got)
+	}
+	if client_status != EarlyDataRejected ||
+		server_status != EarlyDataRejected {
+		t.Fatalf("expected early data to be rejected, client says %v, "+
+			"server says %v", client_status, server_status)
+	}
+
+	// sessions from servers not accepting early data can't carry it
+	session, _, _, _ = connect(newTestServerCtx(t), nil, "")
+	client, err := Client(nil, client_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetSession(session); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.WriteEarlyData([]byte("early")); err !=
+		EarlyDataUnavailable {
+		t.Fatalf("expected EarlyDataUnavailable, got %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <openssl/ec.h>
+#include <openssl/evp.h>
+
+static EVP_PKEY *OUR_EC_generate(int nid) {
+    EVP_PKEY *key = NULL;
+    EVP_PKEY_CTX *ctx = EVP_PKEY_CTX_new_id(EVP_PKEY_EC, NULL);
+    if (ctx == NULL)
+        return NULL;
+    if (EVP_PKEY_keygen_init(ctx) <= 0)
+        goto end;
+    if (EVP_PKEY_CTX_set_ec_paramgen_curve_nid(ctx, nid) <= 0)
+        goto end;
+    // so that the key is written out with the curve's name, as for
+    // certificates, rather than its parameters
+    if (EVP_PKEY_CTX_set_ec_param_enc(ctx, OPENSSL_EC_NAMED_CURVE) <= 0)
+        goto end;
+    if (EVP_PKEY_keygen(ctx, &key) <= 0)
+        key = NULL;
+end:
+    EVP_PKEY_CTX_free(ctx);
+    return key;
+}
+*/
+import "C"
+
+import (
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	"runtime"
+)
+
+// GenerateECKey generates a new EC key on curve. Its ECDSA signatures are
+// made with SignDigest, as ASN.1, or SignECDSA, as r and s.
+func GenerateECKey(curve EllipticCurve) (PrivateKey, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	key := C.OUR_EC_generate(C.int(curve))
+	if key == nil {
+		return nil, errorFromErrorQueue()
+	}
+	return newPKey(key), nil
+}
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// SignECDSA signs hashed, a message digest, with the EC key key, returning
+// the signature as the integers r and s rather than ASN.1, for formats such
+// as JWS that encode them themselves.
+func SignECDSA(key PrivateKey, hashed []byte) (r, s *big.Int, err error) {
+	key_type, err := key.KeyType()
+	if err != nil {
+		return nil, nil, err
+	}
+	if key_type != KeyTypeEC {
+		return nil, nil, errors.New("ECDSA requires an EC key")
+	}
+	der, err := key.SignDigest(nil, hashed, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	var sig ecdsaSignature
+	rest, err := asn1.Unmarshal(der, &sig)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(rest) > 0 {
+		return nil, nil, errors.New("trailing data after ECDSA signature")
+	}
+	return sig.R, sig.S, nil
+}
+
+// VerifyECDSA checks the ECDSA signature r and s over hashed, a message
+// digest, with the EC key key.
+func VerifyECDSA(key PublicKey, hashed []byte, r, s *big.Int) error {
+	if r == nil || s == nil || r.Sign() <= 0 || s.Sign() <= 0 {
+		return errors.New("verify: invalid signature")
+	}
+	der, err := asn1.Marshal(ecdsaSignature{R: r, S: s})
+	if err != nil {
+		return err
+	}
+	return key.VerifyDigest(nil, hashed, der, nil)
+}
@@ -0,0 +1,80 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"math/big"
+	"testing"
+)
+
+func TestGenerateECKey(t *testing.T) {
+	curves := []struct {
+		curve EllipticCurve
+		name  string
+		bits  int
+	}{
+		{Prime256v1, "prime256v1", 256},
+		{Secp384r1, "secp384r1", 384},
+		{Secp521r1, "secp521r1", 521},
+	}
+	hashed := sha256.Sum256([]byte("token"))
+	for _, c := range curves {
+		key, err := GenerateECKey(c.curve)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name, err := key.CurveName(); err != nil || name != c.name {
+			t.Fatalf("expected curve %s, got %q (%v)", c.name, name, err)
+		}
+		if bits, err := key.Bits(); err != nil || bits != c.bits {
+			t.Fatalf("expected %d bits, got %d (%v)", c.bits, bits, err)
+		}
+		std, err := ToStdlibPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub := &std.(*ecdsa.PrivateKey).PublicKey
+
+		sig, err := key.SignDigest(nil, hashed[:], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ecdsa.VerifyASN1(pub, hashed[:], sig) {
+			t.Fatalf("%s: expected the ASN.1 signature to verify", c.name)
+		}
+
+		r, s, err := SignECDSA(key, hashed[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ecdsa.Verify(pub, hashed[:], r, s) {
+			t.Fatalf("%s: expected r and s to verify", c.name)
+		}
+		if err := VerifyECDSA(key, hashed[:], r, s); err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifyECDSA(key, hashed[:], r,
+			new(big.Int).Add(s, big.NewInt(1))); err == nil {
+			t.Fatalf("%s: expected a bad signature to fail", c.name)
+		}
+	}
+	if _, _, err := SignECDSA(generateTestRSAKey(t), hashed[:]); err == nil {
+		t.Fatal("expected ECDSA with an RSA key to fail")
+	}
+}
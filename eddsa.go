@@ -0,0 +1,152 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <openssl/err.h>
+#include <openssl/evp.h>
+
+extern int OUR_EVP_DigestSign_oneshot(EVP_PKEY *pkey,
+    const unsigned char *tbs, size_t tbslen,
+    unsigned char *sig, size_t *siglen);
+
+static EVP_PKEY *OUR_EVP_PKEY_keygen(int type) {
+    EVP_PKEY *key = NULL;
+    EVP_PKEY_CTX *ctx = EVP_PKEY_CTX_new_id(type, NULL);
+    if (ctx == NULL)
+        return NULL;
+    if (EVP_PKEY_keygen_init(ctx) <= 0 || EVP_PKEY_keygen(ctx, &key) <= 0)
+        key = NULL;
+    EVP_PKEY_CTX_free(ctx);
+    return key;
+}
+
+static int OUR_EVP_DigestVerify_oneshot(EVP_PKEY *pkey,
+    const unsigned char *sig, size_t siglen,
+    const unsigned char *tbs, size_t tbslen) {
+#if OPENSSL_VERSION_NUMBER >= 0x10101000L
+    int ret = 0;
+    EVP_MD_CTX *ctx = EVP_MD_CTX_new();
+    if (ctx == NULL)
+        return 0;
+    if (EVP_DigestVerifyInit(ctx, NULL, NULL, NULL, pkey) == 1)
+        ret = EVP_DigestVerify(ctx, sig, siglen, tbs, tbslen);
+    EVP_MD_CTX_free(ctx);
+    return ret;
+#else
+    return 0;
+#endif
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"runtime"
+	"unsafe"
+)
+
+// isEdDSAKey reports whether key is an Ed25519 or Ed448 key.
+func isEdDSAKey(key PublicKey) bool {
+	key_type, err := key.KeyType()
+	// the types are 0 if the linked OpenSSL doesn't know them
+	return err == nil && key_type != 0 &&
+		(key_type == KeyTypeEd25519 || key_type == KeyTypeEd448)
+}
+
+// generateKey generates a key of a type that needs no parameters, such as
+// Ed25519 or X25519. EC keys are generated with GenerateECKey.
+func generateKey(key_type KeyType) (PrivateKey, error) {
+	if key_type == 0 {
+		return nil, errors.New("key type not supported by this version of " +
+			"OpenSSL")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	key := C.OUR_EVP_PKEY_keygen(C.int(key_type))
+	if key == nil {
+		return nil, errorFromErrorQueue()
+	}
+	return newPKey(key), nil
+}
+
+// GenerateEd25519Key generates a new Ed25519 key. It requires OpenSSL 1.1.1.
+func GenerateEd25519Key() (PrivateKey, error) {
+	return generateKey(KeyTypeEd25519)
+}
+
+// GenerateEd448Key generates a new Ed448 key. It requires OpenSSL 1.1.1.
+func GenerateEd448Key() (PrivateKey, error) {
+	return generateKey(KeyTypeEd448)
+}
+
+// SignEdDSA signs message, which isn't hashed first, with the Ed25519 or
+// Ed448 key key.
+func SignEdDSA(key PrivateKey, message []byte) ([]byte, error) {
+	if !isEdDSAKey(key) {
+		return nil, errors.New("EdDSA requires an Ed25519 or Ed448 key")
+	}
+	pkey := key.acquirePKey()
+	if pkey == nil {
+		return nil, keyFreed
+	}
+	defer C.EVP_PKEY_free(pkey)
+	sig := make([]byte, C.EVP_PKEY_size(pkey))
+	siglen := C.size_t(len(sig))
+	var tbs *C.uchar
+	if len(message) > 0 {
+		tbs = (*C.uchar)(unsafe.Pointer(&message[0]))
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.OUR_EVP_DigestSign_oneshot(pkey, tbs, C.size_t(len(message)),
+		(*C.uchar)(&sig[0]), &siglen) != 1 {
+		return nil, errorFromErrorQueue()
+	}
+	return sig[:siglen], nil
+}
+
+// VerifyEdDSA checks the signature sig over message with the Ed25519 or
+// Ed448 key key.
+func VerifyEdDSA(key PublicKey, message, sig []byte) error {
+	if !isEdDSAKey(key) {
+		return errors.New("EdDSA requires an Ed25519 or Ed448 key")
+	}
+	if len(sig) == 0 {
+		return errors.New("verify: invalid signature")
+	}
+	pkey := key.acquirePKey()
+	if pkey == nil {
+		return keyFreed
+	}
+	defer C.EVP_PKEY_free(pkey)
+	var tbs *C.uchar
+	if len(message) > 0 {
+		tbs = (*C.uchar)(unsafe.Pointer(&message[0]))
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.OUR_EVP_DigestVerify_oneshot(pkey,
+		(*C.uchar)(unsafe.Pointer(&sig[0])), C.size_t(len(sig)), tbs,
+		C.size_t(len(message))) != 1 {
+		C.ERR_clear_error()
+		return errors.New("verify: invalid signature")
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+	"time"
+)
+
+func TestEdDSAKeys(t *testing.T) {
+	generators := []struct {
+		key_type KeyType
+		generate func() (PrivateKey, error)
+	}{
+		{KeyTypeEd25519, GenerateEd25519Key},
+		{KeyTypeEd448, GenerateEd448Key},
+	}
+	msg := []byte("a short-lived token")
+	for _, g := range generators {
+		key, err := g.generate()
+		if err != nil {
+			t.Skip(err)
+		}
+		if key_type, err := key.KeyType(); err != nil ||
+			key_type != g.key_type {
+			t.Fatalf("expected a %v key, got %v (%v)", g.key_type,
+				key_type, err)
+		}
+		sig, err := SignEdDSA(key, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pem_block, err := key.MarshalPKCS8PrivateKeyPEM()
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := LoadPrivateKeyFromPEM(pem_block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := key.MarshalPKCS8PrivateKeyDER()
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded_der, err := loaded.MarshalPKCS8PrivateKeyDER()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(der, loaded_der) {
+			t.Fatalf("%v: expected the PEM round trip to keep the key",
+				g.key_type)
+		}
+		if _, err := LoadPrivateKeyFromDER(der); err != nil {
+			t.Fatal(err)
+		}
+
+		pub_pem, err := key.MarshalPKIXPublicKeyPEM()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub, err := LoadPublicKeyFromPEM(pub_pem)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifyEdDSA(pub, msg, sig); err != nil {
+			t.Fatal(err)
+		}
+		pub_der, err := key.MarshalPKIXPublicKeyDER()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pub, err = LoadPublicKeyFromDER(pub_der); err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifyEdDSA(pub, []byte("another token"), sig); err == nil {
+			t.Fatalf("%v: expected a different message to fail", g.key_type)
+		}
+	}
+
+	if _, err := SignEdDSA(generateTestRSAKey(t), msg); err == nil {
+		t.Fatal("expected EdDSA with an RSA key to fail")
+	}
+}
+
+func TestEd25519Stdlib(t *testing.T) {
+	key, err := GenerateEd25519Key()
+	if err != nil {
+		t.Skip(err)
+	}
+	msg := []byte("hello")
+	sig, err := SignEdDSA(key, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	std, err := ToStdlibPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	std_key := std.(ed25519.PrivateKey)
+	if !ed25519.Verify(std_key.Public().(ed25519.PublicKey), msg, sig) {
+		t.Fatal("expected the signature to verify with crypto/ed25519")
+	}
+	if !bytes.Equal(sig, ed25519.Sign(std_key, msg)) {
+		t.Fatal("expected the deterministic signatures to match")
+	}
+}
+
+func TestEdDSACertificate(t *testing.T) {
+	for _, generate := range []func() (PrivateKey, error){
+		GenerateEd25519Key, GenerateEd448Key} {
+		key, err := generate()
+		if err != nil {
+			t.Skip(err)
+		}
+		cert := issueTestCert(t, key, testCert{})
+		server_ctx := newSharedCtx(t, key, cert, cert)
+		client_ctx, err := NewCtx()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := client_ctx.GetCertificateStore().AddCertificate(
+			cert); err != nil {
+			t.Fatal(err)
+		}
+		client_ctx.SetVerifyMode(VerifyPeer)
+
+		server_conn, client_conn := NetPipe(t)
+		server_conn.SetDeadline(time.Now().Add(10 * time.Second))
+		client_conn.SetDeadline(time.Now().Add(10 * time.Second))
+		server, err := Server(server_conn, server_ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := Client(client_conn, client_ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server_err := make(chan error, 1)
+		go func() { server_err <- server.Handshake() }()
+		if err := client.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-server_err; err != nil {
+			t.Fatal(err)
+		}
+		peer, err := client.PeerCertificate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		peer_key, err := peer.PublicKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isEdDSAKey(peer_key) {
+			t.Fatal("expected the peer to present an EdDSA certificate")
+		}
+		close_both(server, client)
+	}
+}
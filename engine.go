@@ -17,11 +17,123 @@
 package openssl
 
 /*
-#include "openssl/engine.h"
+#include <stdlib.h>
+#include <openssl/crypto.h>
+#include <openssl/evp.h>
+
+// BoringSSL keeps only the ENGINE type, and builds of OpenSSL and LibreSSL
+// may leave engines out altogether
+#if !defined(OPENSSL_NO_ENGINE) && !defined(OPENSSL_IS_BORINGSSL)
+#include <openssl/engine.h>
+#define HAVE_ENGINE 1
+#else
+#define ENGINE_METHOD_RSA 0x0001
+#define ENGINE_METHOD_DSA 0x0002
+#define ENGINE_METHOD_DH 0x0004
+#define ENGINE_METHOD_RAND 0x0008
+#define ENGINE_METHOD_CIPHERS 0x0040
+#define ENGINE_METHOD_DIGESTS 0x0080
+#define ENGINE_METHOD_PKEY_METHS 0x0200
+#define ENGINE_METHOD_ALL 0xFFFF
+#endif
+
+static int OUR_engines_supported() {
+#ifdef HAVE_ENGINE
+    return 1;
+#else
+    return 0;
+#endif
+}
+
+static ENGINE *OUR_ENGINE_by_id(const char *id) {
+#ifdef HAVE_ENGINE
+    return ENGINE_by_id(id);
+#else
+    return NULL;
+#endif
+}
+
+static int OUR_ENGINE_init(ENGINE *e) {
+#ifdef HAVE_ENGINE
+    return ENGINE_init(e);
+#else
+    return 0;
+#endif
+}
+
+static void OUR_ENGINE_finish(ENGINE *e) {
+#ifdef HAVE_ENGINE
+    ENGINE_finish(e);
+#endif
+}
+
+static void OUR_ENGINE_free(ENGINE *e) {
+#ifdef HAVE_ENGINE
+    ENGINE_free(e);
+#endif
+}
+
+static int OUR_ENGINE_ctrl_cmd_string(ENGINE *e, const char *name,
+        const char *value) {
+#ifdef HAVE_ENGINE
+    return ENGINE_ctrl_cmd_string(e, name, value, 0);
+#else
+    return 0;
+#endif
+}
+
+static const char *OUR_ENGINE_get_id(ENGINE *e) {
+#ifdef HAVE_ENGINE
+    return ENGINE_get_id(e);
+#else
+    return NULL;
+#endif
+}
+
+static const char *OUR_ENGINE_get_name(ENGINE *e) {
+#ifdef HAVE_ENGINE
+    return ENGINE_get_name(e);
+#else
+    return NULL;
+#endif
+}
+
+static int OUR_ENGINE_set_default(ENGINE *e, unsigned int methods) {
+#ifdef HAVE_ENGINE
+    return ENGINE_set_default(e, methods);
+#else
+    return 0;
+#endif
+}
+
+static int OUR_ENGINE_set_default_string(ENGINE *e, const char *methods) {
+#ifdef HAVE_ENGINE
+    return ENGINE_set_default_string(e, methods);
+#else
+    return 0;
+#endif
+}
+
+static EVP_PKEY *OUR_ENGINE_load_private_key(ENGINE *e, const char *key_id) {
+#ifdef HAVE_ENGINE
+    return ENGINE_load_private_key(e, key_id, NULL, NULL);
+#else
+    return NULL;
+#endif
+}
+
+static EVP_PKEY *OUR_ENGINE_load_public_key(ENGINE *e, const char *key_id) {
+#ifdef HAVE_ENGINE
+    return ENGINE_load_public_key(e, key_id, NULL, NULL);
+#else
+    return NULL;
+#endif
+}
 */
 import "C"
 
 import (
+	"errors"
 	"fmt"
 	"runtime"
 	"unsafe"
@@ -31,22 +143,204 @@ type Engine struct {
 	e *C.ENGINE
 }
 
+// EngineCommand is a control command sent to an engine, as found in the
+// engine sections of openssl.cnf. Value is empty for commands that take no
+// input, such as LOAD.
+type EngineCommand struct {
+	Name  string
+	Value string
+}
+
+// EngineMethod selects the algorithms an engine is made the default for.
+type EngineMethod int
+
+const (
+	EngineMethodRSA       EngineMethod = C.ENGINE_METHOD_RSA
+	EngineMethodDSA       EngineMethod = C.ENGINE_METHOD_DSA
+	EngineMethodDH        EngineMethod = C.ENGINE_METHOD_DH
+	EngineMethodRAND      EngineMethod = C.ENGINE_METHOD_RAND
+	EngineMethodCiphers   EngineMethod = C.ENGINE_METHOD_CIPHERS
+	EngineMethodDigests   EngineMethod = C.ENGINE_METHOD_DIGESTS
+	EngineMethodPKeyMeths EngineMethod = C.ENGINE_METHOD_PKEY_METHS
+	EngineMethodAll       EngineMethod = C.ENGINE_METHOD_ALL
+)
+
+var errEnginesUnsupported = errors.New(
+	"engines are not supported by the linked library")
+
+// EnginesSupported reports whether engines can be loaded. BoringSSL has no
+// engines, and OpenSSL and LibreSSL may be built without them; EngineById
+// and LoadDynamicEngine then always fail.
+func EnginesSupported() bool {
+	return C.OUR_engines_supported() == 1
+}
+
 func EngineById(name string) (*Engine, error) {
+	if !EnginesSupported() {
+		return nil, errEnginesUnsupported
+	}
 	cname := C.CString(name)
 	defer C.free(unsafe.Pointer(cname))
-	e := &Engine{
-		e: C.ENGINE_by_id(cname),
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	e := C.OUR_ENGINE_by_id(cname)
+	if e == nil {
+		return nil, fmt.Errorf("engine %s missing: %s", name,
+			errorFromErrorQueue())
 	}
-	if e.e == nil {
-		return nil, fmt.Errorf("engine %s missing", name)
+	return initEngine(e, name)
+}
+
+// LoadDynamicEngine loads the engine with the given id from the shared
+// library at path, through OpenSSL's dynamic engine, as an engine section of
+// openssl.cnf with a dynamic_path would. Engines installed in OpenSSL's
+// engines directory can instead be loaded by name with EngineById. cmds are
+// sent to the loaded engine before it is initialized, which is where engines
+// such as pkcs11 expect settings like MODULE_PATH or PIN.
+func LoadDynamicEngine(path, id string, cmds ...EngineCommand) (
+	*Engine, error) {
+	if !EnginesSupported() {
+		return nil, errEnginesUnsupported
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	cdynamic := C.CString("dynamic")
+	defer C.free(unsafe.Pointer(cdynamic))
+	e := C.OUR_ENGINE_by_id(cdynamic)
+	if e == nil {
+		return nil, fmt.Errorf("dynamic engine missing: %s",
+			errorFromErrorQueue())
 	}
-	if C.ENGINE_init(e.e) == 0 {
-		C.ENGINE_free(e.e)
-		return nil, fmt.Errorf("engine %s not initialized", name)
+	pre := []EngineCommand{
+		{Name: "SO_PATH", Value: path},
+		{Name: "ID", Value: id},
+		{Name: "LIST_ADD", Value: "1"},
+		{Name: "LOAD"},
 	}
-	runtime.SetFinalizer(e, func(e *Engine) {
-		C.ENGINE_finish(e.e)
-		C.ENGINE_free(e.e)
+	for _, cmd := range append(pre, cmds...) {
+		if err := engineCtrl(e, cmd); err != nil {
+			C.OUR_ENGINE_free(e)
+			return nil, fmt.Errorf("engine %s: %s: %s", id, cmd.Name, err)
+		}
+	}
+	return initEngine(e, id)
+}
+
+// initEngine takes over the structural reference e, adding the functional
+// one needed to use it. The calling goroutine must be locked to its thread.
+func initEngine(e *C.ENGINE, name string) (*Engine, error) {
+	if C.OUR_ENGINE_init(e) == 0 {
+		C.OUR_ENGINE_free(e)
+		return nil, fmt.Errorf("engine %s not initialized: %s", name,
+			errorFromErrorQueue())
+	}
+	engine := &Engine{e: e}
+	runtime.SetFinalizer(engine, func(e *Engine) {
+		C.OUR_ENGINE_finish(e.e)
+		C.OUR_ENGINE_free(e.e)
 	})
-	return e, nil
+	return engine, nil
+}
+
+func engineCtrl(e *C.ENGINE, cmd EngineCommand) error {
+	cname := C.CString(cmd.Name)
+	defer C.free(unsafe.Pointer(cname))
+	var cvalue *C.char
+	if cmd.Value != "" {
+		cvalue = C.CString(cmd.Value)
+		defer C.free(unsafe.Pointer(cvalue))
+	}
+	if C.OUR_ENGINE_ctrl_cmd_string(e, cname, cvalue) != 1 {
+		return errorFromErrorQueue()
+	}
+	return nil
+}
+
+// ID returns the engine's short name, as passed to EngineById.
+func (e *Engine) ID() string {
+	defer runtime.KeepAlive(e)
+	return C.GoString(C.OUR_ENGINE_get_id(e.e))
+}
+
+// Name returns the engine's human readable description.
+func (e *Engine) Name() string {
+	defer runtime.KeepAlive(e)
+	return C.GoString(C.OUR_ENGINE_get_name(e.e))
+}
+
+// Ctrl sends a control command to an initialized engine.
+func (e *Engine) Ctrl(cmd EngineCommand) error {
+	defer runtime.KeepAlive(e)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	return engineCtrl(e.e, cmd)
+}
+
+// SetDefault makes the engine the implementation OpenSSL uses, process wide,
+// for the algorithms it provides among those selected by methods.
+func (e *Engine) SetDefault(methods EngineMethod) error {
+	defer runtime.KeepAlive(e)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.OUR_ENGINE_set_default(e.e, C.uint(methods)) != 1 {
+		return errorFromErrorQueue()
+	}
+	return nil
+}
+
+// SetDefaultString is SetDefault with the methods given as in the
+// default_algorithms setting of openssl.cnf, e.g. "RSA,CIPHERS" or "ALL".
+func (e *Engine) SetDefaultString(methods string) error {
+	defer runtime.KeepAlive(e)
+	cmethods := C.CString(methods)
+	defer C.free(unsafe.Pointer(cmethods))
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.OUR_ENGINE_set_default_string(e.e, cmethods) != 1 {
+		return errorFromErrorQueue()
+	}
+	return nil
+}
+
+// LoadPrivateKey asks the engine for the private key named by key_id, whose
+// format is engine specific (a PKCS#11 URI for the pkcs11 engine, say). The
+// key material usually never leaves the engine; operations on the returned
+// key are performed by it.
+func (e *Engine) LoadPrivateKey(key_id string) (PrivateKey, error) {
+	defer runtime.KeepAlive(e)
+	ckey_id := C.CString(key_id)
+	defer C.free(unsafe.Pointer(ckey_id))
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	key := C.OUR_ENGINE_load_private_key(e.e, ckey_id)
+	if key == nil {
+		return nil, errorFromErrorQueue()
+	}
+	return newPKey(key), nil
+}
+
+// LoadPublicKey asks the engine for the public key named by key_id, as
+// LoadPrivateKey does for private keys.
+func (e *Engine) LoadPublicKey(key_id string) (PublicKey, error) {
+	defer runtime.KeepAlive(e)
+	ckey_id := C.CString(key_id)
+	defer C.free(unsafe.Pointer(ckey_id))
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	key := C.OUR_ENGINE_load_public_key(e.e, ckey_id)
+	if key == nil {
+		return nil, errorFromErrorQueue()
+	}
+	return newPKey(key), nil
+}
+
+// UseEnginePrivateKey loads the private key named by key_id from the engine
+// and uses it for the context's certificate, so TLS handshakes are signed by
+// the engine without the key entering Go memory.
+func (c *Ctx) UseEnginePrivateKey(e *Engine, key_id string) error {
+	key, err := e.LoadPrivateKey(key_id)
+	if err != nil {
+		return err
+	}
+	return c.UsePrivateKey(key)
 }
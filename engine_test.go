@@ -0,0 +1,87 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+// testEnginesDir returns the directory the openssl CLI looks for engines in.
+func testEnginesDir(t *testing.T) string {
+	out, err := exec.Command("openssl", "version", "-e").Output()
+	if err != nil {
+		t.Skip(err)
+	}
+	m := regexp.MustCompile(`ENGINESDIR: "(.*)"`).FindSubmatch(out)
+	if m == nil {
+		t.Skipf("no engines directory in %q", out)
+	}
+	return string(m[1])
+}
+
+func TestDynamicEngine(t *testing.T) {
+	if !EnginesSupported() {
+		if _, err := EngineById("dynamic"); err == nil {
+			t.Fatal("expected an error loading an engine")
+		}
+		t.Skip("engines not supported")
+	}
+	_, err := LoadDynamicEngine("/nonexistent/engine.so", "nonexistent")
+	if err == nil {
+		t.Fatal("expected an error loading a missing engine")
+	}
+
+	// loader_attic ships with OpenSSL 3.0
+	e, err := LoadDynamicEngine(
+		filepath.Join(testEnginesDir(t), "loader_attic.so"), "loader_attic")
+	if err != nil {
+		t.Skip(err)
+	}
+	if e.ID() != "loader_attic" {
+		t.Fatalf("expected loader_attic, got %q", e.ID())
+	}
+	if e.Name() == "" {
+		t.Fatal("expected an engine name")
+	}
+	if err := e.Ctrl(EngineCommand{Name: "NO_SUCH_COMMAND"}); err == nil {
+		t.Fatal("expected an error sending an unknown command")
+	}
+}
+
+func TestEngineSetDefault(t *testing.T) {
+	e, err := EngineById("rdrand")
+	if err != nil {
+		t.Skip(err)
+	}
+	if e.ID() != "rdrand" {
+		t.Fatalf("expected rdrand, got %q", e.ID())
+	}
+	if err := e.SetDefault(EngineMethodRAND); err != nil {
+		t.Fatal(err)
+	}
+	defer ClearRandEngine()
+	readRand(t, 100)
+	if err := e.SetDefaultString("RAND"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetDefaultString("NOT_A_METHOD"); err == nil {
+		t.Fatal("expected an error for an unknown method")
+	}
+}
@@ -0,0 +1,306 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <stdint.h>
+#include <openssl/err.h>
+#include <openssl/ssl.h>
+#include <openssl/x509.h>
+
+#ifndef SSL_AD_REASON_OFFSET
+#define SSL_AD_REASON_OFFSET 1000
+#endif
+
+extern STACK_OF(X509) *OUR_SSL_get0_verified_chain(const SSL *ssl);
+extern int sk_X509_num_not_a_macro(STACK_OF(X509) *sk);
+extern X509 *sk_X509_value_not_a_macro(STACK_OF(X509)* sk, int i);
+
+static int ERR_GET_LIB_not_a_macro(unsigned long err) {
+    return ERR_GET_LIB(err);
+}
+
+static int ERR_GET_FUNC_not_a_macro(unsigned long err) {
+#if OPENSSL_VERSION_NUMBER >= 0x30000000L || defined(OPENSSL_IS_BORINGSSL)
+    return 0;
+#else
+    return ERR_GET_FUNC(err);
+#endif
+}
+
+static int ERR_GET_REASON_not_a_macro(unsigned long err) {
+    return ERR_GET_REASON(err);
+}
+
+// function codes are gone from OpenSSL 3.0's errors, and BoringSSL reports
+// the same placeholder for all of them
+static const char *OUR_ERR_func_error_string(unsigned long err) {
+#if OPENSSL_VERSION_NUMBER >= 0x30000000L || defined(OPENSSL_IS_BORINGSSL)
+    return NULL;
+#else
+    return ERR_func_error_string(err);
+#endif
+}
+
+static int verify_depth_idx = -1;
+
+static void init_verify_depth_idx() {
+    verify_depth_idx = SSL_get_ex_new_index(0, NULL, NULL, NULL, NULL);
+}
+
+// records, once the verify callback has decided, the depth of the first
+// certificate failing verification, which OpenSSL doesn't keep
+void OUR_record_verify_failure(int ok, X509_STORE_CTX *store) {
+    SSL *ssl;
+    if (ok || verify_depth_idx < 0)
+        return;
+    ssl = X509_STORE_CTX_get_ex_data(store,
+        SSL_get_ex_data_X509_STORE_CTX_idx());
+    if (ssl == NULL || SSL_get_ex_data(ssl, verify_depth_idx) != NULL)
+        return;
+    SSL_set_ex_data(ssl, verify_depth_idx,
+        (void *)(intptr_t)(X509_STORE_CTX_get_error_depth(store) + 1));
+}
+
+// the verify callback of contexts without one of their own
+int record_verify_cb(int ok, X509_STORE_CTX *store) {
+    OUR_record_verify_failure(ok, store);
+    return ok;
+}
+
+static int SSL_get_verify_failure_depth(SSL *ssl) {
+    if (verify_depth_idx < 0)
+        return -1;
+    return (int)(intptr_t)SSL_get_ex_data(ssl, verify_depth_idx) - 1;
+}
+
+static X509 *SSL_get_verified_cert(SSL *ssl, int depth) {
+    STACK_OF(X509) *sk = OUR_SSL_get0_verified_chain(ssl);
+    if (sk == NULL || depth >= sk_X509_num_not_a_macro(sk))
+        return NULL;
+    return sk_X509_value_not_a_macro(sk, depth);
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrOpenSSL matches, with errors.Is, every error taken from OpenSSL's
+	// error queue, including the VerifyErrors and AlertErrors connections
+	// fail with.
+	ErrOpenSSL = errors.New("openssl: library error")
+	// ErrVerification matches VerifyError.
+	ErrVerification = errors.New("openssl: certificate verification failed")
+	// ErrAlert matches AlertError.
+	ErrAlert = errors.New("openssl: fatal alert received")
+)
+
+// The libraries of OpenSSL raising the most common errors, as found in
+// ErrorCode's Library.
+const (
+	LibSys    = C.ERR_LIB_SYS
+	LibASN1   = C.ERR_LIB_ASN1
+	LibEVP    = C.ERR_LIB_EVP
+	LibPEM    = C.ERR_LIB_PEM
+	LibX509   = C.ERR_LIB_X509
+	LibX509V3 = C.ERR_LIB_X509V3
+	LibSSL    = C.ERR_LIB_SSL
+)
+
+// ErrorCode is an error OpenSSL queued, split into the library that raised
+// it, the function, and the reason, as with ERR_GET_LIB, ERR_GET_FUNC and
+// ERR_GET_REASON, along with their descriptions. OpenSSL 3.0 dropped
+// function codes, leaving Function 0 and FunctionString empty.
+type ErrorCode struct {
+	Library        int
+	Function       int
+	Reason         int
+	LibraryString  string
+	FunctionString string
+	ReasonString   string
+}
+
+func (e ErrorCode) String() string {
+	return fmt.Sprintf("%s:%s:%s", e.LibraryString, e.FunctionString,
+		e.ReasonString)
+}
+
+// Error is an error from OpenSSL's error queue. Its ErrorCode is the first
+// error queued, usually the cause of those after it; Queue holds them all.
+type Error struct {
+	ErrorCode
+	Queue []ErrorCode
+}
+
+func (e *Error) Error() string {
+	codes := make([]string, 0, len(e.Queue))
+	for _, code := range e.Queue {
+		codes = append(codes, code.String())
+	}
+	return fmt.Sprintf("SSL errors: %s", strings.Join(codes, "\n"))
+}
+
+func (e *Error) Is(target error) bool {
+	return target == ErrOpenSSL
+}
+
+// HasReason reports whether any of the queued errors came from library for
+// reason.
+func (e *Error) HasReason(library, reason int) bool {
+	for _, code := range e.Queue {
+		if code.Library == library && code.Reason == reason {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	C.init_verify_depth_idx()
+}
+
+// errorFromErrorQueue needs to run in the same OS thread as the operation
+// that caused the possible error
+func errorFromErrorQueue() error {
+	return newErrorFromQueue()
+}
+
+// newErrorFromQueue empties the error queue into an Error. It needs to run
+// in the same OS thread as the operation that queued the errors.
+func newErrorFromQueue() *Error {
+	rv := &Error{}
+	for {
+		err := C.ERR_get_error()
+		if err == 0 {
+			break
+		}
+		rv.Queue = append(rv.Queue, ErrorCode{
+			Library:        int(C.ERR_GET_LIB_not_a_macro(err)),
+			Function:       int(C.ERR_GET_FUNC_not_a_macro(err)),
+			Reason:         int(C.ERR_GET_REASON_not_a_macro(err)),
+			LibraryString:  C.GoString(C.ERR_lib_error_string(err)),
+			FunctionString: C.GoString(C.OUR_ERR_func_error_string(err)),
+			ReasonString:   C.GoString(C.ERR_reason_error_string(err))})
+	}
+	if len(rv.Queue) > 0 {
+		rv.ErrorCode = rv.Queue[0]
+	}
+	return rv
+}
+
+// errorFromErrorQueue is the package's errorFromErrorQueue for I/O on c,
+// returning a VerifyError if the peer's certificate failed verification, or
+// an AlertError if the peer sent a fatal alert. The caller must hold c.mtx.
+func (c *Conn) errorFromErrorQueue() error {
+	err := newErrorFromQueue()
+	for _, code := range err.Queue {
+		if code.Library != LibSSL {
+			continue
+		}
+		switch {
+		case code.Reason == C.SSL_R_CERTIFICATE_VERIFY_FAILED:
+			result := VerifyResult(C.SSL_get_verify_result(c.ssl))
+			if result == Ok {
+				continue
+			}
+			verify_err := VerifyError{
+				Result: result,
+				Depth:  int(C.SSL_get_verify_failure_depth(c.ssl)),
+				err:    err}
+			if verify_err.Depth >= 0 {
+				x := C.SSL_get_verified_cert(c.ssl, C.int(verify_err.Depth))
+				if x != nil {
+					verify_err.Certificate = refCertificate(x)
+				}
+			}
+			return verify_err
+		case code.Reason >= C.SSL_AD_REASON_OFFSET &&
+			code.Reason < C.SSL_AD_REASON_OFFSET+256:
+			return AlertError{
+				Alert: Alert(code.Reason - C.SSL_AD_REASON_OFFSET),
+				err:   err}
+		}
+	}
+	return err
+}
+
+// Alert is a TLS alert description.
+type Alert uint8
+
+const (
+	AlertCloseNotify            Alert = 0
+	AlertUnexpectedMessage      Alert = 10
+	AlertBadRecordMAC           Alert = 20
+	AlertRecordOverflow         Alert = 22
+	AlertHandshakeFailure       Alert = 40
+	AlertBadCertificate         Alert = 42
+	AlertUnsupportedCertificate Alert = 43
+	AlertCertificateRevoked     Alert = 44
+	AlertCertificateExpired     Alert = 45
+	AlertCertificateUnknown     Alert = 46
+	AlertIllegalParameter       Alert = 47
+	AlertUnknownCA              Alert = 48
+	AlertAccessDenied           Alert = 49
+	AlertDecodeError            Alert = 50
+	AlertDecryptError           Alert = 51
+	AlertProtocolVersion        Alert = 70
+	AlertInsufficientSecurity   Alert = 71
+	AlertInternalError          Alert = 80
+	AlertInappropriateFallback  Alert = 86
+	AlertUserCanceled           Alert = 90
+	AlertMissingExtension       Alert = 109
+	AlertUnsupportedExtension   Alert = 110
+	AlertUnrecognizedName       Alert = 112
+	AlertBadCertificateStatus   Alert = 113
+	AlertUnknownPSKIdentity     Alert = 115
+	AlertCertificateRequired    Alert = 116
+	AlertNoApplicationProtocol  Alert = 120
+)
+
+// String returns OpenSSL's description of the alert, e.g. "certificate
+// expired".
+func (a Alert) String() string {
+	return C.GoString(C.SSL_alert_desc_string_long(C.int(a)))
+}
+
+// AlertError is returned by connections the peer aborted with a fatal
+// alert, such as a server rejecting the client's certificate with
+// AlertBadCertificate. It wraps the Error it was taken from.
+type AlertError struct {
+	Alert Alert
+	err   *Error
+}
+
+func (e AlertError) Error() string {
+	return fmt.Sprintf("openssl: peer sent alert: %s", e.Alert)
+}
+
+func (e AlertError) Is(target error) bool {
+	return target == ErrAlert
+}
+
+func (e AlertError) Unwrap() error {
+	if e.err == nil {
+		return nil
+	}
+	return e.err
+}
@@ -0,0 +1,116 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestErrorQueue(t *testing.T) {
+	_, err := LoadCertificateFromDER([]byte("not a certificate"))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	var openssl_err *Error
+	if !errors.As(err, &openssl_err) {
+		t.Fatalf("expected an *Error, got %T: %v", err, err)
+	}
+	if !errors.Is(err, ErrOpenSSL) {
+		t.Fatal("expected the error to match ErrOpenSSL")
+	}
+	if len(openssl_err.Queue) == 0 ||
+		openssl_err.ErrorCode != openssl_err.Queue[0] {
+		t.Fatalf("unexpected queue %v", openssl_err.Queue)
+	}
+	// errors left on the thread's queue by other tests may come first
+	found := false
+	for _, code := range openssl_err.Queue {
+		if code.Library == LibASN1 {
+			found = openssl_err.HasReason(LibASN1, code.Reason)
+		}
+	}
+	if !found {
+		t.Fatalf("expected an ASN1 error in %v", err)
+	}
+}
+
+func TestHandshakeErrors(t *testing.T) {
+	ca_key := generateTestRSAKey(t)
+	ca := issueTestCert(t, ca_key, testCert{CA: true})
+	key := generateTestRSAKey(t)
+	leaf := issueTestCert(t, key, testCert{Serial: 2, Issuer: ca,
+		IssuerKey: ca_key})
+	server_ctx := newSharedCtx(t, key, leaf, ca)
+	// the client trusts nothing, so the CA the server sends fails
+	client_ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client_ctx.SetVerifyMode(VerifyPeer)
+
+	server_conn, client_conn := NetPipe(t)
+	defer server_conn.Close()
+	defer client_conn.Close()
+	server_conn.SetDeadline(time.Now().Add(10 * time.Second))
+	client_conn.SetDeadline(time.Now().Add(10 * time.Second))
+	server, err := Server(server_conn, server_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := Client(client_conn, client_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server_errs := make(chan error, 1)
+	go func() { server_errs <- server.Handshake() }()
+	err = client.Handshake()
+
+	var verify_err VerifyError
+	if !errors.As(err, &verify_err) {
+		t.Fatalf("expected a VerifyError, got %T: %v", err, err)
+	}
+	if !errors.Is(err, ErrVerification) || !errors.Is(err, ErrOpenSSL) {
+		t.Fatal("expected the error to match ErrVerification and ErrOpenSSL")
+	}
+	if verify_err.Result != SelfSignedCertInChain {
+		t.Fatalf("unexpected result %d", verify_err.Result)
+	}
+	if verify_err.Depth != 1 || verify_err.Certificate == nil {
+		t.Fatalf("expected the CA at depth 1, got depth %d",
+			verify_err.Depth)
+	}
+	if !sameCertificate(t, verify_err.Certificate, ca) {
+		t.Fatal("expected the failing certificate to be the CA")
+	}
+	if verify_err.Result != client.VerifyResult() {
+		t.Fatal("expected the result to match VerifyResult")
+	}
+
+	err = <-server_errs
+	var alert_err AlertError
+	if !errors.As(err, &alert_err) {
+		t.Fatalf("expected an AlertError, got %T: %v", err, err)
+	}
+	if alert_err.Alert != AlertUnknownCA {
+		t.Fatalf("expected unknown CA, got %s", alert_err.Alert)
+	}
+	if !errors.Is(err, ErrAlert) || errors.Is(err, ErrVerification) {
+		t.Fatal("expected the error to match ErrAlert alone")
+	}
+}
@@ -0,0 +1,38 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package expvars publishes the openssl package's counters through expvar.
+// Importing expvar installs its /debug/vars handler on http.DefaultServeMux,
+// so this is kept out of the openssl package for programs to opt into.
+package expvars
+
+import (
+	"expvar"
+	"sync"
+
+	"github.com/spacemonkeygo/openssl"
+)
+
+var publishOnce sync.Once
+
+// Publish publishes the counters from openssl.GetStats as the expvar
+// "openssl", read afresh whenever the variable is. Calling it again is
+// harmless.
+func Publish() {
+	publishOnce.Do(func() {
+		expvar.Publish("openssl", expvar.Func(func() interface{} {
+			return openssl.GetStats()
+		}))
+	})
+}
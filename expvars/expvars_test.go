@@ -0,0 +1,44 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package expvars
+
+import (
+	"encoding/json"
+	"expvar"
+	"testing"
+
+	"github.com/spacemonkeygo/openssl"
+)
+
+func TestPublish(t *testing.T) {
+	Publish()
+	Publish()
+	if _, err := openssl.NewCtx(); err != nil {
+		t.Fatal(err)
+	}
+	v := expvar.Get("openssl")
+	if v == nil {
+		t.Fatal("expected the openssl variable to be published")
+	}
+	var stats openssl.Stats
+	if err := json.Unmarshal([]byte(v.String()), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Contexts < 1 || stats.CgoCalls < 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
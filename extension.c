@@ -0,0 +1,58 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include <stdlib.h>
+#include <openssl/ssl.h>
+#include "_cgo_export.h"
+
+#if OPENSSL_VERSION_NUMBER >= 0x10101000L
+
+static int add_custom_ext_cb(SSL *ssl, unsigned int ext_type,
+		unsigned int context, const unsigned char **out, size_t *outlen,
+		X509 *x, size_t chainidx, int *al, void *add_arg) {
+	return custom_ext_add_cb_thunk(
+		SSL_CTX_get_ex_data(SSL_get_SSL_CTX(ssl), get_ssl_ctx_idx()),
+		SSL_get_ex_data(ssl, get_ssl_idx()), ext_type, context,
+		(unsigned char **)out, outlen, al);
+}
+
+static void free_custom_ext_cb(SSL *ssl, unsigned int ext_type,
+		unsigned int context, const unsigned char *out, void *add_arg) {
+	free((void *)out);
+}
+
+static int parse_custom_ext_cb(SSL *ssl, unsigned int ext_type,
+		unsigned int context, const unsigned char *in, size_t inlen,
+		X509 *x, size_t chainidx, int *al, void *parse_arg) {
+	return custom_ext_parse_cb_thunk(
+		SSL_CTX_get_ex_data(SSL_get_SSL_CTX(ssl), get_ssl_ctx_idx()),
+		SSL_get_ex_data(ssl, get_ssl_idx()), ext_type, context,
+		(unsigned char *)in, inlen, al);
+}
+
+int SSL_CTX_add_custom_extension(SSL_CTX *ctx, unsigned int ext_type,
+		unsigned int context) {
+	return SSL_CTX_add_custom_ext(ctx, ext_type, context,
+		add_custom_ext_cb, free_custom_ext_cb, NULL,
+		parse_custom_ext_cb, NULL);
+}
+
+#else
+
+int SSL_CTX_add_custom_extension(SSL_CTX *ctx, unsigned int ext_type,
+		unsigned int context) {
+	return -1;
+}
+
+#endif
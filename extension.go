@@ -0,0 +1,179 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <stdlib.h>
+#include <openssl/ssl.h>
+
+#ifndef SSL_EXT_CLIENT_HELLO
+#define SSL_EXT_CLIENT_HELLO 0x0080
+#define SSL_EXT_TLS1_2_SERVER_HELLO 0x0100
+#define SSL_EXT_TLS1_3_SERVER_HELLO 0x0200
+#define SSL_EXT_TLS1_3_ENCRYPTED_EXTENSIONS 0x0400
+#define SSL_EXT_TLS1_3_HELLO_RETRY_REQUEST 0x0800
+#define SSL_EXT_TLS1_3_CERTIFICATE 0x1000
+#define SSL_EXT_TLS1_3_NEW_SESSION_TICKET 0x2000
+#define SSL_EXT_TLS1_3_CERTIFICATE_REQUEST 0x4000
+#endif
+
+extern int SSL_CTX_add_custom_extension(SSL_CTX *ctx, unsigned int ext_type,
+    unsigned int context);
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"unsafe"
+)
+
+// ExtensionContext is a set of the handshake messages a TLS extension may
+// appear in.
+type ExtensionContext int
+
+const (
+	ExtClientHello         ExtensionContext = C.SSL_EXT_CLIENT_HELLO
+	ExtTLS1_2ServerHello   ExtensionContext = C.SSL_EXT_TLS1_2_SERVER_HELLO
+	ExtTLS1_3ServerHello   ExtensionContext = C.SSL_EXT_TLS1_3_SERVER_HELLO
+	ExtEncryptedExtensions ExtensionContext = C.SSL_EXT_TLS1_3_ENCRYPTED_EXTENSIONS
+	ExtHelloRetryRequest   ExtensionContext = C.SSL_EXT_TLS1_3_HELLO_RETRY_REQUEST
+	// ExtCertificate is the TLS 1.3 Certificate message, where the
+	// extension goes with each certificate of the chain.
+	ExtCertificate        ExtensionContext = C.SSL_EXT_TLS1_3_CERTIFICATE
+	ExtNewSessionTicket   ExtensionContext = C.SSL_EXT_TLS1_3_NEW_SESSION_TICKET
+	ExtCertificateRequest ExtensionContext = C.SSL_EXT_TLS1_3_CERTIFICATE_REQUEST
+)
+
+// CustomExtension is a TLS extension OpenSSL doesn't know, handled by Go
+// callbacks. The handshake holds the connection's lock while they run, so
+// they must not call its methods; conn only tells connections apart.
+type CustomExtension struct {
+	// Type is the extension's number, which must not be one OpenSSL
+	// handles itself.
+	Type uint16
+	// Contexts are the messages the extension may appear in.
+	Contexts ExtensionContext
+	// Add returns the data to send in the extension in the given message,
+	// or false to leave it out. Servers only answer extensions in
+	// ServerHello or EncryptedExtensions if the client sent them. A nil Add
+	// never sends the extension.
+	Add func(conn *Conn, context ExtensionContext) (data []byte, ok bool)
+	// Parse checks the data the peer sent in the extension, returning an
+	// error to fail the handshake with an illegal_parameter alert. The data
+	// is kept for Conn.PeerExtension either way. It may be nil.
+	Parse func(conn *Conn, context ExtensionContext, data []byte) error
+}
+
+var customExtensionsUnsupported = errors.New(
+	"custom extensions require OpenSSL 1.1.1 or newer")
+
+// AddCustomExtension makes connections using the context send and receive
+// ext, such as a private extension carrying a routing hint in the
+// ClientHello. Each extension type may only be added once per context. With
+// SetTLSExtServerNameCallback, servers use the extensions of the context the
+// callback picks.
+func (c *Ctx) AddCustomExtension(ext CustomExtension) error {
+	c.custom_ext_mtx.Lock()
+	defer c.custom_ext_mtx.Unlock()
+	if _, ok := c.custom_exts[ext.Type]; ok {
+		return fmt.Errorf("extension %d already added", ext.Type)
+	}
+	switch C.SSL_CTX_add_custom_extension(c.ctx, C.uint(ext.Type),
+		C.uint(ext.Contexts)) {
+	case 1:
+	case -1:
+		return customExtensionsUnsupported
+	default:
+		return fmt.Errorf("failed to add extension %d", ext.Type)
+	}
+	if c.custom_exts == nil {
+		c.custom_exts = make(map[uint16]CustomExtension)
+	}
+	c.custom_exts[ext.Type] = ext
+	return nil
+}
+
+// PeerExtension returns the data the peer last sent in the custom extension
+// ext_type, and whether it sent it at all.
+func (c *Conn) PeerExtension(ext_type uint16) ([]byte, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	data, ok := c.peer_exts[ext_type]
+	return data, ok
+}
+
+func (c *Ctx) customExtension(ext_type C.uint) (CustomExtension, bool) {
+	c.custom_ext_mtx.Lock()
+	defer c.custom_ext_mtx.Unlock()
+	ext, ok := c.custom_exts[uint16(ext_type)]
+	return ext, ok
+}
+
+func customExtensionThunkRecover() {
+	if err := recover(); err != nil {
+		logger.Critf("openssl: custom extension callback panic'd: %v", err)
+		os.Exit(1)
+	}
+}
+
+//export custom_ext_add_cb_thunk
+func custom_ext_add_cb_thunk(p unsafe.Pointer, conn_p unsafe.Pointer,
+	ext_type C.uint, context C.uint, out **C.uchar, outlen *C.size_t,
+	al *C.int) C.int {
+	defer customExtensionThunkRecover()
+	ext, ok := (*Ctx)(p).customExtension(ext_type)
+	if !ok || ext.Add == nil {
+		return 0
+	}
+	data, ok := ext.Add((*Conn)(conn_p), ExtensionContext(context))
+	if !ok {
+		return 0
+	}
+	*out, *outlen = nil, 0
+	if len(data) > 0 {
+		// freed by free_custom_ext_cb once sent
+		*out = (*C.uchar)(C.CBytes(data))
+		*outlen = C.size_t(len(data))
+	}
+	return 1
+}
+
+//export custom_ext_parse_cb_thunk
+func custom_ext_parse_cb_thunk(p unsafe.Pointer, conn_p unsafe.Pointer,
+	ext_type C.uint, context C.uint, in *C.uchar, inlen C.size_t,
+	al *C.int) C.int {
+	defer customExtensionThunkRecover()
+	ext, ok := (*Ctx)(p).customExtension(ext_type)
+	if !ok {
+		return 1
+	}
+	conn := (*Conn)(conn_p)
+	data := C.GoBytes(unsafe.Pointer(in), C.int(inlen))
+	// the handshake holds conn.mtx
+	if conn.peer_exts == nil {
+		conn.peer_exts = make(map[uint16][]byte)
+	}
+	conn.peer_exts[uint16(ext_type)] = data
+	if ext.Parse != nil &&
+		ext.Parse(conn, ExtensionContext(context), data) != nil {
+		*al = C.SSL_AD_ILLEGAL_PARAMETER
+		return 0
+	}
+	return 1
+}
@@ -0,0 +1,114 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCustomExtension(t *testing.T) {
+	const ext_type = 0xff42
+	var tenant string
+	server_ctx := newTestServerCtx(t)
+	err := server_ctx.AddCustomExtension(CustomExtension{
+		Type:     ext_type,
+		Contexts: ExtClientHello | ExtEncryptedExtensions,
+		Add: func(conn *Conn, context ExtensionContext) ([]byte, bool) {
+			return []byte("routed"), true
+		},
+		Parse: func(conn *Conn, context ExtensionContext,
+			data []byte) error {
+			if string(data) == "unknown" {
+				return errors.New("unknown tenant")
+			}
+			return nil
+		}})
+	if err == customExtensionsUnsupported {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server_ctx.AddCustomExtension(CustomExtension{
+		Type: ext_type}); err == nil {
+		t.Fatal("expected adding the extension twice to fail")
+	}
+	client_ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client_ctx.AddCustomExtension(CustomExtension{
+		Type:     ext_type,
+		Contexts: ExtClientHello | ExtEncryptedExtensions,
+		Add: func(conn *Conn, context ExtensionContext) ([]byte, bool) {
+			if context != ExtClientHello {
+				t.Errorf("client asked for the extension in %x", context)
+			}
+			return []byte(tenant), true
+		}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handshake := func() (server, client *Conn, err error) {
+		server_conn, client_conn := NetPipe(t)
+		server_conn.SetDeadline(time.Now().Add(10 * time.Second))
+		client_conn.SetDeadline(time.Now().Add(10 * time.Second))
+		server, err = Server(server_conn, server_ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err = Client(client_conn, client_ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		errs := make(chan error, 1)
+		go func() { errs <- server.Handshake() }()
+		err = client.Handshake()
+		if server_err := <-errs; err == nil {
+			err = server_err
+		}
+		return server, client, err
+	}
+
+	tenant = "tenant-a"
+	server, client, err := handshake()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, ok := server.PeerExtension(ext_type); !ok ||
+		string(data) != "tenant-a" {
+		t.Fatalf("server received %q, %v", data, ok)
+	}
+	if data, ok := client.PeerExtension(ext_type); !ok ||
+		string(data) != "routed" {
+		t.Fatalf("client received %q, %v", data, ok)
+	}
+	server.Close()
+	client.Close()
+
+	// the server's Parse may refuse the handshake
+	tenant = "unknown"
+	server, client, err = handshake()
+	if err == nil {
+		t.Fatal("expected the handshake to fail")
+	}
+	server.Close()
+	client.Close()
+}
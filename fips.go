@@ -0,0 +1,182 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <openssl/crypto.h>
+#include <openssl/err.h>
+#include <openssl/evp.h>
+#include <openssl/objects.h>
+#include <openssl/ssl.h>
+#if OPENSSL_VERSION_NUMBER >= 0x30000000L
+#include <openssl/provider.h>
+#endif
+
+static int OUR_FIPS_mode_set(int on) {
+#if OPENSSL_VERSION_NUMBER >= 0x30000000L
+    // only called under fips_mtx
+    static OSSL_PROVIDER *fips;
+    if (on && fips == NULL) {
+        fips = OSSL_PROVIDER_load(NULL, "fips");
+        if (fips == NULL)
+            return 0;
+    }
+    return EVP_default_properties_enable_fips(NULL, on);
+#else
+    return FIPS_mode_set(on);
+#endif
+}
+
+static int OUR_FIPS_mode() {
+#if OPENSSL_VERSION_NUMBER >= 0x30000000L
+    return EVP_default_properties_is_fips_enabled(NULL);
+#else
+    return FIPS_mode();
+#endif
+}
+
+#if OPENSSL_VERSION_NUMBER >= 0x30000000L
+static int fips_has_digest(const char *name) {
+    EVP_MD *md = EVP_MD_fetch(NULL, name, "fips=yes");
+    EVP_MD_free(md);
+    return md != NULL;
+}
+#endif
+
+// whether the FIPS provider implements the cipher's encryption, MAC and
+// handshake digest. Before 3.0 OpenSSL refuses non-approved algorithms
+// itself once in FIPS mode.
+static int OUR_SSL_CIPHER_is_fips(const SSL_CIPHER *c) {
+#if OPENSSL_VERSION_NUMBER >= 0x30000000L
+    int ok = 0;
+    int nid = SSL_CIPHER_get_cipher_nid(c);
+    EVP_CIPHER *cipher;
+    const EVP_MD *md;
+    ERR_set_mark();
+    if (nid == NID_undef)
+        goto end;
+    cipher = EVP_CIPHER_fetch(NULL, OBJ_nid2sn(nid), "fips=yes");
+    if (cipher == NULL)
+        goto end;
+    EVP_CIPHER_free(cipher);
+    nid = SSL_CIPHER_get_digest_nid(c);
+    if (nid != NID_undef && !fips_has_digest(OBJ_nid2sn(nid)))
+        goto end;
+    md = SSL_CIPHER_get_handshake_digest(c);
+    if (md != NULL && !fips_has_digest(EVP_MD_get0_name(md)))
+        goto end;
+    ok = 1;
+end:
+    ERR_pop_to_mark();
+    return ok;
+#else
+    return 1;
+#endif
+}
+
+static const SSL_CIPHER *OUR_SSL_CTX_first_non_fips_cipher(SSL_CTX *ctx) {
+    int i;
+    STACK_OF(SSL_CIPHER) *sk = SSL_CTX_get_ciphers(ctx);
+    for (i = 0; sk != NULL && i < sk_SSL_CIPHER_num(sk); i++) {
+        if (!OUR_SSL_CIPHER_is_fips(sk_SSL_CIPHER_value(sk, i)))
+            return sk_SSL_CIPHER_value(sk, i);
+    }
+    return NULL;
+}
+
+static const SSL_CIPHER *OUR_SSL_first_non_fips_cipher(SSL *ssl) {
+    int i;
+    STACK_OF(SSL_CIPHER) *sk = SSL_get_ciphers(ssl);
+    for (i = 0; sk != NULL && i < sk_SSL_CIPHER_num(sk); i++) {
+        if (!OUR_SSL_CIPHER_is_fips(sk_SSL_CIPHER_value(sk, i)))
+            return sk_SSL_CIPHER_value(sk, i);
+    }
+    return NULL;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+var fips_mtx sync.Mutex
+
+// FIPSModeSet turns FIPS mode on or off, process wide. On OpenSSL 3.0 and
+// newer that loads the fips provider and makes it the only source of
+// algorithms fetched without an explicit provider; before 3.0 it calls
+// FIPS_mode_set, which needs a FIPS capable build of OpenSSL. Either way,
+// FIPS mode should be set before creating any contexts, which hold on to
+// the algorithms they start with.
+func FIPSModeSet(on bool) error {
+	fips_mtx.Lock()
+	defer fips_mtx.Unlock()
+	var con C.int
+	if on {
+		con = 1
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.OUR_FIPS_mode_set(con) != 1 {
+		return errorFromErrorQueue()
+	}
+	return nil
+}
+
+// FIPSModeEnabled reports whether FIPS mode is on.
+func FIPSModeEnabled() bool {
+	return C.OUR_FIPS_mode() == 1
+}
+
+// RequireFIPS makes the context refuse cipher configuration that would use
+// algorithms the FIPS provider doesn't implement, failing now if FIPS mode
+// is off or the context's cipher suites already include such algorithms,
+// and failing later calls to SetCipherList and SetCipherSuites that bring
+// them in. Before OpenSSL 3.0 only FIPS mode itself is checked, as OpenSSL
+// then refuses non-approved algorithms on its own.
+func (c *Ctx) RequireFIPS() error {
+	if !FIPSModeEnabled() {
+		return errors.New("FIPS mode is not enabled")
+	}
+	if err := c.checkFIPS(); err != nil {
+		return err
+	}
+	c.require_fips = true
+	return nil
+}
+
+func (c *Ctx) checkFIPS() error {
+	cipher := C.OUR_SSL_CTX_first_non_fips_cipher(c.ctx)
+	if cipher != nil {
+		return fmt.Errorf("cipher suite %s is not FIPS approved",
+			C.GoString(C.SSL_CIPHER_get_name(cipher)))
+	}
+	return nil
+}
+
+// checkFIPS is Ctx.checkFIPS for a connection's own ciphers.
+func (c *Conn) checkFIPS() error {
+	cipher := C.OUR_SSL_first_non_fips_cipher(c.ssl)
+	if cipher != nil {
+		return fmt.Errorf("cipher suite %s is not FIPS approved",
+			C.GoString(C.SSL_CIPHER_get_name(cipher)))
+	}
+	return nil
+}
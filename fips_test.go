@@ -0,0 +1,70 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"testing"
+)
+
+func TestFIPSMode(t *testing.T) {
+	if FIPSModeEnabled() {
+		t.Skip("FIPS mode is already on")
+	}
+	ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.RequireFIPS(); err == nil {
+		t.Fatal("expected an error requiring FIPS outside FIPS mode")
+	}
+	if err := FIPSModeSet(true); err != nil {
+		if FIPSModeEnabled() {
+			t.Fatal("FIPS mode on after failing to set it")
+		}
+		t.Skip(err)
+	}
+	defer FIPSModeSet(false)
+	if !FIPSModeEnabled() {
+		t.Fatal("expected FIPS mode to be on")
+	}
+
+	ctx, err = NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.SetCipherList("ECDHE-RSA-AES128-GCM-SHA256"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.SetCipherSuites("TLS_AES_128_GCM_SHA256"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.RequireFIPS(); err != nil {
+		t.Fatal(err)
+	}
+	err = ctx.SetCipherSuites("TLS_AES_128_GCM_SHA256:" +
+		"TLS_CHACHA20_POLY1305_SHA256")
+	if err == nil {
+		t.Fatal("expected an error enabling ChaCha20-Poly1305")
+	}
+
+	if err := FIPSModeSet(false); err != nil {
+		t.Fatal(err)
+	}
+	if FIPSModeEnabled() {
+		t.Fatal("expected FIPS mode to be off")
+	}
+}
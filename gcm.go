@@ -0,0 +1,337 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo,!darwin
+
+package openssl
+
+/*
+#include <openssl/evp.h>
+
+// seals in with a fresh nonce, writing the ciphertext to out and the tag to
+// tag, in one call. the GCM ctrls are shared by the other AEAD ciphers
+static int OUR_aead_seal(EVP_CIPHER_CTX *ctx, const unsigned char *nonce,
+        const unsigned char *aad, int aad_len, const unsigned char *in,
+        int in_len, unsigned char *out, unsigned char *tag) {
+    unsigned char final[16];
+    int len;
+    if (EVP_EncryptInit_ex(ctx, NULL, NULL, NULL, nonce) != 1)
+        return 0;
+    if (aad_len > 0 && EVP_EncryptUpdate(ctx, NULL, &len, aad, aad_len) != 1)
+        return 0;
+    if (in_len > 0 && EVP_EncryptUpdate(ctx, out, &len, in, in_len) != 1)
+        return 0;
+    if (EVP_EncryptFinal_ex(ctx, final, &len) != 1)
+        return 0;
+    return EVP_CIPHER_CTX_ctrl(ctx, EVP_CTRL_GCM_GET_TAG, 16, tag);
+}
+
+// opens in with a fresh nonce, returning 1 if tag authenticates it and the
+// plaintext written to out may be used
+static int OUR_aead_open(EVP_CIPHER_CTX *ctx, const unsigned char *nonce,
+        const unsigned char *aad, int aad_len, const unsigned char *in,
+        int in_len, unsigned char *tag, unsigned char *out) {
+    unsigned char final[16];
+    int len;
+    if (EVP_DecryptInit_ex(ctx, NULL, NULL, NULL, nonce) != 1)
+        return 0;
+    if (aad_len > 0 && EVP_DecryptUpdate(ctx, NULL, &len, aad, aad_len) != 1)
+        return 0;
+    if (in_len > 0 && EVP_DecryptUpdate(ctx, out, &len, in, in_len) != 1)
+        return 0;
+    if (EVP_CIPHER_CTX_ctrl(ctx, EVP_CTRL_GCM_SET_TAG, 16, tag) != 1)
+        return 0;
+    return EVP_DecryptFinal_ex(ctx, final, &len) == 1;
+}
+*/
+import "C"
+
+import (
+	"crypto/cipher"
+	"errors"
+	"io"
+	"math"
+	"sync"
+)
+
+const (
+	aeadNonceSize = 12
+	aeadTagSize   = GCM_TAG_MAXLEN
+)
+
+// AuthenticationFailed is returned when an AEAD ciphertext or its additional
+// data has been tampered with, or the wrong key or nonce was used.
+var AuthenticationFailed = errors.New("openssl: message authentication failed")
+
+// evpAEAD is a cipher.AEAD for EVP ciphers taking a 12 byte nonce and a 16
+// byte tag.
+type evpAEAD struct {
+	seal_mtx sync.Mutex
+	seal     *encryptionCipherCtx
+	open_mtx sync.Mutex
+	open     *decryptionCipherCtx
+}
+
+// NewGCM returns AES-GCM with a 12 byte nonce and a 16 byte tag as a
+// cipher.AEAD, in place of crypto/cipher's NewGCM. The key is 16, 24 or 32
+// bytes long, for AES-128, AES-192 or AES-256. Seal and Open are safe for
+// concurrent use, but are each serialized; use an AEAD per goroutine for
+// parallelism.
+func NewGCM(key []byte) (cipher.AEAD, error) {
+	return NewGCMWithEngine(key, nil)
+}
+
+// NewGCMWithEngine is like NewGCM, but uses the engine e.
+func NewGCMWithEngine(key []byte, e *Engine) (cipher.AEAD, error) {
+	c, err := getGCMCipher(len(key) * 8)
+	if err != nil {
+		return nil, err
+	}
+	return newEVPAEAD(c, e, key)
+}
+
+func newEVPAEAD(c *Cipher, e *Engine, key []byte) (*evpAEAD, error) {
+	seal, err := newEncryptionCipherCtx(c, e, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	open, err := newDecryptionCipherCtx(c, e, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, ctx := range []*cipherCtx{seal.cipherCtx, open.cipherCtx} {
+		err := ctx.setCtrl(C.EVP_CTRL_GCM_SET_IVLEN, aeadNonceSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &evpAEAD{seal: seal, open: open}, nil
+}
+
+func (a *evpAEAD) NonceSize() int { return aeadNonceSize }
+
+func (a *evpAEAD) Overhead() int { return aeadTagSize }
+
+// cBytes returns a C pointer to b, or nil if it is empty.
+func cBytes(b []byte) *C.uchar {
+	if len(b) == 0 {
+		return nil
+	}
+	return (*C.uchar)(&b[0])
+}
+
+// grow extends b by n bytes, returning the result and the extension.
+func grow(b []byte, n int) (rv, tail []byte) {
+	if total := len(b) + n; cap(b) >= total {
+		rv = b[:total]
+	} else {
+		rv = make([]byte, total)
+		copy(rv, b)
+	}
+	return rv, rv[len(b):]
+}
+
+func checkAEADSizes(nonce, text, aad []byte) {
+	if len(nonce) != aeadNonceSize {
+		panic("openssl: incorrect nonce length given to AEAD")
+	}
+	if len(text) > math.MaxInt32-aeadTagSize || len(aad) > math.MaxInt32 {
+		panic("openssl: message too large for AEAD")
+	}
+}
+
+// Seal encrypts and authenticates plaintext, authenticates aad, and appends
+// the result to dst. dst may alias plaintext exactly, but not otherwise
+// overlap it.
+func (a *evpAEAD) Seal(dst, nonce, plaintext, aad []byte) []byte {
+	checkAEADSizes(nonce, plaintext, aad)
+	rv, out := grow(dst, len(plaintext)+aeadTagSize)
+	a.seal_mtx.Lock()
+	defer a.seal_mtx.Unlock()
+	if C.OUR_aead_seal(a.seal.ctx, cBytes(nonce), cBytes(aad), C.int(len(aad)),
+		cBytes(plaintext), C.int(len(plaintext)), cBytes(out),
+		cBytes(out[len(plaintext):])) != 1 {
+		panic("openssl: aead: seal failed")
+	}
+	return rv
+}
+
+// Open authenticates and decrypts ciphertext, authenticates aad, and appends
+// the plaintext to dst, returning AuthenticationFailed if either was
+// tampered with. dst may alias ciphertext exactly, but not otherwise overlap
+// it.
+func (a *evpAEAD) Open(dst, nonce, ciphertext, aad []byte) ([]byte, error) {
+	checkAEADSizes(nonce, ciphertext, aad)
+	if len(ciphertext) < aeadTagSize {
+		return nil, AuthenticationFailed
+	}
+	text_len := len(ciphertext) - aeadTagSize
+	// copied, as decrypting in place overwrites the start of ciphertext
+	var tag [aeadTagSize]byte
+	copy(tag[:], ciphertext[text_len:])
+	rv, out := grow(dst, text_len)
+	a.open_mtx.Lock()
+	defer a.open_mtx.Unlock()
+	if C.OUR_aead_open(a.open.ctx, cBytes(nonce), cBytes(aad), C.int(len(aad)),
+		cBytes(ciphertext), C.int(text_len), cBytes(tag[:]),
+		cBytes(out)) != 1 {
+		for i := range out {
+			out[i] = 0
+		}
+		return nil, AuthenticationFailed
+	}
+	return rv, nil
+}
+
+type gcmWriter struct {
+	w   io.Writer
+	ctx AuthenticatedEncryptionCipherCtx
+	err error
+}
+
+// NewGCMEncryptWriter returns a writer that encrypts what is written to it
+// with AES-GCM as it goes, for payloads too large to hold in memory. The
+// key is as for NewGCM, and the nonce is 12 bytes long. The ciphertext is
+// written to w, and the tag is appended to it by Close, which doesn't close
+// w. The output is the same as NewGCM's Seal.
+func NewGCMEncryptWriter(w io.Writer, key, nonce, aad []byte) (
+	io.WriteCloser, error) {
+	if len(nonce) != aeadNonceSize {
+		return nil, errors.New("openssl: incorrect nonce length given to GCM")
+	}
+	ctx, err := NewGCMEncryptionCipherCtx(len(key)*8, nil, key, nonce)
+	if err != nil {
+		return nil, err
+	}
+	if len(aad) > 0 {
+		if err := ctx.ExtraData(aad); err != nil {
+			return nil, err
+		}
+	}
+	return &gcmWriter{w: w, ctx: ctx}, nil
+}
+
+func (g *gcmWriter) Write(p []byte) (n int, err error) {
+	if g.err != nil {
+		return 0, g.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	out, err := g.ctx.EncryptUpdate(p)
+	if err == nil {
+		_, err = g.w.Write(out)
+	}
+	if err != nil {
+		g.err = err
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (g *gcmWriter) Close() error {
+	if g.err != nil {
+		return g.err
+	}
+	g.err = errors.New("openssl: gcm: writer closed")
+	out, err := g.ctx.EncryptFinal()
+	if err != nil {
+		return err
+	}
+	tag, err := g.ctx.GetTag()
+	if err != nil {
+		return err
+	}
+	_, err = g.w.Write(append(out, tag...))
+	return err
+}
+
+type gcmReader struct {
+	r   io.Reader
+	ctx AuthenticatedDecryptionCipherCtx
+	// pending holds ciphertext not yet decrypted, the last aeadTagSize bytes
+	// of which may turn out to be the tag
+	pending []byte
+	plain   []byte
+	err     error
+}
+
+// NewGCMDecryptReader returns a reader that decrypts the output of
+// NewGCMEncryptWriter, or NewGCM's Seal, read from r as it goes. Once r is
+// exhausted, the tag is checked, and Read returns io.EOF if it authenticates
+// the payload, or AuthenticationFailed if not. Plaintext is returned before
+// it has been authenticated, so it must not be acted upon until then.
+func NewGCMDecryptReader(r io.Reader, key, nonce, aad []byte) (io.Reader,
+	error) {
+	if len(nonce) != aeadNonceSize {
+		return nil, errors.New("openssl: incorrect nonce length given to GCM")
+	}
+	ctx, err := NewGCMDecryptionCipherCtx(len(key)*8, nil, key, nonce)
+	if err != nil {
+		return nil, err
+	}
+	if len(aad) > 0 {
+		if err := ctx.ExtraData(aad); err != nil {
+			return nil, err
+		}
+	}
+	return &gcmReader{
+		r:       r,
+		ctx:     ctx,
+		pending: make([]byte, 0, 32*1024)}, nil
+}
+
+func (g *gcmReader) Read(p []byte) (n int, err error) {
+	for len(g.plain) == 0 && g.err == nil {
+		g.fill()
+	}
+	if len(g.plain) > 0 {
+		n = copy(p, g.plain)
+		g.plain = g.plain[n:]
+		return n, nil
+	}
+	return 0, g.err
+}
+
+// fill reads more ciphertext, decrypting what can't be the tag into plain,
+// or checks the tag once the ciphertext ends.
+func (g *gcmReader) fill() {
+	n, err := g.r.Read(g.pending[len(g.pending):cap(g.pending)])
+	g.pending = g.pending[:len(g.pending)+n]
+	if body := len(g.pending) - aeadTagSize; body > 0 {
+		g.plain, g.err = g.ctx.DecryptUpdate(g.pending[:body])
+		if g.err != nil {
+			return
+		}
+		g.pending = g.pending[:copy(g.pending, g.pending[body:])]
+	}
+	if err == io.EOF {
+		g.err = g.finish()
+	} else if err != nil {
+		g.err = err
+	}
+}
+
+func (g *gcmReader) finish() error {
+	if len(g.pending) != aeadTagSize {
+		return AuthenticationFailed
+	}
+	if err := g.ctx.SetTag(g.pending); err != nil {
+		return err
+	}
+	if _, err := g.ctx.DecryptFinal(); err != nil {
+		return AuthenticationFailed
+	}
+	return io.EOF
+}
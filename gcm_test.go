@@ -0,0 +1,173 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin
+// +build cgo
+
+package openssl
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func randomBytes(t testing.TB, n int) []byte {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestGCMAEAD(t *testing.T) {
+	for _, key_len := range []int{16, 24, 32} {
+		key := randomBytes(t, key_len)
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, err := cipher.NewGCM(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aead, err := NewGCM(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if aead.NonceSize() != expected.NonceSize() ||
+			aead.Overhead() != expected.Overhead() {
+			t.Fatal("expected the same sizes as crypto/cipher")
+		}
+		for _, text_len := range []int{0, 1, 16, 1000} {
+			nonce := randomBytes(t, aead.NonceSize())
+			plaintext := randomBytes(t, text_len)
+			aad := randomBytes(t, text_len%7)
+			sealed := aead.Seal([]byte("x"), nonce, plaintext, aad)
+			if !bytes.Equal(sealed, expected.Seal([]byte("x"), nonce,
+				plaintext, aad)) {
+				t.Fatalf("%d byte key, %d byte plaintext: seal mismatch",
+					key_len, text_len)
+			}
+			opened, err := aead.Open(nil, nonce, sealed[1:], aad)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(opened, plaintext) {
+				t.Fatal("open mismatch")
+			}
+
+			// in place
+			buf := append([]byte(nil), plaintext...)
+			buf = aead.Seal(buf[:0], nonce, buf, aad)
+			if !bytes.Equal(buf, sealed[1:]) {
+				t.Fatal("in place seal mismatch")
+			}
+			buf, err = aead.Open(buf[:0], nonce, buf, aad)
+			if err != nil || !bytes.Equal(buf, plaintext) {
+				t.Fatal("in place open mismatch", err)
+			}
+
+			sealed[len(sealed)-1] ^= 1
+			if _, err := aead.Open(nil, nonce, sealed[1:],
+				aad); err != AuthenticationFailed {
+				t.Fatalf("expected a tampered tag to fail, got %v", err)
+			}
+			if _, err := aead.Open(nil, nonce, sealed[1:],
+				append(aad, 0)); err != AuthenticationFailed {
+				t.Fatalf("expected different aad to fail, got %v", err)
+			}
+		}
+	}
+	if _, err := NewGCM(make([]byte, 20)); err == nil {
+		t.Fatal("expected an error for a bad key size")
+	}
+}
+
+func TestGCMStream(t *testing.T) {
+	key := randomBytes(t, 32)
+	nonce := randomBytes(t, 12)
+	aad := []byte("header")
+	plaintext := randomBytes(t, 100*1024+3)
+	aead, err := NewGCM(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sealed bytes.Buffer
+	w, err := NewGCMEncryptWriter(&sealed, key, nonce, aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rest := plaintext; len(rest) > 0; {
+		n := 1000
+		if n > len(rest) {
+			n = len(rest)
+		}
+		if _, err := w.Write(rest[:n]); err != nil {
+			t.Fatal(err)
+		}
+		rest = rest[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sealed.Bytes(), aead.Seal(nil, nonce, plaintext, aad)) {
+		t.Fatal("expected the stream to match Seal")
+	}
+
+	r, err := NewGCMDecryptReader(bytes.NewReader(sealed.Bytes()), key,
+		nonce, aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opened, plaintext) {
+		t.Fatal("expected the stream to decrypt")
+	}
+
+	tampered := sealed.Bytes()
+	tampered[len(tampered)/2] ^= 1
+	r, err = NewGCMDecryptReader(bytes.NewReader(tampered), key, nonce, aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(r); err != AuthenticationFailed {
+		t.Fatalf("expected a tampered stream to fail, got %v", err)
+	}
+}
+
+func BenchmarkGCMSeal(b *testing.B) {
+	key := randomBytes(b, 16)
+	nonce := randomBytes(b, 12)
+	buf := make([]byte, 16*1024)
+	aead, err := NewGCM(key)
+	if err != nil {
+		b.Fatal(err)
+	}
+	out := make([]byte, 0, len(buf)+aead.Overhead())
+	b.SetBytes(int64(len(buf)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		aead.Seal(out, nonce, buf, nil)
+	}
+}
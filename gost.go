@@ -0,0 +1,88 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Names of the GOST algorithms (RFC 6986, RFC 7801, RFC 8891) as the GOST
+// engine and provider register them, for GetDigestByName, GetCipherByName,
+// FetchDigest and FetchCipher.
+const (
+	// GOSTStreebog256 and GOSTStreebog512 are the GOST R 34.11-2012
+	// digests.
+	GOSTStreebog256 = "md_gost12_256"
+	GOSTStreebog512 = "md_gost12_512"
+	// GOSTKuznyechikCTR and GOSTMagmaCTR are the GOST R 34.12-2015 block
+	// ciphers in counter mode.
+	GOSTKuznyechikCTR = "kuznyechik-ctr"
+	GOSTMagmaCTR      = "magma-ctr"
+)
+
+// GOSTCipherList is a cipher list, for Ctx.SetCipherList, of the TLS 1.2
+// GOST cipher suites (RFC 9189), strongest first. They authenticate with
+// GOST R 34.10-2012 keys, see KeyTypeGOST2012_256.
+const GOSTCipherList = "GOST2012-KUZNYECHIK-KUZNYECHIKOMAC:" +
+	"GOST2012-MAGMA-MAGMAOMAC:GOST2012-GOST8912-GOST8912"
+
+var (
+	gost_mtx       sync.Mutex
+	gost_engine    *Engine
+	gost_providers []*Provider
+)
+
+// EnableGOST makes the GOST algorithms available process wide, so that
+// they can be used through the usual Ctx, digest and cipher functions. It
+// loads the gost engine, made the default for everything it implements as
+// an openssl.cnf engine section would, or where engines aren't available,
+// the gostprov provider of OpenSSL 3.0 and newer, alongside the default
+// one. Either must be installed separately, from the gost-engine project.
+// It does nothing if they are already loaded by it.
+//
+// Contexts only offer the GOST cipher suites if they are created after
+// this, as OpenSSL decides which suites are usable when creating them.
+func EnableGOST() error {
+	gost_mtx.Lock()
+	defer gost_mtx.Unlock()
+	if gost_engine != nil || gost_providers != nil {
+		return nil
+	}
+	engine_err := errEnginesUnsupported
+	if EnginesSupported() {
+		var e *Engine
+		e, engine_err = EngineById("gost")
+		if engine_err == nil {
+			engine_err = e.SetDefault(EngineMethodAll)
+		}
+		if engine_err == nil {
+			gost_engine = e
+			return nil
+		}
+	}
+	if !providersSupported {
+		return fmt.Errorf("loading the GOST engine: %s", engine_err)
+	}
+	loaded, err := loadProviders("gostprov", "default")
+	if err != nil {
+		return fmt.Errorf("loading the GOST engine: %s; loading the GOST "+
+			"provider: %s", engine_err, err)
+	}
+	gost_providers = loaded
+	return nil
+}
@@ -0,0 +1,64 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"testing"
+)
+
+func TestGOST(t *testing.T) {
+	if err := EnableGOST(); err != nil {
+		t.Skip(err)
+	}
+	for name, size := range map[string]int{
+		GOSTStreebog256: 32,
+		GOSTStreebog512: 64,
+	} {
+		md, err := GetDigestByName(name)
+		if err != nil && providersSupported {
+			md, err = FetchDigest(name, "")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, err := NewDigest(md)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := len(h.Sum(nil)); got != size {
+			t.Fatalf("%s: expected %d byte digests, got %d", name, size, got)
+		}
+	}
+	cipher, err := GetCipherByName(GOSTKuznyechikCTR)
+	if err != nil && providersSupported {
+		cipher, err = FetchCipher(GOSTKuznyechikCTR, "")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cipher.KeySize() != 32 {
+		t.Fatalf("expected a 32 byte Kuznyechik key, got %d", cipher.KeySize())
+	}
+
+	ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.SetCipherList(GOSTCipherList); err != nil {
+		t.Fatal(err)
+	}
+}
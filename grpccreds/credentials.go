@@ -0,0 +1,190 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package grpccreds provides gRPC transport credentials backed by OpenSSL,
+// so that gRPC clients and servers can use keys held in an engine or any
+// other configuration only this package's Ctx supports.
+//
+//	ctx, err := openssl.NewCtxSecure()
+//	...
+//	creds, err := grpccreds.NewCredentials(ctx, 0)
+//	...
+//	server := grpc.NewServer(grpc.Creds(creds))
+//
+// Peers are described to gRPC with a credentials.TLSInfo, so interceptors
+// that inspect peer certificates work unchanged.
+package grpccreds
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/spacemonkeygo/openssl"
+	"google.golang.org/grpc/credentials"
+)
+
+type transportCredentials struct {
+	ctx         *openssl.Ctx
+	flags       openssl.DialFlags
+	server_name string
+}
+
+// NewCredentials returns credentials for both clients and servers that secure
+// connections with ctx. Clients check the server's hostname as Dial does,
+// unless flags includes InsecureSkipHostVerification, and send SNI unless
+// flags includes DisableSNI. ctx is set to negotiate "h2" with ALPN, as gRPC
+// requires, in place of any protocols it was set to before.
+func NewCredentials(ctx *openssl.Ctx, flags openssl.DialFlags) (
+	credentials.TransportCredentials, error) {
+	if ctx == nil {
+		return nil, errors.New("no ssl context provided")
+	}
+	err := ctx.SetAlpnProtos([]string{"h2"})
+	if err != nil {
+		return nil, err
+	}
+	return &transportCredentials{ctx: ctx, flags: flags}, nil
+}
+
+// ClientHandshake implements credentials.TransportCredentials.
+func (c *transportCredentials) ClientHandshake(ctx context.Context,
+	authority string, raw_conn net.Conn) (net.Conn, credentials.AuthInfo,
+	error) {
+	host := c.server_name
+	if host == "" {
+		host = authority
+		if h, _, err := net.SplitHostPort(authority); err == nil {
+			host = h
+		}
+	}
+	conn, err := openssl.Client(raw_conn, c.ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.flags&openssl.DisableSNI == 0 && net.ParseIP(host) == nil {
+		err = conn.SetTlsExtHostName(host)
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+	err = handshake(ctx, conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if c.flags&openssl.InsecureSkipHostVerification == 0 {
+		err = conn.VerifyHostname(host)
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+	info, err := authInfo(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, info, nil
+}
+
+// ServerHandshake implements credentials.TransportCredentials.
+func (c *transportCredentials) ServerHandshake(raw_conn net.Conn) (net.Conn,
+	credentials.AuthInfo, error) {
+	conn, err := openssl.Server(raw_conn, c.ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	// gRPC bounds the server handshake with a deadline on raw_conn
+	err = conn.Handshake()
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	info, err := authInfo(conn, "")
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, info, nil
+}
+
+// handshake runs the handshake on conn, giving up when ctx is done.
+func handshake(ctx context.Context, conn *openssl.Conn) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	err := conn.Handshake()
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// authInfo describes conn's peer in the form gRPC's own TLS credentials use.
+func authInfo(conn *openssl.Conn, server_name string) (credentials.TLSInfo,
+	error) {
+	conn_state := conn.ConnectionState()
+	if conn_state.PeerCertificatesError != nil {
+		return credentials.TLSInfo{}, conn_state.PeerCertificatesError
+	}
+	state := tls.ConnectionState{
+		Version:            conn_state.Version,
+		HandshakeComplete:  true,
+		DidResume:          conn_state.DidResume,
+		CipherSuite:        conn_state.CipherSuite,
+		ServerName:         server_name,
+		NegotiatedProtocol: conn_state.NegotiatedProtocol,
+		PeerCertificates:   conn_state.PeerCertificates}
+	return credentials.TLSInfo{
+		State: state,
+		CommonAuthInfo: credentials.CommonAuthInfo{
+			SecurityLevel: credentials.PrivacyAndIntegrity}}, nil
+}
+
+// Info implements credentials.TransportCredentials.
+func (c *transportCredentials) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{
+		SecurityProtocol: "tls",
+		SecurityVersion:  "1.2",
+		ServerName:       c.server_name}
+}
+
+// Clone implements credentials.TransportCredentials. The clone shares the
+// underlying Ctx.
+func (c *transportCredentials) Clone() credentials.TransportCredentials {
+	clone := *c
+	return &clone
+}
+
+// OverrideServerName implements credentials.TransportCredentials, setting
+// the name clients send with SNI and check the server's certificate against
+// in place of the dialed authority.
+func (c *transportCredentials) OverrideServerName(name string) error {
+	c.server_name = name
+	return nil
+}
@@ -0,0 +1,185 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpccreds
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/spacemonkeygo/openssl"
+	"google.golang.org/grpc/credentials"
+)
+
+func newServerCtx(t *testing.T) (*openssl.Ctx, *x509.Certificate) {
+	std_key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "grpc.test"},
+		DNSNames:     []string{"grpc.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&std_key.PublicKey, std_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	std_cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := openssl.LoadCertificateFromPEM(pem.EncodeToMemory(
+		&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := openssl.FromStdlibPrivateKey(std_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, err := openssl.NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.UseCertificate(cert); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.UsePrivateKey(key); err != nil {
+		t.Fatal(err)
+	}
+	return ctx, std_cert
+}
+
+// tcpPipe returns both ends of a loopback TCP connection.
+func tcpPipe(t *testing.T) (server, client net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, client
+}
+
+func TestHandshake(t *testing.T) {
+	server_ctx, std_cert := newServerCtx(t)
+	server_creds, err := NewCredentials(server_ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client_ctx, err := openssl.NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client_creds, err := NewCredentials(client_ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client_creds = client_creds.Clone()
+	if err := client_creds.OverrideServerName("grpc.test"); err != nil {
+		t.Fatal(err)
+	}
+
+	server_raw, client_raw := tcpPipe(t)
+	type result struct {
+		info credentials.AuthInfo
+		err  error
+	}
+	server_result := make(chan result, 1)
+	go func() {
+		conn, info, err := server_creds.ServerHandshake(server_raw)
+		if err == nil {
+			defer conn.Close()
+		}
+		server_result <- result{info, err}
+	}()
+	conn, info, err := client_creds.ClientHandshake(context.Background(),
+		"127.0.0.1:443", client_raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	res := <-server_result
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+
+	tls_info, ok := info.(credentials.TLSInfo)
+	if !ok {
+		t.Fatalf("unexpected auth info %T", info)
+	}
+	if tls_info.State.ServerName != "grpc.test" {
+		t.Fatalf("unexpected server name %q", tls_info.State.ServerName)
+	}
+	if tls_info.State.NegotiatedProtocol != "h2" {
+		t.Fatalf("unexpected protocol %q", tls_info.State.NegotiatedProtocol)
+	}
+	if len(tls_info.State.PeerCertificates) != 1 ||
+		!tls_info.State.PeerCertificates[0].Equal(std_cert) {
+		t.Fatal("expected the server certificate")
+	}
+	if tls_info.SecurityLevel != credentials.PrivacyAndIntegrity {
+		t.Fatalf("unexpected security level %v", tls_info.SecurityLevel)
+	}
+	if res.info.AuthType() != "tls" {
+		t.Fatalf("unexpected auth type %q", res.info.AuthType())
+	}
+}
+
+func TestClientHandshakeChecksHostname(t *testing.T) {
+	server_ctx, _ := newServerCtx(t)
+	server_creds, err := NewCredentials(server_ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client_ctx, err := openssl.NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client_creds, err := NewCredentials(client_ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server_raw, client_raw := tcpPipe(t)
+	go func() {
+		conn, _, err := server_creds.ServerHandshake(server_raw)
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	_, _, err = client_creds.ClientHandshake(context.Background(),
+		"other.test:443", client_raw)
+	if err == nil {
+		t.Fatal("expected a hostname mismatch")
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	HandshakeTimeoutError = errors.New("handshake timed out")
+)
+
+// SetHandshakeTimeout limits how long connections made with the context
+// after the call have to complete their first handshake, counting from when
+// they are created with Client or Server. Once the time is up the underlying
+// connection is closed, which fails the handshake whatever is waiting on it:
+// Handshake returns HandshakeTimeoutError, and Read and Write fail as they
+// would on a closed connection. This keeps clients that open connections and
+// then stall from tying up a server's resources. Deadlines set on the
+// connection still apply as well. 0 removes the limit.
+func (c *Ctx) SetHandshakeTimeout(timeout time.Duration) {
+	c.handshake_timeout = timeout
+}
+
+// HandshakeTimeout returns the timeout set with SetHandshakeTimeout.
+func (c *Ctx) HandshakeTimeout() time.Duration {
+	return c.handshake_timeout
+}
+
+func (c *Conn) startHandshakeTimer(timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+	c.handshake_timer = time.AfterFunc(timeout, func() {
+		c.mtx.Lock()
+		if c.handshake_done || c.is_shutdown {
+			c.mtx.Unlock()
+			return
+		}
+		c.handshake_timed_out = true
+		c.mtx.Unlock()
+		c.conn.Close()
+	})
+}
+
+// stopHandshakeTimer is called with c.mtx held.
+func (c *Conn) stopHandshakeTimer() {
+	if c.handshake_timer != nil {
+		c.handshake_timer.Stop()
+		c.handshake_timer = nil
+	}
+}
+
+func (c *Conn) handshakeTimedOut() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.handshake_timed_out
+}
+
+// handshakeListener completes the handshakes of the connections it accepts
+// before handing them out, at most max_pending at a time.
+type handshakeListener struct {
+	*listener
+	pending    chan struct{}
+	conns      chan net.Conn
+	errs       chan error
+	quit       chan struct{}
+	close_once sync.Once
+}
+
+// NewHandshakeListener is like NewListener, except that connections are only
+// returned by Accept once their handshake has completed. Handshakes run in
+// the background, at most max_pending of them at a time: once that many are
+// in progress, the listener stops accepting connections until one of them
+// completes or fails, leaving further clients waiting in the kernel's listen
+// queue. Connections failing their handshake are closed and dropped. Set a
+// handshake timeout on ctx, see Ctx.SetHandshakeTimeout, so that stalled
+// handshakes can't hold on to their slots, and use
+// Ctx.SetMaxRenegotiations to also bound handshakes after the first.
+func NewHandshakeListener(inner net.Listener, ctx *Ctx,
+	max_pending int) (net.Listener, error) {
+	if ctx == nil {
+		return nil, errors.New("no ssl context provided")
+	}
+	if max_pending < 1 {
+		return nil, errors.New("at least one pending handshake is required")
+	}
+	l := &handshakeListener{
+		listener: &listener{
+			Listener: inner,
+			ctx:      ctx},
+		pending: make(chan struct{}, max_pending),
+		conns:   make(chan net.Conn),
+		errs:    make(chan error),
+		quit:    make(chan struct{})}
+	go l.acceptLoop()
+	return l, nil
+}
+
+func (l *handshakeListener) acceptLoop() {
+	for {
+		select {
+		case l.pending <- struct{}{}:
+		case <-l.quit:
+			return
+		}
+		c, err := l.listener.Accept()
+		if err != nil {
+			<-l.pending
+			select {
+			case l.errs <- err:
+			case <-l.quit:
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		go l.handshake(c.(*Conn))
+	}
+}
+
+func (l *handshakeListener) handshake(c *Conn) {
+	err := c.Handshake()
+	<-l.pending
+	if err != nil {
+		c.Close()
+		return
+	}
+	select {
+	case l.conns <- c:
+	case <-l.quit:
+		c.Close()
+	}
+}
+
+func (l *handshakeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.quit:
+		return nil, errors.New("use of closed listener")
+	}
+}
+
+func (l *handshakeListener) Close() error {
+	l.close_once.Do(func() { close(l.quit) })
+	return l.listener.Close()
+}
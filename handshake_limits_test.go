@@ -0,0 +1,174 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHandshakeTimeout(t *testing.T) {
+	ctx := newTestServerCtx(t)
+	ctx.SetHandshakeTimeout(100 * time.Millisecond)
+	server_conn, client_conn := NetPipe(t)
+	defer client_conn.Close()
+	server_conn.SetDeadline(time.Now().Add(10 * time.Second))
+	server, err := Server(server_conn, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	// the client never sends its ClientHello
+	if err := server.Handshake(); err != HandshakeTimeoutError {
+		t.Fatalf("expected HandshakeTimeoutError, got %v", err)
+	}
+}
+
+func TestHandshakeListener(t *testing.T) {
+	ctx := newTestServerCtx(t)
+	ctx.SetHandshakeTimeout(200 * time.Millisecond)
+	inner, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := NewHandshakeListener(inner, ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// holds the only handshake slot until it times out
+	stalled, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+
+	client_ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 1)
+	go func() {
+		conn, err := Dial("tcp", l.Addr().String(), client_ctx,
+			InsecureSkipHostVerification)
+		if err == nil {
+			_, err = conn.Write([]byte("x"))
+			conn.Close()
+		}
+		errs <- err
+	}()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- c
+	}()
+	select {
+	case c := <-accepted:
+		if c == nil {
+			t.FailNow()
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(10 * time.Second))
+		if _, err := c.Read(make([]byte, 1)); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the client's connection")
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMaxRenegotiations(t *testing.T) {
+	MaxRenegotiationsTest(t, func(server_ctx *Ctx) {})
+}
+
+func TestMaxRenegotiationsWithInfoCallbacks(t *testing.T) {
+	// every feature with an info callback, turned on after the limit
+	MaxRenegotiationsTest(t, func(server_ctx *Ctx) {
+		server_ctx.SetInfoCallback(func(conn *Conn, info Info) {})
+		server_ctx.SetMetrics(&HandshakeCounters{})
+	})
+}
+
+func TestMaxRenegotiationsWithMetrics(t *testing.T) {
+	MaxRenegotiationsTest(t, func(server_ctx *Ctx) {
+		server_ctx.SetMetrics(&HandshakeCounters{})
+	})
+}
+
+func TestMaxRenegotiationsAfterInfoCallbackRemoved(t *testing.T) {
+	MaxRenegotiationsTest(t, func(server_ctx *Ctx) {
+		server_ctx.SetInfoCallback(func(conn *Conn, info Info) {})
+		server_ctx.SetInfoCallback(nil)
+	})
+}
+
+// MaxRenegotiationsTest checks that a server limited to one renegotiation
+// refuses the client's second, once setup has configured its context.
+func MaxRenegotiationsTest(t *testing.T, setup func(server_ctx *Ctx)) {
+	server_ctx := newTestServerCtx(t)
+	server_ctx.SetRenegotiationPolicy(RenegotiateFreely)
+	server_ctx.SetMaxRenegotiations(1)
+	setup(server_ctx)
+	client_ctx, err := NewCtxWithVersion(TLSv1_2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client_ctx.SetRenegotiationPolicy(RenegotiateFreely)
+	server_conn, client_conn := NetPipe(t)
+	server_conn.SetDeadline(time.Now().Add(10 * time.Second))
+	client_conn.SetDeadline(time.Now().Add(10 * time.Second))
+	server, err := Server(server_conn, server_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := Client(client_conn, client_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// the server handles the client's renegotiations as it reads
+	errs := make(chan error, 1)
+	go func() {
+		_, err := server.Read(make([]byte, 1))
+		errs <- err
+	}()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Renegotiate(); err != nil {
+		t.Fatal(err)
+	}
+	// fails once the server gives up on the connection
+	go client.Renegotiate()
+	err = <-errs
+	if reneg_err, ok := err.(*RenegotiationError); !ok ||
+		!reneg_err.PeerInitiated || reneg_err.Attempts != 2 {
+		t.Fatalf("expected a RenegotiationError, got %v", err)
+	}
+	server_conn.Close()
+}
@@ -0,0 +1,164 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <openssl/ssl.h>
+#include <openssl/err.h>
+
+extern int ERR_peek_inappropriate_fallback();
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+)
+
+// HandshakeStatus tells the caller of DoHandshakeStep what the handshake is
+// waiting on.
+type HandshakeStatus int
+
+const (
+	// HandshakeWantRead means the handshake needs more input from the peer:
+	// pass it to FeedInput once it arrives, then step again.
+	HandshakeWantRead HandshakeStatus = iota + 1
+	// HandshakeWantWrite means there is output to send to the peer: take it
+	// with TakeOutput, then step again.
+	HandshakeWantWrite
+	// HandshakeComplete means the handshake is done and all of its output
+	// has been taken.
+	HandshakeComplete
+)
+
+func (s HandshakeStatus) String() string {
+	switch s {
+	case HandshakeWantRead:
+		return "want read"
+	case HandshakeWantWrite:
+		return "want write"
+	case HandshakeComplete:
+		return "complete"
+	}
+	return fmt.Sprintf("HandshakeStatus(%d)", int(s))
+}
+
+// DoHandshakeStep advances the handshake as far as it can go without I/O,
+// and returns what it is waiting on instead of blocking, for event loops
+// that read from and write to the peer themselves. The step API never
+// touches the underlying connection: input is handed over with FeedInput,
+// and output is collected with TakeOutput. Step until HandshakeComplete;
+// the status means nothing when err is non-nil.
+//
+// Once the handshake is complete, the connection may be used with Read and
+// Write as usual, which go through the underlying connection, or handed to
+// another goroutine. Don't mix DoHandshakeStep with Handshake, or with Read
+// and Write before the handshake is complete.
+func (c *Conn) DoHandshakeStep() (HandshakeStatus, error) {
+	status, errcb := c.handshakeStep()
+	if errcb != nil {
+		err := errcb()
+		if err == nil || err == io.EOF {
+			// the input ended, if without close_notify as a syscall error
+			// without errno
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	return status, nil
+}
+
+func (c *Conn) handshakeStep() (HandshakeStatus, func() error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.is_shutdown {
+		return 0, func() error { return errors.New("connection closed") }
+	}
+	if err := c.renegotiationError(); err != nil {
+		return 0, func() error { return err }
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	rv, errno := C.SSL_do_handshake(c.ssl)
+	if err := c.renegotiationError(); err != nil {
+		return 0, func() error { return err }
+	}
+	if rv > 0 {
+		c.countHandshake()
+		if c.from_ssl.Buffered() > 0 {
+			return HandshakeWantWrite, nil
+		}
+		return HandshakeComplete, nil
+	}
+	return c.stepError(rv, errno)
+}
+
+// stepError turns a failed SSL call's result into what it is waiting on, or
+// an error, without touching the underlying connection. The caller must hold
+// c.mtx and stay on the OS thread it made the call on.
+func (c *Conn) stepError(rv C.int, errno error) (HandshakeStatus,
+	func() error) {
+	if C.ERR_peek_inappropriate_fallback() == 1 {
+		C.ERR_clear_error()
+		return 0, func() error { return DowngradeDetected }
+	}
+	if err := c.ocsp_err; err != nil {
+		// the alert is left for TakeOutput, unlike in getErrorHandler
+		C.ERR_clear_error()
+		return 0, func() error { return err }
+	}
+	switch C.SSL_get_error(c.ssl, rv) {
+	case C.SSL_ERROR_WANT_READ:
+		if c.from_ssl.Buffered() > 0 {
+			return HandshakeWantWrite, nil
+		}
+		return HandshakeWantRead, nil
+	case C.SSL_ERROR_WANT_WRITE:
+		return HandshakeWantWrite, nil
+	case C.SSL_ERROR_ZERO_RETURN:
+		// the peer sent close_notify
+		return 0, func() error { return io.EOF }
+	}
+	return 0, c.getErrorHandler(rv, errno)
+}
+
+// FeedInput hands bytes received from the peer to the connection, for
+// DoHandshakeStep to process.
+func (c *Conn) FeedInput(b []byte) {
+	c.into_ssl.Write(b)
+}
+
+// FeedEOF tells the connection that the peer has closed its side, failing
+// the handshake once the input fed so far is used up.
+func (c *Conn) FeedEOF() {
+	c.into_ssl.MarkEOF()
+}
+
+// TakeOutput moves up to len(b) bytes the connection has to send to the peer
+// into b, returning how many it moved. See PendingOutput.
+func (c *Conn) TakeOutput(b []byte) int {
+	return c.from_ssl.Read(b)
+}
+
+// PendingOutput returns how many bytes the connection has to send to the
+// peer, which TakeOutput hands over. A failed handshake may leave an alert
+// to send.
+func (c *Conn) PendingOutput() int {
+	return c.from_ssl.Buffered()
+}
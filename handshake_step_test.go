@@ -0,0 +1,100 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"io"
+	"testing"
+)
+
+// shuttle moves from's pending output to to's input.
+func shuttle(from, to *Conn) {
+	buf := make([]byte, 1024)
+	for from.PendingOutput() > 0 {
+		to.FeedInput(buf[:from.TakeOutput(buf)])
+	}
+}
+
+func TestDoHandshakeStep(t *testing.T) {
+	// the step API never touches these, but Read and Write use them after
+	server_conn, client_conn := NetPipe(t)
+	defer server_conn.Close()
+	defer client_conn.Close()
+	server, err := Server(server_conn, newTestServerCtx(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client_ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := Client(client_conn, client_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// drives both ends from this goroutine
+	var client_status, server_status HandshakeStatus
+	for i := 0; client_status != HandshakeComplete ||
+		server_status != HandshakeComplete; i++ {
+		if i > 20 {
+			t.Fatalf("stuck at client %v, server %v", client_status,
+				server_status)
+		}
+		client_status, err = client.DoHandshakeStep()
+		if err != nil {
+			t.Fatal(err)
+		}
+		shuttle(client, server)
+		server_status, err = server.DoHandshakeStep()
+		if err != nil {
+			t.Fatal(err)
+		}
+		shuttle(server, client)
+	}
+
+	go client.Write([]byte("hi"))
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(server, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hi" {
+		t.Fatalf("unexpected data %q", buf)
+	}
+}
+
+func TestDoHandshakeStepEOF(t *testing.T) {
+	server_conn, client_conn := NetPipe(t)
+	defer server_conn.Close()
+	defer client_conn.Close()
+	server, err := Server(server_conn, newTestServerCtx(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	status, err := server.DoHandshakeStep()
+	if err != nil || status != HandshakeWantRead {
+		t.Fatalf("unexpected status %v, error %v", status, err)
+	}
+	server.FeedInput([]byte{22, 3, 1})
+	server.FeedEOF()
+	if _, err := server.DoHandshakeStep(); err == nil {
+		t.Fatal("expected the handshake to fail")
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <stdlib.h>
+#include <string.h>
+
+#include <openssl/evp.h>
+#include <openssl/hmac.h>
+
+static HMAC_CTX *OUR_HMAC_CTX_new() {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+    return HMAC_CTX_new();
+#else
+    HMAC_CTX *ctx = malloc(sizeof(HMAC_CTX));
+    if (ctx != NULL)
+        HMAC_CTX_init(ctx);
+    return ctx;
+#endif
+}
+
+static void OUR_HMAC_CTX_free(HMAC_CTX *ctx) {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+    HMAC_CTX_free(ctx);
+#else
+    HMAC_CTX_cleanup(ctx);
+    free(ctx);
+#endif
+}
+
+int OUR_EVP_MD_size(const EVP_MD *md) { return EVP_MD_size(md); }
+
+int OUR_EVP_MD_block_size(const EVP_MD *md) {
+    return EVP_MD_block_size(md);
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"hash"
+	"runtime"
+	"unsafe"
+)
+
+type hmacHash struct {
+	ctx *C.HMAC_CTX
+	// sum finalizes a copy of ctx, so that Sum leaves the hash running
+	sum        *C.HMAC_CTX
+	size       int
+	block_size int
+}
+
+// NewHMAC returns a hash.Hash computing the HMAC of what is written to it
+// with the given key and digest, using OpenSSL's implementation. It is a
+// drop-in replacement for crypto/hmac's New, e.g.
+//
+//   mac, err := openssl.NewHMAC(key, openssl.SHA256_Method)
+//
+// Like other hash.Hash implementations, it is not safe for concurrent use.
+func NewHMAC(key []byte, method Method) (hash.Hash, error) {
+	if method == nil {
+		return nil, errors.New("openssl: hmac: no digest provided")
+	}
+	h := &hmacHash{
+		ctx:        C.OUR_HMAC_CTX_new(),
+		sum:        C.OUR_HMAC_CTX_new(),
+		size:       int(C.OUR_EVP_MD_size(method)),
+		block_size: int(C.OUR_EVP_MD_block_size(method)),
+	}
+	runtime.SetFinalizer(h, func(h *hmacHash) {
+		if h.ctx != nil {
+			C.OUR_HMAC_CTX_free(h.ctx)
+		}
+		if h.sum != nil {
+			C.OUR_HMAC_CTX_free(h.sum)
+		}
+	})
+	if h.ctx == nil || h.sum == nil {
+		return nil, errors.New("openssl: hmac: cannot allocate ctx")
+	}
+	// HMAC_Init_ex takes a NULL key to mean reusing the last one, so an empty
+	// key must still point somewhere
+	ckey := unsafe.Pointer(&[]byte{0}[0])
+	if len(key) > 0 {
+		ckey = unsafe.Pointer(&key[0])
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.HMAC_Init_ex(h.ctx, ckey, C.int(len(key)), method, nil) != 1 {
+		return nil, errorFromErrorQueue()
+	}
+	return h, nil
+}
+
+func (h *hmacHash) Write(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	defer runtime.KeepAlive(h)
+	if C.HMAC_Update(h.ctx, (*C.uchar)(unsafe.Pointer(&p[0])),
+		C.size_t(len(p))) != 1 {
+		return 0, errors.New("openssl: hmac: cannot update ctx")
+	}
+	return len(p), nil
+}
+
+func (h *hmacHash) Sum(b []byte) []byte {
+	defer runtime.KeepAlive(h)
+	if C.HMAC_CTX_copy(h.sum, h.ctx) != 1 {
+		panic("openssl: hmac: cannot copy ctx")
+	}
+	var result [C.EVP_MAX_MD_SIZE]byte
+	var length C.uint
+	if C.HMAC_Final(h.sum, (*C.uchar)(unsafe.Pointer(&result[0])),
+		&length) != 1 {
+		panic("openssl: hmac: cannot finalize ctx")
+	}
+	return append(b, result[:length]...)
+}
+
+func (h *hmacHash) Reset() {
+	defer runtime.KeepAlive(h)
+	// keeps the key and digest
+	if C.HMAC_Init_ex(h.ctx, nil, 0, nil, nil) != 1 {
+		panic("openssl: hmac: cannot reset ctx")
+	}
+}
+
+func (h *hmacHash) Size() int { return h.size }
+
+func (h *hmacHash) BlockSize() int { return h.block_size }
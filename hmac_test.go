@@ -0,0 +1,99 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"hash"
+	"io"
+	"testing"
+)
+
+func TestHMAC(t *testing.T) {
+	methods := []struct {
+		name   string
+		method Method
+		hash   func() hash.Hash
+	}{
+		{"sha1", SHA1_Method, sha1.New},
+		{"sha256", SHA256_Method, sha256.New},
+		{"sha384", SHA384_Method, sha512.New384},
+		{"sha512", SHA512_Method, sha512.New},
+	}
+	for _, m := range methods {
+		// empty, short and longer than a block
+		for _, key_len := range []int{0, 16, 200} {
+			key := make([]byte, key_len)
+			if _, err := io.ReadFull(rand.Reader, key); err != nil {
+				t.Fatal(err)
+			}
+			mac, err := NewHMAC(key, m.method)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := hmac.New(m.hash, key)
+			if mac.Size() != expected.Size() ||
+				mac.BlockSize() != expected.BlockSize() {
+				t.Fatalf("%s: expected sizes %d/%d, got %d/%d", m.name,
+					expected.Size(), expected.BlockSize(), mac.Size(),
+					mac.BlockSize())
+			}
+			for i := 0; i < 3; i++ {
+				buf := make([]byte, 1024*i+7)
+				if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+					t.Fatal(err)
+				}
+				mac.Write(buf)
+				expected.Write(buf)
+				// Sum leaves the hash running
+				if got := mac.Sum([]byte("x")); !bytes.Equal(got,
+					expected.Sum([]byte("x"))) {
+					t.Fatalf("%s with a %d byte key: exp:%x got:%x", m.name,
+						key_len, expected.Sum(nil), got)
+				}
+			}
+			mac.Reset()
+			expected.Reset()
+			mac.Write([]byte("hello"))
+			expected.Write([]byte("hello"))
+			if !hmac.Equal(mac.Sum(nil), expected.Sum(nil)) {
+				t.Fatalf("%s: mismatch after reset", m.name)
+			}
+		}
+	}
+}
+
+func BenchmarkHMACSHA256(b *testing.B) {
+	key := []byte("0123456789abcdef")
+	buf := make([]byte, 1024)
+	mac, err := NewHMAC(key, SHA256_Method)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mac.Reset()
+		mac.Write(buf)
+		mac.Sum(nil)
+	}
+}
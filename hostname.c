@@ -5,6 +5,7 @@
  */
 
 #include <openssl/x509.h>
+#include <openssl/x509v3.h>
 
 #ifndef X509_CHECK_FLAG_ALWAYS_CHECK_SUBJECT
 
@@ -20,8 +20,11 @@ package openssl
 #include <openssl/ssl.h>
 #include <openssl/conf.h>
 #include <openssl/x509.h>
+#include <openssl/x509v3.h>
 
 #ifndef X509_CHECK_FLAG_ALWAYS_CHECK_SUBJECT
+// hostname.c provides these before OpenSSL 1.0.2
+#define OUR_X509_CHECK_FALLBACK
 #define X509_CHECK_FLAG_ALWAYS_CHECK_SUBJECT	0x1
 #define X509_CHECK_FLAG_NO_WILDCARDS	0x2
 
@@ -32,12 +35,61 @@ extern int X509_check_email(X509 *x, const unsigned char *chk, size_t chklen,
 extern int X509_check_ip(X509 *x, const unsigned char *chk, size_t chklen,
 		unsigned int flags);
 #endif
+
+// OpenSSL's own versions take the names as char
+static int OUR_X509_check_host(X509 *x, const unsigned char *chk,
+        size_t chklen, unsigned int flags) {
+#ifdef OUR_X509_CHECK_FALLBACK
+    return X509_check_host(x, chk, chklen, flags);
+#else
+    return X509_check_host(x, (const char *)chk, chklen, flags, NULL);
+#endif
+}
+
+static int OUR_X509_check_email(X509 *x, const unsigned char *chk,
+        size_t chklen, unsigned int flags) {
+#ifdef OUR_X509_CHECK_FALLBACK
+    return X509_check_email(x, chk, chklen, flags);
+#else
+    return X509_check_email(x, (const char *)chk, chklen, flags);
+#endif
+}
+
+#ifndef X509_CHECK_FLAG_NO_PARTIAL_WILDCARDS
+#define X509_CHECK_FLAG_NO_PARTIAL_WILDCARDS 0x4
+#endif
+
+#ifndef X509_CHECK_FLAG_MULTI_LABEL_WILDCARDS
+#define X509_CHECK_FLAG_MULTI_LABEL_WILDCARDS 0x8
+#endif
+
+#ifndef X509_CHECK_FLAG_NEVER_CHECK_SUBJECT
+#define X509_CHECK_FLAG_NEVER_CHECK_SUBJECT 0x20
+#endif
+
+static int OUR_SSL_set_verify_host(SSL *ssl, const char *host, int is_ip,
+        unsigned int flags) {
+#if OPENSSL_VERSION_NUMBER >= 0x10002000L
+    X509_VERIFY_PARAM *param = SSL_get0_param(ssl);
+    X509_VERIFY_PARAM_set_hostflags(param, flags);
+    // a name set earlier, e.g. by SSL_set1_host for SNI, would have to
+    // match as well, so only one kind is kept
+    if (is_ip)
+        return X509_VERIFY_PARAM_set1_host(param, NULL, 0) &&
+            X509_VERIFY_PARAM_set1_ip_asc(param, host);
+    return X509_VERIFY_PARAM_set1_ip(param, NULL, 0) &&
+        X509_VERIFY_PARAM_set1_host(param, host, 0);
+#else
+    return -1;
+#endif
+}
 */
 import "C"
 
 import (
 	"errors"
 	"net"
+	"runtime"
 	"unsafe"
 )
 
@@ -50,8 +102,67 @@ type CheckFlags int
 const (
 	AlwaysCheckSubject CheckFlags = C.X509_CHECK_FLAG_ALWAYS_CHECK_SUBJECT
 	NoWildcards        CheckFlags = C.X509_CHECK_FLAG_NO_WILDCARDS
+	// NoPartialWildcards refuses wildcards that are only part of a label,
+	// such as "www*.example.com".
+	NoPartialWildcards CheckFlags = C.X509_CHECK_FLAG_NO_PARTIAL_WILDCARDS
+	// MultiLabelWildcards lets a wildcard match several labels.
+	MultiLabelWildcards CheckFlags = C.X509_CHECK_FLAG_MULTI_LABEL_WILDCARDS
+	// NeverCheckSubject never falls back to the subject's common name, even
+	// when the certificate has no DNS names. It is only valid if you are
+	// using OpenSSL 1.1.0 or newer.
+	NeverCheckSubject CheckFlags = C.X509_CHECK_FLAG_NEVER_CHECK_SUBJECT
 )
 
+// SetVerifyHostname makes client connections using the context check the
+// peer certificate against the host name they set with
+// Conn.SetTlsExtHostName, or with Conn.SetVerifyHostname, as part of
+// verifying it during the handshake, like crypto/tls does with ServerName.
+// As with VerifyHostname, names that look like IP addresses are checked
+// against the certificate's IP addresses. A mismatch fails the handshake,
+// with Conn.VerifyResult reporting HostnameMismatch or IPAddressMismatch,
+// provided the certificate is verified at all: clients do so with VerifyPeer.
+// flags adjust the matching as for Certificate.CheckHost. It takes effect
+// for new connections, and requires OpenSSL 1.0.2 or newer.
+func (c *Ctx) SetVerifyHostname(flags CheckFlags) {
+	c.verify_hostname = true
+	c.hostname_flags = flags
+}
+
+// SetVerifyHostname sets the name or IP address the peer certificate must
+// be issued for, checked while it is verified during the handshake. Unlike
+// with Ctx.SetVerifyHostname it need not also be sent with SNI, and servers
+// may use it for client certificates. Call it before the handshake. The
+// flags come from Ctx.SetVerifyHostname, if it was called.
+func (c *Conn) SetVerifyHostname(host string) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.setVerifyHostname(host)
+}
+
+// setVerifyHostname is SetVerifyHostname without the locking. The caller
+// must hold c.mtx.
+func (c *Conn) setVerifyHostname(host string) error {
+	var is_ip C.int
+	if ip := parseHostIP(host); ip != nil {
+		host = ip.String()
+		is_ip = 1
+	}
+	chost := C.CString(host)
+	defer C.free(unsafe.Pointer(chost))
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	switch C.OUR_SSL_set_verify_host(c.ssl, chost, is_ip,
+		C.uint(c.ctx.hostname_flags)) {
+	case 1:
+		return nil
+	case -1:
+		return errors.New(
+			"hostname verification requires OpenSSL 1.0.2 or newer")
+	default:
+		return errorFromErrorQueue()
+	}
+}
+
 // CheckHost checks that the X509 certificate is signed for the provided
 // host name. See http://www.openssl.org/docs/crypto/X509_check_host.html for
 // more. Note that CheckHost does not check the IP field. See VerifyHostname.
@@ -60,7 +171,12 @@ const (
 func (c *Certificate) CheckHost(host string, flags CheckFlags) error {
 	chost := unsafe.Pointer(C.CString(host))
 	defer C.free(chost)
-	rv := C.X509_check_host(c.x, (*C.uchar)(chost), C.size_t(len(host)),
+	x := c.acquireX509()
+	if x == nil {
+		return certificateFreed
+	}
+	defer C.X509_free(x)
+	rv := C.OUR_X509_check_host(x, (*C.uchar)(chost), C.size_t(len(host)),
 		C.uint(flags))
 	if rv > 0 {
 		return nil
@@ -79,8 +195,13 @@ func (c *Certificate) CheckHost(host string, flags CheckFlags) error {
 func (c *Certificate) CheckEmail(email string, flags CheckFlags) error {
 	cemail := unsafe.Pointer(C.CString(email))
 	defer C.free(cemail)
-	rv := C.X509_check_email(c.x, (*C.uchar)(cemail), C.size_t(len(email)),
-		C.uint(flags))
+	x := c.acquireX509()
+	if x == nil {
+		return certificateFreed
+	}
+	defer C.X509_free(x)
+	rv := C.OUR_X509_check_email(x, (*C.uchar)(cemail),
+		C.size_t(len(email)), C.uint(flags))
 	if rv > 0 {
 		return nil
 	}
@@ -97,7 +218,12 @@ func (c *Certificate) CheckEmail(email string, flags CheckFlags) error {
 // there was no internal error.
 func (c *Certificate) CheckIP(ip net.IP, flags CheckFlags) error {
 	cip := unsafe.Pointer(&ip[0])
-	rv := C.X509_check_ip(c.x, (*C.uchar)(cip), C.size_t(len(ip)),
+	x := c.acquireX509()
+	if x == nil {
+		return certificateFreed
+	}
+	defer C.X509_free(x)
+	rv := C.X509_check_ip(x, (*C.uchar)(cip), C.size_t(len(ip)),
 		C.uint(flags))
 	if rv > 0 {
 		return nil
@@ -114,13 +240,7 @@ func (c *Certificate) CheckIP(ip net.IP, flags CheckFlags) error {
 // Specifically returns ValidationError if the Certificate didn't match but
 // there was no internal error.
 func (c *Certificate) VerifyHostname(host string) error {
-	var ip net.IP
-	if len(host) >= 3 && host[0] == '[' && host[len(host)-1] == ']' {
-		ip = net.ParseIP(host[1 : len(host)-1])
-	} else {
-		ip = net.ParseIP(host)
-	}
-	if ip != nil {
+	if ip := parseHostIP(host); ip != nil {
 		return c.CheckIP(ip, 0)
 	}
 	return c.CheckHost(host, 0)
@@ -0,0 +1,130 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !cgo
+
+package openssl
+
+import (
+	"crypto/x509"
+	"errors"
+	"net"
+	"strings"
+)
+
+var (
+	ValidationError = errors.New("Host validation error")
+)
+
+type CheckFlags int
+
+// the values are OpenSSL's
+const (
+	AlwaysCheckSubject  CheckFlags = 0x1
+	NoWildcards         CheckFlags = 0x2
+	NoPartialWildcards  CheckFlags = 0x4
+	MultiLabelWildcards CheckFlags = 0x8
+	NeverCheckSubject   CheckFlags = 0x20
+)
+
+// CheckHost checks that the X509 certificate is signed for the provided
+// host name, as crypto/x509 matches names, which never falls back to the
+// subject's common name. Of the flags, only NoWildcards has an effect.
+// Specifically returns ValidationError if the Certificate didn't match but
+// there was no internal error.
+func (c *Certificate) CheckHost(host string, flags CheckFlags) error {
+	if parseHostIP(host) != nil {
+		return ValidationError
+	}
+	if flags&NoWildcards != 0 {
+		for _, name := range c.x509.DNSNames {
+			if strings.EqualFold(strings.TrimSuffix(host, "."), name) {
+				return nil
+			}
+		}
+		return ValidationError
+	}
+	if c.x509.VerifyHostname(host) != nil {
+		return ValidationError
+	}
+	return nil
+}
+
+// CheckEmail checks that the X509 certificate is signed for the provided
+// email address. Specifically returns ValidationError if the Certificate
+// didn't match but there was no internal error.
+func (c *Certificate) CheckEmail(email string, flags CheckFlags) error {
+	for _, addr := range c.x509.EmailAddresses {
+		if strings.EqualFold(addr, email) {
+			return nil
+		}
+	}
+	return ValidationError
+}
+
+// CheckIP checks that the X509 certificate is signed for the provided
+// IP address. Specifically returns ValidationError if the Certificate didn't
+// match but there was no internal error.
+func (c *Certificate) CheckIP(ip net.IP, flags CheckFlags) error {
+	for _, addr := range c.x509.IPAddresses {
+		if addr.Equal(ip) {
+			return nil
+		}
+	}
+	return ValidationError
+}
+
+// VerifyHostname is a combination of CheckHost and CheckIP. If the provided
+// hostname looks like an IP address, it will be checked as an IP address,
+// otherwise it will be checked as a hostname.
+// Specifically returns ValidationError if the Certificate didn't match but
+// there was no internal error.
+func (c *Certificate) VerifyHostname(host string) error {
+	if ip := parseHostIP(host); ip != nil {
+		return c.CheckIP(ip, 0)
+	}
+	return c.CheckHost(host, 0)
+}
+
+// verifyChain verifies the certificate the peer presented first against
+// roots, with the rest as intermediates, for use as usage, and for host
+// unless it is empty.
+func verifyChain(raw [][]byte, roots *x509.CertPool, usage x509.ExtKeyUsage,
+	host string) error {
+	if len(raw) == 0 {
+		return errors.New("peer presented no certificate")
+	}
+	certs := make([]*x509.Certificate, 0, len(raw))
+	for _, der := range raw {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{usage}}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(opts); err != nil {
+		return err
+	}
+	if host == "" {
+		return nil
+	}
+	return (&Certificate{x509: certs[0]}).VerifyHostname(host)
+}
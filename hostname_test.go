@@ -0,0 +1,118 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"encoding/asn1"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestVerifyHostnameDuringHandshake(t *testing.T) {
+	key := generateTestRSAKey(t)
+	cert, err := NewCertificate(&CertificateInfo{
+		Serial:     big.NewInt(1),
+		NotBefore:  time.Now().Add(-time.Hour),
+		NotAfter:   time.Now().Add(time.Hour),
+		CommonName: "www.example.com",
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	san, err := asn1.Marshal([]asn1.RawValue{
+		{Class: 2, Tag: 2, Bytes: []byte("*.example.com")},
+		{Class: 2, Tag: 7, Bytes: net.ParseIP("127.0.0.1").To4()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.AddExtensionDER("2.5.29.17", false, san); err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.Sign(key, SHA256_Method); err != nil {
+		t.Fatal(err)
+	}
+	server_ctx := newSharedCtx(t, key, cert, cert)
+
+	client_ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client_ctx.GetCertificateStore().AddCertificate(cert); err != nil {
+		t.Fatal(err)
+	}
+	client_ctx.SetVerifyMode(VerifyPeer)
+	client_ctx.SetVerifyHostname(NoPartialWildcards)
+
+	// handshake connects with SNI set to sni, and with the name to verify
+	// overridden by host if it isn't empty
+	handshake := func(sni, host string) (VerifyResult, error) {
+		server_conn, client_conn := NetPipe(t)
+		defer server_conn.Close()
+		defer client_conn.Close()
+		server_conn.SetDeadline(time.Now().Add(10 * time.Second))
+		client_conn.SetDeadline(time.Now().Add(10 * time.Second))
+		server, err := Server(server_conn, server_ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+		client, err := Client(client_conn, client_ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		if err := client.SetTlsExtHostName(sni); err != nil {
+			t.Skip(err)
+		}
+		if host != "" {
+			if err := client.SetVerifyHostname(host); err != nil {
+				t.Fatal(err)
+			}
+		}
+		go server.Handshake()
+		err = client.Handshake()
+		return client.VerifyResult(), err
+	}
+
+	if _, err := handshake("api.example.com", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, sni := range []string{"example.com", "a.b.example.com",
+		"www.example.org"} {
+		result, err := handshake(sni, "")
+		if err == nil {
+			t.Fatalf("expected %q not to match", sni)
+		}
+		if result != HostnameMismatch {
+			t.Fatalf("expected HostnameMismatch for %q, got %d", sni, result)
+		}
+	}
+
+	if _, err := handshake("localhost", "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	result, err := handshake("localhost", "[127.0.0.2]")
+	if err == nil {
+		t.Fatal("expected 127.0.0.2 not to match")
+	}
+	if result != IPAddressMismatch {
+		t.Fatalf("expected IPAddressMismatch, got %d", result)
+	}
+}
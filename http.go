@@ -15,11 +15,24 @@
 package openssl
 
 import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
 )
 
 // ListenAndServeTLS will take an http.Handler and serve it using OpenSSL over
 // the given tcp address, configured to use the provided cert and key files.
+// Clients may use HTTP/1.1 or HTTP/2, see HTTPServer.
 func ListenAndServeTLS(addr string, cert_file string, key_file string,
 	handler http.Handler) error {
 	return ServerListenAndServeTLS(
@@ -27,35 +40,472 @@ func ListenAndServeTLS(addr string, cert_file string, key_file string,
 }
 
 // ServerListenAndServeTLS will take an http.Server and serve it using OpenSSL
-// configured to use the provided cert and key files.
+// configured to use the provided cert and key files. Clients may use
+// HTTP/1.1 or HTTP/2, see HTTPServer.
 func ServerListenAndServeTLS(srv *http.Server,
 	cert_file, key_file string) error {
-	addr := srv.Addr
+	ctx, err := NewCtxFromFiles(cert_file, key_file)
+	if err != nil {
+		return err
+	}
+	return (&HTTPServer{Server: srv, Ctx: ctx}).ListenAndServe()
+}
+
+// ListenAndServeTLSWithCtx is like ListenAndServeTLS, serving with the
+// prebuilt context ctx rather than one loaded from files.
+func ListenAndServeTLSWithCtx(addr string, ctx *Ctx,
+	handler http.Handler) error {
+	return (&HTTPServer{
+		Server: &http.Server{Addr: addr, Handler: handler},
+		Ctx:    ctx}).ListenAndServe()
+}
+
+// ListenAndServeTLSFromPEM is like ListenAndServeTLS, with the certificate
+// chain, leaf first, and the private key given as PEM rather than read from
+// files, so that credentials injected through the environment or a mounted
+// secret need not be written out first.
+func ListenAndServeTLSFromPEM(addr string, cert_pem, key_pem []byte,
+	handler http.Handler) error {
+	ctx, err := newCtxFromPEM(cert_pem, key_pem)
+	if err != nil {
+		return err
+	}
+	return ListenAndServeTLSWithCtx(addr, ctx, handler)
+}
+
+// ServeTLS serves handler over OpenSSL connections using ctx, wrapping those
+// l accepts. l is a plain listener, such as one from net.Listen or inherited
+// through socket activation.
+func ServeTLS(l net.Listener, ctx *Ctx, handler http.Handler) error {
+	return (&HTTPServer{
+		Server: &http.Server{Handler: handler},
+		Ctx:    ctx}).Serve(NewListener(l, ctx))
+}
+
+// newCtxFromPEM calls NewCtx and configures the context with the certificate
+// chain in cert_pem and the unencrypted private key in key_pem.
+func newCtxFromPEM(cert_pem, key_pem []byte) (*Ctx, error) {
+	ctx, err := NewCtx()
+	if err != nil {
+		return nil, err
+	}
+	certs := 0
+	for rest := cert_pem; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := LoadCertificateFromDER(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if certs == 0 {
+			err = ctx.UseCertificate(cert)
+		} else {
+			err = ctx.AddChainCertificate(cert)
+		}
+		if err != nil {
+			return nil, err
+		}
+		certs++
+	}
+	if certs == 0 {
+		return nil, errors.New("no certificate found in PEM data")
+	}
+	key, err := LoadPrivateKeyFromPEM(key_pem)
+	if err != nil {
+		return nil, err
+	}
+	err = ctx.UsePrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return ctx, nil
+}
+
+// HTTPServer serves HTTP over OpenSSL connections, negotiating HTTP/2 or
+// another protocol with ALPN like http.Server does over crypto/tls.
+// Connections that negotiate no protocol or "http/1.1" are served by the
+// http.Server. The embedded server's TLSConfig and TLSNextProto are not
+// used, and neither are its ServeTLS and ListenAndServeTLS methods, which
+// use crypto/tls; Shutdown and Close work as usual.
+type HTTPServer struct {
+	*http.Server
+	// Ctx is the server context. Serve sets its ALPN protocols.
+	Ctx *Ctx
+	// NextProto maps the ALPN protocols to offer besides "http/1.1" to the
+	// functions serving connections that negotiate them, like http.Server's
+	// TLSNextProto. conn is closed once the function returns. If NextProto
+	// is nil, "h2" is served with golang.org/x/net/http2; set it to an
+	// empty map to serve HTTP/1.1 only.
+	NextProto map[string]func(srv *http.Server, conn *Conn, h http.Handler)
+	// HTTP2 configures HTTP/2 when NextProto is nil. If it is nil, the
+	// http2 package's defaults are used.
+	HTTP2 *http2.Server
+	// ListenFlags are the socket options ListenAndServe listens with.
+	ListenFlags ListenFlags
+	// Listeners is the number of listeners ListenAndServe binds to the
+	// address with ListenReusePort, each with its own accept loop, see
+	// ListenMulti. Values below 2 mean a single listener.
+	Listeners int
+}
+
+// ListenAndServe listens on the TCP address s.Addr, or ":https" if it is
+// empty, and serves connections with Serve. When s.Listeners is above 1,
+// it serves them on all listeners until one of them fails or the server is
+// shut down, closing the rest and returning the first error.
+func (s *HTTPServer) ListenAndServe() error {
+	if s.Ctx == nil {
+		return errors.New("no ssl context provided")
+	}
+	addr := s.Addr
 	if addr == "" {
 		addr = ":https"
 	}
-
-	ctx, err := NewCtxFromFiles(cert_file, key_file)
+	if s.Listeners < 2 {
+		l, err := ListenWithFlags("tcp", addr, s.Ctx, s.ListenFlags)
+		if err != nil {
+			return err
+		}
+		return s.Serve(l)
+	}
+	listeners, err := ListenMulti("tcp", addr, s.Ctx, s.Listeners,
+		s.ListenFlags)
+	if err != nil {
+		return err
+	}
+	next_proto, err := s.configureNextProto()
 	if err != nil {
+		for _, l := range listeners {
+			l.Close()
+		}
 		return err
 	}
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			errs <- s.serve(l, next_proto)
+		}(l)
+	}
+	err = <-errs
+	for _, l := range listeners {
+		l.Close()
+	}
+	return err
+}
 
-	l, err := Listen("tcp", addr, ctx)
+// Serve serves the OpenSSL connections l accepts, as from Listen or
+// NewListener, until l fails or the server is shut down, returning the error
+// as http.Server's Serve does. Handshakes happen off the accept loop, and
+// are bounded by the server's read and write timeouts.
+func (s *HTTPServer) Serve(l net.Listener) error {
+	if s.Ctx == nil {
+		return errors.New("no ssl context provided")
+	}
+	next_proto, err := s.configureNextProto()
 	if err != nil {
 		return err
 	}
+	return s.serve(l, next_proto)
+}
 
-	return srv.Serve(l)
+// configureNextProto sets up HTTP/2 when NextProto is nil and offers the
+// protocols served with ALPN, returning the functions serving them.
+func (s *HTTPServer) configureNextProto() (
+	map[string]func(*http.Server, *Conn, http.Handler), error) {
+	next_proto := s.NextProto
+	if next_proto == nil {
+		h2 := s.HTTP2
+		if h2 == nil {
+			h2 = new(http2.Server)
+		}
+		// shuts HTTP/2 connections down gracefully along with the server
+		if err := http2.ConfigureServer(s.Server, h2); err != nil {
+			return nil, err
+		}
+		next_proto = map[string]func(*http.Server, *Conn, http.Handler){
+			http2.NextProtoTLS: func(srv *http.Server, conn *Conn,
+				h http.Handler) {
+				h2.ServeConn(conn, &http2.ServeConnOpts{
+					BaseConfig: srv,
+					Handler:    h})
+			}}
+	}
+	protos := make([]string, 0, len(next_proto)+1)
+	if _, ok := next_proto[http2.NextProtoTLS]; ok {
+		protos = append(protos, http2.NextProtoTLS)
+	}
+	for proto := range next_proto {
+		if proto != http2.NextProtoTLS {
+			protos = append(protos, proto)
+		}
+	}
+	if err := s.Ctx.SetAlpnProtos(append(protos, "http/1.1")); err != nil {
+		return nil, err
+	}
+	return next_proto, nil
+}
+
+func (s *HTTPServer) serve(l net.Listener,
+	next_proto map[string]func(*http.Server, *Conn, http.Handler)) error {
+	nl := &nextProtoListener{
+		Listener:   l,
+		srv:        s.Server,
+		next_proto: next_proto,
+		conns:      make(chan net.Conn),
+		errs:       make(chan error),
+		quit:       make(chan struct{})}
+	go nl.acceptLoop()
+	return s.Server.Serve(nl)
+}
+
+// nextProtoListener hands the http.Server the connections it accepts that
+// negotiated no other protocol, serving the rest itself.
+type nextProtoListener struct {
+	net.Listener
+	srv        *http.Server
+	next_proto map[string]func(*http.Server, *Conn, http.Handler)
+	conns      chan net.Conn
+	errs       chan error
+	quit       chan struct{}
+	close_once sync.Once
+}
+
+func (l *nextProtoListener) acceptLoop() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.quit:
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		go l.dispatch(c)
+	}
+}
+
+func (l *nextProtoListener) dispatch(c net.Conn) {
+	if conn, ok := c.(*Conn); ok {
+		if timeout := handshakeTimeout(l.srv); timeout > 0 {
+			conn.SetDeadline(time.Now().Add(timeout))
+		}
+		err := conn.Handshake()
+		if err == nil {
+			err = conn.SetDeadline(time.Time{})
+		}
+		if err != nil {
+			if l.srv.ErrorLog != nil {
+				l.srv.ErrorLog.Printf("http: TLS handshake error from %s: %v",
+					conn.RemoteAddr(), err)
+			}
+			conn.Close()
+			return
+		}
+		if fn := l.next_proto[conn.NegotiatedProtocol()]; fn != nil {
+			defer conn.Close()
+			h := l.srv.Handler
+			if h == nil {
+				h = http.DefaultServeMux
+			}
+			fn(l.srv, conn, h)
+			return
+		}
+	}
+	select {
+	case l.conns <- c:
+	case <-l.quit:
+		c.Close()
+	}
+}
+
+func (l *nextProtoListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.quit:
+		return nil, errors.New("use of closed listener")
+	}
 }
 
-// TODO: http client integration
-// holy crap, getting this integrated nicely with the Go stdlib HTTP client
-// stack so that it does proxying, connection pooling, and most importantly
-// hostname verification is really hard. So much stuff is hardcoded to just use
-// the built-in TLS lib. I think to get this to work either some crazy
-// hacktackery beyond me, an almost straight up fork of the HTTP client, or
-// serious stdlib internal refactoring is necessary.
-// even more so, good luck getting openssl to use the operating system default
-// root certificates if the user doesn't provide any. sadlol
-// NOTE: if you're going to try and write your own round tripper, at least use
-//  openssl.Dial, or equivalent logic
+func (l *nextProtoListener) Close() error {
+	l.close_once.Do(func() { close(l.quit) })
+	return l.Listener.Close()
+}
+
+// handshakeTimeout is the shortest of srv's read and write timeouts, as
+// http.Server bounds crypto/tls handshakes, or 0 for none.
+func handshakeTimeout(srv *http.Server) time.Duration {
+	var timeout time.Duration
+	for _, t := range []time.Duration{srv.ReadTimeout, srv.WriteTimeout} {
+		if t > 0 && (timeout == 0 || t < timeout) {
+			timeout = t
+		}
+	}
+	return timeout
+}
+
+// NewTransport returns an http.Transport making https requests over OpenSSL
+// client connections using ctx, dialed as by Dial, so the server's host name
+// is checked against its certificate. Like http.DefaultTransport, it pools
+// connections, keeps them alive and goes through the proxies named by the
+// environment, see http.ProxyFromEnvironment. Requests use HTTP/1.1, as
+// net/http only speaks HTTP/2 over crypto/tls.
+//
+// As with Dial, ctx needs roots to verify servers with, e.g. from
+// Ctx.SetDefaultVerifyPaths.
+func NewTransport(ctx *Ctx) *http.Transport {
+	return NewTransportWithProxy(ctx, http.ProxyFromEnvironment)
+}
+
+// NewTransportWithProxy is like NewTransport, with proxy picking the proxy
+// for each request like http.Transport's Proxy. https requests are tunneled
+// through http proxies with CONNECT, or through socks5 proxies. The
+// transport's Proxy field only applies to plain http requests, and must not
+// be changed, or https requests through proxies would use crypto/tls. https
+// proxies are not supported.
+func NewTransportWithProxy(ctx *Ctx,
+	proxy func(*http.Request) (*url.URL, error)) *http.Transport {
+	return newTransport(ctx, proxy, nil)
+}
+
+// newTransport builds the transports of NewTransportWithProxy, calling check,
+// if not nil, on each https connection once it is dialed, and closing the
+// connection if it returns an error.
+func newTransport(ctx *Ctx, proxy func(*http.Request) (*url.URL, error),
+	check func(*Conn) error) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second}
+	return &http.Transport{
+		Proxy: func(req *http.Request) (*url.URL, error) {
+			if req.URL.Scheme == "https" || proxy == nil {
+				return nil, nil
+			}
+			proxy_url, err := proxy(req)
+			if err == nil && proxy_url != nil &&
+				proxy_url.Scheme == "https" {
+				// it would be dialed as if it were the server
+				return nil, errors.New("https proxies are not supported")
+			}
+			return proxy_url, err
+		},
+		DialContext: dialer.DialContext,
+		DialTLSContext: func(dial_ctx context.Context, network,
+			addr string) (net.Conn, error) {
+			c, err := dialHTTPS(dial_ctx, network, addr, ctx, proxy)
+			if err != nil || check == nil {
+				return c, err
+			}
+			if conn, ok := c.(*Conn); ok {
+				if err := check(conn); err != nil {
+					c.Close()
+					return nil, err
+				}
+			}
+			return c, nil
+		},
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second}
+}
+
+// dialHTTPS dials addr for an https request, through the proxy proxy picks
+// for it.
+func dialHTTPS(dial_ctx context.Context, network, addr string, ctx *Ctx,
+	proxy func(*http.Request) (*url.URL, error)) (net.Conn, error) {
+	d := Dialer{Ctx: ctx}
+	var proxy_url *url.URL
+	if proxy != nil {
+		var err error
+		proxy_url, err = proxy(&http.Request{
+			URL: &url.URL{Scheme: "https", Host: addr}})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if proxy_url == nil {
+		return d.DialContext(dial_ctx, network, addr)
+	}
+	proxy_addr := proxy_url.Host
+	if proxy_url.Port() == "" {
+		proxy_addr = net.JoinHostPort(proxy_url.Hostname(), "1080")
+		if proxy_url.Scheme == "http" || proxy_url.Scheme == "" {
+			proxy_addr = net.JoinHostPort(proxy_url.Hostname(), "80")
+		}
+	}
+	switch proxy_url.Scheme {
+	case "socks5", "socks5h":
+		d.Proxy = &SOCKS5Proxy{Addr: proxy_addr}
+		if proxy_url.User != nil {
+			d.Proxy.Username = proxy_url.User.Username()
+			d.Proxy.Password, _ = proxy_url.User.Password()
+		}
+		return d.DialContext(dial_ctx, network, addr)
+	case "http", "":
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		c, err := dialHappyEyeballs(dial_ctx, "tcp", proxy_addr, 0)
+		if err != nil {
+			return nil, err
+		}
+		c, err = negotiateProxy(dial_ctx, c, func() error {
+			return httpConnect(c, addr, proxy_url.User)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return handshakeContext(dial_ctx, c,
+			func(c net.Conn) (*Conn, error) {
+				return d.handshake(c, ctx, addr, host)
+			})
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q",
+			proxy_url.Scheme)
+	}
+}
+
+// httpConnect asks the http proxy on the other end of c to tunnel it to
+// addr.
+func httpConnect(c net.Conn, addr string, user *url.Userinfo) error {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header)}
+	if user != nil {
+		password, _ := user.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+
+			base64.StdEncoding.EncodeToString(
+				[]byte(user.Username()+":"+password)))
+	}
+	if err := req.Write(c); err != nil {
+		return err
+	}
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("proxy refused to connect to %s: %s", addr,
+			resp.Status)
+	}
+	// the server speaks first only once it has our ClientHello
+	if br.Buffered() > 0 {
+		return errors.New("proxy sent data before the tunnel was used")
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// RevocationOptions say how a RevocationTransport checks whether server
+// certificates have been revoked.
+type RevocationOptions struct {
+	// OCSP, if set, checks certificates with the OCSP response the server
+	// staples, or failing that, one it fetches from the issuer's responder.
+	// Its own policy is not used.
+	OCSP *OCSPChecker
+	// CRLs, if set, checks certificates against the CRLs it keeps, see
+	// CRLManager.Check. Managers created with no context are the ones to
+	// use, as a context's manager fails its handshakes with peers it has no
+	// CRL for whatever the policy.
+	CRLs *CRLManager
+	// Policy is what requests do with certificates whose status neither
+	// source can find out, unless their context says otherwise with
+	// WithRevocationPolicy.
+	Policy OCSPPolicy
+}
+
+// RevocationTransport is an http.RoundTripper like NewTransport's which
+// checks the certificate of each server it connects to for revocation
+// before sending requests over the connection. Certificates reported as
+// revoked by any source fail the request with OCSPRevoked or CRLRevoked.
+// Certificates whose status is unknown fail it only under OCSPHardFail.
+// Certificates trusted directly, with no issuer in their verified chain,
+// aren't checked.
+//
+// Connections are pooled per policy, so a connection accepted under
+// OCSPSoftFail is never reused by a request asking for OCSPHardFail.
+type RevocationTransport struct {
+	policy OCSPPolicy
+	soft   *http.Transport
+	hard   *http.Transport
+}
+
+// NewRevocationTransport returns a transport making https requests over
+// OpenSSL client connections using ctx, as NewTransport does, and checking
+// server certificates as opts say. When opts has an OCSPChecker, ctx is set
+// to ask servers for OCSP staples, keeping any flags already given to
+// Ctx.RequestOCSPStaple.
+func NewRevocationTransport(ctx *Ctx,
+	opts RevocationOptions) (*RevocationTransport, error) {
+	if opts.OCSP == nil && opts.CRLs == nil {
+		return nil, errors.New("no OCSP checker or CRL manager provided")
+	}
+	if opts.OCSP != nil {
+		ctx.ocsp_mtx.Lock()
+		flags := ctx.ocsp_client_flags
+		ctx.ocsp_mtx.Unlock()
+		// without staples, every connection asks the responder
+		if err := ctx.RequestOCSPStaple(flags); err != nil {
+			logger.Warnf("openssl: not requesting OCSP staples: %v", err)
+		}
+	}
+	t := &RevocationTransport{policy: opts.Policy}
+	t.soft = newTransport(ctx, http.ProxyFromEnvironment,
+		func(conn *Conn) error {
+			return checkRevocation(conn, opts, OCSPSoftFail)
+		})
+	t.hard = newTransport(ctx, http.ProxyFromEnvironment,
+		func(conn *Conn) error {
+			return checkRevocation(conn, opts, OCSPHardFail)
+		})
+	return t, nil
+}
+
+type revocationPolicyKey struct{}
+
+// WithRevocationPolicy returns a copy of parent making requests sent with it
+// through a RevocationTransport use policy in place of the transport's.
+func WithRevocationPolicy(parent context.Context,
+	policy OCSPPolicy) context.Context {
+	return context.WithValue(parent, revocationPolicyKey{}, policy)
+}
+
+// RoundTrip sends req over a connection whose server certificate passed the
+// checks under the request's policy.
+func (t *RevocationTransport) RoundTrip(req *http.Request) (*http.Response,
+	error) {
+	policy := t.policy
+	if p, ok := req.Context().Value(revocationPolicyKey{}).(OCSPPolicy); ok {
+		policy = p
+	}
+	if policy == OCSPHardFail {
+		return t.hard.RoundTrip(req)
+	}
+	return t.soft.RoundTrip(req)
+}
+
+// CloseIdleConnections closes the idle connections of both policies.
+func (t *RevocationTransport) CloseIdleConnections() {
+	t.soft.CloseIdleConnections()
+	t.hard.CloseIdleConnections()
+}
+
+// checkRevocation checks the certificate of the server on the other end of
+// conn with the sources in opts, refusing it if one reports it as revoked,
+// or if none can find out its status and policy is OCSPHardFail.
+func checkRevocation(conn *Conn, opts RevocationOptions,
+	policy OCSPPolicy) error {
+	chain, err := conn.VerifiedChain()
+	if err != nil {
+		return unknownRevocationStatus(err, policy)
+	}
+	defer func() {
+		for _, cert := range chain {
+			cert.Free()
+		}
+	}()
+	if len(chain) < 2 {
+		return nil
+	}
+	leaf, issuer := chain[0], chain[1]
+	known := false
+	var unknown error
+	if opts.OCSP != nil {
+		err := checkStapledOCSP(conn.OCSPResponse(), leaf, issuer)
+		if err != nil && err != OCSPRevoked {
+			err = opts.OCSP.check(leaf, issuer)
+		}
+		switch err {
+		case nil:
+			known = true
+		case OCSPRevoked:
+			return err
+		default:
+			unknown = err
+		}
+	}
+	if opts.CRLs != nil {
+		switch err := opts.CRLs.Check(leaf, issuer); err {
+		case nil:
+			known = true
+		case CRLRevoked:
+			return err
+		default:
+			if unknown == nil {
+				unknown = err
+			}
+		}
+	}
+	if known {
+		return nil
+	}
+	return unknownRevocationStatus(unknown, policy)
+}
+
+// unknownRevocationStatus returns the error to fail a connection whose
+// certificate's status couldn't be found out because of err with, if policy
+// says to.
+func unknownRevocationStatus(err error, policy OCSPPolicy) error {
+	if policy == OCSPHardFail {
+		return fmt.Errorf("openssl: certificate revocation status "+
+			"unknown: %v", err)
+	}
+	logger.Warnf("openssl: accepting certificate with unknown "+
+		"revocation status: %v", err)
+	return nil
+}
@@ -0,0 +1,173 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// serveTestHello serves "hello" over https on localhost with server_ctx,
+// returning the URL to request it at.
+func serveTestHello(t *testing.T, server_ctx *Ctx) (string, io.Closer) {
+	l, err := Listen("tcp", "127.0.0.1:0", server_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "hello")
+		})}
+	go srv.Serve(l)
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "https://localhost:" + port + "/", l
+}
+
+func TestRevocationTransport(t *testing.T) {
+	ca_key := generateTestRSAKey(t)
+	ca := issueTestCert(t, ca_key, testCert{CA: true})
+	responder := newTestOCSPResponder(t, ca, ca_key)
+	defer responder.Close()
+	responder.SetStatus(7, "V")
+	crl_server := newTestCRLServer(t, ca, ca_key)
+	defer crl_server.Close()
+
+	key := generateTestRSAKey(t)
+	leaf := issueTestCert(t, key, testCert{Serial: 7, Issuer: ca,
+		IssuerKey: ca_key, OCSPServer: responder.URL(),
+		CRLDistributionPoints: []string{crl_server.URL()}})
+	server_ctx := newSharedCtx(t, key, leaf, ca)
+	good_url, l := serveTestHello(t, server_ctx)
+	defer l.Close()
+	// the responder doesn't know this one
+	unknown_key := generateTestRSAKey(t)
+	unknown_leaf := issueTestCert(t, unknown_key, testCert{Serial: 8,
+		Issuer: ca, IssuerKey: ca_key, OCSPServer: responder.URL()})
+	unknown_url, l := serveTestHello(t,
+		newSharedCtx(t, unknown_key, unknown_leaf, ca))
+	defer l.Close()
+
+	client_ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client_ctx.GetCertificateStore().AddCertificate(
+		ca); err != nil {
+		t.Fatal(err)
+	}
+	client_ctx.SetVerifyMode(VerifyPeer)
+	http_client := responder.server.Client()
+	get := func(transport *RevocationTransport, url string,
+		policy *OCSPPolicy) error {
+		transport.CloseIdleConnections()
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if policy != nil {
+			req = req.WithContext(
+				WithRevocationPolicy(context.Background(), *policy))
+		}
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != "hello" {
+			t.Fatalf("unexpected body %q", body)
+		}
+		return nil
+	}
+	hard_fail := OCSPHardFail
+
+	if _, err := NewRevocationTransport(client_ctx,
+		RevocationOptions{}); err == nil {
+		t.Fatal("expected an error without a checker or CRL manager")
+	}
+	transport, err := NewRevocationTransport(client_ctx, RevocationOptions{
+		OCSP: NewOCSPChecker(http_client, OCSPHardFail)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := get(transport, good_url, nil); err != nil {
+		t.Fatal(err)
+	}
+	// unknown statuses are only refused when the request asks for it
+	if err := get(transport, unknown_url, nil); err != nil {
+		t.Fatalf("expected the unknown status to be accepted: %v", err)
+	}
+	if err := get(transport, unknown_url, &hard_fail); err == nil {
+		t.Fatal("expected the unknown status to be refused")
+	}
+
+	// a good staple stands in for the responder
+	staple, _, err := fetchOCSPResponse(http_client, responder.URL(), leaf,
+		ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server_ctx.SetOCSPStaple(staple)
+	responder.SetStatus(7, "R")
+	transport, err = NewRevocationTransport(client_ctx, RevocationOptions{
+		OCSP:   NewOCSPChecker(http_client, OCSPSoftFail),
+		Policy: OCSPHardFail})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := get(transport, good_url, nil); err != nil {
+		t.Fatalf("expected the staple to be used: %v", err)
+	}
+	server_ctx.SetOCSPStaple(nil)
+	if err := get(transport, good_url, nil); err != OCSPRevoked {
+		t.Fatalf("expected a revoked certificate, got %v", err)
+	}
+
+	manager, err := NewCRLManager(nil, crl_server.server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+	if err := manager.AddCertificate(leaf, ca); err != nil {
+		t.Fatal(err)
+	}
+	transport, err = NewRevocationTransport(client_ctx, RevocationOptions{
+		CRLs: manager})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := get(transport, good_url, &hard_fail); err != nil {
+		t.Fatal(err)
+	}
+	crl_server.Revoke(7)
+	if err := manager.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if err := get(transport, good_url, nil); err != CRLRevoked {
+		t.Fatalf("expected a revoked certificate, got %v", err)
+	}
+}
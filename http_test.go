@@ -0,0 +1,272 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// newTestHTTPSServer serves "hello" over https on localhost with a fresh
+// certificate, returning the port and a client context trusting it.
+func newTestHTTPSServer(t *testing.T) (port string, client_ctx *Ctx,
+	closer io.Closer) {
+	key := generateTestRSAKey(t)
+	cert := issueTestCert(t, key, testCert{})
+	server_ctx := newSharedCtx(t, key, cert, cert)
+	l, err := Listen("tcp", "127.0.0.1:0", server_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &HTTPServer{
+		Server: &http.Server{Handler: http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, r.Proto+" hello")
+			})},
+		Ctx: server_ctx}
+	go srv.Serve(l)
+	_, port, err = net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client_ctx, err = NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client_ctx.GetCertificateStore().AddCertificate(cert); err != nil {
+		t.Fatal(err)
+	}
+	client_ctx.SetVerifyMode(VerifyPeer)
+	return port, client_ctx, l
+}
+
+func getHello(t *testing.T, transport http.RoundTripper, url string,
+	proto string) {
+	client := &http.Client{Transport: transport}
+	// the second request reuses the connection
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != proto+" hello" {
+			t.Fatalf("unexpected body %q", body)
+		}
+	}
+}
+
+func TestNewTransport(t *testing.T) {
+	port, client_ctx, l := newTestHTTPSServer(t)
+	defer l.Close()
+	transport := NewTransportWithProxy(client_ctx, nil)
+	defer transport.CloseIdleConnections()
+	getHello(t, transport, "https://localhost:"+port+"/", "HTTP/1.1")
+
+	_, err := transport.RoundTrip(&http.Request{
+		Method: "GET",
+		URL:    &url.URL{Scheme: "https", Host: "127.0.0.2:" + port}})
+	if err == nil {
+		t.Fatal("expected a host name mismatch")
+	}
+}
+
+func TestNewTransportConnectProxy(t *testing.T) {
+	port, client_ctx, l := newTestHTTPSServer(t)
+	defer l.Close()
+
+	connects := make(chan *http.Request, 1)
+	proxy_l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy_l.Close()
+	go http.Serve(proxy_l, http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			connects <- r
+			if r.Method != "CONNECT" {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			target, err := net.Dial("tcp", "127.0.0.1:"+port)
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			defer target.Close()
+			w.WriteHeader(http.StatusOK)
+			c, brw, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			brw.Flush()
+			go io.Copy(target, c)
+			io.Copy(c, target)
+		}))
+
+	proxy_url := &url.URL{Scheme: "http", Host: proxy_l.Addr().String(),
+		User: url.UserPassword("user", "secret")}
+	transport := NewTransportWithProxy(client_ctx, http.ProxyURL(proxy_url))
+	defer transport.CloseIdleConnections()
+	getHello(t, transport, "https://localhost:"+port+"/", "HTTP/1.1")
+
+	r := <-connects
+	if r.Method != "CONNECT" || r.Host != "localhost:"+port {
+		t.Fatalf("unexpected request %s %s", r.Method, r.Host)
+	}
+	user, password, ok := (&http.Request{Header: http.Header{
+		"Authorization": r.Header["Proxy-Authorization"]}}).BasicAuth()
+	if !ok || user != "user" || password != "secret" {
+		t.Fatalf("unexpected credentials %q", r.Header["Proxy-Authorization"])
+	}
+}
+
+func TestHTTPServerHTTP2(t *testing.T) {
+	port, client_ctx, l := newTestHTTPSServer(t)
+	defer l.Close()
+	if err := client_ctx.SetAlpnProtos([]string{"h2"}); err != nil {
+		t.Fatal(err)
+	}
+	transport := &http2.Transport{
+		DialTLSContext: func(ctx context.Context, network, addr string,
+			cfg *tls.Config) (net.Conn, error) {
+			conn, err := Dial(network, addr, client_ctx, 0)
+			if err != nil {
+				return nil, err
+			}
+			if proto := conn.NegotiatedProtocol(); proto != "h2" {
+				conn.Close()
+				return nil, fmt.Errorf("negotiated %q", proto)
+			}
+			return conn, nil
+		}}
+	defer transport.CloseIdleConnections()
+	getHello(t, transport, "https://localhost:"+port+"/", "HTTP/2.0")
+}
+
+func TestServeTLS(t *testing.T) {
+	key := generateTestRSAKey(t)
+	cert := issueTestCert(t, key, testCert{})
+	cert_pem, err := cert.MarshalPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key_pem, err := key.MarshalPKCS1PrivateKeyPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server_ctx, err := newCtxFromPEM(cert_pem, key_pem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newCtxFromPEM(key_pem, key_pem); err == nil {
+		t.Fatal("expected an error without a certificate")
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go ServeTLS(l, server_ctx, http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, r.Proto+" hello")
+		}))
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client_ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client_ctx.GetCertificateStore().AddCertificate(cert); err != nil {
+		t.Fatal(err)
+	}
+	client_ctx.SetVerifyMode(VerifyPeer)
+	transport := NewTransportWithProxy(client_ctx, nil)
+	defer transport.CloseIdleConnections()
+	getHello(t, transport, "https://localhost:"+port+"/", "HTTP/1.1")
+}
+
+func TestHTTPServerListeners(t *testing.T) {
+	if !reusePortSupported {
+		t.Skip("reuseport listeners are not supported on this platform")
+	}
+	// ListenAndServe doesn't report the port it picks, so find a free one
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	srv := &HTTPServer{
+		Server: &http.Server{Addr: addr, Handler: http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, r.Proto+" hello")
+			})},
+		Ctx:       newTestServerCtx(t),
+		Listeners: 4}
+	done := make(chan error, 1)
+	go func() { done <- srv.ListenAndServe() }()
+	client_ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := NewTransportWithProxy(client_ctx, nil)
+	transport.DialTLSContext = func(ctx context.Context, network,
+		addr string) (net.Conn, error) {
+		return Dial(network, addr, client_ctx, InsecureSkipHostVerification)
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+	for i := 0; ; i++ {
+		resp, err := client.Get("https://" + addr + "/")
+		if err == nil {
+			resp.Body.Close()
+			break
+		}
+		if i == 50 {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-done:
+			t.Fatal(err)
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	getHello(t, transport, "https://"+addr+"/", "HTTP/1.1")
+	srv.Close()
+	if err := <-done; err != http.ErrServerClosed {
+		t.Fatalf("expected ErrServerClosed, got %v", err)
+	}
+}
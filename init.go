@@ -80,6 +80,13 @@ Making a client connection is straightforward too:
   }
   conn, err := openssl.Dial("tcp", "localhost:7777", ctx, 0)
 
+Delegated credentials
+
+NewDelegatedCredential issues delegated credentials (RFC 9345), and
+DelegatedCredential.Verify checks them, for TLS stacks that implement the
+delegated_credential extension. OpenSSL doesn't, so serving credentials from
+a Ctx, and accepting them from servers, are out of scope for this package.
+
 Help wanted: To get this library to work with net/http's client, we
 had to fork net/http. It would be nice if an alternate http client library
 supported the generality needed to use OpenSSL instead of crypto/tls.
@@ -89,6 +96,7 @@ package openssl
 /*
 #include <openssl/ssl.h>
 #include <openssl/conf.h>
+#include <openssl/crypto.h>
 #include <openssl/err.h>
 #include <openssl/evp.h>
 #include <openssl/engine.h>
@@ -97,6 +105,10 @@ extern int Goopenssl_init_locks();
 extern void Goopenssl_thread_locking_callback(int, int, const char*, int);
 
 static int Goopenssl_init_threadsafety() {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+	// OpenSSL 1.1.0 and newer do their own locking
+	return 0;
+#else
 	// Set up OPENSSL thread safety callbacks.  We only set the locking
 	// callback because the default id callback implementation is good
 	// enough for us.
@@ -105,10 +117,66 @@ static int Goopenssl_init_threadsafety() {
 		CRYPTO_set_locking_callback(Goopenssl_thread_locking_callback);
 	}
 	return rc;
+#endif
 }
 
-static void OpenSSL_add_all_algorithms_not_a_macro() {
+static int Goopenssl_init_library() {
+#if defined(OPENSSL_IS_BORINGSSL)
+	// BoringSSL needs no configuration and has no engines
+	CRYPTO_library_init();
+	return 1;
+#elif defined(LIBRESSL_VERSION_NUMBER)
+	// LibreSSL loads strings and algorithms itself, and has no
+	// OPENSSL_config
+	return OPENSSL_init_ssl(OPENSSL_INIT_LOAD_CONFIG, NULL);
+#elif OPENSSL_VERSION_NUMBER >= 0x10100000L
+	uint64_t opts = OPENSSL_INIT_LOAD_CONFIG |
+		OPENSSL_INIT_LOAD_SSL_STRINGS | OPENSSL_INIT_LOAD_CRYPTO_STRINGS |
+		OPENSSL_INIT_ADD_ALL_CIPHERS | OPENSSL_INIT_ADD_ALL_DIGESTS;
+#ifndef OPENSSL_NO_ENGINE
+	opts |= OPENSSL_INIT_ENGINE_ALL_BUILTIN;
+#endif
+	return OPENSSL_init_ssl(opts, NULL);
+#else
+	OPENSSL_config(NULL);
+	ENGINE_load_builtin_engines();
+	SSL_load_error_strings();
+	SSL_library_init();
 	OpenSSL_add_all_algorithms();
+	return 1;
+#endif
+}
+
+enum {
+	OUR_LIBRARY_OPENSSL,
+	OUR_LIBRARY_LIBRESSL,
+	OUR_LIBRARY_BORINGSSL,
+};
+
+static int OUR_library() {
+#if defined(OPENSSL_IS_BORINGSSL)
+	return OUR_LIBRARY_BORINGSSL;
+#elif defined(LIBRESSL_VERSION_NUMBER)
+	return OUR_LIBRARY_LIBRESSL;
+#else
+	return OUR_LIBRARY_OPENSSL;
+#endif
+}
+
+static const char *OUR_OpenSSL_version() {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+	return OpenSSL_version(OPENSSL_VERSION);
+#else
+	return SSLeay_version(SSLEAY_VERSION);
+#endif
+}
+
+static unsigned long OUR_OpenSSL_version_num() {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+	return OpenSSL_version_num();
+#else
+	return SSLeay();
+#endif
 }
 
 */
@@ -117,7 +185,6 @@ import "C"
 import (
 	"errors"
 	"fmt"
-	"strings"
 	"sync"
 )
 
@@ -126,30 +193,57 @@ var (
 )
 
 func init() {
-	C.OPENSSL_config(nil)
-	C.ENGINE_load_builtin_engines()
-	C.SSL_load_error_strings()
-	C.SSL_library_init()
-	C.OpenSSL_add_all_algorithms_not_a_macro()
+	if C.Goopenssl_init_library() != 1 {
+		panic(errors.New("failed to initialize OpenSSL"))
+	}
 	rc := C.Goopenssl_init_threadsafety()
 	if rc != 0 {
 		panic(fmt.Errorf("Goopenssl_init_locks failed with %d", rc))
 	}
 }
 
-// errorFromErrorQueue needs to run in the same OS thread as the operation
-// that caused the possible error
-func errorFromErrorQueue() error {
-	var errs []string
-	for {
-		err := C.ERR_get_error()
-		if err == 0 {
-			break
-		}
-		errs = append(errs, fmt.Sprintf("%s:%s:%s",
-			C.GoString(C.ERR_lib_error_string(err)),
-			C.GoString(C.ERR_func_error_string(err)),
-			C.GoString(C.ERR_reason_error_string(err))))
+// Version returns the version of the OpenSSL library the package is linked
+// against, e.g. "OpenSSL 3.0.13 30 Jan 2024", which may be newer than the
+// headers it was built with.
+func Version() string {
+	return C.GoString(C.OUR_OpenSSL_version())
+}
+
+// VersionNumber returns the version of the linked OpenSSL library in the
+// form of OPENSSL_VERSION_NUMBER, e.g. 0x30000000 for 3.0.0. LibreSSL always
+// reports 0x20000000 and BoringSSL the OpenSSL 1.1.1 it is compatible with,
+// so use Version or LinkedLibrary to tell those apart.
+func VersionNumber() int64 {
+	return int64(C.OUR_OpenSSL_version_num())
+}
+
+// Library is an implementation of the OpenSSL API the package can be built
+// against.
+type Library int
+
+const (
+	LibraryOpenSSL   Library = C.OUR_LIBRARY_OPENSSL
+	LibraryLibreSSL  Library = C.OUR_LIBRARY_LIBRESSL
+	LibraryBoringSSL Library = C.OUR_LIBRARY_BORINGSSL
+)
+
+func (l Library) String() string {
+	switch l {
+	case LibraryOpenSSL:
+		return "OpenSSL"
+	case LibraryLibreSSL:
+		return "LibreSSL"
+	case LibraryBoringSSL:
+		return "BoringSSL"
 	}
-	return errors.New(fmt.Sprintf("SSL errors: %s", strings.Join(errs, "\n")))
+	return fmt.Sprintf("Library(%d)", int(l))
+}
+
+// LinkedLibrary returns the implementation the package was built against.
+// LibreSSL is found through pkg-config like OpenSSL is; BoringSSL, which
+// doesn't install a pkg-config file, is selected with the boringssl build
+// tag. Features the library lacks fail with an error when used, and have
+// probes such as EnginesSupported where callers may want to check first.
+func LinkedLibrary() Library {
+	return Library(C.OUR_library())
 }
@@ -22,6 +22,10 @@ package openssl
 #include <openssl/crypto.h>
 #include <pthread.h>
 
+// OpenSSL 1.1.0 and newer do their own locking, see
+// Goopenssl_init_threadsafety
+#if OPENSSL_VERSION_NUMBER < 0x10100000L
+
 pthread_mutex_t* goopenssl_locks;
 
 int Goopenssl_init_locks() {
@@ -60,5 +64,17 @@ void Goopenssl_thread_locking_callback(int mode, int n, const char *file,
 		pthread_mutex_unlock(&goopenssl_locks[n]);
 	}
 }
+
+#else
+
+int Goopenssl_init_locks() {
+	return 0;
+}
+
+void Goopenssl_thread_locking_callback(int mode, int n, const char *file,
+	int line) {
+}
+
+#endif
 */
 import "C"
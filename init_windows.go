@@ -18,7 +18,7 @@ package openssl
 
 /*
 
-#cgo pkg-config: libssl
+#cgo pkg-config: libssl libcrypto
 
 #ifndef WIN32_LEAN_AND_MEAN
 #define WIN32_LEAN_AND_MEAN
@@ -27,6 +27,10 @@ package openssl
 #include <openssl/crypto.h>
 #include <windows.h>
 
+// OpenSSL 1.1.0 and newer do their own locking, see
+// Goopenssl_init_threadsafety
+#if OPENSSL_VERSION_NUMBER < 0x10100000L
+
 CRITICAL_SECTION* goopenssl_locks;
 
 int Goopenssl_init_locks() {
@@ -55,5 +59,17 @@ void Goopenssl_thread_locking_callback(int mode, int n, const char *file,
 		LeaveCriticalSection(&goopenssl_locks[n]);
 	}
 }
+
+#else
+
+int Goopenssl_init_locks() {
+	return 0;
+}
+
+void Goopenssl_thread_locking_callback(int mode, int n, const char *file,
+	int line) {
+}
+
+#endif
 */
 import "C"
@@ -0,0 +1,428 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <openssl/evp.h>
+
+static EVP_PKEY *OUR_EVP_PKEY_new_raw_key(int type, int private,
+        const unsigned char *key, size_t len) {
+#if OPENSSL_VERSION_NUMBER >= 0x10101000L
+    if (private)
+        return EVP_PKEY_new_raw_private_key(type, NULL, key, len);
+    return EVP_PKEY_new_raw_public_key(type, NULL, key, len);
+#else
+    return NULL;
+#endif
+}
+
+static int OUR_EVP_PKEY_get_raw_key(EVP_PKEY *pkey, int private,
+        unsigned char *out, size_t *len) {
+#if OPENSSL_VERSION_NUMBER >= 0x10101000L
+    if (private)
+        return EVP_PKEY_get_raw_private_key(pkey, out, len);
+    return EVP_PKEY_get_raw_public_key(pkey, out, len);
+#else
+    return 0;
+#endif
+}
+*/
+import "C"
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"runtime"
+	"unsafe"
+)
+
+// jsonWebKey holds the members of an RSA, EC or OKP JSON Web Key (RFC 7517,
+// RFC 7518 and RFC 8037) that make up the key itself.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	D   string `json:"d,omitempty"`
+	P   string `json:"p,omitempty"`
+	Q   string `json:"q,omitempty"`
+	Dp  string `json:"dp,omitempty"`
+	Dq  string `json:"dq,omitempty"`
+	Qi  string `json:"qi,omitempty"`
+}
+
+// okpCurves are the key types of OKP keys, by their JWK curve names.
+var okpCurves = []struct {
+	key_type KeyType
+	crv      string
+}{
+	{KeyTypeEd25519, "Ed25519"},
+	{KeyTypeEd448, "Ed448"},
+	{KeyTypeX25519, "X25519"},
+	{KeyTypeX448, "X448"},
+}
+
+var jwkCurves = []elliptic.Curve{
+	elliptic.P256(),
+	elliptic.P384(),
+	elliptic.P521(),
+}
+
+// MarshalJWK encodes the public key as a JSON Web Key. RSA and EC keys on
+// the NIST curves are supported, as are Ed25519, Ed448, X25519 and X448 keys
+// with OpenSSL 1.1.1 or later. Only the public key is needed, so keys held by
+// an engine can be published too.
+func MarshalJWK(key PublicKey) ([]byte, error) {
+	jwk, err := publicJWK(key)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(jwk)
+}
+
+// MarshalPrivateJWK encodes key as a JSON Web Key including its private
+// members, for the same key types as MarshalJWK.
+func MarshalPrivateJWK(key PrivateKey) ([]byte, error) {
+	jwk, err := publicJWK(key)
+	if err != nil {
+		return nil, err
+	}
+	if jwk.Kty == "OKP" {
+		d, err := rawKey(key, true)
+		if err != nil {
+			return nil, err
+		}
+		jwk.D = encodeJWKBytes(d)
+		return json.Marshal(jwk)
+	}
+	priv, err := ToStdlibPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	switch k := priv.(type) {
+	case *rsa.PrivateKey:
+		if len(k.Primes) != 2 {
+			return nil, errors.New("multi-prime RSA keys can't be encoded " +
+				"as JWKs")
+		}
+		k.Precompute()
+		jwk.D = encodeJWKInt(k.D, 0)
+		jwk.P = encodeJWKInt(k.Primes[0], 0)
+		jwk.Q = encodeJWKInt(k.Primes[1], 0)
+		jwk.Dp = encodeJWKInt(k.Precomputed.Dp, 0)
+		jwk.Dq = encodeJWKInt(k.Precomputed.Dq, 0)
+		jwk.Qi = encodeJWKInt(k.Precomputed.Qinv, 0)
+	case *ecdsa.PrivateKey:
+		jwk.D = encodeJWKInt(k.D, (k.Curve.Params().N.BitLen()+7)/8)
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", priv)
+	}
+	return json.Marshal(jwk)
+}
+
+// LoadPublicKeyFromJWK loads the public key of a JSON Web Key. Private
+// members, if any, are ignored.
+func LoadPublicKeyFromJWK(data []byte) (PublicKey, error) {
+	var jwk jsonWebKey
+	if err := json.Unmarshal(data, &jwk); err != nil {
+		return nil, err
+	}
+	switch jwk.Kty {
+	case "RSA":
+		pub, err := jwk.rsaPublicKey()
+		if err != nil {
+			return nil, err
+		}
+		return FromStdlibPublicKey(pub)
+	case "EC":
+		pub, err := jwk.ecdsaPublicKey()
+		if err != nil {
+			return nil, err
+		}
+		return FromStdlibPublicKey(pub)
+	case "OKP":
+		key_type, err := jwk.okpKeyType()
+		if err != nil {
+			return nil, err
+		}
+		x, err := decodeJWKBytes("x", jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		return newRawKey(key_type, false, x)
+	}
+	return nil, fmt.Errorf("unsupported JWK key type %q", jwk.Kty)
+}
+
+// LoadPrivateKeyFromJWK loads the private key of a JSON Web Key.
+func LoadPrivateKeyFromJWK(data []byte) (PrivateKey, error) {
+	var jwk jsonWebKey
+	if err := json.Unmarshal(data, &jwk); err != nil {
+		return nil, err
+	}
+	if jwk.D == "" {
+		return nil, errors.New("JWK has no private key")
+	}
+	switch jwk.Kty {
+	case "RSA":
+		pub, err := jwk.rsaPublicKey()
+		if err != nil {
+			return nil, err
+		}
+		if jwk.P == "" || jwk.Q == "" {
+			return nil, errors.New("RSA JWKs without primes are not " +
+				"supported")
+		}
+		d, err := decodeJWKInt("d", jwk.D)
+		if err != nil {
+			return nil, err
+		}
+		p, err := decodeJWKInt("p", jwk.P)
+		if err != nil {
+			return nil, err
+		}
+		q, err := decodeJWKInt("q", jwk.Q)
+		if err != nil {
+			return nil, err
+		}
+		key := &rsa.PrivateKey{
+			PublicKey: *pub,
+			D:         d,
+			Primes:    []*big.Int{p, q}}
+		if err := key.Validate(); err != nil {
+			return nil, err
+		}
+		key.Precompute()
+		return FromStdlibPrivateKey(key)
+	case "EC":
+		pub, err := jwk.ecdsaPublicKey()
+		if err != nil {
+			return nil, err
+		}
+		d, err := decodeJWKInt("d", jwk.D)
+		if err != nil {
+			return nil, err
+		}
+		x, y := pub.Curve.ScalarBaseMult(d.Bytes())
+		if d.Sign() <= 0 || d.Cmp(pub.Curve.Params().N) >= 0 ||
+			x.Cmp(pub.X) != 0 || y.Cmp(pub.Y) != 0 {
+			return nil, errors.New("JWK private key doesn't match its " +
+				"public key")
+		}
+		return FromStdlibPrivateKey(&ecdsa.PrivateKey{PublicKey: *pub, D: d})
+	case "OKP":
+		key_type, err := jwk.okpKeyType()
+		if err != nil {
+			return nil, err
+		}
+		d, err := decodeJWKBytes("d", jwk.D)
+		if err != nil {
+			return nil, err
+		}
+		key, err := newRawKey(key_type, true, d)
+		if err != nil {
+			return nil, err
+		}
+		if jwk.X != "" {
+			x, err := rawKey(key, false)
+			if err != nil {
+				return nil, err
+			}
+			if encodeJWKBytes(x) != jwk.X {
+				return nil, errors.New("JWK private key doesn't match its " +
+					"public key")
+			}
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported JWK key type %q", jwk.Kty)
+}
+
+// publicJWK fills in the public members of key's JWK.
+func publicJWK(key PublicKey) (*jsonWebKey, error) {
+	key_type, err := key.KeyType()
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range okpCurves {
+		if c.key_type == 0 || c.key_type != key_type {
+			continue
+		}
+		x, err := rawKey(key, false)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonWebKey{Kty: "OKP", Crv: c.crv, X: encodeJWKBytes(x)},
+			nil
+	}
+	der, err := key.MarshalPKIXPublicKeyDER()
+	if err != nil {
+		return nil, err
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return &jsonWebKey{
+			Kty: "RSA",
+			N:   encodeJWKInt(k.N, 0),
+			E:   encodeJWKInt(big.NewInt(int64(k.E)), 0)}, nil
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		return &jsonWebKey{
+			Kty: "EC",
+			Crv: k.Curve.Params().Name,
+			X:   encodeJWKInt(k.X, size),
+			Y:   encodeJWKInt(k.Y, size)}, nil
+	}
+	return nil, fmt.Errorf("unsupported public key type %T", pub)
+}
+
+func (jwk *jsonWebKey) rsaPublicKey() (*rsa.PublicKey, error) {
+	n, err := decodeJWKInt("n", jwk.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := decodeJWKInt("e", jwk.E)
+	if err != nil {
+		return nil, err
+	}
+	if n.Sign() <= 0 || !e.IsInt64() || e.Int64() <= 1 ||
+		e.Int64() > 1<<31-1 {
+		return nil, errors.New("invalid RSA JWK")
+	}
+	return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+}
+
+func (jwk *jsonWebKey) ecdsaPublicKey() (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	for _, c := range jwkCurves {
+		if c.Params().Name == jwk.Crv {
+			curve = c
+		}
+	}
+	if curve == nil {
+		return nil, fmt.Errorf("unsupported JWK curve %q", jwk.Crv)
+	}
+	x, err := decodeJWKInt("x", jwk.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := decodeJWKInt("y", jwk.Y)
+	if err != nil {
+		return nil, err
+	}
+	if !curve.IsOnCurve(x, y) {
+		return nil, errors.New("JWK point is not on its curve")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+func (jwk *jsonWebKey) okpKeyType() (KeyType, error) {
+	for _, c := range okpCurves {
+		if c.key_type != 0 && c.crv == jwk.Crv {
+			return c.key_type, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported JWK curve %q", jwk.Crv)
+}
+
+func newRawKey(key_type KeyType, private bool, raw []byte) (*pKey, error) {
+	if len(raw) == 0 {
+		return nil, errors.New("empty raw key")
+	}
+	var c_private C.int
+	if private {
+		c_private = 1
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	key := C.OUR_EVP_PKEY_new_raw_key(C.int(key_type), c_private,
+		(*C.uchar)(unsafe.Pointer(&raw[0])), C.size_t(len(raw)))
+	if key == nil {
+		return nil, errorFromErrorQueue()
+	}
+	return newPKey(key), nil
+}
+
+// rawKey returns the raw public or private key of an OKP key.
+func rawKey(key PublicKey, private bool) ([]byte, error) {
+	pkey := key.acquirePKey()
+	if pkey == nil {
+		return nil, keyFreed
+	}
+	defer C.EVP_PKEY_free(pkey)
+	var c_private C.int
+	if private {
+		c_private = 1
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	var n C.size_t
+	if C.OUR_EVP_PKEY_get_raw_key(pkey, c_private, nil, &n) != 1 {
+		return nil, errorFromErrorQueue()
+	}
+	raw := make([]byte, n)
+	if C.OUR_EVP_PKEY_get_raw_key(pkey, c_private,
+		(*C.uchar)(unsafe.Pointer(&raw[0])), &n) != 1 {
+		return nil, errorFromErrorQueue()
+	}
+	return raw[:n], nil
+}
+
+func encodeJWKBytes(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// encodeJWKInt encodes n big-endian, left padded with zeros to size bytes.
+func encodeJWKInt(n *big.Int, size int) string {
+	b := n.Bytes()
+	if len(b) < size {
+		b = append(make([]byte, size-len(b)), b...)
+	}
+	return encodeJWKBytes(b)
+}
+
+func decodeJWKBytes(name, value string) ([]byte, error) {
+	if value == "" {
+		return nil, fmt.Errorf("JWK is missing %q", name)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWK %q: %v", name, err)
+	}
+	return b, nil
+}
+
+func decodeJWKInt(name, value string) (*big.Int, error) {
+	b, err := decodeJWKBytes(name, value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
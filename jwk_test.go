@@ -0,0 +1,135 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"os/exec"
+	"testing"
+)
+
+func checkJWKRoundTrip(t *testing.T, name string, key PrivateKey) {
+	data, err := MarshalPrivateJWK(key)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	loaded, err := LoadPrivateKeyFromJWK(data)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	expected, err := key.MarshalPKCS8PrivateKeyDER()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := loaded.MarshalPKCS8PrivateKeyDER()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Fatalf("%s: private key changed in the round trip", name)
+	}
+
+	data, err = MarshalJWK(key)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	var members map[string]interface{}
+	if err := json.Unmarshal(data, &members); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := members["d"]; ok {
+		t.Fatalf("%s: public JWK has private members: %s", name, data)
+	}
+	pub, err := LoadPublicKeyFromJWK(data)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	expected, err = key.MarshalPKIXPublicKeyDER()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = pub.MarshalPKIXPublicKeyDER()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Fatalf("%s: public key changed in the round trip", name)
+	}
+}
+
+func TestJWKRoundTrip(t *testing.T) {
+	checkJWKRoundTrip(t, "RSA", generateTestRSAKey(t))
+	ec, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := FromStdlibPrivateKey(ec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkJWKRoundTrip(t, "EC", key)
+
+	if _, err := exec.LookPath("openssl"); err != nil {
+		t.Skip("openssl command line tool not available")
+	}
+	for _, algorithm := range []string{"ED25519", "ED448", "X25519",
+		"X448"} {
+		pem_block, err := exec.Command("openssl", "genpkey", "-algorithm",
+			algorithm).Output()
+		if err != nil {
+			t.Logf("openssl can't generate %s keys: %v", algorithm, err)
+			continue
+		}
+		key, err := LoadPrivateKeyFromPEMWithPassword(pem_block, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkJWKRoundTrip(t, algorithm, key)
+	}
+}
+
+func TestJWKEd25519Vector(t *testing.T) {
+	// RFC 8037, appendix A
+	const jwk = `{"kty":"OKP","crv":"Ed25519",` +
+		`"d":"nWGxne_9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A",` +
+		`"x":"11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}`
+	key, err := LoadPrivateKeyFromJWK([]byte(jwk))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := MarshalJWK(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const expected = `{"kty":"OKP","crv":"Ed25519",` +
+		`"x":"11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}`
+	if string(data) != expected {
+		t.Fatalf("expected %s, got %s", expected, data)
+	}
+
+	// the public key must match the private one
+	const mismatched = `{"kty":"OKP","crv":"Ed25519",` +
+		`"d":"nWGxne_9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A",` +
+		`"x":"AAAAAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}`
+	if _, err := LoadPrivateKeyFromJWK([]byte(mismatched)); err == nil {
+		t.Fatal("expected mismatched JWK to be refused")
+	}
+}
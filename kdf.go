@@ -0,0 +1,114 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <stdint.h>
+#include <openssl/evp.h>
+
+static int OUR_EVP_PBE_scrypt(const char *pass, size_t passlen,
+    const unsigned char *salt, size_t saltlen, uint64_t N, uint64_t r,
+    uint64_t p, unsigned char *key, size_t keylen) {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L && !defined(OPENSSL_NO_SCRYPT)
+    // the default memory limit is 32MB, so allow what the parameters need,
+    // with room to spare; they have already been checked for overflow
+    uint64_t maxmem = 128 * r * (N + p + 2) + (1 << 20);
+    return EVP_PBE_scrypt(pass, passlen, salt, saltlen, N, r, p, maxmem,
+        key, keylen);
+#else
+    return -1;
+#endif
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"math"
+	"runtime"
+	"unsafe"
+)
+
+// kdfBytes returns a C pointer to b, which points somewhere even if b is
+// empty, as OpenSSL treats NULL passwords and salts differently from empty
+// ones.
+func kdfBytes(b []byte) unsafe.Pointer {
+	if len(b) == 0 {
+		return unsafe.Pointer(&[]byte{0}[0])
+	}
+	return unsafe.Pointer(&b[0])
+}
+
+// PBKDF2 derives a key_len byte key from password and salt with PBKDF2
+// (PKCS #5 v2.0) using HMAC with the given digest, e.g. SHA256_Method, and
+// iter iterations.
+func PBKDF2(password, salt []byte, iter, key_len int, digest Method) (
+	[]byte, error) {
+	if digest == nil {
+		return nil, errors.New("pbkdf2: no digest provided")
+	}
+	if iter < 1 || key_len < 1 {
+		return nil, errors.New("pbkdf2: iterations and key length must be " +
+			"positive")
+	}
+	if iter > math.MaxInt32 || key_len > math.MaxInt32 ||
+		len(password) > math.MaxInt32 || len(salt) > math.MaxInt32 {
+		return nil, errors.New("pbkdf2: parameters too large")
+	}
+	key := make([]byte, key_len)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.PKCS5_PBKDF2_HMAC((*C.char)(kdfBytes(password)),
+		C.int(len(password)), (*C.uchar)(kdfBytes(salt)), C.int(len(salt)),
+		C.int(iter), digest, C.int(key_len), (*C.uchar)(&key[0])) != 1 {
+		return nil, errorFromErrorQueue()
+	}
+	return key, nil
+}
+
+// Scrypt derives a key_len byte key from password and salt with scrypt
+// (RFC 7914), using the CPU/memory cost N, a power of two, the block size r
+// and the parallelization p. It takes about 128*N*r bytes of memory. It
+// requires OpenSSL 1.1.0.
+func Scrypt(password, salt []byte, N, r, p, key_len int) ([]byte, error) {
+	if N < 2 || N&(N-1) != 0 {
+		return nil, errors.New("scrypt: N must be a power of two above 1")
+	}
+	if r < 1 || p < 1 || key_len < 1 {
+		return nil, errors.New("scrypt: r, p and key length must be positive")
+	}
+	// as in RFC 7914, and so that the memory needed fits in 64 bits
+	if uint64(r)*uint64(p) >= 1<<30 ||
+		uint64(N) > math.MaxInt64/128/uint64(r)-uint64(p)-2 {
+		return nil, errors.New("scrypt: parameters too large")
+	}
+	key := make([]byte, key_len)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	rv := C.OUR_EVP_PBE_scrypt((*C.char)(kdfBytes(password)),
+		C.size_t(len(password)), (*C.uchar)(kdfBytes(salt)),
+		C.size_t(len(salt)), C.uint64_t(N), C.uint64_t(r), C.uint64_t(p),
+		(*C.uchar)(&key[0]), C.size_t(key_len))
+	if rv < 0 {
+		return nil, errors.New("scrypt is not supported by this version " +
+			"of OpenSSL")
+	}
+	if rv != 1 {
+		return nil, errorFromErrorQueue()
+	}
+	return key, nil
+}
@@ -0,0 +1,80 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestPBKDF2(t *testing.T) {
+	// RFC 6070
+	tests := []struct {
+		password, salt string
+		iter           int
+		expected       string
+	}{
+		{"password", "salt", 1, "0c60c80f961f0e71f3a9b524af6012062fe037a6"},
+		{"password", "salt", 4096, "4b007901b765489abead49d926f721d065a429c1"},
+		{"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt",
+			4096, "3d2eec4fe41c849b80c8d83662c0e44a8b291a964cf2f07038"},
+	}
+	for _, test := range tests {
+		key, err := PBKDF2([]byte(test.password), []byte(test.salt),
+			test.iter, len(test.expected)/2, SHA1_Method)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(key); got != test.expected {
+			t.Fatalf("exp:%s got:%s", test.expected, got)
+		}
+	}
+	if _, err := PBKDF2([]byte("password"), nil, 0, 32,
+		SHA256_Method); err == nil {
+		t.Fatal("expected zero iterations to fail")
+	}
+}
+
+func TestScrypt(t *testing.T) {
+	// RFC 7914, section 12
+	tests := []struct {
+		password, salt string
+		N, r, p        int
+		expected       string
+	}{
+		{"", "", 16, 1, 1, "77d6576238657b203b19ca42c18a0497" +
+			"f16b4844e3074ae8dfdffa3fede21442fcd0069ded0948f8326a753a0fc81f17" +
+			"e8d3e0fb2e0d3628cf35e20c38d18906"},
+		{"password", "NaCl", 1024, 8, 16, "fdbabe1c9d3472007856e7190d01e9fe" +
+			"7c6ad7cbc8237830e77376634b3731622eaf30d92e22a3886ff109279d9830da" +
+			"c727afb94a83ee6d8360cbdfa2cc0640"},
+	}
+	for _, test := range tests {
+		key, err := Scrypt([]byte(test.password), []byte(test.salt), test.N,
+			test.r, test.p, len(test.expected)/2)
+		if err != nil {
+			t.Skip(err)
+		}
+		if got := hex.EncodeToString(key); got != test.expected {
+			t.Fatalf("exp:%s got:%s", test.expected, got)
+		}
+	}
+	if _, err := Scrypt([]byte("password"), nil, 1000, 8, 1,
+		32); err == nil {
+		t.Fatal("expected N that isn't a power of two to fail")
+	}
+}
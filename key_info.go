@@ -0,0 +1,226 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <string.h>
+#include <openssl/evp.h>
+#include <openssl/ec.h>
+#include <openssl/objects.h>
+#if OPENSSL_VERSION_NUMBER >= 0x30000000L
+#include <openssl/core_names.h>
+#endif
+
+#ifndef EVP_PKEY_RSA_PSS
+#define EVP_PKEY_RSA_PSS 0
+#endif
+#ifndef EVP_PKEY_ED25519
+#define EVP_PKEY_ED25519 0
+#endif
+#ifndef EVP_PKEY_ED448
+#define EVP_PKEY_ED448 0
+#endif
+#ifndef EVP_PKEY_X25519
+#define EVP_PKEY_X25519 0
+#endif
+#ifndef EVP_PKEY_X448
+#define EVP_PKEY_X448 0
+#endif
+#if !defined(EVP_PKEY_SM2) || defined(OPENSSL_NO_SM2)
+#undef EVP_PKEY_SM2
+#define EVP_PKEY_SM2 0
+#endif
+// GOST keys come from the GOST engine or provider, but OpenSSL knows their
+// types
+#ifndef NID_id_GostR3410_2012_256
+#define NID_id_GostR3410_2012_256 0
+#endif
+#ifndef NID_id_GostR3410_2012_512
+#define NID_id_GostR3410_2012_512 0
+#endif
+
+static const char *EVP_PKEY_get0_curve_name(EVP_PKEY *pkey) {
+    EC_KEY *ec;
+    int nid;
+    if (EVP_PKEY_base_id(pkey) != EVP_PKEY_EC)
+        return NULL;
+    ec = EVP_PKEY_get1_EC_KEY(pkey);
+    if (ec == NULL)
+        return NULL;
+    nid = EC_GROUP_get_curve_name(EC_KEY_get0_group(ec));
+    EC_KEY_free(ec);
+    return nid == NID_undef ? NULL : OBJ_nid2sn(nid);
+}
+
+#if OPENSSL_VERSION_NUMBER >= 0x30000000L
+static void OUR_digest_short_name(char *name, size_t len) {
+    const EVP_MD *md = EVP_get_digestbyname(name);
+    if (md != NULL && OBJ_nid2sn(EVP_MD_type(md)) != NULL) {
+        strncpy(name, OBJ_nid2sn(EVP_MD_type(md)), len - 1);
+        name[len - 1] = 0;
+    }
+}
+#endif
+
+// returns 1 and fills in the restrictions of a restricted RSA-PSS key, 0 for
+// other keys, or -1 if they can't be read
+static int EVP_PKEY_get_pss_restrictions(EVP_PKEY *pkey, char *md,
+        char *mgf1_md, size_t len, int *saltlen) {
+    if (EVP_PKEY_RSA_PSS == 0 || EVP_PKEY_base_id(pkey) != EVP_PKEY_RSA_PSS)
+        return 0;
+#if OPENSSL_VERSION_NUMBER >= 0x30000000L
+    if (!EVP_PKEY_get_utf8_string_param(pkey, OSSL_PKEY_PARAM_RSA_DIGEST, md,
+            len, NULL))
+        return 0;
+    if (!EVP_PKEY_get_utf8_string_param(pkey,
+            OSSL_PKEY_PARAM_RSA_MGF1_DIGEST, mgf1_md, len, NULL))
+        strncpy(mgf1_md, md, len);
+    if (!EVP_PKEY_get_int_param(pkey, OSSL_PKEY_PARAM_RSA_PSS_SALTLEN,
+            saltlen))
+        *saltlen = 0;
+    // report the short names, e.g. SHA256 rather than SHA2-256
+    OUR_digest_short_name(md, len);
+    OUR_digest_short_name(mgf1_md, len);
+    return 1;
+#else
+    return -1;
+#endif
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+)
+
+// KeyType is the algorithm of a key, as OpenSSL's EVP_PKEY type. Types the
+// linked OpenSSL doesn't know are 0.
+type KeyType int
+
+const (
+	KeyTypeRSA     KeyType = C.EVP_PKEY_RSA
+	KeyTypeRSAPSS  KeyType = C.EVP_PKEY_RSA_PSS
+	KeyTypeDSA     KeyType = C.EVP_PKEY_DSA
+	KeyTypeDH      KeyType = C.EVP_PKEY_DH
+	KeyTypeEC      KeyType = C.EVP_PKEY_EC
+	KeyTypeEd25519 KeyType = C.EVP_PKEY_ED25519
+	KeyTypeEd448   KeyType = C.EVP_PKEY_ED448
+	KeyTypeX25519  KeyType = C.EVP_PKEY_X25519
+	KeyTypeX448    KeyType = C.EVP_PKEY_X448
+	KeyTypeSM2     KeyType = C.EVP_PKEY_SM2
+	// KeyTypeGOST2012_256 and KeyTypeGOST2012_512 are GOST R 34.10-2012
+	// keys, see EnableGOST.
+	KeyTypeGOST2012_256 KeyType = C.NID_id_GostR3410_2012_256
+	KeyTypeGOST2012_512 KeyType = C.NID_id_GostR3410_2012_512
+)
+
+// keyTypeNames is a list rather than a map or switch since types the linked
+// OpenSSL doesn't know are all 0.
+var keyTypeNames = []struct {
+	key_type KeyType
+	name     string
+}{
+	{KeyTypeRSA, "RSA"},
+	{KeyTypeRSAPSS, "RSA-PSS"},
+	{KeyTypeDSA, "DSA"},
+	{KeyTypeDH, "DH"},
+	{KeyTypeEC, "EC"},
+	{KeyTypeEd25519, "Ed25519"},
+	{KeyTypeEd448, "Ed448"},
+	{KeyTypeX25519, "X25519"},
+	{KeyTypeX448, "X448"},
+	{KeyTypeSM2, "SM2"},
+	{KeyTypeGOST2012_256, "GOST2012-256"},
+	{KeyTypeGOST2012_512, "GOST2012-512"},
+}
+
+func (t KeyType) String() string {
+	for _, n := range keyTypeNames {
+		if t != 0 && n.key_type == t {
+			return n.name
+		}
+	}
+	return fmt.Sprintf("KeyType(%d)", int(t))
+}
+
+// PSSRestrictions are the limits an RSA-PSS key places on the signatures it
+// makes, per RFC 4055.
+type PSSRestrictions struct {
+	// Digest is the short name of the only digest the key signs with, e.g.
+	// SHA256.
+	Digest string
+	// MGF1Digest is the short name of the digest used by the mask generation
+	// function.
+	MGF1Digest string
+	// MinSaltLength is the shortest salt signatures may use.
+	MinSaltLength int
+}
+
+func (key *pKey) KeyType() (KeyType, error) {
+	pkey := key.acquirePKey()
+	if pkey == nil {
+		return 0, keyFreed
+	}
+	defer C.EVP_PKEY_free(pkey)
+	return KeyType(C.EVP_PKEY_base_id(pkey)), nil
+}
+
+func (key *pKey) Bits() (int, error) {
+	pkey := key.acquirePKey()
+	if pkey == nil {
+		return 0, keyFreed
+	}
+	defer C.EVP_PKEY_free(pkey)
+	return int(C.EVP_PKEY_bits(pkey)), nil
+}
+
+func (key *pKey) CurveName() (string, error) {
+	pkey := key.acquirePKey()
+	if pkey == nil {
+		return "", keyFreed
+	}
+	defer C.EVP_PKEY_free(pkey)
+	name := C.EVP_PKEY_get0_curve_name(pkey)
+	if name == nil {
+		return "", nil
+	}
+	return C.GoString(name), nil
+}
+
+func (key *pKey) PSSRestrictions() (*PSSRestrictions, error) {
+	pkey := key.acquirePKey()
+	if pkey == nil {
+		return nil, keyFreed
+	}
+	defer C.EVP_PKEY_free(pkey)
+	var md, mgf1_md [64]C.char
+	var saltlen C.int
+	switch C.EVP_PKEY_get_pss_restrictions(pkey, &md[0], &mgf1_md[0],
+		C.size_t(len(md)), &saltlen) {
+	case 0:
+		return nil, nil
+	case 1:
+		return &PSSRestrictions{
+			Digest:        C.GoString(&md[0]),
+			MGF1Digest:    C.GoString(&mgf1_md[0]),
+			MinSaltLength: int(saltlen)}, nil
+	default:
+		return nil, errors.New("reading RSA-PSS restrictions requires " +
+			"OpenSSL 3.0 or newer")
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestKeyInfo(t *testing.T) {
+	ec_std, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec_key, err := FromStdlibPrivateKey(ec_std)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed_std, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed_key, err := FromStdlibPrivateKey(ed_std)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		key        PrivateKey
+		key_type   KeyType
+		name       string
+		bits       int
+		curve_name string
+	}{
+		{generateTestRSAKey(t), KeyTypeRSA, "RSA", 2048, ""},
+		{ec_key, KeyTypeEC, "EC", 384, "secp384r1"},
+		// OpenSSL 3.0 rounds Ed25519 keys up to 256 bits
+		{ed_key, KeyTypeEd25519, "Ed25519", 0, ""},
+	} {
+		key_type, err := test.key.KeyType()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key_type != test.key_type || key_type.String() != test.name {
+			t.Fatalf("expected a %s key, got %s", test.name, key_type)
+		}
+		bits, err := test.key.Bits()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bits != test.bits && (test.bits != 0 || bits < 253) {
+			t.Fatalf("expected a %d bit %s key, got %d", test.bits, test.name,
+				bits)
+		}
+		curve_name, err := test.key.CurveName()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if curve_name != test.curve_name {
+			t.Fatalf("unexpected curve %q", curve_name)
+		}
+		restrictions, err := test.key.PSSRestrictions()
+		if err != nil || restrictions != nil {
+			t.Fatalf("unexpected PSS restrictions %+v: %v", restrictions, err)
+		}
+	}
+
+	ec_key.Free()
+	if _, err := ec_key.KeyType(); err != keyFreed {
+		t.Fatalf("expected keyFreed, got %v", err)
+	}
+}
+
+func TestKeyInfoPSSRestrictions(t *testing.T) {
+	if _, err := exec.LookPath("openssl"); err != nil {
+		t.Skip("openssl command line tool not available")
+	}
+	pem_block, err := exec.Command("openssl", "genpkey", "-algorithm",
+		"RSA-PSS", "-pkeyopt", "rsa_keygen_bits:1024",
+		"-pkeyopt", "rsa_pss_keygen_md:sha256",
+		"-pkeyopt", "rsa_pss_keygen_mgf1_md:sha384",
+		"-pkeyopt", "rsa_pss_keygen_saltlen:32").Output()
+	if err != nil {
+		t.Skipf("openssl can't generate RSA-PSS keys: %v", err)
+	}
+	key, err := LoadPrivateKeyFromPEMWithPassword(pem_block, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key_type, err := key.KeyType()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key_type != KeyTypeRSAPSS {
+		t.Fatalf("expected an RSA-PSS key, got %s", key_type)
+	}
+	restrictions, err := key.PSSRestrictions()
+	if err != nil {
+		if strings.Contains(err.Error(), "3.0") {
+			t.Skip(err)
+		}
+		t.Fatal(err)
+	}
+	if restrictions == nil ||
+		restrictions.Digest != "SHA256" ||
+		restrictions.MGF1Digest != "SHA384" ||
+		restrictions.MinSaltLength != 32 {
+		t.Fatalf("unexpected PSS restrictions %+v", restrictions)
+	}
+}
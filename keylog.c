@@ -0,0 +1,65 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include <string.h>
+#include <openssl/ssl.h>
+#include "_cgo_export.h"
+
+#if OPENSSL_VERSION_NUMBER >= 0x10101000L
+
+static void keylog_cb(const SSL *ssl, const char *line) {
+	keylog_cb_thunk(
+		SSL_CTX_get_ex_data(SSL_get_SSL_CTX(ssl), get_ssl_ctx_idx()),
+		SSL_get_ex_data(ssl, get_ssl_idx()), (char *)line);
+}
+
+int SSL_CTX_set_keylog(SSL_CTX *ctx, int enabled) {
+	SSL_CTX_set_keylog_callback(ctx, (enabled ? keylog_cb : NULL));
+	return 1;
+}
+
+int SSL_get_keylog_master_secret(SSL *ssl, unsigned char *client_random,
+		unsigned char *master, int *master_len) {
+	return 0;
+}
+
+#else
+
+int SSL_CTX_set_keylog(SSL_CTX *ctx, int enabled) {
+	// the lines are put together once handshakes complete instead
+	return 0;
+}
+
+// SSL_get_keylog_master_secret gets what a CLIENT_RANDOM key log line
+// holds, for versions without a key log callback.
+int SSL_get_keylog_master_secret(SSL *ssl, unsigned char *client_random,
+		unsigned char *master, int *master_len) {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+	SSL_SESSION *session = SSL_get_session(ssl);
+	if (session == NULL)
+		return 0;
+	SSL_get_client_random(ssl, client_random, SSL3_RANDOM_SIZE);
+	*master_len = SSL_SESSION_get_master_key(session, master,
+		SSL_MAX_MASTER_KEY_LENGTH);
+#else
+	if (ssl->s3 == NULL || ssl->session == NULL)
+		return 0;
+	memcpy(client_random, ssl->s3->client_random, SSL3_RANDOM_SIZE);
+	*master_len = ssl->session->master_key_length;
+	memcpy(master, ssl->session->master_key, *master_len);
+#endif
+	return *master_len > 0;
+}
+
+#endif
@@ -0,0 +1,108 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <openssl/ssl.h>
+
+extern int SSL_CTX_set_keylog(SSL_CTX *ctx, int enabled);
+extern int SSL_get_keylog_master_secret(SSL *ssl,
+    unsigned char *client_random, unsigned char *master, int *master_len);
+*/
+import "C"
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"unsafe"
+)
+
+// SetKeyLogWriter makes connections using the context write the secrets
+// they derive to w, one per line in the NSS key log format that Wireshark
+// and the like read to decrypt captured traffic, as with crypto/tls's
+// Config.KeyLogWriter. Lines are written as the secrets are derived, so
+// writes to w should not block for long. Before OpenSSL 1.1.1 only the
+// master secret of each connection's first handshake is logged, once it
+// completes, and TLS 1.3 isn't supported anyway. A nil w stops logging.
+//
+// Anyone with the log can decrypt the traffic, so use it only for debugging.
+func (c *Ctx) SetKeyLogWriter(w io.Writer) {
+	c.keylog_mtx.Lock()
+	defer c.keylog_mtx.Unlock()
+	c.keylog_writer = w
+	c.updateKeyLog()
+}
+
+// updateKeyLog installs the key log callback if there is a writer to log to
+// or kTLS needs the secrets, see SetKTLS. The caller must hold
+// c.keylog_mtx.
+func (c *Ctx) updateKeyLog() {
+	var enabled C.int
+	if c.keylog_writer != nil || c.ktls {
+		enabled = 1
+	}
+	c.keylog_fallback = C.SSL_CTX_set_keylog(c.ctx, enabled) == 0 &&
+		c.keylog_writer != nil
+}
+
+func (c *Ctx) writeKeyLog(line string) {
+	c.keylog_mtx.Lock()
+	defer c.keylog_mtx.Unlock()
+	if c.keylog_writer != nil {
+		// there's no one to report failures to, as with crypto/tls
+		io.WriteString(c.keylog_writer, line+"\n")
+	}
+}
+
+// logMasterSecret writes the CLIENT_RANDOM line for ssl's master secret
+// where OpenSSL has no key log callback to do it.
+func (c *Ctx) logMasterSecret(ssl *C.SSL) {
+	c.keylog_mtx.Lock()
+	fallback := c.keylog_fallback
+	c.keylog_mtx.Unlock()
+	if !fallback {
+		return
+	}
+	var client_random [C.SSL3_RANDOM_SIZE]byte
+	var master [C.SSL_MAX_MASTER_KEY_LENGTH]byte
+	var master_len C.int
+	if C.SSL_get_keylog_master_secret(ssl,
+		(*C.uchar)(unsafe.Pointer(&client_random[0])),
+		(*C.uchar)(unsafe.Pointer(&master[0])), &master_len) != 1 {
+		return
+	}
+	c.writeKeyLog(fmt.Sprintf("CLIENT_RANDOM %x %x", client_random[:],
+		master[:master_len]))
+}
+
+//export keylog_cb_thunk
+func keylog_cb_thunk(p unsafe.Pointer, conn_p unsafe.Pointer,
+	line *C.char) {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Critf("openssl: key log writer panic'd: %v", err)
+			os.Exit(1)
+		}
+	}()
+	go_line := C.GoString(line)
+	// the handshake holds conn.mtx
+	if conn := (*Conn)(conn_p); conn != nil && conn.ktls {
+		conn.ktlsSaveSecret(go_line)
+	}
+	(*Ctx)(p).writeKeyLog(go_line)
+}
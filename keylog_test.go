@@ -0,0 +1,105 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"bytes"
+	"crypto/tls"
+	"strings"
+	"testing"
+)
+
+func TestKeyLogWriter(t *testing.T) {
+	cert, err := tls.X509KeyPair(certBytes, keyBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, version := range []SSLVersion{TLSv1_2, TLSv1_3} {
+		// crypto/tls logs the same secrets
+		var stdlib_log, openssl_log bytes.Buffer
+		server_conn, client_conn := NetPipe(t)
+		server := tls.Server(server_conn, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			KeyLogWriter: &stdlib_log})
+		client_ctx, err := NewCtxWithVersion(version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client_ctx.SetKeyLogWriter(&openssl_log)
+		client, err := Client(client_conn, client_ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		errs := make(chan error, 1)
+		go func() { errs <- server.Handshake() }()
+		if err := client.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+		client.Close()
+		server.Close()
+
+		logged := make(map[string]bool)
+		for _, line := range strings.Split(openssl_log.String(), "\n") {
+			logged[line] = true
+		}
+		expected := strings.Split(strings.TrimSpace(stdlib_log.String()), "\n")
+		if len(expected) == 0 || expected[0] == "" {
+			t.Fatal("crypto/tls logged nothing")
+		}
+		for _, line := range expected {
+			if !logged[line] {
+				t.Fatalf("version %d: missing %q from %q", version, line,
+					openssl_log.String())
+			}
+		}
+	}
+}
+
+func TestKeyLogWriterDisabled(t *testing.T) {
+	var log bytes.Buffer
+	client_ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client_ctx.SetKeyLogWriter(&log)
+	client_ctx.SetKeyLogWriter(nil)
+	server_conn, client_conn := NetPipe(t)
+	server, err := Server(server_conn, newTestServerCtx(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := Client(client_conn, client_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	errs := make(chan error, 1)
+	go func() { errs <- server.Handshake() }()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if log.Len() != 0 {
+		t.Fatalf("logged %q", log.String())
+	}
+}
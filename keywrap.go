@@ -0,0 +1,134 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <openssl/err.h>
+#include <openssl/evp.h>
+
+static const EVP_CIPHER *OUR_aes_wrap(int bits, int pad) {
+    switch (bits) {
+    case 128: return pad ? EVP_aes_128_wrap_pad() : EVP_aes_128_wrap();
+    case 192: return pad ? EVP_aes_192_wrap_pad() : EVP_aes_192_wrap();
+    case 256: return pad ? EVP_aes_256_wrap_pad() : EVP_aes_256_wrap();
+    }
+    return NULL;
+}
+
+// wraps or unwraps in with the default initial value, in one call, as the
+// wrap ciphers require
+static int OUR_aes_key_wrap(const EVP_CIPHER *cipher, int wrap,
+        const unsigned char *kek, const unsigned char *in, int inlen,
+        unsigned char *out, int *outlen) {
+    int ret = 0, len = 0, final_len = 0;
+    EVP_CIPHER_CTX *ctx = EVP_CIPHER_CTX_new();
+    if (ctx == NULL)
+        return 0;
+    EVP_CIPHER_CTX_set_flags(ctx, EVP_CIPHER_CTX_FLAG_WRAP_ALLOW);
+    if (EVP_CipherInit_ex(ctx, cipher, NULL, kek, NULL, wrap) != 1)
+        goto end;
+    if (EVP_CipherUpdate(ctx, out, &len, in, inlen) != 1)
+        goto end;
+    if (EVP_CipherFinal_ex(ctx, out + len, &final_len) != 1)
+        goto end;
+    *outlen = len + final_len;
+    ret = 1;
+end:
+    EVP_CIPHER_CTX_free(ctx);
+    return ret;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"unsafe"
+)
+
+// WrapKey wraps key, a multiple of 8 bytes and at least 16 bytes long, with
+// the AES key-encryption key kek, per RFC 3394. kek is 16, 24 or 32 bytes
+// long. The result is 8 bytes longer than key.
+func WrapKey(kek, key []byte) ([]byte, error) {
+	if len(key) < 16 || len(key)%8 != 0 {
+		return nil, errors.New("openssl: key wrap: key must be a multiple " +
+			"of 8 bytes, and at least 16 bytes, long")
+	}
+	return aesKeyWrap(kek, key, true, false)
+}
+
+// UnwrapKey unwraps the output of WrapKey with kek, and fails if it was
+// tampered with or kek is wrong.
+func UnwrapKey(kek, wrapped []byte) ([]byte, error) {
+	if len(wrapped) < 24 || len(wrapped)%8 != 0 {
+		return nil, errors.New("openssl: key wrap: bad wrapped key length")
+	}
+	return aesKeyWrap(kek, wrapped, false, false)
+}
+
+// WrapKeyWithPadding wraps key, of any length but empty, with the AES
+// key-encryption key kek, per RFC 5649. kek is 16, 24 or 32 bytes long.
+func WrapKeyWithPadding(kek, key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, errors.New("openssl: key wrap: empty key")
+	}
+	return aesKeyWrap(kek, key, true, true)
+}
+
+// UnwrapKeyWithPadding unwraps the output of WrapKeyWithPadding with kek, and
+// fails if it was tampered with or kek is wrong.
+func UnwrapKeyWithPadding(kek, wrapped []byte) ([]byte, error) {
+	if len(wrapped) < 16 || len(wrapped)%8 != 0 {
+		return nil, errors.New("openssl: key wrap: bad wrapped key length")
+	}
+	return aesKeyWrap(kek, wrapped, false, true)
+}
+
+func aesKeyWrap(kek, in []byte, wrap, pad bool) ([]byte, error) {
+	var cwrap, cpad C.int
+	if wrap {
+		cwrap = 1
+	}
+	if pad {
+		cpad = 1
+	}
+	cipher := C.OUR_aes_wrap(C.int(len(kek)*8), cpad)
+	if cipher == nil {
+		return nil, fmt.Errorf("openssl: key wrap: bad AES key size (%d "+
+			"bytes)", len(kek))
+	}
+	// wrapping adds at most 7 bytes of padding and the 8 byte integrity
+	// check
+	out := make([]byte, len(in)+16)
+	var outlen C.int
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.OUR_aes_key_wrap(cipher, cwrap,
+		(*C.uchar)(unsafe.Pointer(&kek[0])),
+		(*C.uchar)(unsafe.Pointer(&in[0])), C.int(len(in)),
+		(*C.uchar)(&out[0]), &outlen) != 1 {
+		if !wrap {
+			// don't give away why unwrapping failed
+			C.ERR_clear_error()
+			return nil, errors.New("openssl: key wrap: unwrapping failed")
+		}
+		return nil, errorFromErrorQueue()
+	}
+	return out[:outlen], nil
+}
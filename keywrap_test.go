@@ -0,0 +1,84 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestKeyWrap(t *testing.T) {
+	// RFC 3394 section 4.1
+	kek, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	key, _ := hex.DecodeString("00112233445566778899aabbccddeeff")
+	expected := "1fa68b0a8112b447aef34bd8fb5a7b829d3e862371d2cfe5"
+	wrapped, err := WrapKey(kek, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(wrapped) != expected {
+		t.Fatalf("expected %s, got %x", expected, wrapped)
+	}
+	unwrapped, err := UnwrapKey(kek, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unwrapped, key) {
+		t.Fatalf("expected %x, got %x", key, unwrapped)
+	}
+	wrapped[3] ^= 1
+	if _, err := UnwrapKey(kek, wrapped); err == nil {
+		t.Fatal("expected a tampered key to fail to unwrap")
+	}
+	if _, err := WrapKey(kek, key[:12]); err == nil {
+		t.Fatal("expected an error for a key that isn't a multiple of 8 bytes")
+	}
+}
+
+func TestKeyWrapWithPadding(t *testing.T) {
+	// RFC 5649 section 6
+	kek, _ := hex.DecodeString("5840df6e29b02af1ab493b705bf16ea1ae8338f4dcc176a8")
+	vectors := []struct {
+		key      string
+		expected string
+	}{
+		{"c37b7e6492584340bed12207808941155068f738",
+			"138bdeaa9b8fa7fc61f97742e72248ee5ae6ae5360d1ae6a5f54f373fa543b6a"},
+		{"466f7250617369", "afbeb0f07dfbf5419200f2ccb50bb24f"},
+	}
+	for _, v := range vectors {
+		key, _ := hex.DecodeString(v.key)
+		wrapped, err := WrapKeyWithPadding(kek, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(wrapped) != v.expected {
+			t.Fatalf("expected %s, got %x", v.expected, wrapped)
+		}
+		unwrapped, err := UnwrapKeyWithPadding(kek, wrapped)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(unwrapped, key) {
+			t.Fatalf("expected %x, got %x", key, unwrapped)
+		}
+		if _, err := UnwrapKeyWithPadding(kek[:16], wrapped); err == nil {
+			t.Fatal("expected the wrong kek to fail to unwrap")
+		}
+	}
+}
@@ -0,0 +1,360 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+// +build cgo
+
+package openssl
+
+/*
+#include <string.h>
+#include <openssl/ssl.h>
+
+#ifndef TLS1_3_VERSION
+#define TLS1_3_VERSION 0x0304
+#endif
+
+static unsigned int SSL_get_ktls_cipher(const SSL *ssl) {
+    const SSL_CIPHER *cipher = SSL_get_current_cipher(ssl);
+    return cipher == NULL ? 0 : SSL_CIPHER_get_id(cipher) & 0xffff;
+}
+
+static int SSL_is_ktls_server(SSL *ssl) {
+#if OPENSSL_VERSION_NUMBER >= 0x10002000L
+    return SSL_is_server(ssl);
+#else
+    return ssl->server;
+#endif
+}
+
+// SSL_get_tls12_secrets gets what TLS 1.2 derives its record keys from.
+static int SSL_get_tls12_secrets(SSL *ssl, unsigned char *client_random,
+        unsigned char *server_random, unsigned char *master,
+        size_t *master_len) {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+    SSL_SESSION *session = SSL_get_session(ssl);
+    if (session == NULL)
+        return 0;
+    SSL_get_client_random(ssl, client_random, SSL3_RANDOM_SIZE);
+    SSL_get_server_random(ssl, server_random, SSL3_RANDOM_SIZE);
+    *master_len = SSL_SESSION_get_master_key(session, master,
+        SSL_MAX_MASTER_KEY_LENGTH);
+#else
+    if (ssl->s3 == NULL || ssl->session == NULL)
+        return 0;
+    memcpy(client_random, ssl->s3->client_random, SSL3_RANDOM_SIZE);
+    memcpy(server_random, ssl->s3->server_random, SSL3_RANDOM_SIZE);
+    *master_len = ssl->session->master_key_length;
+    memcpy(master, ssl->session->master_key, *master_len);
+#endif
+    return *master_len > 0;
+}
+*/
+import "C"
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strings"
+	"unsafe"
+)
+
+var ktlsHandshakeMessage = errors.New(
+	"openssl: can't send handshake messages once kTLS is in use")
+
+// KTLSSupported reports whether the kernel can encrypt TLS records, so that
+// connections from contexts with SetKTLS can use it. It is only ever true
+// on Linux, with the tls module available.
+func KTLSSupported() bool {
+	return ktlsSupported()
+}
+
+// SetKTLS makes connections using the context hand the encryption of what
+// they send to the kernel (kTLS), once the handshake has completed, so that
+// ReadFrom can send files with sendfile(2) without copying them through
+// userspace. Connections try it on their first Write or ReadFrom, which for
+// TLS 1.3 starts with a KeyUpdate. Where it can't be done, the connection
+// carries on encrypting in userspace: on other systems, over anything but
+// TCP, and for cipher suites other than AES-GCM. Conn.KTLS tells which. It
+// takes effect for new connections.
+//
+// Only sending is offloaded; reading still goes through OpenSSL. Once the
+// kernel encrypts, OpenSSL can no longer send anything: KeyUpdate,
+// Renegotiate and VerifyClientPostHandshake fail, the KeyUpdates a peer
+// asks for aren't answered, and renegotiations a peer starts fail, so use
+// RenegotiateNever with TLS 1.2. Records are as large as the kernel makes
+// them, regardless of SetMaxSendFragment and SetDynamicRecordSizing.
+func (c *Ctx) SetKTLS(enabled bool) {
+	c.keylog_mtx.Lock()
+	defer c.keylog_mtx.Unlock()
+	c.ktls = enabled
+	c.updateKeyLog()
+}
+
+// KTLS reports whether the kernel encrypts what the connection sends, see
+// Ctx.SetKTLS.
+func (c *Conn) KTLS() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.ktls_tx
+}
+
+// ReadFrom writes everything read from r to the connection, as with
+// io.Copy, but through a buffer several records long, so that reads from r
+// that fill it are written as whole records. Once the kernel encrypts for the
+// connection, see Ctx.SetKTLS, a file is sent with sendfile(2).
+func (c *Conn) ReadFrom(r io.Reader) (int64, error) {
+	if err := c.startKTLS(); err != nil {
+		return 0, err
+	}
+	if c.KTLS() {
+		if rf, ok := c.conn.(io.ReaderFrom); ok {
+			return rf.ReadFrom(r)
+		}
+	}
+	return c.readFrom(r)
+}
+
+// startKTLS hands encryption to the kernel if the context asks for it and
+// this is the connection's first try.
+func (c *Conn) startKTLS() error {
+	c.mtx.Lock()
+	try := c.ktls && !c.ktls_tried
+	c.ktls_tried = true
+	c.mtx.Unlock()
+	if !try || !ktlsSupported() {
+		return nil
+	}
+	if err := c.Handshake(); err != nil {
+		return err
+	}
+	c.mtx.Lock()
+	version := C.SSL_version(c.ssl)
+	suite := ktlsCipherSuites[uint16(C.SSL_get_ktls_cipher(c.ssl))]
+	c.mtx.Unlock()
+	if suite.key_len == 0 || (version != C.TLS1_2_VERSION &&
+		version != C.TLS1_3_VERSION) {
+		return nil
+	}
+	if version == C.TLS1_3_VERSION {
+		// the KeyUpdate gives keys whose records are numbered from 0,
+		// whatever OpenSSL has sent with the ones before
+		if err := c.KeyUpdate(false); err != nil {
+			return err
+		}
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	var crypto_info []byte
+	if version == C.TLS1_3_VERSION {
+		if c.ktls_secret == nil {
+			return nil
+		}
+		key := hkdfExpandLabel(suite.hash, c.ktls_secret, "key",
+			suite.key_len)
+		iv := hkdfExpandLabel(suite.hash, c.ktls_secret, "iv", 12)
+		crypto_info = ktlsCryptoInfo(C.TLS1_3_VERSION, suite, key, iv[:4],
+			iv[4:], make([]byte, 8))
+	} else {
+		var client_random, server_random [C.SSL3_RANDOM_SIZE]byte
+		var master [C.SSL_MAX_MASTER_KEY_LENGTH]byte
+		var master_len C.size_t
+		if C.SSL_get_tls12_secrets(c.ssl,
+			(*C.uchar)(unsafe.Pointer(&client_random[0])),
+			(*C.uchar)(unsafe.Pointer(&server_random[0])),
+			(*C.uchar)(unsafe.Pointer(&master[0])), &master_len) != 1 {
+			return nil
+		}
+		// the client and server write keys, then their implicit nonces
+		key_block := tls12PRF(suite.hash, master[:master_len],
+			"key expansion", append(server_random[:], client_random[:]...),
+			2*suite.key_len+8)
+		key := key_block[:suite.key_len]
+		salt := key_block[2*suite.key_len : 2*suite.key_len+4]
+		if C.SSL_is_ktls_server(c.ssl) != 0 {
+			key = key_block[suite.key_len : 2*suite.key_len]
+			salt = key_block[2*suite.key_len+4:]
+		}
+		// only Finished has been sent with these keys
+		seq := []byte{0, 0, 0, 0, 0, 0, 0, 1}
+		crypto_info = ktlsCryptoInfo(C.TLS1_2_VERSION, suite, key, salt,
+			seq, seq)
+	}
+	// whatever OpenSSL encrypted has to go out before the kernel takes over
+	if _, err := c.from_ssl.WriteTo(c.conn); err != nil {
+		return err
+	}
+	if ktlsEnableTX(c.conn, crypto_info) == nil {
+		c.ktls_tx = true
+	}
+	return nil
+}
+
+// ktlsFlush stands in for flushing OpenSSL's output once the kernel
+// encrypts, which would have it encrypted twice, by dropping it.
+func (c *Conn) ktlsFlush() (bool, error) {
+	c.mtx.Lock()
+	ktls_tx := c.ktls_tx
+	c.mtx.Unlock()
+	if !ktls_tx {
+		return false, nil
+	}
+	n, _ := c.from_ssl.WriteTo(ioutil.Discard)
+	if n > 0 {
+		return true, ktlsHandshakeMessage
+	}
+	return true, nil
+}
+
+// ktlsWrite writes b for the kernel to encrypt, if it does.
+func (c *Conn) ktlsWrite(b []byte) (bool, int, error) {
+	if err := c.startKTLS(); err != nil {
+		return true, 0, err
+	}
+	if !c.KTLS() {
+		return false, 0, nil
+	}
+	n, err := c.conn.Write(b)
+	return true, n, err
+}
+
+// ktlsClose sends close_notify where OpenSSL no longer can.
+func (c *Conn) ktlsClose() (bool, error) {
+	if !c.KTLS() {
+		return false, nil
+	}
+	return true, ktlsSendAlert(c.conn, []byte{1, 0})
+}
+
+// ktlsSaveSecret keeps the traffic secret this side of a TLS 1.3
+// connection first sends with, from a line of the key log. The caller must
+// hold c.mtx.
+func (c *Conn) ktlsSaveSecret(line string) {
+	label := "CLIENT_TRAFFIC_SECRET_0 "
+	if C.SSL_is_ktls_server(c.ssl) != 0 {
+		label = "SERVER_TRAFFIC_SECRET_0 "
+	}
+	if !strings.HasPrefix(line, label) {
+		return
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return
+	}
+	secret, err := hex.DecodeString(fields[2])
+	if err == nil {
+		c.ktls_secret = secret
+	}
+}
+
+// ktlsKeyUpdated follows a KeyUpdate of this side's keys. The caller must
+// hold c.mtx.
+func (c *Conn) ktlsKeyUpdated() {
+	if c.ktls_secret == nil {
+		return
+	}
+	suite := ktlsCipherSuites[uint16(C.SSL_get_ktls_cipher(c.ssl))]
+	if suite.hash == nil {
+		c.ktls_secret = nil
+		return
+	}
+	c.ktls_secret = hkdfExpandLabel(suite.hash, c.ktls_secret,
+		"traffic upd", len(c.ktls_secret))
+}
+
+type ktlsCipherSuite struct {
+	hash        func() hash.Hash
+	key_len     int
+	cipher_type uint16
+}
+
+var (
+	ktlsAES128GCM = ktlsCipherSuite{sha256.New, 16, 51}
+	ktlsAES256GCM = ktlsCipherSuite{sha512.New384, 32, 52}
+
+	// the cipher suites the kernel can take over, by IANA number
+	ktlsCipherSuites = map[uint16]ktlsCipherSuite{
+		0x1301: ktlsAES128GCM, // TLS_AES_128_GCM_SHA256
+		0x1302: ktlsAES256GCM, // TLS_AES_256_GCM_SHA384
+		0xc02b: ktlsAES128GCM, // ECDHE-ECDSA-AES128-GCM-SHA256
+		0xc02f: ktlsAES128GCM, // ECDHE-RSA-AES128-GCM-SHA256
+		0x009e: ktlsAES128GCM, // DHE-RSA-AES128-GCM-SHA256
+		0x009c: ktlsAES128GCM, // AES128-GCM-SHA256
+		0xc02c: ktlsAES256GCM, // ECDHE-ECDSA-AES256-GCM-SHA384
+		0xc030: ktlsAES256GCM, // ECDHE-RSA-AES256-GCM-SHA384
+		0x009f: ktlsAES256GCM, // DHE-RSA-AES256-GCM-SHA384
+		0x009d: ktlsAES256GCM, // AES256-GCM-SHA384
+	}
+)
+
+// ktlsCryptoInfo lays out a struct tls12_crypto_info_aes_gcm_128 or _256.
+func ktlsCryptoInfo(version uint16, suite ktlsCipherSuite, key, salt, iv,
+	seq []byte) []byte {
+	info := make([]byte, 4, 4+8+len(key)+4+8)
+	// the header is in host byte order
+	*(*uint16)(unsafe.Pointer(&info[0])) = version
+	*(*uint16)(unsafe.Pointer(&info[2])) = suite.cipher_type
+	info = append(info, iv...)
+	info = append(info, key...)
+	info = append(info, salt...)
+	return append(info, seq...)
+}
+
+// hkdfExpandLabel is HKDF-Expand-Label from RFC 8446 section 7.1, with an
+// empty context.
+func hkdfExpandLabel(h func() hash.Hash, secret []byte, label string,
+	length int) []byte {
+	label = "tls13 " + label
+	info := []byte{byte(length >> 8), byte(length), byte(len(label))}
+	info = append(info, label...)
+	info = append(info, 0)
+	var out, t []byte
+	mac := hmac.New(h, secret)
+	for i := byte(1); len(out) < length; i++ {
+		mac.Reset()
+		mac.Write(t)
+		mac.Write(info)
+		mac.Write([]byte{i})
+		t = mac.Sum(nil)
+		out = append(out, t...)
+	}
+	return out[:length]
+}
+
+// tls12PRF is the TLS 1.2 PRF from RFC 5246 section 5.
+func tls12PRF(h func() hash.Hash, secret []byte, label string, seed []byte,
+	length int) []byte {
+	seed = append([]byte(label), seed...)
+	mac := hmac.New(h, secret)
+	mac.Write(seed)
+	a := mac.Sum(nil)
+	var out []byte
+	for len(out) < length {
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(seed)
+		out = append(out, mac.Sum(nil)...)
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+	}
+	return out[:length]
+}
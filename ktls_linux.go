@@ -0,0 +1,129 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+// +build linux
+
+package openssl
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// from the Linux headers, as the syscall package lacks them
+	tcpULP           = 31
+	solTLS           = 282
+	tlsTX            = 1
+	tlsSetRecordType = 1
+)
+
+var (
+	ktlsProbeOnce sync.Once
+	ktlsProbed    bool
+)
+
+// ktlsSupported tries attaching the TLS upper layer protocol to a loopback
+// connection, which loads the kernel module if need be.
+func ktlsSupported() bool {
+	ktlsProbeOnce.Do(func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return
+		}
+		defer l.Close()
+		go func() {
+			conn, err := l.Accept()
+			if err == nil {
+				conn.Close()
+			}
+		}()
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		ktlsProbed = ktlsControl(conn, func(fd int) error {
+			return syscall.SetsockoptString(fd, syscall.IPPROTO_TCP, tcpULP,
+				"tls")
+		}) == nil
+	})
+	return ktlsProbed
+}
+
+// ktlsControl runs f on the socket of conn, which must be a TCP connection.
+func ktlsControl(conn net.Conn, f func(fd int) error) error {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return errors.New("kTLS requires a TCP connection")
+	}
+	raw, err := tcp.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var f_err error
+	err = raw.Control(func(fd uintptr) {
+		f_err = f(int(fd))
+	})
+	if err != nil {
+		return err
+	}
+	return f_err
+}
+
+// ktlsEnableTX makes the kernel encrypt what is written to conn from now on,
+// as described by crypto_info, a struct tls12_crypto_info_*.
+func ktlsEnableTX(conn net.Conn, crypto_info []byte) error {
+	return ktlsControl(conn, func(fd int) error {
+		err := syscall.SetsockoptString(fd, syscall.IPPROTO_TCP, tcpULP,
+			"tls")
+		if err != nil {
+			return err
+		}
+		return syscall.SetsockoptString(fd, solTLS, tlsTX,
+			string(crypto_info))
+	})
+}
+
+// ktlsSendAlert sends alert as an alert record rather than application
+// data.
+func ktlsSendAlert(conn net.Conn, alert []byte) error {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return errors.New("kTLS requires a TCP connection")
+	}
+	raw, err := tcp.SyscallConn()
+	if err != nil {
+		return err
+	}
+	oob := make([]byte, syscall.CmsgSpace(1))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = solTLS
+	h.Type = tlsSetRecordType
+	h.SetLen(syscall.CmsgLen(1))
+	oob[syscall.CmsgLen(0)] = 21 // alert
+	var send_err error
+	err = raw.Write(func(fd uintptr) bool {
+		send_err = syscall.Sendmsg(int(fd), alert, oob, nil, 0)
+		return send_err != syscall.EAGAIN
+	})
+	if err != nil {
+		return err
+	}
+	return send_err
+}
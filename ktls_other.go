@@ -0,0 +1,37 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+// +build !linux
+
+package openssl
+
+import (
+	"errors"
+	"net"
+)
+
+var ktlsUnsupported = errors.New("kTLS is only supported on Linux")
+
+func ktlsSupported() bool {
+	return false
+}
+
+func ktlsEnableTX(conn net.Conn, crypto_info []byte) error {
+	return ktlsUnsupported
+}
+
+func ktlsSendAlert(conn net.Conn, alert []byte) error {
+	return ktlsUnsupported
+}
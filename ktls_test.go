@@ -0,0 +1,116 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// ktlsSendFile sends a file from an OpenSSL server using kTLS to a
+// crypto/tls client, which checks the kernel's records, and reports whether
+// the kernel encrypted them.
+func ktlsSendFile(t *testing.T, server_conn, client_conn net.Conn,
+	version uint16) bool {
+	data := make([]byte, 256*1024)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "openssl-ktls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	server_ctx := newTestServerCtx(t)
+	server_ctx.SetKTLS(true)
+	err = server_ctx.SetCipherSuites("TLS_AES_128_GCM_SHA256")
+	if err != nil && err != tls13Unsupported {
+		t.Fatal(err)
+	}
+	server, err := Server(server_conn, server_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := tls.Client(client_conn, &tls.Config{
+		InsecureSkipVerify: true,
+		MinVersion:         version,
+		MaxVersion:         version,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}})
+	server_conn.SetDeadline(time.Now().Add(10 * time.Second))
+	client_conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	errs := make(chan error, 1)
+	var ktls bool
+	go func() {
+		_, err := server.ReadFrom(f)
+		ktls = server.KTLS()
+		if err == nil {
+			err = server.Close()
+		}
+		errs <- err
+	}()
+	got, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("client received something else")
+	}
+	return ktls
+}
+
+func TestKTLSSendFile(t *testing.T) {
+	if !KTLSSupported() {
+		t.Skip("kernel has no kTLS")
+	}
+	for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		server_conn, client_conn := NetPipe(t)
+		if !ktlsSendFile(t, server_conn, client_conn, version) {
+			t.Fatalf("expected kTLS with version %x", version)
+		}
+		server_conn.Close()
+		client_conn.Close()
+	}
+}
+
+func TestKTLSFallback(t *testing.T) {
+	// there is no socket to hand over
+	server_conn, client_conn := net.Pipe()
+	defer server_conn.Close()
+	defer client_conn.Close()
+	if ktlsSendFile(t, server_conn, client_conn, tls.VersionTLS12) {
+		t.Fatal("expected kTLS not to be used over a pipe")
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openssl
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+var finalizers_disabled int32
+
+// SetFinalizersEnabled decides whether Ctx, Certificate and key values
+// created from now on are freed by the garbage collector once unreachable,
+// as they are by default. Long-running programs that free them explicitly
+// can turn this off so that OpenSSL memory is only ever released at a known
+// point, at the cost of leaking whatever they forget to free. Conns and the
+// package's other types are always finalized, though Conns can be freed
+// explicitly too. Values created before the call are unaffected.
+func SetFinalizersEnabled(enabled bool) {
+	if enabled {
+		atomic.StoreInt32(&finalizers_disabled, 0)
+	} else {
+		atomic.StoreInt32(&finalizers_disabled, 1)
+	}
+}
+
+// FinalizersEnabled reports whether finalizers are set, see
+// SetFinalizersEnabled.
+func FinalizersEnabled() bool {
+	return atomic.LoadInt32(&finalizers_disabled) == 0
+}
+
+// setFinalizer sets finalizer on obj, which p points to, unless finalizers
+// are disabled. Then, if leak detection is on, obj is reported as leaked for
+// good once collected, as a new object may take its address.
+func setFinalizer(p unsafe.Pointer, obj interface{}, finalizer interface{}) {
+	if FinalizersEnabled() {
+		runtime.SetFinalizer(obj, finalizer)
+		return
+	}
+	key := uintptr(p)
+	leak_mtx.Lock()
+	_, tracked := leak_objects[key]
+	leak_mtx.Unlock()
+	if tracked {
+		runtime.SetFinalizer(obj, func(interface{}) {
+			leak_mtx.Lock()
+			defer leak_mtx.Unlock()
+			if leak, ok := leak_objects[key]; ok {
+				delete(leak_objects, key)
+				leak_collected = append(leak_collected, leak)
+			}
+		})
+	}
+}
+
+// Leak is an object reported by Leaks.
+type Leak struct {
+	// Kind is the type of the object: "Ctx", "Conn", "Certificate" or
+	// "key".
+	Kind string
+	// Stack is the call stack that created the object, one function per
+	// line followed by its file and line number.
+	Stack string
+
+	seq uint64
+}
+
+var (
+	leak_mtx      sync.Mutex
+	leak_tracking bool
+	leak_objects  = map[uintptr]Leak{}
+	// leak_collected holds the objects collected without being freed
+	leak_collected []Leak
+	leak_seq       uint64
+)
+
+// SetLeakDetection turns leak detection on or off. While it is on, the Ctx,
+// Conn, Certificate and key values created are recorded along with where
+// they were created, until they are freed, either explicitly or by their
+// finalizers. Recording a stack for each object is slow, so this is meant
+// for debugging and tests. Turning it off forgets the objects recorded so
+// far.
+func SetLeakDetection(enabled bool) {
+	leak_mtx.Lock()
+	defer leak_mtx.Unlock()
+	leak_tracking = enabled
+	if !enabled {
+		leak_objects = map[uintptr]Leak{}
+		leak_collected = nil
+	}
+}
+
+// Leaks returns the objects recorded since leak detection was turned on
+// that haven't been freed, oldest first. Objects left to the garbage
+// collector only stop being reported once it has finalized them, so with
+// finalizers disabled, everything not freed explicitly is reported, even
+// once unreachable.
+func Leaks() []Leak {
+	leak_mtx.Lock()
+	leaks := append([]Leak(nil), leak_collected...)
+	for _, leak := range leak_objects {
+		leaks = append(leaks, leak)
+	}
+	leak_mtx.Unlock()
+	sort.Slice(leaks, func(i, j int) bool {
+		return leaks[i].seq < leaks[j].seq
+	})
+	return leaks
+}
+
+// ReportLeaks writes the objects returned by Leaks to w, and returns how
+// many there were. Deferring it in main, or calling it from TestMain after
+// the tests have run, reports what a program leaked by the time it exits:
+//
+//	openssl.SetLeakDetection(true)
+//	defer openssl.ReportLeaks(os.Stderr)
+func ReportLeaks(w io.Writer) int {
+	leaks := Leaks()
+	for _, leak := range leaks {
+		fmt.Fprintf(w, "openssl: leaked %s created at\n%s", leak.Kind,
+			leak.Stack)
+	}
+	return len(leaks)
+}
+
+// trackObject records p, of the given kind, if leak detection is on. It is
+// called by the constructor of the object, whose caller is recorded as where
+// it was created.
+func trackObject(p unsafe.Pointer, kind string) {
+	leak_mtx.Lock()
+	tracking := leak_tracking
+	leak_mtx.Unlock()
+	if !tracking {
+		return
+	}
+	pcs := make([]uintptr, 32)
+	n := runtime.Callers(3, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	var stack bytes.Buffer
+	for {
+		frame, more := frames.Next()
+		fmt.Fprintf(&stack, "\t%s\n\t\t%s:%d\n", frame.Function, frame.File,
+			frame.Line)
+		if !more {
+			break
+		}
+	}
+	leak_mtx.Lock()
+	defer leak_mtx.Unlock()
+	if leak_tracking {
+		leak_seq++
+		leak_objects[uintptr(p)] = Leak{
+			Kind: kind, Stack: stack.String(), seq: leak_seq}
+	}
+}
+
+// untrackObject forgets p once it has been freed.
+func untrackObject(p unsafe.Pointer) {
+	leak_mtx.Lock()
+	defer leak_mtx.Unlock()
+	delete(leak_objects, uintptr(p))
+}
@@ -0,0 +1,151 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCtxFree(t *testing.T) {
+	key := generateTestRSAKey(t)
+	ca := issueTestCert(t, key, testCert{})
+	server_ctx := newSharedCtx(t, key, ca, ca)
+	client_ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client_ctx.Free()
+
+	server_conn, client_conn := NetPipe(t)
+	defer server_conn.Close()
+	defer client_conn.Close()
+	server_conn.SetDeadline(time.Now().Add(10 * time.Second))
+	client_conn.SetDeadline(time.Now().Add(10 * time.Second))
+	server, err := Server(server_conn, server_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server_ctx.Free()
+	server_ctx.Free()
+	if _, err := Server(server_conn, server_ctx); err != ctxFreed {
+		t.Fatalf("expected ctxFreed, got %v", err)
+	}
+	if server_ctx.ctx == nil {
+		t.Fatal("context freed while a connection still uses it")
+	}
+
+	// the connection keeps the context usable for its handshake
+	client, err := Client(client_conn, client_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Free()
+	server_errs := make(chan error, 1)
+	go func() { server_errs <- server.Handshake() }()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-server_errs; err != nil {
+		t.Fatal(err)
+	}
+
+	server.Free()
+	server.Free()
+	if server_ctx.ctx != nil {
+		t.Fatal("expected the context to be freed with its last connection")
+	}
+}
+
+// leaksFrom returns the leaked objects created by the named function.
+func leaksFrom(name string) (leaks []Leak) {
+	for _, leak := range Leaks() {
+		if strings.Contains(leak.Stack, "."+name+"\n") {
+			leaks = append(leaks, leak)
+		}
+	}
+	return leaks
+}
+
+func TestLeakDetection(t *testing.T) {
+	SetLeakDetection(true)
+	defer SetLeakDetection(false)
+
+	cert, err := LoadCertificateFromPEM(certBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := LoadPrivateKeyFromPEM(keyBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaks := leaksFrom("TestLeakDetection")
+	if len(leaks) != 3 || leaks[0].Kind != "Certificate" ||
+		leaks[1].Kind != "key" || leaks[2].Kind != "Ctx" {
+		t.Fatalf("unexpected leaks %v", leaks)
+	}
+	var report strings.Builder
+	if n := ReportLeaks(&report); n < 3 ||
+		!strings.Contains(report.String(), "leaked Certificate") {
+		t.Fatalf("unexpected report of %d leaks:\n%s", n, report.String())
+	}
+
+	cert.Free()
+	key.Free()
+	ctx.Free()
+	if leaks := leaksFrom("TestLeakDetection"); len(leaks) != 0 {
+		t.Fatalf("unexpected leaks after freeing %v", leaks)
+	}
+}
+
+func TestFinalizersDisabled(t *testing.T) {
+	SetLeakDetection(true)
+	defer SetLeakDetection(false)
+
+	load := func() {
+		if _, err := LoadCertificateFromPEM(certBytes); err != nil {
+			t.Fatal(err)
+		}
+	}
+	SetFinalizersEnabled(false)
+	load()
+	SetFinalizersEnabled(true)
+	runtime.GC()
+	runtime.GC()
+	if leaks := leaksFrom("TestFinalizersDisabled"); len(leaks) != 1 {
+		t.Fatalf("expected the certificate to stay unfreed, got %v", leaks)
+	}
+
+	SetLeakDetection(false)
+	SetLeakDetection(true)
+	load()
+	// finalizers run in the background after the collection
+	deadline := time.Now().Add(10 * time.Second)
+	for len(leaksFrom("TestFinalizersDisabled")) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the certificate to be finalized")
+		}
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+}
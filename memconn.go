@@ -0,0 +1,247 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+// #include <openssl/ssl.h>
+import "C"
+
+import (
+	"errors"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// InputNeeded is returned by MemoryConn's Handshake, Read and Write when they
+// can't go on until more ciphertext from the peer is fed in.
+var InputNeeded = errors.New("openssl: more input from the peer is needed")
+
+// MemoryConn is a TLS connection that doesn't own a transport: ciphertext from
+// the peer is fed in with FeedInput, ciphertext for the peer is taken with
+// TakeOutput, and the plaintext is read and written with Read and Write,
+// none of which block. It suits carrying TLS over a WebSocket, a message
+// queue or an in-memory pipe. After each call, send whatever PendingOutput
+// reports to the peer.
+//
+// MemoryConn's methods may be called from several goroutines, but Read and
+// Write return InputNeeded rather than waiting for input to be fed.
+type MemoryConn struct {
+	conn *Conn
+}
+
+// NewMemoryClient returns a MemoryConn in the client role, using ctx.
+func NewMemoryClient(ctx *Ctx) (*MemoryConn, error) {
+	c, err := Client(memoryTransport{}, ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.ktls = false
+	return &MemoryConn{conn: c}, nil
+}
+
+// NewMemoryServer returns a MemoryConn in the server role, using ctx.
+func NewMemoryServer(ctx *Ctx) (*MemoryConn, error) {
+	c, err := Server(memoryTransport{}, ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.ktls = false
+	return &MemoryConn{conn: c}, nil
+}
+
+// Conn returns the connection the MemoryConn drives, for inspecting it, e.g.
+// with ConnectionState, PeerCertificate or NegotiatedProtocol, or setting
+// it up before the handshake, e.g. with SetTlsExtHostName. Its Handshake,
+// Read, Write and Close methods must not be used.
+func (m *MemoryConn) Conn() *Conn {
+	return m.conn
+}
+
+// Handshake advances the handshake with the input fed so far. It returns nil
+// once the handshake is complete, and InputNeeded while it waits on the
+// peer. Read and Write run the handshake as needed, so calling Handshake is
+// optional.
+func (m *MemoryConn) Handshake() error {
+	if _, err := m.conn.DoHandshakeStep(); err != nil {
+		return err
+	}
+	m.conn.mtx.Lock()
+	done := m.conn.handshake_done
+	m.conn.mtx.Unlock()
+	if !done {
+		return InputNeeded
+	}
+	return nil
+}
+
+// Read decrypts up to len(b) bytes of plaintext from the input fed so far.
+// It returns InputNeeded if there is none yet, and io.EOF once the peer has
+// sent close_notify.
+func (m *MemoryConn) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	n, errcb := m.read(b)
+	if errcb != nil {
+		return 0, errcb()
+	}
+	return n, nil
+}
+
+func (m *MemoryConn) read(b []byte) (int, func() error) {
+	c := m.conn
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.is_shutdown {
+		return 0, func() error { return errors.New("connection closed") }
+	}
+	if err := c.renegotiationError(); err != nil {
+		return 0, func() error { return err }
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	rv, errno := C.SSL_read(c.ssl, unsafe.Pointer(&b[0]), C.int(len(b)))
+	if err := c.renegotiationError(); err != nil {
+		return 0, func() error { return err }
+	}
+	if rv > 0 {
+		c.countHandshake()
+		return int(rv), nil
+	}
+	return 0, memoryStepError(c.stepError(rv, errno))
+}
+
+// Write encrypts b for the peer, to be taken with TakeOutput. Before the
+// handshake is complete it may return InputNeeded, having written nothing.
+func (m *MemoryConn) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	n, errcb := m.write(b)
+	if errcb != nil {
+		return 0, errcb()
+	}
+	return n, nil
+}
+
+func (m *MemoryConn) write(b []byte) (int, func() error) {
+	c := m.conn
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.is_shutdown {
+		return 0, func() error { return errors.New("connection closed") }
+	}
+	if err := c.renegotiationError(); err != nil {
+		return 0, func() error { return err }
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	rv, errno := C.SSL_write(c.ssl, unsafe.Pointer(&b[0]), C.int(len(b)))
+	if err := c.renegotiationError(); err != nil {
+		return 0, func() error { return err }
+	}
+	if rv > 0 {
+		c.countHandshake()
+		c.countRecord(int(rv))
+		return int(rv), nil
+	}
+	return 0, memoryStepError(c.stepError(rv, errno))
+}
+
+// memoryStepError maps a call waiting on I/O to InputNeeded: output never
+// blocks, so waiting to write only means the peer has yet to answer.
+func memoryStepError(_ HandshakeStatus, errcb func() error) func() error {
+	if errcb != nil {
+		return func() error {
+			if err := errcb(); err != nil {
+				return err
+			}
+			return InputNeeded
+		}
+	}
+	return func() error { return InputNeeded }
+}
+
+// FeedInput hands ciphertext received from the peer to the connection.
+func (m *MemoryConn) FeedInput(b []byte) {
+	m.conn.FeedInput(b)
+}
+
+// FeedEOF tells the connection that the transport from the peer has closed.
+func (m *MemoryConn) FeedEOF() {
+	m.conn.FeedEOF()
+}
+
+// TakeOutput moves up to len(b) bytes of ciphertext for the peer into b,
+// returning how many it moved.
+func (m *MemoryConn) TakeOutput(b []byte) int {
+	return m.conn.TakeOutput(b)
+}
+
+// PendingOutput returns how many bytes of ciphertext are waiting to be sent
+// to the peer.
+func (m *MemoryConn) PendingOutput() int {
+	return m.conn.PendingOutput()
+}
+
+// Close sends close_notify, to be taken with TakeOutput, and stops Read
+// and Write.
+func (m *MemoryConn) Close() error {
+	c := m.conn
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.is_shutdown {
+		return nil
+	}
+	c.is_shutdown = true
+	atomic.AddInt64(&statActiveConns, -1)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if rv := C.SSL_shutdown(c.ssl); rv < 0 {
+		return errorFromErrorQueue()
+	}
+	return nil
+}
+
+// memoryTransport stands in for the underlying connection of a
+// MemoryConn's Conn, which it never uses.
+type memoryTransport struct{}
+
+var memoryTransportUnused = errors.New(
+	"openssl: memory connections have no underlying connection")
+
+func (memoryTransport) Read(b []byte) (int, error) {
+	return 0, memoryTransportUnused
+}
+
+func (memoryTransport) Write(b []byte) (int, error) {
+	return 0, memoryTransportUnused
+}
+
+func (memoryTransport) Close() error                       { return nil }
+func (memoryTransport) LocalAddr() net.Addr                { return memoryAddr{} }
+func (memoryTransport) RemoteAddr() net.Addr               { return memoryAddr{} }
+func (memoryTransport) SetDeadline(t time.Time) error      { return nil }
+func (memoryTransport) SetReadDeadline(t time.Time) error  { return nil }
+func (memoryTransport) SetWriteDeadline(t time.Time) error { return nil }
+
+type memoryAddr struct{}
+
+func (memoryAddr) Network() string { return "memory" }
+func (memoryAddr) String() string  { return "memory" }
@@ -0,0 +1,94 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"io"
+	"testing"
+)
+
+// pump moves from's pending ciphertext to to.
+func pump(from, to *MemoryConn) {
+	buf := make([]byte, 1024)
+	for from.PendingOutput() > 0 {
+		to.FeedInput(buf[:from.TakeOutput(buf)])
+	}
+}
+
+func TestMemoryConn(t *testing.T) {
+	server, err := NewMemoryServer(newTestServerCtx(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client_ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewMemoryClient(client_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 16)
+	if _, err := server.Read(buf); err != InputNeeded {
+		t.Fatalf("expected InputNeeded, got %v", err)
+	}
+	// the client's write runs its handshake
+	if _, err := client.Write([]byte("hello")); err != InputNeeded {
+		t.Fatalf("expected InputNeeded, got %v", err)
+	}
+	for i := 0; ; i++ {
+		if i > 10 {
+			t.Fatal("handshake is stuck")
+		}
+		client_err := client.Handshake()
+		pump(client, server)
+		server_err := server.Handshake()
+		pump(server, client)
+		if client_err == nil && server_err == nil {
+			break
+		}
+		for _, err := range []error{client_err, server_err} {
+			if err != nil && err != InputNeeded {
+				t.Fatal(err)
+			}
+		}
+	}
+	if server.Conn().Version() == 0 {
+		t.Fatal("expected a negotiated version")
+	}
+
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	pump(client, server)
+	n, err := server.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "hello" {
+		t.Fatalf("unexpected data %q", buf[:n])
+	}
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	pump(client, server)
+	if _, err := server.Read(buf); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <openssl/ssl.h>
+
+extern void SSL_set_info(SSL *ssl, int enabled);
+
+static const char *OUR_SSL_get_cipher_name(SSL *ssl) {
+    return SSL_get_cipher_name(ssl);
+}
+*/
+import "C"
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Metrics receives telemetry from the connections of a context, see
+// Ctx.SetMetrics. The connection's lock is held while its methods run, so
+// they must not call conn's methods; conn only tells connections apart.
+// They are called from every connection concurrently.
+type Metrics interface {
+	// HandshakeStarted is called as a connection starts its handshake.
+	HandshakeStarted(conn *Conn)
+	// HandshakeCompleted is called once the handshake has succeeded.
+	HandshakeCompleted(conn *Conn, info HandshakeInfo)
+	// HandshakeFailed is called with the first error a connection returns
+	// after starting its handshake and before completing it, whether from
+	// OpenSSL, such as a VerifyError or AlertError, or from the underlying
+	// connection, such as a timeout. Handshakes abandoned by closing the
+	// connection are neither completed nor failed.
+	HandshakeFailed(conn *Conn, info HandshakeInfo, err error)
+	// Alert is called for each alert the connection sends or receives,
+	// including the close_notify warnings of an orderly shutdown.
+	Alert(conn *Conn, alert AlertInfo)
+}
+
+// HandshakeInfo describes a handshake reported to Metrics.
+type HandshakeInfo struct {
+	Server bool
+	// Duration is the time since the handshake started.
+	Duration time.Duration
+	// Resumed tells handshakes that resumed a session from full ones.
+	Resumed bool
+	// Version and Cipher are the negotiated protocol version and cipher,
+	// which are 0 and "" for failed handshakes.
+	Version SSLVersion
+	Cipher  string
+}
+
+// AlertInfo describes an alert reported to Metrics.
+type AlertInfo struct {
+	Alert Alert
+	// Sent tells alerts sent from those received.
+	Sent bool
+	// Fatal tells fatal alerts, which end the connection, from warnings.
+	Fatal bool
+	// Handshake is true for alerts before the handshake has completed.
+	Handshake bool
+}
+
+// SetMetrics makes connections created with the context from now on report
+// handshakes and alerts to m, for monitoring servers in production. They
+// keep reporting to m when a server name callback moves them to another
+// context. HandshakeCounters is a Metrics counting what it is told. A nil m
+// stops reporting.
+func (c *Ctx) SetMetrics(m Metrics) {
+	c.metrics = m
+}
+
+// setMetrics makes the connection report to m, if not nil. The connection
+// gets an info callback of its own, so that it keeps reporting should it
+// move to a context without one. That callback stands in for the context's,
+// so it runs the context's renegotiation checks as well.
+func (c *Conn) setMetrics(m Metrics) {
+	c.metrics = m
+	if m != nil {
+		C.SSL_set_info(c.ssl, 1)
+	}
+}
+
+// reportInfo passes the events of an info callback on to the connection's
+// Metrics. The caller must hold c.mtx.
+func (c *Conn) reportInfo(where InfoWhere, ret int) {
+	switch {
+	case where&InfoHandshakeStart != 0:
+		// renegotiations and TLS 1.3 post-handshake messages start
+		// handshakes too
+		if !c.handshake_done && c.handshake_start.IsZero() {
+			c.handshake_start = time.Now()
+			c.metrics.HandshakeStarted(c)
+		}
+	case where&InfoAlert != 0:
+		c.metrics.Alert(c, AlertInfo{
+			Alert:     Alert(ret & 0xff),
+			Sent:      where&InfoWrite != 0,
+			Fatal:     ret>>8 == C.SSL3_AL_FATAL,
+			Handshake: !c.handshake_done})
+	}
+}
+
+// handshakeInfo describes the handshake for Metrics. The caller must hold
+// c.mtx.
+func (c *Conn) handshakeInfo() HandshakeInfo {
+	info := HandshakeInfo{Server: C.SSL_is_server(c.ssl) != 0}
+	if !c.handshake_start.IsZero() {
+		info.Duration = time.Since(c.handshake_start)
+	}
+	if c.handshake_done {
+		info.Resumed = C.SSL_session_reused(c.ssl) == 1
+		info.Version = c.version()
+		if name := C.OUR_SSL_get_cipher_name(c.ssl); name != nil {
+			info.Cipher = C.GoString(name)
+		}
+	}
+	return info
+}
+
+// reportHandshakeFailure reports err to the connection's Metrics if it ended
+// a handshake in progress.
+func (c *Conn) reportHandshakeFailure(err error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.handshake_done || c.handshake_failed || c.handshake_start.IsZero() {
+		return
+	}
+	c.handshake_failed = true
+	c.metrics.HandshakeFailed(c, c.handshakeInfo(), err)
+}
+
+// HandshakeCounters is a Metrics keeping counts of what connections report,
+// for one or more contexts. It implements expvar.Var, so it can be
+// published with expvar.Publish.
+type HandshakeCounters struct {
+	mtx   sync.Mutex
+	stats HandshakeStats
+}
+
+// HandshakeStats are the counts kept by HandshakeCounters.
+type HandshakeStats struct {
+	Started   int64
+	Completed int64
+	Failed    int64
+	// Resumed and Full split the completed handshakes by whether they
+	// resumed a session.
+	Resumed int64
+	Full    int64
+	// Duration is the total time completed handshakes took, and
+	// MaxDuration the longest.
+	Duration    time.Duration
+	MaxDuration time.Duration
+	// Versions and Ciphers count completed handshakes by their negotiated
+	// protocol version, e.g. "TLSv1.3", and cipher.
+	Versions map[string]int64
+	Ciphers  map[string]int64
+	// AlertsSent and AlertsReceived count alerts by their description,
+	// e.g. "unknown CA".
+	AlertsSent     map[string]int64
+	AlertsReceived map[string]int64
+}
+
+// MeanDuration returns the mean time completed handshakes took.
+func (s HandshakeStats) MeanDuration() time.Duration {
+	if s.Completed == 0 {
+		return 0
+	}
+	return s.Duration / time.Duration(s.Completed)
+}
+
+func (h *HandshakeCounters) HandshakeStarted(conn *Conn) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.stats.Started++
+}
+
+func (h *HandshakeCounters) HandshakeCompleted(conn *Conn,
+	info HandshakeInfo) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.stats.Completed++
+	if info.Resumed {
+		h.stats.Resumed++
+	} else {
+		h.stats.Full++
+	}
+	h.stats.Duration += info.Duration
+	if info.Duration > h.stats.MaxDuration {
+		h.stats.MaxDuration = info.Duration
+	}
+	countKey(&h.stats.Versions, info.Version.String())
+	countKey(&h.stats.Ciphers, info.Cipher)
+}
+
+func (h *HandshakeCounters) HandshakeFailed(conn *Conn, info HandshakeInfo,
+	err error) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.stats.Failed++
+}
+
+func (h *HandshakeCounters) Alert(conn *Conn, alert AlertInfo) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if alert.Sent {
+		countKey(&h.stats.AlertsSent, alert.Alert.String())
+	} else {
+		countKey(&h.stats.AlertsReceived, alert.Alert.String())
+	}
+}
+
+func countKey(counts *map[string]int64, key string) {
+	if *counts == nil {
+		*counts = map[string]int64{}
+	}
+	(*counts)[key]++
+}
+
+// Stats returns a copy of the counts.
+func (h *HandshakeCounters) Stats() HandshakeStats {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	stats := h.stats
+	stats.Versions = copyCounts(h.stats.Versions)
+	stats.Ciphers = copyCounts(h.stats.Ciphers)
+	stats.AlertsSent = copyCounts(h.stats.AlertsSent)
+	stats.AlertsReceived = copyCounts(h.stats.AlertsReceived)
+	return stats
+}
+
+func copyCounts(counts map[string]int64) map[string]int64 {
+	if counts == nil {
+		return nil
+	}
+	rv := make(map[string]int64, len(counts))
+	for key, n := range counts {
+		rv[key] = n
+	}
+	return rv
+}
+
+// String returns the counts as JSON, for expvar.
+func (h *HandshakeCounters) String() string {
+	data, err := json.Marshal(h.Stats())
+	if err != nil {
+		return "{}"
+	}
+	return string(data)
+}
@@ -0,0 +1,119 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// handshakeWithMetrics runs a handshake between server_ctx and client_ctx,
+// returning the errors of both ends.
+func handshakeWithMetrics(t *testing.T, server_ctx, client_ctx *Ctx) (
+	server_err, client_err error) {
+	server_conn, client_conn := NetPipe(t)
+	defer server_conn.Close()
+	defer client_conn.Close()
+	server_conn.SetDeadline(time.Now().Add(10 * time.Second))
+	client_conn.SetDeadline(time.Now().Add(10 * time.Second))
+	server, err := Server(server_conn, server_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := Client(client_conn, client_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server_errs := make(chan error, 1)
+	go func() {
+		err := server.Handshake()
+		if err == nil {
+			// with TLS 1.3, the client's rejection of the server arrives
+			// after the server's handshake
+			_, err = server.Read(make([]byte, 1))
+		}
+		server_errs <- err
+	}()
+	client_err = client.Handshake()
+	if client_err == nil {
+		client.Close()
+	}
+	return <-server_errs, client_err
+}
+
+func TestMetrics(t *testing.T) {
+	ca_key := generateTestRSAKey(t)
+	ca := issueTestCert(t, ca_key, testCert{CA: true})
+	key := generateTestRSAKey(t)
+	leaf := issueTestCert(t, key, testCert{Serial: 2, Issuer: ca,
+		IssuerKey: ca_key})
+	server_ctx := newSharedCtx(t, key, leaf, ca)
+	var server_metrics, client_metrics HandshakeCounters
+	server_ctx.SetMetrics(&server_metrics)
+	client_ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client_ctx.SetMetrics(&client_metrics)
+
+	_, client_err := handshakeWithMetrics(t, server_ctx, client_ctx)
+	if client_err != nil {
+		t.Fatal(client_err)
+	}
+	stats := client_metrics.Stats()
+	if stats.Started != 1 || stats.Completed != 1 || stats.Full != 1 ||
+		stats.Failed != 0 || stats.Versions["TLSv1.3"] != 1 ||
+		len(stats.Ciphers) != 1 || stats.MeanDuration() <= 0 {
+		t.Fatalf("unexpected client stats %+v", stats)
+	}
+	if stats.AlertsSent["close notify"] != 1 {
+		t.Fatalf("expected close_notify to be sent, got %+v", stats)
+	}
+
+	// the client trusts nothing, so the CA the server sends fails
+	client_ctx.SetVerifyMode(VerifyPeer)
+	server_err, client_err := handshakeWithMetrics(t, server_ctx,
+		client_ctx)
+	if client_err == nil || server_err == nil {
+		t.Fatal("expected the handshake to fail")
+	}
+	stats = client_metrics.Stats()
+	if stats.Started != 2 || stats.Completed != 1 || stats.Failed != 1 ||
+		stats.AlertsSent["unknown CA"] != 1 {
+		t.Fatalf("unexpected client stats %+v", stats)
+	}
+	stats = server_metrics.Stats()
+	if stats.Started != 2 || stats.AlertsReceived["unknown CA"] != 1 {
+		t.Fatalf("unexpected server stats %+v", stats)
+	}
+	var alert_err AlertError
+	if !errors.As(server_err, &alert_err) ||
+		alert_err.Alert != AlertUnknownCA {
+		t.Fatalf("unexpected server error %v", server_err)
+	}
+
+	var published HandshakeStats
+	if err := json.Unmarshal([]byte(client_metrics.String()),
+		&published); err != nil {
+		t.Fatal(err)
+	}
+	if published.Failed != 1 {
+		t.Fatalf("unexpected published stats %+v", published)
+	}
+}
@@ -15,8 +15,10 @@
 package openssl
 
 import (
+	"context"
 	"errors"
 	"net"
+	"syscall"
 )
 
 type listener struct {
@@ -37,9 +39,20 @@ func (l *listener) Accept() (c net.Conn, err error) {
 	return ssl_c, nil
 }
 
+// SyscallConn returns a raw network connection for the inner listener, so
+// that socket options can be set on it. See Conn.SyscallConn.
+func (l *listener) SyscallConn() (syscall.RawConn, error) {
+	sc, ok := l.Listener.(syscall.Conn)
+	if !ok {
+		return nil, errors.New("inner listener has no file descriptor")
+	}
+	return sc.SyscallConn()
+}
+
 // NewListener wraps an existing net.Listener such that all accepted
 // connections are wrapped as OpenSSL server connections using the provided
-// context ctx.
+// context ctx. The listener implements syscall.Conn, reaching inner's socket
+// so that options can be set on it.
 func NewListener(inner net.Listener, ctx *Ctx) net.Listener {
 	return &listener{
 		Listener: inner,
@@ -49,34 +62,138 @@ func NewListener(inner net.Listener, ctx *Ctx) net.Listener {
 // Listen is a wrapper around net.Listen that wraps incoming connections with
 // an OpenSSL server connection using the provided context ctx.
 func Listen(network, laddr string, ctx *Ctx) (net.Listener, error) {
+	return ListenWithFlags(network, laddr, ctx, 0)
+}
+
+type ListenFlags int
+
+const (
+	// ListenTCPFastOpen lets clients send data along with their SYN, saving
+	// a round trip on connections from clients that have connected before.
+	// It is only effective on Linux, and is ignored elsewhere or if the
+	// kernel refuses it.
+	ListenTCPFastOpen ListenFlags = 1 << iota
+	// ListenReusePort allows several listeners to bind the same address,
+	// with the kernel spreading incoming connections across them. It is only
+	// supported on Linux. See ListenMulti.
+	ListenReusePort
+)
+
+// ListenWithFlags is like Listen, with socket options controlled by flags.
+func ListenWithFlags(network, laddr string, ctx *Ctx, flags ListenFlags) (
+	net.Listener, error) {
 	if ctx == nil {
 		return nil, errors.New("no ssl context provided")
 	}
-	l, err := net.Listen(network, laddr)
+	lc := net.ListenConfig{Control: listenControl(flags)}
+	l, err := lc.Listen(context.Background(), network, laddr)
 	if err != nil {
 		return nil, err
 	}
 	return NewListener(l, ctx), nil
 }
 
+// ListenMulti creates n listeners bound to the same address, sharing
+// ctx, so that separate accept loops can each serve their share of incoming
+// connections rather than contending on one. If laddr has port 0, all
+// listeners use the port chosen for the first. It is only supported on
+// Linux.
+func ListenMulti(network, laddr string, ctx *Ctx, n int,
+	flags ListenFlags) (rv []net.Listener, err error) {
+	if !reusePortSupported {
+		return nil, errors.New("reuseport listeners are not supported on " +
+			"this platform")
+	}
+	if n < 1 {
+		return nil, errors.New("at least one listener is required")
+	}
+	defer func() {
+		if err != nil {
+			for _, l := range rv {
+				l.Close()
+			}
+			rv = nil
+		}
+	}()
+	for i := 0; i < n; i++ {
+		l, err := ListenWithFlags(network, laddr, ctx, flags|ListenReusePort)
+		if err != nil {
+			return rv, err
+		}
+		rv = append(rv, l)
+		laddr = l.Addr().String()
+	}
+	return rv, nil
+}
+
 type DialFlags int
 
 const (
 	InsecureSkipHostVerification DialFlags = 1 << iota
 	DisableSNI
+	// TCPFastOpen sends the ClientHello along with the SYN to servers that
+	// accept it, saving a round trip. With TLS 1.3 the handshake then
+	// completes one round trip after the connection is opened. Servers must
+	// have enabled it, see ListenTCPFastOpen. It is only effective on Linux,
+	// and is ignored elsewhere, if the kernel refuses it, or when going
+	// through a proxy.
+	//
+	// The TCP connection isn't known to work until the handshake succeeds,
+	// so the resolved addresses are tried one at a time, each with a full
+	// handshake, rather than raced.
+	TCPFastOpen
 )
 
 // Dial will connect to network/address and then wrap the corresponding
 // underlying connection with an OpenSSL client connection using context ctx.
 // If flags includes InsecureSkipHostVerification, the server certificate's
 // hostname will not be checked to match the hostname in addr. Otherwise, flags
-// should be 0.
+// should be 0. When the context verifies the server, see
+// Ctx.SetVerifyHostname, a mismatch fails the handshake itself.
 //
 // Dial probably won't work for you unless you set a verify location or add
 // some certs to the certificate store of the client context you're using.
 // This library is not nice enough to use the system certificate store by
-// default for you yet.
+// default for you yet, but Ctx.SetDefaultVerifyPaths will.
 func Dial(network, addr string, ctx *Ctx, flags DialFlags) (*Conn, error) {
+	return DialContext(context.Background(), network, addr, ctx, flags)
+}
+
+// DialContext is like Dial, but gives up on connecting once dial_ctx is
+// canceled or its deadline passes, whether during the TCP connect or the
+// handshake, returning dial_ctx's error. When addr names a host with several
+// addresses, TCP connections to them are raced with staggered starts as
+// described by RFC 8305 (Happy Eyeballs), alternating between IPv6 and IPv4,
+// and the handshake is performed on the first to connect. dial_ctx does not
+// bound the connection once it is returned.
+func DialContext(dial_ctx context.Context, network, addr string, ctx *Ctx,
+	flags DialFlags) (*Conn, error) {
+	d := Dialer{Ctx: ctx, Flags: flags}
+	return d.DialContext(dial_ctx, network, addr)
+}
+
+// Dialer holds options for dialing OpenSSL client connections. The zero
+// value dials like Dial with a nil context and no flags.
+type Dialer struct {
+	// Ctx is the client context, as for Dial.
+	Ctx *Ctx
+	// Flags are as for Dial.
+	Flags DialFlags
+	// Proxy, if set, is a SOCKS5 proxy the TCP connection is tunneled
+	// through before the handshake.
+	Proxy *SOCKS5Proxy
+}
+
+// Dial connects to addr, as with the package level Dial.
+func (d *Dialer) Dial(network, addr string) (*Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to addr, as with the package level DialContext. When
+// a Proxy is set, dial_ctx also bounds the proxy negotiation.
+func (d *Dialer) DialContext(dial_ctx context.Context, network,
+	addr string) (*Conn, error) {
+	ctx, flags := d.Ctx, d.Flags
 	host, _, err := net.SplitHostPort(addr)
 	if err != nil {
 		return nil, err
@@ -89,28 +206,59 @@ func Dial(network, addr string, ctx *Ctx, flags DialFlags) (*Conn, error) {
 		}
 		// TODO: use operating system default certificate chain?
 	}
-	c, err := net.Dial(network, addr)
+	if d.Proxy == nil && flags&TCPFastOpen != 0 {
+		return dialFastOpen(dial_ctx, network, addr, flags,
+			func(c net.Conn) (*Conn, error) {
+				return d.handshake(c, ctx, addr, host)
+			})
+	}
+	var c net.Conn
+	if d.Proxy != nil {
+		c, err = d.Proxy.dial(dial_ctx, network, addr)
+	} else {
+		c, err = dialHappyEyeballs(dial_ctx, network, addr, flags)
+	}
 	if err != nil {
 		return nil, err
 	}
+	return handshakeContext(dial_ctx, c, func(c net.Conn) (*Conn, error) {
+		return d.handshake(c, ctx, addr, host)
+	})
+}
+
+// handshake performs the client handshake on c, closing it on failure.
+func (d *Dialer) handshake(c net.Conn, ctx *Ctx, addr, host string) (*Conn,
+	error) {
 	conn, err := Client(c, ctx)
 	if err != nil {
 		c.Close()
 		return nil, err
 	}
-	if flags&DisableSNI == 0 {
+	if ctx.session_store != nil {
+		err = conn.SetSessionKey(addr)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if d.Flags&DisableSNI == 0 {
 		err = conn.SetTlsExtHostName(host)
 		if err != nil {
 			conn.Close()
 			return nil, err
 		}
 	}
+	if d.Flags&InsecureSkipHostVerification == 0 {
+		// fails the handshake itself where OpenSSL can check the name, and
+		// the check after it covers the rest
+		conn.SetVerifyHostname(host)
+	}
 	err = conn.Handshake()
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
-	if flags&InsecureSkipHostVerification == 0 {
+	if d.Flags&InsecureSkipHostVerification == 0 {
 		err = conn.VerifyHostname(host)
 		if err != nil {
 			conn.Close()
@@ -119,3 +267,12 @@ func Dial(network, addr string, ctx *Ctx, flags DialFlags) (*Conn, error) {
 	}
 	return conn, nil
 }
+
+// parseHostIP returns the IP address host holds, possibly in brackets, or
+// nil if it is a name.
+func parseHostIP(host string) net.IP {
+	if len(host) >= 3 && host[0] == '[' && host[len(host)-1] == ']' {
+		return net.ParseIP(host[1 : len(host)-1])
+	}
+	return net.ParseIP(host)
+}
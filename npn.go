@@ -0,0 +1,169 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <stdlib.h>
+#include <string.h>
+#include <openssl/ssl.h>
+
+typedef struct {
+    unsigned char *data;
+    unsigned int len;
+} npn_protos;
+
+#ifndef OPENSSL_NO_NEXTPROTONEG
+
+static int npn_advertised_cb(SSL *ssl, const unsigned char **out,
+        unsigned int *outlen, void *arg) {
+    npn_protos *protos = arg;
+    // OpenSSL copies the list into the ServerHello before returning
+    *out = protos->data;
+    *outlen = protos->len;
+    return SSL_TLSEXT_ERR_OK;
+}
+
+static int npn_select_cb(SSL *ssl, unsigned char **out,
+        unsigned char *outlen, const unsigned char *in, unsigned int inlen,
+        void *arg) {
+    npn_protos *protos = arg;
+    // without any protocol in common, this picks our first, as NPN intends
+    SSL_select_next_proto(out, outlen, in, inlen, protos->data, protos->len);
+    return SSL_TLSEXT_ERR_OK;
+}
+
+static int SSL_CTX_set_npn(SSL_CTX *ctx, npn_protos *protos) {
+    if (protos == NULL) {
+        SSL_CTX_set_next_protos_advertised_cb(ctx, NULL, NULL);
+        SSL_CTX_set_next_proto_select_cb(ctx, NULL, NULL);
+    } else {
+        SSL_CTX_set_next_protos_advertised_cb(ctx, npn_advertised_cb, protos);
+        SSL_CTX_set_next_proto_select_cb(ctx, npn_select_cb, protos);
+    }
+    return 1;
+}
+
+static void SSL_get_npn_negotiated(SSL *ssl, const unsigned char **data,
+        unsigned int *len) {
+    SSL_get0_next_proto_negotiated(ssl, data, len);
+}
+
+#else
+
+static int SSL_CTX_set_npn(SSL_CTX *ctx, npn_protos *protos) {
+    return -1;
+}
+
+static void SSL_get_npn_negotiated(SSL *ssl, const unsigned char **data,
+        unsigned int *len) {
+    *data = NULL;
+    *len = 0;
+}
+
+#endif
+
+static npn_protos *npn_protos_new(const unsigned char *data,
+        unsigned int len) {
+    npn_protos *protos = malloc(sizeof(npn_protos));
+    if (protos == NULL)
+        return NULL;
+    protos->data = malloc(len);
+    if (protos->data == NULL) {
+        free(protos);
+        return NULL;
+    }
+    memcpy(protos->data, data, len);
+    protos->len = len;
+    return protos;
+}
+
+static void npn_protos_free(npn_protos *protos) {
+    if (protos != NULL)
+        free(protos->data);
+    free(protos);
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"unsafe"
+)
+
+// marshalProtocolList encodes protocol names as a length prefixed list, the
+// wire format of both NPN and ALPN.
+func marshalProtocolList(protos []string) ([]byte, error) {
+	var wire []byte
+	for _, proto := range protos {
+		if len(proto) == 0 || len(proto) > 255 {
+			return nil, errors.New("invalid protocol name")
+		}
+		wire = append(wire, byte(len(proto)))
+		wire = append(wire, proto...)
+	}
+	return wire, nil
+}
+
+// SetNextProtos sets the application protocols negotiated with the legacy
+// Next Protocol Negotiation extension, for peers that predate ALPN, such as
+// SPDY-era clients. Servers advertise protos, and clients pick the first of
+// protos that the server advertises, or the first of protos if there is
+// none in common. An empty list disables NPN.
+//
+// NPN is only negotiated by TLS 1.2 and older, so peers that need it must be
+// kept off TLS 1.3. Like the rest of the context's configuration, the list
+// must be set before the context is used.
+func (c *Ctx) SetNextProtos(protos []string) error {
+	wire, err := marshalProtocolList(protos)
+	if err != nil {
+		return err
+	}
+	var npn *C.npn_protos
+	if len(wire) > 0 {
+		npn = C.npn_protos_new((*C.uchar)(unsafe.Pointer(&wire[0])),
+			C.uint(len(wire)))
+		if npn == nil {
+			return errors.New("failed to allocate memory")
+		}
+	}
+	if C.SSL_CTX_set_npn(c.ctx, npn) != 1 {
+		C.npn_protos_free(npn)
+		return errors.New("NPN is not supported by this OpenSSL build")
+	}
+	c.freeNextProtos()
+	c.npn_protos = unsafe.Pointer(npn)
+	return nil
+}
+
+func (c *Ctx) freeNextProtos() {
+	C.npn_protos_free((*C.npn_protos)(c.npn_protos))
+	c.npn_protos = nil
+}
+
+// NextProtoNegotiated returns the application protocol chosen with NPN, or ""
+// if none was. It is only meaningful once the handshake has completed.
+func (c *Conn) NextProtoNegotiated() string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	var data *C.uchar
+	var length C.uint
+	C.SSL_get_npn_negotiated(c.ssl, &data, &length)
+	if data == nil || length == 0 {
+		return ""
+	}
+	return string(C.GoBytes(unsafe.Pointer(data), C.int(length)))
+}
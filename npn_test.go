@@ -0,0 +1,77 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"testing"
+)
+
+func TestNextProtos(t *testing.T) {
+	server_ctx := newTestServerCtx(t)
+	if err := server_ctx.SetNextProtos(
+		[]string{"spdy/3.1", "http/1.1"}); err != nil {
+		t.Fatal(err)
+	}
+	negotiate := func(protos []string) (string, string) {
+		// NPN isn't part of TLS 1.3
+		client_ctx, err := NewCtxWithVersion(TLSv1_2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := client_ctx.SetNextProtos(protos); err != nil {
+			t.Fatal(err)
+		}
+		server_conn, client_conn := NetPipe(t)
+		defer server_conn.Close()
+		defer client_conn.Close()
+		server, err := Server(server_conn, server_ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+		client, err := Client(client_conn, client_ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		errs := make(chan error, 1)
+		go func() { errs <- server.Handshake() }()
+		if err := client.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+		return client.NextProtoNegotiated(), server.NextProtoNegotiated()
+	}
+
+	client_proto, server_proto := negotiate([]string{"h2", "http/1.1"})
+	if client_proto != "http/1.1" || server_proto != "http/1.1" {
+		t.Fatalf("unexpected protocols %q and %q", client_proto,
+			server_proto)
+	}
+	// with nothing in common the client's first choice wins
+	client_proto, server_proto = negotiate([]string{"h2"})
+	if client_proto != "h2" || server_proto != "h2" {
+		t.Fatalf("unexpected protocols %q and %q", client_proto,
+			server_proto)
+	}
+
+	if err := server_ctx.SetNextProtos([]string{""}); err == nil {
+		t.Fatal("expected an error for an empty protocol name")
+	}
+}
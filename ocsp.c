@@ -0,0 +1,80 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include <string.h>
+#include <openssl/ssl.h>
+#include <openssl/x509v3.h>
+#include "_cgo_export.h"
+
+extern int OUR_X509_up_ref(X509 *x);
+
+static int ocsp_status_cb(SSL *ssl, void *arg) {
+	// after an SNI switch this is the context the client was handed to, so
+	// it staples the response for that context's certificate
+	SSL_CTX *ssl_ctx = SSL_get_SSL_CTX(ssl);
+	return ocsp_status_cb_thunk(
+		SSL_CTX_get_ex_data(ssl_ctx, get_ssl_ctx_idx()), ssl);
+}
+
+long SSL_CTX_set_ocsp_status_cb(SSL_CTX *ssl_ctx) {
+	return SSL_CTX_set_tlsext_status_cb(ssl_ctx, ocsp_status_cb);
+}
+
+int SSL_set_ocsp_response(SSL *ssl, const unsigned char *der, long len) {
+	// the connection takes ownership of the copy
+	unsigned char *buf = OPENSSL_malloc(len);
+	if (buf == NULL)
+		return 0;
+	memcpy(buf, der, len);
+	if (SSL_set_tlsext_status_ocsp_resp(ssl, buf, len) != 1) {
+		OPENSSL_free(buf);
+		return 0;
+	}
+	return 1;
+}
+
+long SSL_CTX_request_ocsp_staple(SSL_CTX *ssl_ctx) {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+	return SSL_CTX_set_tlsext_status_type(ssl_ctx, TLSEXT_STATUSTYPE_ocsp);
+#else
+	return -1;
+#endif
+}
+
+long SSL_get_ocsp_response(SSL *ssl, const unsigned char **der) {
+	return SSL_get_tlsext_status_ocsp_resp(ssl, der);
+}
+
+// returns a reference to the issuer of the peer's certificate, preferring the
+// chain it was verified with, which may end in a certificate the peer didn't
+// send
+X509 *SSL_get_peer_issuer(SSL *ssl, X509 *leaf) {
+	STACK_OF(X509) *chains[2] = { NULL, SSL_get_peer_cert_chain(ssl) };
+	int i, j;
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+	chains[0] = SSL_get0_verified_chain(ssl);
+#endif
+	for (i = 0; i < 2; i++) {
+		if (chains[i] == NULL)
+			continue;
+		for (j = 0; j < sk_X509_num(chains[i]); j++) {
+			X509 *x = sk_X509_value(chains[i], j);
+			if (X509_check_issued(x, leaf) == X509_V_OK) {
+				OUR_X509_up_ref(x);
+				return x;
+			}
+		}
+	}
+	return NULL;
+}
@@ -0,0 +1,768 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <stdlib.h>
+#include <string.h>
+#include <openssl/ssl.h>
+#include <openssl/ocsp.h>
+#include <openssl/x509v3.h>
+
+extern long SSL_CTX_set_ocsp_status_cb(SSL_CTX *ssl_ctx);
+extern int SSL_set_ocsp_response(SSL *ssl, const unsigned char *der,
+    long len);
+extern long SSL_CTX_request_ocsp_staple(SSL_CTX *ssl_ctx);
+extern long SSL_get_ocsp_response(SSL *ssl, const unsigned char **der);
+extern X509 *SSL_get_peer_issuer(SSL *ssl, X509 *leaf);
+extern int OCSP_basic_verify_issuer(OCSP_BASICRESP *bs, X509 *issuer);
+
+static char *X509_get_ocsp_url(X509 *x) {
+    STACK_OF(OPENSSL_STRING) *urls = X509_get1_ocsp(x);
+    char *rv = NULL;
+    if (urls != NULL && sk_OPENSSL_STRING_num(urls) > 0)
+        rv = strdup(sk_OPENSSL_STRING_value(urls, 0));
+    X509_email_free(urls);
+    return rv;
+}
+
+static int OCSP_request_der(OCSP_CERTID *id, unsigned char *out) {
+    OCSP_REQUEST *req = OCSP_REQUEST_new();
+    OCSP_CERTID *dup = OCSP_CERTID_dup(id);
+    int rv = -1;
+    if (req != NULL && dup != NULL && OCSP_request_add0_id(req, dup) != NULL) {
+        dup = NULL;
+        rv = i2d_OCSP_REQUEST(req, out == NULL ? NULL : &out);
+    }
+    OCSP_CERTID_free(dup);
+    OCSP_REQUEST_free(req);
+    return rv;
+}
+
+static OCSP_RESPONSE *d2i_OCSP_RESPONSE_buf(const unsigned char *der,
+        long len) {
+    return d2i_OCSP_RESPONSE(NULL, &der, len);
+}
+*/
+import "C"
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+var (
+	// OCSPRetryInterval is how long an OCSPStapler waits before trying again
+	// after failing to refresh its response.
+	OCSPRetryInterval = time.Minute
+	// OCSPDefaultRefreshInterval is how often an OCSPStapler refreshes
+	// responses that don't say when the next update is due.
+	OCSPDefaultRefreshInterval = time.Hour
+)
+
+// OCSPRevoked is returned when an OCSP responder reports a certificate as
+// revoked.
+var OCSPRevoked = errors.New(
+	"openssl: OCSP responder reports the certificate as revoked")
+
+// maxOCSPResponseSize bounds the responses we are willing to read.
+const maxOCSPResponseSize = 1 << 20
+
+// SetOCSPStaple makes servers using the context staple der, a DER-encoded
+// OCSP response for the context's certificate, for clients that request one
+// (RFC 6066). A nil der stops stapling. The response is served as is; see
+// OCSPStapler for one that is validated and kept fresh.
+func (c *Ctx) SetOCSPStaple(der []byte) {
+	c.ocsp_mtx.Lock()
+	defer c.ocsp_mtx.Unlock()
+	c.ocsp_staple = der
+	if !c.ocsp_cb_set {
+		c.ocsp_cb_set = true
+		C.SSL_CTX_set_ocsp_status_cb(c.ctx)
+	}
+}
+
+// OCSPStapleFlags control what clients do with the OCSP responses servers
+// staple.
+type OCSPStapleFlags int
+
+const (
+	// OCSPStapleVerify fails the handshake if the server staples a response
+	// that isn't signed on behalf of the certificate's issuer, isn't current,
+	// or doesn't report the certificate as good. The issuer is found in the
+	// chain the certificate was verified with, or failing that, the chain
+	// the server sent.
+	OCSPStapleVerify OCSPStapleFlags = 1 << iota
+	// OCSPMustStaple fails the handshake if the server's certificate asks
+	// for a staple with the TLS Feature extension (RFC 7633) but the server
+	// doesn't provide one.
+	OCSPMustStaple
+)
+
+// RequestOCSPStaple makes clients using the context ask servers to staple an
+// OCSP response for their certificate, which then shows up in
+// Conn.OCSPResponse, and act on it as flags say. With no flags the response
+// is only passed on. It requires OpenSSL 1.1.0 or newer.
+func (c *Ctx) RequestOCSPStaple(flags OCSPStapleFlags) error {
+	c.ocsp_mtx.Lock()
+	defer c.ocsp_mtx.Unlock()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	switch C.SSL_CTX_request_ocsp_staple(c.ctx) {
+	case 1:
+	case -1:
+		return errors.New("requesting OCSP staples requires OpenSSL 1.1.0 " +
+			"or newer")
+	default:
+		return errorFromErrorQueue()
+	}
+	c.ocsp_client_flags = flags
+	if !c.ocsp_cb_set {
+		c.ocsp_cb_set = true
+		C.SSL_CTX_set_ocsp_status_cb(c.ctx)
+	}
+	return nil
+}
+
+// OCSPResponse returns the OCSP response the server stapled, or nil if it
+// stapled none. It is only available to clients that asked for one with
+// Ctx.RequestOCSPStaple, once the handshake has completed.
+func (c *Conn) OCSPResponse() []byte {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	var der *C.uchar
+	n := C.SSL_get_ocsp_response(c.ssl, &der)
+	if der == nil || n <= 0 {
+		return nil
+	}
+	return C.GoBytes(unsafe.Pointer(der), C.int(n))
+}
+
+// checkOCSPStaple acts on the response a server stapled as the client's
+// flags say, returning why the handshake should fail, if it should.
+func (c *Ctx) checkOCSPStaple(ssl *C.SSL) error {
+	c.ocsp_mtx.Lock()
+	flags := c.ocsp_client_flags
+	c.ocsp_mtx.Unlock()
+	if flags == 0 {
+		return nil
+	}
+	leaf_x := C.SSL_get_peer_certificate(ssl)
+	if leaf_x == nil {
+		return errors.New("no peer certificate found")
+	}
+	leaf := newCertificate(leaf_x)
+	defer leaf.Free()
+	var der_ptr *C.uchar
+	n := C.SSL_get_ocsp_response(ssl, &der_ptr)
+	if der_ptr == nil || n <= 0 {
+		if flags&OCSPMustStaple == 0 {
+			return nil
+		}
+		must_staple, err := leaf.MustStaple()
+		if err != nil {
+			return err
+		}
+		if must_staple {
+			return errors.New("certificate requires an OCSP staple, but " +
+				"none was provided")
+		}
+		return nil
+	}
+	if flags&OCSPStapleVerify == 0 {
+		return nil
+	}
+	der := C.GoBytes(unsafe.Pointer(der_ptr), C.int(n))
+	issuer_x := C.SSL_get_peer_issuer(ssl, leaf_x)
+	if issuer_x == nil {
+		return errors.New("no issuer to check the OCSP staple against")
+	}
+	issuer := newCertificate(issuer_x)
+	defer issuer.Free()
+	return checkStapledOCSP(der, leaf, issuer)
+}
+
+// checkStapledOCSP checks that der, a response a server stapled, is current,
+// signed on behalf of issuer, and reports leaf as good.
+func checkStapledOCSP(der []byte, leaf, issuer *Certificate) error {
+	if der == nil {
+		return errors.New("no OCSP response stapled")
+	}
+	id, err := newOCSPCertID(leaf, issuer)
+	if err != nil {
+		return err
+	}
+	defer C.OCSP_CERTID_free(id)
+	_, err = checkOCSPResponse(der, id, issuer)
+	return err
+}
+
+// OCSPStapleError is returned by client handshakes failed because of the
+// OCSP response the server stapled, or didn't, as Ctx.RequestOCSPStaple
+// describes.
+type OCSPStapleError struct {
+	Err error
+}
+
+func (e OCSPStapleError) Error() string {
+	return fmt.Sprintf("openssl: OCSP staple rejected: %v", e.Err)
+}
+
+// SetStapledOCSP is like SetOCSPStaple, but first checks that der is a
+// successful OCSP response, so that a stray file or responder error page
+// isn't handed to clients. It doesn't check what the response says about
+// the certificate; OCSPStapler does that.
+func (c *Ctx) SetStapledOCSP(der []byte) error {
+	if der != nil {
+		if len(der) == 0 {
+			return errors.New("empty OCSP response")
+		}
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		resp := C.d2i_OCSP_RESPONSE_buf((*C.uchar)(&der[0]),
+			C.long(len(der)))
+		if resp == nil {
+			return errorFromErrorQueue()
+		}
+		resp_status := C.OCSP_response_status(resp)
+		C.OCSP_RESPONSE_free(resp)
+		if resp_status != C.OCSP_RESPONSE_STATUS_SUCCESSFUL {
+			return fmt.Errorf("OCSP responder failed: %s", C.GoString(
+				C.OCSP_response_status_str(C.long(resp_status))))
+		}
+	}
+	c.SetOCSPStaple(der)
+	return nil
+}
+
+//export ocsp_status_cb_thunk
+func ocsp_status_cb_thunk(p unsafe.Pointer, ssl *C.SSL) C.int {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Critf("openssl: OCSP status callback panic'd: %v", err)
+			os.Exit(1)
+		}
+	}()
+	ctx := (*Ctx)(p)
+	if C.SSL_is_server(ssl) == 0 {
+		// clients are called with the response the server stapled
+		err := ctx.checkOCSPStaple(ssl)
+		if err == nil {
+			return 1
+		}
+		conn := (*Conn)(C.SSL_get_ex_data(ssl, get_ssl_idx()))
+		conn.ocsp_err = OCSPStapleError{err}
+		return 0
+	}
+	ctx.ocsp_mtx.Lock()
+	staple := ctx.ocsp_staple
+	ctx.ocsp_mtx.Unlock()
+	if len(staple) == 0 {
+		return C.SSL_TLSEXT_ERR_NOACK
+	}
+	if C.SSL_set_ocsp_response(ssl, (*C.uchar)(&staple[0]),
+		C.long(len(staple))) != 1 {
+		logger.Errorf("openssl: failed to staple OCSP response")
+		return C.SSL_TLSEXT_ERR_NOACK
+	}
+	return C.SSL_TLSEXT_ERR_OK
+}
+
+// OCSPStapler keeps the OCSP response stapled by a server context fresh, much
+// like nginx's ssl_stapling. It fetches responses from the responder named in
+// the certificate, checks that they are signed by the issuer (or a responder
+// it delegated to) and report the certificate as good, and refreshes them
+// halfway to their next update. If a refresh fails, the previous response is
+// kept until it expires and the refresh is retried every
+// OCSPRetryInterval; servers staple nothing while they have no valid
+// response.
+type OCSPStapler struct {
+	ctx    *Ctx
+	leaf   *Certificate
+	issuer *Certificate
+	url    string
+	client *http.Client
+
+	mtx              sync.Mutex
+	staple           []byte
+	fetched          time.Time
+	next_update      time.Time
+	refresh_interval time.Duration
+
+	done       chan struct{}
+	stopped    chan struct{}
+	reschedule chan struct{}
+}
+
+// NewOCSPStapler starts keeping ctx stapled with responses for leaf, which
+// must be the certificate ctx serves, issued by issuer. Responses are fetched
+// with client, or http.DefaultClient if it is nil. The first fetch happens
+// before NewOCSPStapler returns; if it fails, the failure is logged and
+// retried in the background.
+func NewOCSPStapler(ctx *Ctx, leaf, issuer *Certificate,
+	client *http.Client) (*OCSPStapler, error) {
+	url, err := leaf.OCSPServer()
+	if err != nil {
+		return nil, err
+	}
+	if url == "" {
+		return nil, errors.New("certificate names no OCSP responder")
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	s := &OCSPStapler{
+		ctx:        ctx,
+		leaf:       leaf,
+		issuer:     issuer,
+		url:        url,
+		client:     client,
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+		reschedule: make(chan struct{}, 1)}
+	err = s.Refresh()
+	if err != nil {
+		logger.Errorf("openssl: failed to fetch OCSP staple: %v", err)
+	}
+	go s.run(err)
+	return s, nil
+}
+
+// OCSPServer returns the URL of the first OCSP responder listed in the
+// certificate's Authority Information Access extension, or "" if there is
+// none.
+func (c *Certificate) OCSPServer() (string, error) {
+	x := c.acquireX509()
+	if x == nil {
+		return "", certificateFreed
+	}
+	defer C.X509_free(x)
+	url := C.X509_get_ocsp_url(x)
+	if url == nil {
+		return "", nil
+	}
+	defer C.free(unsafe.Pointer(url))
+	return C.GoString(url), nil
+}
+
+// Staple returns the response currently stapled, or nil if there is none.
+func (s *OCSPStapler) Staple() []byte {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.staple
+}
+
+// Refresh fetches, checks and installs a new response right away.
+func (s *OCSPStapler) Refresh() error {
+	der, next_update, err := fetchOCSPResponse(s.client, s.url, s.leaf,
+		s.issuer)
+	if err != nil {
+		return err
+	}
+	s.mtx.Lock()
+	s.staple = der
+	s.fetched = time.Now()
+	s.next_update = next_update
+	s.mtx.Unlock()
+	s.ctx.SetOCSPStaple(der)
+	return nil
+}
+
+// SetRefreshInterval makes the stapler refresh its response at least every
+// interval, even when the response would stay good for longer, so that
+// clients learn of a revocation sooner. An interval of 0 restores the
+// default of refreshing halfway to the next update.
+func (s *OCSPStapler) SetRefreshInterval(interval time.Duration) {
+	s.mtx.Lock()
+	s.refresh_interval = interval
+	s.mtx.Unlock()
+	select {
+	case s.reschedule <- struct{}{}:
+	default:
+	}
+}
+
+// Close stops refreshing and stapling.
+func (s *OCSPStapler) Close() error {
+	select {
+	case <-s.done:
+		return nil
+	default:
+	}
+	close(s.done)
+	<-s.stopped
+	s.mtx.Lock()
+	s.staple = nil
+	s.mtx.Unlock()
+	s.ctx.SetOCSPStaple(nil)
+	return nil
+}
+
+func (s *OCSPStapler) run(err error) {
+	defer close(s.stopped)
+	for {
+		timer := time.NewTimer(s.wait(err, time.Now()))
+		select {
+		case <-s.done:
+			timer.Stop()
+			return
+		case <-s.reschedule:
+			timer.Stop()
+			continue
+		case <-timer.C:
+		}
+		err = s.Refresh()
+		if err != nil {
+			logger.Errorf("openssl: failed to refresh OCSP staple: %v", err)
+			s.dropExpired(time.Now())
+		}
+	}
+}
+
+// wait returns how long to wait until the next refresh, given the outcome of
+// the last one.
+func (s *OCSPStapler) wait(err error, now time.Time) time.Duration {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	var until time.Duration
+	if s.next_update.IsZero() {
+		until = s.fetched.Add(OCSPDefaultRefreshInterval).Sub(now)
+	} else {
+		until = s.fetched.Add(s.next_update.Sub(s.fetched) / 2).Sub(now)
+	}
+	if s.refresh_interval > 0 {
+		if limit := s.fetched.Add(s.refresh_interval).Sub(now); limit < until {
+			until = limit
+		}
+	}
+	if err != nil || s.staple == nil {
+		until = OCSPRetryInterval
+		if s.staple != nil && !s.next_update.IsZero() {
+			// wake up in time to drop the response when it expires
+			if expires := s.next_update.Sub(now); expires < until {
+				until = expires
+			}
+		}
+	}
+	if until < 0 {
+		until = 0
+	}
+	return until
+}
+
+func (s *OCSPStapler) dropExpired(now time.Time) {
+	s.mtx.Lock()
+	expired := s.staple != nil && !s.next_update.IsZero() &&
+		!now.Before(s.next_update)
+	if expired {
+		s.staple = nil
+	}
+	s.mtx.Unlock()
+	if expired {
+		s.ctx.SetOCSPStaple(nil)
+	}
+}
+
+// fetchOCSPResponse asks the responder at url about leaf, and returns the
+// response after checking it, along with when it is next due to be updated.
+func fetchOCSPResponse(client *http.Client, url string, leaf,
+	issuer *Certificate) ([]byte, time.Time, error) {
+	id, err := newOCSPCertID(leaf, issuer)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer C.OCSP_CERTID_free(id)
+	req, err := ocspRequestDER(id)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	resp, err := client.Post(url, "application/ocsp-request",
+		bytes.NewReader(req))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, time.Time{}, fmt.Errorf("OCSP responder returned %s",
+			resp.Status)
+	}
+	der, err := ioutil.ReadAll(io.LimitReader(resp.Body,
+		maxOCSPResponseSize))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	next_update, err := checkOCSPResponse(der, id, issuer)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return der, next_update, nil
+}
+
+func ocspRequestDER(id *C.OCSP_CERTID) ([]byte, error) {
+	n := C.OCSP_request_der(id, nil)
+	if n <= 0 {
+		return nil, errors.New("failed to build OCSP request")
+	}
+	req := make([]byte, n)
+	if C.OCSP_request_der(id, (*C.uchar)(&req[0])) != n {
+		return nil, errors.New("failed to build OCSP request")
+	}
+	return req, nil
+}
+
+func newOCSPCertID(leaf, issuer *Certificate) (*C.OCSP_CERTID, error) {
+	leaf_x := leaf.acquireX509()
+	if leaf_x == nil {
+		return nil, certificateFreed
+	}
+	defer C.X509_free(leaf_x)
+	issuer_x := issuer.acquireX509()
+	if issuer_x == nil {
+		return nil, certificateFreed
+	}
+	defer C.X509_free(issuer_x)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	id := C.OCSP_cert_to_id(nil, leaf_x, issuer_x)
+	if id == nil {
+		return nil, errorFromErrorQueue()
+	}
+	return id, nil
+}
+
+// checkOCSPResponse checks that der is a currently valid response, signed on
+// behalf of issuer, reporting the certificate identified by id as good. It
+// returns when the next update is due, or the zero time if the response
+// doesn't say.
+func checkOCSPResponse(der []byte, id *C.OCSP_CERTID,
+	issuer *Certificate) (time.Time, error) {
+	if len(der) == 0 {
+		return time.Time{}, errors.New("empty OCSP response")
+	}
+	issuer_x := issuer.acquireX509()
+	if issuer_x == nil {
+		return time.Time{}, certificateFreed
+	}
+	defer C.X509_free(issuer_x)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	resp := C.d2i_OCSP_RESPONSE_buf((*C.uchar)(&der[0]), C.long(len(der)))
+	if resp == nil {
+		return time.Time{}, errorFromErrorQueue()
+	}
+	defer C.OCSP_RESPONSE_free(resp)
+	resp_status := C.OCSP_response_status(resp)
+	if resp_status != C.OCSP_RESPONSE_STATUS_SUCCESSFUL {
+		return time.Time{}, fmt.Errorf("OCSP responder failed: %s",
+			C.GoString(C.OCSP_response_status_str(C.long(resp_status))))
+	}
+	basic := C.OCSP_response_get1_basic(resp)
+	if basic == nil {
+		return time.Time{}, errorFromErrorQueue()
+	}
+	defer C.OCSP_BASICRESP_free(basic)
+	if C.OCSP_basic_verify_issuer(basic, issuer_x) != 1 {
+		return time.Time{}, errorFromErrorQueue()
+	}
+	var status, reason C.int
+	var revoked, this_update, next_update *C.ASN1_GENERALIZEDTIME
+	if C.OCSP_resp_find_status(basic, id, &status, &reason, &revoked,
+		&this_update, &next_update) != 1 {
+		return time.Time{}, errors.New(
+			"OCSP response doesn't cover the certificate")
+	}
+	if status == C.V_OCSP_CERTSTATUS_REVOKED {
+		return time.Time{}, OCSPRevoked
+	}
+	if status != C.V_OCSP_CERTSTATUS_GOOD {
+		return time.Time{}, fmt.Errorf("OCSP responder reports the "+
+			"certificate as %s", C.GoString(C.OCSP_cert_status_str(
+			C.long(status))))
+	}
+	// allow for some clock skew, as OpenSSL's own tools do
+	if C.OCSP_check_validity(this_update, next_update, 300, -1) != 1 {
+		return time.Time{}, errorFromErrorQueue()
+	}
+	if next_update == nil {
+		return time.Time{}, nil
+	}
+	return asn1TimeToTime((*C.ASN1_TIME)(unsafe.Pointer(next_update)))
+}
+
+// OCSPPolicy says what an OCSPChecker does with certificates whose status it
+// can't find out, such as when the responder is unreachable.
+type OCSPPolicy int
+
+const (
+	// OCSPSoftFail accepts them, as browsers do. An attacker able to block
+	// the responder can then get a revoked certificate accepted.
+	OCSPSoftFail OCSPPolicy = iota
+	// OCSPHardFail refuses them.
+	OCSPHardFail
+)
+
+// maxOCSPCacheSize is how many responses an OCSPChecker holds before it
+// starts dropping expired ones.
+const maxOCSPCacheSize = 1024
+
+// OCSPChecker checks peer certificates with their issuer's OCSP responder
+// once the chain has been verified. It asks the responder named in the
+// certificate's Authority Information Access extension, checks that the
+// response is signed on behalf of the issuer and current, and refuses
+// certificates reported as revoked. Responses are cached until their next
+// update, or for OCSPDefaultRefreshInterval if they don't say, and failures
+// to get one for OCSPRetryInterval, so that handshakes only wait on the
+// responder when the cache has nothing current. One checker may be shared by
+// several contexts.
+type OCSPChecker struct {
+	client *http.Client
+	policy OCSPPolicy
+
+	mtx   sync.Mutex
+	cache map[string]ocspCacheEntry
+}
+
+type ocspCacheEntry struct {
+	err     error
+	expires time.Time
+}
+
+// NewOCSPChecker returns a checker fetching responses with client, or
+// http.DefaultClient if it is nil, and treating certificates whose status
+// it can't find out as policy says.
+func NewOCSPChecker(client *http.Client, policy OCSPPolicy) *OCSPChecker {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &OCSPChecker{
+		client: client,
+		policy: policy,
+		cache:  make(map[string]ocspCacheEntry)}
+}
+
+// SetOCSPChecker makes connections using the context check the peer's
+// certificate with checker as part of verifying it, once the rest of its
+// chain has been verified. Certificates refused fail verification with
+// Conn.VerifyResult reporting CertRevoked, or ApplicationVerification when
+// the checker's policy refuses a certificate whose status is unknown. It
+// only applies when the verify mode asks for the peer's certificate, and a
+// certificate trusted directly, with no issuer in its chain, isn't checked.
+// The handshake waits on the responder while it holds the connection's
+// lock. A nil checker removes it.
+func (c *Ctx) SetOCSPChecker(checker *OCSPChecker) {
+	c.ocsp_mtx.Lock()
+	c.ocsp_checker = checker
+	c.ocsp_mtx.Unlock()
+	c.SetVerify(c.VerifyMode(), c.verify_cb)
+}
+
+func (c *Ctx) ocspChecker() *OCSPChecker {
+	c.ocsp_mtx.Lock()
+	defer c.ocsp_mtx.Unlock()
+	return c.ocsp_checker
+}
+
+// Check returns nil if the responder reports leaf, issued by issuer, as
+// good, OCSPRevoked if it reports it as revoked, and otherwise why its
+// status couldn't be found out, unless the checker's policy is
+// OCSPSoftFail.
+func (o *OCSPChecker) Check(leaf, issuer *Certificate) error {
+	err := o.check(leaf, issuer)
+	if err == nil || err == OCSPRevoked || o.policy == OCSPHardFail {
+		return err
+	}
+	logger.Warnf("openssl: accepting certificate with unknown OCSP "+
+		"status: %v", err)
+	return nil
+}
+
+func (o *OCSPChecker) check(leaf, issuer *Certificate) error {
+	id, err := newOCSPCertID(leaf, issuer)
+	if err != nil {
+		return err
+	}
+	req, err := ocspRequestDER(id)
+	C.OCSP_CERTID_free(id)
+	if err != nil {
+		return err
+	}
+	key := string(req)
+	now := time.Now()
+	o.mtx.Lock()
+	entry, ok := o.cache[key]
+	o.mtx.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.err
+	}
+
+	entry = ocspCacheEntry{expires: now.Add(OCSPDefaultRefreshInterval)}
+	url, err := leaf.OCSPServer()
+	if err == nil && url == "" {
+		err = errors.New("certificate names no OCSP responder")
+	}
+	if err != nil {
+		return err
+	}
+	_, next_update, err := fetchOCSPResponse(o.client, url, leaf, issuer)
+	switch {
+	case err == OCSPRevoked:
+		entry.err = err
+	case err != nil:
+		entry.err = err
+		entry.expires = now.Add(OCSPRetryInterval)
+	case !next_update.IsZero():
+		entry.expires = next_update
+	}
+	o.mtx.Lock()
+	if len(o.cache) >= maxOCSPCacheSize {
+		for key, entry := range o.cache {
+			if !now.Before(entry.expires) {
+				delete(o.cache, key)
+			}
+		}
+	}
+	o.cache[key] = entry
+	o.mtx.Unlock()
+	return entry.err
+}
+
+// checkOCSP runs the context's OCSPChecker, if any, on a verified chain,
+// returning the verify result to fail verification with, or Ok.
+func (c *Ctx) checkOCSP(chain []*Certificate) VerifyResult {
+	checker := c.ocspChecker()
+	if checker == nil || len(chain) < 2 {
+		return Ok
+	}
+	switch checker.Check(chain[0], chain[1]) {
+	case nil:
+		return Ok
+	case OCSPRevoked:
+		return CertRevoked
+	default:
+		return ApplicationVerification
+	}
+}
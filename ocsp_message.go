@@ -0,0 +1,713 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <openssl/err.h>
+#include <openssl/ocsp.h>
+#include <openssl/x509v3.h>
+
+#ifndef X509_V_FLAG_PARTIAL_CHAIN
+#define X509_V_FLAG_PARTIAL_CHAIN 0
+#endif
+
+// verifies the response's signature, which must come from issuer or a
+// responder it delegated to
+int OCSP_basic_verify_issuer(OCSP_BASICRESP *bs, X509 *issuer) {
+    X509_STORE *store = X509_STORE_new();
+    STACK_OF(X509) *certs = sk_X509_new_null();
+    int rv = -1;
+    if (store != NULL && certs != NULL &&
+            X509_STORE_add_cert(store, issuer) == 1 &&
+            sk_X509_push(certs, issuer) > 0) {
+        X509_STORE_set_flags(store, X509_V_FLAG_PARTIAL_CHAIN);
+        rv = OCSP_basic_verify(bs, certs, store, 0);
+    }
+    sk_X509_free(certs);
+    X509_STORE_free(store);
+    return rv;
+}
+
+// verifies the response's signature and the signer's chain against store,
+// with pool as untrusted candidates for building it
+static int OUR_OCSP_basic_verify(OCSP_BASICRESP *bs, X509_STORE *store,
+        X509 **pool, int n) {
+    STACK_OF(X509) *certs = sk_X509_new_null();
+    int rv = -1;
+    int i;
+    if (certs == NULL)
+        return -1;
+    for (i = 0; i < n; i++) {
+        if (sk_X509_push(certs, pool[i]) <= 0)
+            goto done;
+    }
+    rv = OCSP_basic_verify(bs, certs, store, 0);
+done:
+    sk_X509_free(certs);
+    return rv;
+}
+
+// the i2d_*_bio functions are macros before OpenSSL 3.0
+static OCSP_REQUEST *OUR_d2i_OCSP_REQUEST(const unsigned char *der,
+        long len) {
+    return d2i_OCSP_REQUEST(NULL, &der, len);
+}
+
+static int OUR_i2d_OCSP_REQUEST_bio(BIO *bio, OCSP_REQUEST *req) {
+    return i2d_OCSP_REQUEST_bio(bio, req);
+}
+
+static OCSP_RESPONSE *OUR_d2i_OCSP_RESPONSE(const unsigned char *der,
+        long len) {
+    return d2i_OCSP_RESPONSE(NULL, &der, len);
+}
+
+static int OUR_i2d_OCSP_RESPONSE_bio(BIO *bio, OCSP_RESPONSE *resp) {
+    return i2d_OCSP_RESPONSE_bio(bio, resp);
+}
+
+static OCSP_CERTID *OUR_OCSP_request_get0_id(OCSP_REQUEST *req, int i) {
+    return OCSP_onereq_get0_id(OCSP_request_onereq_get0(req, i));
+}
+
+static void OUR_OCSP_id_get0_info(OCSP_CERTID *id, ASN1_OBJECT **md_oid,
+        ASN1_INTEGER **serial) {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+    OCSP_id_get0_info(NULL, md_oid, NULL, serial, id);
+#else
+    *md_oid = id->hashAlgorithm->algorithm;
+    *serial = id->serialNumber;
+#endif
+}
+
+// returns 1 if id is for a certificate issued by issuer, hashing its name
+// and key as id does, 0 if not or -1 on error
+static int OUR_OCSP_id_issued_by(OCSP_CERTID *id, X509 *issuer) {
+    ASN1_OBJECT *md_oid;
+    ASN1_INTEGER *serial;
+    const EVP_MD *md;
+    OCSP_CERTID *issuer_id;
+    int rv;
+    OUR_OCSP_id_get0_info(id, &md_oid, &serial);
+    md = EVP_get_digestbyobj(md_oid);
+    // no certificate can match a hash OpenSSL doesn't know
+    if (md == NULL)
+        return 0;
+    issuer_id = OCSP_cert_id_new(md, X509_get_subject_name(issuer),
+        X509_get0_pubkey_bitstr(issuer), serial);
+    if (issuer_id == NULL)
+        return -1;
+    rv = OCSP_id_issuer_cmp(issuer_id, id) == 0;
+    OCSP_CERTID_free(issuer_id);
+    return rv;
+}
+
+static int OUR_OCSP_basic_sign(OCSP_BASICRESP *bs, X509 *signer,
+        EVP_PKEY *key, const EVP_MD *md, X509 **pool, int n) {
+    STACK_OF(X509) *certs = sk_X509_new_null();
+    int rv = 0;
+    int i;
+    if (certs == NULL)
+        return 0;
+    for (i = 0; i < n; i++) {
+        if (sk_X509_push(certs, pool[i]) <= 0)
+            goto done;
+    }
+    rv = OCSP_basic_sign(bs, signer, key, md, certs, 0);
+done:
+    sk_X509_free(certs);
+    return rv;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"runtime"
+	"time"
+	"unsafe"
+)
+
+// OCSPResponseStatus is the outcome of an OCSP request as a whole. Only
+// successful responses report the status of certificates.
+type OCSPResponseStatus int
+
+const (
+	OCSPSuccessful       OCSPResponseStatus = C.OCSP_RESPONSE_STATUS_SUCCESSFUL
+	OCSPMalformedRequest OCSPResponseStatus = C.OCSP_RESPONSE_STATUS_MALFORMEDREQUEST
+	OCSPInternalError    OCSPResponseStatus = C.OCSP_RESPONSE_STATUS_INTERNALERROR
+	OCSPTryLater         OCSPResponseStatus = C.OCSP_RESPONSE_STATUS_TRYLATER
+	OCSPSigRequired      OCSPResponseStatus = C.OCSP_RESPONSE_STATUS_SIGREQUIRED
+	OCSPUnauthorized     OCSPResponseStatus = C.OCSP_RESPONSE_STATUS_UNAUTHORIZED
+)
+
+func (s OCSPResponseStatus) String() string {
+	return C.GoString(C.OCSP_response_status_str(C.long(s)))
+}
+
+// OCSPCertStatus is what a responder reports about a certificate.
+type OCSPCertStatus int
+
+const (
+	OCSPStatusGood    OCSPCertStatus = C.V_OCSP_CERTSTATUS_GOOD
+	OCSPStatusRevoked OCSPCertStatus = C.V_OCSP_CERTSTATUS_REVOKED
+	OCSPStatusUnknown OCSPCertStatus = C.V_OCSP_CERTSTATUS_UNKNOWN
+)
+
+func (s OCSPCertStatus) String() string {
+	return C.GoString(C.OCSP_cert_status_str(C.long(s)))
+}
+
+// OCSPSingleResponse is a responder's report on one certificate.
+type OCSPSingleResponse struct {
+	Status OCSPCertStatus
+	// RevocationTime and Reason are only set for revoked certificates.
+	// Reason is ReasonUnspecified if the responder gives none.
+	RevocationTime time.Time
+	Reason         RevocationReason
+	// ThisUpdate is when the status was known to be correct, defaulting to
+	// now when building a response. NextUpdate, when newer information
+	// will be available, is the zero time if the responder doesn't say.
+	ThisUpdate time.Time
+	NextUpdate time.Time
+}
+
+// CheckValidity checks that the report is current at now, allowing for skew
+// between the responder's clock and ours.
+func (s *OCSPSingleResponse) CheckValidity(now time.Time,
+	skew time.Duration) error {
+	if s.ThisUpdate.After(now.Add(skew)) {
+		return errors.New("OCSP response is not yet valid")
+	}
+	if !s.NextUpdate.IsZero() && s.NextUpdate.Before(now.Add(-skew)) {
+		return errors.New("OCSP response has expired")
+	}
+	return nil
+}
+
+// OCSPCertID identifies a certificate to a responder, by its serial number
+// and hashes of its issuer's name and key.
+type OCSPCertID struct {
+	id *C.OCSP_CERTID
+}
+
+func newOCSPCertIDObject(id *C.OCSP_CERTID) *OCSPCertID {
+	i := &OCSPCertID{id: id}
+	runtime.SetFinalizer(i, func(i *OCSPCertID) {
+		C.OCSP_CERTID_free(i.id)
+	})
+	return i
+}
+
+// NewOCSPCertID returns the ID of leaf, issued by issuer, hashing the
+// issuer's name and key with SHA-1 as responders expect.
+func NewOCSPCertID(leaf, issuer *Certificate) (*OCSPCertID, error) {
+	id, err := newOCSPCertID(leaf, issuer)
+	if err != nil {
+		return nil, err
+	}
+	return newOCSPCertIDObject(id), nil
+}
+
+// SerialNumber returns the serial number of the certificate identified.
+func (i *OCSPCertID) SerialNumber() (*big.Int, error) {
+	defer runtime.KeepAlive(i)
+	var md_oid *C.ASN1_OBJECT
+	var serial *C.ASN1_INTEGER
+	C.OUR_OCSP_id_get0_info(i.id, &md_oid, &serial)
+	return asn1IntegerToBig(serial)
+}
+
+// IssuedBy reports whether the certificate identified was issued by issuer,
+// as a responder must check before reporting on it.
+func (i *OCSPCertID) IssuedBy(issuer *Certificate) (bool, error) {
+	defer runtime.KeepAlive(i)
+	issuer_x := issuer.acquireX509()
+	if issuer_x == nil {
+		return false, certificateFreed
+	}
+	defer C.X509_free(issuer_x)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	switch C.OUR_OCSP_id_issued_by(i.id, issuer_x) {
+	case 1:
+		return true, nil
+	case 0:
+		return false, nil
+	default:
+		return false, errorFromErrorQueue()
+	}
+}
+
+// OCSPRequest asks a responder about one or more certificates.
+type OCSPRequest struct {
+	req *C.OCSP_REQUEST
+}
+
+func newOCSPRequest(req *C.OCSP_REQUEST) *OCSPRequest {
+	r := &OCSPRequest{req: req}
+	runtime.SetFinalizer(r, func(r *OCSPRequest) {
+		C.OCSP_REQUEST_free(r.req)
+	})
+	return r
+}
+
+// NewOCSPRequest returns an empty request. Add the certificates to ask
+// about with AddCertificate.
+func NewOCSPRequest() (*OCSPRequest, error) {
+	req := C.OCSP_REQUEST_new()
+	if req == nil {
+		return nil, errors.New("failed to allocate OCSP request")
+	}
+	return newOCSPRequest(req), nil
+}
+
+// LoadOCSPRequestFromDER loads a DER-encoded request, as a responder
+// receives it.
+func LoadOCSPRequestFromDER(der_block []byte) (*OCSPRequest, error) {
+	if len(der_block) == 0 {
+		return nil, errors.New("empty der block")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	req := C.OUR_d2i_OCSP_REQUEST(
+		(*C.uchar)(unsafe.Pointer(&der_block[0])), C.long(len(der_block)))
+	if req == nil {
+		return nil, errorFromErrorQueue()
+	}
+	return newOCSPRequest(req), nil
+}
+
+// MarshalDER converts the request to DER-encoded format, to be sent with a
+// Content-Type of application/ocsp-request.
+func (r *OCSPRequest) MarshalDER() (der_block []byte, err error) {
+	defer runtime.KeepAlive(r)
+	bio := C.BIO_new(C.BIO_s_mem())
+	if bio == nil {
+		return nil, errors.New("failed to allocate memory BIO")
+	}
+	defer C.BIO_free(bio)
+	if C.OUR_i2d_OCSP_REQUEST_bio(bio, r.req) != 1 {
+		return nil, errors.New("failed dumping OCSP request der")
+	}
+	return ioutil.ReadAll(asAnyBio(bio))
+}
+
+// AddCertificate adds leaf, issued by issuer, to the certificates the
+// request asks about, returning its ID for finding its status in the
+// response.
+func (r *OCSPRequest) AddCertificate(leaf,
+	issuer *Certificate) (*OCSPCertID, error) {
+	defer runtime.KeepAlive(r)
+	id, err := NewOCSPCertID(leaf, issuer)
+	if err != nil {
+		return nil, err
+	}
+	dup := C.OCSP_CERTID_dup(id.id)
+	if dup == nil {
+		return nil, errors.New("failed to copy OCSP certificate ID")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.OCSP_request_add0_id(r.req, dup) == nil {
+		C.OCSP_CERTID_free(dup)
+		return nil, errorFromErrorQueue()
+	}
+	return id, nil
+}
+
+// AddNonce adds a random nonce, which the responder should echo back so
+// that a replayed response can be told apart. Check it with
+// OCSPResponse.CheckNonce.
+func (r *OCSPRequest) AddNonce() error {
+	defer runtime.KeepAlive(r)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.OCSP_request_add1_nonce(r.req, nil, -1) != 1 {
+		return errorFromErrorQueue()
+	}
+	return nil
+}
+
+// CertificateIDs returns the IDs of the certificates the request asks
+// about, in order.
+func (r *OCSPRequest) CertificateIDs() ([]*OCSPCertID, error) {
+	defer runtime.KeepAlive(r)
+	n := int(C.OCSP_request_onereq_count(r.req))
+	ids := make([]*OCSPCertID, 0, n)
+	for i := 0; i < n; i++ {
+		id := C.OCSP_CERTID_dup(C.OUR_OCSP_request_get0_id(r.req, C.int(i)))
+		if id == nil {
+			return nil, errors.New("failed to copy OCSP certificate ID")
+		}
+		ids = append(ids, newOCSPCertIDObject(id))
+	}
+	return ids, nil
+}
+
+// OCSPResponse is a responder's answer to an OCSPRequest.
+type OCSPResponse struct {
+	resp *C.OCSP_RESPONSE
+	// nil unless the response is successful
+	basic *C.OCSP_BASICRESP
+}
+
+func newOCSPResponse(resp *C.OCSP_RESPONSE) (*OCSPResponse, error) {
+	r := &OCSPResponse{resp: resp}
+	runtime.SetFinalizer(r, func(r *OCSPResponse) {
+		if r.basic != nil {
+			C.OCSP_BASICRESP_free(r.basic)
+		}
+		C.OCSP_RESPONSE_free(r.resp)
+	})
+	if C.OCSP_response_status(resp) == C.OCSP_RESPONSE_STATUS_SUCCESSFUL {
+		r.basic = C.OCSP_response_get1_basic(resp)
+		if r.basic == nil {
+			return nil, errorFromErrorQueue()
+		}
+	}
+	return r, nil
+}
+
+// LoadOCSPResponseFromDER loads a DER-encoded response. Its signature isn't
+// checked until CheckSignature or Verify is called.
+func LoadOCSPResponseFromDER(der_block []byte) (*OCSPResponse, error) {
+	if len(der_block) == 0 {
+		return nil, errors.New("empty der block")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	resp := C.OUR_d2i_OCSP_RESPONSE(
+		(*C.uchar)(unsafe.Pointer(&der_block[0])), C.long(len(der_block)))
+	if resp == nil {
+		return nil, errorFromErrorQueue()
+	}
+	return newOCSPResponse(resp)
+}
+
+// NewOCSPErrorResponse returns an unsigned response reporting that the
+// request failed, for a responder to send instead of a signed one. status
+// must not be OCSPSuccessful.
+func NewOCSPErrorResponse(status OCSPResponseStatus) (*OCSPResponse, error) {
+	if status == OCSPSuccessful {
+		return nil, errors.New("successful OCSP responses must be signed")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	resp := C.OCSP_response_create(C.int(status), nil)
+	if resp == nil {
+		return nil, errorFromErrorQueue()
+	}
+	return newOCSPResponse(resp)
+}
+
+// MarshalDER converts the response to DER-encoded format, to be sent with a
+// Content-Type of application/ocsp-response.
+func (r *OCSPResponse) MarshalDER() (der_block []byte, err error) {
+	defer runtime.KeepAlive(r)
+	bio := C.BIO_new(C.BIO_s_mem())
+	if bio == nil {
+		return nil, errors.New("failed to allocate memory BIO")
+	}
+	defer C.BIO_free(bio)
+	if C.OUR_i2d_OCSP_RESPONSE_bio(bio, r.resp) != 1 {
+		return nil, errors.New("failed dumping OCSP response der")
+	}
+	return ioutil.ReadAll(asAnyBio(bio))
+}
+
+// ResponseStatus returns the outcome of the request as a whole.
+func (r *OCSPResponse) ResponseStatus() OCSPResponseStatus {
+	defer runtime.KeepAlive(r)
+	return OCSPResponseStatus(C.OCSP_response_status(r.resp))
+}
+
+func (r *OCSPResponse) basicResponse() (*C.OCSP_BASICRESP, error) {
+	if r.basic == nil {
+		return nil, fmt.Errorf("OCSP responder failed: %s",
+			r.ResponseStatus())
+	}
+	return r.basic, nil
+}
+
+// CheckSignature checks that the response is signed by issuer, or by a
+// responder holding a certificate from issuer that delegates OCSP signing
+// to it.
+func (r *OCSPResponse) CheckSignature(issuer *Certificate) error {
+	defer runtime.KeepAlive(r)
+	basic, err := r.basicResponse()
+	if err != nil {
+		return err
+	}
+	issuer_x := issuer.acquireX509()
+	if issuer_x == nil {
+		return certificateFreed
+	}
+	defer C.X509_free(issuer_x)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.OCSP_basic_verify_issuer(basic, issuer_x) != 1 {
+		return errorFromErrorQueue()
+	}
+	return nil
+}
+
+// Verify checks the response's signature and verifies the signer's chain
+// against store, with intermediates, as well as any certificates in the
+// response, as untrusted candidates for building it. The signer must be
+// the issuer of the certificates reported on or a responder it delegated
+// to.
+func (r *OCSPResponse) Verify(store *CertificateStore,
+	intermediates []*Certificate) error {
+	defer runtime.KeepAlive(r)
+	defer runtime.KeepAlive(store)
+	basic, err := r.basicResponse()
+	if err != nil {
+		return err
+	}
+	xs := make([]*C.X509, 0, len(intermediates))
+	defer func() {
+		for _, x := range xs {
+			C.X509_free(x)
+		}
+	}()
+	for _, cert := range intermediates {
+		x := cert.acquireX509()
+		if x == nil {
+			return certificateFreed
+		}
+		xs = append(xs, x)
+	}
+	var xs_ptr **C.X509
+	if len(xs) > 0 {
+		xs_ptr = &xs[0]
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.OUR_OCSP_basic_verify(basic, store.store, xs_ptr,
+		C.int(len(xs))) != 1 {
+		return errorFromErrorQueue()
+	}
+	return nil
+}
+
+// CheckNonce checks that the response echoes the nonce of req. It fails if
+// req has a nonce the response lacks, which some responders don't echo, so
+// only call it for responders known to support nonces.
+func (r *OCSPResponse) CheckNonce(req *OCSPRequest) error {
+	defer runtime.KeepAlive(r)
+	defer runtime.KeepAlive(req)
+	basic, err := r.basicResponse()
+	if err != nil {
+		return err
+	}
+	switch C.OCSP_check_nonce(req.req, basic) {
+	case 0:
+		return errors.New("OCSP response nonce doesn't match the request")
+	case -1:
+		return errors.New("OCSP response has no nonce")
+	default:
+		return nil
+	}
+}
+
+// CertificateStatus returns what the response reports about the
+// certificate identified by id. It doesn't check that the report is
+// current; use OCSPSingleResponse.CheckValidity for that.
+func (r *OCSPResponse) CertificateStatus(
+	id *OCSPCertID) (*OCSPSingleResponse, error) {
+	defer runtime.KeepAlive(r)
+	defer runtime.KeepAlive(id)
+	basic, err := r.basicResponse()
+	if err != nil {
+		return nil, err
+	}
+	var status, reason C.int
+	var revoked, this_update, next_update *C.ASN1_GENERALIZEDTIME
+	if C.OCSP_resp_find_status(basic, id.id, &status, &reason, &revoked,
+		&this_update, &next_update) != 1 {
+		return nil, errors.New(
+			"OCSP response doesn't cover the certificate")
+	}
+	single := &OCSPSingleResponse{Status: OCSPCertStatus(status)}
+	single.ThisUpdate, err = asn1TimeToTime(
+		(*C.ASN1_TIME)(unsafe.Pointer(this_update)))
+	if err != nil {
+		return nil, err
+	}
+	if next_update != nil {
+		single.NextUpdate, err = asn1TimeToTime(
+			(*C.ASN1_TIME)(unsafe.Pointer(next_update)))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if revoked != nil {
+		single.RevocationTime, err = asn1TimeToTime(
+			(*C.ASN1_TIME)(unsafe.Pointer(revoked)))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if reason >= 0 {
+		single.Reason = RevocationReason(reason)
+	}
+	return single, nil
+}
+
+// OCSPResponseBuilder builds the signed response of a responder.
+type OCSPResponseBuilder struct {
+	basic *C.OCSP_BASICRESP
+}
+
+// NewOCSPResponseBuilder returns a builder reporting on no certificates.
+// Add reports with AddStatus, then sign the response with Sign.
+func NewOCSPResponseBuilder() (*OCSPResponseBuilder, error) {
+	basic := C.OCSP_BASICRESP_new()
+	if basic == nil {
+		return nil, errors.New("failed to allocate OCSP response")
+	}
+	b := &OCSPResponseBuilder{basic: basic}
+	runtime.SetFinalizer(b, func(b *OCSPResponseBuilder) {
+		C.OCSP_BASICRESP_free(b.basic)
+	})
+	return b, nil
+}
+
+// AddStatus reports single as the status of the certificate identified by
+// id, typically one of the IDs of the request being answered. Revoked
+// certificates with ReasonUnspecified have no reason code.
+func (b *OCSPResponseBuilder) AddStatus(id *OCSPCertID,
+	single *OCSPSingleResponse) error {
+	defer runtime.KeepAlive(b)
+	defer runtime.KeepAlive(id)
+	this_update := single.ThisUpdate
+	if this_update.IsZero() {
+		this_update = time.Now()
+	}
+	if !single.NextUpdate.IsZero() && !single.NextUpdate.After(this_update) {
+		return errors.New("next update is not after this update")
+	}
+	this_asn1, err := newASN1Time(this_update)
+	if err != nil {
+		return err
+	}
+	defer C.ASN1_TIME_free(this_asn1)
+	var next_asn1, revoked_asn1 *C.ASN1_TIME
+	if !single.NextUpdate.IsZero() {
+		next_asn1, err = newASN1Time(single.NextUpdate)
+		if err != nil {
+			return err
+		}
+		defer C.ASN1_TIME_free(next_asn1)
+	}
+	reason := C.int(C.OCSP_REVOKED_STATUS_NOSTATUS)
+	switch single.Status {
+	case OCSPStatusGood, OCSPStatusUnknown:
+	case OCSPStatusRevoked:
+		if single.Reason < ReasonUnspecified ||
+			single.Reason > ReasonAACompromise || single.Reason == 7 {
+			return fmt.Errorf("invalid revocation reason %d", single.Reason)
+		}
+		if single.Reason != ReasonUnspecified {
+			reason = C.int(single.Reason)
+		}
+		revoked_asn1, err = newASN1Time(single.RevocationTime)
+		if err != nil {
+			return err
+		}
+		defer C.ASN1_TIME_free(revoked_asn1)
+	default:
+		return fmt.Errorf("invalid OCSP certificate status %d", single.Status)
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.OCSP_basic_add1_status(b.basic, id.id, C.int(single.Status), reason,
+		revoked_asn1, this_asn1, next_asn1) == nil {
+		return errorFromErrorQueue()
+	}
+	return nil
+}
+
+// CopyNonce echoes the nonce of req, the request being answered, if it has
+// one.
+func (b *OCSPResponseBuilder) CopyNonce(req *OCSPRequest) error {
+	defer runtime.KeepAlive(b)
+	defer runtime.KeepAlive(req)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.OCSP_copy_nonce(b.basic, req.req) <= 0 {
+		return errorFromErrorQueue()
+	}
+	return nil
+}
+
+// Sign signs the reports with key, the private key of signer, using the
+// given digest, e.g. SHA256_Method, and returns the successful response.
+// The signer must be the issuer of the certificates reported on, or hold
+// a certificate from it with the OCSP signing extended key usage, in which
+// case chain should hold the certificates leading up to it. The digest is
+// ignored for Ed25519 and Ed448 keys.
+func (b *OCSPResponseBuilder) Sign(signer *Certificate, key PrivateKey,
+	digest Method, chain []*Certificate) (*OCSPResponse, error) {
+	defer runtime.KeepAlive(b)
+	if isEdDSAKey(key) {
+		digest = nil
+	}
+	signer_x := signer.acquireX509()
+	if signer_x == nil {
+		return nil, certificateFreed
+	}
+	defer C.X509_free(signer_x)
+	pkey := key.acquirePKey()
+	if pkey == nil {
+		return nil, keyFreed
+	}
+	defer C.EVP_PKEY_free(pkey)
+	xs := make([]*C.X509, 0, len(chain))
+	defer func() {
+		for _, x := range xs {
+			C.X509_free(x)
+		}
+	}()
+	for _, cert := range chain {
+		x := cert.acquireX509()
+		if x == nil {
+			return nil, certificateFreed
+		}
+		xs = append(xs, x)
+	}
+	var xs_ptr **C.X509
+	if len(xs) > 0 {
+		xs_ptr = &xs[0]
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.OUR_OCSP_basic_sign(b.basic, signer_x, pkey, digest, xs_ptr,
+		C.int(len(xs))) != 1 {
+		return nil, errorFromErrorQueue()
+	}
+	resp := C.OCSP_response_create(C.OCSP_RESPONSE_STATUS_SUCCESSFUL,
+		b.basic)
+	if resp == nil {
+		return nil, errorFromErrorQueue()
+	}
+	return newOCSPResponse(resp)
+}
@@ -0,0 +1,550 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// testOCSPResponder answers OCSP requests with the openssl command line tool,
+// reporting statuses from an index file in the format of openssl ca.
+type testOCSPResponder struct {
+	t      *testing.T
+	dir    string
+	server *httptest.Server
+}
+
+func newTestOCSPResponder(t *testing.T, ca *Certificate,
+	ca_key PrivateKey) *testOCSPResponder {
+	if _, err := exec.LookPath("openssl"); err != nil {
+		t.Skip("openssl command line tool not available")
+	}
+	dir, err := ioutil.TempDir("", "openssl-ocsp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca_pem, err := ca.MarshalPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key_pem, err := ca_key.MarshalPKCS1PrivateKeyPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string][]byte{
+		"ca.pem": ca_pem, "ca.key": key_pem} {
+		err := ioutil.WriteFile(dir+"/"+name, data, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := &testOCSPResponder{t: t, dir: dir}
+	r.server = httptest.NewServer(http.HandlerFunc(r.serve))
+	return r
+}
+
+func (r *testOCSPResponder) URL() string { return r.server.URL }
+
+func (r *testOCSPResponder) Close() {
+	r.server.Close()
+	os.RemoveAll(r.dir)
+}
+
+// SetStatus records the status of serial, "V" for valid or "R" for revoked.
+func (r *testOCSPResponder) SetStatus(serial int, status string) {
+	expires := time.Now().Add(time.Hour).UTC().Format("060102150405Z")
+	var revoked string
+	if status == "R" {
+		revoked = time.Now().UTC().Format("060102150405Z")
+	}
+	line := fmt.Sprintf("%s\t%s\t%s\t%02X\tunknown\t/CN=localhost\n",
+		status, expires, revoked, serial)
+	err := ioutil.WriteFile(r.dir+"/index.txt", []byte(line), 0600)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+}
+
+func (r *testOCSPResponder) serve(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err == nil {
+		err = ioutil.WriteFile(r.dir+"/req.der", body, 0600)
+	}
+	if err == nil {
+		err = exec.Command("openssl", "ocsp", "-index", r.dir+"/index.txt",
+			"-CA", r.dir+"/ca.pem", "-rsigner", r.dir+"/ca.pem",
+			"-rkey", r.dir+"/ca.key", "-reqin", r.dir+"/req.der",
+			"-respout", r.dir+"/resp.der", "-ndays", "1").Run()
+	}
+	var resp []byte
+	if err == nil {
+		resp, err = ioutil.ReadFile(r.dir + "/resp.der")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Write(resp)
+}
+
+func TestOCSPStapler(t *testing.T) {
+	ca_key := generateTestRSAKey(t)
+	ca := issueTestCert(t, ca_key, testCert{CA: true})
+	responder := newTestOCSPResponder(t, ca, ca_key)
+	defer responder.Close()
+	responder.SetStatus(7, "V")
+
+	key := generateTestRSAKey(t)
+	leaf := issueTestCert(t, key, testCert{Serial: 7, Issuer: ca,
+		IssuerKey: ca_key, OCSPServer: responder.URL()})
+	if url, err := leaf.OCSPServer(); err != nil || url != responder.URL() {
+		t.Fatalf("unexpected OCSP server %q: %v", url, err)
+	}
+	ctx := newSharedCtx(t, key, leaf, ca)
+	stapler, err := NewOCSPStapler(ctx, leaf, ca, responder.server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stapler.Close()
+	staple := stapler.Staple()
+	if staple == nil {
+		t.Fatal("no staple fetched")
+	}
+
+	handshake := func() []byte {
+		server_conn, client_conn := NetPipe(t)
+		defer server_conn.Close()
+		defer client_conn.Close()
+		server, err := Server(server_conn, ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+		go server.Handshake()
+		client := tls.Client(client_conn, &tls.Config{
+			InsecureSkipVerify: true})
+		if err := client.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		return client.ConnectionState().OCSPResponse
+	}
+	if !bytes.Equal(handshake(), staple) {
+		t.Fatal("client didn't receive the staple")
+	}
+
+	// a revoked certificate's response isn't stapled, and the previous one
+	// stays in place
+	responder.SetStatus(7, "R")
+	if err := stapler.Refresh(); err == nil {
+		t.Fatal("expected an error for a revoked certificate")
+	}
+	if !bytes.Equal(stapler.Staple(), staple) {
+		t.Fatal("previous staple not kept")
+	}
+
+	stapler.Close()
+	if handshake() != nil {
+		t.Fatal("staple served after Close")
+	}
+
+	// stapling by hand
+	if err := ctx.SetStapledOCSP([]byte("junk")); err == nil {
+		t.Fatal("expected an error for a malformed response")
+	}
+	if err := ctx.SetStapledOCSP(staple); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(handshake(), staple) {
+		t.Fatal("client didn't receive the manual staple")
+	}
+}
+
+func TestRequestOCSPStaple(t *testing.T) {
+	ca_key := generateTestRSAKey(t)
+	ca := issueTestCert(t, ca_key, testCert{CA: true})
+	responder := newTestOCSPResponder(t, ca, ca_key)
+	defer responder.Close()
+	responder.SetStatus(7, "V")
+
+	must_key := generateTestRSAKey(t)
+	must_leaf := issueTestCert(t, must_key, testCert{Serial: 7, Issuer: ca,
+		IssuerKey: ca_key, OCSPServer: responder.URL(),
+		Modify: func(c *Certificate) {
+			err := c.AddTLSFeatureExtension(TLSFeatureStatusRequest)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}})
+	must_ctx := newSharedCtx(t, must_key, must_leaf, ca)
+	stapler, err := NewOCSPStapler(must_ctx, must_leaf, ca,
+		responder.server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stapler.Close()
+	staple := stapler.Staple()
+	if staple == nil {
+		t.Fatal("no staple fetched")
+	}
+	other_key := generateTestRSAKey(t)
+	other_leaf := issueTestCert(t, other_key, testCert{Serial: 8, Issuer: ca,
+		IssuerKey: ca_key, OCSPServer: responder.URL()})
+	other_ctx := newSharedCtx(t, other_key, other_leaf, ca)
+
+	client_ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client_ctx.RequestOCSPStaple(OCSPStapleVerify | OCSPMustStaple)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handshake := func(server_ctx *Ctx) ([]byte, error) {
+		server_conn, client_conn := NetPipe(t)
+		defer server_conn.Close()
+		defer client_conn.Close()
+		server, err := Server(server_conn, server_ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+		client, err := Client(client_conn, client_ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		go server.Handshake()
+		err = client.Handshake()
+		return client.OCSPResponse(), err
+	}
+
+	der, err := handshake(must_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(der, staple) {
+		t.Fatal("client didn't see the staple")
+	}
+	// no staple is fine for certificates that don't ask for one
+	if der, err = handshake(other_ctx); err != nil || der != nil {
+		t.Fatalf("unexpected staple %x: %v", der, err)
+	}
+	// but a staple for another certificate isn't
+	other_ctx.SetOCSPStaple(staple)
+	_, err = handshake(other_ctx)
+	if _, ok := err.(OCSPStapleError); !ok {
+		t.Fatalf("expected a staple error, got %v", err)
+	}
+	// nor is no staple for a certificate that must have one
+	stapler.Close()
+	_, err = handshake(must_ctx)
+	if _, ok := err.(OCSPStapleError); !ok {
+		t.Fatalf("expected a staple error, got %v", err)
+	}
+}
+
+func TestOCSPStaplerRefreshInterval(t *testing.T) {
+	now := time.Now()
+	s := &OCSPStapler{
+		staple:      []byte("staple"),
+		fetched:     now,
+		next_update: now.Add(24 * time.Hour)}
+	if wait := s.wait(nil, now); wait != 12*time.Hour {
+		t.Fatalf("unexpected wait %v", wait)
+	}
+	s.SetRefreshInterval(time.Hour)
+	if wait := s.wait(nil, now); wait != time.Hour {
+		t.Fatalf("unexpected wait %v", wait)
+	}
+	// failures are still retried sooner
+	if wait := s.wait(errors.New("failed"), now); wait != OCSPRetryInterval {
+		t.Fatalf("unexpected wait %v", wait)
+	}
+	s.SetRefreshInterval(0)
+	if wait := s.wait(nil, now); wait != 12*time.Hour {
+		t.Fatalf("unexpected wait %v", wait)
+	}
+}
+
+func TestOCSPStaplerRequiresResponder(t *testing.T) {
+	key, err := LoadPrivateKeyFromPEM(keyBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := issueTestCert(t, key, testCert{})
+	ctx := newSharedCtx(t, key, cert, cert)
+	if _, err := NewOCSPStapler(ctx, cert, cert, nil); err == nil {
+		t.Fatal("expected an error without an OCSP responder")
+	}
+}
+
+func TestOCSPChecker(t *testing.T) {
+	ca_key := generateTestRSAKey(t)
+	ca := issueTestCert(t, ca_key, testCert{CA: true})
+	responder := newTestOCSPResponder(t, ca, ca_key)
+	defer responder.Close()
+	responder.SetStatus(7, "V")
+
+	key := generateTestRSAKey(t)
+	leaf := issueTestCert(t, key, testCert{Serial: 7, Issuer: ca,
+		IssuerKey: ca_key, OCSPServer: responder.URL()})
+	server_ctx := newSharedCtx(t, key, leaf, ca)
+	unknown_key := generateTestRSAKey(t)
+	unknown_leaf := issueTestCert(t, unknown_key, testCert{Serial: 8,
+		Issuer: ca, IssuerKey: ca_key, OCSPServer: responder.URL()})
+	unknown_ctx := newSharedCtx(t, unknown_key, unknown_leaf, ca)
+
+	client_ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client_ctx.GetCertificateStore().AddCertificate(
+		ca); err != nil {
+		t.Fatal(err)
+	}
+	client_ctx.SetVerifyMode(VerifyPeer)
+	handshake := func(server_ctx *Ctx) VerifyResult {
+		server_conn, client_conn := NetPipe(t)
+		defer server_conn.Close()
+		defer client_conn.Close()
+		server, err := Server(server_conn, server_ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+		go server.Handshake()
+		client, err := Client(client_conn, client_ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		client.Handshake()
+		return client.VerifyResult()
+	}
+
+	http_client := responder.server.Client()
+	client_ctx.SetOCSPChecker(NewOCSPChecker(http_client, OCSPHardFail))
+	if rv := handshake(server_ctx); rv != Ok {
+		t.Fatalf("verification failed: %d", rv)
+	}
+	// the good response is cached until its next update
+	responder.SetStatus(7, "R")
+	if rv := handshake(server_ctx); rv != Ok {
+		t.Fatalf("expected the cached response to be used, got %d", rv)
+	}
+	client_ctx.SetOCSPChecker(NewOCSPChecker(http_client, OCSPHardFail))
+	if rv := handshake(server_ctx); rv != CertRevoked {
+		t.Fatalf("expected a revoked certificate, got %d", rv)
+	}
+
+	// the responder doesn't know the other certificate
+	if rv := handshake(unknown_ctx); rv != ApplicationVerification {
+		t.Fatalf("expected the unknown status to fail, got %d", rv)
+	}
+	client_ctx.SetOCSPChecker(NewOCSPChecker(http_client, OCSPSoftFail))
+	if rv := handshake(unknown_ctx); rv != Ok {
+		t.Fatalf("expected the unknown status to be accepted, got %d", rv)
+	}
+	if rv := handshake(server_ctx); rv != CertRevoked {
+		t.Fatalf("expected a revoked certificate, got %d", rv)
+	}
+
+	client_ctx.SetOCSPChecker(nil)
+	if rv := handshake(server_ctx); rv != Ok {
+		t.Fatalf("verification failed without a checker: %d", rv)
+	}
+}
+
+func TestOCSPRequestResponse(t *testing.T) {
+	ca_key := generateTestRSAKey(t)
+	ca := issueTestCert(t, ca_key, testCert{CA: true})
+	key := generateTestRSAKey(t)
+	good := issueTestCert(t, key, testCert{Serial: 2, Issuer: ca,
+		IssuerKey: ca_key})
+	revoked := issueTestCert(t, key, testCert{Serial: 3, Issuer: ca,
+		IssuerKey: ca_key})
+
+	// client side
+	req, err := NewOCSPRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	good_id, err := req.AddCertificate(good, ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked_id, err := req.AddCertificate(revoked, ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := req.AddNonce(); err != nil {
+		t.Fatal(err)
+	}
+	req_der, err := req.MarshalDER()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// responder side
+	received, err := LoadOCSPRequestFromDER(req_der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := received.CertificateIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 {
+		t.Fatalf("expected 2 certificate IDs, got %d", len(ids))
+	}
+	builder, err := NewOCSPResponseBuilder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	revocation_time := time.Now().Add(-time.Minute).Truncate(time.Second)
+	for _, id := range ids {
+		issued, err := id.IssuedBy(ca)
+		if err != nil || !issued {
+			t.Fatalf("expected the ID to match the CA, got %v, %v", issued,
+				err)
+		}
+		if issued, _ := id.IssuedBy(good); issued {
+			t.Fatal("expected the ID not to match another issuer")
+		}
+		serial, err := id.SerialNumber()
+		if err != nil {
+			t.Fatal(err)
+		}
+		single := &OCSPSingleResponse{Status: OCSPStatusGood,
+			NextUpdate: time.Now().Add(time.Hour)}
+		if serial.Int64() == 3 {
+			single.Status = OCSPStatusRevoked
+			single.RevocationTime = revocation_time
+			single.Reason = ReasonKeyCompromise
+		}
+		if err := builder.AddStatus(id, single); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := builder.CopyNonce(received); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := builder.Sign(ca, ca_key, SHA256_Method, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp_der, err := resp.MarshalDER()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// client side again
+	resp, err = LoadOCSPResponseFromDER(resp_der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ResponseStatus() != OCSPSuccessful {
+		t.Fatalf("unexpected response status %s", resp.ResponseStatus())
+	}
+	if err := resp.CheckSignature(ca); err != nil {
+		t.Fatal(err)
+	}
+	if err := resp.CheckSignature(good); err == nil {
+		t.Fatal("expected the signature check against another issuer to fail")
+	}
+	store, err := NewCertificateStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := resp.Verify(store, nil); err == nil {
+		t.Fatal("expected verification against an empty store to fail")
+	}
+	if err := store.AddCertificate(ca); err != nil {
+		t.Fatal(err)
+	}
+	if err := resp.Verify(store, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := resp.CheckNonce(req); err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewOCSPRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.AddNonce(); err != nil {
+		t.Fatal(err)
+	}
+	if err := resp.CheckNonce(other); err == nil {
+		t.Fatal("expected a nonce mismatch")
+	}
+
+	single, err := resp.CertificateStatus(good_id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if single.Status != OCSPStatusGood {
+		t.Fatalf("expected good, got %s", single.Status)
+	}
+	if err := single.CheckValidity(time.Now(), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := single.CheckValidity(time.Now().Add(2*time.Hour),
+		time.Minute); err == nil {
+		t.Fatal("expected the response to have expired")
+	}
+	single, err = resp.CertificateStatus(revoked_id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if single.Status != OCSPStatusRevoked ||
+		!single.RevocationTime.Equal(revocation_time) ||
+		single.Reason != ReasonKeyCompromise {
+		t.Fatalf("unexpected revoked status %+v", single)
+	}
+
+	// the stapling and checking code accepts the response too
+	if _, err := checkOCSPResponse(resp_der, good_id.id, ca); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkOCSPResponse(resp_der, revoked_id.id,
+		ca); err != OCSPRevoked {
+		t.Fatalf("expected OCSPRevoked, got %v", err)
+	}
+
+	resp, err = NewOCSPErrorResponse(OCSPTryLater)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ResponseStatus() != OCSPTryLater {
+		t.Fatalf("unexpected response status %s", resp.ResponseStatus())
+	}
+	if _, err := resp.CertificateStatus(good_id); err == nil {
+		t.Fatal("expected an unsuccessful response to report nothing")
+	}
+}
@@ -16,12 +16,50 @@
 
 package openssl
 
+// #include <stdlib.h>
 // #include <openssl/evp.h>
 // #include <openssl/ssl.h>
 // #include <openssl/conf.h>
+// #include <openssl/err.h>
+// #include <openssl/pem.h>
 //
 // void OPENSSL_free_not_a_macro(void *ref) { OPENSSL_free(ref); }
 //
+// extern EVP_MD_CTX *OUR_EVP_MD_CTX_new();
+// extern void OUR_EVP_MD_CTX_free(EVP_MD_CTX *ctx);
+//
+// int OUR_X509_up_ref(X509 *x) {
+// #if OPENSSL_VERSION_NUMBER >= 0x10100000L
+//     return X509_up_ref(x);
+// #else
+//     CRYPTO_add(&x->references, 1, CRYPTO_LOCK_X509);
+//     return 1;
+// #endif
+// }
+//
+// int OUR_EVP_PKEY_up_ref(EVP_PKEY *key) {
+// #if OPENSSL_VERSION_NUMBER >= 0x10100000L
+//     return EVP_PKEY_up_ref(key);
+// #else
+//     CRYPTO_add(&key->references, 1, CRYPTO_LOCK_EVP_PKEY);
+//     return 1;
+// #endif
+// }
+//
+// ASN1_TIME *X509_get_notBefore_not_a_macro(X509 *x) {
+//     return X509_get_notBefore(x);
+// }
+//
+// ASN1_TIME *X509_get_notAfter_not_a_macro(X509 *x) {
+//     return X509_get_notAfter(x);
+// }
+//
+// int ERR_peek_pem_no_start_line() {
+//     unsigned long err = ERR_peek_last_error();
+//     return ERR_GET_LIB(err) == ERR_LIB_PEM &&
+//         ERR_GET_REASON(err) == PEM_R_NO_START_LINE;
+// }
+//
 // int EVP_SignInit_not_a_macro(EVP_MD_CTX *ctx, const EVP_MD *type) {
 //     return EVP_SignInit(ctx, type);
 // }
@@ -42,22 +80,41 @@ package openssl
 import "C"
 
 import (
+	"crypto"
+	"crypto/rsa"
 	"errors"
+	"io"
 	"io/ioutil"
 	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
 type Method *C.EVP_MD
 
 var (
+	SHA1_Method   Method = C.EVP_sha1()
 	SHA256_Method Method = C.EVP_sha256()
+	SHA384_Method Method = C.EVP_sha384()
+	SHA512_Method Method = C.EVP_sha512()
 )
 
 type PublicKey interface {
 	// Verifies the data signature using PKCS1.15
 	VerifyPKCS1v15(method Method, data, sig []byte) error
 
+	// VerifyDigest checks sig over hashed, the digest of a message computed
+	// with method. RSA signatures are PKCS#1 v1.5 if opts is nil, and PSS
+	// otherwise; rsa.PSSSaltLengthAuto detects the salt length. opts is
+	// ignored for other keys.
+	VerifyDigest(method Method, hashed, sig []byte, opts *rsa.PSSOptions) error
+
+	// EncryptOAEP encrypts plaintext to an RSA key with OAEP padding, using
+	// method for both the label hash and MGF1. label may be nil.
+	EncryptOAEP(method Method, plaintext, label []byte) ([]byte, error)
+
 	// MarshalPKIXPublicKeyPEM converts the public key to PEM-encoded PKIX
 	// format
 	MarshalPKIXPublicKeyPEM() (pem_block []byte, err error)
@@ -66,15 +123,61 @@ type PublicKey interface {
 	// format
 	MarshalPKIXPublicKeyDER() (der_block []byte, err error)
 
-	evpPKey() *C.EVP_PKEY
+	// KeyType returns the key's algorithm.
+	KeyType() (KeyType, error)
+
+	// Bits returns the size of the key in bits, e.g. the modulus size of an
+	// RSA key or the group order size of an EC key.
+	Bits() (int, error)
+
+	// CurveName returns the short name of an EC key's curve, e.g.
+	// prime256v1, or "" for other keys and keys on explicitly specified
+	// curves.
+	CurveName() (string, error)
+
+	// PSSRestrictions returns the limits an RSA-PSS key places on its
+	// signatures, or nil if the key isn't a restricted RSA-PSS key.
+	PSSRestrictions() (*PSSRestrictions, error)
+
+	// Free releases this key's reference to the underlying EVP_PKEY without
+	// waiting for the garbage collector. Contexts and certificates using the
+	// same key hold their own references and are unaffected, as are calls
+	// already in progress on this key. Later calls fail, and calling Free
+	// again is harmless. Free may be called concurrently with any use.
+	Free()
+
+	// acquirePKey returns a new reference to the underlying EVP_PKEY, which
+	// the caller must free, or nil if the key has been freed.
+	acquirePKey() *C.EVP_PKEY
 }
 
 type PrivateKey interface {
 	PublicKey
 
+	// Public, Sign and Decrypt implement crypto.Signer and crypto.Decrypter,
+	// so that keys can be used with the standard library, e.g. for
+	// x509.CreateCertificate or crypto/tls. Public returns nil if the
+	// standard library can't represent the public key. See NewSigner for
+	// the signature schemes, and Decrypt for decryption.
+	Public() crypto.PublicKey
+	Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte,
+		error)
+	Decrypt(rand io.Reader, msg []byte, opts crypto.DecrypterOpts) ([]byte,
+		error)
+
 	// Signs the data using PKCS1.15
 	SignPKCS1v15(Method, []byte) ([]byte, error)
 
+	// SignDigest signs hashed, the digest of a message computed with
+	// method, with PKCS#1 v1.5 padding for RSA keys if opts is nil and PSS
+	// otherwise. ECDSA keys produce ASN.1 signatures and ignore opts.
+	SignDigest(method Method, hashed []byte, opts *rsa.PSSOptions) ([]byte,
+		error)
+
+	// DecryptOAEP decrypts ciphertext from EncryptOAEP with the same method
+	// and label. It fails the same way whatever is wrong with ciphertext.
+	DecryptOAEP(method Method, ciphertext, label []byte) ([]byte, error)
+
 	// MarshalPKCS1PrivateKeyPEM converts the private key to PEM-encoded PKCS1
 	// format
 	MarshalPKCS1PrivateKeyPEM() (pem_block []byte, err error)
@@ -82,53 +185,117 @@ type PrivateKey interface {
 	// MarshalPKCS1PrivateKeyDER converts the private key to DER-encoded PKCS1
 	// format
 	MarshalPKCS1PrivateKeyDER() (der_block []byte, err error)
+
+	// MarshalPKCS8PrivateKeyPEM converts the private key to PEM-encoded
+	// PKCS#8 format, which unlike PKCS1 holds keys of any type
+	MarshalPKCS8PrivateKeyPEM() (pem_block []byte, err error)
+
+	// MarshalPKCS8PrivateKeyDER converts the private key to DER-encoded
+	// PKCS#8 format
+	MarshalPKCS8PrivateKeyDER() (der_block []byte, err error)
+
+	// MarshalPKCS8PrivateKeyPEMWithPassword converts the private key to
+	// PEM-encoded encrypted PKCS#8 format, encrypting it with cipher under a
+	// key derived from password with PBKDF2
+	MarshalPKCS8PrivateKeyPEMWithPassword(cipher *Cipher, password string) (
+		pem_block []byte, err error)
 }
 
+var (
+	keyFreed         = errors.New("key has been freed")
+	certificateFreed = errors.New("certificate has been freed")
+)
+
 type pKey struct {
+	mtx sync.Mutex
 	key *C.EVP_PKEY
 }
 
-func (key *pKey) evpPKey() *C.EVP_PKEY { return key.key }
+// newPKey wraps key, taking over one reference to it.
+func newPKey(key *C.EVP_PKEY) *pKey {
+	p := &pKey{key: key}
+	atomic.AddInt64(&statKeys, 1)
+	trackObject(unsafe.Pointer(p), "key")
+	setFinalizer(unsafe.Pointer(p), p, (*pKey).Free)
+	return p
+}
+
+func (key *pKey) acquirePKey() *C.EVP_PKEY {
+	key.mtx.Lock()
+	defer key.mtx.Unlock()
+	if key.key == nil {
+		return nil
+	}
+	C.OUR_EVP_PKEY_up_ref(key.key)
+	return key.key
+}
+
+func (key *pKey) Free() {
+	key.mtx.Lock()
+	defer key.mtx.Unlock()
+	if key.key == nil {
+		return
+	}
+	runtime.SetFinalizer(key, nil)
+	untrackObject(unsafe.Pointer(key))
+	C.EVP_PKEY_free(key.key)
+	key.key = nil
+	atomic.AddInt64(&statKeys, -1)
+}
 
 func (key *pKey) SignPKCS1v15(method Method, data []byte) ([]byte, error) {
-	var ctx C.EVP_MD_CTX
-	C.EVP_MD_CTX_init(&ctx)
-	defer C.EVP_MD_CTX_cleanup(&ctx)
+	pkey := key.acquirePKey()
+	if pkey == nil {
+		return nil, keyFreed
+	}
+	defer C.EVP_PKEY_free(pkey)
+	ctx := C.OUR_EVP_MD_CTX_new()
+	if ctx == nil {
+		return nil, errors.New("signpkcs1v15: failed to allocate context")
+	}
+	defer C.OUR_EVP_MD_CTX_free(ctx)
 
-	if 1 != C.EVP_SignInit_not_a_macro(&ctx, method) {
+	if 1 != C.EVP_SignInit_not_a_macro(ctx, method) {
 		return nil, errors.New("signpkcs1v15: failed to init signature")
 	}
 	if len(data) > 0 {
 		if 1 != C.EVP_SignUpdate_not_a_macro(
-			&ctx, unsafe.Pointer(&data[0]), C.uint(len(data))) {
+			ctx, unsafe.Pointer(&data[0]), C.uint(len(data))) {
 			return nil, errors.New("signpkcs1v15: failed to update signature")
 		}
 	}
-	sig := make([]byte, C.EVP_PKEY_size(key.key))
+	sig := make([]byte, C.EVP_PKEY_size(pkey))
 	var sigblen C.uint
-	if 1 != C.EVP_SignFinal(&ctx,
-		((*C.uchar)(unsafe.Pointer(&sig[0]))), &sigblen, key.key) {
+	if 1 != C.EVP_SignFinal(ctx,
+		((*C.uchar)(unsafe.Pointer(&sig[0]))), &sigblen, pkey) {
 		return nil, errors.New("signpkcs1v15: failed to finalize signature")
 	}
 	return sig[:sigblen], nil
 }
 
 func (key *pKey) VerifyPKCS1v15(method Method, data, sig []byte) error {
-	var ctx C.EVP_MD_CTX
-	C.EVP_MD_CTX_init(&ctx)
-	defer C.EVP_MD_CTX_cleanup(&ctx)
+	pkey := key.acquirePKey()
+	if pkey == nil {
+		return keyFreed
+	}
+	defer C.EVP_PKEY_free(pkey)
+	ctx := C.OUR_EVP_MD_CTX_new()
+	if ctx == nil {
+		return errors.New("verifypkcs1v15: failed to allocate context")
+	}
+	defer C.OUR_EVP_MD_CTX_free(ctx)
 
-	if 1 != C.EVP_VerifyInit_not_a_macro(&ctx, method) {
+	if 1 != C.EVP_VerifyInit_not_a_macro(ctx, method) {
 		return errors.New("verifypkcs1v15: failed to init verify")
 	}
 	if len(data) > 0 {
 		if 1 != C.EVP_VerifyUpdate_not_a_macro(
-			&ctx, unsafe.Pointer(&data[0]), C.uint(len(data))) {
+			ctx, unsafe.Pointer(&data[0]), C.uint(len(data))) {
 			return errors.New("verifypkcs1v15: failed to update verify")
 		}
 	}
-	if 1 != C.EVP_VerifyFinal(&ctx,
-		((*C.uchar)(unsafe.Pointer(&sig[0]))), C.uint(len(sig)), key.key) {
+	if 1 != C.EVP_VerifyFinal(ctx,
+		((*C.uchar)(unsafe.Pointer(&sig[0]))), C.uint(len(sig)), pkey) {
 		return errors.New("verifypkcs1v15: failed to finalize verify")
 	}
 	return nil
@@ -141,7 +308,12 @@ func (key *pKey) MarshalPKCS1PrivateKeyPEM() (pem_block []byte,
 		return nil, errors.New("failed to allocate memory BIO")
 	}
 	defer C.BIO_free(bio)
-	rsa := (*C.RSA)(C.EVP_PKEY_get1_RSA(key.key))
+	pkey := key.acquirePKey()
+	if pkey == nil {
+		return nil, keyFreed
+	}
+	defer C.EVP_PKEY_free(pkey)
+	rsa := (*C.RSA)(C.EVP_PKEY_get1_RSA(pkey))
 	if rsa == nil {
 		return nil, errors.New("failed getting rsa key")
 	}
@@ -160,7 +332,12 @@ func (key *pKey) MarshalPKCS1PrivateKeyDER() (der_block []byte,
 		return nil, errors.New("failed to allocate memory BIO")
 	}
 	defer C.BIO_free(bio)
-	rsa := (*C.RSA)(C.EVP_PKEY_get1_RSA(key.key))
+	pkey := key.acquirePKey()
+	if pkey == nil {
+		return nil, keyFreed
+	}
+	defer C.EVP_PKEY_free(pkey)
+	rsa := (*C.RSA)(C.EVP_PKEY_get1_RSA(pkey))
 	if rsa == nil {
 		return nil, errors.New("failed getting rsa key")
 	}
@@ -171,6 +348,44 @@ func (key *pKey) MarshalPKCS1PrivateKeyDER() (der_block []byte,
 	return ioutil.ReadAll(asAnyBio(bio))
 }
 
+func (key *pKey) MarshalPKCS8PrivateKeyPEM() (pem_block []byte,
+	err error) {
+	bio := C.BIO_new(C.BIO_s_mem())
+	if bio == nil {
+		return nil, errors.New("failed to allocate memory BIO")
+	}
+	defer C.BIO_free(bio)
+	pkey := key.acquirePKey()
+	if pkey == nil {
+		return nil, keyFreed
+	}
+	defer C.EVP_PKEY_free(pkey)
+	if int(C.PEM_write_bio_PKCS8PrivateKey(bio, pkey, nil, nil, 0, nil,
+		nil)) != 1 {
+		return nil, errors.New("failed dumping pkcs8 private key pem")
+	}
+	return ioutil.ReadAll(asAnyBio(bio))
+}
+
+func (key *pKey) MarshalPKCS8PrivateKeyDER() (der_block []byte,
+	err error) {
+	bio := C.BIO_new(C.BIO_s_mem())
+	if bio == nil {
+		return nil, errors.New("failed to allocate memory BIO")
+	}
+	defer C.BIO_free(bio)
+	pkey := key.acquirePKey()
+	if pkey == nil {
+		return nil, keyFreed
+	}
+	defer C.EVP_PKEY_free(pkey)
+	if int(C.i2d_PKCS8PrivateKey_bio(bio, pkey, nil, nil, 0, nil,
+		nil)) != 1 {
+		return nil, errors.New("failed dumping pkcs8 private key der")
+	}
+	return ioutil.ReadAll(asAnyBio(bio))
+}
+
 func (key *pKey) MarshalPKIXPublicKeyPEM() (pem_block []byte,
 	err error) {
 	bio := C.BIO_new(C.BIO_s_mem())
@@ -178,12 +393,12 @@ func (key *pKey) MarshalPKIXPublicKeyPEM() (pem_block []byte,
 		return nil, errors.New("failed to allocate memory BIO")
 	}
 	defer C.BIO_free(bio)
-	rsa := (*C.RSA)(C.EVP_PKEY_get1_RSA(key.key))
-	if rsa == nil {
-		return nil, errors.New("failed getting rsa key")
+	pkey := key.acquirePKey()
+	if pkey == nil {
+		return nil, keyFreed
 	}
-	defer C.RSA_free(rsa)
-	if int(C.PEM_write_bio_RSA_PUBKEY(bio, rsa)) != 1 {
+	defer C.EVP_PKEY_free(pkey)
+	if int(C.PEM_write_bio_PUBKEY(bio, pkey)) != 1 {
 		return nil, errors.New("failed dumping public key pem")
 	}
 	return ioutil.ReadAll(asAnyBio(bio))
@@ -196,53 +411,78 @@ func (key *pKey) MarshalPKIXPublicKeyDER() (der_block []byte,
 		return nil, errors.New("failed to allocate memory BIO")
 	}
 	defer C.BIO_free(bio)
-	rsa := (*C.RSA)(C.EVP_PKEY_get1_RSA(key.key))
-	if rsa == nil {
-		return nil, errors.New("failed getting rsa key")
+	pkey := key.acquirePKey()
+	if pkey == nil {
+		return nil, keyFreed
 	}
-	defer C.RSA_free(rsa)
-	if int(C.i2d_RSA_PUBKEY_bio(bio, rsa)) != 1 {
+	defer C.EVP_PKEY_free(pkey)
+	if int(C.i2d_PUBKEY_bio(bio, pkey)) != 1 {
 		return nil, errors.New("failed dumping public key der")
 	}
 	return ioutil.ReadAll(asAnyBio(bio))
 }
 
-// LoadPrivateKeyFromPEM loads a private key from a PEM-encoded block.
+// LoadPrivateKeyFromPEM loads a private key of any type from a PEM-encoded
+// block, in PKCS#8 or the traditional per-algorithm format. Encrypted keys
+// need LoadPrivateKeyFromPEMWithPassword or
+// LoadPrivateKeyFromPEMWithCallback.
 func LoadPrivateKeyFromPEM(pem_block []byte) (PrivateKey, error) {
+	// rather than OpenSSL prompting for a password on the terminal
+	return LoadPrivateKeyFromPEMWithCallback(pem_block,
+		func() (string, error) {
+			return "", errors.New("private key is encrypted")
+		})
+}
+
+// LoadPrivateKeyFromPEMWithPassword loads a private key of any type from a
+// PEM-encoded block, decrypting it with password if it is encrypted.
+func LoadPrivateKeyFromPEMWithPassword(pem_block []byte, password string) (
+	PrivateKey, error) {
 	if len(pem_block) == 0 {
 		return nil, errors.New("empty pem block")
 	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
 	bio := C.BIO_new_mem_buf(unsafe.Pointer(&pem_block[0]),
 		C.int(len(pem_block)))
 	if bio == nil {
 		return nil, errors.New("failed creating bio")
 	}
 	defer C.BIO_free(bio)
+	// always pass a password, so that OpenSSL never prompts for one
+	cpassword := C.CString(password)
+	defer C.free(unsafe.Pointer(cpassword))
+	key := C.PEM_read_bio_PrivateKey(bio, nil, nil, unsafe.Pointer(cpassword))
+	if key == nil {
+		return nil, errorFromErrorQueue()
+	}
+	return newPKey(key), nil
+}
 
-	rsakey := C.PEM_read_bio_RSAPrivateKey(bio, nil, nil, nil)
-	if rsakey == nil {
-		return nil, errors.New("failed reading rsa key")
+// LoadPrivateKeyFromDER loads a private key from a DER-encoded block. Both
+// PKCS#8 PrivateKeyInfo and the traditional per-algorithm formats are
+// accepted.
+func LoadPrivateKeyFromDER(der_block []byte) (PrivateKey, error) {
+	if len(der_block) == 0 {
+		return nil, errors.New("empty der block")
 	}
-	defer C.RSA_free(rsakey)
+	bio := C.BIO_new_mem_buf(unsafe.Pointer(&der_block[0]),
+		C.int(len(der_block)))
+	if bio == nil {
+		return nil, errors.New("failed creating bio")
+	}
+	defer C.BIO_free(bio)
 
-	// convert to PKEY
-	key := C.EVP_PKEY_new()
+	key := C.d2i_PrivateKey_bio(bio, nil)
 	if key == nil {
-		return nil, errors.New("failed converting to evp_pkey")
-	}
-	if C.EVP_PKEY_set1_RSA(key, (*C.struct_rsa_st)(rsakey)) != 1 {
-		C.EVP_PKEY_free(key)
-		return nil, errors.New("failed converting to evp_pkey")
+		return nil, errors.New("failed reading private key der")
 	}
 
-	p := &pKey{key: key}
-	runtime.SetFinalizer(p, func(p *pKey) {
-		C.EVP_PKEY_free(p.key)
-	})
-	return p, nil
+	return newPKey(key), nil
 }
 
-// LoadPublicKeyFromPEM loads a public key from a PEM-encoded block.
+// LoadPublicKeyFromPEM loads a public key of any type from a PEM-encoded
+// PKIX block.
 func LoadPublicKeyFromPEM(pem_block []byte) (PublicKey, error) {
 	if len(pem_block) == 0 {
 		return nil, errors.New("empty pem block")
@@ -254,30 +494,16 @@ func LoadPublicKeyFromPEM(pem_block []byte) (PublicKey, error) {
 	}
 	defer C.BIO_free(bio)
 
-	rsakey := C.PEM_read_bio_RSA_PUBKEY(bio, nil, nil, nil)
-	if rsakey == nil {
-		return nil, errors.New("failed reading rsa key")
-	}
-	defer C.RSA_free(rsakey)
-
-	// convert to PKEY
-	key := C.EVP_PKEY_new()
+	key := C.PEM_read_bio_PUBKEY(bio, nil, nil, nil)
 	if key == nil {
-		return nil, errors.New("failed converting to evp_pkey")
-	}
-	if C.EVP_PKEY_set1_RSA(key, (*C.struct_rsa_st)(rsakey)) != 1 {
-		C.EVP_PKEY_free(key)
-		return nil, errors.New("failed converting to evp_pkey")
+		return nil, errors.New("failed reading public key")
 	}
 
-	p := &pKey{key: key}
-	runtime.SetFinalizer(p, func(p *pKey) {
-		C.EVP_PKEY_free(p.key)
-	})
-	return p, nil
+	return newPKey(key), nil
 }
 
-// LoadPublicKeyFromDER loads a public key from a DER-encoded block.
+// LoadPublicKeyFromDER loads a public key of any type from a DER-encoded
+// PKIX block.
 func LoadPublicKeyFromDER(der_block []byte) (PublicKey, error) {
 	if len(der_block) == 0 {
 		return nil, errors.New("empty der block")
@@ -289,32 +515,64 @@ func LoadPublicKeyFromDER(der_block []byte) (PublicKey, error) {
 	}
 	defer C.BIO_free(bio)
 
-	rsakey := C.d2i_RSA_PUBKEY_bio(bio, nil)
-	if rsakey == nil {
-		return nil, errors.New("failed reading rsa key")
-	}
-	defer C.RSA_free(rsakey)
-
-	// convert to PKEY
-	key := C.EVP_PKEY_new()
+	key := C.d2i_PUBKEY_bio(bio, nil)
 	if key == nil {
-		return nil, errors.New("failed converting to evp_pkey")
-	}
-	if C.EVP_PKEY_set1_RSA(key, (*C.struct_rsa_st)(rsakey)) != 1 {
-		C.EVP_PKEY_free(key)
-		return nil, errors.New("failed converting to evp_pkey")
+		return nil, errors.New("failed reading public key")
 	}
 
-	p := &pKey{key: key}
-	runtime.SetFinalizer(p, func(p *pKey) {
-		C.EVP_PKEY_free(p.key)
-	})
-	return p, nil
+	return newPKey(key), nil
 }
 
 type Certificate struct {
+	mtx sync.Mutex
 	x   *C.X509
-	ref interface{}
+}
+
+// newCertificate wraps x, taking over one reference to it.
+func newCertificate(x *C.X509) *Certificate {
+	c := &Certificate{x: x}
+	atomic.AddInt64(&statCertificates, 1)
+	trackObject(unsafe.Pointer(c), "Certificate")
+	setFinalizer(unsafe.Pointer(c), c, (*Certificate).Free)
+	return c
+}
+
+// refCertificate wraps an X509 owned by someone else, such as an SSL object
+// or a stack, adding a reference so the Certificate stays valid on its own.
+func refCertificate(x *C.X509) *Certificate {
+	C.OUR_X509_up_ref(x)
+	return newCertificate(x)
+}
+
+// acquireX509 returns a new reference to the underlying X509, which the
+// caller must free, or nil if the Certificate has been freed.
+func (c *Certificate) acquireX509() *C.X509 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.x == nil {
+		return nil
+	}
+	C.OUR_X509_up_ref(c.x)
+	return c.x
+}
+
+// Free releases this Certificate's reference to the underlying X509 without
+// waiting for the garbage collector. Contexts, stores and other Certificates
+// sharing the X509 hold their own references and are unaffected, as are
+// calls already in progress on this Certificate. Later calls fail, and
+// calling Free again is harmless. Free may be called concurrently with any
+// use.
+func (c *Certificate) Free() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.x == nil {
+		return
+	}
+	runtime.SetFinalizer(c, nil)
+	untrackObject(unsafe.Pointer(c))
+	C.X509_free(c.x)
+	c.x = nil
+	atomic.AddInt64(&statCertificates, -1)
 }
 
 // LoadCertificateFromPEM loads an X509 certificate from a PEM-encoded block.
@@ -331,11 +589,57 @@ func LoadCertificateFromPEM(pem_block []byte) (*Certificate, error) {
 	if cert == nil {
 		return nil, errorFromErrorQueue()
 	}
-	x := &Certificate{x: cert}
-	runtime.SetFinalizer(x, func(x *Certificate) {
-		C.X509_free(x.x)
-	})
-	return x, nil
+	return newCertificate(cert), nil
+}
+
+// LoadCertificateFromDER loads an X509 certificate from a DER-encoded block.
+func LoadCertificateFromDER(der_block []byte) (*Certificate, error) {
+	if len(der_block) == 0 {
+		return nil, errors.New("empty der block")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	bio := C.BIO_new_mem_buf(unsafe.Pointer(&der_block[0]),
+		C.int(len(der_block)))
+	cert := C.d2i_X509_bio(bio, nil)
+	C.BIO_free(bio)
+	if cert == nil {
+		return nil, errorFromErrorQueue()
+	}
+	return newCertificate(cert), nil
+}
+
+// LoadCertificateChainFromPEM loads every X509 certificate in a PEM-encoded
+// block, in order.
+func LoadCertificateChainFromPEM(pem_block []byte) ([]*Certificate, error) {
+	if len(pem_block) == 0 {
+		return nil, errors.New("empty pem block")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	bio := C.BIO_new_mem_buf(unsafe.Pointer(&pem_block[0]),
+		C.int(len(pem_block)))
+	if bio == nil {
+		return nil, errors.New("failed creating bio")
+	}
+	defer C.BIO_free(bio)
+	var rv []*Certificate
+	for {
+		cert := C.PEM_read_bio_X509(bio, nil, nil, nil)
+		if cert == nil {
+			break
+		}
+		rv = append(rv, newCertificate(cert))
+	}
+	if len(rv) > 0 && C.ERR_peek_pem_no_start_line() == 1 {
+		// just the end of the input
+		C.ERR_clear_error()
+		return rv, nil
+	}
+	for _, cert := range rv {
+		cert.Free()
+	}
+	return nil, errorFromErrorQueue()
 }
 
 // MarshalPEM converts the X509 certificate to PEM-encoded format
@@ -345,28 +649,57 @@ func (c *Certificate) MarshalPEM() (pem_block []byte, err error) {
 		return nil, errors.New("failed to allocate memory BIO")
 	}
 	defer C.BIO_free(bio)
-	if int(C.PEM_write_bio_X509(bio, c.x)) != 1 {
+	x := c.acquireX509()
+	if x == nil {
+		return nil, certificateFreed
+	}
+	defer C.X509_free(x)
+	if int(C.PEM_write_bio_X509(bio, x)) != 1 {
 		return nil, errors.New("failed dumping certificate")
 	}
 	return ioutil.ReadAll(asAnyBio(bio))
 }
 
+// MarshalDER converts the X509 certificate to DER-encoded format
+func (c *Certificate) MarshalDER() (der_block []byte, err error) {
+	bio := C.BIO_new(C.BIO_s_mem())
+	if bio == nil {
+		return nil, errors.New("failed to allocate memory BIO")
+	}
+	defer C.BIO_free(bio)
+	x := c.acquireX509()
+	if x == nil {
+		return nil, certificateFreed
+	}
+	defer C.X509_free(x)
+	if int(C.i2d_X509_bio(bio, x)) != 1 {
+		return nil, errors.New("failed dumping certificate der")
+	}
+	return ioutil.ReadAll(asAnyBio(bio))
+}
+
 // PublicKey returns the public key embedded in the X509 certificate.
 func (c *Certificate) PublicKey() (PublicKey, error) {
-	pkey := C.X509_get_pubkey(c.x)
+	x := c.acquireX509()
+	if x == nil {
+		return nil, certificateFreed
+	}
+	defer C.X509_free(x)
+	pkey := C.X509_get_pubkey(x)
 	if pkey == nil {
 		return nil, errors.New("no public key found")
 	}
-	key := &pKey{key: pkey}
-	runtime.SetFinalizer(key, func(key *pKey) {
-		C.EVP_PKEY_free(key.key)
-	})
-	return key, nil
+	return newPKey(pkey), nil
 }
 
 // GetSerialNumberHex returns the certificate's serial number in hex format
 func (c *Certificate) GetSerialNumberHex() (serial string) {
-	asn1_i := C.X509_get_serialNumber(c.x)
+	x := c.acquireX509()
+	if x == nil {
+		return ""
+	}
+	defer C.X509_free(x)
+	asn1_i := C.X509_get_serialNumber(x)
 	bignum := C.ASN1_INTEGER_to_BN(asn1_i, nil)
 	hex := C.BN_bn2hex(bignum)
 	serial = C.GoString(hex)
@@ -374,3 +707,24 @@ func (c *Certificate) GetSerialNumberHex() (serial string) {
 	C.OPENSSL_free_not_a_macro(unsafe.Pointer(hex))
 	return
 }
+
+// NotBefore returns the start of the certificate's validity period.
+func (c *Certificate) NotBefore() (time.Time, error) {
+	x := c.acquireX509()
+	if x == nil {
+		return time.Time{}, certificateFreed
+	}
+	defer C.X509_free(x)
+	return asn1TimeToTime(C.X509_get_notBefore_not_a_macro(x))
+}
+
+// NotAfter returns the end of the certificate's validity period. Certificates
+// without a well-defined expiration report NoWellDefinedExpiration.
+func (c *Certificate) NotAfter() (time.Time, error) {
+	x := c.acquireX509()
+	if x == nil {
+		return time.Time{}, certificateFreed
+	}
+	defer C.X509_free(x)
+	return asn1TimeToTime(C.X509_get_notAfter_not_a_macro(x))
+}
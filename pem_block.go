@@ -0,0 +1,296 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <stdlib.h>
+#include <string.h>
+#include <openssl/err.h>
+#include <openssl/evp.h>
+#include <openssl/pem.h>
+#include <openssl/rand.h>
+
+static void OPENSSL_free_not_a_macro(void *p) {
+    OPENSSL_free(p);
+}
+
+// returns 1 after reading a block, 0 once there are none left or -1 on error
+static int PEM_read_bio_block(BIO *bio, char **name, char **header,
+        unsigned char **data, long *len) {
+    unsigned long err;
+    if (PEM_read_bio(bio, name, header, data, len) == 1)
+        return 1;
+    err = ERR_peek_last_error();
+    if (ERR_GET_LIB(err) == ERR_LIB_PEM &&
+            ERR_GET_REASON(err) == PEM_R_NO_START_LINE) {
+        ERR_clear_error();
+        return 0;
+    }
+    return -1;
+}
+
+static int PEM_decrypt_block(char *header, unsigned char *data, long *len,
+        char *password) {
+    EVP_CIPHER_INFO cipher;
+    if (!PEM_get_EVP_CIPHER_INFO(header, &cipher))
+        return 0;
+    return PEM_do_header(&cipher, data, len, NULL, password);
+}
+
+// encrypts in the way PEM_ASN1_write_bio does, with a random iv whose first
+// 8 bytes double as the key derivation salt
+static int PEM_encrypt_block(const EVP_CIPHER *enc, const char *password,
+        unsigned char *iv, const unsigned char *in, int inlen,
+        unsigned char *out, int *outlen) {
+    unsigned char key[EVP_MAX_KEY_LENGTH];
+    EVP_CIPHER_CTX *ctx = NULL;
+    int n, rv = 0;
+    if (RAND_bytes(iv, EVP_CIPHER_iv_length(enc)) != 1)
+        return 0;
+    if (!EVP_BytesToKey(enc, EVP_md5(), iv, (const unsigned char *)password,
+            strlen(password), 1, key, NULL))
+        goto done;
+    ctx = EVP_CIPHER_CTX_new();
+    if (ctx == NULL || !EVP_EncryptInit_ex(ctx, enc, NULL, key, iv) ||
+            !EVP_EncryptUpdate(ctx, out, &n, in, inlen))
+        goto done;
+    *outlen = n;
+    if (!EVP_EncryptFinal_ex(ctx, out + n, &n))
+        goto done;
+    *outlen += n;
+    rv = 1;
+done:
+    EVP_CIPHER_CTX_free(ctx);
+    OPENSSL_cleanse(key, sizeof(key));
+    return rv;
+}
+*/
+import "C"
+
+import (
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"runtime"
+	"strings"
+	"unsafe"
+)
+
+// PEMHeader is a header of a PEM block, such as the Proc-Type and DEK-Info
+// headers of an encrypted block.
+type PEMHeader struct {
+	Name  string
+	Value string
+}
+
+// PEMBlock is a PEM block of any type, read and written with OpenSSL's PEM
+// routines, so that blocks OpenSSL writes come back exactly as OpenSSL reads
+// them. Headers keep their order, which matters to encrypted blocks.
+type PEMBlock struct {
+	// Type is the label of the block, e.g. TRUSTED CERTIFICATE.
+	Type    string
+	Headers []PEMHeader
+	Bytes   []byte
+}
+
+// DecodePEMBlocks reads all of the PEM blocks in data, skipping any text
+// around them.
+func DecodePEMBlocks(data []byte) ([]*PEMBlock, error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty pem data")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	bio := C.BIO_new_mem_buf(unsafe.Pointer(&data[0]), C.int(len(data)))
+	if bio == nil {
+		return nil, errors.New("failed creating bio")
+	}
+	defer C.BIO_free(bio)
+	var blocks []*PEMBlock
+	for {
+		var name, header *C.char
+		var payload *C.uchar
+		var n C.long
+		switch C.PEM_read_bio_block(bio, &name, &header, &payload, &n) {
+		case 0:
+			if len(blocks) == 0 {
+				return nil, errors.New("no pem blocks found")
+			}
+			return blocks, nil
+		case -1:
+			return nil, errorFromErrorQueue()
+		}
+		block := &PEMBlock{
+			Type:    C.GoString(name),
+			Headers: parsePEMHeaders(C.GoString(header)),
+			Bytes:   C.GoBytes(unsafe.Pointer(payload), C.int(n))}
+		C.OPENSSL_free_not_a_macro(unsafe.Pointer(name))
+		C.OPENSSL_free_not_a_macro(unsafe.Pointer(header))
+		C.OPENSSL_free_not_a_macro(unsafe.Pointer(payload))
+		blocks = append(blocks, block)
+	}
+}
+
+// EncodePEMBlocks writes blocks in PEM form, one after another.
+func EncodePEMBlocks(blocks ...*PEMBlock) ([]byte, error) {
+	bio := C.BIO_new(C.BIO_s_mem())
+	if bio == nil {
+		return nil, errors.New("failed to allocate memory BIO")
+	}
+	defer C.BIO_free(bio)
+	for _, block := range blocks {
+		if block.Type == "" {
+			return nil, errors.New("pem block has no type")
+		}
+		var header string
+		for _, h := range block.Headers {
+			if strings.ContainsAny(h.Name, ":\n") ||
+				strings.Contains(h.Value, "\n") {
+				return nil, errors.New("invalid pem header")
+			}
+			header += h.Name + ": " + h.Value + "\n"
+		}
+		name := C.CString(block.Type)
+		c_header := C.CString(header)
+		var payload *C.uchar
+		if len(block.Bytes) > 0 {
+			payload = (*C.uchar)(unsafe.Pointer(&block.Bytes[0]))
+		}
+		rv := C.PEM_write_bio(bio, name, c_header, payload,
+			C.long(len(block.Bytes)))
+		C.free(unsafe.Pointer(name))
+		C.free(unsafe.Pointer(c_header))
+		if rv <= 0 {
+			return nil, errors.New("failed writing pem block")
+		}
+	}
+	return ioutil.ReadAll(asAnyBio(bio))
+}
+
+// IsEncrypted reports whether the block is encrypted, as marked by its
+// Proc-Type header.
+func (b *PEMBlock) IsEncrypted() bool {
+	for _, h := range b.Headers {
+		if h.Name == "Proc-Type" && strings.HasSuffix(h.Value, ",ENCRYPTED") {
+			return true
+		}
+	}
+	return false
+}
+
+// Decrypt returns the block decrypted with password, without the Proc-Type
+// and DEK-Info headers. This is the legacy encryption of the traditional key
+// formats, e.g. an RSA PRIVATE KEY with a DEK-Info header; an ENCRYPTED
+// PRIVATE KEY block is encrypted inside its PKCS#8 payload instead. A wrong
+// password usually, but not always, makes Decrypt fail rather than return
+// garbage.
+func (b *PEMBlock) Decrypt(password string) (*PEMBlock, error) {
+	if !b.IsEncrypted() {
+		return nil, errors.New("pem block is not encrypted")
+	}
+	var header string
+	for _, h := range b.Headers {
+		header += h.Name + ": " + h.Value + "\n"
+	}
+	c_header := C.CString(header)
+	defer C.free(unsafe.Pointer(c_header))
+	c_password := C.CString(password)
+	defer C.free(unsafe.Pointer(c_password))
+	data := C.CBytes(b.Bytes)
+	defer C.free(data)
+	n := C.long(len(b.Bytes))
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.PEM_decrypt_block(c_header, (*C.uchar)(data), &n,
+		c_password) != 1 {
+		return nil, errorFromErrorQueue()
+	}
+	return &PEMBlock{
+		Type:    b.Type,
+		Headers: withoutEncryptionHeaders(b.Headers),
+		Bytes:   C.GoBytes(data, C.int(n))}, nil
+}
+
+// EncryptPEMBlock returns block encrypted with cipher under password in the
+// legacy PEM scheme that Decrypt undoes, as OpenSSL does when writing
+// traditional keys, e.g. with GetCipherByName("aes-256-cbc"). The key is
+// derived from the password with a single round of MD5, so this protects
+// little against password guessing; prefer PKCS#8 encryption for keys.
+func EncryptPEMBlock(block *PEMBlock, cipher *Cipher, password string) (
+	*PEMBlock, error) {
+	if block.IsEncrypted() {
+		return nil, errors.New("pem block is already encrypted")
+	}
+	if cipher.IVSize() < 8 {
+		return nil, errors.New("cipher is unsuitable for pem encryption")
+	}
+	name, err := cipher.ShortName()
+	if err != nil {
+		return nil, err
+	}
+	c_password := C.CString(password)
+	defer C.free(unsafe.Pointer(c_password))
+	iv := make([]byte, cipher.IVSize())
+	out := make([]byte, len(block.Bytes)+cipher.BlockSize())
+	var in *C.uchar
+	if len(block.Bytes) > 0 {
+		in = (*C.uchar)(unsafe.Pointer(&block.Bytes[0]))
+	}
+	var n C.int
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.PEM_encrypt_block(cipher.ptr, c_password,
+		(*C.uchar)(unsafe.Pointer(&iv[0])), in, C.int(len(block.Bytes)),
+		(*C.uchar)(unsafe.Pointer(&out[0])), &n) != 1 {
+		return nil, errorFromErrorQueue()
+	}
+	// Proc-Type has to come first
+	headers := []PEMHeader{
+		{Name: "Proc-Type", Value: "4,ENCRYPTED"},
+		{Name: "DEK-Info", Value: strings.ToUpper(name) + "," +
+			strings.ToUpper(hex.EncodeToString(iv))}}
+	return &PEMBlock{
+		Type:    block.Type,
+		Headers: append(headers, withoutEncryptionHeaders(block.Headers)...),
+		Bytes:   out[:n]}, nil
+}
+
+func parsePEMHeaders(header string) []PEMHeader {
+	var headers []PEMHeader
+	for _, line := range strings.Split(header, "\n") {
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		h := PEMHeader{Name: strings.TrimSpace(parts[0])}
+		if len(parts) == 2 {
+			h.Value = strings.TrimSpace(parts[1])
+		}
+		headers = append(headers, h)
+	}
+	return headers
+}
+
+func withoutEncryptionHeaders(headers []PEMHeader) []PEMHeader {
+	var rv []PEMHeader
+	for _, h := range headers {
+		if h.Name != "Proc-Type" && h.Name != "DEK-Info" {
+			rv = append(rv, h)
+		}
+	}
+	return rv
+}
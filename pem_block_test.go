@@ -0,0 +1,89 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestPEMBlocksRoundTrip(t *testing.T) {
+	blocks := []*PEMBlock{{
+		Type:  "TRUSTED CERTIFICATE",
+		Bytes: []byte("not really a certificate"),
+	}, {
+		Type: "X-CUSTOM",
+		Headers: []PEMHeader{
+			{Name: "Zebra", Value: "first"},
+			{Name: "Apple", Value: "second"}},
+		Bytes: bytes.Repeat([]byte{0xa5}, 100),
+	}}
+	data, err := EncodePEMBlocks(blocks...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodePEMBlocks(append([]byte("leading text\n"),
+		data...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, blocks) {
+		t.Fatalf("blocks changed in the round trip:\n%s", data)
+	}
+	if _, err := DecodePEMBlocks([]byte("no blocks here\n")); err == nil {
+		t.Fatal("expected an error without pem blocks")
+	}
+}
+
+func TestPEMBlockEncryption(t *testing.T) {
+	key_pem, err := generateTestRSAKey(t).MarshalPKCS1PrivateKeyPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks, err := DecodePEMBlocks(key_pem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipher, err := GetCipherByName("aes-256-cbc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := EncryptPEMBlock(blocks[0], cipher, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !encrypted.IsEncrypted() || blocks[0].IsEncrypted() {
+		t.Fatal("expected only the encrypted block to be marked encrypted")
+	}
+	encrypted_pem, err := EncodePEMBlocks(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// OpenSSL must be able to read what we encrypted
+	if _, err := LoadPrivateKeyFromPEMWithPassword(encrypted_pem,
+		"secret"); err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := encrypted.Decrypt("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decrypted, blocks[0]) {
+		t.Fatal("block changed in the encryption round trip")
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// PEMBundle holds the objects of a PEM file that mixes several kinds, such
+// as a key with its certificate chain, each kind in the order of the file.
+type PEMBundle struct {
+	Certificates []*Certificate
+	PrivateKeys  []PrivateKey
+	PublicKeys   []PublicKey
+	Requests     []*X509Request
+	CRLs         []*CRL
+	DHParameters []*DHParameters
+}
+
+// LoadPEMBundle loads every block in a PEM file, skipping EC PARAMETERS. It
+// fails on blocks of types it doesn't know and on encrypted keys, which need
+// LoadPrivateKeyFromPEMWithPassword or LoadPrivateKeyFromPEMWithCallback.
+func LoadPEMBundle(pem_data []byte) (*PEMBundle, error) {
+	blocks, err := DecodePEMBlocks(pem_data)
+	if err != nil {
+		return nil, err
+	}
+	bundle := &PEMBundle{}
+	for _, block := range blocks {
+		if err := bundle.add(block); err != nil {
+			return nil, err
+		}
+	}
+	return bundle, nil
+}
+
+func (b *PEMBundle) add(block *PEMBlock) error {
+	switch block.Type {
+	case "CERTIFICATE", "X509 CERTIFICATE":
+		cert, err := LoadCertificateFromDER(block.Bytes)
+		if err != nil {
+			return err
+		}
+		b.Certificates = append(b.Certificates, cert)
+	case "PRIVATE KEY", "RSA PRIVATE KEY", "EC PRIVATE KEY",
+		"DSA PRIVATE KEY", "ENCRYPTED PRIVATE KEY":
+		if block.IsEncrypted() || block.Type == "ENCRYPTED PRIVATE KEY" {
+			return fmt.Errorf("%s block is encrypted", block.Type)
+		}
+		key, err := LoadPrivateKeyFromDER(block.Bytes)
+		if err != nil {
+			return err
+		}
+		b.PrivateKeys = append(b.PrivateKeys, key)
+	case "PUBLIC KEY":
+		key, err := LoadPublicKeyFromDER(block.Bytes)
+		if err != nil {
+			return err
+		}
+		b.PublicKeys = append(b.PublicKeys, key)
+	case "CERTIFICATE REQUEST", "NEW CERTIFICATE REQUEST":
+		req, err := LoadX509RequestFromDER(block.Bytes)
+		if err != nil {
+			return err
+		}
+		b.Requests = append(b.Requests, req)
+	case "X509 CRL":
+		crl, err := LoadCRLFromDER(block.Bytes)
+		if err != nil {
+			return err
+		}
+		b.CRLs = append(b.CRLs, crl)
+	case "DH PARAMETERS":
+		params, err := LoadDHParametersFromDER(block.Bytes)
+		if err != nil {
+			return err
+		}
+		b.DHParameters = append(b.DHParameters, params)
+	case "EC PARAMETERS":
+		// as openssl ecparam -genkey writes before the key, which names its
+		// curve again
+	default:
+		return fmt.Errorf("unsupported pem block type %q", block.Type)
+	}
+	return nil
+}
+
+// MarshalPEM converts everything in the bundle to PEM-encoded format, for
+// LoadPEMBundle to read back: the certificates first, then the private keys
+// in PKCS#8 format, the public keys, requests, CRLs and DH parameters.
+func (b *PEMBundle) MarshalPEM() (pem_data []byte, err error) {
+	var buf bytes.Buffer
+	write := func(pem_block []byte, err error) error {
+		if err != nil {
+			return err
+		}
+		buf.Write(pem_block)
+		return nil
+	}
+	for _, cert := range b.Certificates {
+		if err := write(cert.MarshalPEM()); err != nil {
+			return nil, err
+		}
+	}
+	for _, key := range b.PrivateKeys {
+		if err := write(key.MarshalPKCS8PrivateKeyPEM()); err != nil {
+			return nil, err
+		}
+	}
+	for _, key := range b.PublicKeys {
+		if err := write(key.MarshalPKIXPublicKeyPEM()); err != nil {
+			return nil, err
+		}
+	}
+	for _, req := range b.Requests {
+		if err := write(req.MarshalPEM()); err != nil {
+			return nil, err
+		}
+	}
+	for _, crl := range b.CRLs {
+		if err := write(crl.MarshalPEM()); err != nil {
+			return nil, err
+		}
+	}
+	for _, params := range b.DHParameters {
+		if err := write(params.MarshalPEM()); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,193 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !cgo
+
+package openssl
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+type PublicKey interface {
+	// MarshalPKIXPublicKeyPEM converts the public key to PEM-encoded PKIX
+	// format
+	MarshalPKIXPublicKeyPEM() (pem_block []byte, err error)
+
+	// MarshalPKIXPublicKeyDER converts the public key to DER-encoded PKIX
+	// format
+	MarshalPKIXPublicKeyDER() (der_block []byte, err error)
+
+	publicKey() crypto.PublicKey
+}
+
+type PrivateKey interface {
+	PublicKey
+
+	// MarshalPKCS1PrivateKeyPEM converts the private key to PEM-encoded PKCS1
+	// format
+	MarshalPKCS1PrivateKeyPEM() (pem_block []byte, err error)
+
+	// MarshalPKCS1PrivateKeyDER converts the private key to DER-encoded PKCS1
+	// format
+	MarshalPKCS1PrivateKeyDER() (der_block []byte, err error)
+}
+
+// pKey holds a crypto/x509 key: a crypto.PublicKey, or a crypto.Signer for
+// private keys.
+type pKey struct {
+	key interface{}
+}
+
+func (key *pKey) publicKey() crypto.PublicKey {
+	if signer, ok := key.key.(crypto.Signer); ok {
+		return signer.Public()
+	}
+	return key.key
+}
+
+func (key *pKey) MarshalPKIXPublicKeyDER() (der_block []byte, err error) {
+	return x509.MarshalPKIXPublicKey(key.publicKey())
+}
+
+func (key *pKey) MarshalPKIXPublicKeyPEM() (pem_block []byte, err error) {
+	der, err := key.MarshalPKIXPublicKeyDER()
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+func (key *pKey) MarshalPKCS1PrivateKeyDER() (der_block []byte, err error) {
+	rsa_key, ok := key.key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is %T, not an RSA key", key.key)
+	}
+	return x509.MarshalPKCS1PrivateKey(rsa_key), nil
+}
+
+func (key *pKey) MarshalPKCS1PrivateKeyPEM() (pem_block []byte, err error) {
+	der, err := key.MarshalPKCS1PrivateKeyDER()
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY",
+		Bytes: der}), nil
+}
+
+// LoadPrivateKeyFromPEM loads an RSA, ECDSA or Ed25519 private key from a
+// PEM-encoded block, in PKCS#8 or the traditional per-algorithm format.
+// Encrypted keys aren't supported.
+func LoadPrivateKeyFromPEM(pem_block []byte) (PrivateKey, error) {
+	block, _ := pem.Decode(pem_block)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported private key type %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey:
+		return &pKey{key: key}, nil
+	}
+	return nil, fmt.Errorf("unsupported private key %T", key)
+}
+
+// LoadPublicKeyFromPEM loads a public key from a PEM-encoded block, in PKIX
+// or PKCS#1 format.
+func LoadPublicKeyFromPEM(pem_block []byte) (PublicKey, error) {
+	block, _ := pem.Decode(pem_block)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported public key type %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &pKey{key: key}, nil
+}
+
+type Certificate struct {
+	x509 *x509.Certificate
+}
+
+// LoadCertificateFromPEM loads an X509 certificate from a PEM-encoded block.
+func LoadCertificateFromPEM(pem_block []byte) (*Certificate, error) {
+	block, _ := pem.Decode(pem_block)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no PEM certificate found")
+	}
+	return LoadCertificateFromDER(block.Bytes)
+}
+
+// LoadCertificateFromDER loads an X509 certificate from a DER-encoded block.
+func LoadCertificateFromDER(der_block []byte) (*Certificate, error) {
+	cert, err := x509.ParseCertificate(der_block)
+	if err != nil {
+		return nil, err
+	}
+	return &Certificate{x509: cert}, nil
+}
+
+// MarshalPEM converts the X509 certificate to PEM-encoded format
+func (c *Certificate) MarshalPEM() (pem_block []byte, err error) {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE",
+		Bytes: c.x509.Raw}), nil
+}
+
+// MarshalDER converts the X509 certificate to DER-encoded format
+func (c *Certificate) MarshalDER() (der_block []byte, err error) {
+	return append([]byte(nil), c.x509.Raw...), nil
+}
+
+// PublicKey returns the public key embedded in the X509 certificate.
+func (c *Certificate) PublicKey() (PublicKey, error) {
+	return &pKey{key: c.x509.PublicKey}, nil
+}
+
+// keysMatch reports whether key is the private key for cert.
+func keysMatch(cert *Certificate, key PrivateKey) bool {
+	pub, ok := key.publicKey().(interface {
+		Equal(crypto.PublicKey) bool
+	})
+	return ok && pub.Equal(cert.x509.PublicKey)
+}
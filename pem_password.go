@@ -0,0 +1,160 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <stdint.h>
+#include <stdlib.h>
+#include <string.h>
+#include <openssl/err.h>
+#include <openssl/pem.h>
+
+extern int password_cb_thunk(char *buf, int size, int rwflag, void *u);
+
+// the callback's state is found by token, as C can't hold on to Go pointers
+static EVP_PKEY *OUR_PEM_read_bio_PrivateKey_cb(BIO *bio, uintptr_t token) {
+    return PEM_read_bio_PrivateKey(bio, NULL, password_cb_thunk,
+        (void *)token);
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sync"
+	"unsafe"
+)
+
+// PasswordCallback supplies the password for an encrypted key, such as by
+// prompting for it or fetching it from a secret store. It is only called
+// for keys that are encrypted, and an error it returns fails the load.
+type PasswordCallback func() (string, error)
+
+type passwordCallbackState struct {
+	cb  PasswordCallback
+	err error
+}
+
+var (
+	password_cbs_mtx  sync.Mutex
+	password_cbs      = map[uintptr]*passwordCallbackState{}
+	password_cbs_next uintptr
+)
+
+// LoadPrivateKeyFromPEMWithCallback loads a private key of any type from a
+// PEM-encoded block, in encrypted PKCS#8 or the traditional encrypted
+// format, calling cb for the password if it is encrypted.
+func LoadPrivateKeyFromPEMWithCallback(pem_block []byte,
+	cb PasswordCallback) (PrivateKey, error) {
+	if len(pem_block) == 0 {
+		return nil, errors.New("empty pem block")
+	}
+	state := &passwordCallbackState{cb: cb}
+	password_cbs_mtx.Lock()
+	password_cbs_next++
+	token := password_cbs_next
+	password_cbs[token] = state
+	password_cbs_mtx.Unlock()
+	defer func() {
+		password_cbs_mtx.Lock()
+		delete(password_cbs, token)
+		password_cbs_mtx.Unlock()
+	}()
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	bio := C.BIO_new_mem_buf(unsafe.Pointer(&pem_block[0]),
+		C.int(len(pem_block)))
+	if bio == nil {
+		return nil, errors.New("failed creating bio")
+	}
+	defer C.BIO_free(bio)
+	key := C.OUR_PEM_read_bio_PrivateKey_cb(bio, C.uintptr_t(token))
+	if key == nil {
+		if state.err != nil {
+			C.ERR_clear_error()
+			return nil, state.err
+		}
+		return nil, errorFromErrorQueue()
+	}
+	return newPKey(key), nil
+}
+
+//export password_cb_thunk
+func password_cb_thunk(buf *C.char, size C.int, rwflag C.int,
+	u unsafe.Pointer) C.int {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Critf("openssl: password callback panic'd: %v", err)
+			os.Exit(1)
+		}
+	}()
+	password_cbs_mtx.Lock()
+	state := password_cbs[uintptr(u)]
+	password_cbs_mtx.Unlock()
+	if state == nil {
+		return -1
+	}
+	password, err := state.cb()
+	if err != nil {
+		state.err = err
+		return -1
+	}
+	if len(password) > int(size) {
+		state.err = errors.New("password too long")
+		return -1
+	}
+	if len(password) > 0 {
+		p := []byte(password)
+		C.memcpy(unsafe.Pointer(buf), unsafe.Pointer(&p[0]), C.size_t(len(p)))
+	}
+	return C.int(len(password))
+}
+
+func (key *pKey) MarshalPKCS8PrivateKeyPEMWithPassword(cipher *Cipher,
+	password string) (pem_block []byte, err error) {
+	if cipher == nil {
+		return nil, errors.New("no cipher given")
+	}
+	// without a password OpenSSL would prompt for one on the terminal
+	if password == "" {
+		return nil, errors.New("empty password")
+	}
+	pkey := key.acquirePKey()
+	if pkey == nil {
+		return nil, keyFreed
+	}
+	defer C.EVP_PKEY_free(pkey)
+	cpassword := C.CString(password)
+	defer C.free(unsafe.Pointer(cpassword))
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	bio := C.BIO_new(C.BIO_s_mem())
+	if bio == nil {
+		return nil, errors.New("failed to allocate memory BIO")
+	}
+	defer C.BIO_free(bio)
+	if C.PEM_write_bio_PKCS8PrivateKey(bio, pkey, cipher.ptr, cpassword,
+		C.int(len(password)), nil, nil) != 1 {
+		return nil, errorFromErrorQueue()
+	}
+	return ioutil.ReadAll(asAnyBio(bio))
+}
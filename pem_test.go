@@ -12,15 +12,21 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+// +build cgo
+
 package openssl
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/hex"
 	pem_pkg "encoding/pem"
+	"errors"
 	"io/ioutil"
 	"testing"
 )
@@ -132,3 +138,249 @@ func TestMarshal(t *testing.T) {
 		t.Fatal("invalid public key der bytes")
 	}
 }
+
+func TestMarshalECDSAPublicKey(t *testing.T) {
+	std, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := FromStdlibPrivateKey(std)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tls_der, err := x509.MarshalPKIXPublicKey(&std.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := key.MarshalPKIXPublicKeyDER()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(der, tls_der) {
+		t.Fatal("invalid public key der bytes")
+	}
+	pem, err := key.MarshalPKIXPublicKeyPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tls_pem := pem_pkg.EncodeToMemory(&pem_pkg.Block{
+		Type: "PUBLIC KEY", Bytes: tls_der})
+	if !bytes.Equal(pem, tls_pem) {
+		t.Fatal("invalid public key pem bytes")
+	}
+}
+
+func TestLoadPrivateKeyFromPEMWithPassword(t *testing.T) {
+	block, _ := pem_pkg.Decode(keyBytes)
+	encrypted, err := x509.EncryptPEMBlock(rand.Reader, block.Type,
+		block.Bytes, []byte("hunter2"), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted_pem := pem_pkg.EncodeToMemory(encrypted)
+
+	if _, err := LoadPrivateKeyFromPEMWithPassword(encrypted_pem,
+		"wrong"); err == nil {
+		t.Fatal("expected an error with the wrong password")
+	}
+	if _, err := LoadPrivateKeyFromPEMWithPassword(encrypted_pem,
+		""); err == nil {
+		t.Fatal("expected an error without a password")
+	}
+	key, err := LoadPrivateKeyFromPEMWithPassword(encrypted_pem, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := LoadPrivateKeyFromPEMWithPassword(keyBytes, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	der1, err := key.MarshalPKCS1PrivateKeyDER()
+	if err != nil {
+		t.Fatal(err)
+	}
+	der2, err := plain.MarshalPKCS1PrivateKeyDER()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(der1, der2) {
+		t.Fatal("decrypted key differs")
+	}
+}
+
+func TestLoadPrivateKeyFromPEMWithCallback(t *testing.T) {
+	block, _ := pem_pkg.Decode(keyBytes)
+	encrypted, err := x509.EncryptPEMBlock(rand.Reader, block.Type,
+		block.Bytes, []byte("hunter2"), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted_pem := pem_pkg.EncodeToMemory(encrypted)
+
+	if _, err := LoadPrivateKeyFromPEM(encrypted_pem); err == nil {
+		t.Fatal("expected an error without a password")
+	}
+	locked := errors.New("vault is locked")
+	_, err = LoadPrivateKeyFromPEMWithCallback(encrypted_pem,
+		func() (string, error) { return "", locked })
+	if err != locked {
+		t.Fatalf("expected the callback's error, got %v", err)
+	}
+	calls := 0
+	if _, err := LoadPrivateKeyFromPEMWithCallback(keyBytes,
+		func() (string, error) {
+			calls++
+			return "", nil
+		}); err != nil || calls != 0 {
+		t.Fatalf("expected a plain key to load without the callback, got "+
+			"%v after %d calls", err, calls)
+	}
+	if _, err := LoadPrivateKeyFromPEMWithCallback(encrypted_pem,
+		func() (string, error) { return "wrong", nil }); err == nil {
+		t.Fatal("expected an error with the wrong password")
+	}
+
+	key, err := LoadPrivateKeyFromPEMWithCallback(encrypted_pem,
+		func() (string, error) { return "hunter2", nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipher, err := GetCipherByName("aes-256-cbc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := key.MarshalPKCS8PrivateKeyPEMWithPassword(cipher,
+		"correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(pkcs8, []byte("ENCRYPTED PRIVATE KEY")) {
+		t.Fatalf("expected an encrypted PKCS#8 key, got %s", pkcs8)
+	}
+	loaded, err := LoadPrivateKeyFromPEMWithCallback(pkcs8,
+		func() (string, error) { return "correct horse", nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	der1, err := key.MarshalPKCS8PrivateKeyDER()
+	if err != nil {
+		t.Fatal(err)
+	}
+	der2, err := loaded.MarshalPKCS8PrivateKeyDER()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(der1, der2) {
+		t.Fatal("decrypted key differs")
+	}
+	if _, err := LoadPrivateKeyFromPEMWithPassword(pkcs8,
+		"correct horse"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadCertificateChainFromPEM(t *testing.T) {
+	key, err := LoadPrivateKeyFromPEM(keyBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := issueTestCert(t, key, testCert{}).MarshalPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, err := LoadCertificateChainFromPEM(
+		append(append([]byte{}, certBytes...), other...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 2 {
+		t.Fatalf("expected 2 certificates, got %d", len(chain))
+	}
+	if _, err := LoadCertificateChainFromPEM([]byte("junk")); err == nil {
+		t.Fatal("expected an error without certificates")
+	}
+}
+
+func TestPEMBundle(t *testing.T) {
+	ca_key := generateTestRSAKey(t)
+	ca := issueTestCert(t, ca_key, testCert{CA: true})
+	crl_server := newTestCRLServer(t, ca, ca_key)
+	defer crl_server.Close()
+	crl_pem, err := crl_server.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, err := LoadCRLFromPEM(crl_pem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, err := LoadDHParametersFromPEM(ffdhe2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := generateTestRSAKey(t)
+	leaf := issueTestCert(t, key, testCert{Serial: 2, Issuer: ca,
+		IssuerKey: ca_key})
+	bundle := &PEMBundle{
+		Certificates: []*Certificate{leaf, ca},
+		PrivateKeys:  []PrivateKey{key},
+		PublicKeys:   []PublicKey{ca_key},
+		Requests:     []*X509Request{newTestX509Request(t, key)},
+		CRLs:         []*CRL{crl},
+		DHParameters: []*DHParameters{params},
+	}
+	pem_data, err := bundle.MarshalPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadPEMBundle(pem_data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Certificates) != 2 || len(loaded.PrivateKeys) != 1 ||
+		len(loaded.PublicKeys) != 1 || len(loaded.Requests) != 1 ||
+		len(loaded.CRLs) != 1 || len(loaded.DHParameters) != 1 {
+		t.Fatalf("unexpected bundle %+v", loaded)
+	}
+	if !sameCertificate(t, ca, loaded.Certificates[1]) {
+		t.Fatal("certificates out of order")
+	}
+	crl_der, err := crl.MarshalDER()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded_crl_der, err := loaded.CRLs[0].MarshalDER()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(crl_der, loaded_crl_der) {
+		t.Fatal("crl changed in the round trip")
+	}
+	if err := loaded.Requests[0].CheckSignature(); err != nil {
+		t.Fatal(err)
+	}
+	again, err := loaded.MarshalPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pem_data, again) {
+		t.Fatal("bundle changed in the round trip")
+	}
+
+	cipher, err := GetCipherByName("aes-256-cbc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := key.MarshalPKCS8PrivateKeyPEMWithPassword(cipher,
+		"hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadPEMBundle(encrypted); err == nil {
+		t.Fatal("expected an encrypted key to fail")
+	}
+	if _, err := LoadPEMBundle([]byte(
+		"-----BEGIN FOO-----\nAAAA\n-----END FOO-----\n")); err == nil {
+		t.Fatal("expected an unknown block type to fail")
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+)
+
+// SPKIPin returns the pin of key: the base64 SHA-256 digest of its DER
+// SubjectPublicKeyInfo, as used by HPKP (RFC 7469) and curl's
+// --pinnedpubkey.
+func SPKIPin(key PublicKey) (string, error) {
+	der, err := key.MarshalPKIXPublicKeyDER()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return base64.StdEncoding.EncodeToString(sum[:]), nil
+}
+
+// SPKIPin returns the pin of the certificate's public key, see SPKIPin.
+func (c *Certificate) SPKIPin() (string, error) {
+	key, err := c.PublicKey()
+	if err != nil {
+		return "", err
+	}
+	return SPKIPin(key)
+}
+
+// SetSPKIPins makes connections using the context refuse peers unless the
+// public key of some certificate in the verified chain, the peer's own or
+// one of its issuers, has one of the pins, as returned by SPKIPin. A
+// mismatch fails verification with Conn.VerifyResult reporting
+// ApplicationVerification. Pinning an issuer as well as the peer's key
+// leaves room to replace the peer's key. The verify mode must ask for the
+// peer's certificate. No pins turns pinning off.
+func (c *Ctx) SetSPKIPins(pins []string) error {
+	var set map[string]bool
+	if len(pins) > 0 {
+		set = make(map[string]bool, len(pins))
+	}
+	for _, pin := range pins {
+		sum, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(sum) != sha256.Size {
+			return fmt.Errorf("invalid SPKI pin %q", pin)
+		}
+		set[pin] = true
+	}
+	c.spki_pins = set
+	c.SetVerify(c.VerifyMode(), c.verify_cb)
+	return nil
+}
+
+func (c *Ctx) matchesSPKIPin(chain []*Certificate) bool {
+	for _, cert := range chain {
+		pin, err := cert.SPKIPin()
+		if err == nil && c.spki_pins[pin] {
+			return true
+		}
+	}
+	return false
+}
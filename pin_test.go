@@ -0,0 +1,107 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"testing"
+)
+
+func TestSPKIPins(t *testing.T) {
+	root_key := generateTestRSAKey(t)
+	root := issueTestCert(t, root_key, testCert{Serial: 1, Name: "root",
+		CA: true})
+	inter_key := generateTestRSAKey(t)
+	inter := issueTestCert(t, inter_key, testCert{Serial: 2,
+		Name: "intermediate", Issuer: root, IssuerKey: root_key, CA: true})
+	leaf_key := generateTestRSAKey(t)
+	leaf := issueTestCert(t, leaf_key, testCert{Serial: 3, Name: "leaf",
+		Issuer: inter, IssuerKey: inter_key})
+	server_ctx := newSharedCtx(t, leaf_key, leaf, inter)
+
+	leaf_pin, err := leaf.SPKIPin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	std, err := ToStdlibCertificate(leaf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(std.RawSubjectPublicKeyInfo)
+	if leaf_pin != base64.StdEncoding.EncodeToString(sum[:]) {
+		t.Fatalf("unexpected pin %s", leaf_pin)
+	}
+	if key_pin, err := SPKIPin(leaf_key); err != nil || key_pin != leaf_pin {
+		t.Fatalf("expected the key's pin to match, got %s: %v", key_pin, err)
+	}
+	root_pin, err := root.SPKIPin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other_pin, err := SPKIPin(generateTestRSAKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client_ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client_ctx.GetCertificateStore().AddCertificate(
+		root); err != nil {
+		t.Fatal(err)
+	}
+	client_ctx.SetVerifyMode(VerifyPeer)
+	handshake := func() VerifyResult {
+		server_conn, client_conn := NetPipe(t)
+		defer server_conn.Close()
+		defer client_conn.Close()
+		server, err := Server(server_conn, server_ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+		go server.Handshake()
+		client, err := Client(client_conn, client_ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		client.Handshake()
+		return client.VerifyResult()
+	}
+
+	for _, pins := range [][]string{
+		{leaf_pin}, {other_pin, root_pin}, nil} {
+		if err := client_ctx.SetSPKIPins(pins); err != nil {
+			t.Fatal(err)
+		}
+		if rv := handshake(); rv != Ok {
+			t.Fatalf("pins %q: verification failed: %d", pins, rv)
+		}
+	}
+	if err := client_ctx.SetSPKIPins([]string{other_pin}); err != nil {
+		t.Fatal(err)
+	}
+	if rv := handshake(); rv != ApplicationVerification {
+		t.Fatalf("expected the pin mismatch to fail, got %d", rv)
+	}
+	if err := client_ctx.SetSPKIPins([]string{"not a pin"}); err == nil {
+		t.Fatal("expected an error for an invalid pin")
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <stdlib.h>
+#include <openssl/err.h>
+#include <openssl/pkcs12.h>
+
+extern int sk_X509_num_not_a_macro(STACK_OF(X509) *sk);
+extern X509 *sk_X509_value_not_a_macro(STACK_OF(X509)* sk, int i);
+
+static void sk_X509_free_not_a_macro(STACK_OF(X509) *sk) {
+    sk_X509_free(sk);
+}
+
+// PKCS12_parse appends to *ca if it is given a stack, so start from none
+static int OUR_PKCS12_parse(PKCS12 *p12, const char *pass, EVP_PKEY **pkey,
+        X509 **cert, STACK_OF(X509) **ca) {
+    *pkey = NULL;
+    *cert = NULL;
+    *ca = NULL;
+    return PKCS12_parse(p12, pass, pkey, cert, ca);
+}
+
+static PKCS12 *OUR_PKCS12_create(const char *pass, EVP_PKEY *pkey,
+        X509 *cert, X509 **ca, int n) {
+    STACK_OF(X509) *sk = NULL;
+    PKCS12 *p12;
+    int i;
+    if (n > 0) {
+        sk = sk_X509_new_null();
+        if (sk == NULL)
+            return NULL;
+        for (i = 0; i < n; i++) {
+            if (sk_X509_push(sk, ca[i]) <= 0) {
+                sk_X509_free(sk);
+                return NULL;
+            }
+        }
+    }
+    // the library defaults pick the ciphers and iteration counts
+    p12 = PKCS12_create(pass, NULL, pkey, cert, sk, 0, 0, 0, 0, 0);
+    sk_X509_free(sk);
+    return p12;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"io/ioutil"
+	"runtime"
+	"unsafe"
+)
+
+// LoadPKCS12 loads a DER-encoded PKCS#12 bundle, a .p12 or .pfx file as
+// exported by Windows, Java keytool and most PKI tooling, decrypting it with
+// password. It returns the bundle's private key, the certificate for it,
+// and any other certificates, which are normally the certificate's chain.
+// The key is nil if the bundle has none, and then so is the certificate,
+// which is told apart from the rest by matching the key, leaving all of
+// them among the others.
+func LoadPKCS12(der []byte, password string) (PrivateKey, *Certificate,
+	[]*Certificate, error) {
+	if len(der) == 0 {
+		return nil, nil, nil, errors.New("empty der block")
+	}
+	cpass := C.CString(password)
+	defer C.free(unsafe.Pointer(cpass))
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	bio := C.BIO_new_mem_buf(unsafe.Pointer(&der[0]), C.int(len(der)))
+	if bio == nil {
+		return nil, nil, nil, errors.New("failed creating bio")
+	}
+	p12 := C.d2i_PKCS12_bio(bio, nil)
+	C.BIO_free(bio)
+	if p12 == nil {
+		return nil, nil, nil, errorFromErrorQueue()
+	}
+	defer C.PKCS12_free(p12)
+
+	var pkey *C.EVP_PKEY
+	var x *C.X509
+	var sk *C.struct_stack_st_X509
+	if C.OUR_PKCS12_parse(p12, cpass, &pkey, &x, &sk) != 1 {
+		return nil, nil, nil, errorFromErrorQueue()
+	}
+	var key PrivateKey
+	if pkey != nil {
+		key = newPKey(pkey)
+	}
+	var cert *Certificate
+	if x != nil {
+		cert = newCertificate(x)
+	}
+	var ca []*Certificate
+	if sk != nil {
+		// the certificates' references go to Go, so free only the stack
+		defer C.sk_X509_free_not_a_macro(sk)
+		n := int(C.sk_X509_num_not_a_macro(sk))
+		ca = make([]*Certificate, 0, n)
+		for i := 0; i < n; i++ {
+			ca = append(ca, newCertificate(
+				C.sk_X509_value_not_a_macro(sk, C.int(i))))
+		}
+	}
+	return key, cert, ca, nil
+}
+
+// MarshalPKCS12 bundles key, the certificate for it and cert's chain, ca,
+// into a DER-encoded PKCS#12 file encrypted with password, as LoadPKCS12
+// and other tools read. Either key or cert may be nil. The encryption is
+// OpenSSL's default, which from OpenSSL 3.0 is AES-256 with PBKDF2; older
+// versions use the legacy RC2 and 3DES schemes that older Windows and Java
+// releases expect.
+func MarshalPKCS12(key PrivateKey, cert *Certificate, ca []*Certificate,
+	password string) ([]byte, error) {
+	if key == nil && cert == nil {
+		return nil, errors.New("nothing to marshal")
+	}
+	var pkey *C.EVP_PKEY
+	if key != nil {
+		pkey = key.acquirePKey()
+		if pkey == nil {
+			return nil, keyFreed
+		}
+		defer C.EVP_PKEY_free(pkey)
+	}
+	var x *C.X509
+	if cert != nil {
+		x = cert.acquireX509()
+		if x == nil {
+			return nil, certificateFreed
+		}
+		defer C.X509_free(x)
+	}
+	xs := make([]*C.X509, 0, len(ca))
+	defer func() {
+		for _, x := range xs {
+			C.X509_free(x)
+		}
+	}()
+	for _, cert := range ca {
+		x := cert.acquireX509()
+		if x == nil {
+			return nil, certificateFreed
+		}
+		xs = append(xs, x)
+	}
+	var xs_ptr **C.X509
+	if len(xs) > 0 {
+		xs_ptr = &xs[0]
+	}
+	cpass := C.CString(password)
+	defer C.free(unsafe.Pointer(cpass))
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	p12 := C.OUR_PKCS12_create(cpass, pkey, x, xs_ptr, C.int(len(xs)))
+	if p12 == nil {
+		return nil, errorFromErrorQueue()
+	}
+	defer C.PKCS12_free(p12)
+	bio := C.BIO_new(C.BIO_s_mem())
+	if bio == nil {
+		return nil, errors.New("failed to allocate memory BIO")
+	}
+	defer C.BIO_free(bio)
+	if C.i2d_PKCS12_bio(bio, p12) != 1 {
+		return nil, errorFromErrorQueue()
+	}
+	return ioutil.ReadAll(asAnyBio(bio))
+}
+
+// UsePKCS12 configures the context with the private key, certificate and
+// chain in a PKCS#12 bundle, as loaded by LoadPKCS12.
+func (c *Ctx) UsePKCS12(der []byte, password string) error {
+	key, cert, ca, err := LoadPKCS12(der, password)
+	if err != nil {
+		return err
+	}
+	if key == nil || cert == nil {
+		return errors.New("pkcs12 bundle lacks a key or certificate")
+	}
+	if err := c.UseCertificate(cert); err != nil {
+		return err
+	}
+	if err := c.UsePrivateKey(key); err != nil {
+		return err
+	}
+	for _, cert := range ca {
+		if err := c.AddChainCertificate(cert); err != nil {
+			return err
+		}
+	}
+	return c.CheckPrivateKey()
+}
@@ -0,0 +1,92 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"bytes"
+	"testing"
+)
+
+func sameCertificate(t *testing.T, a, b *Certificate) bool {
+	a_der, err := a.MarshalDER()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b_der, err := b.MarshalDER()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Equal(a_der, b_der)
+}
+
+func TestPKCS12(t *testing.T) {
+	ca_key := generateTestRSAKey(t)
+	ca := issueTestCert(t, ca_key, testCert{CA: true})
+	key := generateTestRSAKey(t)
+	leaf := issueTestCert(t, key, testCert{Serial: 2, Issuer: ca,
+		IssuerKey: ca_key})
+
+	der, err := MarshalPKCS12(key, leaf, []*Certificate{ca}, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded_key, loaded_leaf, loaded_ca, err := LoadPKCS12(der, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameCertificate(t, leaf, loaded_leaf) {
+		t.Fatal("certificate changed in the round trip")
+	}
+	if len(loaded_ca) != 1 || !sameCertificate(t, ca, loaded_ca[0]) {
+		t.Fatalf("unexpected chain of %d certificates", len(loaded_ca))
+	}
+	matches, err := loaded_leaf.MatchesKey(loaded_key)
+	if err != nil || !matches {
+		t.Fatalf("expected the key to match, got %v, %v", matches, err)
+	}
+
+	if _, _, _, err := LoadPKCS12(der, "wrong"); err == nil {
+		t.Fatal("expected the wrong password to fail")
+	}
+
+	ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.UsePKCS12(der, "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a bundle of just a certificate can't configure a context
+	der, err = MarshalPKCS12(nil, leaf, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded_key, loaded_leaf, loaded_ca, err = LoadPKCS12(der, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// without a key to match, the certificate comes back with the others
+	if loaded_key != nil || loaded_leaf != nil || len(loaded_ca) != 1 ||
+		!sameCertificate(t, leaf, loaded_ca[0]) {
+		t.Fatalf("unexpected bundle contents %v, %v, %v", loaded_key,
+			loaded_leaf, loaded_ca)
+	}
+	if err := ctx.UsePKCS12(der, ""); err == nil {
+		t.Fatal("expected a bundle without a key to fail")
+	}
+}
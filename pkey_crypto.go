@@ -0,0 +1,265 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <string.h>
+#include <openssl/err.h>
+#include <openssl/evp.h>
+#include <openssl/rsa.h>
+
+extern int OUR_EVP_PKEY_sign_digest(EVP_PKEY *pkey, const EVP_MD *md,
+    int pss, int saltlen, const unsigned char *tbs, size_t tbslen,
+    unsigned char *sig, size_t *siglen);
+
+static int OUR_EVP_PKEY_verify_digest(EVP_PKEY *pkey, const EVP_MD *md,
+    int pss, int saltlen, const unsigned char *tbs, size_t tbslen,
+    const unsigned char *sig, size_t siglen) {
+    int ret = 0;
+    EVP_PKEY_CTX *ctx = EVP_PKEY_CTX_new(pkey, NULL);
+    if (ctx == NULL)
+        return 0;
+    if (EVP_PKEY_verify_init(ctx) <= 0)
+        goto end;
+    if (EVP_PKEY_base_id(pkey) == EVP_PKEY_RSA) {
+        if (EVP_PKEY_CTX_set_rsa_padding(ctx,
+                pss ? RSA_PKCS1_PSS_PADDING : RSA_PKCS1_PADDING) <= 0)
+            goto end;
+        if (pss && EVP_PKEY_CTX_set_rsa_pss_saltlen(ctx, saltlen) <= 0)
+            goto end;
+    }
+    if (md != NULL && EVP_PKEY_CTX_set_signature_md(ctx, md) <= 0)
+        goto end;
+    ret = EVP_PKEY_verify(ctx, sig, siglen, tbs, tbslen);
+end:
+    EVP_PKEY_CTX_free(ctx);
+    return ret;
+}
+
+// encrypts or decrypts in with RSA-OAEP, using md for both the label hash
+// and MGF1, or with PKCS#1 v1.5 padding if md is NULL
+static int OUR_EVP_PKEY_rsa_crypt(EVP_PKEY *pkey, int encrypt,
+    const EVP_MD *md,
+    const unsigned char *label, size_t label_len,
+    const unsigned char *in, size_t inlen,
+    unsigned char *out, size_t *outlen) {
+    int ret = 0;
+    unsigned char *label_copy = NULL;
+    EVP_PKEY_CTX *ctx = EVP_PKEY_CTX_new(pkey, NULL);
+    if (ctx == NULL)
+        return 0;
+    if ((encrypt ? EVP_PKEY_encrypt_init(ctx) :
+            EVP_PKEY_decrypt_init(ctx)) <= 0)
+        goto end;
+    if (md == NULL) {
+        if (EVP_PKEY_CTX_set_rsa_padding(ctx, RSA_PKCS1_PADDING) <= 0)
+            goto end;
+        goto crypt;
+    }
+    if (EVP_PKEY_CTX_set_rsa_padding(ctx, RSA_PKCS1_OAEP_PADDING) <= 0)
+        goto end;
+    if (EVP_PKEY_CTX_set_rsa_oaep_md(ctx, md) <= 0)
+        goto end;
+    if (EVP_PKEY_CTX_set_rsa_mgf1_md(ctx, md) <= 0)
+        goto end;
+    if (label_len > 0) {
+        // the ctx takes ownership of the label
+        label_copy = OPENSSL_malloc(label_len);
+        if (label_copy == NULL)
+            goto end;
+        memcpy(label_copy, label, label_len);
+        if (EVP_PKEY_CTX_set0_rsa_oaep_label(ctx, label_copy,
+                label_len) <= 0) {
+            OPENSSL_free(label_copy);
+            goto end;
+        }
+    }
+crypt:
+    if (encrypt)
+        ret = EVP_PKEY_encrypt(ctx, out, outlen, in, inlen);
+    else
+        ret = EVP_PKEY_decrypt(ctx, out, outlen, in, inlen);
+end:
+    EVP_PKEY_CTX_free(ctx);
+    return ret;
+}
+*/
+import "C"
+
+import (
+	"crypto"
+	crypto_rand "crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"unsafe"
+)
+
+// pssSaltLength returns whether opts asks for PSS padding, and the salt
+// length OpenSSL takes for it.
+func pssSaltLength(opts *rsa.PSSOptions) (pss, saltlen C.int) {
+	if opts == nil {
+		return 0, 0
+	}
+	switch opts.SaltLength {
+	case rsa.PSSSaltLengthAuto:
+		// as large as possible when signing, and detected when verifying
+		return 1, -2
+	case rsa.PSSSaltLengthEqualsHash:
+		return 1, -1
+	}
+	return 1, C.int(opts.SaltLength)
+}
+
+func (key *pKey) SignDigest(method Method, hashed []byte,
+	opts *rsa.PSSOptions) ([]byte, error) {
+	pkey := key.acquirePKey()
+	if pkey == nil {
+		return nil, keyFreed
+	}
+	defer C.EVP_PKEY_free(pkey)
+	if len(hashed) == 0 {
+		return nil, errors.New("no digest to sign")
+	}
+	sig := make([]byte, C.EVP_PKEY_size(pkey))
+	siglen := C.size_t(len(sig))
+	pss, saltlen := pssSaltLength(opts)
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.OUR_EVP_PKEY_sign_digest(pkey, method, pss, saltlen,
+		(*C.uchar)(unsafe.Pointer(&hashed[0])), C.size_t(len(hashed)),
+		(*C.uchar)(&sig[0]), &siglen) != 1 {
+		return nil, errorFromErrorQueue()
+	}
+	return sig[:siglen], nil
+}
+
+func (key *pKey) VerifyDigest(method Method, hashed, sig []byte,
+	opts *rsa.PSSOptions) error {
+	pkey := key.acquirePKey()
+	if pkey == nil {
+		return keyFreed
+	}
+	defer C.EVP_PKEY_free(pkey)
+	if len(hashed) == 0 || len(sig) == 0 {
+		return errors.New("verify: missing digest or signature")
+	}
+	pss, saltlen := pssSaltLength(opts)
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.OUR_EVP_PKEY_verify_digest(pkey, method, pss, saltlen,
+		(*C.uchar)(unsafe.Pointer(&hashed[0])), C.size_t(len(hashed)),
+		(*C.uchar)(unsafe.Pointer(&sig[0])), C.size_t(len(sig))) != 1 {
+		C.ERR_clear_error()
+		return errors.New("verify: invalid signature")
+	}
+	return nil
+}
+
+func (key *pKey) EncryptOAEP(method Method, plaintext, label []byte) (
+	[]byte, error) {
+	if method == nil {
+		return nil, errors.New("oaep: no digest provided")
+	}
+	return key.rsaCrypt(true, method, plaintext, label)
+}
+
+func (key *pKey) DecryptOAEP(method Method, ciphertext, label []byte) (
+	[]byte, error) {
+	if method == nil {
+		return nil, errors.New("oaep: no digest provided")
+	}
+	return key.rsaCrypt(false, method, ciphertext, label)
+}
+
+// Decrypt implements crypto.Decrypter for RSA keys. opts is nil or
+// *rsa.PKCS1v15DecryptOptions for PKCS#1 v1.5, or *rsa.OAEPOptions for OAEP,
+// whose Hash is used for MGF1 as well. As with rsa.DecryptPKCS1v15SessionKey,
+// a PKCS#1 v1.5 SessionKeyLen makes failures return random bytes read from
+// rand, or crypto/rand if it is nil, rather than an error.
+func (key *pKey) Decrypt(rand io.Reader, msg []byte,
+	opts crypto.DecrypterOpts) ([]byte, error) {
+	switch o := opts.(type) {
+	case *rsa.OAEPOptions:
+		md, err := hashMethod(o.Hash)
+		if err != nil {
+			return nil, err
+		}
+		return key.rsaCrypt(false, md, msg, o.Label)
+	case *rsa.PKCS1v15DecryptOptions:
+		if o != nil && o.SessionKeyLen > 0 {
+			if rand == nil {
+				rand = crypto_rand.Reader
+			}
+			session := make([]byte, o.SessionKeyLen)
+			if _, err := io.ReadFull(rand, session); err != nil {
+				return nil, err
+			}
+			plaintext, err := key.rsaCrypt(false, nil, msg, nil)
+			if err == nil && len(plaintext) == len(session) {
+				copy(session, plaintext)
+			}
+			return session, nil
+		}
+	case nil:
+	default:
+		return nil, fmt.Errorf("unsupported decrypter options %T", opts)
+	}
+	return key.rsaCrypt(false, nil, msg, nil)
+}
+
+// rsaCrypt encrypts or decrypts in with OAEP using method, or with PKCS#1
+// v1.5 padding if method is nil.
+func (key *pKey) rsaCrypt(encrypt bool, method Method, in, label []byte) (
+	[]byte, error) {
+	pkey := key.acquirePKey()
+	if pkey == nil {
+		return nil, keyFreed
+	}
+	defer C.EVP_PKEY_free(pkey)
+	out := make([]byte, C.EVP_PKEY_size(pkey))
+	outlen := C.size_t(len(out))
+	var cencrypt C.int
+	if encrypt {
+		cencrypt = 1
+	}
+	var clabel, cin *C.uchar
+	if len(label) > 0 {
+		clabel = (*C.uchar)(unsafe.Pointer(&label[0]))
+	}
+	if len(in) > 0 {
+		cin = (*C.uchar)(unsafe.Pointer(&in[0]))
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.OUR_EVP_PKEY_rsa_crypt(pkey, cencrypt, method, clabel,
+		C.size_t(len(label)), cin, C.size_t(len(in)), (*C.uchar)(&out[0]),
+		&outlen) != 1 {
+		if !encrypt {
+			// don't give away why decryption failed
+			C.ERR_clear_error()
+			return nil, errors.New("decryption failed")
+		}
+		return nil, errorFromErrorQueue()
+	}
+	return out[:outlen], nil
+}
@@ -0,0 +1,216 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestSignVerify(t *testing.T) {
+	std, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := FromStdlibPrivateKey(std)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashed := sha256.Sum256([]byte("hello"))
+	pss := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}
+
+	sig, err := key.SignDigest(SHA256_Method, hashed[:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rsa.VerifyPKCS1v15(&std.PublicKey, crypto.SHA256, hashed[:],
+		sig); err != nil {
+		t.Fatal(err)
+	}
+	if err := key.VerifyDigest(SHA256_Method, hashed[:], sig, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := key.VerifyDigest(SHA256_Method, hashed[:], sig, pss); err == nil {
+		t.Fatal("expected a PKCS#1 v1.5 signature to fail as PSS")
+	}
+
+	sig, err = key.SignDigest(SHA256_Method, hashed[:], pss)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rsa.VerifyPSS(&std.PublicKey, crypto.SHA256, hashed[:], sig,
+		pss); err != nil {
+		t.Fatal(err)
+	}
+	// the salt length is detected
+	if err := key.VerifyDigest(SHA256_Method, hashed[:], sig,
+		&rsa.PSSOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	sig, err = rsa.SignPSS(rand.Reader, std, crypto.SHA256, hashed[:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := key.VerifyDigest(SHA256_Method, hashed[:], sig,
+		&rsa.PSSOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	sig[0] ^= 1
+	if err := key.VerifyDigest(SHA256_Method, hashed[:], sig,
+		&rsa.PSSOptions{}); err == nil {
+		t.Fatal("expected a corrupted signature to fail")
+	}
+
+	ec_std, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec_key, err := FromStdlibPrivateKey(ec_std)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err = ec_key.SignDigest(SHA256_Method, hashed[:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ecdsa.VerifyASN1(&ec_std.PublicKey, hashed[:], sig) {
+		t.Fatal("expected the ECDSA signature to verify")
+	}
+	if err := ec_key.VerifyDigest(SHA256_Method, hashed[:], sig, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOAEP(t *testing.T) {
+	std, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := FromStdlibPrivateKey(std)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte("attack at dawn")
+	for _, label := range [][]byte{nil, []byte("orders")} {
+		ciphertext, err := key.EncryptOAEP(SHA256_Method, msg, label)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plaintext, err := rsa.DecryptOAEP(sha256.New(), nil, std,
+			ciphertext, label)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(plaintext, msg) {
+			t.Fatal("stdlib decryption mismatch")
+		}
+
+		ciphertext, err = rsa.EncryptOAEP(sha256.New(), rand.Reader,
+			&std.PublicKey, msg, label)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plaintext, err = key.DecryptOAEP(SHA256_Method, ciphertext, label)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(plaintext, msg) {
+			t.Fatal("decryption mismatch")
+		}
+		if _, err := key.DecryptOAEP(SHA256_Method, ciphertext,
+			[]byte("other")); err == nil {
+			t.Fatal("expected the wrong label to fail")
+		}
+	}
+}
+
+func TestPrivateKeyStdlibInterfaces(t *testing.T) {
+	rsa_key := generateTestRSAKey(t)
+	ec_key, err := GenerateECKey(Prime256v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []PrivateKey{rsa_key, ec_key}
+	if ed_key, err := GenerateEd25519Key(); err == nil {
+		keys = append(keys, ed_key)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "signer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	for _, key := range keys {
+		var signer crypto.Signer = key
+		der, err := x509.CreateCertificate(rand.Reader, template, template,
+			signer.Public(), signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cert.CheckSignature(cert.SignatureAlgorithm,
+			cert.RawTBSCertificate, cert.Signature); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var decrypter crypto.Decrypter = rsa_key
+	pub := decrypter.Public().(*rsa.PublicKey)
+	msg := []byte("session key 0123")
+	ciphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, msg,
+		[]byte("label"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := decrypter.Decrypt(nil, ciphertext, &rsa.OAEPOptions{
+		Hash: crypto.SHA256, Label: []byte("label")})
+	if err != nil || !bytes.Equal(plaintext, msg) {
+		t.Fatalf("OAEP decryption mismatch: %v", err)
+	}
+	ciphertext, err = rsa.EncryptPKCS1v15(rand.Reader, pub, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err = decrypter.Decrypt(nil, ciphertext, nil)
+	if err != nil || !bytes.Equal(plaintext, msg) {
+		t.Fatalf("PKCS#1 v1.5 decryption mismatch: %v", err)
+	}
+	plaintext, err = decrypter.Decrypt(nil, ciphertext,
+		&rsa.PKCS1v15DecryptOptions{SessionKeyLen: len(msg)})
+	if err != nil || !bytes.Equal(plaintext, msg) {
+		t.Fatalf("session key decryption mismatch: %v", err)
+	}
+	// a wrong session key length is hidden behind random bytes
+	plaintext, err = decrypter.Decrypt(nil, ciphertext,
+		&rsa.PKCS1v15DecryptOptions{SessionKeyLen: 32})
+	if err != nil || len(plaintext) != 32 {
+		t.Fatalf("expected a random session key, got %x (%v)", plaintext, err)
+	}
+}
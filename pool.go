@@ -0,0 +1,232 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/spacemonkeygo/openssl/utils"
+)
+
+const (
+	// DefaultMaxIdlePerHost is the number of idle connections a Pool keeps
+	// per address when MaxIdlePerHost is zero.
+	DefaultMaxIdlePerHost = 2
+
+	// probeTimeout bounds how long the default health check waits on an idle
+	// connection. A healthy idle connection has nothing to read, so this is
+	// always the cost of a successful check.
+	probeTimeout = time.Millisecond
+)
+
+var (
+	PoolClosed = errors.New("connection pool closed")
+)
+
+// Pool is a dialer that keeps idle client connections around for reuse, for
+// protocols that make many short exchanges with the same servers. The zero
+// value is not usable; set at least Ctx. Exported fields must not be changed
+// once the Pool is in use.
+type Pool struct {
+	// Ctx is the client context connections are dialed with.
+	Ctx *Ctx
+	// Flags are passed to Dial.
+	Flags DialFlags
+	// MaxIdlePerHost is the number of idle connections kept per address.
+	// Zero means DefaultMaxIdlePerHost; negative disables pooling.
+	MaxIdlePerHost int
+	// MaxLifetime, if nonzero, is how long after dialing a connection may
+	// still be handed out.
+	MaxLifetime time.Duration
+	// IdleTimeout, if nonzero, is how long a connection may sit idle before
+	// it is closed instead of reused.
+	IdleTimeout time.Duration
+	// HealthCheck is called on an idle connection before it is reused, and
+	// the connection is discarded if it returns an error. If nil, the
+	// connection is checked for having been closed by the peer or having
+	// unexpected data waiting.
+	HealthCheck func(conn *Conn) error
+
+	mtx    sync.Mutex
+	idle   map[string][]*PooledConn
+	closed bool
+}
+
+// PooledConn is a connection handed out by a Pool. Closing it returns it to
+// the pool rather than closing the underlying connection.
+type PooledConn struct {
+	*Conn
+	pool     *Pool
+	key      string
+	dialed   time.Time
+	idled    time.Time
+	broken   bool
+	released bool
+}
+
+func poolKey(network, addr string) string {
+	return network + " " + addr
+}
+
+// Get returns an idle connection to addr if a healthy one is available, and
+// dials a new one otherwise.
+func (p *Pool) Get(network, addr string) (*PooledConn, error) {
+	key := poolKey(network, addr)
+	for {
+		conn, err := p.takeIdle(key)
+		if err != nil {
+			return nil, err
+		}
+		if conn == nil {
+			break
+		}
+		if p.usable(conn) {
+			conn.released = false
+			return conn, nil
+		}
+		conn.Conn.Close()
+	}
+	conn, err := Dial(network, addr, p.Ctx, p.Flags)
+	if err != nil {
+		return nil, err
+	}
+	return &PooledConn{
+		Conn:   conn,
+		pool:   p,
+		key:    key,
+		dialed: time.Now()}, nil
+}
+
+func (p *Pool) takeIdle(key string) (*PooledConn, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.closed {
+		return nil, PoolClosed
+	}
+	conns := p.idle[key]
+	if len(conns) == 0 {
+		return nil, nil
+	}
+	// most recently used first, so that surplus connections age out
+	conn := conns[len(conns)-1]
+	conns[len(conns)-1] = nil
+	if len(conns) == 1 {
+		delete(p.idle, key)
+	} else {
+		p.idle[key] = conns[:len(conns)-1]
+	}
+	return conn, nil
+}
+
+func (p *Pool) expired(conn *PooledConn, now time.Time) bool {
+	if p.MaxLifetime > 0 && now.Sub(conn.dialed) >= p.MaxLifetime {
+		return true
+	}
+	if p.IdleTimeout > 0 && now.Sub(conn.idled) >= p.IdleTimeout {
+		return true
+	}
+	return false
+}
+
+func (p *Pool) usable(conn *PooledConn) bool {
+	if p.expired(conn, time.Now()) {
+		return false
+	}
+	if p.HealthCheck != nil {
+		return p.HealthCheck(conn.Conn) == nil
+	}
+	return probeIdle(conn.Conn) == nil
+}
+
+// probeIdle checks that nothing is waiting to be read on an idle connection.
+// Post-handshake messages such as TLS 1.3 session tickets are consumed by
+// OpenSSL along the way, so only a closure or stray application data fails.
+func probeIdle(conn *Conn) error {
+	err := conn.SetReadDeadline(time.Now().Add(probeTimeout))
+	if err != nil {
+		return err
+	}
+	var buf [1]byte
+	n, err := conn.Read(buf[:])
+	if n > 0 {
+		return errors.New("unexpected data on idle connection")
+	}
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		if err == nil {
+			err = errors.New("unexpected read result on idle connection")
+		}
+		return err
+	}
+	return conn.SetReadDeadline(time.Time{})
+}
+
+func (p *Pool) put(conn *PooledConn) error {
+	max_idle := p.MaxIdlePerHost
+	if max_idle == 0 {
+		max_idle = DefaultMaxIdlePerHost
+	}
+	now := time.Now()
+	p.mtx.Lock()
+	if p.closed || conn.broken || max_idle < 0 || p.expired(conn, now) ||
+		len(p.idle[conn.key]) >= max_idle {
+		p.mtx.Unlock()
+		return conn.Conn.Close()
+	}
+	conn.idled = now
+	if p.idle == nil {
+		p.idle = make(map[string][]*PooledConn)
+	}
+	p.idle[conn.key] = append(p.idle[conn.key], conn)
+	p.mtx.Unlock()
+	return nil
+}
+
+// Close closes all idle connections. Connections currently handed out are
+// closed as they are released.
+func (p *Pool) Close() error {
+	p.mtx.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.mtx.Unlock()
+	var errs utils.ErrorGroup
+	for _, conns := range idle {
+		for _, conn := range conns {
+			errs.Add(conn.Conn.Close())
+		}
+	}
+	return errs.Finalize()
+}
+
+// Close returns the connection to its pool. It must not be used afterwards.
+func (c *PooledConn) Close() error {
+	if c.released {
+		return nil
+	}
+	c.released = true
+	return c.pool.put(c)
+}
+
+// Discard marks the connection as unusable, for instance after a protocol
+// error left it in an unknown state, so that Close closes it rather than
+// returning it to the pool.
+func (c *PooledConn) Discard() {
+	c.broken = true
+}
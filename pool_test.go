@@ -0,0 +1,139 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"bufio"
+	"io"
+	"testing"
+	"time"
+)
+
+// lineServer answers each line with the same line, and hangs up on "bye".
+func lineServer(t *testing.T) (addr string, accepted chan struct{},
+	cleanup func()) {
+	l, err := Listen("tcp", "localhost:0", newTestServerCtx(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted = make(chan struct{}, 16)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- struct{}{}
+			go func() {
+				defer c.Close()
+				r := bufio.NewReader(c)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil || line == "bye\n" {
+						return
+					}
+					if _, err := io.WriteString(c, line); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), accepted, func() { l.Close() }
+}
+
+func poolRoundTrip(t *testing.T, pool *Pool, addr, line string) *Conn {
+	conn, err := pool.Get("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, line); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != line {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+	return conn.Conn
+}
+
+func TestPoolReusesConnections(t *testing.T) {
+	addr, accepted, cleanup := lineServer(t)
+	defer cleanup()
+	ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := &Pool{Ctx: ctx, Flags: InsecureSkipHostVerification}
+	defer pool.Close()
+
+	first := poolRoundTrip(t, pool, addr, "one\n")
+	if second := poolRoundTrip(t, pool, addr, "two\n"); second != first {
+		t.Fatal("expected the idle connection to be reused")
+	}
+	if len(accepted) != 1 {
+		t.Fatalf("expected a single connection, got %d", len(accepted))
+	}
+
+	// have the server hang up on the pooled connection
+	conn, err := pool.Get("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(conn, "bye\n"); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	time.Sleep(50 * time.Millisecond)
+	if third := poolRoundTrip(t, pool, addr, "three\n"); third == first {
+		t.Fatal("expected the closed connection to be replaced")
+	}
+	if len(accepted) != 2 {
+		t.Fatalf("expected a second connection, got %d", len(accepted))
+	}
+}
+
+func TestPoolMaxLifetime(t *testing.T) {
+	addr, accepted, cleanup := lineServer(t)
+	defer cleanup()
+	ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := &Pool{
+		Ctx:         ctx,
+		Flags:       InsecureSkipHostVerification,
+		MaxLifetime: 20 * time.Millisecond}
+	defer pool.Close()
+
+	first := poolRoundTrip(t, pool, addr, "one\n")
+	time.Sleep(30 * time.Millisecond)
+	if second := poolRoundTrip(t, pool, addr, "two\n"); second == first {
+		t.Fatal("expected the expired connection to be replaced")
+	}
+	if len(accepted) != 2 {
+		t.Fatalf("expected two connections, got %d", len(accepted))
+	}
+	pool.Close()
+	if _, err := pool.Get("tcp", addr); err != PoolClosed {
+		t.Fatalf("expected PoolClosed, got %v", err)
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <stdlib.h>
+#include <openssl/err.h>
+#include <openssl/ssl.h>
+
+#if defined(OPENSSL_IS_BORINGSSL) || (OPENSSL_VERSION_NUMBER >= 0x30000000L \
+    && !defined(LIBRESSL_VERSION_NUMBER))
+#define HAVE_GROUP_NAME 1
+#endif
+
+// tries list on a connection from ctx, so that groups from the providers
+// loaded into ctx's library context are known, returning -1 before OpenSSL
+// 1.0.2
+static int OUR_groups_list_supported(SSL_CTX *ctx, const char *list) {
+#if OPENSSL_VERSION_NUMBER >= 0x10002000L
+    int rc;
+    SSL *ssl = SSL_new(ctx);
+    if (ssl == NULL)
+        return 0;
+#if OPENSSL_VERSION_NUMBER >= 0x10101000L
+    rc = SSL_set1_groups_list(ssl, list);
+#else
+    rc = SSL_set1_curves_list(ssl, list);
+#endif
+    SSL_free(ssl);
+    ERR_clear_error();
+    return rc == 1;
+#else
+    return -1;
+#endif
+}
+
+// returns -1 if the negotiated group can't be told, and 0 if there is none
+static int OUR_SSL_get_group_name(SSL *ssl, const char **name) {
+#if !defined(HAVE_GROUP_NAME)
+    return -1;
+#elif defined(OPENSSL_IS_BORINGSSL)
+    *name = SSL_get_curve_name(SSL_get_curve_id(ssl));
+    return *name != NULL;
+#elif OPENSSL_VERSION_NUMBER >= 0x30200000L
+    *name = SSL_get0_group_name(ssl);
+    return *name != NULL;
+#else
+    int id;
+    // 3.0 and 3.1 look at the session, which clients lack at first
+    if (SSL_get_session(ssl) == NULL)
+        return 0;
+    id = SSL_get_negotiated_group(ssl);
+    if (id == 0)
+        return 0;
+    *name = SSL_group_to_name(ssl, id);
+    return *name != NULL;
+#endif
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"runtime"
+	"strings"
+	"unsafe"
+)
+
+// Post-quantum key exchange groups, as named by OpenSSL 3.5 and newer, which
+// has ML-KEM built in, and by recent releases of oqs-provider. The hybrids
+// combine ML-KEM with a classical exchange, so that the connection stays as
+// safe as the classical exchange alone should ML-KEM be broken.
+const (
+	GroupX25519MLKEM768     = "X25519MLKEM768"
+	GroupSecP256r1MLKEM768  = "SecP256r1MLKEM768"
+	GroupSecP384r1MLKEM1024 = "SecP384r1MLKEM1024"
+	GroupMLKEM768           = "MLKEM768"
+	GroupMLKEM1024          = "MLKEM1024"
+)
+
+// GroupSupported reports whether the key exchange group name, such as
+// GroupX25519MLKEM768 or "P-256", can be offered by connections from the
+// context. Groups supplied by providers, such as oqs-provider, are only
+// known once the provider is loaded, see LoadProvider.
+func (c *Ctx) GroupSupported(name string) bool {
+	if name == "" || strings.ContainsAny(name, ":, ") {
+		return false
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	cstr := C.CString(name)
+	defer C.free(unsafe.Pointer(cstr))
+	return C.OUR_groups_list_supported(c.ctx, cstr) == 1
+}
+
+// SetPreferredGroups offers the key exchange groups, in order of
+// preference, that the linked OpenSSL supports, skipping the rest, and
+// returns those offered. This lets post-quantum hybrids lead the list and
+// fall back to classical groups where they are unavailable, e.g.
+//
+//	ctx.SetPreferredGroups(GroupX25519MLKEM768, "X25519", "P-256")
+//
+// It fails if none of the groups are supported. See SetCurvesList, which
+// fails on any unknown group instead.
+func (c *Ctx) SetPreferredGroups(groups ...string) ([]string, error) {
+	var supported []string
+	for _, group := range groups {
+		if c.GroupSupported(group) {
+			supported = append(supported, group)
+		}
+	}
+	if len(supported) == 0 {
+		return nil, errors.New("none of the key exchange groups are " +
+			"supported")
+	}
+	if err := c.SetCurvesList(strings.Join(supported, ":")); err != nil {
+		return nil, err
+	}
+	return supported, nil
+}
+
+// NegotiatedGroup returns the name of the key exchange group the handshake
+// settled on, e.g. "x25519" or "X25519MLKEM768", as OpenSSL spells it. It
+// requires OpenSSL 3.0 or newer, or BoringSSL.
+func (c *Conn) NegotiatedGroup() (string, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	var name *C.char
+	switch C.OUR_SSL_get_group_name(c.ssl, &name) {
+	case 1:
+		return C.GoString(name), nil
+	case -1:
+		return "", errors.New("telling the negotiated group requires " +
+			"OpenSSL 3.0 or newer, or BoringSSL")
+	default:
+		return "", errors.New("no key exchange group negotiated")
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPreferredGroups(t *testing.T) {
+	server_ctx := newTestServerCtx(t)
+	client_ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !client_ctx.GroupSupported("X25519") {
+		t.Skip("X25519 is not supported")
+	}
+	if client_ctx.GroupSupported("no-such-group") ||
+		client_ctx.GroupSupported("X25519:P-256") {
+		t.Fatal("expected unknown groups to be unsupported")
+	}
+	if _, err := client_ctx.SetPreferredGroups("no-such-group"); err == nil {
+		t.Fatal("expected an error without supported groups")
+	}
+	groups, err := client_ctx.SetPreferredGroups(GroupX25519MLKEM768,
+		"no-such-group", "X25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "X25519"
+	if client_ctx.GroupSupported(GroupX25519MLKEM768) {
+		expected = GroupX25519MLKEM768
+		if len(groups) != 2 || groups[0] != GroupX25519MLKEM768 {
+			t.Fatalf("unexpected groups %v", groups)
+		}
+	} else if len(groups) != 1 || groups[0] != "X25519" {
+		t.Fatalf("unexpected groups %v", groups)
+	}
+	if _, err := server_ctx.SetPreferredGroups(groups...); err != nil {
+		t.Fatal(err)
+	}
+
+	server_conn, client_conn := NetPipe(t)
+	defer server_conn.Close()
+	defer client_conn.Close()
+	server, err := Server(server_conn, server_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := Client(client_conn, client_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.NegotiatedGroup(); err == nil {
+		t.Fatal("expected no group before the handshake")
+	} else if strings.Contains(err.Error(), "requires") {
+		t.Skip(err)
+	}
+	errs := make(chan error, 1)
+	go func() { errs <- server.Handshake() }()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	for _, conn := range []*Conn{client, server} {
+		group, err := conn.NegotiatedGroup()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.EqualFold(group, expected) {
+			t.Fatalf("expected group %s, got %s", expected, group)
+		}
+	}
+}
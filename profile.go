@@ -0,0 +1,187 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <stdlib.h>
+#include <openssl/ssl.h>
+
+int OUR_SSL_CTX_set_ciphersuites(SSL_CTX *ctx, const char *str) {
+// BoringSSL's TLS 1.3 cipher suites are fixed
+#if OPENSSL_VERSION_NUMBER >= 0x10101000L && !defined(OPENSSL_IS_BORINGSSL)
+    return SSL_CTX_set_ciphersuites(ctx, str);
+#else
+    return -1;
+#endif
+}
+
+int OUR_SSL_CTX_set1_groups_list(SSL_CTX *ctx, char *list) {
+#if OPENSSL_VERSION_NUMBER >= 0x10101000L
+    return SSL_CTX_set1_groups_list(ctx, list);
+#elif OPENSSL_VERSION_NUMBER >= 0x10002000L
+    return SSL_CTX_set1_curves_list(ctx, list);
+#else
+    return -1;
+#endif
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"runtime"
+	"unsafe"
+)
+
+// Profile is one of the server side TLS configurations recommended by
+// Mozilla, see https://wiki.mozilla.org/Security/Server_Side_TLS
+type Profile int
+
+const (
+	// Modern allows only TLS 1.3, for services whose clients are all recent.
+	// It requires OpenSSL 1.1.1 or newer.
+	Modern Profile = iota
+	// Intermediate allows TLS 1.2 and 1.3 with forward secret AEAD ciphers,
+	// and is the recommended choice for general purpose servers.
+	Intermediate
+	// Old allows TLS 1.0 and newer with legacy ciphers, for services that
+	// must support very old clients. It lowers the OpenSSL security level as
+	// needed.
+	Old
+)
+
+const (
+	mozillaCipherSuites = "TLS_AES_128_GCM_SHA256:TLS_AES_256_GCM_SHA384:" +
+		"TLS_CHACHA20_POLY1305_SHA256"
+	mozillaGroups = "X25519:prime256v1:secp384r1"
+
+	mozillaIntermediateCiphers = "ECDHE-ECDSA-AES128-GCM-SHA256:" +
+		"ECDHE-RSA-AES128-GCM-SHA256:ECDHE-ECDSA-AES256-GCM-SHA384:" +
+		"ECDHE-RSA-AES256-GCM-SHA384:ECDHE-ECDSA-CHACHA20-POLY1305:" +
+		"ECDHE-RSA-CHACHA20-POLY1305:DHE-RSA-AES128-GCM-SHA256:" +
+		"DHE-RSA-AES256-GCM-SHA384:DHE-RSA-CHACHA20-POLY1305"
+
+	mozillaOldCiphers = mozillaIntermediateCiphers + ":" +
+		"ECDHE-ECDSA-AES128-SHA256:ECDHE-RSA-AES128-SHA256:" +
+		"ECDHE-ECDSA-AES128-SHA:ECDHE-RSA-AES128-SHA:" +
+		"ECDHE-ECDSA-AES256-SHA384:ECDHE-RSA-AES256-SHA384:" +
+		"ECDHE-ECDSA-AES256-SHA:ECDHE-RSA-AES256-SHA:" +
+		"DHE-RSA-AES128-SHA256:DHE-RSA-AES256-SHA256:" +
+		"AES128-GCM-SHA256:AES256-GCM-SHA384:AES128-SHA256:AES256-SHA256:" +
+		"AES128-SHA:AES256-SHA:DES-CBC3-SHA"
+)
+
+// NewCtxWithProfile creates a context configured according to one of
+// Mozilla's server side TLS recommendations: protocol versions, ciphers,
+// key exchange groups and cipher preference. Certificates and keys are left
+// for the caller to configure.
+func NewCtxWithProfile(profile Profile) (*Ctx, error) {
+	c, err := NewCtx()
+	if err != nil {
+		return nil, err
+	}
+	err = c.applyProfile(profile)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewCtxSecure creates a context with conservative defaults, for callers that
+// would rather opt out of protections than into them. It starts from the
+// Intermediate profile, which rules out SSLv3, TLS 1.0 and 1.1, compression
+// and weak ciphers, and additionally prefers the server's cipher order,
+// refuses renegotiation (see DisableRenegotiation) and trusts the system's
+// default certificate authorities.
+//
+// Client connections using the context always verify the server's
+// certificate chain; the verify mode only controls whether servers ask for
+// client certificates. Hostnames are checked by Dial, or by calling
+// Conn.VerifyHostname.
+func NewCtxSecure() (*Ctx, error) {
+	c, err := NewCtxWithProfile(Intermediate)
+	if err != nil {
+		return nil, err
+	}
+	c.SetOptions(CipherServerPreference | NoCompression)
+	c.DisableRenegotiation()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.SSL_CTX_set_default_verify_paths(c.ctx) != 1 {
+		return nil, errorFromErrorQueue()
+	}
+	c.verify_servers = true
+	return c, nil
+}
+
+func (c *Ctx) applyProfile(profile Profile) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	tls13_supported := NoTLSv1_3 != 0
+
+	var ciphers string
+	switch profile {
+	case Modern:
+		if !tls13_supported {
+			return tls13Unsupported
+		}
+		c.SetOptions(NoTLSv1 | NoTLSv1_1 | NoTLSv1_2)
+		c.ClearOptions(NoTLSv1_3 | CipherServerPreference)
+	case Intermediate:
+		ciphers = mozillaIntermediateCiphers
+		c.SetOptions(NoTLSv1 | NoTLSv1_1)
+		c.ClearOptions(NoTLSv1_2 | NoTLSv1_3 | CipherServerPreference)
+	case Old:
+		ciphers = mozillaOldCiphers
+		c.ClearOptions(NoTLSv1 | NoTLSv1_1 | NoTLSv1_2 | NoTLSv1_3)
+		c.SetOptions(CipherServerPreference)
+		// SHA-1 signatures, needed before TLS 1.2, are refused at level 1
+		c.SetSecurityLevel(0)
+	default:
+		return errors.New("unknown TLS profile")
+	}
+	c.SetOptions(NoSSLv2 | NoSSLv3 | NoCompression)
+
+	if ciphers != "" {
+		if err := c.SetCipherList(ciphers); err != nil {
+			return err
+		}
+	}
+	if tls13_supported {
+		cstr := C.CString(mozillaCipherSuites)
+		defer C.free(unsafe.Pointer(cstr))
+		if C.OUR_SSL_CTX_set_ciphersuites(c.ctx, cstr) != 1 {
+			return errorFromErrorQueue()
+		}
+	}
+	cstr := C.CString(mozillaGroups)
+	defer C.free(unsafe.Pointer(cstr))
+	switch C.OUR_SSL_CTX_set1_groups_list(c.ctx, cstr) {
+	case 1:
+	case -1:
+		// too old to configure groups by name; fall back to P-256 alone
+		if err := c.SetEllipticCurve(Prime256v1); err != nil {
+			return err
+		}
+	default:
+		return errorFromErrorQueue()
+	}
+	// DHE ciphers are offered, so use parameters matching the certificate
+	// where the library can pick them
+	c.SetDHAuto(true)
+	return nil
+}
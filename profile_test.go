@@ -0,0 +1,173 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+// profileHandshake handshakes a stdlib client limited to the given versions
+// with a server using profile, returning the negotiated state.
+func profileHandshake(t *testing.T, profile Profile, min_version,
+	max_version uint16) (tls.ConnectionState, error) {
+	ctx, err := NewCtxWithProfile(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useTestCertificate(t, ctx)
+
+	server_conn, client_conn := NetPipe(t)
+	defer server_conn.Close()
+	defer client_conn.Close()
+	server, err := Server(server_conn, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		server.Handshake()
+		server.Close()
+	}()
+	client := tls.Client(client_conn, &tls.Config{
+		InsecureSkipVerify: true,
+		MinVersion:         min_version,
+		MaxVersion:         max_version})
+	err = client.Handshake()
+	return client.ConnectionState(), err
+}
+
+func TestProfileModern(t *testing.T) {
+	state, err := profileHandshake(t, Modern, tls.VersionTLS12,
+		tls.VersionTLS13)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Version != tls.VersionTLS13 {
+		t.Fatalf("unexpected version %x", state.Version)
+	}
+	if _, err := profileHandshake(t, Modern, tls.VersionTLS12,
+		tls.VersionTLS12); err == nil {
+		t.Fatal("expected TLS 1.2 to be refused")
+	}
+}
+
+func TestProfileIntermediate(t *testing.T) {
+	state, err := profileHandshake(t, Intermediate, tls.VersionTLS12,
+		tls.VersionTLS12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.CipherSuite != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 &&
+		state.CipherSuite != tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384 &&
+		state.CipherSuite != tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305 {
+		t.Fatalf("unexpected cipher suite %s",
+			tls.CipherSuiteName(state.CipherSuite))
+	}
+	if _, err := profileHandshake(t, Intermediate, tls.VersionTLS10,
+		tls.VersionTLS11); err == nil {
+		t.Fatal("expected TLS 1.1 to be refused")
+	}
+}
+
+func TestProfileOld(t *testing.T) {
+	state, err := profileHandshake(t, Old, tls.VersionTLS10,
+		tls.VersionTLS10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Version != tls.VersionTLS10 {
+		t.Fatalf("unexpected version %x", state.Version)
+	}
+}
+
+func TestNewCtxSecure(t *testing.T) {
+	key := generateTestRSAKey(t)
+	cert := issueTestCert(t, key, testCert{})
+	server_ctx, err := NewCtxSecure()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server_ctx.UsePrivateKey(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := server_ctx.UseCertificate(cert); err != nil {
+		t.Fatal(err)
+	}
+
+	handshake := func(client_ctx *Ctx) error {
+		server_conn, client_conn := NetPipe(t)
+		defer server_conn.Close()
+		defer client_conn.Close()
+		server, err := Server(server_conn, server_ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			server.Handshake()
+			server.Close()
+		}()
+		client, err := Client(client_conn, client_ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		return client.Handshake()
+	}
+
+	// the certificate is self-signed, so it must be trusted explicitly
+	client_ctx, err := NewCtxSecure()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake(client_ctx); err == nil {
+		t.Fatal("expected an untrusted server certificate to be refused")
+	}
+	if err := client_ctx.GetCertificateStore().AddCertificate(
+		cert); err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake(client_ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// servers do not ask for client certificates
+	server_conn, client_conn := NetPipe(t)
+	defer server_conn.Close()
+	defer client_conn.Close()
+	server, err := Server(server_conn, server_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		server.Handshake()
+		server.Close()
+	}()
+	asked := false
+	client := tls.Client(client_conn, &tls.Config{
+		InsecureSkipVerify: true,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (
+			*tls.Certificate, error) {
+			asked = true
+			return &tls.Certificate{}, nil
+		}})
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if asked {
+		t.Fatal("expected no client certificate request")
+	}
+}
@@ -0,0 +1,356 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <stdlib.h>
+#include <openssl/evp.h>
+#if OPENSSL_VERSION_NUMBER >= 0x30000000L
+#include <openssl/provider.h>
+#else
+typedef struct ossl_provider_st OSSL_PROVIDER;
+#endif
+
+static int OUR_providers_supported() {
+    return OPENSSL_VERSION_NUMBER >= 0x30000000L;
+}
+
+static OSSL_PROVIDER *OUR_OSSL_PROVIDER_load(const char *name,
+        int retain_fallbacks) {
+#if OPENSSL_VERSION_NUMBER >= 0x30000000L
+    return OSSL_PROVIDER_try_load(NULL, name, retain_fallbacks);
+#else
+    return NULL;
+#endif
+}
+
+static int OUR_OSSL_PROVIDER_unload(OSSL_PROVIDER *prov) {
+#if OPENSSL_VERSION_NUMBER >= 0x30000000L
+    return OSSL_PROVIDER_unload(prov);
+#else
+    return 0;
+#endif
+}
+
+static int OUR_OSSL_PROVIDER_available(const char *name) {
+#if OPENSSL_VERSION_NUMBER >= 0x30000000L
+    return OSSL_PROVIDER_available(NULL, name);
+#else
+    return 0;
+#endif
+}
+
+static int OUR_OSSL_PROVIDER_set_default_search_path(const char *path) {
+#if OPENSSL_VERSION_NUMBER >= 0x30000000L
+    return OSSL_PROVIDER_set_default_search_path(NULL, path);
+#else
+    return 0;
+#endif
+}
+
+static int OUR_EVP_set_default_properties(const char *propq) {
+#if OPENSSL_VERSION_NUMBER >= 0x30000000L
+    return EVP_set_default_properties(NULL, propq);
+#else
+    return 0;
+#endif
+}
+
+static const EVP_CIPHER *OUR_EVP_CIPHER_fetch(const char *name,
+        const char *propq) {
+#if OPENSSL_VERSION_NUMBER >= 0x30000000L
+    return EVP_CIPHER_fetch(NULL, name, propq);
+#else
+    return NULL;
+#endif
+}
+
+static const EVP_MD *OUR_EVP_MD_fetch(const char *name, const char *propq) {
+#if OPENSSL_VERSION_NUMBER >= 0x30000000L
+    return EVP_MD_fetch(NULL, name, propq);
+#else
+    return NULL;
+#endif
+}
+
+// the provider's name, or NULL for ciphers and digests built in before 3.0
+// or found without fetching
+static const char *OUR_EVP_CIPHER_provider_name(const EVP_CIPHER *cipher) {
+#if OPENSSL_VERSION_NUMBER >= 0x30000000L
+    const OSSL_PROVIDER *prov = EVP_CIPHER_get0_provider(cipher);
+    return prov == NULL ? NULL : OSSL_PROVIDER_get0_name(prov);
+#else
+    return NULL;
+#endif
+}
+
+static const char *OUR_EVP_MD_provider_name(const EVP_MD *md) {
+#if OPENSSL_VERSION_NUMBER >= 0x30000000L
+    const OSSL_PROVIDER *prov = EVP_MD_get0_provider(md);
+    return prov == NULL ? NULL : OSSL_PROVIDER_get0_name(prov);
+#else
+    return NULL;
+#endif
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"unsafe"
+)
+
+var (
+	providersSupported   = C.OUR_providers_supported() == 1
+	providersUnsupported = errors.New("providers require OpenSSL 3.0 or " +
+		"newer")
+)
+
+// Provider is an OpenSSL 3.0 provider loaded with LoadProvider, a module
+// supplying implementations of algorithms. The default provider has the
+// usual ones, legacy has old ciphers and digests such as RC4, DES, Blowfish
+// and MD4, which some older key formats encrypt with, and fips has the FIPS
+// 140 validated ones; others may come from third parties.
+type Provider struct {
+	p    *C.OSSL_PROVIDER
+	name string
+}
+
+// LoadProvider loads the provider called name, either one built in or a
+// module in the provider search path, see SetProviderSearchPath. Loading a
+// provider explicitly keeps OpenSSL from loading the default provider on
+// first use, so load "default" too, unless the point is to replace it.
+// Providers stay loaded until unloaded with Unload, which loading one twice
+// takes twice.
+func LoadProvider(name string) (*Provider, error) {
+	return loadProvider(name, false)
+}
+
+// loadProvider loads the provider called name, leaving OpenSSL free to load
+// the default provider on first use if retain_fallbacks is set.
+func loadProvider(name string, retain_fallbacks bool) (*Provider, error) {
+	if !providersSupported {
+		return nil, providersUnsupported
+	}
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	retain := C.int(0)
+	if retain_fallbacks {
+		retain = 1
+	}
+	p := C.OUR_OSSL_PROVIDER_load(cname, retain)
+	if p == nil {
+		return nil, errorFromErrorQueue()
+	}
+	return &Provider{p: p, name: name}, nil
+}
+
+// Name returns the name the provider was loaded by.
+func (p *Provider) Name() string {
+	return p.name
+}
+
+// Unload undoes LoadProvider. The provider must not be used afterwards.
+func (p *Provider) Unload() error {
+	if p.p == nil {
+		return fmt.Errorf("provider %s already unloaded", p.name)
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.OUR_OSSL_PROVIDER_unload(p.p) != 1 {
+		return errorFromErrorQueue()
+	}
+	p.p = nil
+	return nil
+}
+
+// ProviderAvailable reports whether the provider called name is loaded, or
+// could be loaded on first use, as the default provider is.
+func ProviderAvailable(name string) bool {
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	return C.OUR_OSSL_PROVIDER_available(cname) == 1
+}
+
+// SetProviderSearchPath sets the directory LoadProvider looks for provider
+// modules in, in place of the one OpenSSL was built with or the
+// OPENSSL_MODULES environment variable.
+func SetProviderSearchPath(path string) error {
+	if !providersSupported {
+		return providersUnsupported
+	}
+	cpath := C.CString(path)
+	defer C.free(unsafe.Pointer(cpath))
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.OUR_OSSL_PROVIDER_set_default_search_path(cpath) != 1 {
+		return errorFromErrorQueue()
+	}
+	return nil
+}
+
+var (
+	legacy_mtx       sync.Mutex
+	legacy_providers []*Provider
+)
+
+// EnableLegacyProvider loads the legacy provider, alongside the default one,
+// so that the old ciphers and digests OpenSSL 3.0 moved there, and the key
+// formats encrypted with them, keep working. It does nothing if they are
+// already loaded by it.
+func EnableLegacyProvider() error {
+	legacy_mtx.Lock()
+	defer legacy_mtx.Unlock()
+	if legacy_providers != nil {
+		return nil
+	}
+	loaded, err := loadProviders("legacy", "default")
+	if err != nil {
+		return err
+	}
+	legacy_providers = loaded
+	return nil
+}
+
+// loadProviders loads the providers called names, or none of them. OpenSSL
+// 3.0 stops loading the default provider on first use even when a load
+// fails, so they're loaded keeping that fallback, and callers name "default"
+// last, as unloading it again would leave no provider at all.
+func loadProviders(names ...string) ([]*Provider, error) {
+	var loaded []*Provider
+	for _, name := range names {
+		p, err := loadProvider(name, true)
+		if err != nil {
+			for _, p := range loaded {
+				p.Unload()
+			}
+			return nil, err
+		}
+		loaded = append(loaded, p)
+	}
+	return loaded, nil
+}
+
+// SetDefaultProperties sets the property query OpenSSL 3.0 fetches
+// algorithms with when not given one, e.g. "provider=default" or
+// "?provider=legacy", process wide. NewCtxWithProperties, FetchCipher and
+// FetchDigest take queries of their own.
+func SetDefaultProperties(propq string) error {
+	if !providersSupported {
+		return providersUnsupported
+	}
+	cpropq := C.CString(propq)
+	defer C.free(unsafe.Pointer(cpropq))
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.OUR_EVP_set_default_properties(cpropq) != 1 {
+		return errorFromErrorQueue()
+	}
+	return nil
+}
+
+type fetchKey struct {
+	name  string
+	propq string
+}
+
+// fetched ciphers and digests are kept for the life of the process, so that
+// Cipher and Method needn't be freed
+var (
+	fetch_mtx       sync.Mutex
+	fetched_ciphers = map[fetchKey]*C.EVP_CIPHER{}
+	fetched_digests = map[fetchKey]*C.EVP_MD{}
+)
+
+// FetchCipher finds the cipher called name in the loaded providers, picking
+// between implementations with the property query propq, e.g.
+// "provider=legacy", or the default properties if empty. See
+// GetCipherByName for OpenSSL before 3.0.
+func FetchCipher(name, propq string) (*Cipher, error) {
+	if !providersSupported {
+		return nil, providersUnsupported
+	}
+	fetch_mtx.Lock()
+	defer fetch_mtx.Unlock()
+	key := fetchKey{name: name, propq: propq}
+	if cipher, ok := fetched_ciphers[key]; ok {
+		return &Cipher{ptr: cipher}, nil
+	}
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	var cpropq *C.char
+	if propq != "" {
+		cpropq = C.CString(propq)
+		defer C.free(unsafe.Pointer(cpropq))
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	cipher := C.OUR_EVP_CIPHER_fetch(cname, cpropq)
+	if cipher == nil {
+		return nil, fmt.Errorf("cipher %s not found: %s", name,
+			errorFromErrorQueue())
+	}
+	fetched_ciphers[key] = cipher
+	return &Cipher{ptr: cipher}, nil
+}
+
+// FetchDigest finds the digest called name in the loaded providers, as
+// FetchCipher does ciphers.
+func FetchDigest(name, propq string) (Method, error) {
+	if !providersSupported {
+		return nil, providersUnsupported
+	}
+	fetch_mtx.Lock()
+	defer fetch_mtx.Unlock()
+	key := fetchKey{name: name, propq: propq}
+	if md, ok := fetched_digests[key]; ok {
+		return md, nil
+	}
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	var cpropq *C.char
+	if propq != "" {
+		cpropq = C.CString(propq)
+		defer C.free(unsafe.Pointer(cpropq))
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	md := C.OUR_EVP_MD_fetch(cname, cpropq)
+	if md == nil {
+		return nil, fmt.Errorf("digest %s not found: %s", name,
+			errorFromErrorQueue())
+	}
+	fetched_digests[key] = md
+	return md, nil
+}
+
+// Provider returns the name of the provider implementing the cipher, or ""
+// if it wasn't fetched from one, as ciphers from GetCipherByName aren't.
+func (c *Cipher) Provider() string {
+	return C.GoString(C.OUR_EVP_CIPHER_provider_name(c.ptr))
+}
+
+// DigestProvider returns the name of the provider implementing the digest,
+// as Cipher.Provider does.
+func DigestProvider(md Method) string {
+	return C.GoString(C.OUR_EVP_MD_provider_name(md))
+}
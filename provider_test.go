@@ -0,0 +1,118 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+)
+
+func TestProviders(t *testing.T) {
+	if !providersSupported {
+		if _, err := LoadProvider("default"); err == nil {
+			t.Fatal("expected an error loading a provider")
+		}
+		t.Skip(providersUnsupported)
+	}
+	if !ProviderAvailable("default") {
+		t.Fatal("expected the default provider to be available")
+	}
+	if _, err := LoadProvider("nonexistent"); err == nil {
+		t.Fatal("expected an error loading a missing provider")
+	}
+	p, err := LoadProvider("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Name() != "default" {
+		t.Fatalf("expected default, got %q", p.Name())
+	}
+	if err := p.Unload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Unload(); err == nil {
+		t.Fatal("expected an error unloading twice")
+	}
+
+	cipher, err := FetchCipher("AES-128-CBC", "provider=default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cipher.Provider() != "default" || cipher.KeySize() != 16 {
+		t.Fatalf("unexpected cipher from %q with key size %d",
+			cipher.Provider(), cipher.KeySize())
+	}
+	md, err := FetchDigest("SHA256", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if DigestProvider(md) != "default" {
+		t.Fatalf("expected the default provider, got %q", DigestProvider(md))
+	}
+	h, err := NewDigest(md)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Write([]byte("hello"))
+	expected := sha256.Sum256([]byte("hello"))
+	if !bytes.Equal(h.Sum(nil), expected[:]) {
+		t.Fatal("SHA256 digest mismatch")
+	}
+	if _, err := FetchDigest("SHA256", "provider=nonexistent"); err == nil {
+		t.Fatal("expected an error fetching from a missing provider")
+	}
+
+	ctx, err := NewCtxWithProperties("provider=default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ctx.CipherSuites()) == 0 {
+		t.Fatal("expected cipher suites")
+	}
+}
+
+func TestLegacyProvider(t *testing.T) {
+	if !providersSupported {
+		t.Skip(providersUnsupported)
+	}
+	if err := EnableLegacyProvider(); err != nil {
+		t.Skip(err)
+	}
+	cipher, err := FetchCipher("BF-CBC", "provider=legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cipher.Provider() != "legacy" {
+		t.Fatalf("expected the legacy provider, got %q", cipher.Provider())
+	}
+	// the default provider stays in use
+	if _, err := FetchCipher("AES-256-GCM", "provider=default"); err != nil {
+		t.Fatal(err)
+	}
+	providers, err := ListProviders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, name := range providers {
+		found = found || name == "legacy"
+	}
+	if !found {
+		t.Fatalf("expected legacy among %v", providers)
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include <string.h>
+#include <openssl/evp.h>
+#include <openssl/ssl.h>
+#include "_cgo_export.h"
+
+#ifndef OPENSSL_NO_PSK
+
+static unsigned int psk_client_cb(SSL *ssl, const char *hint,
+		char *identity, unsigned int max_identity_len, unsigned char *psk,
+		unsigned int max_psk_len) {
+	return psk_client_cb_thunk(
+		SSL_CTX_get_ex_data(SSL_get_SSL_CTX(ssl), get_ssl_ctx_idx()),
+		(char *)hint, identity, max_identity_len, psk, max_psk_len);
+}
+
+static unsigned int psk_server_cb(SSL *ssl, const char *identity,
+		unsigned char *psk, unsigned int max_psk_len) {
+	return psk_server_cb_thunk(
+		SSL_CTX_get_ex_data(SSL_get_SSL_CTX(ssl), get_ssl_ctx_idx()),
+		SSL_get_ex_data(ssl, get_ssl_idx()), (char *)identity, psk,
+		max_psk_len);
+}
+
+#if OPENSSL_VERSION_NUMBER >= 0x10101000L
+
+// TLS 1.3 resumes a session made up from the key instead
+
+static int psk_identity_idx = -1;
+
+static void psk_identity_free(void *parent, void *ptr, CRYPTO_EX_DATA *ad,
+		int idx, long argl, void *argp) {
+	OPENSSL_free(ptr);
+}
+
+static SSL_SESSION *psk_session(SSL *ssl, const EVP_MD *md,
+		const unsigned char *psk, size_t psk_len) {
+	// the cipher only has to share its hash with the one negotiated
+	static const unsigned char aes128gcmsha256[] = { 0x13, 0x01 };
+	static const unsigned char aes256gcmsha384[] = { 0x13, 0x02 };
+	const SSL_CIPHER *cipher;
+	SSL_SESSION *sess;
+	if (md != NULL && EVP_MD_type(md) == NID_sha384)
+		cipher = SSL_CIPHER_find(ssl, aes256gcmsha384);
+	else
+		cipher = SSL_CIPHER_find(ssl, aes128gcmsha256);
+	if (cipher == NULL)
+		return NULL;
+	sess = SSL_SESSION_new();
+	if (sess == NULL)
+		return NULL;
+	if (!SSL_SESSION_set1_master_key(sess, psk, psk_len) ||
+			!SSL_SESSION_set_cipher(sess, cipher) ||
+			!SSL_SESSION_set_protocol_version(sess, TLS1_3_VERSION)) {
+		SSL_SESSION_free(sess);
+		return NULL;
+	}
+	return sess;
+}
+
+static int psk_use_session_cb(SSL *ssl, const EVP_MD *md,
+		const unsigned char **id, size_t *idlen, SSL_SESSION **sess) {
+	unsigned char psk[PSK_MAX_PSK_LEN];
+	char *identity;
+	unsigned int psk_len;
+	*sess = NULL;
+	// OpenSSL copies the identity after we return, so it lives with ssl
+	identity = OPENSSL_zalloc(PSK_MAX_IDENTITY_LEN + 1);
+	if (identity == NULL)
+		return 0;
+	OPENSSL_free(SSL_get_ex_data(ssl, psk_identity_idx));
+	if (
+			!SSL_set_ex_data(ssl, psk_identity_idx, identity)) {
+		OPENSSL_free(identity);
+		return 0;
+	}
+	psk_len = psk_client_cb_thunk(
+		SSL_CTX_get_ex_data(SSL_get_SSL_CTX(ssl), get_ssl_ctx_idx()),
+		NULL, identity, PSK_MAX_IDENTITY_LEN + 1, psk, sizeof(psk));
+	if (psk_len == 0)
+		// carry on without PSK
+		return 1;
+	*sess = psk_session(ssl, md, psk, psk_len);
+	OPENSSL_cleanse(psk, sizeof(psk));
+	if (*sess == NULL)
+		return 0;
+	*id = (unsigned char *)identity;
+	*idlen = strlen(identity);
+	return 1;
+}
+
+static int psk_find_session_cb(SSL *ssl, const unsigned char *identity,
+		size_t identity_len, SSL_SESSION **sess) {
+	unsigned char psk[PSK_MAX_PSK_LEN];
+	char id[PSK_MAX_IDENTITY_LEN + 1];
+	unsigned int psk_len;
+	*sess = NULL;
+	if (identity_len > PSK_MAX_IDENTITY_LEN)
+		// an unknown identity
+		return 1;
+	memcpy(id, identity, identity_len);
+	id[identity_len] = 0;
+	psk_len = psk_server_cb(ssl, id, psk, sizeof(psk));
+	if (psk_len == 0)
+		return 1;
+	*sess = psk_session(ssl, NULL, psk, psk_len);
+	OPENSSL_cleanse(psk, sizeof(psk));
+	return *sess != NULL;
+}
+
+#endif
+
+int psk_init() {
+#if OPENSSL_VERSION_NUMBER >= 0x10101000L
+	psk_identity_idx = SSL_get_ex_new_index(0, NULL, NULL, NULL,
+		psk_identity_free);
+	return psk_identity_idx >= 0;
+#else
+	return 1;
+#endif
+}
+
+int SSL_CTX_set_psk_client(SSL_CTX *ctx, int enabled) {
+	SSL_CTX_set_psk_client_callback(ctx, (enabled ? psk_client_cb : NULL));
+#if OPENSSL_VERSION_NUMBER >= 0x10101000L
+	if (psk_identity_idx < 0)
+		return 0;
+	SSL_CTX_set_psk_use_session_callback(ctx,
+		(enabled ? psk_use_session_cb : NULL));
+#endif
+	return 1;
+}
+
+int SSL_CTX_set_psk_server(SSL_CTX *ctx, int enabled) {
+	SSL_CTX_set_psk_server_callback(ctx, (enabled ? psk_server_cb : NULL));
+#if OPENSSL_VERSION_NUMBER >= 0x10101000L
+	SSL_CTX_set_psk_find_session_callback(ctx,
+		(enabled ? psk_find_session_cb : NULL));
+#endif
+	return 1;
+}
+
+int SSL_CTX_use_psk_hint(SSL_CTX *ctx, const char *hint) {
+	return SSL_CTX_use_psk_identity_hint(ctx, hint);
+}
+
+#else
+
+int psk_init() {
+	return 1;
+}
+
+int SSL_CTX_set_psk_client(SSL_CTX *ctx, int enabled) {
+	return -1;
+}
+
+int SSL_CTX_set_psk_server(SSL_CTX *ctx, int enabled) {
+	return -1;
+}
+
+int SSL_CTX_use_psk_hint(SSL_CTX *ctx, const char *hint) {
+	return -1;
+}
+
+#endif
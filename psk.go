@@ -0,0 +1,180 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <stdlib.h>
+#include <openssl/ssl.h>
+
+extern int psk_init();
+extern int SSL_CTX_set_psk_client(SSL_CTX *ctx, int enabled);
+extern int SSL_CTX_set_psk_server(SSL_CTX *ctx, int enabled);
+extern int SSL_CTX_use_psk_hint(SSL_CTX *ctx, const char *hint);
+*/
+import "C"
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"unsafe"
+)
+
+var (
+	psk_init_ok = C.psk_init() == 1
+
+	pskUnsupported = errors.New("OpenSSL was built without PSK support")
+)
+
+// PSKClientCallback returns the identity a client authenticates as and the
+// key it shares with the server under that identity, given the identity hint
+// the server sent, if any. TLS 1.3 servers send no hint. Returning a nil key
+// carries on without a pre-shared key.
+type PSKClientCallback func(hint string) (identity string, psk []byte)
+
+// PSKServerCallback returns the key a server shares with the client claiming
+// identity, or nil if it knows no such client.
+type PSKServerCallback func(identity string) []byte
+
+// SetPSKClientCallback makes clients using the context authenticate with a
+// pre-shared key from cb rather than, or along with, certificates. Up to TLS
+// 1.2 this takes one of the PSK cipher suites, such as PSK-AES128-GCM-SHA256,
+// enabled with SetCipherList. With TLS 1.3 the key is offered as an external
+// PSK that must be used with a SHA-256 cipher suite, such as
+// TLS_AES_128_GCM_SHA256. A nil cb disables PSK.
+func (c *Ctx) SetPSKClientCallback(cb PSKClientCallback) error {
+	var enabled C.int
+	if cb != nil {
+		enabled = 1
+	}
+	if !psk_init_ok {
+		return errors.New("failed to allocate PSK ex data index")
+	}
+	c.psk_client_cb = cb
+	switch C.SSL_CTX_set_psk_client(c.ctx, enabled) {
+	case 1:
+		return nil
+	case -1:
+		return pskUnsupported
+	default:
+		return errors.New("failed to set PSK client callback")
+	}
+}
+
+// SetPSKServerCallback makes servers using the context accept clients
+// authenticating with a pre-shared key from cb. As for SetPSKClientCallback,
+// up to TLS 1.2 this takes a PSK cipher suite, and such servers need no
+// certificate. Conn.PSKIdentity tells which client connected. A nil cb
+// disables PSK.
+func (c *Ctx) SetPSKServerCallback(cb PSKServerCallback) error {
+	var enabled C.int
+	if cb != nil {
+		enabled = 1
+	}
+	c.psk_server_cb = cb
+	switch C.SSL_CTX_set_psk_server(c.ctx, enabled) {
+	case 1:
+		return nil
+	case -1:
+		return pskUnsupported
+	default:
+		return errors.New("failed to set PSK server callback")
+	}
+}
+
+// UsePSKIdentityHint sets the identity hint servers send to help clients
+// choose their identity up to TLS 1.2. An empty hint sends none.
+func (c *Ctx) UsePSKIdentityHint(hint string) error {
+	var chint *C.char
+	if hint != "" {
+		chint = C.CString(hint)
+		defer C.free(unsafe.Pointer(chint))
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	switch C.SSL_CTX_use_psk_hint(c.ctx, chint) {
+	case 1:
+		return nil
+	case -1:
+		return pskUnsupported
+	default:
+		return errorFromErrorQueue()
+	}
+}
+
+// PSKIdentity returns the identity a client authenticated as with a
+// pre-shared key, or "" if it did not. It is only set on servers.
+func (c *Conn) PSKIdentity() string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.psk_identity
+}
+
+//export psk_client_cb_thunk
+func psk_client_cb_thunk(p unsafe.Pointer, hint *C.char, identity *C.char,
+	max_identity_len C.uint, psk *C.uchar, max_psk_len C.uint) C.uint {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Critf("openssl: PSK client callback panic'd: %v", err)
+			os.Exit(1)
+		}
+	}()
+	ctx := (*Ctx)(p)
+	if ctx.psk_client_cb == nil {
+		return 0
+	}
+	var go_hint string
+	if hint != nil {
+		go_hint = C.GoString(hint)
+	}
+	id, key := ctx.psk_client_cb(go_hint)
+	// the identity is NUL terminated
+	if len(key) == 0 || len(key) > int(max_psk_len) ||
+		len(id) >= int(max_identity_len) {
+		return 0
+	}
+	id_buf := nonCopyCString(identity, C.int(max_identity_len))
+	id_buf[copy(id_buf, id)] = 0
+	copy(nonCopyCString((*C.char)(unsafe.Pointer(psk)), C.int(len(key))), key)
+	return C.uint(len(key))
+}
+
+//export psk_server_cb_thunk
+func psk_server_cb_thunk(p unsafe.Pointer, conn_p unsafe.Pointer,
+	identity *C.char, psk *C.uchar, max_psk_len C.uint) C.uint {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Critf("openssl: PSK server callback panic'd: %v", err)
+			os.Exit(1)
+		}
+	}()
+	ctx := (*Ctx)(p)
+	if ctx.psk_server_cb == nil || identity == nil {
+		return 0
+	}
+	id := C.GoString(identity)
+	key := ctx.psk_server_cb(id)
+	if len(key) == 0 || len(key) > int(max_psk_len) {
+		return 0
+	}
+	copy(nonCopyCString((*C.char)(unsafe.Pointer(psk)), C.int(len(key))), key)
+	if conn_p != nil {
+		// the handshake holds conn.mtx
+		(*Conn)(conn_p).psk_identity = id
+	}
+	return C.uint(len(key))
+}
@@ -0,0 +1,124 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"bytes"
+	"testing"
+)
+
+var testPSK = bytes.Repeat([]byte{0x42}, 32)
+
+func newPSKCtxs(t *testing.T, version SSLVersion, client_key []byte) (
+	server_ctx, client_ctx *Ctx, hints chan string) {
+	var err error
+	server_ctx, err = NewCtxWithVersion(version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client_ctx, err = NewCtxWithVersion(version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != TLSv1_3 {
+		for _, ctx := range []*Ctx{server_ctx, client_ctx} {
+			if err := ctx.SetCipherList("PSK-AES128-GCM-SHA256"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := server_ctx.UsePSKIdentityHint("fleet"); err != nil {
+		t.Fatal(err)
+	}
+	if err := server_ctx.SetPSKServerCallback(func(identity string) []byte {
+		if identity == "device-1" {
+			return testPSK
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	hints = make(chan string, 2)
+	if err := client_ctx.SetPSKClientCallback(func(hint string) (string,
+		[]byte) {
+		hints <- hint
+		return "device-1", client_key
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return server_ctx, client_ctx, hints
+}
+
+func pskHandshake(t *testing.T, server_ctx, client_ctx *Ctx) (*Conn, error,
+	error) {
+	server_conn, client_conn := NetPipe(t)
+	server, err := Server(server_conn, server_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := Client(client_conn, client_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 1)
+	go func() { errs <- server.Handshake() }()
+	client_err := client.Handshake()
+	if client_err == nil {
+		// TLS 1.3 servers finish once they read the client's Finished
+		client.Write([]byte("x"))
+	}
+	server_err := <-errs
+	server.Close()
+	client.Close()
+	return server, client_err, server_err
+}
+
+func TestPSK(t *testing.T) {
+	for _, test := range []struct {
+		version SSLVersion
+		hint    string
+	}{{TLSv1_2, "fleet"}, {TLSv1_3, ""}} {
+		server_ctx, client_ctx, hints := newPSKCtxs(t, test.version,
+			testPSK)
+		// no certificates needed
+		server, client_err, server_err := pskHandshake(t, server_ctx,
+			client_ctx)
+		if client_err != nil || server_err != nil {
+			t.Fatalf("version %d: %v, %v", test.version, client_err,
+				server_err)
+		}
+		if identity := server.PSKIdentity(); identity != "device-1" {
+			t.Fatalf("version %d: identity %q", test.version, identity)
+		}
+		if hint := <-hints; hint != test.hint {
+			t.Fatalf("version %d: hint %q", test.version, hint)
+		}
+	}
+}
+
+func TestPSKWrongKey(t *testing.T) {
+	for _, version := range []SSLVersion{TLSv1_2, TLSv1_3} {
+		server_ctx, client_ctx, _ := newPSKCtxs(t, version,
+			bytes.Repeat([]byte{0x24}, 32))
+		_, client_err, server_err := pskHandshake(t, server_ctx,
+			client_ctx)
+		if client_err == nil && server_err == nil {
+			t.Fatalf("version %d: handshake succeeded with the wrong key",
+				version)
+		}
+	}
+}
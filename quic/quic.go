@@ -0,0 +1,539 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+// Package quic speaks QUIC (RFC 9000) using the client support built into
+// OpenSSL 3.2 and newer, so that applications can reach QUIC and HTTP/3
+// servers with the system's OpenSSL rather than a separate implementation.
+//
+//	conn, err := quic.Dial("udp", "example.com:443", &quic.Config{
+//		NextProtos: []string{"h3"}})
+//	...
+//	stream, err := conn.OpenStream()
+//
+// OpenSSL drives the UDP socket itself and each call blocks the calling
+// goroutine's thread until it can proceed, so calls on different streams may
+// block concurrently. Servers are not supported yet. With older libraries,
+// Dial returns Unsupported.
+package quic
+
+/*
+#cgo pkg-config: libssl libcrypto
+#cgo windows CFLAGS: -DWIN32_LEAN_AND_MEAN
+
+#include <stdint.h>
+#include <stdlib.h>
+#include <string.h>
+#include <openssl/ssl.h>
+#include <openssl/err.h>
+#include <openssl/bio.h>
+
+#ifdef _WIN32
+#include <winsock2.h>
+#else
+#include <sys/socket.h>
+#endif
+
+#if OPENSSL_VERSION_NUMBER >= 0x30200000L
+#include <openssl/quic.h>
+#define QUIC_SUPPORTED 1
+#else
+#define QUIC_SUPPORTED 0
+#endif
+
+static SSL_CTX *quic_ctx_new(const char *ca_file, int verify) {
+#if QUIC_SUPPORTED
+    SSL_CTX *ctx = SSL_CTX_new(OSSL_QUIC_client_method());
+    if (ctx == NULL)
+        return NULL;
+    if (verify) {
+        SSL_CTX_set_verify(ctx, SSL_VERIFY_PEER, NULL);
+        if ((ca_file != NULL &&
+                SSL_CTX_load_verify_locations(ctx, ca_file, NULL) != 1) ||
+            (ca_file == NULL && SSL_CTX_set_default_verify_paths(ctx) != 1)) {
+            SSL_CTX_free(ctx);
+            return NULL;
+        }
+    }
+    return ctx;
+#else
+    return NULL;
+#endif
+}
+
+// quic_conn_new sets up a connection to the peer at ip and port over the
+// nonblocking UDP socket fd, which stays owned by the caller.
+static SSL *quic_conn_new(SSL_CTX *ctx, int fd, int v6, const void *ip,
+        size_t ip_len, int port, const char *host, int verify,
+        const unsigned char *alpn, unsigned int alpn_len) {
+#if QUIC_SUPPORTED
+    SSL *ssl;
+    BIO *bio;
+    BIO_ADDR *addr;
+    unsigned char port_bytes[2] = {(unsigned char)(port >> 8),
+        (unsigned char)port};
+    unsigned short port_n;
+    int ok;
+
+    ssl = SSL_new(ctx);
+    if (ssl == NULL)
+        return NULL;
+    bio = BIO_new_dgram(fd, BIO_NOCLOSE);
+    if (bio == NULL) {
+        SSL_free(ssl);
+        return NULL;
+    }
+    SSL_set_bio(ssl, bio, bio);
+
+    addr = BIO_ADDR_new();
+    if (addr == NULL) {
+        SSL_free(ssl);
+        return NULL;
+    }
+    memcpy(&port_n, port_bytes, 2);
+    ok = BIO_ADDR_rawmake(addr, v6 ? AF_INET6 : AF_INET, ip, ip_len, port_n) &&
+        SSL_set1_initial_peer_addr(ssl, addr);
+    BIO_ADDR_free(addr);
+    if (!ok ||
+        (host != NULL && SSL_set_tlsext_host_name(ssl, host) != 1) ||
+        (host != NULL && verify && SSL_set1_host(ssl, host) != 1) ||
+        SSL_set_alpn_protos(ssl, alpn, alpn_len) != 0 ||
+        SSL_set_default_stream_mode(ssl, SSL_DEFAULT_STREAM_MODE_NONE) != 1 ||
+        SSL_set_incoming_stream_policy(ssl,
+            SSL_INCOMING_STREAM_POLICY_ACCEPT, 0) != 1) {
+        SSL_free(ssl);
+        return NULL;
+    }
+    return ssl;
+#else
+    return NULL;
+#endif
+}
+
+static SSL *quic_new_stream(SSL *ssl, int uni) {
+#if QUIC_SUPPORTED
+    return SSL_new_stream(ssl, uni ? SSL_STREAM_FLAG_UNI : 0);
+#else
+    return NULL;
+#endif
+}
+
+static SSL *quic_accept_stream(SSL *ssl) {
+#if QUIC_SUPPORTED
+    return SSL_accept_stream(ssl, 0);
+#else
+    return NULL;
+#endif
+}
+
+static uint64_t quic_stream_id(SSL *stream) {
+#if QUIC_SUPPORTED
+    return SSL_get_stream_id(stream);
+#else
+    return 0;
+#endif
+}
+
+static int quic_stream_conclude(SSL *stream) {
+#if QUIC_SUPPORTED
+    return SSL_stream_conclude(stream, 0);
+#else
+    return 0;
+#endif
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+var (
+	Unsupported = errors.New("quic: the linked OpenSSL lacks QUIC support, " +
+		"which needs 3.2 or newer")
+	Closed = errors.New("quic: connection closed")
+)
+
+// Supported reports whether the linked OpenSSL can speak QUIC.
+func Supported() bool {
+	return C.QUIC_SUPPORTED != 0
+}
+
+// Config holds options for Dial.
+type Config struct {
+	// ServerName is sent with SNI and checked against the server's
+	// certificate. It defaults to the host Dial was given, unless that is an
+	// IP address.
+	ServerName string
+	// NextProtos lists the application protocols to offer with ALPN, most
+	// preferred first. QUIC requires at least one.
+	NextProtos []string
+	// CAFile names a PEM file of roots to verify the server against. The
+	// system's default roots are used if it is empty.
+	CAFile string
+	// InsecureSkipVerify disables checking the server's certificate.
+	InsecureSkipVerify bool
+}
+
+// Conn is a QUIC connection, over which any number of streams can be opened.
+type Conn struct {
+	mtx    sync.Mutex
+	ctx    *C.SSL_CTX
+	ssl    *C.SSL
+	udp    *net.UDPConn
+	remote *net.UDPAddr
+	closed bool
+}
+
+// Dial connects to addr over network, which must be "udp", "udp4" or "udp6",
+// and completes the handshake.
+func Dial(network, addr string, config *Config) (*Conn, error) {
+	if config == nil || len(config.NextProtos) == 0 {
+		return nil, errors.New("quic: at least one ALPN protocol is required")
+	}
+	alpn, err := marshalALPN(config.NextProtos)
+	if err != nil {
+		return nil, err
+	}
+	if !Supported() {
+		return nil, Unsupported
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if config.ServerName != "" {
+		host = config.ServerName
+	} else if net.ParseIP(host) != nil {
+		host = ""
+	}
+	remote, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	ip, listen_network := remote.IP.To4(), "udp4"
+	if ip == nil {
+		ip, listen_network = remote.IP.To16(), "udp6"
+	}
+	udp, err := net.ListenUDP(listen_network, nil)
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{udp: udp, remote: remote}
+	err = c.connect(ip, remote.Port, host, alpn, config)
+	if err != nil {
+		c.free()
+		udp.Close()
+		return nil, err
+	}
+	runtime.SetFinalizer(c, (*Conn).Close)
+	return c, nil
+}
+
+func (c *Conn) connect(ip net.IP, port int, host string, alpn []byte,
+	config *Config) error {
+	var verify C.int
+	if !config.InsecureSkipVerify {
+		verify = 1
+	}
+	var ca_file *C.char
+	if config.CAFile != "" {
+		ca_file = C.CString(config.CAFile)
+		defer C.free(unsafe.Pointer(ca_file))
+	}
+	var chost *C.char
+	if host != "" {
+		chost = C.CString(host)
+		defer C.free(unsafe.Pointer(chost))
+	}
+	var v6 C.int
+	if len(ip) == net.IPv6len {
+		v6 = 1
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	c.ctx = C.quic_ctx_new(ca_file, verify)
+	if c.ctx == nil {
+		return errorFromErrorQueue()
+	}
+	raw, err := c.udp.SyscallConn()
+	if err != nil {
+		return err
+	}
+	// the socket is nonblocking, as OpenSSL requires, and stays open for as
+	// long as c holds on to udp
+	err = raw.Control(func(fd uintptr) {
+		c.ssl = C.quic_conn_new(c.ctx, C.int(fd), v6, unsafe.Pointer(&ip[0]),
+			C.size_t(len(ip)), C.int(port), chost, verify,
+			(*C.uchar)(&alpn[0]), C.uint(len(alpn)))
+	})
+	if err != nil {
+		return err
+	}
+	if c.ssl == nil {
+		return errorFromErrorQueue()
+	}
+	if C.SSL_connect(c.ssl) != 1 {
+		return errorFromErrorQueue()
+	}
+	return nil
+}
+
+func (c *Conn) free() {
+	if c.ssl != nil {
+		C.SSL_free(c.ssl)
+		c.ssl = nil
+	}
+	if c.ctx != nil {
+		C.SSL_CTX_free(c.ctx)
+		c.ctx = nil
+	}
+}
+
+// NegotiatedProtocol returns the application protocol chosen with ALPN.
+func (c *Conn) NegotiatedProtocol() string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.closed {
+		return ""
+	}
+	var proto *C.uchar
+	var proto_len C.uint
+	C.SSL_get0_alpn_selected(c.ssl, &proto, &proto_len)
+	return C.GoStringN((*C.char)(unsafe.Pointer(proto)), C.int(proto_len))
+}
+
+// OpenStream opens a bidirectional stream.
+func (c *Conn) OpenStream() (*Stream, error) {
+	return c.newStream(0)
+}
+
+// OpenUniStream opens a stream that only this side can write to.
+func (c *Conn) OpenUniStream() (*Stream, error) {
+	return c.newStream(1)
+}
+
+func (c *Conn) newStream(uni C.int) (*Stream, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.closed {
+		return nil, Closed
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	stream := C.quic_new_stream(c.ssl, uni)
+	if stream == nil {
+		return nil, errorFromErrorQueue()
+	}
+	return newStream(c, stream), nil
+}
+
+// AcceptStream waits for the server to open a stream and returns it.
+func (c *Conn) AcceptStream() (*Stream, error) {
+	c.mtx.Lock()
+	if c.closed {
+		c.mtx.Unlock()
+		return nil, Closed
+	}
+	ssl := c.ssl
+	c.mtx.Unlock()
+	// streams hold a reference to the connection, so it stays valid while
+	// we block here even if c is closed meanwhile
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	stream := C.quic_accept_stream(ssl)
+	if stream == nil {
+		if c.isClosed() {
+			return nil, Closed
+		}
+		return nil, errorFromErrorQueue()
+	}
+	return newStream(c, stream), nil
+}
+
+func (c *Conn) isClosed() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.closed
+}
+
+// LocalAddr returns the address of the UDP socket the connection uses.
+func (c *Conn) LocalAddr() net.Addr { return c.udp.LocalAddr() }
+
+// RemoteAddr returns the server's address.
+func (c *Conn) RemoteAddr() net.Addr { return c.remote }
+
+// Close shuts the connection down, waiting for the server to acknowledge,
+// and releases it. Streams still open fail from then on.
+func (c *Conn) Close() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	runtime.SetFinalizer(c, nil)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	var err error
+	for {
+		rv := C.SSL_shutdown(c.ssl)
+		if rv == 1 {
+			break
+		}
+		if rv < 0 {
+			err = errorFromErrorQueue()
+			break
+		}
+	}
+	c.free()
+	if udp_err := c.udp.Close(); err == nil {
+		err = udp_err
+	}
+	return err
+}
+
+// Stream is a QUIC stream. It is safe to Read from one goroutine while
+// writing from another.
+type Stream struct {
+	conn *Conn
+	mtx  sync.Mutex
+	ssl  *C.SSL
+}
+
+func newStream(conn *Conn, ssl *C.SSL) *Stream {
+	s := &Stream{conn: conn, ssl: ssl}
+	runtime.SetFinalizer(s, (*Stream).Close)
+	return s
+}
+
+// ID returns the stream's identifier, whose low bits tell who opened it and
+// whether it is unidirectional.
+func (s *Stream) ID() uint64 {
+	return uint64(C.quic_stream_id(s.ssl))
+}
+
+// Read reads data from the stream, returning io.EOF once the peer has
+// finished writing.
+func (s *Stream) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	var n C.size_t
+	if C.SSL_read_ex(s.ssl, unsafe.Pointer(&b[0]), C.size_t(len(b)),
+		&n) == 1 {
+		return int(n), nil
+	}
+	return 0, s.ioError(0)
+}
+
+// Write writes data to the stream, blocking until it has all been queued.
+func (s *Stream) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	var n C.size_t
+	if C.SSL_write_ex(s.ssl, unsafe.Pointer(&b[0]), C.size_t(len(b)),
+		&n) == 1 {
+		return int(n), nil
+	}
+	return 0, s.ioError(0)
+}
+
+func (s *Stream) ioError(rv C.int) error {
+	switch C.SSL_get_error(s.ssl, rv) {
+	case C.SSL_ERROR_ZERO_RETURN:
+		return io.EOF
+	default:
+		if s.conn.isClosed() {
+			return Closed
+		}
+		return errorFromErrorQueue()
+	}
+}
+
+// CloseWrite tells the peer this side is done writing, while still allowing
+// reads.
+func (s *Stream) CloseWrite() error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.quic_stream_conclude(s.ssl) != 1 {
+		return errorFromErrorQueue()
+	}
+	return nil
+}
+
+// Close finishes writing to the stream and releases it. It must not be
+// called while a Read or Write is in progress.
+func (s *Stream) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.ssl == nil {
+		return nil
+	}
+	runtime.SetFinalizer(s, nil)
+	var err error
+	if !s.conn.isClosed() {
+		err = s.CloseWrite()
+	}
+	C.SSL_free(s.ssl)
+	s.ssl = nil
+	return err
+}
+
+// LocalAddr returns the local address of the stream's connection.
+func (s *Stream) LocalAddr() net.Addr { return s.conn.LocalAddr() }
+
+// RemoteAddr returns the remote address of the stream's connection.
+func (s *Stream) RemoteAddr() net.Addr { return s.conn.RemoteAddr() }
+
+func marshalALPN(protos []string) ([]byte, error) {
+	var rv []byte
+	for _, proto := range protos {
+		if len(proto) == 0 || len(proto) > 255 {
+			return nil, fmt.Errorf("quic: invalid ALPN protocol %q", proto)
+		}
+		rv = append(rv, byte(len(proto)))
+		rv = append(rv, proto...)
+	}
+	return rv, nil
+}
+
+func errorFromErrorQueue() error {
+	var errs []string
+	for {
+		err := C.ERR_get_error()
+		if err == 0 {
+			break
+		}
+		errs = append(errs, C.GoString(C.ERR_error_string(err, nil)))
+	}
+	if len(errs) == 0 {
+		return errors.New("quic: unknown error")
+	}
+	return errors.New("quic: " + strings.Join(errs, "\n"))
+}
@@ -0,0 +1,42 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package quic
+
+import (
+	"testing"
+)
+
+func TestDialRequiresALPN(t *testing.T) {
+	_, err := Dial("udp", "127.0.0.1:443", &Config{})
+	if err == nil {
+		t.Fatal("expected an error without ALPN protocols")
+	}
+	_, err = Dial("udp", "127.0.0.1:443", &Config{NextProtos: []string{""}})
+	if err == nil {
+		t.Fatal("expected an error for an empty ALPN protocol")
+	}
+}
+
+func TestDialUnsupported(t *testing.T) {
+	if Supported() {
+		t.Skip("the linked OpenSSL supports QUIC")
+	}
+	_, err := Dial("udp", "127.0.0.1:443", &Config{NextProtos: []string{"h3"}})
+	if err != Unsupported {
+		t.Fatalf("expected Unsupported, got %v", err)
+	}
+}
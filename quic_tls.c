@@ -0,0 +1,220 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include <stdint.h>
+#include <openssl/ssl.h>
+#include "_cgo_export.h"
+
+#if OPENSSL_VERSION_NUMBER >= 0x30500000L
+#include <openssl/core_dispatch.h>
+
+// the callbacks' arg is the handle of the Go QUICConn
+#define QUIC_HANDLE(arg) ((uintptr_t)(arg))
+
+static int quic_crypto_send(SSL *ssl, const unsigned char *buf, size_t len,
+		size_t *consumed, void *arg) {
+	return quic_crypto_send_thunk(QUIC_HANDLE(arg), (unsigned char *)buf, len,
+		consumed);
+}
+
+static int quic_crypto_recv_rcd(SSL *ssl, const unsigned char **buf,
+		size_t *len, void *arg) {
+	return quic_crypto_recv_thunk(QUIC_HANDLE(arg), (unsigned char **)buf,
+		len);
+}
+
+static int quic_crypto_release_rcd(SSL *ssl, size_t len, void *arg) {
+	return quic_crypto_release_thunk(QUIC_HANDLE(arg), len);
+}
+
+static int quic_yield_secret(SSL *ssl, uint32_t level, int direction,
+		const unsigned char *secret, size_t len, void *arg) {
+	const SSL_CIPHER *cipher = SSL_get_pending_cipher(ssl);
+	if (cipher == NULL)
+		cipher = SSL_get_current_cipher(ssl);
+	if (cipher == NULL)
+		return 0;
+	return quic_yield_secret_thunk(QUIC_HANDLE(arg), level, direction,
+		SSL_CIPHER_get_protocol_id(cipher), (unsigned char *)secret, len);
+}
+
+static int quic_got_transport_params(SSL *ssl, const unsigned char *params,
+		size_t len, void *arg) {
+	return quic_got_transport_params_thunk(QUIC_HANDLE(arg),
+		(unsigned char *)params, len);
+}
+
+static int quic_alert(SSL *ssl, unsigned char alert, void *arg) {
+	return quic_alert_thunk(QUIC_HANDLE(arg), alert);
+}
+
+static const OSSL_DISPATCH quic_tls_dispatch[] = {
+	{OSSL_FUNC_SSL_QUIC_TLS_CRYPTO_SEND, (void (*)(void))quic_crypto_send},
+	{OSSL_FUNC_SSL_QUIC_TLS_CRYPTO_RECV_RCD,
+		(void (*)(void))quic_crypto_recv_rcd},
+	{OSSL_FUNC_SSL_QUIC_TLS_CRYPTO_RELEASE_RCD,
+		(void (*)(void))quic_crypto_release_rcd},
+	{OSSL_FUNC_SSL_QUIC_TLS_YIELD_SECRET, (void (*)(void))quic_yield_secret},
+	{OSSL_FUNC_SSL_QUIC_TLS_GOT_TRANSPORT_PARAMS,
+		(void (*)(void))quic_got_transport_params},
+	{OSSL_FUNC_SSL_QUIC_TLS_ALERT, (void (*)(void))quic_alert},
+	OSSL_DISPATCH_END
+};
+
+int OUR_SSL_set_quic_tls(SSL *ssl, uintptr_t handle) {
+	return SSL_set_quic_tls_cbs(ssl, quic_tls_dispatch, (void *)handle);
+}
+
+int OUR_SSL_set_quic_tls_transport_params(SSL *ssl,
+		const unsigned char *params, size_t len) {
+	return SSL_set_quic_tls_transport_params(ssl, params, len);
+}
+
+// the received data is pulled with quic_crypto_recv_rcd instead
+int OUR_SSL_provide_quic_data(SSL *ssl, int level, const unsigned char *data,
+		size_t len) {
+	return -1;
+}
+
+int OUR_SSL_get_peer_quic_transport_params(SSL *ssl,
+		const unsigned char **params, size_t *len) {
+	return -1;
+}
+
+int OUR_SSL_process_quic_post_handshake(SSL *ssl) {
+	return -1;
+}
+#elif defined(OPENSSL_IS_BORINGSSL) || defined(OPENSSL_INFO_QUIC)
+// BoringSSL and quictls have SSL_QUIC_METHOD instead, whose callbacks find
+// the handle of the Go QUICConn in the app data
+#define QUIC_HANDLE(ssl) ((uintptr_t)SSL_get_app_data(ssl))
+
+static int quic_set_secret(SSL *ssl, enum ssl_encryption_level_t level,
+		int direction, const SSL_CIPHER *cipher, const uint8_t *secret,
+		size_t len) {
+	if (cipher == NULL)
+		return 0;
+	return quic_yield_secret_thunk(QUIC_HANDLE(ssl), level, direction,
+		SSL_CIPHER_get_protocol_id(cipher), (unsigned char *)secret, len);
+}
+
+#ifdef OPENSSL_IS_BORINGSSL
+static int quic_set_read_secret(SSL *ssl, enum ssl_encryption_level_t level,
+		const SSL_CIPHER *cipher, const uint8_t *secret, size_t len) {
+	return quic_set_secret(ssl, level, 0, cipher, secret, len);
+}
+
+static int quic_set_write_secret(SSL *ssl, enum ssl_encryption_level_t level,
+		const SSL_CIPHER *cipher, const uint8_t *secret, size_t len) {
+	return quic_set_secret(ssl, level, 1, cipher, secret, len);
+}
+#else
+static int quic_set_encryption_secrets(SSL *ssl, OSSL_ENCRYPTION_LEVEL level,
+		const uint8_t *read_secret, const uint8_t *write_secret,
+		size_t len) {
+	// early data keys come from the session being resumed
+	const SSL_CIPHER *cipher = SSL_get_pending_cipher(ssl);
+	if (cipher == NULL)
+		cipher = SSL_get_current_cipher(ssl);
+	if (cipher == NULL && SSL_get_session(ssl) != NULL)
+		cipher = SSL_SESSION_get0_cipher(SSL_get_session(ssl));
+	if (write_secret != NULL &&
+			!quic_set_secret(ssl, level, 1, cipher, write_secret, len))
+		return 0;
+	if (read_secret != NULL &&
+			!quic_set_secret(ssl, level, 0, cipher, read_secret, len))
+		return 0;
+	return 1;
+}
+#endif
+
+static int quic_add_handshake_data(SSL *ssl,
+		enum ssl_encryption_level_t level, const uint8_t *data, size_t len) {
+	return quic_write_crypto_data_thunk(QUIC_HANDLE(ssl), level,
+		(unsigned char *)data, len);
+}
+
+// the data is written out as it is added
+static int quic_flush_flight(SSL *ssl) {
+	return 1;
+}
+
+static int quic_send_alert(SSL *ssl, enum ssl_encryption_level_t level,
+		uint8_t alert) {
+	return quic_alert_thunk(QUIC_HANDLE(ssl), alert);
+}
+
+static const SSL_QUIC_METHOD quic_method = {
+#ifdef OPENSSL_IS_BORINGSSL
+	quic_set_read_secret,
+	quic_set_write_secret,
+#else
+	quic_set_encryption_secrets,
+#endif
+	quic_add_handshake_data,
+	quic_flush_flight,
+	quic_send_alert,
+};
+
+int OUR_SSL_set_quic_tls(SSL *ssl, uintptr_t handle) {
+	SSL_set_app_data(ssl, (void *)handle);
+	return SSL_set_quic_method(ssl, &quic_method) == 1 ? 1 : 0;
+}
+
+int OUR_SSL_set_quic_tls_transport_params(SSL *ssl,
+		const unsigned char *params, size_t len) {
+	return SSL_set_quic_transport_params(ssl, params, len);
+}
+
+int OUR_SSL_provide_quic_data(SSL *ssl, int level, const unsigned char *data,
+		size_t len) {
+	return SSL_provide_quic_data(ssl, (enum ssl_encryption_level_t)level,
+		data, len);
+}
+
+int OUR_SSL_get_peer_quic_transport_params(SSL *ssl,
+		const unsigned char **params, size_t *len) {
+	const uint8_t *out = NULL;
+	SSL_get_peer_quic_transport_params(ssl, &out, len);
+	*params = out;
+	return out != NULL && *len > 0;
+}
+
+int OUR_SSL_process_quic_post_handshake(SSL *ssl) {
+	return SSL_process_quic_post_handshake(ssl);
+}
+#else
+int OUR_SSL_set_quic_tls(SSL *ssl, uintptr_t handle) {
+	return -1;
+}
+
+int OUR_SSL_set_quic_tls_transport_params(SSL *ssl,
+		const unsigned char *params, size_t len) {
+	return -1;
+}
+
+int OUR_SSL_provide_quic_data(SSL *ssl, int level, const unsigned char *data,
+		size_t len) {
+	return -1;
+}
+
+int OUR_SSL_get_peer_quic_transport_params(SSL *ssl,
+		const unsigned char **params, size_t *len) {
+	return -1;
+}
+
+int OUR_SSL_process_quic_post_handshake(SSL *ssl) {
+	return -1;
+}
+#endif
@@ -0,0 +1,470 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+// #include <stdint.h>
+// #include <stdlib.h>
+// #include <string.h>
+// #include <openssl/ssl.h>
+//
+// extern long SSL_set_tlsext_host_name_not_a_macro(SSL *ssl,
+//     const char *name);
+// extern int OUR_SSL_set_quic_tls(SSL *ssl, uintptr_t handle);
+// extern int OUR_SSL_set_quic_tls_transport_params(SSL *ssl,
+//     const unsigned char *params, size_t len);
+// extern int OUR_SSL_provide_quic_data(SSL *ssl, int level,
+//     const unsigned char *data, size_t len);
+// extern int OUR_SSL_get_peer_quic_transport_params(SSL *ssl,
+//     const unsigned char **params, size_t *len);
+// extern int OUR_SSL_process_quic_post_handshake(SSL *ssl);
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"unsafe"
+)
+
+var QUICUnsupported = errors.New(
+	"the QUIC TLS API requires OpenSSL 3.5 or newer, BoringSSL or quictls")
+
+// QUICEncryptionLevel is a QUIC packet protection level.
+type QUICEncryptionLevel int
+
+const (
+	QUICEncryptionLevelInitial     QUICEncryptionLevel = 0
+	QUICEncryptionLevelEarly       QUICEncryptionLevel = 1
+	QUICEncryptionLevelHandshake   QUICEncryptionLevel = 2
+	QUICEncryptionLevelApplication QUICEncryptionLevel = 3
+)
+
+func (l QUICEncryptionLevel) String() string {
+	switch l {
+	case QUICEncryptionLevelInitial:
+		return "Initial"
+	case QUICEncryptionLevelEarly:
+		return "Early"
+	case QUICEncryptionLevelHandshake:
+		return "Handshake"
+	case QUICEncryptionLevelApplication:
+		return "Application"
+	}
+	return fmt.Sprintf("QUICEncryptionLevel(%d)", int(l))
+}
+
+// QUICTransport is implemented by a QUIC stack that uses a QUICConn for its
+// TLS handshake (RFC 9001). OpenSSL calls it from within QUICConn methods,
+// on the same goroutine. An error aborts the handshake, and is returned from
+// the QUICConn method that was running.
+type QUICTransport interface {
+	// SetReadSecret installs the secret for removing packet protection at
+	// level. suite is the negotiated TLS 1.3 cipher suite, from which the
+	// hash and AEAD follow.
+	SetReadSecret(level QUICEncryptionLevel, suite uint16,
+		secret []byte) error
+	// SetWriteSecret installs the secret for protecting packets sent at
+	// level.
+	SetWriteSecret(level QUICEncryptionLevel, suite uint16,
+		secret []byte) error
+	// WriteCryptoData sends handshake data to the peer in CRYPTO frames at
+	// level.
+	WriteCryptoData(level QUICEncryptionLevel, data []byte) error
+	// SetPeerTransportParameters receives the peer's encoded transport
+	// parameters.
+	SetPeerTransportParameters(params []byte) error
+	// SendAlert closes the connection with the CRYPTO_ERROR for the TLS
+	// alert.
+	SendAlert(alert uint8)
+}
+
+// QUICConn runs a TLS 1.3 handshake on behalf of a QUIC implementation,
+// which carries the handshake messages and protects packets itself. It is
+// not safe for concurrent use. It uses the QUIC TLS callbacks of OpenSSL 3.5
+// and newer, or SSL_QUIC_METHOD and SSL_provide_quic_data with BoringSSL and
+// the quictls fork of OpenSSL; the QUICTransport sees no difference.
+type QUICConn struct {
+	ssl       *C.SSL
+	ctx       *Ctx // for gc
+	transport QUICTransport
+	handle    C.uintptr_t
+	params    unsafe.Pointer
+
+	read_level  QUICEncryptionLevel
+	write_level QUICEncryptionLevel
+	pending     [4][]byte
+	// rcd is the received data OpenSSL is working on, copied out of
+	// pending
+	rcd     unsafe.Pointer
+	rcd_len C.size_t
+	err     error
+	// peer_params is set once the peer's transport parameters have been
+	// passed on, which SSL_QUIC_METHOD leaves to be asked for
+	peer_params bool
+}
+
+var (
+	quic_conns_mtx sync.Mutex
+	quic_conns     = make(map[C.uintptr_t]*QUICConn)
+	quic_next      C.uintptr_t
+)
+
+func lookupQUICConn(handle C.uintptr_t) *QUICConn {
+	quic_conns_mtx.Lock()
+	defer quic_conns_mtx.Unlock()
+	return quic_conns[handle]
+}
+
+// NewQUICClient returns a QUICConn for the client side of a QUIC
+// connection. ctx must allow TLS 1.3.
+func NewQUICClient(ctx *Ctx, transport QUICTransport) (*QUICConn, error) {
+	q, err := newQUICConn(ctx, transport)
+	if err != nil {
+		return nil, err
+	}
+	C.SSL_set_connect_state(q.ssl)
+	return q, nil
+}
+
+// NewQUICServer returns a QUICConn for the server side of a QUIC
+// connection.
+func NewQUICServer(ctx *Ctx, transport QUICTransport) (*QUICConn, error) {
+	q, err := newQUICConn(ctx, transport)
+	if err != nil {
+		return nil, err
+	}
+	C.SSL_set_accept_state(q.ssl)
+	return q, nil
+}
+
+func newQUICConn(ctx *Ctx, transport QUICTransport) (*QUICConn, error) {
+	if transport == nil {
+		return nil, errors.New("no QUIC transport provided")
+	}
+	ssl, err := newSSL(ctx)
+	if err != nil {
+		return nil, err
+	}
+	q := &QUICConn{ssl: ssl, ctx: ctx, transport: transport}
+	quic_conns_mtx.Lock()
+	quic_next++
+	q.handle = quic_next
+	quic_conns[q.handle] = q
+	quic_conns_mtx.Unlock()
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	switch C.OUR_SSL_set_quic_tls(ssl, q.handle) {
+	case 1:
+	case -1:
+		q.Free()
+		return nil, QUICUnsupported
+	default:
+		err = errorFromErrorQueue()
+		q.Free()
+		return nil, err
+	}
+	return q, nil
+}
+
+// Free releases the connection. It must be called once the QUICConn is no
+// longer needed.
+func (q *QUICConn) Free() {
+	quic_conns_mtx.Lock()
+	delete(quic_conns, q.handle)
+	quic_conns_mtx.Unlock()
+	if q.ssl != nil {
+		freeSSL(q.ssl, q.ctx)
+		q.ssl = nil
+	}
+	C.free(q.rcd)
+	q.rcd = nil
+	C.free(q.params)
+	q.params = nil
+}
+
+// SetTransportParameters sets the encoded transport parameters sent to the
+// peer. It must be called before the handshake starts.
+func (q *QUICConn) SetTransportParameters(params []byte) error {
+	if len(params) == 0 {
+		return errors.New("no transport parameters provided")
+	}
+	cparams := C.CBytes(params)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	// OpenSSL only keeps a pointer to the parameters
+	if C.OUR_SSL_set_quic_tls_transport_params(q.ssl,
+		(*C.uchar)(cparams), C.size_t(len(params))) != 1 {
+		C.free(cparams)
+		return errorFromErrorQueue()
+	}
+	C.free(q.params)
+	q.params = cparams
+	return nil
+}
+
+// SetTlsExtHostName sets the server name a client sends with SNI.
+func (q *QUICConn) SetTlsExtHostName(name string) error {
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.SSL_set_tlsext_host_name_not_a_macro(q.ssl, cname) == 0 {
+		return errorFromErrorQueue()
+	}
+	return nil
+}
+
+// HandleCryptoData hands data received from the peer in CRYPTO frames at
+// level to TLS, and advances the handshake. With BoringSSL and quictls, data
+// received once the handshake is complete, such as session tickets, is
+// processed as it arrives.
+func (q *QUICConn) HandleCryptoData(level QUICEncryptionLevel,
+	data []byte) error {
+	if level < QUICEncryptionLevelInitial ||
+		level > QUICEncryptionLevelApplication {
+		return fmt.Errorf("invalid QUIC encryption level %d", int(level))
+	}
+	if len(data) == 0 {
+		return q.Handshake()
+	}
+	runtime.LockOSThread()
+	rv := C.OUR_SSL_provide_quic_data(q.ssl, C.int(level),
+		(*C.uchar)(unsafe.Pointer(&data[0])), C.size_t(len(data)))
+	var err error
+	if rv == 0 {
+		err = errorFromErrorQueue()
+	}
+	runtime.UnlockOSThread()
+	switch {
+	case rv < 0:
+		// OpenSSL asks for the data as it needs it
+		q.pending[level] = append(q.pending[level], data...)
+	case err != nil:
+		return err
+	case q.HandshakeComplete():
+		return q.processPostHandshake()
+	}
+	return q.Handshake()
+}
+
+// processPostHandshake processes the messages provided after the handshake,
+// such as session tickets, with SSL_QUIC_METHOD.
+func (q *QUICConn) processPostHandshake() error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	q.err = nil
+	if C.OUR_SSL_process_quic_post_handshake(q.ssl) == 1 {
+		return nil
+	}
+	if q.err != nil {
+		return q.err
+	}
+	return errorFromErrorQueue()
+}
+
+// Handshake advances the handshake as far as the data received so far
+// allows, starting it for clients. It returns nil while more data is needed;
+// see HandshakeComplete.
+func (q *QUICConn) Handshake() error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	q.err = nil
+	rv := C.SSL_do_handshake(q.ssl)
+	if q.err != nil {
+		return q.err
+	}
+	if err := q.passPeerTransportParameters(); err != nil {
+		return err
+	}
+	if rv == 1 {
+		return nil
+	}
+	switch C.SSL_get_error(q.ssl, rv) {
+	case C.SSL_ERROR_WANT_READ, C.SSL_ERROR_WANT_WRITE:
+		return nil
+	}
+	return errorFromErrorQueue()
+}
+
+// passPeerTransportParameters hands the peer's transport parameters to the
+// transport once they have arrived, with SSL_QUIC_METHOD. OpenSSL 3.5 passes
+// them on with a callback instead.
+func (q *QUICConn) passPeerTransportParameters() error {
+	if q.peer_params {
+		return nil
+	}
+	var params *C.uchar
+	var params_len C.size_t
+	if C.OUR_SSL_get_peer_quic_transport_params(q.ssl, &params,
+		&params_len) != 1 {
+		return nil
+	}
+	q.peer_params = true
+	return q.transport.SetPeerTransportParameters(
+		C.GoBytes(unsafe.Pointer(params), C.int(params_len)))
+}
+
+// HandshakeComplete reports whether the handshake has finished.
+func (q *QUICConn) HandshakeComplete() bool {
+	return C.SSL_is_init_finished(q.ssl) == 1
+}
+
+// NegotiatedProtocol returns the application protocol chosen with ALPN,
+// which QUIC requires.
+func (q *QUICConn) NegotiatedProtocol() string {
+	var proto *C.uchar
+	var proto_len C.uint
+	C.SSL_get0_alpn_selected(q.ssl, &proto, &proto_len)
+	return C.GoStringN((*C.char)(unsafe.Pointer(proto)), C.int(proto_len))
+}
+
+func quicThunkRecover(name string) {
+	if err := recover(); err != nil {
+		logger.Critf("openssl: QUIC %s callback panic'd: %v", name, err)
+		os.Exit(1)
+	}
+}
+
+//export quic_crypto_send_thunk
+func quic_crypto_send_thunk(handle C.uintptr_t, buf *C.uchar, n C.size_t,
+	consumed *C.size_t) C.int {
+	defer quicThunkRecover("send")
+	q := lookupQUICConn(handle)
+	if q == nil {
+		return 0
+	}
+	err := q.transport.WriteCryptoData(q.write_level,
+		C.GoBytes(unsafe.Pointer(buf), C.int(n)))
+	if err != nil {
+		q.err = err
+		return 0
+	}
+	*consumed = n
+	return 1
+}
+
+//export quic_write_crypto_data_thunk
+func quic_write_crypto_data_thunk(handle C.uintptr_t, level C.int,
+	buf *C.uchar, n C.size_t) C.int {
+	defer quicThunkRecover("add handshake data")
+	q := lookupQUICConn(handle)
+	if q == nil {
+		return 0
+	}
+	err := q.transport.WriteCryptoData(QUICEncryptionLevel(level),
+		C.GoBytes(unsafe.Pointer(buf), C.int(n)))
+	if err != nil {
+		q.err = err
+		return 0
+	}
+	return 1
+}
+
+//export quic_crypto_recv_thunk
+func quic_crypto_recv_thunk(handle C.uintptr_t, buf **C.uchar,
+	n *C.size_t) C.int {
+	defer quicThunkRecover("receive")
+	q := lookupQUICConn(handle)
+	if q == nil {
+		return 0
+	}
+	if q.rcd == nil {
+		pending := q.pending[q.read_level]
+		if len(pending) == 0 {
+			*buf, *n = nil, 0
+			return 1
+		}
+		q.rcd = C.CBytes(pending)
+		q.rcd_len = C.size_t(len(pending))
+		q.pending[q.read_level] = nil
+	}
+	*buf, *n = (*C.uchar)(q.rcd), q.rcd_len
+	return 1
+}
+
+//export quic_crypto_release_thunk
+func quic_crypto_release_thunk(handle C.uintptr_t, n C.size_t) C.int {
+	defer quicThunkRecover("release")
+	q := lookupQUICConn(handle)
+	if q == nil || n > q.rcd_len {
+		return 0
+	}
+	if n == q.rcd_len {
+		C.free(q.rcd)
+		q.rcd, q.rcd_len = nil, 0
+		return 1
+	}
+	C.memmove(q.rcd, unsafe.Pointer(uintptr(q.rcd)+uintptr(n)), q.rcd_len-n)
+	q.rcd_len -= n
+	return 1
+}
+
+//export quic_yield_secret_thunk
+func quic_yield_secret_thunk(handle C.uintptr_t, level C.uint32_t,
+	direction C.int, suite C.uint16_t, secret *C.uchar, n C.size_t) C.int {
+	defer quicThunkRecover("secret")
+	q := lookupQUICConn(handle)
+	if q == nil {
+		return 0
+	}
+	l := QUICEncryptionLevel(level)
+	s := C.GoBytes(unsafe.Pointer(secret), C.int(n))
+	var err error
+	if direction == 1 {
+		err = q.transport.SetWriteSecret(l, uint16(suite), s)
+		q.write_level = l
+	} else {
+		err = q.transport.SetReadSecret(l, uint16(suite), s)
+		q.read_level = l
+	}
+	if err != nil {
+		q.err = err
+		return 0
+	}
+	return 1
+}
+
+//export quic_got_transport_params_thunk
+func quic_got_transport_params_thunk(handle C.uintptr_t, params *C.uchar,
+	n C.size_t) C.int {
+	defer quicThunkRecover("transport parameters")
+	q := lookupQUICConn(handle)
+	if q == nil {
+		return 0
+	}
+	err := q.transport.SetPeerTransportParameters(
+		C.GoBytes(unsafe.Pointer(params), C.int(n)))
+	if err != nil {
+		q.err = err
+		return 0
+	}
+	return 1
+}
+
+//export quic_alert_thunk
+func quic_alert_thunk(handle C.uintptr_t, alert C.uchar) C.int {
+	defer quicThunkRecover("alert")
+	q := lookupQUICConn(handle)
+	if q == nil {
+		return 0
+	}
+	q.transport.SendAlert(uint8(alert))
+	return 1
+}
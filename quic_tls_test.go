@@ -0,0 +1,185 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"bytes"
+	"testing"
+)
+
+type discardQUICTransport struct{}
+
+func (discardQUICTransport) SetReadSecret(QUICEncryptionLevel, uint16,
+	[]byte) error {
+	return nil
+}
+func (discardQUICTransport) SetWriteSecret(QUICEncryptionLevel, uint16,
+	[]byte) error {
+	return nil
+}
+func (discardQUICTransport) WriteCryptoData(QUICEncryptionLevel,
+	[]byte) error {
+	return nil
+}
+func (discardQUICTransport) SetPeerTransportParameters([]byte) error {
+	return nil
+}
+func (discardQUICTransport) SendAlert(uint8) {}
+
+func TestNewQUICClient(t *testing.T) {
+	ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewQUICClient(ctx, nil); err == nil {
+		t.Fatal("expected an error without a transport")
+	}
+	q, err := NewQUICClient(ctx, discardQUICTransport{})
+	if err == QUICUnsupported {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Free()
+	err = q.SetTransportParameters([]byte{0x01, 0x02, 0x00, 0x01})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.HandshakeComplete() {
+		t.Fatal("handshake complete before it started")
+	}
+}
+
+// recordingQUICTransport keeps what a QUICConn hands it, for passing to the
+// other end of the connection.
+type recordingQUICTransport struct {
+	read_secrets  map[QUICEncryptionLevel][]byte
+	write_secrets map[QUICEncryptionLevel][]byte
+	out           []quicCryptoData
+	peer_params   []byte
+}
+
+type quicCryptoData struct {
+	level QUICEncryptionLevel
+	data  []byte
+}
+
+func newRecordingQUICTransport() *recordingQUICTransport {
+	return &recordingQUICTransport{
+		read_secrets:  map[QUICEncryptionLevel][]byte{},
+		write_secrets: map[QUICEncryptionLevel][]byte{}}
+}
+
+func (r *recordingQUICTransport) SetReadSecret(level QUICEncryptionLevel,
+	suite uint16, secret []byte) error {
+	r.read_secrets[level] = secret
+	return nil
+}
+func (r *recordingQUICTransport) SetWriteSecret(level QUICEncryptionLevel,
+	suite uint16, secret []byte) error {
+	r.write_secrets[level] = secret
+	return nil
+}
+func (r *recordingQUICTransport) WriteCryptoData(level QUICEncryptionLevel,
+	data []byte) error {
+	r.out = append(r.out, quicCryptoData{level: level, data: data})
+	return nil
+}
+func (r *recordingQUICTransport) SetPeerTransportParameters(
+	params []byte) error {
+	r.peer_params = params
+	return nil
+}
+func (r *recordingQUICTransport) SendAlert(uint8) {}
+
+// deliver passes the crypto data sent so far to q.
+func (r *recordingQUICTransport) deliver(t *testing.T, q *QUICConn) {
+	out := r.out
+	r.out = nil
+	for _, d := range out {
+		if err := q.HandleCryptoData(d.level, d.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestQUICHandshake(t *testing.T) {
+	key := generateTestRSAKey(t)
+	ca := issueTestCert(t, key, testCert{})
+	server_ctx := newSharedCtx(t, key, ca, ca)
+	client_ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ctx := range []*Ctx{server_ctx, client_ctx} {
+		if err := ctx.SetAlpnProtos([]string{"h3"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server_transport := newRecordingQUICTransport()
+	client_transport := newRecordingQUICTransport()
+	server, err := NewQUICServer(server_ctx, server_transport)
+	if err == QUICUnsupported {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Free()
+	client, err := NewQUICClient(client_ctx, client_transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Free()
+	server_params := []byte{0x04, 0x01, 0x10}
+	client_params := []byte{0x05, 0x01, 0x20}
+	if err := server.SetTransportParameters(server_params); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetTransportParameters(client_params); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10 && !(client.HandshakeComplete() &&
+		server.HandshakeComplete()); i++ {
+		client_transport.deliver(t, server)
+		server_transport.deliver(t, client)
+	}
+	if !client.HandshakeComplete() || !server.HandshakeComplete() {
+		t.Fatal("expected the handshake to complete")
+	}
+	if client.NegotiatedProtocol() != "h3" {
+		t.Fatalf("unexpected protocol %q", client.NegotiatedProtocol())
+	}
+	if !bytes.Equal(client_transport.peer_params, server_params) ||
+		!bytes.Equal(server_transport.peer_params, client_params) {
+		t.Fatal("expected the transport parameters to be exchanged")
+	}
+	for _, level := range []QUICEncryptionLevel{
+		QUICEncryptionLevelHandshake, QUICEncryptionLevelApplication} {
+		if len(client_transport.write_secrets[level]) == 0 ||
+			!bytes.Equal(client_transport.write_secrets[level],
+				server_transport.read_secrets[level]) {
+			t.Fatalf("expected matching %s secrets", level)
+		}
+	}
+}
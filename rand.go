@@ -0,0 +1,123 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <openssl/crypto.h>
+#include <openssl/rand.h>
+#if !defined(OPENSSL_NO_ENGINE) && !defined(OPENSSL_IS_BORINGSSL)
+#include <openssl/engine.h>
+#endif
+
+static int OUR_ENGINE_set_default_RAND(ENGINE *e) {
+#if !defined(OPENSSL_NO_ENGINE) && !defined(OPENSSL_IS_BORINGSSL)
+    return ENGINE_set_default_RAND(e);
+#else
+    return 0;
+#endif
+}
+
+static int OUR_RAND_clear_rand_engine() {
+#if !defined(OPENSSL_NO_ENGINE) && !defined(OPENSSL_IS_BORINGSSL)
+    return RAND_set_rand_engine(NULL);
+#else
+    return 1;
+#endif
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"io"
+	"math"
+	"runtime"
+	"unsafe"
+)
+
+type randReader struct{}
+
+// RandReader reads from OpenSSL's CSPRNG, or from the engine given to
+// Engine.SetDefaultRand, for use in place of crypto/rand's Reader. It is safe
+// for concurrent use. Read fails, rather than returning weak bytes, if the
+// generator isn't adequately seeded, as may happen early in boot on embedded
+// systems; see RandStatus, RandSeed and RandAdd.
+var RandReader io.Reader = randReader{}
+
+func (randReader) Read(b []byte) (n int, err error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	for n < len(b) {
+		chunk := b[n:]
+		if len(chunk) > math.MaxInt32 {
+			chunk = chunk[:math.MaxInt32]
+		}
+		if C.RAND_bytes((*C.uchar)(unsafe.Pointer(&chunk[0])),
+			C.int(len(chunk))) != 1 {
+			return n, errorFromErrorQueue()
+		}
+		n += len(chunk)
+	}
+	return n, nil
+}
+
+// RandStatus reports whether OpenSSL's CSPRNG has been seeded with enough
+// entropy to generate random bytes.
+func RandStatus() bool {
+	return C.RAND_status() == 1
+}
+
+// RandSeed mixes buf into the state of OpenSSL's CSPRNG, crediting it with
+// as much entropy as it is long, so it must be fully unpredictable, e.g.
+// read from a hardware TRNG.
+func RandSeed(buf []byte) {
+	if len(buf) == 0 {
+		return
+	}
+	C.RAND_seed(unsafe.Pointer(&buf[0]), C.int(len(buf)))
+}
+
+// RandAdd mixes buf into the state of OpenSSL's CSPRNG, crediting it with
+// entropy bytes of entropy, which may be anything from 0, for data that is
+// merely hard to guess, to len(buf).
+func RandAdd(buf []byte, entropy float64) {
+	if len(buf) == 0 {
+		return
+	}
+	C.RAND_add(unsafe.Pointer(&buf[0]), C.int(len(buf)), C.double(entropy))
+}
+
+// SetDefaultRand makes the engine, such as one driving a hardware TRNG, the
+// source of all the random bytes OpenSSL generates, including RandReader's,
+// process wide. ClearRandEngine undoes it.
+func (e *Engine) SetDefaultRand() error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.OUR_ENGINE_set_default_RAND(e.e) != 1 {
+		return errorFromErrorQueue()
+	}
+	return nil
+}
+
+// ClearRandEngine makes OpenSSL generate random bytes itself again, after
+// Engine.SetDefaultRand.
+func ClearRandEngine() error {
+	if C.OUR_RAND_clear_rand_engine() != 1 {
+		return errors.New("openssl: rand: cannot clear the engine")
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func readRand(t *testing.T, n int) []byte {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(RandReader, buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestRandReader(t *testing.T) {
+	RandSeed([]byte("not actually unpredictable"))
+	RandAdd([]byte("boot time, say"), 0)
+	if !RandStatus() {
+		t.Fatal("expected the generator to be seeded")
+	}
+	a, b := readRand(t, 100000), readRand(t, 100000)
+	if bytes.Equal(a, b) {
+		t.Fatal("expected successive reads to differ")
+	}
+	if bytes.Equal(a[:32], make([]byte, 32)) {
+		t.Fatal("expected random bytes, got zeros")
+	}
+	// from an engine, if one is available
+	e, err := EngineById("rdrand")
+	if err != nil {
+		t.Log(err)
+		return
+	}
+	if err := e.SetDefaultRand(); err != nil {
+		t.Fatal(err)
+	}
+	defer ClearRandEngine()
+	readRand(t, 1000)
+}
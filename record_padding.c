@@ -0,0 +1,49 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+#include <openssl/ssl.h>
+#include "_cgo_export.h"
+
+#if OPENSSL_VERSION_NUMBER >= 0x10101000L && \
+	!defined(LIBRESSL_VERSION_NUMBER) && !defined(OPENSSL_IS_BORINGSSL)
+
+static size_t record_padding_cb(SSL *ssl, int type, size_t len, void *arg) {
+	return record_padding_cb_thunk(SSL_get_ex_data(ssl, get_ssl_idx()), type,
+		len);
+}
+
+int SSL_CTX_set_record_padding(SSL_CTX *ctx, int enabled) {
+	// newer versions return whether it succeeded, which it only fails to
+	// for kTLS connections
+	SSL_CTX_set_record_padding_callback(ctx,
+		(enabled ? record_padding_cb : NULL));
+	return 1;
+}
+
+int SSL_CTX_set_block_padding_not_a_macro(SSL_CTX *ctx, size_t block_size) {
+	return SSL_CTX_set_block_padding(ctx, block_size);
+}
+
+#else
+
+int SSL_CTX_set_record_padding(SSL_CTX *ctx, int enabled) {
+	return -1;
+}
+
+int SSL_CTX_set_block_padding_not_a_macro(SSL_CTX *ctx, size_t block_size) {
+	return -1;
+}
+
+#endif
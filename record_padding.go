@@ -0,0 +1,104 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <stddef.h>
+#include <openssl/ssl.h>
+
+extern int SSL_CTX_set_record_padding(SSL_CTX *ctx, int enabled);
+extern int SSL_CTX_set_block_padding_not_a_macro(SSL_CTX *ctx,
+	size_t block_size);
+*/
+import "C"
+
+import (
+	"errors"
+	"os"
+	"unsafe"
+)
+
+// RecordPaddingCallback returns how many bytes of padding to add to a TLS
+// 1.3 record about to be sent, given its type and the length of its
+// content, to hide the length of what the connection sends. OpenSSL caps
+// the padding to keep the record within the maximum size. The connection's
+// lock is held while it runs, so it must not call conn's methods; conn only
+// tells connections apart.
+type RecordPaddingCallback func(conn *Conn, record_type RecordType,
+	length int) int
+
+// SetRecordPaddingCallback makes TLS 1.3 connections created with the
+// context from now on pad the records they send as cb decides, taking
+// precedence over SetRecordPaddingBlockSize. Padding costs bandwidth, and
+// only hides the length of records from someone watching the network, not
+// their timing or number. It requires OpenSSL 1.1.1 or newer. A nil cb
+// removes the callback.
+func (c *Ctx) SetRecordPaddingCallback(cb RecordPaddingCallback) error {
+	var enabled C.int
+	if cb != nil {
+		enabled = 1
+	}
+	switch C.SSL_CTX_set_record_padding(c.ctx, enabled) {
+	case 1:
+		c.record_padding_cb = cb
+		return nil
+	case -1:
+		return tls13Unsupported
+	default:
+		return errorFromErrorQueue()
+	}
+}
+
+// SetRecordPaddingBlockSize makes TLS 1.3 connections created with the
+// context from now on pad the records they send to a multiple of
+// block_size bytes, so that messages of similar lengths can't be told
+// apart. A block_size of 0 or 1 turns padding off, and it can be at most
+// 16384, the maximum record size. It requires OpenSSL 1.1.1 or newer.
+func (c *Ctx) SetRecordPaddingBlockSize(block_size int) error {
+	if block_size < 0 {
+		return errors.New("negative record padding block size")
+	}
+	switch C.SSL_CTX_set_block_padding_not_a_macro(c.ctx,
+		C.size_t(block_size)) {
+	case 1:
+		return nil
+	case -1:
+		return tls13Unsupported
+	default:
+		return errors.New("record padding block size too large")
+	}
+}
+
+//export record_padding_cb_thunk
+func record_padding_cb_thunk(p unsafe.Pointer, record_type C.int,
+	length C.size_t) C.size_t {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Critf("openssl: record padding callback panic'd: %v", err)
+			os.Exit(1)
+		}
+	}()
+	conn := (*Conn)(p)
+	if conn == nil || conn.padding_cb == nil {
+		return 0
+	}
+	padding := conn.padding_cb(conn, RecordType(record_type), int(length))
+	if padding < 0 {
+		return 0
+	}
+	return C.size_t(padding)
+}
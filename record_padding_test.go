@@ -0,0 +1,123 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRecordPadding(t *testing.T) {
+	// sentRecordLengths returns the lengths of the records a server using
+	// ctx sends after the handshake to write a single byte
+	sentRecordLengths := func(ctx *Ctx) []int {
+		var mtx sync.Mutex
+		var lengths []int
+		recording := false
+		ctx.SetMessageCallback(func(conn *Conn, msg Message) {
+			mtx.Lock()
+			defer mtx.Unlock()
+			if recording && msg.Sent && msg.Type == RecordHeader &&
+				len(msg.Data) == 5 {
+				lengths = append(lengths,
+					int(binary.BigEndian.Uint16(msg.Data[3:])))
+			}
+		})
+		client_ctx, err := NewCtx()
+		if err != nil {
+			t.Fatal(err)
+		}
+		server_conn, client_conn := NetPipe(t)
+		server_conn.SetDeadline(time.Now().Add(10 * time.Second))
+		client_conn.SetDeadline(time.Now().Add(10 * time.Second))
+		server, err := Server(server_conn, ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+		client, err := Client(client_conn, client_ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		errs := make(chan error, 1)
+		go func() { errs <- client.Handshake() }()
+		if err := server.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+		mtx.Lock()
+		recording = true
+		mtx.Unlock()
+		if _, err := server.Write([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Read(make([]byte, 1)); err != nil {
+			t.Fatal(err)
+		}
+		mtx.Lock()
+		defer mtx.Unlock()
+		if len(lengths) == 0 {
+			t.Fatal("no records sent")
+		}
+		return lengths
+	}
+
+	t.Run("BlockSize", func(t *testing.T) {
+		ctx := newTestServerCtx(t)
+		err := ctx.SetRecordPaddingBlockSize(512)
+		if err == tls13Unsupported {
+			t.Skip(err)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, length := range sentRecordLengths(ctx) {
+			if length < 512 {
+				t.Fatalf("record of %d bytes wasn't padded", length)
+			}
+		}
+	})
+
+	t.Run("Callback", func(t *testing.T) {
+		ctx := newTestServerCtx(t)
+		var calls int
+		err := ctx.SetRecordPaddingCallback(
+			func(conn *Conn, record_type RecordType, length int) int {
+				calls++
+				return 300 - length
+			})
+		if err == tls13Unsupported {
+			t.Skip(err)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, length := range sentRecordLengths(ctx) {
+			if length < 300 {
+				t.Fatalf("record of %d bytes wasn't padded", length)
+			}
+		}
+		if calls == 0 {
+			t.Fatal("padding callback wasn't called")
+		}
+	})
+}
@@ -0,0 +1,198 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <openssl/ssl.h>
+
+static long SSL_CTX_set_max_send_fragment_not_a_macro(SSL_CTX *ctx,
+        long m) {
+    return SSL_CTX_set_max_send_fragment(ctx, m);
+}
+
+static long SSL_set_max_send_fragment_not_a_macro(SSL *ssl, long m) {
+    return SSL_set_max_send_fragment(ssl, m);
+}
+
+static int OUR_SSL_CTX_set_max_fragment_length(SSL_CTX *ctx, int mode) {
+#ifdef TLSEXT_max_fragment_length_DISABLED
+    return SSL_CTX_set_tlsext_max_fragment_length(ctx, mode);
+#else
+    return -1;
+#endif
+}
+
+static int OUR_SSL_set_max_fragment_length(SSL *ssl, int mode) {
+#ifdef TLSEXT_max_fragment_length_DISABLED
+    return SSL_set_tlsext_max_fragment_length(ssl, mode);
+#else
+    return -1;
+#endif
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	// smallRecordSize fits a record, with its header, nonce and tag, in the
+	// 1208 byte TCP segments crypto/tls assumes for its dynamic sizing
+	smallRecordSize = 1170
+	// the connection writes full sized records once this much has been sent
+	dynamicRecordBoost = 128 * 1024
+	// and starts over with small records after being idle for this long
+	dynamicRecordIdle = time.Second
+)
+
+var maxFragmentLengthUnsupported = errors.New(
+	"max fragment length negotiation requires OpenSSL 1.1.1 or newer")
+
+// SetMaxSendFragment sets the most plaintext connections using the context
+// put in each record they send, between 512 and SSLRecordSize, the default.
+// Smaller records need smaller buffers on the receiving end, and can be
+// decrypted before as much has arrived, at the cost of more overhead. See
+// also SetDynamicRecordSizing.
+func (c *Ctx) SetMaxSendFragment(size int) error {
+	if C.SSL_CTX_set_max_send_fragment_not_a_macro(c.ctx, C.long(size)) != 1 {
+		return errors.New("invalid max send fragment")
+	}
+	return nil
+}
+
+// SetMaxSendFragment overrides the context's max send fragment for this
+// connection, see Ctx.SetMaxSendFragment.
+func (c *Conn) SetMaxSendFragment(size int) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if C.SSL_set_max_send_fragment_not_a_macro(c.ssl, C.long(size)) != 1 {
+		return errors.New("invalid max send fragment")
+	}
+	return nil
+}
+
+func maxFragmentLengthMode(length int) (C.int, error) {
+	// as numbered by RFC 6066
+	switch length {
+	case 0:
+		return 0, nil
+	case 512:
+		return 1, nil
+	case 1024:
+		return 2, nil
+	case 2048:
+		return 3, nil
+	case 4096:
+		return 4, nil
+	}
+	return 0, errors.New("max fragment length must be 512, 1024, 2048 or " +
+		"4096")
+}
+
+// SetMaxFragmentLength makes clients using the context ask servers to send
+// records of at most length bytes of plaintext with the max_fragment_length
+// extension (RFC 6066), for the benefit of clients short on memory. The
+// length must be 512, 1024, 2048 or 4096, or 0 to send no such request.
+// Servers honor it without being asked. Servers that ignore the extension
+// carry on as usual, so it is no guarantee. It requires OpenSSL 1.1.1 or
+// newer.
+func (c *Ctx) SetMaxFragmentLength(length int) error {
+	mode, err := maxFragmentLengthMode(length)
+	if err != nil {
+		return err
+	}
+	switch C.OUR_SSL_CTX_set_max_fragment_length(c.ctx, mode) {
+	case 1:
+		return nil
+	case -1:
+		return maxFragmentLengthUnsupported
+	default:
+		return errorFromErrorQueue()
+	}
+}
+
+// SetMaxFragmentLength overrides the context's max fragment length request
+// for this client connection. It must be called before the handshake. See
+// Ctx.SetMaxFragmentLength.
+func (c *Conn) SetMaxFragmentLength(length int) error {
+	mode, err := maxFragmentLengthMode(length)
+	if err != nil {
+		return err
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	switch C.OUR_SSL_set_max_fragment_length(c.ssl, mode) {
+	case 1:
+		return nil
+	case -1:
+		return maxFragmentLengthUnsupported
+	default:
+		return errorFromErrorQueue()
+	}
+}
+
+// SetDynamicRecordSizing makes connections using the context start writing
+// small records, each fitting in a single TCP segment, so that the peer can
+// start decrypting the first of a response as soon as it arrives rather than
+// once a whole 16 KiB record has, and grow them to the max send fragment as
+// more is sent, as crypto/tls does. Connections start over with small
+// records when they write after being idle for a second, as the TCP
+// congestion window may have shrunk since. It suits latency sensitive
+// servers, and takes effect for new connections.
+func (c *Ctx) SetDynamicRecordSizing(enabled bool) {
+	c.dynamic_records = enabled
+}
+
+// SetDynamicRecordSizing overrides the context's dynamic record sizing for
+// this connection, see Ctx.SetDynamicRecordSizing.
+func (c *Conn) SetDynamicRecordSizing(enabled bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.dynamic_records = enabled
+}
+
+// nextRecordSize returns how much of the n bytes left to write the next
+// record should carry. The caller must hold c.mtx.
+func (c *Conn) nextRecordSize(n int) int {
+	if !c.dynamic_records {
+		return n
+	}
+	now := time.Now()
+	if now.Sub(c.last_write) > dynamicRecordIdle {
+		c.records_sent, c.bytes_sent = 0, 0
+	}
+	c.last_write = now
+	if c.bytes_sent >= dynamicRecordBoost {
+		return n
+	}
+	// as crypto/tls does, grow by a segment a record
+	if size := smallRecordSize * (c.records_sent + 1); size < n {
+		return size
+	}
+	return n
+}
+
+// countRecord accounts for a write of n bytes in dynamic record sizing. The
+// caller must hold c.mtx.
+func (c *Conn) countRecord(n int) {
+	if c.dynamic_records {
+		c.records_sent++
+		c.bytes_sent += n
+	}
+}
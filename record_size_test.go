@@ -0,0 +1,199 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// recordingConn keeps what is written to it, to check the records sent.
+type recordingConn struct {
+	net.Conn
+	mtx     sync.Mutex
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.mtx.Lock()
+	c.written.Write(b)
+	c.mtx.Unlock()
+	return c.Conn.Write(b)
+}
+
+// records returns the lengths of the records written since the last call.
+func (c *recordingConn) records(t *testing.T) (lengths []int) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	data := c.written.Bytes()
+	for len(data) > 0 {
+		if len(data) < 5 {
+			t.Fatal("truncated record header")
+		}
+		length := int(data[3])<<8 | int(data[4])
+		lengths = append(lengths, length)
+		data = data[5+length:]
+	}
+	c.written.Reset()
+	return lengths
+}
+
+// recordsFor sends data over a connection from a server using server_ctx to
+// a client using client_ctx, and returns the lengths of the records the
+// server sent it with.
+func recordsFor(t *testing.T, server_ctx, client_ctx *Ctx,
+	setup func(server, client *Conn), data []byte) []int {
+	server_conn, client_conn := NetPipe(t)
+	recorder := &recordingConn{Conn: server_conn}
+	server, err := Server(recorder, server_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := Client(client_conn, client_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if setup != nil {
+		setup(server, client)
+	}
+	errs := make(chan error, 1)
+	go func() { errs <- server.Handshake() }()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	recorder.records(t)
+	go func() {
+		_, err := server.Write(data)
+		errs <- err
+	}()
+	if _, err := io.ReadFull(client, make([]byte, len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	return recorder.records(t)
+}
+
+func maxRecord(lengths []int) (max int) {
+	for _, length := range lengths {
+		if length > max {
+			max = length
+		}
+	}
+	return max
+}
+
+// recordOverhead bounds what encryption adds to a record's plaintext
+const recordOverhead = 256
+
+func TestMaxSendFragment(t *testing.T) {
+	data := make([]byte, 64*1024)
+	server_ctx := newTestServerCtx(t)
+	if err := server_ctx.SetMaxSendFragment(100); err == nil {
+		t.Fatal("expected an error for a tiny fragment")
+	}
+	if err := server_ctx.SetMaxSendFragment(2048); err != nil {
+		t.Fatal(err)
+	}
+	client_ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lengths := recordsFor(t, server_ctx, client_ctx, nil, data)
+	if max := maxRecord(lengths); max > 2048+recordOverhead || max < 2048 {
+		t.Fatalf("largest record was %d bytes", max)
+	}
+
+	// connections override the context
+	lengths = recordsFor(t, server_ctx, client_ctx,
+		func(server, client *Conn) {
+			if err := server.SetMaxSendFragment(1024); err != nil {
+				t.Fatal(err)
+			}
+		}, data)
+	if max := maxRecord(lengths); max > 1024+recordOverhead {
+		t.Fatalf("largest record was %d bytes", max)
+	}
+}
+
+func TestMaxFragmentLength(t *testing.T) {
+	data := make([]byte, 16*1024)
+	client_ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client_ctx.SetMaxFragmentLength(1000); err == nil {
+		t.Fatal("expected an error for an invalid length")
+	}
+	if err := client_ctx.SetMaxFragmentLength(1024); err != nil {
+		t.Fatal(err)
+	}
+	lengths := recordsFor(t, newTestServerCtx(t), client_ctx, nil, data)
+	if max := maxRecord(lengths); max > 1024+recordOverhead {
+		t.Fatalf("largest record was %d bytes", max)
+	}
+
+	// connections override the context
+	lengths = recordsFor(t, newTestServerCtx(t), client_ctx,
+		func(server, client *Conn) {
+			if err := client.SetMaxFragmentLength(512); err != nil {
+				t.Fatal(err)
+			}
+		}, data)
+	if max := maxRecord(lengths); max > 512+recordOverhead {
+		t.Fatalf("largest record was %d bytes", max)
+	}
+}
+
+func TestDynamicRecordSizing(t *testing.T) {
+	data := make([]byte, 256*1024)
+	server_ctx := newTestServerCtx(t)
+	server_ctx.SetDynamicRecordSizing(true)
+	// TLS 1.3 tickets would come first
+	client_ctx, err := NewCtxWithVersion(TLSv1_2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lengths := recordsFor(t, server_ctx, client_ctx, nil, data)
+	if lengths[0] > smallRecordSize+recordOverhead {
+		t.Fatalf("first record was %d bytes", lengths[0])
+	}
+	if lengths[1] <= lengths[0] {
+		t.Fatalf("records didn't grow: %v", lengths[:2])
+	}
+	if max := maxRecord(lengths); max < SSLRecordSize {
+		t.Fatalf("largest record was %d bytes", max)
+	}
+
+	// and connections can opt out
+	lengths = recordsFor(t, server_ctx, client_ctx,
+		func(server, client *Conn) {
+			server.SetDynamicRecordSizing(false)
+		}, data)
+	if lengths[0] < SSLRecordSize {
+		t.Fatalf("first record was %d bytes", lengths[0])
+	}
+}
@@ -0,0 +1,389 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <stddef.h>
+#include <openssl/ssl.h>
+
+#ifndef TLS1_3_VERSION
+#define TLS1_3_VERSION 0x0304
+#endif
+
+#ifndef SSL_OP_NO_RENEGOTIATION
+#define SSL_OP_NO_RENEGOTIATION 0
+#endif
+
+#ifndef SSL_OP_ALLOW_CLIENT_RENEGOTIATION
+#define SSL_OP_ALLOW_CLIENT_RENEGOTIATION 0
+#endif
+
+#ifndef SSL_AD_NO_RENEGOTIATION
+#define SSL_AD_NO_RENEGOTIATION 100
+#endif
+
+#define RENEGOTIATION_HANDSHAKE_DONE 1
+#define RENEGOTIATION_ATTEMPTED 2
+// set by Conn.Renegotiate until its handshake starts
+#define RENEGOTIATION_LOCAL 4
+// whether the refused renegotiation was the peer's
+#define RENEGOTIATION_BY_PEER 8
+#define RENEGOTIATION_IN_PROGRESS 16
+// the bits above count the handshakes started after the first one completed
+#define RENEGOTIATION_COUNT_SHIFT 5
+
+// as for RenegotiationPolicy
+#define RENEGOTIATE_NEVER 0
+#define RENEGOTIATE_SERVER_INITIATED 1
+#define RENEGOTIATE_FREELY 2
+
+static int renegotiation_idx = -1;
+// set once renegotiations are checked on the context
+static int renegotiation_watch_idx = -1;
+static int renegotiation_policy_idx = -1;
+static int renegotiation_max_idx = -1;
+
+static void init_renegotiation_idx() {
+    renegotiation_idx = SSL_get_ex_new_index(0, NULL, NULL, NULL, NULL);
+    renegotiation_watch_idx = SSL_CTX_get_ex_new_index(0, NULL, NULL, NULL,
+        NULL);
+    renegotiation_policy_idx = SSL_CTX_get_ex_new_index(0, NULL, NULL, NULL,
+        NULL);
+    renegotiation_max_idx = SSL_CTX_get_ex_new_index(0, NULL, NULL, NULL,
+        NULL);
+}
+
+// renegotiation_info_cb flags any handshake starting after the first one
+// completed that the context's policy or renegotiation limit disallows, and
+// any renegotiation OpenSSL declines with a no_renegotiation alert, either
+// side's. Once a connection reaches the limit, it has OpenSSL decline any
+// more. Every info callback this package installs calls it, see trace.c, so
+// that none replaces the checks. TLS 1.3 has no renegotiation, and its
+// post-handshake messages also trigger SSL_CB_HANDSHAKE_START on some
+// versions, so it is ignored.
+void renegotiation_info_cb(const SSL *ssl, int where, int ret) {
+    size_t state;
+    int by_peer;
+    SSL_CTX *ctx = SSL_get_SSL_CTX(ssl);
+    // one more than the policy, or 0 if none was set
+    size_t policy = (size_t)SSL_CTX_get_ex_data(ctx,
+        renegotiation_policy_idx);
+    // one more than the limit, or 0 for none
+    size_t max = (size_t)SSL_CTX_get_ex_data(ctx, renegotiation_max_idx);
+    if (!(where & (SSL_CB_HANDSHAKE_START | SSL_CB_HANDSHAKE_DONE |
+            SSL_CB_ALERT)))
+        return;
+    if (SSL_CTX_get_ex_data(ctx, renegotiation_watch_idx) == NULL)
+        return;
+    if (SSL_version(ssl) == TLS1_3_VERSION)
+        return;
+    policy = policy == 0 ? RENEGOTIATE_FREELY : policy - 1;
+    state = (size_t)SSL_get_ex_data(ssl, renegotiation_idx);
+    if (where & SSL_CB_ALERT) {
+        if ((ret & 0xff) != SSL_AD_NO_RENEGOTIATION ||
+                state & RENEGOTIATION_ATTEMPTED)
+            return;
+        // declined before its handshake started, if it did at all
+        if (!(state & RENEGOTIATION_IN_PROGRESS))
+            state += 1 << RENEGOTIATION_COUNT_SHIFT;
+        state |= RENEGOTIATION_ATTEMPTED;
+        // this side declines the peer's renegotiation, the peer this side's
+        if (where & SSL_CB_WRITE)
+            state |= RENEGOTIATION_BY_PEER;
+    } else if (where & SSL_CB_HANDSHAKE_DONE) {
+        state |= RENEGOTIATION_HANDSHAKE_DONE;
+        state &= ~(size_t)RENEGOTIATION_IN_PROGRESS;
+#ifdef SSL_OP_NO_RENEGOTIATION
+        if (max != 0 && (state >> RENEGOTIATION_COUNT_SHIFT) + 1 >= max)
+            SSL_set_options((SSL *)ssl, SSL_OP_NO_RENEGOTIATION);
+#endif
+    } else if (state & RENEGOTIATION_HANDSHAKE_DONE) {
+        // servers' own renegotiations stay pending across the HelloRequest
+        // and the handshake the client answers it with
+        if (SSL_is_server(ssl))
+            by_peer = !SSL_renegotiate_pending((SSL *)ssl);
+        else
+            by_peer = !(state & RENEGOTIATION_LOCAL);
+        state &= ~(size_t)RENEGOTIATION_LOCAL;
+        state |= RENEGOTIATION_IN_PROGRESS;
+        state += 1 << RENEGOTIATION_COUNT_SHIFT;
+        if (!(state & RENEGOTIATION_ATTEMPTED) &&
+                (policy == RENEGOTIATE_NEVER ||
+                (policy == RENEGOTIATE_SERVER_INITIATED &&
+                SSL_is_server(ssl) && by_peer) ||
+                (max != 0 && (state >> RENEGOTIATION_COUNT_SHIFT) >= max))) {
+            state |= RENEGOTIATION_ATTEMPTED;
+            if (by_peer)
+                state |= RENEGOTIATION_BY_PEER;
+        }
+    }
+    SSL_set_ex_data((SSL *)ssl, renegotiation_idx, (void *)state);
+}
+
+static void install_renegotiation_info_cb(SSL_CTX *ctx) {
+    SSL_CTX_set_ex_data(ctx, renegotiation_watch_idx, (void *)1);
+    // the info callback of SetInfoCallback runs the checks as well
+    if (SSL_CTX_get_info_callback(ctx) == NULL)
+        SSL_CTX_set_info_callback(ctx, renegotiation_info_cb);
+}
+
+static void OUR_SSL_CTX_set_renegotiation_policy(SSL_CTX *ctx,
+        int policy) {
+    // what the info callback is left to enforce
+    int check = RENEGOTIATE_FREELY;
+    SSL_CTX_clear_options(ctx,
+        SSL_OP_NO_RENEGOTIATION | SSL_OP_ALLOW_CLIENT_RENEGOTIATION);
+    switch (policy) {
+    case RENEGOTIATE_NEVER:
+        if (SSL_OP_NO_RENEGOTIATION != 0)
+            SSL_CTX_set_options(ctx, SSL_OP_NO_RENEGOTIATION);
+        else
+            check = policy;
+        break;
+    case RENEGOTIATE_SERVER_INITIATED:
+        // servers on 3.0 and newer decline clients' unless allowed
+        if (SSL_OP_ALLOW_CLIENT_RENEGOTIATION == 0)
+            check = policy;
+        break;
+    default:
+        SSL_CTX_set_options(ctx, SSL_OP_ALLOW_CLIENT_RENEGOTIATION);
+        break;
+    }
+    SSL_CTX_set_ex_data(ctx, renegotiation_policy_idx,
+        (void *)(size_t)(check + 1));
+    // also to see the renegotiations OpenSSL declines
+    if (policy != RENEGOTIATE_FREELY)
+        install_renegotiation_info_cb(ctx);
+}
+
+static void OUR_SSL_CTX_watch_renegotiations(SSL_CTX *ctx) {
+    install_renegotiation_info_cb(ctx);
+}
+
+static void OUR_SSL_CTX_set_max_renegotiations(SSL_CTX *ctx, int max) {
+    SSL_CTX_set_ex_data(ctx, renegotiation_max_idx,
+        (void *)(size_t)(max < 0 ? 0 : max + 1));
+    if (max >= 0)
+        install_renegotiation_info_cb(ctx);
+}
+
+static long SSL_get_secure_renegotiation_support_not_a_macro(SSL *ssl) {
+    return SSL_get_secure_renegotiation_support(ssl);
+}
+
+static long SSL_total_renegotiations_not_a_macro(SSL *ssl) {
+    return SSL_total_renegotiations(ssl);
+}
+
+static size_t OUR_SSL_renegotiation_state(SSL *ssl) {
+    return (size_t)SSL_get_ex_data(ssl, renegotiation_idx);
+}
+
+// OUR_SSL_renegotiate returns 0 without starting a renegotiation
+// SSL_OP_NO_RENEGOTIATION refuses, and -1 if SSL_renegotiate fails.
+static int OUR_SSL_renegotiate(SSL *ssl) {
+    size_t state = (size_t)SSL_get_ex_data(ssl, renegotiation_idx);
+    if (SSL_get_options(ssl) & SSL_OP_NO_RENEGOTIATION)
+        return 0;
+    SSL_set_ex_data(ssl, renegotiation_idx,
+        (void *)(state | RENEGOTIATION_LOCAL));
+    if (SSL_renegotiate(ssl) != 1) {
+        SSL_set_ex_data(ssl, renegotiation_idx, (void *)state);
+        return -1;
+    }
+    return 1;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+)
+
+// RenegotiationError is returned once a renegotiation the context's
+// RenegotiationPolicy or renegotiation limit disallows has begun, or one
+// either side declined with a no_renegotiation alert. The connection can't be
+// used after it, and Read, Write and Handshake keep returning it. Conn's
+// Renegotiate also returns it, leaving the connection usable, for a
+// renegotiation NoRenegotiation keeps from starting at all.
+type RenegotiationError struct {
+	// PeerInitiated says whether the peer started the refused
+	// renegotiation, rather than this side.
+	PeerInitiated bool
+	// Attempts counts the renegotiations started on the connection,
+	// including the refused one.
+	Attempts int
+}
+
+func (e *RenegotiationError) Error() string {
+	side := "peer"
+	if !e.PeerInitiated {
+		side = "local"
+	}
+	return fmt.Sprintf("%s renegotiation refused (renegotiation %d)", side,
+		e.Attempts)
+}
+
+func init() {
+	C.init_renegotiation_idx()
+}
+
+// RenegotiationPolicy says which renegotiations connections allow. TLS 1.3
+// has no renegotiation, whatever the policy.
+type RenegotiationPolicy int
+
+const (
+	// RenegotiateNever refuses every renegotiation, see
+	// DisableRenegotiation.
+	RenegotiateNever RenegotiationPolicy = C.RENEGOTIATE_NEVER
+	// RenegotiateServerInitiated lets servers renegotiate, with
+	// Conn.Renegotiate, but refuses renegotiations clients start, which
+	// otherwise let a client force expensive handshakes on a server at will.
+	// It is what OpenSSL 3.0 and newer do by default.
+	RenegotiateServerInitiated RenegotiationPolicy = C.RENEGOTIATE_SERVER_INITIATED
+	// RenegotiateFreely allows renegotiations from either side. It is what
+	// OpenSSL before 3.0 does by default.
+	RenegotiateFreely RenegotiationPolicy = C.RENEGOTIATE_FREELY
+)
+
+// SetRenegotiationPolicy sets which renegotiations connections using the
+// context allow. Refused renegotiations are declined with a no_renegotiation
+// alert where OpenSSL can: with NoRenegotiation on 1.1.0h and newer for
+// RenegotiateNever, and by servers on 3.0 and newer for
+// RenegotiateServerInitiated. Otherwise they're refused once they begin.
+// Either way the connection is failed, with Read, Write and Handshake
+// returning a *RenegotiationError from then on. The policy replaces the
+// NoRenegotiation option and, on 3.0, the option allowing client
+// renegotiation.
+//
+// Unless the policy is RenegotiateFreely, connections are checked from the
+// context's info callback. The callbacks SetInfoCallback and SetMetrics
+// install run the check too, so either can be used alongside a policy.
+func (c *Ctx) SetRenegotiationPolicy(policy RenegotiationPolicy) {
+	C.OUR_SSL_CTX_set_renegotiation_policy(c.ctx, C.int(policy))
+}
+
+// DisableRenegotiation makes connections using the context refuse any
+// renegotiation, which otherwise lets a client force expensive handshakes on
+// a server at will. It is SetRenegotiationPolicy(RenegotiateNever): with
+// OpenSSL 1.1.0h and newer OpenSSL declines a peer's attempt with a
+// no_renegotiation alert, and won't start one itself. Older libraries can't
+// decline, so the renegotiation is refused once it begins, whichever side
+// started it. Either way the connection is then failed with a
+// *RenegotiationError.
+func (c *Ctx) DisableRenegotiation() {
+	c.SetRenegotiationPolicy(RenegotiateNever)
+}
+
+// watchRenegotiations installs the info callback reporting renegotiations
+// OpenSSL declines for the NoRenegotiation option, with no policy of its own.
+func (c *Ctx) watchRenegotiations() {
+	C.OUR_SSL_CTX_watch_renegotiations(c.ctx)
+}
+
+// SetMaxRenegotiations limits connections using the context to n
+// renegotiations, counting those either side starts, so that a peer the
+// RenegotiationPolicy lets renegotiate can't force handshake after handshake
+// on the connection. Once a connection reaches the limit, OpenSSL 1.1.0h and
+// newer decline any more renegotiations with a no_renegotiation alert, as
+// with NoRenegotiation; older libraries refuse them once they begin. Either
+// way the connection is failed, with Read, Write and Handshake returning a
+// *RenegotiationError from then on. A negative n removes the limit. Like
+// SetRenegotiationPolicy, this checks connections from the context's info
+// callback.
+func (c *Ctx) SetMaxRenegotiations(n int) {
+	C.OUR_SSL_CTX_set_max_renegotiations(c.ctx, C.int(n))
+}
+
+// Renegotiate starts a new handshake on a TLS 1.2 or older connection, e.g.
+// to refresh its keys or, on servers, to ask for a client certificate after
+// changing the verify mode. Clients return once the handshake completes,
+// which takes the server reading. Servers return once they have sent the
+// HelloRequest, and complete the handshake as they read the client's
+// response; clients handle one as they read. The context's
+// RenegotiationPolicy applies to the peer's as well as this side's. Use
+// KeyUpdate with TLS 1.3.
+func (c *Conn) Renegotiate() error {
+	c.mtx.Lock()
+	if c.is_shutdown {
+		c.mtx.Unlock()
+		return errors.New("connection closed")
+	}
+	if C.SSL_version(c.ssl) == C.TLS1_3_VERSION {
+		c.mtx.Unlock()
+		return errors.New("TLS 1.3 has no renegotiation, see KeyUpdate")
+	}
+	runtime.LockOSThread()
+	var err error
+	switch C.OUR_SSL_renegotiate(c.ssl) {
+	case 0:
+		state := C.OUR_SSL_renegotiation_state(c.ssl)
+		err = &RenegotiationError{
+			Attempts: int(state>>C.RENEGOTIATION_COUNT_SHIFT) + 1}
+	case -1:
+		err = errorFromErrorQueue()
+	}
+	runtime.UnlockOSThread()
+	c.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	err = tryAgain
+	for err == tryAgain {
+		err = c.handleError(c.handshake())
+	}
+	if err != nil {
+		return err
+	}
+	return c.flushOutputBuffer()
+}
+
+// renegotiationError returns a *RenegotiationError if a renegotiation was
+// refused on the connection. The caller must hold c.mtx.
+func (c *Conn) renegotiationError() error {
+	state := C.OUR_SSL_renegotiation_state(c.ssl)
+	if state&C.RENEGOTIATION_ATTEMPTED == 0 {
+		return nil
+	}
+	return &RenegotiationError{
+		PeerInitiated: state&C.RENEGOTIATION_BY_PEER != 0,
+		Attempts:      int(state >> C.RENEGOTIATION_COUNT_SHIFT)}
+}
+
+// SecureRenegotiationSupported reports whether the peer supports secure
+// renegotiation (RFC 5746), which binds renegotiations to the connection they
+// happen on. It is only meaningful once the handshake has completed. TLS 1.3
+// has no renegotiation at all, whatever this reports.
+func (c *Conn) SecureRenegotiationSupported() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return C.SSL_get_secure_renegotiation_support_not_a_macro(c.ssl) != 0
+}
+
+// LegacyRenegotiationUsed reports whether the connection has renegotiated
+// without secure renegotiation, which OpenSSL only allows with
+// AllowUnsafeLegacyRenegotiation. OpenSSL only counts the renegotiations
+// this side started, and for clients, those the server asked for;
+// renegotiations clients start aren't seen by servers.
+func (c *Conn) LegacyRenegotiationUsed() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return C.SSL_total_renegotiations_not_a_macro(c.ssl) > 0 &&
+		C.SSL_get_secure_renegotiation_support_not_a_macro(c.ssl) == 0
+}
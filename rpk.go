@@ -0,0 +1,237 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <openssl/ssl.h>
+
+#ifndef TLSEXT_cert_type_x509
+#define TLSEXT_cert_type_x509 0
+#endif
+
+#ifndef TLSEXT_cert_type_rpk
+#define TLSEXT_cert_type_rpk 2
+#endif
+
+#if OPENSSL_VERSION_NUMBER >= 0x30200000L && \
+    !defined(LIBRESSL_VERSION_NUMBER) && !defined(OPENSSL_IS_BORINGSSL)
+#define HAVE_RPK 1
+#endif
+
+static int OUR_rpk_supported() {
+#ifdef HAVE_RPK
+    return 1;
+#else
+    return 0;
+#endif
+}
+
+// sets the types the side selected by server sends or accepts, returning -1
+// before OpenSSL 3.2
+static int OUR_SSL_CTX_set1_cert_type(SSL_CTX *ctx, int server,
+        const unsigned char *types, size_t n) {
+#ifdef HAVE_RPK
+    if (server)
+        return SSL_CTX_set1_server_cert_type(ctx, types, n);
+    return SSL_CTX_set1_client_cert_type(ctx, types, n);
+#else
+    return -1;
+#endif
+}
+
+static int OUR_SSL_get_negotiated_cert_type(SSL *ssl, int server) {
+#ifdef HAVE_RPK
+    if (server)
+        return SSL_get_negotiated_server_cert_type(ssl);
+    return SSL_get_negotiated_client_cert_type(ssl);
+#else
+    return TLSEXT_cert_type_x509;
+#endif
+}
+
+// expected keys are DANE-EE records, so DANE must be enabled on the context.
+// Enabling it on the connection sets the host name certificates are checked
+// against, so it is kept to the SNI name, if any.
+static int OUR_SSL_add_expected_rpk(SSL *ssl, EVP_PKEY *key) {
+#ifdef HAVE_RPK
+    if (SSL_get0_dane(ssl) == NULL && SSL_dane_enable(ssl,
+            SSL_get_servername(ssl, TLSEXT_NAMETYPE_host_name)) <= 0)
+        return 0;
+    return SSL_add_expected_rpk(ssl, key);
+#else
+    return -1;
+#endif
+}
+
+static EVP_PKEY *OUR_SSL_get1_peer_rpk(SSL *ssl) {
+#ifdef HAVE_RPK
+    EVP_PKEY *key = SSL_get0_peer_rpk(ssl);
+    if (key != NULL)
+        EVP_PKEY_up_ref(key);
+    return key;
+#else
+    return NULL;
+#endif
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"runtime"
+)
+
+// CertificateType is the kind of credential a peer authenticates with
+// during the handshake (RFC 7250).
+type CertificateType int
+
+const (
+	// CertificateTypeX509 is the usual X.509 certificate and chain.
+	CertificateTypeX509 CertificateType = C.TLSEXT_cert_type_x509
+	// CertificateTypeRawPublicKey is a bare public key, in its
+	// SubjectPublicKeyInfo encoding, which the peer must know in advance
+	// as it carries no name or issuer to verify.
+	CertificateTypeRawPublicKey CertificateType = C.TLSEXT_cert_type_rpk
+)
+
+var rpkUnsupported = errors.New(
+	"raw public keys require OpenSSL 3.2 or newer")
+
+func (c *Ctx) setCertificateTypes(server C.int,
+	types []CertificateType) error {
+	if len(types) == 0 {
+		return errors.New("no certificate types given")
+	}
+	ctypes := make([]C.uchar, len(types))
+	for i, t := range types {
+		ctypes[i] = C.uchar(t)
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	switch C.OUR_SSL_CTX_set1_cert_type(c.ctx, server, &ctypes[0],
+		C.size_t(len(ctypes))) {
+	case 1:
+		return nil
+	case -1:
+		return rpkUnsupported
+	default:
+		return errorFromErrorQueue()
+	}
+}
+
+// SetServerCertificateTypes sets the kinds of credential servers present,
+// in order of preference: on servers using the context, those they can
+// send, and on clients, those they accept. Including
+// CertificateTypeRawPublicKey lets a server authenticate with just the
+// public key of its private key, see SetExpectedPeerKeys. Peers that don't
+// support the negotiation get a certificate, so servers offering
+// CertificateTypeX509 as well need one. It requires OpenSSL 3.2 or newer.
+func (c *Ctx) SetServerCertificateTypes(types []CertificateType) error {
+	return c.setCertificateTypes(1, types)
+}
+
+// SetClientCertificateTypes is SetServerCertificateTypes for the
+// credentials clients present: on servers using the context, those they
+// accept, and on clients, those they can send.
+func (c *Ctx) SetClientCertificateTypes(types []CertificateType) error {
+	return c.setCertificateTypes(0, types)
+}
+
+// SetExpectedPeerKeys makes connections created with the context from now
+// on accept a peer authenticating with a raw public key only if it is one
+// of keys, e.g. those of a fleet of devices provisioned with them. It
+// enables DANE on the context, as the keys are checked as DANE-EE records,
+// and the verify mode must include VerifyPeer for a mismatch to fail the
+// handshake. Peers presenting certificates are verified as usual, so
+// restrict the certificate types to CertificateTypeRawPublicKey to only
+// accept the keys. A nil keys stops adding expected keys to new
+// connections. It requires OpenSSL 3.2 or newer.
+func (c *Ctx) SetExpectedPeerKeys(keys []PublicKey) error {
+	if C.OUR_rpk_supported() == 0 {
+		return rpkUnsupported
+	}
+	if len(keys) > 0 {
+		if err := c.EnableDANE(); err != nil {
+			return err
+		}
+	}
+	c.expected_peer_keys = keys
+	return nil
+}
+
+// AddExpectedPeerKeys adds to the raw public keys the connection accepts
+// from its peer, as for Ctx.SetExpectedPeerKeys, e.g. a key looked up for
+// the device a client connects to. The context must have DANE enabled,
+// with Ctx.EnableDANE or Ctx.SetExpectedPeerKeys, and this enables it on
+// the connection, so it can't be combined with EnableDANE. Call it before
+// the handshake.
+func (c *Conn) AddExpectedPeerKeys(keys []PublicKey) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	for _, key := range keys {
+		pkey := key.acquirePKey()
+		if pkey == nil {
+			return keyFreed
+		}
+		rv := C.OUR_SSL_add_expected_rpk(c.ssl, pkey)
+		C.EVP_PKEY_free(pkey)
+		switch {
+		case rv == -1:
+			return rpkUnsupported
+		case rv <= 0:
+			return errorFromErrorQueue()
+		}
+	}
+	return nil
+}
+
+// ServerCertificateType returns the kind of credential the server
+// presented, once the handshake has completed.
+func (c *Conn) ServerCertificateType() CertificateType {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return CertificateType(C.OUR_SSL_get_negotiated_cert_type(c.ssl, 1))
+}
+
+// ClientCertificateType returns the kind of credential the client presents,
+// if it is asked for one, once the handshake has completed.
+func (c *Conn) ClientCertificateType() CertificateType {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return CertificateType(C.OUR_SSL_get_negotiated_cert_type(c.ssl, 0))
+}
+
+// PeerRawPublicKey returns the raw public key the peer authenticated with,
+// if it presented one rather than a certificate. See PeerCertificate for
+// certificates.
+func (c *Conn) PeerRawPublicKey() (PublicKey, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.is_shutdown {
+		return nil, errors.New("connection closed")
+	}
+	if C.OUR_rpk_supported() == 0 {
+		return nil, rpkUnsupported
+	}
+	key := C.OUR_SSL_get1_peer_rpk(c.ssl)
+	if key == nil {
+		return nil, errors.New("no peer raw public key found")
+	}
+	return newPKey(key), nil
+}
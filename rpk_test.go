@@ -0,0 +1,100 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestRawPublicKeys(t *testing.T) {
+	server_key, err := LoadPrivateKeyFromPEM(keyBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpk_only := []CertificateType{CertificateTypeRawPublicKey}
+
+	// handshake connects to a server presenting its raw public key with a
+	// client expecting expected
+	handshake := func(expected PublicKey) (*Conn, error) {
+		server_ctx := newTestServerCtx(t)
+		if err := server_ctx.SetServerCertificateTypes(
+			rpk_only); err == rpkUnsupported {
+			t.Skip(err)
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		client_ctx, err := NewCtx()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := client_ctx.SetServerCertificateTypes(rpk_only); err != nil {
+			t.Fatal(err)
+		}
+		err = client_ctx.SetExpectedPeerKeys([]PublicKey{expected})
+		if err != nil {
+			t.Fatal(err)
+		}
+		client_ctx.SetVerifyMode(VerifyPeer)
+		server_conn, client_conn := NetPipe(t)
+		server_conn.SetDeadline(time.Now().Add(10 * time.Second))
+		client_conn.SetDeadline(time.Now().Add(10 * time.Second))
+		server, err := Server(server_conn, server_ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+		client, err := Client(client_conn, client_ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go server.Handshake()
+		return client, client.Handshake()
+	}
+
+	client, err := handshake(server_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if typ := client.ServerCertificateType(); typ != CertificateTypeRawPublicKey {
+		t.Fatalf("expected a raw public key, got certificate type %d", typ)
+	}
+	peer_key, err := client.PeerRawPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := peer_key.MarshalPKIXPublicKeyDER()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := server_key.MarshalPKIXPublicKeyDER()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("peer raw public key isn't the server's")
+	}
+
+	client, err = handshake(generateTestRSAKey(t))
+	if err == nil {
+		t.Fatal("expected a raw public key other than the expected one to " +
+			"be refused")
+	}
+	client.Close()
+}
@@ -0,0 +1,413 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+// #include <stdlib.h>
+// #include <openssl/evp.h>
+//
+// #ifndef EVP_CTRL_GCM_GET_TAG
+// #define EVP_CTRL_GCM_GET_TAG 0
+// #define EVP_CTRL_GCM_SET_TAG 0
+// #endif
+//
+// static int EVP_CIPHER_is_gcm(const EVP_CIPHER *c) {
+// #ifdef EVP_CIPH_GCM_MODE
+//     return EVP_CIPHER_mode(c) == EVP_CIPH_GCM_MODE;
+// #else
+//     return 0;
+// #endif
+// }
+//
+// static int EVP_CIPHER_is_aead(const EVP_CIPHER *c) {
+// #ifdef EVP_CIPH_FLAG_AEAD_CIPHER
+//     return (EVP_CIPHER_flags(c) & EVP_CIPH_FLAG_AEAD_CIPHER) != 0;
+// #else
+//     return 0;
+// #endif
+// }
+import "C"
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"unsafe"
+)
+
+// Sealed boxes are laid out as a small header followed by the ciphertext.
+// The header holds the magic "SEAL", a version byte, the cipher nid, the IV
+// length and IV, and the recipient count, then for each recipient the SHA-256
+// of its DER-encoded PKIX public key, the wrapped key length and the wrapped
+// key. All integers are 16 bit big endian. With GCM the header is
+// authenticated along with the ciphertext, and the tag follows the
+// ciphertext.
+const (
+	sealMagic   = "SEAL"
+	sealVersion = 1
+)
+
+var (
+	NoRecipientKey          = errors.New("sealed box is not addressed to this key")
+	SealAuthenticationError = errors.New("sealed box failed authentication")
+)
+
+func sealKeyId(key PublicKey) ([32]byte, error) {
+	der, err := key.MarshalPKIXPublicKeyDER()
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return SHA256(der)
+}
+
+func defaultSealCipher(c *Cipher) (*Cipher, error) {
+	if c == nil {
+		return GetCipherByName("aes-256-gcm")
+	}
+	if C.EVP_CIPHER_is_aead(c.ptr) != 0 && C.EVP_CIPHER_is_gcm(c.ptr) == 0 {
+		return nil, errors.New("only GCM is supported among AEAD ciphers")
+	}
+	return c, nil
+}
+
+type sealWriter struct {
+	w      io.Writer
+	ctx    *encryptionCipherCtx
+	gcm    bool
+	closed bool
+}
+
+// NewSealWriter returns a WriteCloser that encrypts everything written to it
+// with a fresh random key for cipher c (AES-256-GCM if c is nil), and writes
+// the result to w. The random key is wrapped with every recipient's RSA public
+// key (EVP_SealInit), so any one of the matching private keys can open the
+// box with NewOpenReader. Close must be called to flush the final block and
+// write the tag; it does not close w.
+//
+// With GCM, opening a box that was modified in any way fails with
+// SealAuthenticationError. Other ciphers provide confidentiality only. In
+// either case anyone with a recipient's public key can seal a box for it, so
+// if the recipient needs to know who sealed it, sign the box separately.
+func NewSealWriter(w io.Writer, c *Cipher, recipients ...PublicKey) (
+	io.WriteCloser, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("no recipients provided")
+	}
+	if len(recipients) > 0xffff {
+		return nil, errors.New("too many recipients")
+	}
+	c, err := defaultSealCipher(c)
+	if err != nil {
+		return nil, err
+	}
+	ctx, err := newCipherCtx()
+	if err != nil {
+		return nil, err
+	}
+
+	npubk := len(recipients)
+	pubk := make([]*C.EVP_PKEY, npubk)
+	ek := make([]*C.uchar, npubk)
+	ekl := make([]C.int, npubk)
+	for i, recipient := range recipients {
+		pubk[i] = recipient.acquirePKey()
+		if pubk[i] == nil {
+			return nil, keyFreed
+		}
+		defer C.EVP_PKEY_free(pubk[i])
+		ek[i] = (*C.uchar)(C.malloc(C.size_t(C.EVP_PKEY_size(pubk[i]))))
+		if ek[i] == nil {
+			return nil, errors.New("failed to allocate wrapped key buffer")
+		}
+		defer C.free(unsafe.Pointer(ek[i]))
+	}
+	iv := make([]byte, C.EVP_MAX_IV_LENGTH)
+	if C.EVP_SealInit(ctx.ctx, c.ptr, &ek[0], &ekl[0],
+		(*C.uchar)(&iv[0]), &pubk[0], C.int(npubk)) == 0 {
+		return nil, errors.New("failed to initialize seal")
+	}
+	iv = iv[:ctx.IVSize()]
+
+	var header bytes.Buffer
+	header.WriteString(sealMagic)
+	header.WriteByte(sealVersion)
+	binary.Write(&header, binary.BigEndian, uint16(c.Nid()))
+	binary.Write(&header, binary.BigEndian, uint16(len(iv)))
+	header.Write(iv)
+	binary.Write(&header, binary.BigEndian, uint16(npubk))
+	for i, recipient := range recipients {
+		id, err := sealKeyId(recipient)
+		if err != nil {
+			return nil, err
+		}
+		header.Write(id[:])
+		binary.Write(&header, binary.BigEndian, uint16(ekl[i]))
+		header.Write(C.GoBytes(unsafe.Pointer(ek[i]), ekl[i]))
+	}
+	gcm := C.EVP_CIPHER_is_gcm(c.ptr) != 0
+	if gcm {
+		var outlen C.int
+		if C.EVP_EncryptUpdate(ctx.ctx, nil, &outlen,
+			(*C.uchar)(&header.Bytes()[0]), C.int(header.Len())) != 1 {
+			return nil, errors.New("failed to authenticate sealed box header")
+		}
+	}
+	if _, err := w.Write(header.Bytes()); err != nil {
+		return nil, err
+	}
+	return &sealWriter{
+		w:   w,
+		ctx: &encryptionCipherCtx{cipherCtx: ctx},
+		gcm: gcm}, nil
+}
+
+func (s *sealWriter) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, errors.New("write to closed seal writer")
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	out, err := s.ctx.EncryptUpdate(p)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := s.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *sealWriter) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	out, err := s.ctx.EncryptFinal()
+	if err != nil {
+		return err
+	}
+	if s.gcm {
+		tag, err := s.ctx.getCtrlBytes(C.EVP_CTRL_GCM_GET_TAG, GCM_TAG_MAXLEN,
+			GCM_TAG_MAXLEN)
+		if err != nil {
+			return err
+		}
+		out = append(out, tag...)
+	}
+	_, err = s.w.Write(out)
+	return err
+}
+
+type openReader struct {
+	r   io.Reader
+	ctx *decryptionCipherCtx
+	gcm bool
+	in  []byte
+	// held back from decryption until we know whether it is the tag
+	tag  []byte
+	out  []byte
+	done bool
+}
+
+// NewOpenReader reads a box written by NewSealWriter from r and returns a
+// Reader producing the plaintext. key must be the private half of one of the
+// box's recipients, otherwise NoRecipientKey is returned.
+//
+// With GCM, the tag is only checked once the end of the box is reached, at
+// which point Read returns SealAuthenticationError if the box was modified.
+// Until Read has returned io.EOF, the plaintext must not be trusted. Open
+// checks the tag before returning anything.
+func NewOpenReader(r io.Reader, key PrivateKey) (io.Reader, error) {
+	// keep the header to authenticate it
+	var header bytes.Buffer
+	box := r
+	r = io.TeeReader(box, &header)
+	var magic [5]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return nil, err
+	}
+	if string(magic[:4]) != sealMagic {
+		return nil, errors.New("not a sealed box")
+	}
+	if magic[4] != sealVersion {
+		return nil, fmt.Errorf("unsupported sealed box version %d", magic[4])
+	}
+	var nid, ivlen uint16
+	if err := binary.Read(r, binary.BigEndian, &nid); err != nil {
+		return nil, err
+	}
+	c, err := GetCipherByNid(int(nid))
+	if err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &ivlen); err != nil {
+		return nil, err
+	}
+	if int(ivlen) != c.IVSize() {
+		return nil, fmt.Errorf("bad IV size (%d bytes instead of %d)",
+			ivlen, c.IVSize())
+	}
+	iv := make([]byte, C.EVP_MAX_IV_LENGTH)
+	if _, err := io.ReadFull(r, iv[:ivlen]); err != nil {
+		return nil, err
+	}
+
+	our_id, err := sealKeyId(key)
+	if err != nil {
+		return nil, err
+	}
+	var count uint16
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return nil, err
+	}
+	var ek []byte
+	for i := 0; i < int(count); i++ {
+		var id [32]byte
+		var ekl uint16
+		if _, err := io.ReadFull(r, id[:]); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, binary.BigEndian, &ekl); err != nil {
+			return nil, err
+		}
+		wrapped := make([]byte, ekl)
+		if _, err := io.ReadFull(r, wrapped); err != nil {
+			return nil, err
+		}
+		if id == our_id {
+			ek = wrapped
+		}
+	}
+	if len(ek) == 0 {
+		return nil, NoRecipientKey
+	}
+
+	pkey := key.acquirePKey()
+	if pkey == nil {
+		return nil, keyFreed
+	}
+	defer C.EVP_PKEY_free(pkey)
+	ctx, err := newCipherCtx()
+	if err != nil {
+		return nil, err
+	}
+	if C.EVP_OpenInit(ctx.ctx, c.ptr, (*C.uchar)(&ek[0]), C.int(len(ek)),
+		(*C.uchar)(&iv[0]), pkey) == 0 {
+		return nil, errors.New("failed to unwrap sealed box key")
+	}
+	gcm := C.EVP_CIPHER_is_gcm(c.ptr) != 0
+	if gcm {
+		var outlen C.int
+		if C.EVP_DecryptUpdate(ctx.ctx, nil, &outlen,
+			(*C.uchar)(&header.Bytes()[0]), C.int(header.Len())) != 1 {
+			return nil, errors.New("failed to authenticate sealed box header")
+		}
+	} else if C.EVP_CIPHER_is_aead(c.ptr) != 0 {
+		return nil, errors.New("only GCM is supported among AEAD ciphers")
+	}
+	return &openReader{
+		r:   box,
+		ctx: &decryptionCipherCtx{cipherCtx: ctx},
+		gcm: gcm,
+		in:  make([]byte, SSLRecordSize)}, nil
+}
+
+func (o *openReader) Read(p []byte) (int, error) {
+	for len(o.out) == 0 {
+		if o.done {
+			return 0, io.EOF
+		}
+		n, err := o.r.Read(o.in)
+		if n > 0 {
+			in := o.in[:n]
+			if o.gcm {
+				in = append(o.tag, in...)
+				split := len(in) - GCM_TAG_MAXLEN
+				if split < 0 {
+					split = 0
+				}
+				o.tag = append([]byte(nil), in[split:]...)
+				in = in[:split]
+			}
+			if len(in) > 0 {
+				out, err := o.ctx.DecryptUpdate(in)
+				if err != nil {
+					return 0, err
+				}
+				o.out = out
+			}
+		}
+		if err == io.EOF {
+			if o.gcm {
+				if len(o.tag) != GCM_TAG_MAXLEN {
+					return 0, SealAuthenticationError
+				}
+				err := o.ctx.setCtrlBytes(C.EVP_CTRL_GCM_SET_TAG, GCM_TAG_MAXLEN,
+					o.tag)
+				if err != nil {
+					return 0, err
+				}
+			}
+			final, err := o.ctx.DecryptFinal()
+			if err != nil {
+				if o.gcm {
+					return 0, SealAuthenticationError
+				}
+				return 0, err
+			}
+			o.out = append(o.out, final...)
+			o.done = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, o.out)
+	o.out = o.out[n:]
+	return n, nil
+}
+
+// Seal is a convenience wrapper around NewSealWriter for in-memory data.
+func Seal(c *Cipher, plaintext []byte, recipients ...PublicKey) (
+	[]byte, error) {
+	var buf bytes.Buffer
+	w, err := NewSealWriter(&buf, c, recipients...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Open is a convenience wrapper around NewOpenReader for in-memory data.
+func Open(sealed []byte, key PrivateKey) ([]byte, error) {
+	r, err := NewOpenReader(bytes.NewReader(sealed), key)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, r); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
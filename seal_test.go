@@ -0,0 +1,117 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"io"
+	"testing"
+)
+
+func generateTestRSAKey(t testing.TB) PrivateKey {
+	std, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := FromStdlibPrivateKey(std)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestSealOpen(t *testing.T) {
+	alice := generateTestRSAKey(t)
+	bob := generateTestRSAKey(t)
+	eve := generateTestRSAKey(t)
+
+	plaintext := make([]byte, 3*SSLRecordSize+17)
+	io.ReadFull(rand.Reader, plaintext)
+
+	var buf bytes.Buffer
+	w, err := NewSealWriter(&buf, nil, alice, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// write in odd-sized pieces to exercise the streaming path
+	for rest := plaintext; len(rest) > 0; {
+		n := 1000
+		if n > len(rest) {
+			n = len(rest)
+		}
+		if _, err := w.Write(rest[:n]); err != nil {
+			t.Fatal(err)
+		}
+		rest = rest[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	sealed := buf.Bytes()
+
+	for _, key := range []PrivateKey{alice, bob} {
+		opened, err := Open(sealed, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(opened, plaintext) {
+			t.Fatal("opened box does not match plaintext")
+		}
+	}
+
+	if _, err := Open(sealed, eve); err != NoRecipientKey {
+		t.Fatalf("expected NoRecipientKey, got %v", err)
+	}
+}
+
+func TestSealTamper(t *testing.T) {
+	key := generateTestRSAKey(t)
+	plaintext := make([]byte, 2*SSLRecordSize+5)
+	io.ReadFull(rand.Reader, plaintext)
+	sealed, err := Seal(nil, plaintext, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened, err := Open(sealed, key); err != nil ||
+		!bytes.Equal(opened, plaintext) {
+		t.Fatalf("failed to open untouched box: %v", err)
+	}
+
+	// offsets into the nid, the IV, the ciphertext and the tag
+	for _, offset := range []int{6, 10, len(sealed) / 2, len(sealed) - 1} {
+		tampered := append([]byte(nil), sealed...)
+		tampered[offset] ^= 0x01
+		_, err := Open(tampered, key)
+		if err == nil {
+			t.Fatalf("opened box modified at offset %d", offset)
+		}
+	}
+	for _, cut := range []int{1, GCM_TAG_MAXLEN, GCM_TAG_MAXLEN + 1} {
+		_, err := Open(sealed[:len(sealed)-cut], key)
+		if err != SealAuthenticationError {
+			t.Fatalf("expected SealAuthenticationError for box missing %d "+
+				"bytes, got %v", cut, err)
+		}
+	}
+	tampered := append([]byte(nil), sealed...)
+	tampered[len(sealed)/2] ^= 0x01
+	if _, err := Open(tampered, key); err != SealAuthenticationError {
+		t.Fatalf("expected SealAuthenticationError, got %v", err)
+	}
+}
@@ -0,0 +1,423 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+// Package selftest measures handshakes per second and bulk throughput of
+// the openssl package against crypto/tls on the running machine, per cipher
+// suite, so that deployments can check the linked OpenSSL pays off on their
+// hardware and catch regressions after upgrading either.
+//
+//	results, err := selftest.Run(nil)
+//	...
+//	for _, r := range results {
+//		fmt.Printf("%-12s %-45s %8.0f hs/s %8.1f MB/s\n",
+//			r.Implementation, r.CipherSuiteName, r.HandshakesPerSecond,
+//			r.BytesPerSecond/1e6)
+//	}
+//
+// Both ends of each connection run in this process over loopback TCP, so the
+// figures cover the client and the server together.
+package selftest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/spacemonkeygo/openssl"
+)
+
+// Implementation names a TLS implementation to measure.
+type Implementation string
+
+const (
+	// OpenSSL is this package's parent, backed by the linked OpenSSL.
+	OpenSSL Implementation = "openssl"
+	// CryptoTLS is Go's crypto/tls.
+	CryptoTLS Implementation = "crypto/tls"
+)
+
+// DefaultCipherSuites are the suites measured when Config.CipherSuites is
+// empty: the TLS 1.3 suites and their TLS 1.2 ECDHE-ECDSA counterparts.
+var DefaultCipherSuites = []uint16{
+	tls.TLS_AES_128_GCM_SHA256,
+	tls.TLS_AES_256_GCM_SHA384,
+	tls.TLS_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// Config controls what Run measures. The zero value measures
+// DefaultCipherSuites with both implementations for a second each.
+type Config struct {
+	// CipherSuites are the IANA IDs of the suites to measure, as crypto/tls
+	// defines them. The server certificate uses an ECDSA P-256 key, so TLS
+	// 1.2 suites must be ECDHE-ECDSA ones.
+	CipherSuites []uint16
+	// Implementations are those to measure, both if empty.
+	Implementations []Implementation
+	// Duration is how long each measurement runs, 1 second if zero.
+	Duration time.Duration
+	// WriteSize is the size of the writes throughput is measured with,
+	// 16 KiB if zero.
+	WriteSize int
+}
+
+// Result holds the measurements of one implementation with one suite.
+type Result struct {
+	Implementation  Implementation
+	CipherSuite     uint16
+	CipherSuiteName string
+	// HandshakesPerSecond counts full handshakes, without resumption.
+	HandshakesPerSecond float64
+	// BytesPerSecond is the application data rate over one connection.
+	BytesPerSecond float64
+	// Err is set, and the rates left zero, if the suite couldn't be
+	// measured, e.g. as the linked OpenSSL lacks it or crypto/tls, which
+	// picks TLS 1.3 suites itself, wouldn't negotiate it.
+	Err error
+}
+
+// Run measures each implementation with each suite in turn, and returns the
+// results in that order. It only fails if the measurements can't be set up
+// at all.
+func Run(config *Config) ([]Result, error) {
+	if config == nil {
+		config = &Config{}
+	}
+	suites := config.CipherSuites
+	if len(suites) == 0 {
+		suites = DefaultCipherSuites
+	}
+	impls := config.Implementations
+	if len(impls) == 0 {
+		impls = []Implementation{OpenSSL, CryptoTLS}
+	}
+	duration := config.Duration
+	if duration <= 0 {
+		duration = time.Second
+	}
+	write_size := config.WriteSize
+	if write_size <= 0 {
+		write_size = 16 << 10
+	}
+	creds, err := newCredentials()
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+
+	var results []Result
+	for _, suite := range suites {
+		for _, impl := range impls {
+			result := Result{
+				Implementation:  impl,
+				CipherSuite:     suite,
+				CipherSuiteName: tls.CipherSuiteName(suite)}
+			result.HandshakesPerSecond, result.BytesPerSecond, result.Err =
+				measure(impl, suite, creds, l, duration, write_size)
+			results = append(results, result)
+		}
+	}
+	return results, nil
+}
+
+func measure(impl Implementation, suite uint16, creds *credentials,
+	l net.Listener, duration time.Duration, write_size int) (
+	handshakes, bytes float64, err error) {
+	p, err := newPair(impl, suite, creds)
+	if err != nil {
+		return 0, 0, err
+	}
+	handshakes, err = p.measureHandshakes(l, duration)
+	if err != nil {
+		return 0, 0, err
+	}
+	bytes, err = p.measureThroughput(l, duration, write_size)
+	if err != nil {
+		return 0, 0, err
+	}
+	return handshakes, bytes, nil
+}
+
+// credentials are a self-signed ECDSA P-256 certificate and key.
+type credentials struct {
+	cert_pem []byte
+	key_pem  []byte
+}
+
+func newCredentials() (*credentials, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "selftest"},
+		DNSNames:     []string{"selftest"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	key_der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &credentials{
+		cert_pem: pem.EncodeToMemory(&pem.Block{
+			Type: "CERTIFICATE", Bytes: der}),
+		key_pem: pem.EncodeToMemory(&pem.Block{
+			Type: "EC PRIVATE KEY", Bytes: key_der})}, nil
+}
+
+// conn is a TLS connection from either implementation.
+type conn interface {
+	net.Conn
+	Handshake() error
+}
+
+// pair makes the server and client ends of connections with one
+// implementation, limited to one suite.
+type pair struct {
+	suite  uint16
+	server func(net.Conn) (conn, error)
+	client func(net.Conn) (conn, error)
+}
+
+func newPair(impl Implementation, suite uint16, creds *credentials) (
+	*pair, error) {
+	switch impl {
+	case OpenSSL:
+		return newOpenSSLPair(suite, creds)
+	case CryptoTLS:
+		return newCryptoTLSPair(suite, creds)
+	default:
+		return nil, fmt.Errorf("unknown implementation %q", impl)
+	}
+}
+
+func isTLS13(suite uint16) bool {
+	return suite>>8 == 0x13
+}
+
+func newOpenSSLPair(suite uint16, creds *credentials) (*pair, error) {
+	server_ctx, err := newOpenSSLCtx(suite)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := openssl.LoadCertificateFromPEM(creds.cert_pem)
+	if err != nil {
+		return nil, err
+	}
+	key, err := openssl.LoadPrivateKeyFromPEM(creds.key_pem)
+	if err != nil {
+		return nil, err
+	}
+	if err := server_ctx.UseCertificate(cert); err != nil {
+		return nil, err
+	}
+	if err := server_ctx.UsePrivateKey(key); err != nil {
+		return nil, err
+	}
+	server_ctx.SetSessionCacheMode(openssl.SessionCacheOff)
+	client_ctx, err := newOpenSSLCtx(suite)
+	if err != nil {
+		return nil, err
+	}
+	client_ctx.SetSessionCacheMode(openssl.SessionCacheOff)
+	return &pair{
+		suite: suite,
+		server: func(c net.Conn) (conn, error) {
+			return openssl.Server(c, server_ctx)
+		},
+		client: func(c net.Conn) (conn, error) {
+			return openssl.Client(c, client_ctx)
+		}}, nil
+}
+
+// newOpenSSLCtx returns a context offering suite alone.
+func newOpenSSLCtx(suite uint16) (*openssl.Ctx, error) {
+	ctx, err := openssl.NewCtx()
+	if err != nil {
+		return nil, err
+	}
+	if isTLS13(suite) {
+		if err := ctx.SetMinProtoVersion(openssl.TLSv1_3); err != nil {
+			return nil, err
+		}
+		err = ctx.SetCipherSuites(tls.CipherSuiteName(suite))
+		return ctx, err
+	}
+	if err := ctx.SetMaxProtoVersion(openssl.TLSv1_2); err != nil {
+		return nil, err
+	}
+	for _, cs := range ctx.CipherSuites() {
+		if cs.ID == suite {
+			return ctx, ctx.SetCipherList(cs.Name)
+		}
+	}
+	return nil, fmt.Errorf("cipher suite %s is not available",
+		tls.CipherSuiteName(suite))
+}
+
+func newCryptoTLSPair(suite uint16, creds *credentials) (*pair, error) {
+	cert, err := tls.X509KeyPair(creds.cert_pem, creds.key_pem)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates:           []tls.Certificate{cert},
+		InsecureSkipVerify:     true,
+		SessionTicketsDisabled: true}
+	if isTLS13(suite) {
+		// crypto/tls doesn't let TLS 1.3 suites be chosen, so whether it
+		// lands on suite is checked after the handshake
+		config.MinVersion = tls.VersionTLS13
+	} else {
+		config.MaxVersion = tls.VersionTLS12
+		config.CipherSuites = []uint16{suite}
+	}
+	return &pair{
+		suite: suite,
+		server: func(c net.Conn) (conn, error) {
+			return tls.Server(c, config), nil
+		},
+		client: func(c net.Conn) (conn, error) {
+			return tls.Client(c, config), nil
+		}}, nil
+}
+
+// connect dials l and returns both ends of the connection once their
+// handshake completes with the pair's suite.
+func (p *pair) connect(l net.Listener) (client, server conn, err error) {
+	client_raw, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		return nil, nil, err
+	}
+	server_raw, err := l.Accept()
+	if err != nil {
+		client_raw.Close()
+		return nil, nil, err
+	}
+	server, err = p.server(server_raw)
+	if err != nil {
+		client_raw.Close()
+		server_raw.Close()
+		return nil, nil, err
+	}
+	client, err = p.client(client_raw)
+	if err != nil {
+		client_raw.Close()
+		server.Close()
+		return nil, nil, err
+	}
+	errs := make(chan error, 1)
+	go func() { errs <- server.Handshake() }()
+	err = client.Handshake()
+	if server_err := <-errs; err == nil {
+		err = server_err
+	}
+	if err == nil {
+		if negotiated := negotiatedSuite(client); negotiated != p.suite {
+			err = fmt.Errorf("negotiated %s rather than %s",
+				tls.CipherSuiteName(negotiated),
+				tls.CipherSuiteName(p.suite))
+		}
+	}
+	if err != nil {
+		client.Close()
+		server.Close()
+		return nil, nil, err
+	}
+	return client, server, nil
+}
+
+func negotiatedSuite(c conn) uint16 {
+	switch c := c.(type) {
+	case *tls.Conn:
+		return c.ConnectionState().CipherSuite
+	case *openssl.Conn:
+		if suite, err := c.CurrentCipherSuite(); err == nil {
+			return suite.ID
+		}
+	}
+	return 0
+}
+
+// measureHandshakes connects over l for duration, returning the handshakes
+// completed per second.
+func (p *pair) measureHandshakes(l net.Listener,
+	duration time.Duration) (float64, error) {
+	start := time.Now()
+	handshakes := 0
+	for time.Since(start) < duration {
+		client, server, err := p.connect(l)
+		if err != nil {
+			return 0, err
+		}
+		client.Close()
+		server.Close()
+		handshakes++
+	}
+	return float64(handshakes) / time.Since(start).Seconds(), nil
+}
+
+// measureThroughput writes write_size buffers over one connection for
+// duration, returning the bytes the server read per second.
+func (p *pair) measureThroughput(l net.Listener, duration time.Duration,
+	write_size int) (float64, error) {
+	client, server, err := p.connect(l)
+	if err != nil {
+		return 0, err
+	}
+	defer server.Close()
+	read := make(chan int64, 1)
+	go func() {
+		n, _ := io.Copy(ioutil.Discard, server)
+		read <- n
+	}()
+	buf := make([]byte, write_size)
+	start := time.Now()
+	for time.Since(start) < duration {
+		if _, err := client.Write(buf); err != nil {
+			client.Close()
+			<-read
+			return 0, err
+		}
+	}
+	client.Close()
+	n := <-read
+	return float64(n) / time.Since(start).Seconds(), nil
+}
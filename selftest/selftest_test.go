@@ -0,0 +1,125 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package selftest
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	results, err := Run(&Config{
+		CipherSuites: []uint16{tls.TLS_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		Duration: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 4 {
+		t.Fatalf("expected 4 results, got %d", len(results))
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			// crypto/tls may prefer another TLS 1.3 suite on this hardware
+			if r.Implementation == CryptoTLS && isTLS13(r.CipherSuite) {
+				continue
+			}
+			t.Fatalf("%s with %s: %v", r.Implementation, r.CipherSuiteName,
+				r.Err)
+		}
+		if r.HandshakesPerSecond <= 0 || r.BytesPerSecond <= 0 {
+			t.Fatalf("unexpected result %+v", r)
+		}
+	}
+
+	results, err = Run(&Config{
+		CipherSuites:    []uint16{tls.TLS_RSA_WITH_AES_128_GCM_SHA256},
+		Implementations: []Implementation{OpenSSL, CryptoTLS},
+		Duration:        10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		if r.Err == nil {
+			t.Fatalf("expected %s to fail with an RSA suite and an ECDSA key",
+				r.Implementation)
+		}
+	}
+}
+
+func benchmarkPairs(b *testing.B, fn func(b *testing.B, p *pair,
+	l net.Listener)) {
+	creds, err := newCredentials()
+	if err != nil {
+		b.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	for _, suite := range DefaultCipherSuites {
+		for _, impl := range []Implementation{OpenSSL, CryptoTLS} {
+			name := string(impl) + "/" + tls.CipherSuiteName(suite)
+			b.Run(name, func(b *testing.B) {
+				p, err := newPair(impl, suite, creds)
+				if err != nil {
+					b.Skip(err)
+				}
+				fn(b, p, l)
+			})
+		}
+	}
+}
+
+func BenchmarkHandshake(b *testing.B) {
+	benchmarkPairs(b, func(b *testing.B, p *pair, l net.Listener) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			client, server, err := p.connect(l)
+			if err != nil {
+				b.Skip(err)
+			}
+			client.Close()
+			server.Close()
+		}
+	})
+}
+
+func BenchmarkThroughput(b *testing.B) {
+	benchmarkPairs(b, func(b *testing.B, p *pair, l net.Listener) {
+		client, server, err := p.connect(l)
+		if err != nil {
+			b.Skip(err)
+		}
+		defer client.Close()
+		defer server.Close()
+		go io.Copy(ioutil.Discard, server)
+		buf := make([]byte, 16<<10)
+		b.SetBytes(int64(len(buf)))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := client.Write(buf); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
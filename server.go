@@ -0,0 +1,237 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openssl
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ServerClosed is returned by ConnServer's Serve and ListenAndServe once the
+// server is shut down or closed.
+var ServerClosed = errors.New("openssl: server closed")
+
+// ConnServer accepts OpenSSL connections and serves each with Handler in its
+// own goroutine, keeping track of them so that it can be shut down
+// gracefully. See Server for wrapping single connections, and HTTPServer for
+// serving HTTP.
+type ConnServer struct {
+	// Ctx is the server context for connections that aren't already
+	// OpenSSL connections.
+	Ctx *Ctx
+	// Handler serves conn once its handshake succeeds. ctx is canceled when
+	// the server is shut down, and Handler should then return once conn is
+	// idle, e.g. between requests. conn is closed, sending close_notify, when
+	// Handler returns.
+	Handler func(ctx context.Context, conn *Conn)
+	// HandshakeTimeout bounds each connection's handshake. Zero means no
+	// limit.
+	HandshakeTimeout time.Duration
+
+	mtx       sync.Mutex
+	init_once sync.Once
+	ctx       context.Context
+	cancel    context.CancelFunc
+	listeners map[net.Listener]struct{}
+	// conns maps connections to whether they have been handed to Handler
+	conns   map[*Conn]bool
+	drained chan struct{}
+}
+
+func (s *ConnServer) init() {
+	s.init_once.Do(func() {
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+		s.listeners = make(map[net.Listener]struct{})
+		s.conns = make(map[*Conn]bool)
+		s.drained = make(chan struct{})
+	})
+}
+
+func (s *ConnServer) shuttingDown() bool {
+	return s.ctx.Err() != nil
+}
+
+// ListenAndServe listens on network and addr and serves the connections
+// accepted with Serve.
+func (s *ConnServer) ListenAndServe(network, addr string) error {
+	if s.Ctx == nil {
+		return errors.New("no ssl context provided")
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections from l until it fails or the server is shut down,
+// serving each in its own goroutine. Connections that aren't OpenSSL
+// connections already, as from Listen, are wrapped using Ctx. Serve closes l
+// on return, and returns ServerClosed after Shutdown or Close.
+func (s *ConnServer) Serve(l net.Listener) error {
+	s.init()
+	s.mtx.Lock()
+	if s.shuttingDown() {
+		s.mtx.Unlock()
+		l.Close()
+		return ServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mtx.Unlock()
+	defer func() {
+		s.mtx.Lock()
+		delete(s.listeners, l)
+		s.mtx.Unlock()
+		l.Close()
+	}()
+
+	var delay time.Duration
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if s.shuttingDown() {
+				return ServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				// back off like net/http does
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		conn, ok := c.(*Conn)
+		if !ok {
+			if s.Ctx == nil {
+				c.Close()
+				return errors.New("no ssl context provided")
+			}
+			conn, err = Server(c, s.Ctx)
+			if err != nil {
+				c.Close()
+				continue
+			}
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn handshakes on conn and hands it to Handler, closing it after.
+func (s *ConnServer) serveConn(conn *Conn) {
+	defer func() {
+		conn.Close()
+		s.setState(conn, false, true)
+	}()
+	if s.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.HandshakeTimeout))
+	}
+	// after the deadline is set, so that stop can override it
+	if !s.setState(conn, false, false) {
+		return
+	}
+	if conn.Handshake() != nil || conn.SetDeadline(time.Time{}) != nil {
+		return
+	}
+	s.setState(conn, true, false)
+	if s.Handler != nil {
+		s.Handler(s.ctx, conn)
+	}
+}
+
+// setState records conn as handed to Handler or not, or forgets it if
+// remove is set. It returns false if conn should not be served because the
+// server is shutting down.
+func (s *ConnServer) setState(conn *Conn, active, remove bool) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if remove {
+		if _, ok := s.conns[conn]; ok {
+			delete(s.conns, conn)
+			if len(s.conns) == 0 && s.shuttingDown() {
+				close(s.drained)
+			}
+		}
+		return false
+	}
+	if !active && s.shuttingDown() {
+		return false
+	}
+	s.conns[conn] = active
+	return true
+}
+
+// ActiveConns returns the number of connections being handshaken or served.
+func (s *ConnServer) ActiveConns() int {
+	s.init()
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return len(s.conns)
+}
+
+// Shutdown stops accepting connections, aborts handshakes in progress, and
+// cancels the context passed to Handler, then waits for every Handler to
+// return and its connection to be closed with close_notify. If ctx is done
+// first, the remaining connections are closed and ctx's error is returned.
+func (s *ConnServer) Shutdown(ctx context.Context) error {
+	s.stop(false)
+	select {
+	case <-s.drained:
+		return nil
+	case <-ctx.Done():
+		s.stop(true)
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting connections and closes every connection at once.
+func (s *ConnServer) Close() error {
+	s.stop(true)
+	return nil
+}
+
+// stop closes the listeners and cancels handlers, aborting handshakes, or
+// closing every connection if close_all is set.
+func (s *ConnServer) stop(close_all bool) {
+	s.init()
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if !s.shuttingDown() {
+		s.cancel()
+		if len(s.conns) == 0 {
+			close(s.drained)
+		}
+	}
+	for l := range s.listeners {
+		l.Close()
+	}
+	for conn, active := range s.conns {
+		if close_all {
+			// unblocks the handler, and keeps close_notify from blocking on
+			// a peer that isn't reading
+			conn.SetDeadline(time.Now())
+			conn.Close()
+		} else if !active {
+			conn.SetDeadline(time.Now())
+		}
+	}
+}
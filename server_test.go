@@ -0,0 +1,129 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func startConnServer(t *testing.T, s *ConnServer) (addr string,
+	served chan error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served = make(chan error, 1)
+	go func() { served <- s.Serve(l) }()
+	return l.Addr().String(), served
+}
+
+func TestConnServerShutdown(t *testing.T) {
+	s := &ConnServer{
+		Ctx: newTestServerCtx(t),
+		Handler: func(ctx context.Context, conn *Conn) {
+			conn.Write([]byte("hi"))
+			<-ctx.Done()
+		}}
+	addr, served := startConnServer(t, s)
+
+	conn, err := Dial("tcp", addr, nil, InsecureSkipHostVerification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if s.ActiveConns() != 1 {
+		t.Fatalf("expected 1 active connection, got %d", s.ActiveConns())
+	}
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != ServerClosed {
+		t.Fatalf("unexpected serve error %v", err)
+	}
+	if s.ActiveConns() != 0 {
+		t.Fatalf("expected no active connections, got %d", s.ActiveConns())
+	}
+	// a clean EOF means close_notify was sent
+	if _, err := conn.Read(buf); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+	if _, err := Dial("tcp", addr, nil, InsecureSkipHostVerification); err == nil {
+		t.Fatal("expected the listener to be closed")
+	}
+}
+
+func TestConnServerShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	s := &ConnServer{
+		Ctx: newTestServerCtx(t),
+		Handler: func(ctx context.Context, conn *Conn) {
+			conn.Write([]byte("hi"))
+			<-release
+		}}
+	addr, _ := startConnServer(t, s)
+
+	conn, err := Dial("tcp", addr, nil, InsecureSkipHostVerification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(),
+		50*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected the deadline to pass, got %v", err)
+	}
+	// the connection is closed regardless
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(buf); err == nil {
+		t.Fatal("expected the connection to be closed")
+	}
+}
+
+func TestConnServerHandshakeTimeout(t *testing.T) {
+	s := &ConnServer{
+		Ctx:              newTestServerCtx(t),
+		HandshakeTimeout: 50 * time.Millisecond}
+	defer s.Close()
+	addr, _ := startConnServer(t, s)
+
+	// never sends a ClientHello
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(time.Second))
+	if _, err := ioutil.ReadAll(c); err != nil {
+		t.Fatalf("expected the server to hang up, got %v", err)
+	}
+}
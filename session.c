@@ -0,0 +1,81 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include <stdlib.h>
+#include <string.h>
+#include <openssl/ssl.h>
+#include "_cgo_export.h"
+
+// client connections remember the key their sessions are stored under in
+// their ex_data, so the new session callback can find it.
+struct session_key {
+	size_t len;
+	unsigned char data[1];
+};
+
+static int session_key_idx = -1;
+
+static void session_key_free(void *parent, void *ptr, CRYPTO_EX_DATA *ad,
+		int idx, long argl, void *argp) {
+	free(ptr);
+}
+
+void init_session_key_idx() {
+	session_key_idx = SSL_get_ex_new_index(0, NULL, NULL, NULL,
+		session_key_free);
+}
+
+int SSL_set_session_key(SSL *ssl, const void *key, size_t len) {
+	struct session_key *k = malloc(sizeof(struct session_key) + len);
+	if (k == NULL)
+		return 0;
+	k->len = len;
+	memcpy(k->data, key, len);
+	free(SSL_get_ex_data(ssl, session_key_idx));
+	return SSL_set_ex_data(ssl, session_key_idx, k);
+}
+
+const unsigned char *SSL_get_session_key(SSL *ssl, size_t *len) {
+	struct session_key *k = SSL_get_ex_data(ssl, session_key_idx);
+	if (k == NULL)
+		return NULL;
+	*len = k->len;
+	return k->data;
+}
+
+static void *session_ctx(SSL_CTX *ssl_ctx) {
+	return SSL_CTX_get_ex_data(ssl_ctx, get_ssl_ctx_idx());
+}
+
+int new_session_cb(SSL *ssl, SSL_SESSION *session) {
+	return new_session_cb_thunk(session_ctx(SSL_get_SSL_CTX(ssl)), ssl,
+		session);
+}
+
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+SSL_SESSION *get_session_cb(SSL *ssl, const unsigned char *id, int idlen,
+		int *copy) {
+#else
+SSL_SESSION *get_session_cb(SSL *ssl, unsigned char *id, int idlen,
+		int *copy) {
+#endif
+	// the session we return already carries the reference we hand over
+	*copy = 0;
+	return get_session_cb_thunk(session_ctx(SSL_get_SSL_CTX(ssl)),
+		(unsigned char *)id, idlen);
+}
+
+void remove_session_cb(SSL_CTX *ssl_ctx, SSL_SESSION *session) {
+	remove_session_cb_thunk(session_ctx(ssl_ctx), session);
+}
@@ -0,0 +1,463 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <stdlib.h>
+#include <openssl/ssl.h>
+
+extern void init_session_key_idx();
+extern int SSL_set_session_key(SSL *ssl, const void *key, size_t len);
+extern const unsigned char *SSL_get_session_key(SSL *ssl, size_t *len);
+extern int new_session_cb(SSL *ssl, SSL_SESSION *session);
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+extern SSL_SESSION *get_session_cb(SSL *ssl, const unsigned char *id,
+    int idlen, int *copy);
+#else
+extern SSL_SESSION *get_session_cb(SSL *ssl, unsigned char *id, int idlen,
+    int *copy);
+#endif
+extern void remove_session_cb(SSL_CTX *ssl_ctx, SSL_SESSION *session);
+
+static void SSL_CTX_set_session_store_callbacks(SSL_CTX *ctx, int enabled) {
+    if (enabled) {
+        SSL_CTX_set_session_cache_mode(ctx,
+            SSL_CTX_get_session_cache_mode(ctx) | SSL_SESS_CACHE_BOTH);
+        SSL_CTX_sess_set_new_cb(ctx, new_session_cb);
+        SSL_CTX_sess_set_get_cb(ctx, get_session_cb);
+        SSL_CTX_sess_set_remove_cb(ctx, remove_session_cb);
+    } else {
+        SSL_CTX_sess_set_new_cb(ctx, NULL);
+        SSL_CTX_sess_set_get_cb(ctx, NULL);
+        SSL_CTX_sess_set_remove_cb(ctx, NULL);
+    }
+}
+
+static int OUR_SSL_is_server(SSL *ssl) {
+#if OPENSSL_VERSION_NUMBER >= 0x10002000L
+    return SSL_is_server(ssl);
+#else
+    return ssl->server;
+#endif
+}
+
+static int OUR_i2d_SSL_SESSION(SSL_SESSION *session, unsigned char *out) {
+    return i2d_SSL_SESSION(session, out == NULL ? NULL : &out);
+}
+
+static SSL_SESSION *OUR_d2i_SSL_SESSION(const unsigned char *der, long len) {
+    return d2i_SSL_SESSION(NULL, &der, len);
+}
+
+static int OUR_SSL_SESSION_has_ticket(const SSL_SESSION *session) {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+    return SSL_SESSION_has_ticket(session);
+#else
+    return session->tlsext_tick != NULL;
+#endif
+}
+
+static unsigned long OUR_SSL_SESSION_get_ticket_lifetime_hint(
+    const SSL_SESSION *session) {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+    return SSL_SESSION_get_ticket_lifetime_hint(session);
+#else
+    return session->tlsext_tick_lifetime_hint;
+#endif
+}
+
+static int SSL_is_tls13(const SSL *ssl) {
+#ifdef TLS1_3_VERSION
+    return SSL_version(ssl) == TLS1_3_VERSION;
+#else
+    return 0;
+#endif
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+	"unsafe"
+)
+
+// SessionStore is an external cache of serialized TLS sessions, for
+// resumption across processes or machines. Servers store sessions under their
+// session id, clients under the key given to Conn.SetSessionKey.
+type SessionStore interface {
+	// Get returns the session stored under key, or nil if there is none or it
+	// has expired.
+	Get(key []byte) (session []byte, err error)
+	// Put stores session under key, replacing any previous value. The session
+	// should not be returned by Get after expires.
+	Put(key []byte, session []byte, expires time.Time) error
+	// Delete removes the session stored under key, if any.
+	Delete(key []byte) error
+}
+
+func init() {
+	C.init_session_key_idx()
+}
+
+// SetSessionStore hooks store into OpenSSL's external session cache, enabling
+// session caching for both servers and clients using this context. OpenSSL's
+// internal cache keeps working in front of it unless disabled with
+// SetSessionCacheMode. Passing nil unhooks the store.
+func (c *Ctx) SetSessionStore(store SessionStore) {
+	c.session_store = store
+	var enabled C.int
+	if store != nil {
+		enabled = 1
+	}
+	C.SSL_CTX_set_session_store_callbacks(c.ctx, enabled)
+}
+
+// SetSessionKey names the session cache entry of a client connection, which
+// is usually the address of the server. If the context has a SessionStore and
+// it holds a session under key, the handshake will attempt to resume it, and
+// any new session the server hands out is stored under key. Call it before
+// the handshake; Dial does so automatically. A failed lookup is logged and
+// the handshake proceeds without resuming.
+func (c *Conn) SetSessionKey(key string) error {
+	if key == "" {
+		return errors.New("empty session key")
+	}
+	ckey := C.CString(key)
+	defer C.free(unsafe.Pointer(ckey))
+	c.mtx.Lock()
+	rv := C.SSL_set_session_key(c.ssl, unsafe.Pointer(ckey),
+		C.size_t(len(key)))
+	c.mtx.Unlock()
+	if rv != 1 {
+		return errors.New("failed to set session key")
+	}
+	store := c.ctx.session_store
+	if store == nil {
+		return nil
+	}
+	der, err := store.Get([]byte(key))
+	if err != nil {
+		logger.Errorf("openssl: failed to look up session: %v", err)
+		return nil
+	}
+	if der == nil {
+		return nil
+	}
+	session := unmarshalSession(der)
+	if session == nil {
+		// couldn't be decoded, so it's of no use to anyone
+		err = store.Delete([]byte(key))
+		if err != nil {
+			logger.Errorf("openssl: failed to remove session: %v", err)
+		}
+		return nil
+	}
+	defer C.SSL_SESSION_free(session)
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.SSL_set_session(c.ssl, session) != 1 {
+		return errorFromErrorQueue()
+	}
+	return nil
+}
+
+// Resumption says whether and how a connection resumed an earlier session.
+type Resumption int
+
+const (
+	// NotResumed means a full handshake established a new session.
+	NotResumed Resumption = iota
+	// ResumedSessionID means the session was found in a cache under the id
+	// the client offered.
+	ResumedSessionID
+	// ResumedTicket means the client presented the session in a ticket. All
+	// TLS 1.3 resumptions are reported as such, as TLS 1.3 resumes sessions
+	// with tickets even when the server keeps them in a cache.
+	ResumedTicket
+)
+
+func (r Resumption) String() string {
+	switch r {
+	case NotResumed:
+		return "not resumed"
+	case ResumedSessionID:
+		return "resumed session id"
+	case ResumedTicket:
+		return "resumed ticket"
+	}
+	return fmt.Sprintf("Resumption(%d)", int(r))
+}
+
+// DidResume reports whether the handshake resumed an earlier session rather
+// than negotiating a new one.
+func (c *Conn) DidResume() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return C.SSL_session_reused(c.ssl) == 1
+}
+
+// Resumption reports how the handshake resumed its session, if it did. A
+// TLS 1.2 server can't see which mechanism the client used, so it reports
+// ResumedSessionID if the connection has NoTicket set and ResumedTicket
+// otherwise.
+func (c *Conn) Resumption() Resumption {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if C.SSL_session_reused(c.ssl) != 1 {
+		return NotResumed
+	}
+	if C.SSL_is_tls13(c.ssl) != 0 {
+		return ResumedTicket
+	}
+	if C.OUR_SSL_is_server(c.ssl) != 0 {
+		if C.SSL_get_options(c.ssl)&C.SSL_OP_NO_TICKET != 0 {
+			return ResumedSessionID
+		}
+		return ResumedTicket
+	}
+	session := C.SSL_get_session(c.ssl)
+	if session != nil && C.OUR_SSL_SESSION_has_ticket(session) != 0 {
+		return ResumedTicket
+	}
+	return ResumedSessionID
+}
+
+// SessionAge returns how long ago the connection's session was first
+// established, which for a resumed session is the time of the full
+// handshake that created it.
+func (c *Conn) SessionAge() (time.Duration, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	session := C.SSL_get_session(c.ssl)
+	if session == nil {
+		return 0, errors.New("no session established")
+	}
+	created := time.Unix(int64(C.SSL_SESSION_get_time(session)), 0)
+	return time.Since(created), nil
+}
+
+// SessionLifetimeHint returns how long the server suggested the client keep
+// its session ticket, or 0 if it gave no hint or issued no ticket. It is
+// only known to clients.
+func (c *Conn) SessionLifetimeHint() (time.Duration, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	session := C.SSL_get_session(c.ssl)
+	if session == nil {
+		return 0, errors.New("no session established")
+	}
+	hint := C.OUR_SSL_SESSION_get_ticket_lifetime_hint(session)
+	return time.Duration(hint) * time.Second, nil
+}
+
+// GetSession returns the connection's session in serialized form, for a
+// later client connection to the same server to resume with SetSession. It
+// is only worth keeping once the handshake has completed, and with TLS 1.3
+// once the client has read the server's ticket, which follows the handshake.
+// Sessions hold the keys to the connection; keep them private.
+func (c *Conn) GetSession() ([]byte, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	session := C.SSL_get_session(c.ssl)
+	if session == nil {
+		return nil, errors.New("no session established")
+	}
+	return marshalSession(session)
+}
+
+// SetSession makes the handshake of a client connection attempt to resume
+// session, as returned by GetSession. Call it before the handshake. If the
+// server declines, the handshake carries on in full. With a SessionStore,
+// SetSessionKey does this automatically.
+func (c *Conn) SetSession(session []byte) error {
+	s, err := UnmarshalSession(session)
+	if err != nil {
+		return err
+	}
+	return c.ResumeSession(s)
+}
+
+// Session is a TLS session, holding what a client needs to resume it and a
+// server needs to accept the resumption. Sessions hold the keys to the
+// connections using them; keep them private.
+type Session struct {
+	session *C.SSL_SESSION
+}
+
+// newSession takes over a reference to session.
+func newSession(session *C.SSL_SESSION) *Session {
+	s := &Session{session: session}
+	runtime.SetFinalizer(s, func(s *Session) {
+		C.SSL_SESSION_free(s.session)
+	})
+	return s
+}
+
+// UnmarshalSession parses a session serialized by Session.Marshal, such as
+// one another process handed out.
+func UnmarshalSession(der []byte) (*Session, error) {
+	session := unmarshalSession(der)
+	if session == nil {
+		return nil, errors.New("failed to parse session")
+	}
+	return newSession(session), nil
+}
+
+// Marshal serializes the session in OpenSSL's DER format, the form stored in
+// a SessionStore.
+func (s *Session) Marshal() ([]byte, error) {
+	defer runtime.KeepAlive(s)
+	return marshalSession(s.session)
+}
+
+// ID returns the session id, under which servers store the session.
+func (s *Session) ID() []byte {
+	return sessionId(s.session)
+}
+
+// Expires returns when the session stops being resumable.
+func (s *Session) Expires() time.Time {
+	return sessionExpires(s.session)
+}
+
+// Session returns the connection's session. The caveats of GetSession
+// apply.
+func (c *Conn) Session() (*Session, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	session := C.SSL_get1_session(c.ssl)
+	if session == nil {
+		return nil, errors.New("no session established")
+	}
+	return newSession(session), nil
+}
+
+// ResumeSession is SetSession with a parsed session.
+func (c *Conn) ResumeSession(s *Session) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	defer runtime.KeepAlive(s)
+	if C.SSL_set_session(c.ssl, s.session) != 1 {
+		return errorFromErrorQueue()
+	}
+	return nil
+}
+
+func marshalSession(session *C.SSL_SESSION) ([]byte, error) {
+	n := C.OUR_i2d_SSL_SESSION(session, nil)
+	if n <= 0 {
+		return nil, errors.New("failed to serialize session")
+	}
+	der := make([]byte, n)
+	if C.OUR_i2d_SSL_SESSION(session, (*C.uchar)(&der[0])) != n {
+		return nil, errors.New("failed to serialize session")
+	}
+	return der, nil
+}
+
+// unmarshalSession returns a session holding one reference, or nil.
+func unmarshalSession(der []byte) *C.SSL_SESSION {
+	if len(der) == 0 {
+		return nil
+	}
+	return C.OUR_d2i_SSL_SESSION((*C.uchar)(&der[0]), C.long(len(der)))
+}
+
+func sessionId(session *C.SSL_SESSION) []byte {
+	var n C.uint
+	id := C.SSL_SESSION_get_id(session, &n)
+	return C.GoBytes(unsafe.Pointer(id), C.int(n))
+}
+
+func sessionExpires(session *C.SSL_SESSION) time.Time {
+	return time.Unix(int64(C.SSL_SESSION_get_time(session))+
+		int64(C.SSL_SESSION_get_timeout(session)), 0)
+}
+
+func sessionThunkRecover(name string) {
+	if err := recover(); err != nil {
+		logger.Critf("openssl: %s panic'd: %v", name, err)
+		os.Exit(1)
+	}
+}
+
+//export new_session_cb_thunk
+func new_session_cb_thunk(p unsafe.Pointer, ssl *C.SSL,
+	session *C.SSL_SESSION) C.int {
+	defer sessionThunkRecover("new session callback")
+	store := (*Ctx)(p).session_store
+	if store == nil {
+		return 0
+	}
+	var key []byte
+	if C.OUR_SSL_is_server(ssl) != 0 {
+		key = sessionId(session)
+	} else {
+		var n C.size_t
+		ptr := C.SSL_get_session_key(ssl, &n)
+		if ptr == nil {
+			// nothing to file the session under
+			return 0
+		}
+		key = C.GoBytes(unsafe.Pointer(ptr), C.int(n))
+	}
+	der, err := marshalSession(session)
+	if err == nil {
+		err = store.Put(key, der, sessionExpires(session))
+	}
+	if err != nil {
+		logger.Errorf("openssl: failed to store session: %v", err)
+	}
+	// we didn't keep a reference to the session
+	return 0
+}
+
+//export get_session_cb_thunk
+func get_session_cb_thunk(p unsafe.Pointer, id *C.uchar,
+	idlen C.int) *C.SSL_SESSION {
+	defer sessionThunkRecover("get session callback")
+	store := (*Ctx)(p).session_store
+	if store == nil {
+		return nil
+	}
+	der, err := store.Get(C.GoBytes(unsafe.Pointer(id), idlen))
+	if err != nil {
+		logger.Errorf("openssl: failed to look up session: %v", err)
+		return nil
+	}
+	return unmarshalSession(der)
+}
+
+//export remove_session_cb_thunk
+func remove_session_cb_thunk(p unsafe.Pointer, session *C.SSL_SESSION) {
+	defer sessionThunkRecover("remove session callback")
+	store := (*Ctx)(p).session_store
+	if store == nil {
+		return
+	}
+	if err := store.Delete(sessionId(session)); err != nil {
+		logger.Errorf("openssl: failed to remove session: %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FileSessionStore is a SessionStore keeping one file per session in a
+// directory, so resumption survives process restarts. Sessions hold the keys
+// to past connections; keep the directory private.
+type FileSessionStore struct {
+	dir string
+}
+
+// NewFileSessionStore returns a store using dir, creating it if needed.
+func NewFileSessionStore(dir string) (*FileSessionStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileSessionStore{dir: dir}, nil
+}
+
+func (s *FileSessionStore) path(key []byte) string {
+	sum := sha256.Sum256(key)
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:]))
+}
+
+// Get implements SessionStore. Expired or damaged entries are removed.
+func (s *FileSessionStore) Get(key []byte) ([]byte, error) {
+	data, err := ioutil.ReadFile(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) <= 8 ||
+		time.Now().Unix() >= int64(binary.BigEndian.Uint64(data)) {
+		return nil, s.Delete(key)
+	}
+	return data[8:], nil
+}
+
+// Put implements SessionStore. Entries are replaced atomically, so concurrent
+// readers, including other processes, never see a partial session.
+func (s *FileSessionStore) Put(key []byte, session []byte,
+	expires time.Time) error {
+	f, err := ioutil.TempFile(s.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	var header [8]byte
+	binary.BigEndian.PutUint64(header[:], uint64(expires.Unix()))
+	_, err = f.Write(append(header[:], session...))
+	if close_err := f.Close(); err == nil {
+		err = close_err
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.path(key))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// Delete implements SessionStore.
+func (s *FileSessionStore) Delete(key []byte) error {
+	err := os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,115 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// MemorySessionStore is a SessionStore holding up to a fixed number of
+// sessions in memory, evicting the least recently used first. With it, a
+// client context resumes sessions with the servers it has recently dialed,
+// since Dial files each connection's session under the address dialed, much
+// as tls.Config's ClientSessionCache does.
+type MemorySessionStore struct {
+	mtx      sync.Mutex
+	capacity int
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+type memorySession struct {
+	key     string
+	session []byte
+	expires time.Time
+}
+
+// NewMemorySessionStore returns a store holding up to capacity sessions, or
+// 64 if capacity is not positive.
+func NewMemorySessionStore(capacity int) *MemorySessionStore {
+	if capacity <= 0 {
+		capacity = 64
+	}
+	return &MemorySessionStore{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element)}
+}
+
+// Get implements SessionStore. Expired entries are removed.
+func (s *MemorySessionStore) Get(key []byte) ([]byte, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	elem, ok := s.entries[string(key)]
+	if !ok {
+		return nil, nil
+	}
+	entry := elem.Value.(*memorySession)
+	if !time.Now().Before(entry.expires) {
+		s.remove(elem)
+		return nil, nil
+	}
+	s.order.MoveToFront(elem)
+	return entry.session, nil
+}
+
+// Put implements SessionStore.
+func (s *MemorySessionStore) Put(key []byte, session []byte,
+	expires time.Time) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	entry := &memorySession{
+		key:     string(key),
+		session: append([]byte(nil), session...),
+		expires: expires}
+	if elem, ok := s.entries[entry.key]; ok {
+		elem.Value = entry
+		s.order.MoveToFront(elem)
+		return nil
+	}
+	s.entries[entry.key] = s.order.PushFront(entry)
+	for s.order.Len() > s.capacity {
+		s.remove(s.order.Back())
+	}
+	return nil
+}
+
+// Delete implements SessionStore.
+func (s *MemorySessionStore) Delete(key []byte) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if elem, ok := s.entries[string(key)]; ok {
+		s.remove(elem)
+	}
+	return nil
+}
+
+// Len returns the number of sessions held, including any that have expired
+// but not yet been looked up.
+func (s *MemorySessionStore) Len() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.order.Len()
+}
+
+// remove drops elem. The caller must hold s.mtx.
+func (s *MemorySessionStore) remove(elem *list.Element) {
+	s.order.Remove(elem)
+	delete(s.entries, elem.Value.(*memorySession).key)
+}
@@ -0,0 +1,109 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/spacemonkeygo/openssl/utils"
+)
+
+// RemoteCache is the subset of a networked key/value store, such as memcached
+// or Redis, needed to share sessions across a fleet. The sessioncache
+// package has implementations for both.
+type RemoteCache interface {
+	// Get returns the value stored under key, or nil if there is none.
+	Get(key string) ([]byte, error)
+	// Set stores value under key for ttl.
+	Set(key string, value []byte, ttl time.Duration) error
+	// Delete removes key, if present.
+	Delete(key string) error
+}
+
+// RemoteSessionStore adapts a RemoteCache into a SessionStore, so that any
+// frontend in a fleet can resume sessions established by the others.
+//
+// A burst of handshakes resuming the same session, as happens when a client
+// opens many connections at once, results in a single remote lookup whose
+// result is shared by all of them.
+type RemoteSessionStore struct {
+	cache  RemoteCache
+	prefix string
+
+	mtx      sync.Mutex
+	inflight map[string]*utils.Future
+}
+
+// NewRemoteSessionStore returns a store keeping sessions in cache. Cache keys
+// are prefix followed by a hash of the session key, which keeps them within
+// the key restrictions of common stores.
+func NewRemoteSessionStore(cache RemoteCache,
+	prefix string) *RemoteSessionStore {
+	return &RemoteSessionStore{
+		cache:    cache,
+		prefix:   prefix,
+		inflight: make(map[string]*utils.Future)}
+}
+
+func (s *RemoteSessionStore) cacheKey(key []byte) string {
+	sum := sha256.Sum256(key)
+	return s.prefix + hex.EncodeToString(sum[:])
+}
+
+// Get implements SessionStore.
+func (s *RemoteSessionStore) Get(key []byte) ([]byte, error) {
+	cache_key := s.cacheKey(key)
+	s.mtx.Lock()
+	future, waiting := s.inflight[cache_key]
+	if !waiting {
+		future = utils.NewFuture()
+		s.inflight[cache_key] = future
+	}
+	s.mtx.Unlock()
+
+	if !waiting {
+		session, err := s.cache.Get(cache_key)
+		s.mtx.Lock()
+		delete(s.inflight, cache_key)
+		s.mtx.Unlock()
+		future.Set(session, err)
+	}
+	session, err := future.Get()
+	if err != nil {
+		return nil, err
+	}
+	return session.([]byte), nil
+}
+
+// Put implements SessionStore. Sessions that have already expired are not
+// stored.
+func (s *RemoteSessionStore) Put(key []byte, session []byte,
+	expires time.Time) error {
+	ttl := expires.Sub(time.Now())
+	if ttl <= 0 {
+		return nil
+	}
+	return s.cache.Set(s.cacheKey(key), session, ttl)
+}
+
+// Delete implements SessionStore.
+func (s *RemoteSessionStore) Delete(key []byte) error {
+	return s.cache.Delete(s.cacheKey(key))
+}
@@ -0,0 +1,644 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+type countingStore struct {
+	SessionStore
+	mtx  sync.Mutex
+	hits int
+	puts int
+}
+
+func (s *countingStore) Get(key []byte) ([]byte, error) {
+	session, err := s.SessionStore.Get(key)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if session != nil {
+		s.hits++
+	}
+	return session, err
+}
+
+func (s *countingStore) Put(key []byte, session []byte,
+	expires time.Time) error {
+	s.mtx.Lock()
+	s.puts++
+	s.mtx.Unlock()
+	return s.SessionStore.Put(key, session, expires)
+}
+
+func newSessionStoreCtx(t testing.TB, dir string, server bool) (*Ctx,
+	*countingStore) {
+	ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server {
+		key, err := LoadPrivateKeyFromPEM(keyBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := LoadCertificateFromPEM(certBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ctx.UsePrivateKey(key); err != nil {
+			t.Fatal(err)
+		}
+		if err := ctx.UseCertificate(cert); err != nil {
+			t.Fatal(err)
+		}
+		if err := ctx.SetSessionId([]byte("session test")); err != nil {
+			t.Fatal(err)
+		}
+		// keep sessions on the server side rather than in tickets, and only
+		// in the store
+		ctx.SetOptions(NoTicket)
+		ctx.SetSessionCacheMode(SessionCacheServer | NoInternal)
+	}
+	file_store, err := NewFileSessionStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &countingStore{SessionStore: file_store}
+	ctx.SetSessionStore(store)
+	return ctx, store
+}
+
+func sessionStoreRound(t testing.TB, server_ctx, client_ctx *Ctx) {
+	server_conn, client_conn := NetPipe(t)
+	defer server_conn.Close()
+	defer client_conn.Close()
+	server, err := Server(server_conn, server_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := Client(client_conn, client_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.SetSessionKey("server"); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := server.Write([]byte("hi"))
+		errs <- err
+	}()
+	// the session arrives ahead of the data in TLS 1.3
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileSessionStoreResumption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "openssl-sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	server_dir, client_dir := dir+"/server", dir+"/client"
+
+	server_ctx, server_store := newSessionStoreCtx(t, server_dir, true)
+	client_ctx, client_store := newSessionStoreCtx(t, client_dir, false)
+	sessionStoreRound(t, server_ctx, client_ctx)
+	if server_store.puts == 0 || client_store.puts == 0 {
+		t.Fatalf("expected sessions to be stored, got %d server and %d "+
+			"client", server_store.puts, client_store.puts)
+	}
+
+	// new contexts and stores over the same directories, as if both sides
+	// had restarted
+	server_ctx, server_store = newSessionStoreCtx(t, server_dir, true)
+	client_ctx, client_store = newSessionStoreCtx(t, client_dir, false)
+	sessionStoreRound(t, server_ctx, client_ctx)
+	if client_store.hits != 1 {
+		t.Fatalf("expected the client to find its session, got %d hits",
+			client_store.hits)
+	}
+	if server_store.hits == 0 {
+		t.Fatal("expected the server to find the offered session")
+	}
+}
+
+func TestFileSessionStoreExpiry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "openssl-sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewFileSessionStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := []byte("key")
+	if err := store.Put(key, []byte("session"),
+		time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	session, err := store.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(session, []byte("session")) {
+		t.Fatalf("unexpected session %q", session)
+	}
+	if err := store.Put(key, []byte("session"),
+		time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	session, err = store.Get(key)
+	if err != nil || session != nil {
+		t.Fatalf("expected expired session to be gone, got %q, %v",
+			session, err)
+	}
+	if err := store.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type failingStore struct {
+	SessionStore
+}
+
+func (s failingStore) Get(key []byte) ([]byte, error) {
+	return nil, errors.New("store unavailable")
+}
+
+func TestSessionStoreLookupFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "openssl-sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	server_ctx, _ := newSessionStoreCtx(t, dir+"/server", true)
+	client_ctx, client_store := newSessionStoreCtx(t, dir+"/client", false)
+	// a broken store costs the client its resumption, not its connection
+	client_ctx.SetSessionStore(failingStore{SessionStore: client_store})
+	sessionStoreRound(t, server_ctx, client_ctx)
+}
+
+type slowCache struct {
+	mtx     sync.Mutex
+	values  map[string][]byte
+	gets    int
+	release chan struct{}
+}
+
+func (c *slowCache) Get(key string) ([]byte, error) {
+	c.mtx.Lock()
+	c.gets++
+	c.mtx.Unlock()
+	<-c.release
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.values[key], nil
+}
+
+func (c *slowCache) Set(key string, value []byte, ttl time.Duration) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.values[key] = value
+	return nil
+}
+
+func (c *slowCache) Delete(key string) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	delete(c.values, key)
+	return nil
+}
+
+func TestRemoteSessionStoreCoalescesLookups(t *testing.T) {
+	cache := &slowCache{
+		values:  make(map[string][]byte),
+		release: make(chan struct{})}
+	store := NewRemoteSessionStore(cache, "tls:")
+	key := []byte("key")
+	if err := store.Put(key, []byte("session"),
+		time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	for k := range cache.values {
+		if len(k) != len("tls:")+64 || k[:4] != "tls:" {
+			t.Fatalf("unexpected cache key %q", k)
+		}
+	}
+
+	const lookups = 10
+	results := make(chan []byte, lookups)
+	for i := 0; i < lookups; i++ {
+		go func() {
+			session, err := store.Get(key)
+			if err != nil {
+				t.Error(err)
+			}
+			results <- session
+		}()
+	}
+	// give the lookups a chance to pile up behind the first
+	time.Sleep(50 * time.Millisecond)
+	close(cache.release)
+	for i := 0; i < lookups; i++ {
+		if session := <-results; !bytes.Equal(session, []byte("session")) {
+			t.Fatalf("unexpected session %q", session)
+		}
+	}
+	if cache.gets >= lookups {
+		t.Fatalf("expected lookups to be coalesced, got %d gets", cache.gets)
+	}
+
+	if err := store.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	session, err := store.Get(key)
+	if err != nil || session != nil {
+		t.Fatalf("expected deleted session to be gone, got %q, %v",
+			session, err)
+	}
+	if err := store.Put(key, []byte("session"),
+		time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if len(cache.values) != 0 {
+		t.Fatal("expected expired session not to be stored")
+	}
+}
+
+// resumptionRound is sessionStoreRound, reporting how each side resumed and
+// the lifetime hint the client got.
+func resumptionRound(t testing.TB, server_ctx, client_ctx *Ctx) (
+	client_res, server_res Resumption, hint time.Duration) {
+	server_conn, client_conn := NetPipe(t)
+	defer server_conn.Close()
+	defer client_conn.Close()
+	server, err := Server(server_conn, server_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := Client(client_conn, client_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.SetSessionKey("server"); err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 1)
+	go func() {
+		_, err := server.Write([]byte("hi"))
+		errs <- err
+	}()
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if client.DidResume() != server.DidResume() {
+		t.Fatal("client and server disagree on resumption")
+	}
+	for _, conn := range []*Conn{client, server} {
+		age, err := conn.SessionAge()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if age < 0 || age > time.Minute {
+			t.Fatalf("unexpected session age %v", age)
+		}
+	}
+	hint, err = client.SessionLifetimeHint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client.Resumption(), server.Resumption(), hint
+}
+
+func TestResumptionSessionID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "openssl-sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	server_ctx, _ := newSessionStoreCtx(t, dir+"/server", true)
+	// TLS 1.3 only resumes with tickets
+	client_ctx, err := NewCtxWithVersion(TLSv1_2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client_store, err := NewFileSessionStore(dir + "/client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client_ctx.SetSessionStore(client_store)
+
+	client_res, server_res, _ := resumptionRound(t, server_ctx, client_ctx)
+	if client_res != NotResumed || server_res != NotResumed {
+		t.Fatalf("expected a full handshake, got %v and %v", client_res,
+			server_res)
+	}
+	client_res, server_res, _ = resumptionRound(t, server_ctx, client_ctx)
+	if client_res != ResumedSessionID || server_res != ResumedSessionID {
+		t.Fatalf("expected session id resumption, got %v and %v",
+			client_res, server_res)
+	}
+}
+
+func TestSessionMarshalAcrossServers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "openssl-sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// two frontends sharing a store, as behind a load balancer
+	front1, _ := newSessionStoreCtx(t, dir, true)
+	front2, _ := newSessionStoreCtx(t, dir, true)
+	client_ctx, err := NewCtxWithVersion(TLSv1_2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handshake := func(server_ctx *Ctx, session *Session) *Conn {
+		server_conn, client_conn := NetPipe(t)
+		server, err := Server(server_conn, server_ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			server.Handshake()
+			server.Close()
+		}()
+		client, err := Client(client_conn, client_ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if session != nil {
+			if err := client.ResumeSession(session); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := client.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		// the server stores the session as it finishes
+		<-done
+		return client
+	}
+
+	client := handshake(front1, nil)
+	session, err := client.Session()
+	client.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(session.ID()) == 0 || !session.Expires().After(time.Now()) {
+		t.Fatalf("unexpected session id %x expiring %v", session.ID(),
+			session.Expires())
+	}
+	der, err := session.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := UnmarshalSession(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(parsed.ID(), session.ID()) {
+		t.Fatal("expected the parsed session to keep its id")
+	}
+	client = handshake(front2, parsed)
+	defer client.Close()
+	if !client.DidResume() {
+		t.Fatal("expected the other frontend to resume the session")
+	}
+	if _, err := UnmarshalSession([]byte("garbage")); err == nil {
+		t.Fatal("expected an error parsing garbage")
+	}
+}
+
+func TestSessionCacheStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "openssl-sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// only the internal cache this time
+	server_ctx, _ := newSessionStoreCtx(t, dir+"/server", true)
+	server_ctx.SetSessionStore(nil)
+	server_ctx.SetSessionCacheMode(SessionCacheServer)
+	if mode := server_ctx.SessionCacheMode(); mode != SessionCacheServer {
+		t.Fatalf("unexpected cache mode %d", mode)
+	}
+	server_ctx.SetSessionCacheSize(10)
+	if size := server_ctx.SessionCacheSize(); size != 10 {
+		t.Fatalf("unexpected cache size %d", size)
+	}
+	server_ctx.SetSessionTimeout(time.Hour)
+	if timeout := server_ctx.SessionTimeout(); timeout != time.Hour {
+		t.Fatalf("unexpected session timeout %v", timeout)
+	}
+	client_ctx, err := NewCtxWithVersion(TLSv1_2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client_store, err := NewFileSessionStore(dir + "/client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client_ctx.SetSessionStore(client_store)
+
+	resumptionRound(t, server_ctx, client_ctx)
+	resumptionRound(t, server_ctx, client_ctx)
+	stats := server_ctx.SessionCacheStats()
+	if stats.Sessions != 1 || stats.Accepts != 2 || stats.AcceptsGood != 2 ||
+		stats.Hits != 1 || stats.CallbackHits != 0 || stats.Misses != 0 {
+		t.Fatalf("unexpected server stats %+v", stats)
+	}
+	if stats := client_ctx.SessionCacheStats(); stats.Connects != 2 ||
+		stats.ConnectsGood != 2 {
+		t.Fatalf("unexpected client stats %+v", stats)
+	}
+}
+
+func TestResumptionTicket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "openssl-sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	server_ctx := newTestServerCtx(t)
+	client_ctx, _ := newSessionStoreCtx(t, dir, false)
+
+	client_res, server_res, hint := resumptionRound(t, server_ctx,
+		client_ctx)
+	if client_res != NotResumed || server_res != NotResumed {
+		t.Fatalf("expected a full handshake, got %v and %v", client_res,
+			server_res)
+	}
+	if hint <= 0 {
+		t.Fatalf("expected a ticket lifetime hint, got %v", hint)
+	}
+	client_res, server_res, _ = resumptionRound(t, server_ctx, client_ctx)
+	if client_res != ResumedTicket || server_res != ResumedTicket {
+		t.Fatalf("expected ticket resumption, got %v and %v", client_res,
+			server_res)
+	}
+}
+
+func TestGetSetSession(t *testing.T) {
+	server_ctx := newTestServerCtx(t)
+	client_ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	connect := func(session []byte) ([]byte, bool) {
+		server_conn, client_conn := NetPipe(t)
+		defer server_conn.Close()
+		defer client_conn.Close()
+		server, err := Server(server_conn, server_ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+		client, err := Client(client_conn, client_ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		if session != nil {
+			if err := client.SetSession(session); err != nil {
+				t.Fatal(err)
+			}
+		}
+		errs := make(chan error, 1)
+		go func() {
+			_, err := server.Write([]byte("hi"))
+			errs <- err
+		}()
+		// the ticket arrives ahead of the data in TLS 1.3
+		buf := make([]byte, 2)
+		if _, err := io.ReadFull(client, buf); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+		session, err = client.GetSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return session, client.DidResume()
+	}
+
+	session, resumed := connect(nil)
+	if resumed {
+		t.Fatal("expected a full handshake")
+	}
+	if _, resumed = connect(session); !resumed {
+		t.Fatal("expected the session to be resumed")
+	}
+
+	client, err := Client(nil, client_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetSession([]byte("junk")); err == nil {
+		t.Fatal("expected an error for a malformed session")
+	}
+}
+
+func TestMemorySessionStore(t *testing.T) {
+	store := NewMemorySessionStore(2)
+	expires := time.Now().Add(time.Hour)
+	for _, key := range []string{"a", "b", "c"} {
+		err := store.Put([]byte(key), []byte("session "+key), expires)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key == "b" {
+			// make a the most recently used, so b is evicted for c
+			if _, err := store.Get([]byte("a")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if store.Len() != 2 {
+		t.Fatalf("expected 2 sessions, got %d", store.Len())
+	}
+	for key, want := range map[string]string{
+		"a": "session a", "b": "", "c": "session c"} {
+		got, err := store.Get([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Fatalf("unexpected session %q under %q", got, key)
+		}
+	}
+
+	err := store.Put([]byte("a"), []byte("old"), time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := store.Get([]byte("a")); got != nil {
+		t.Fatal("expected the expired session to be dropped")
+	}
+	if err := store.Delete([]byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	if store.Len() != 0 {
+		t.Fatalf("expected no sessions, got %d", store.Len())
+	}
+}
+
+func TestMemorySessionStoreResumption(t *testing.T) {
+	server_ctx := newTestServerCtx(t)
+	client_ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client_ctx.SetSessionStore(NewMemorySessionStore(0))
+	client_res, _, _ := resumptionRound(t, server_ctx, client_ctx)
+	if client_res != NotResumed {
+		t.Fatalf("expected a full handshake, got %v", client_res)
+	}
+	client_res, _, _ = resumptionRound(t, server_ctx, client_ctx)
+	if client_res != ResumedTicket {
+		t.Fatalf("expected ticket resumption, got %v", client_res)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sessioncache provides minimal memcached and Redis clients that
+// satisfy openssl.RemoteCache, for sharing TLS sessions across a fleet with
+// openssl.NewRemoteSessionStore. They speak just enough of each protocol for
+// that purpose; use a full client library for anything else.
+package sessioncache
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+)
+
+const DefaultTimeout = 100 * time.Millisecond
+
+// conn is a single lazily dialed connection shared by all requests. Session
+// lookups sit in the handshake path, so a broken connection is dropped and
+// redialed by the next request instead of being retried.
+type conn struct {
+	addr    string
+	timeout time.Duration
+
+	mtx sync.Mutex
+	c   net.Conn
+	rw  *bufio.ReadWriter
+}
+
+func (c *conn) do(fn func(rw *bufio.ReadWriter) error) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.c == nil {
+		nc, err := net.DialTimeout("tcp", c.addr, c.timeout)
+		if err != nil {
+			return err
+		}
+		c.c = nc
+		c.rw = bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))
+	}
+	c.c.SetDeadline(time.Now().Add(c.timeout))
+	err := fn(c.rw)
+	if err != nil {
+		c.c.Close()
+		c.c = nil
+		c.rw = nil
+	}
+	return err
+}
+
+func (c *conn) Close() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.c == nil {
+		return nil
+	}
+	err := c.c.Close()
+	c.c = nil
+	c.rw = nil
+	return err
+}
+
+// readLine reads a CRLF terminated line, without the CRLF.
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", errProtocol
+	}
+	return line[:len(line)-2], nil
+}
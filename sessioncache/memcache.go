@@ -0,0 +1,128 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessioncache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errProtocol = errors.New("sessioncache: protocol error")
+)
+
+// Memcache is a client for a single memcached server, using its text
+// protocol.
+type Memcache struct {
+	conn
+}
+
+// NewMemcache returns a client for the memcached server at addr. Requests
+// time out after DefaultTimeout.
+func NewMemcache(addr string) *Memcache {
+	return &Memcache{conn{addr: addr, timeout: DefaultTimeout}}
+}
+
+// SetTimeout changes how long a request may take, including connecting.
+func (m *Memcache) SetTimeout(timeout time.Duration) {
+	m.mtx.Lock()
+	m.timeout = timeout
+	m.mtx.Unlock()
+}
+
+// Get returns the value stored under key, or nil if there is none.
+func (m *Memcache) Get(key string) (value []byte, err error) {
+	err = m.do(func(rw *bufio.ReadWriter) error {
+		fmt.Fprintf(rw, "get %s\r\n", key)
+		if err := rw.Flush(); err != nil {
+			return err
+		}
+		line, err := readLine(rw.Reader)
+		if err != nil {
+			return err
+		}
+		if line == "END" {
+			return nil
+		}
+		// VALUE <key> <flags> <bytes>
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[0] != "VALUE" || fields[1] != key {
+			return errProtocol
+		}
+		n, err := strconv.Atoi(fields[3])
+		if err != nil || n < 0 {
+			return errProtocol
+		}
+		value = make([]byte, n+2)
+		if _, err := io.ReadFull(rw, value); err != nil {
+			return err
+		}
+		value = value[:n]
+		if line, err := readLine(rw.Reader); err != nil {
+			return err
+		} else if line != "END" {
+			return errProtocol
+		}
+		return nil
+	})
+	return value, err
+}
+
+// Set stores value under key for ttl, rounded up to a whole second.
+func (m *Memcache) Set(key string, value []byte, ttl time.Duration) error {
+	secs := int64((ttl + time.Second - 1) / time.Second)
+	if secs > 30*24*60*60 {
+		// longer expirations are interpreted as unix timestamps
+		secs = 30 * 24 * 60 * 60
+	}
+	return m.do(func(rw *bufio.ReadWriter) error {
+		fmt.Fprintf(rw, "set %s 0 %d %d\r\n", key, secs, len(value))
+		rw.Write(value)
+		rw.WriteString("\r\n")
+		if err := rw.Flush(); err != nil {
+			return err
+		}
+		return expectReply(rw.Reader, "STORED")
+	})
+}
+
+// Delete removes key, if present.
+func (m *Memcache) Delete(key string) error {
+	return m.do(func(rw *bufio.ReadWriter) error {
+		fmt.Fprintf(rw, "delete %s\r\n", key)
+		if err := rw.Flush(); err != nil {
+			return err
+		}
+		return expectReply(rw.Reader, "DELETED", "NOT_FOUND")
+	})
+}
+
+func expectReply(r *bufio.Reader, expected ...string) error {
+	line, err := readLine(r)
+	if err != nil {
+		return err
+	}
+	for _, e := range expected {
+		if line == e {
+			return nil
+		}
+	}
+	return fmt.Errorf("sessioncache: unexpected reply %q", line)
+}
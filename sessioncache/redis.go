@@ -0,0 +1,110 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessioncache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// Redis is a client for a single Redis server.
+type Redis struct {
+	conn
+}
+
+// NewRedis returns a client for the Redis server at addr. Requests time out
+// after DefaultTimeout.
+func NewRedis(addr string) *Redis {
+	return &Redis{conn{addr: addr, timeout: DefaultTimeout}}
+}
+
+// SetTimeout changes how long a request may take, including connecting.
+func (r *Redis) SetTimeout(timeout time.Duration) {
+	r.mtx.Lock()
+	r.timeout = timeout
+	r.mtx.Unlock()
+}
+
+// command sends args as a request and returns the reply, which is nil for a
+// nil bulk reply.
+func (r *Redis) command(args ...[]byte) (reply []byte, err error) {
+	err = r.do(func(rw *bufio.ReadWriter) error {
+		fmt.Fprintf(rw, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(rw, "$%d\r\n", len(arg))
+			rw.Write(arg)
+			rw.WriteString("\r\n")
+		}
+		if err := rw.Flush(); err != nil {
+			return err
+		}
+		line, err := readLine(rw.Reader)
+		if err != nil {
+			return err
+		}
+		if len(line) == 0 {
+			return errProtocol
+		}
+		switch line[0] {
+		case '+', ':':
+			reply = []byte(line[1:])
+			return nil
+		case '-':
+			return fmt.Errorf("sessioncache: redis: %s", line[1:])
+		case '$':
+			n, err := strconv.Atoi(line[1:])
+			if err != nil || n < -1 {
+				return errProtocol
+			}
+			if n == -1 {
+				return nil
+			}
+			reply = make([]byte, n+2)
+			if _, err := io.ReadFull(rw, reply); err != nil {
+				return err
+			}
+			reply = reply[:n]
+			return nil
+		default:
+			return errProtocol
+		}
+	})
+	return reply, err
+}
+
+// Get returns the value stored under key, or nil if there is none.
+func (r *Redis) Get(key string) ([]byte, error) {
+	return r.command([]byte("GET"), []byte(key))
+}
+
+// Set stores value under key for ttl, with millisecond precision.
+func (r *Redis) Set(key string, value []byte, ttl time.Duration) error {
+	ms := int64(ttl / time.Millisecond)
+	if ms < 1 {
+		ms = 1
+	}
+	_, err := r.command([]byte("SET"), []byte(key), value, []byte("PX"),
+		[]byte(strconv.FormatInt(ms, 10)))
+	return err
+}
+
+// Delete removes key, if present.
+func (r *Redis) Delete(key string) error {
+	_, err := r.command([]byte("DEL"), []byte(key))
+	return err
+}
@@ -0,0 +1,152 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessioncache
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeServer accepts a single connection and calls serve for each request
+// until it fails.
+func fakeServer(t *testing.T,
+	serve func(r *bufio.Reader, w io.Writer) error) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer l.Close()
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		r := bufio.NewReader(c)
+		for serve(r, c) == nil {
+		}
+	}()
+	return l.Addr().String()
+}
+
+type client interface {
+	Get(key string) ([]byte, error)
+	Set(key string, value []byte, ttl time.Duration) error
+	Delete(key string) error
+}
+
+func exerciseClient(t *testing.T, c client) {
+	value := []byte("a\r\nbinary\x00value")
+	if err := c.Set("key", value, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.Get("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, value) {
+		t.Fatalf("unexpected value %q", got)
+	}
+	if err := c.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	got, err = c.Get("key")
+	if err != nil || got != nil {
+		t.Fatalf("expected a miss, got %q, %v", got, err)
+	}
+}
+
+func TestMemcache(t *testing.T) {
+	values := make(map[string][]byte)
+	addr := fakeServer(t, func(r *bufio.Reader, w io.Writer) error {
+		line, err := readLine(r)
+		if err != nil {
+			return err
+		}
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "get":
+			if v, ok := values[fields[1]]; ok {
+				io.WriteString(w, "VALUE "+fields[1]+" 0 "+
+					strconv.Itoa(len(v))+"\r\n"+string(v)+"\r\n")
+			}
+			_, err = io.WriteString(w, "END\r\n")
+		case "set":
+			n, _ := strconv.Atoi(fields[4])
+			v := make([]byte, n+2)
+			if _, err := io.ReadFull(r, v); err != nil {
+				return err
+			}
+			values[fields[1]] = v[:n]
+			_, err = io.WriteString(w, "STORED\r\n")
+		case "delete":
+			delete(values, fields[1])
+			_, err = io.WriteString(w, "DELETED\r\n")
+		}
+		return err
+	})
+	exerciseClient(t, NewMemcache(addr))
+}
+
+func TestRedis(t *testing.T) {
+	values := make(map[string][]byte)
+	addr := fakeServer(t, func(r *bufio.Reader, w io.Writer) error {
+		line, err := readLine(r)
+		if err != nil {
+			return err
+		}
+		n, _ := strconv.Atoi(line[1:])
+		args := make([]string, n)
+		for i := range args {
+			line, err := readLine(r)
+			if err != nil {
+				return err
+			}
+			size, _ := strconv.Atoi(line[1:])
+			arg := make([]byte, size+2)
+			if _, err := io.ReadFull(r, arg); err != nil {
+				return err
+			}
+			args[i] = string(arg[:size])
+		}
+		switch args[0] {
+		case "GET":
+			if v, ok := values[args[1]]; ok {
+				_, err = io.WriteString(w, "$"+strconv.Itoa(len(v))+"\r\n"+
+					string(v)+"\r\n")
+			} else {
+				_, err = io.WriteString(w, "$-1\r\n")
+			}
+		case "SET":
+			if len(args) != 5 || args[3] != "PX" || args[4] != "60000" {
+				_, err = io.WriteString(w, "-ERR syntax error\r\n")
+				break
+			}
+			values[args[1]] = []byte(args[2])
+			_, err = io.WriteString(w, "+OK\r\n")
+		case "DEL":
+			delete(values, args[1])
+			_, err = io.WriteString(w, ":1\r\n")
+		}
+		return err
+	})
+	exerciseClient(t, NewRedis(addr))
+}
@@ -23,6 +23,9 @@ package openssl
 #include <unistd.h>
 
 #include "openssl/evp.h"
+
+extern EVP_MD_CTX *OUR_EVP_MD_CTX_new();
+extern void OUR_EVP_MD_CTX_free(EVP_MD_CTX *ctx);
 */
 import "C"
 
@@ -33,7 +36,7 @@ import (
 )
 
 type SHA256Hash struct {
-	ctx    C.EVP_MD_CTX
+	ctx    *C.EVP_MD_CTX
 	engine *Engine
 }
 
@@ -41,7 +44,10 @@ func NewSHA256Hash() (*SHA256Hash, error) { return NewSHA256HashWithEngine(nil)
 
 func NewSHA256HashWithEngine(e *Engine) (*SHA256Hash, error) {
 	hash := &SHA256Hash{engine: e}
-	C.EVP_MD_CTX_init(&hash.ctx)
+	hash.ctx = C.OUR_EVP_MD_CTX_new()
+	if hash.ctx == nil {
+		return nil, errors.New("openssl: sha256: cannot allocate digest ctx")
+	}
 	runtime.SetFinalizer(hash, func(hash *SHA256Hash) { hash.Close() })
 	if err := hash.Reset(); err != nil {
 		return nil, err
@@ -50,11 +56,14 @@ func NewSHA256HashWithEngine(e *Engine) (*SHA256Hash, error) {
 }
 
 func (s *SHA256Hash) Close() {
-	C.EVP_MD_CTX_cleanup(&s.ctx)
+	if s.ctx != nil {
+		C.OUR_EVP_MD_CTX_free(s.ctx)
+		s.ctx = nil
+	}
 }
 
 func (s *SHA256Hash) Reset() error {
-	if 1 != C.EVP_DigestInit_ex(&s.ctx, C.EVP_sha256(), engineRef(s.engine)) {
+	if 1 != C.EVP_DigestInit_ex(s.ctx, C.EVP_sha256(), engineRef(s.engine)) {
 		return errors.New("openssl: sha256: cannot init digest ctx")
 	}
 	return nil
@@ -64,7 +73,7 @@ func (s *SHA256Hash) Write(p []byte) (n int, err error) {
 	if len(p) == 0 {
 		return 0, nil
 	}
-	if 1 != C.EVP_DigestUpdate(&s.ctx, unsafe.Pointer(&p[0]),
+	if 1 != C.EVP_DigestUpdate(s.ctx, unsafe.Pointer(&p[0]),
 		C.size_t(len(p))) {
 		return 0, errors.New("openssl: sha256: cannot update digest")
 	}
@@ -72,7 +81,7 @@ func (s *SHA256Hash) Write(p []byte) (n int, err error) {
 }
 
 func (s *SHA256Hash) Sum() (result [32]byte, err error) {
-	if 1 != C.EVP_DigestFinal_ex(&s.ctx,
+	if 1 != C.EVP_DigestFinal_ex(s.ctx,
 		(*C.uchar)(unsafe.Pointer(&result[0])), nil) {
 		return result, errors.New("openssl: sha256: cannot finalize ctx")
 	}
@@ -0,0 +1,237 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <stdlib.h>
+#include <openssl/evp.h>
+#include <openssl/rsa.h>
+#include <openssl/x509.h>
+
+#ifndef EVP_PKEY_ED25519
+#define EVP_PKEY_ED25519 NID_undef
+#endif
+
+int OUR_EVP_PKEY_sign_digest(EVP_PKEY *pkey, const EVP_MD *md,
+    int pss, int saltlen, const unsigned char *tbs, size_t tbslen,
+    unsigned char *sig, size_t *siglen) {
+    int ret = 0;
+    EVP_PKEY_CTX *ctx = EVP_PKEY_CTX_new(pkey, NULL);
+    if (ctx == NULL)
+        return 0;
+    if (EVP_PKEY_sign_init(ctx) <= 0)
+        goto end;
+    if (EVP_PKEY_base_id(pkey) == EVP_PKEY_RSA) {
+        if (EVP_PKEY_CTX_set_rsa_padding(ctx,
+                pss ? RSA_PKCS1_PSS_PADDING : RSA_PKCS1_PADDING) <= 0)
+            goto end;
+        if (pss && EVP_PKEY_CTX_set_rsa_pss_saltlen(ctx, saltlen) <= 0)
+            goto end;
+    }
+    if (md != NULL && EVP_PKEY_CTX_set_signature_md(ctx, md) <= 0)
+        goto end;
+    ret = EVP_PKEY_sign(ctx, sig, siglen, tbs, tbslen);
+end:
+    EVP_PKEY_CTX_free(ctx);
+    return ret;
+}
+
+int OUR_EVP_DigestSign_oneshot(EVP_PKEY *pkey,
+    const unsigned char *tbs, size_t tbslen,
+    unsigned char *sig, size_t *siglen) {
+#if OPENSSL_VERSION_NUMBER >= 0x10101000L
+    int ret = 0;
+    EVP_MD_CTX *ctx = EVP_MD_CTX_new();
+    if (ctx == NULL)
+        return 0;
+    if (EVP_DigestSignInit(ctx, NULL, NULL, NULL, pkey) == 1)
+        ret = EVP_DigestSign(ctx, sig, siglen, tbs, tbslen);
+    EVP_MD_CTX_free(ctx);
+    return ret;
+#else
+    return 0;
+#endif
+}
+*/
+import "C"
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"unsafe"
+)
+
+var signerDigestNames = map[crypto.Hash]string{
+	crypto.SHA1:   "SHA1",
+	crypto.SHA224: "SHA224",
+	crypto.SHA256: "SHA256",
+	crypto.SHA384: "SHA384",
+	crypto.SHA512: "SHA512",
+}
+
+// hashMethod returns the digest for hash.
+func hashMethod(hash crypto.Hash) (Method, error) {
+	name, ok := signerDigestNames[hash]
+	if !ok {
+		return nil, fmt.Errorf("unsupported hash function %v", hash)
+	}
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	md := C.EVP_get_digestbyname(cname)
+	if md == nil {
+		return nil, fmt.Errorf("digest %s not available", name)
+	}
+	return md, nil
+}
+
+type pKeySigner struct {
+	key PrivateKey
+	pub crypto.PublicKey
+}
+
+// NewSigner returns a crypto.Signer that performs its signatures with key,
+// which may live inside an engine (see Engine.LoadPrivateKey). RSA keys
+// support PKCS#1 v1.5 and PSS (pass *rsa.PSSOptions), ECDSA keys produce
+// ASN.1 signatures, and Ed25519 keys sign the unhashed message when built
+// against OpenSSL 1.1.1 or newer. Every PrivateKey is a crypto.Signer
+// itself; NewSigner also converts the public key once, failing if the
+// standard library can't represent it.
+func NewSigner(key PrivateKey) (crypto.Signer, error) {
+	der, err := key.MarshalPKIXPublicKeyDER()
+	if err != nil {
+		return nil, err
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	return &pKeySigner{key: key, pub: pub}, nil
+}
+
+func (s *pKeySigner) Public() crypto.PublicKey { return s.pub }
+
+func (s *pKeySigner) Sign(rand io.Reader, digest []byte,
+	opts crypto.SignerOpts) ([]byte, error) {
+	return s.key.Sign(rand, digest, opts)
+}
+
+// Public returns the standard library form of the key's public key, or nil
+// if it can't be converted. NewSigner converts it once, up front.
+func (key *pKey) Public() crypto.PublicKey {
+	der, err := key.MarshalPKIXPublicKeyDER()
+	if err != nil {
+		return nil
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil
+	}
+	return pub
+}
+
+// Sign implements crypto.Signer; see NewSigner.
+func (key *pKey) Sign(rand io.Reader, digest []byte,
+	opts crypto.SignerOpts) ([]byte, error) {
+	pkey := key.acquirePKey()
+	if pkey == nil {
+		return nil, keyFreed
+	}
+	defer C.EVP_PKEY_free(pkey)
+	sig := make([]byte, C.EVP_PKEY_size(pkey))
+	siglen := C.size_t(len(sig))
+	var tbs *C.uchar
+	if len(digest) > 0 {
+		tbs = (*C.uchar)(unsafe.Pointer(&digest[0]))
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	hash := opts.HashFunc()
+	if hash == 0 {
+		if C.EVP_PKEY_base_id(pkey) != C.EVP_PKEY_ED25519 {
+			return nil, errors.New("signing without a hash is only " +
+				"supported for ed25519 keys")
+		}
+		if C.OUR_EVP_DigestSign_oneshot(pkey, tbs, C.size_t(len(digest)),
+			(*C.uchar)(&sig[0]), &siglen) != 1 {
+			return nil, errorFromErrorQueue()
+		}
+		return sig[:siglen], nil
+	}
+
+	if len(digest) != hash.Size() {
+		return nil, fmt.Errorf("digest is %d bytes, expected %d",
+			len(digest), hash.Size())
+	}
+	var md Method
+	if hash != crypto.MD5SHA1 {
+		var err error
+		if md, err = hashMethod(hash); err != nil {
+			return nil, err
+		}
+	}
+	// the TLS 1.0/1.1 MD5SHA1 combination is signed as a bare digest
+	pss_opts, _ := opts.(*rsa.PSSOptions)
+	pss, saltlen := pssSaltLength(pss_opts)
+	if C.OUR_EVP_PKEY_sign_digest(pkey, md, pss, saltlen, tbs,
+		C.size_t(len(digest)), (*C.uchar)(&sig[0]), &siglen) != 1 {
+		return nil, errorFromErrorQueue()
+	}
+	return sig[:siglen], nil
+}
+
+// NewTLSCertificate builds a crypto/tls certificate from chain, leaf first,
+// whose PrivateKey is a NewSigner proxy for key. This lets standard library
+// TLS servers and clients elsewhere in a program present an identity whose
+// key is held by an OpenSSL engine or HSM.
+func NewTLSCertificate(key PrivateKey, chain ...*Certificate) (
+	tls.Certificate, error) {
+	if len(chain) == 0 {
+		return tls.Certificate{}, errors.New("no certificates provided")
+	}
+	signer, err := NewSigner(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	var rv tls.Certificate
+	for _, cert := range chain {
+		der, err := cert.MarshalDER()
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		rv.Certificate = append(rv.Certificate, der)
+	}
+	rv.Leaf, err = x509.ParseCertificate(rv.Certificate[0])
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf_pub, ok := rv.Leaf.PublicKey.(interface {
+		Equal(crypto.PublicKey) bool
+	})
+	if !ok || !leaf_pub.Equal(signer.Public()) {
+		return tls.Certificate{}, errors.New(
+			"private key does not match certificate")
+	}
+	rv.PrivateKey = signer
+	return rv, nil
+}
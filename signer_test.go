@@ -0,0 +1,111 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"net"
+	"testing"
+)
+
+func testStdlibHandshake(t *testing.T, key PrivateKey, version uint16) {
+	cert, err := NewTLSCertificate(key, issueTestCert(t, key, testCert{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server_conn, client_conn := net.Pipe()
+	defer client_conn.Close()
+	server := tls.Server(server_conn, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   version,
+		MaxVersion:   version})
+	defer server.Close()
+	errs := make(chan error, 1)
+	go func() { errs <- server.Handshake() }()
+
+	// the test certificate has no SANs, so skip chain validation. the
+	// handshake signature made by the signer is still checked.
+	client := tls.Client(client_conn, &tls.Config{
+		InsecureSkipVerify: true,
+		MinVersion:         version,
+		MaxVersion:         version})
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	peer := client.ConnectionState().PeerCertificates
+	if len(peer) != 1 || !peer[0].Equal(cert.Leaf) {
+		t.Fatal("unexpected peer certificate")
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLSCertificateRSA(t *testing.T) {
+	key := generateTestRSAKey(t)
+	testStdlibHandshake(t, key, tls.VersionTLS12)
+	testStdlibHandshake(t, key, tls.VersionTLS13)
+}
+
+func TestTLSCertificateECDSA(t *testing.T) {
+	std, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := FromStdlibPrivateKey(std)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStdlibHandshake(t, key, tls.VersionTLS12)
+	testStdlibHandshake(t, key, tls.VersionTLS13)
+}
+
+func TestTLSCertificateMismatch(t *testing.T) {
+	cert := issueTestCert(t, generateTestRSAKey(t), testCert{})
+	_, err := NewTLSCertificate(generateTestRSAKey(t), cert)
+	if err == nil {
+		t.Fatal("expected mismatched key to be rejected")
+	}
+}
+
+func TestSignerEd25519(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := FromStdlibPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := NewSigner(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte("hello")
+	sig, err := signer.Sign(rand.Reader, msg, crypto.Hash(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ed25519.Verify(pub, msg, sig) {
+		t.Fatal("signature did not verify")
+	}
+}
@@ -0,0 +1,250 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <openssl/ec.h>
+#include <openssl/err.h>
+#include <openssl/evp.h>
+#include <openssl/objects.h>
+
+#if OPENSSL_VERSION_NUMBER < 0x10101000L || defined(OPENSSL_NO_SM2)
+#define OUR_NO_SM2
+#endif
+
+static const EVP_MD *OUR_EVP_sm3() {
+#if OPENSSL_VERSION_NUMBER >= 0x10101000L && !defined(OPENSSL_NO_SM3)
+    return EVP_sm3();
+#else
+    return NULL;
+#endif
+}
+
+static EVP_PKEY *OUR_SM2_generate() {
+#ifdef OUR_NO_SM2
+    return NULL;
+#else
+    EVP_PKEY *key = NULL;
+#if OPENSSL_VERSION_NUMBER >= 0x30000000L
+    EVP_PKEY_CTX *ctx = EVP_PKEY_CTX_new_id(EVP_PKEY_SM2, NULL);
+    if (ctx == NULL)
+        return NULL;
+    if (EVP_PKEY_keygen_init(ctx) <= 0 || EVP_PKEY_keygen(ctx, &key) <= 0)
+        key = NULL;
+#else
+    EVP_PKEY_CTX *ctx = EVP_PKEY_CTX_new_id(EVP_PKEY_EC, NULL);
+    if (ctx == NULL)
+        return NULL;
+    if (EVP_PKEY_keygen_init(ctx) <= 0)
+        goto end;
+    if (EVP_PKEY_CTX_set_ec_paramgen_curve_nid(ctx, NID_sm2) <= 0)
+        goto end;
+    if (EVP_PKEY_CTX_set_ec_param_enc(ctx, OPENSSL_EC_NAMED_CURVE) <= 0)
+        goto end;
+    if (EVP_PKEY_keygen(ctx, &key) <= 0) {
+        key = NULL;
+        goto end;
+    }
+    // 1.1.1 only signs with SM2 rather than ECDSA once told to
+    if (EVP_PKEY_set_alias_type(key, EVP_PKEY_SM2) != 1) {
+        EVP_PKEY_free(key);
+        key = NULL;
+    }
+end:
+#endif
+    EVP_PKEY_CTX_free(ctx);
+    return key;
+#endif
+}
+
+static int OUR_EVP_PKEY_is_sm2(EVP_PKEY *pkey) {
+#if defined(OUR_NO_SM2)
+    return 0;
+#elif OPENSSL_VERSION_NUMBER >= 0x30000000L
+    return EVP_PKEY_is_a(pkey, "SM2");
+#else
+    return EVP_PKEY_id(pkey) == EVP_PKEY_SM2;
+#endif
+}
+
+// signs or verifies tbs with SM2 and SM3, binding the signer's distinguishing
+// id into the digest
+static int OUR_SM2_sign_verify(EVP_PKEY *pkey, int sign,
+        const unsigned char *id, size_t id_len,
+        const unsigned char *tbs, size_t tbslen,
+        unsigned char *sig, size_t *siglen) {
+#ifdef OUR_NO_SM2
+    return 0;
+#else
+    int ret = 0;
+    EVP_PKEY_CTX *pctx = NULL;
+    EVP_MD_CTX *ctx = EVP_MD_CTX_new();
+    if (ctx == NULL)
+        return 0;
+    pctx = EVP_PKEY_CTX_new(pkey, NULL);
+    if (pctx == NULL)
+        goto end;
+    if (EVP_PKEY_CTX_set1_id(pctx, id, id_len) <= 0)
+        goto end;
+    EVP_MD_CTX_set_pkey_ctx(ctx, pctx);
+    if (sign) {
+        if (EVP_DigestSignInit(ctx, NULL, EVP_sm3(), NULL, pkey) != 1)
+            goto end;
+        ret = EVP_DigestSign(ctx, sig, siglen, tbs, tbslen);
+    } else {
+        if (EVP_DigestVerifyInit(ctx, NULL, EVP_sm3(), NULL, pkey) != 1)
+            goto end;
+        ret = EVP_DigestVerify(ctx, sig, *siglen, tbs, tbslen);
+    }
+end:
+    EVP_MD_CTX_free(ctx);
+    EVP_PKEY_CTX_free(pctx);
+    return ret;
+#endif
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"runtime"
+	"strings"
+	"unsafe"
+)
+
+// SM3_Method is the SM3 digest of GM/T 0004, for use wherever a Method is
+// taken, e.g. with NewDigest or NewHMAC. It is nil if the linked OpenSSL
+// lacks it; it requires OpenSSL 1.1.1.
+var SM3_Method Method = C.OUR_EVP_sm3()
+
+// SM2DefaultID is the distinguishing identifier GM/T 0009 specifies for
+// SM2 signatures when the parties haven't agreed on another.
+var SM2DefaultID = []byte("1234567812345678")
+
+// SMCipherSuites is the TLS 1.3 cipher suite list of RFC 8998, which uses SM4
+// and SM3, for Ctx.SetCipherSuites.
+const SMCipherSuites = "TLS_SM4_GCM_SM3:TLS_SM4_CCM_SM3"
+
+// GetSM4Cipher returns the SM4 block cipher of GM/T 0002 in the given mode,
+// such as "CBC", "CTR" or "GCM", for use with the cipher contexts and
+// NewEncryptingWriter. SM4 keys are 16 bytes long. It requires OpenSSL 1.1.1,
+// and GCM and CCM a version that provides them.
+func GetSM4Cipher(mode string) (*Cipher, error) {
+	c, err := GetCipherByName("SM4-" + strings.ToUpper(mode))
+	if err != nil {
+		return nil, errors.New("SM4 in " + mode + " mode is not supported " +
+			"by this version of OpenSSL")
+	}
+	return c, nil
+}
+
+// GenerateSM2Key generates a new SM2 key, an EC key on the SM2 curve that
+// signs with SignSM2 rather than ECDSA. It requires OpenSSL 1.1.1.
+func GenerateSM2Key() (PrivateKey, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	key := C.OUR_SM2_generate()
+	if key == nil {
+		if C.ERR_peek_error() == 0 {
+			return nil, errors.New("SM2 is not supported by this version of " +
+				"OpenSSL")
+		}
+		return nil, errorFromErrorQueue()
+	}
+	return newPKey(key), nil
+}
+
+// SignSM2 signs message, which is hashed with SM3 along with id and the
+// public key as GM/T 0003 specifies, with the SM2 key key. A nil id is taken
+// to be SM2DefaultID.
+func SignSM2(key PrivateKey, id, message []byte) ([]byte, error) {
+	pkey := key.acquirePKey()
+	if pkey == nil {
+		return nil, keyFreed
+	}
+	defer C.EVP_PKEY_free(pkey)
+	if C.OUR_EVP_PKEY_is_sm2(pkey) != 1 {
+		return nil, errors.New("SM2 signatures require an SM2 key")
+	}
+	if id == nil {
+		id = SM2DefaultID
+	}
+	sig := make([]byte, C.EVP_PKEY_size(pkey))
+	siglen := C.size_t(len(sig))
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.OUR_SM2_sign_verify(pkey, 1, smBytes(id), C.size_t(len(id)),
+		smBytes(message), C.size_t(len(message)), (*C.uchar)(&sig[0]),
+		&siglen) != 1 {
+		return nil, errorFromErrorQueue()
+	}
+	return sig[:siglen], nil
+}
+
+// VerifySM2 checks the SM2 signature sig over message with the SM2 key key.
+// id must be the one the signer used; nil is taken to be SM2DefaultID.
+func VerifySM2(key PublicKey, id, message, sig []byte) error {
+	if len(sig) == 0 {
+		return errors.New("verify: invalid signature")
+	}
+	pkey := key.acquirePKey()
+	if pkey == nil {
+		return keyFreed
+	}
+	defer C.EVP_PKEY_free(pkey)
+	if C.OUR_EVP_PKEY_is_sm2(pkey) != 1 {
+		return errors.New("SM2 signatures require an SM2 key")
+	}
+	if id == nil {
+		id = SM2DefaultID
+	}
+	siglen := C.size_t(len(sig))
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.OUR_SM2_sign_verify(pkey, 0, smBytes(id), C.size_t(len(id)),
+		smBytes(message), C.size_t(len(message)),
+		(*C.uchar)(unsafe.Pointer(&sig[0])), &siglen) != 1 {
+		C.ERR_clear_error()
+		return errors.New("verify: invalid signature")
+	}
+	return nil
+}
+
+// smBytes returns a C pointer to b, or to a dummy byte if b is empty, as
+// OpenSSL rejects NULL input even when its length is 0.
+func smBytes(b []byte) *C.uchar {
+	if len(b) == 0 {
+		return (*C.uchar)(unsafe.Pointer(&[]byte{0}[0]))
+	}
+	return (*C.uchar)(unsafe.Pointer(&b[0]))
+}
+
+// UseSMCipherSuites makes the context offer only the TLS 1.3 cipher suites
+// of RFC 8998, SMCipherSuites, as required where the Chinese national
+// algorithms are mandatory. Upstream OpenSSL doesn't implement them, so this
+// fails unless the linked library, such as BabaSSL or Tongsuo, does. The
+// certificates and key exchange groups to pair them with are configured as
+// usual, e.g. with an SM2 key and SetCurvesList.
+func (c *Ctx) UseSMCipherSuites() error {
+	if _, err := ParseCipherList("", SMCipherSuites); err != nil {
+		return errors.New("the SM TLS cipher suites are not supported by " +
+			"this version of OpenSSL")
+	}
+	return c.SetCipherSuites(SMCipherSuites)
+}
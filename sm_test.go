@@ -0,0 +1,146 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestSM3(t *testing.T) {
+	if SM3_Method == nil {
+		t.Skip("SM3 is not supported by this version of OpenSSL")
+	}
+	h, err := NewDigest(SM3_Method)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// GM/T 0004 example 1
+	h.Write([]byte("abc"))
+	expected := "66c7f0f462eeedd9d1f2d46bdc10e4e24167c4875cf2f7a2297da02b8f4ba8e0"
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != expected {
+		t.Fatalf("expected %s, got %s", expected, sum)
+	}
+}
+
+func TestSM4(t *testing.T) {
+	c, err := GetSM4Cipher("ecb")
+	if err != nil {
+		t.Skip(err)
+	}
+	// GM/T 0002 example 1, in which the key is also the plaintext
+	key, _ := hex.DecodeString("0123456789abcdeffedcba9876543210")
+	ctx, err := NewEncryptionCipherCtx(c, nil, key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ctx.EncryptUpdate(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	final, err := ctx.EncryptFinal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out = append(out, final...)
+	expected := "681edf34d206965e86b3e94f536e4246"
+	// followed by the padding block
+	if len(out) != 32 || hex.EncodeToString(out[:16]) != expected {
+		t.Fatalf("expected %s, got %x", expected, out)
+	}
+	if _, err := GetSM4Cipher("bogus"); err == nil {
+		t.Fatal("expected an error for an unknown mode")
+	}
+}
+
+func TestSM2(t *testing.T) {
+	key, err := GenerateSM2Key()
+	if err != nil {
+		t.Skip(err)
+	}
+	key_type, err := key.KeyType()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key_type != KeyTypeSM2 && key_type != KeyTypeEC {
+		t.Fatalf("expected an SM2 key, got %s", key_type)
+	}
+	message := []byte("hello, world")
+	sig, err := SignSM2(key, nil, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifySM2(key, nil, message, sig); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifySM2(key, SM2DefaultID, message, sig); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifySM2(key, []byte("alice@example.com"), message,
+		sig); err == nil {
+		t.Fatal("expected a signature under another id to fail")
+	}
+	if err := VerifySM2(key, nil, []byte("goodbye"), sig); err == nil {
+		t.Fatal("expected a signature over another message to fail")
+	}
+
+	// round trips through PEM
+	pem, err := key.MarshalPKCS8PrivateKeyPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadPrivateKeyFromPEM(pem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifySM2(loaded, nil, message, sig); err != nil {
+		t.Fatal(err)
+	}
+
+	ec_key, err := GenerateECKey(Prime256v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SignSM2(ec_key, nil, message); err == nil {
+		t.Fatal("expected an error signing with a P-256 key")
+	}
+}
+
+func TestUseSMCipherSuites(t *testing.T) {
+	ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, parse_err := ParseCipherList("", SMCipherSuites)
+	err = ctx.UseSMCipherSuites()
+	if parse_err != nil {
+		if err == nil {
+			t.Fatal("expected an error when the suites aren't supported")
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, suite := range ctx.CipherSuites() {
+		if suite.Version == "TLSv1.3" &&
+			!strings.Contains(suite.Name, "SM4") {
+			t.Fatalf("unexpected TLS 1.3 suite %s", suite.Name)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include <openssl/ssl.h>
+#include "_cgo_export.h"
+
+int SSL_get_ex_new_index_not_a_macro() {
+	return SSL_get_ex_new_index(0, NULL, NULL, NULL, NULL);
+}
+
+static int servername_cb(SSL *ssl, int *alert, void *arg) {
+	// this is always the context the connection was made with, even once
+	// the callback has switched it
+	return servername_cb_thunk(
+		SSL_CTX_get_ex_data(SSL_get_SSL_CTX(ssl), get_ssl_ctx_idx()),
+		SSL_get_ex_data(ssl, get_ssl_idx()), ssl);
+}
+
+long SSL_CTX_set_servername_cb(SSL_CTX *ssl_ctx, int enabled) {
+	return SSL_CTX_set_tlsext_servername_callback(ssl_ctx,
+		(enabled ? servername_cb : NULL));
+}
@@ -0,0 +1,114 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <openssl/ssl.h>
+
+extern int SSL_get_ex_new_index_not_a_macro();
+extern long SSL_CTX_set_servername_cb(SSL_CTX *ssl_ctx, int enabled);
+*/
+import "C"
+
+import (
+	"os"
+	"unsafe"
+)
+
+var ssl_idx = C.SSL_get_ex_new_index_not_a_macro()
+
+//export get_ssl_idx
+func get_ssl_idx() C.int {
+	return ssl_idx
+}
+
+// setConnExData lets callbacks find conn from its SSL object.
+func setConnExData(ssl *C.SSL, conn *Conn) {
+	p := unsafe.Pointer(conn)
+	C.SSL_set_ex_data(ssl, get_ssl_idx(), p)
+}
+
+// TLSExtServerNameCallback picks the context a server connection continues
+// its handshake with, given the host name the client sent with SNI, or ""
+// if it sent none. Returning nil carries on with the connection's current
+// context.
+type TLSExtServerNameCallback func(server_name string) *Ctx
+
+// SetTLSExtServerNameCallback makes server connections using the context
+// consult cb during the handshake, so that one listener can present the
+// certificate for each of several host names, like tls.Config's
+// GetCertificate. The chosen context supplies the certificate, key, chain
+// and OCSP staple. Most other settings, such as protocol versions, options,
+// the verify mode and session caching, stay as the connection's original
+// context has them. A nil cb removes the callback.
+func (c *Ctx) SetTLSExtServerNameCallback(cb TLSExtServerNameCallback) {
+	c.servername_cb = cb
+	var enabled C.int
+	if cb != nil {
+		enabled = 1
+	}
+	C.SSL_CTX_set_servername_cb(c.ctx, enabled)
+}
+
+//export servername_cb_thunk
+func servername_cb_thunk(p unsafe.Pointer, conn_p unsafe.Pointer,
+	ssl *C.SSL) C.int {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Critf("openssl: server name callback panic'd: %v", err)
+			os.Exit(1)
+		}
+	}()
+	ctx := (*Ctx)(p)
+	conn := (*Conn)(conn_p)
+	if ctx.servername_cb == nil {
+		return C.SSL_TLSEXT_ERR_OK
+	}
+	server_name := ""
+	if name := C.SSL_get_servername(ssl,
+		C.TLSEXT_NAMETYPE_host_name); name != nil {
+		server_name = C.GoString(name)
+	}
+	new_ctx := ctx.servername_cb(server_name)
+	if new_ctx == nil || new_ctx == conn.ctx {
+		return C.SSL_TLSEXT_ERR_OK
+	}
+	if new_ctx.retain() != nil {
+		return C.SSL_TLSEXT_ERR_ALERT_FATAL
+	}
+	if C.SSL_set_SSL_CTX(ssl, new_ctx.ctx) == nil {
+		new_ctx.release()
+		return C.SSL_TLSEXT_ERR_ALERT_FATAL
+	}
+	// the handshake holds conn.mtx, and the connection now needs new_ctx
+	// kept alive, while OpenSSL still uses the original for sessions
+	conn.ctx = new_ctx
+	conn.ctxs = append(conn.ctxs, new_ctx)
+	return C.SSL_TLSEXT_ERR_OK
+}
+
+// ServerName returns the host name the client sent with SNI, or "" if it
+// sent none. On clients it is the name set with SetTlsExtHostName.
+func (c *Conn) ServerName() string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	name := C.SSL_get_servername(c.ssl, C.TLSEXT_NAMETYPE_host_name)
+	if name == nil {
+		return ""
+	}
+	return C.GoString(name)
+}
@@ -0,0 +1,339 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ClientHelloTimeout is how long an SNIRouter waits for a client to send
+	// its ClientHello before dropping the connection.
+	ClientHelloTimeout = 10 * time.Second
+
+	// maxClientHelloSize bounds how much an SNIRouter buffers while looking
+	// for the server name.
+	maxClientHelloSize = 64 * 1024
+)
+
+var (
+	NotClientHello = errors.New("connection did not start with a TLS " +
+		"ClientHello")
+	NoRoute = errors.New("no route for requested server name")
+)
+
+type sniRoute struct {
+	ctx     *Ctx
+	handler func(conn *Conn)
+	backend string
+}
+
+// SNIRouter accepts connections on a single listener and dispatches each one
+// based on the server name its client asks for, so that one port can front
+// several TLS services. A route either terminates TLS with its own context
+// and hands the connection to a handler, or passes the raw connection
+// through to a backend that terminates TLS itself.
+//
+// Names are matched case insensitively. A name of the form "*.example.com"
+// matches any single label in place of the asterisk, and the name ""
+// matches clients that sent no server name or matched no other route.
+type SNIRouter struct {
+	mtx    sync.RWMutex
+	routes map[string]*sniRoute
+
+	// ErrorLog, if set, is called with connections that could not be routed
+	// and why. They are closed afterwards.
+	ErrorLog func(conn net.Conn, err error)
+}
+
+// NewSNIRouter returns a router with no routes.
+func NewSNIRouter() *SNIRouter {
+	return &SNIRouter{routes: make(map[string]*sniRoute)}
+}
+
+// Handle routes connections for name to handler, after wrapping them as
+// server connections using ctx. The handshake happens on the handler's first
+// read or write, or when it calls Handshake. The handler owns the
+// connection and must close it.
+func (r *SNIRouter) Handle(name string, ctx *Ctx, handler func(conn *Conn)) {
+	r.setRoute(name, &sniRoute{ctx: ctx, handler: handler})
+}
+
+// Passthrough routes connections for name to the TCP address backend,
+// without terminating TLS. Bytes are copied verbatim in both directions,
+// starting with the ClientHello.
+func (r *SNIRouter) Passthrough(name, backend string) {
+	r.setRoute(name, &sniRoute{backend: backend})
+}
+
+// Remove deletes the route for name, if any.
+func (r *SNIRouter) Remove(name string) {
+	r.mtx.Lock()
+	delete(r.routes, strings.ToLower(name))
+	r.mtx.Unlock()
+}
+
+func (r *SNIRouter) setRoute(name string, route *sniRoute) {
+	r.mtx.Lock()
+	r.routes[strings.ToLower(name)] = route
+	r.mtx.Unlock()
+}
+
+func (r *SNIRouter) lookup(name string) *sniRoute {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	if route, ok := r.routes[name]; ok && name != "" {
+		return route
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if route, ok := r.routes["*"+name[i:]]; ok {
+			return route
+		}
+	}
+	return r.routes[""]
+}
+
+// Serve accepts connections from l and routes each in its own goroutine,
+// until l returns an error, which Serve returns.
+func (r *SNIRouter) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go r.ServeConn(conn)
+	}
+}
+
+// ServeConn reads the ClientHello from conn and routes it. It returns when
+// the route's handler does, or when a passthrough connection finishes.
+func (r *SNIRouter) ServeConn(conn net.Conn) {
+	err := r.serveConn(conn)
+	if err != nil {
+		if r.ErrorLog != nil {
+			r.ErrorLog(conn, err)
+		}
+		conn.Close()
+	}
+}
+
+func (r *SNIRouter) serveConn(conn net.Conn) error {
+	err := conn.SetReadDeadline(time.Now().Add(ClientHelloTimeout))
+	if err != nil {
+		return err
+	}
+	hello, name, err := readClientHello(conn)
+	if err != nil {
+		return err
+	}
+	err = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return err
+	}
+	route := r.lookup(name)
+	if route == nil {
+		return NoRoute
+	}
+	replayed := &replayConn{
+		Conn:   conn,
+		reader: io.MultiReader(bytes.NewReader(hello), conn)}
+
+	if route.backend != "" {
+		backend, err := net.DialTimeout("tcp", route.backend,
+			ClientHelloTimeout)
+		if err != nil {
+			return err
+		}
+		proxyConns(replayed, backend)
+		return nil
+	}
+	tls_conn, err := Server(replayed, route.ctx)
+	if err != nil {
+		return err
+	}
+	route.handler(tls_conn)
+	return nil
+}
+
+// proxyConns copies between a and b until both directions finish, then
+// closes both.
+func proxyConns(a, b net.Conn) {
+	var wg sync.WaitGroup
+	copy_half := func(dst, src net.Conn) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		// let the other side see EOF while still sending
+		if tcp, ok := dst.(interface {
+			CloseWrite() error
+		}); ok {
+			tcp.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+	wg.Add(2)
+	go copy_half(a, b)
+	go copy_half(b, a)
+	wg.Wait()
+	a.Close()
+	b.Close()
+}
+
+// replayConn is a net.Conn that yields some already-read bytes before
+// reading from the connection again.
+type replayConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// CloseWrite half-closes the underlying connection when it supports it.
+func (c *replayConn) CloseWrite() error {
+	if tcp, ok := c.Conn.(interface {
+		CloseWrite() error
+	}); ok {
+		return tcp.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// readClientHello reads TLS records from r until it has the complete
+// ClientHello handshake message, returning the bytes read and the server
+// name the client asked for, if any.
+func readClientHello(r io.Reader) (raw []byte, name string, err error) {
+	var handshake []byte
+	for {
+		var header [5]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return raw, "", err
+		}
+		raw = append(raw, header[:]...)
+		// content type handshake, major version 3
+		if header[0] != 22 || header[1] != 3 {
+			return raw, "", NotClientHello
+		}
+		length := int(header[3])<<8 | int(header[4])
+		if len(raw)+length > maxClientHelloSize {
+			return raw, "", NotClientHello
+		}
+		record := make([]byte, length)
+		if _, err := io.ReadFull(r, record); err != nil {
+			return raw, "", err
+		}
+		raw = append(raw, record...)
+		handshake = append(handshake, record...)
+		if len(handshake) < 4 {
+			continue
+		}
+		if handshake[0] != 1 {
+			return raw, "", NotClientHello
+		}
+		msg_len := int(handshake[1])<<16 | int(handshake[2])<<8 |
+			int(handshake[3])
+		if len(handshake) < 4+msg_len {
+			continue
+		}
+		name, err := parseServerName(handshake[4 : 4+msg_len])
+		return raw, name, err
+	}
+}
+
+// parseServerName extracts the host name from the server_name extension of
+// a ClientHello message body.
+func parseServerName(hello []byte) (string, error) {
+	p := &helloParser{data: hello}
+	p.skip(2 + 32)          // client_version, random
+	p.skip(int(p.uint8()))  // session_id
+	p.skip(int(p.uint16())) // cipher_suites
+	p.skip(int(p.uint8()))  // compression_methods
+	if p.err == nil && len(p.data) == 0 {
+		// no extensions
+		return "", nil
+	}
+	extensions := &helloParser{data: p.bytes(int(p.uint16()))}
+	for p.err == nil && len(extensions.data) > 0 {
+		ext_type := extensions.uint16()
+		ext := &helloParser{data: extensions.bytes(int(extensions.uint16()))}
+		if extensions.err != nil {
+			return "", extensions.err
+		}
+		if ext_type != 0 {
+			continue
+		}
+		names := &helloParser{data: ext.bytes(int(ext.uint16()))}
+		for ext.err == nil && len(names.data) > 0 {
+			name_type := names.uint8()
+			host := names.bytes(int(names.uint16()))
+			if names.err != nil {
+				return "", names.err
+			}
+			if name_type == 0 {
+				return string(host), nil
+			}
+		}
+		return "", ext.err
+	}
+	return "", p.err
+}
+
+type helloParser struct {
+	data []byte
+	err  error
+}
+
+func (p *helloParser) bytes(n int) []byte {
+	if p.err != nil {
+		return nil
+	}
+	if len(p.data) < n {
+		p.err = NotClientHello
+		return nil
+	}
+	rv := p.data[:n]
+	p.data = p.data[n:]
+	return rv
+}
+
+func (p *helloParser) skip(n int) {
+	p.bytes(n)
+}
+
+func (p *helloParser) uint8() uint8 {
+	b := p.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (p *helloParser) uint16() uint16 {
+	b := p.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return uint16(b[0])<<8 | uint16(b[1])
+}
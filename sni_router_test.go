@@ -0,0 +1,109 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestSNIRouter(t *testing.T) {
+	// a backend terminating TLS itself, for passthrough
+	backend, err := Listen("tcp", "127.0.0.1:0", newTestServerCtx(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			c, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			io.WriteString(c, "backend")
+			c.Close()
+		}
+	}()
+
+	router := NewSNIRouter()
+	router.Handle("*.example.com", newTestServerCtx(t), func(conn *Conn) {
+		io.WriteString(conn, "terminated")
+		conn.Close()
+	})
+	router.Passthrough("passthrough.test", backend.Addr().String())
+	unrouted := make(chan error, 1)
+	router.ErrorLog = func(conn net.Conn, err error) { unrouted <- err }
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go router.Serve(l)
+
+	get := func(name string) (string, error) {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+			ServerName:         name,
+			InsecureSkipVerify: true})
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		data, err := io.ReadAll(conn)
+		return string(data), err
+	}
+	if data, err := get("www.Example.com"); err != nil || data != "terminated" {
+		t.Fatalf("unexpected result %q, %v", data, err)
+	}
+	if data, err := get("passthrough.test"); err != nil || data != "backend" {
+		t.Fatalf("unexpected result %q, %v", data, err)
+	}
+	if _, err := get("unknown.test"); err == nil {
+		t.Fatal("expected unrouted connection to fail")
+	}
+	if err := <-unrouted; err != NoRoute {
+		t.Fatalf("expected NoRoute, got %v", err)
+	}
+}
+
+func TestParseServerName(t *testing.T) {
+	server_conn, client_conn := net.Pipe()
+	defer server_conn.Close()
+	go func() {
+		tls.Client(client_conn, &tls.Config{ServerName: "host.test"}).
+			Handshake()
+		client_conn.Close()
+	}()
+	raw, name, err := readClientHello(server_conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "host.test" {
+		t.Fatalf("unexpected server name %q", name)
+	}
+	if len(raw) < 5 || raw[0] != 22 {
+		t.Fatal("expected the raw record to be returned")
+	}
+
+	_, _, err = readClientHello(strings.NewReader("GET / HTTP/1.0\r\n\r\n"))
+	if err != NotClientHello {
+		t.Fatalf("expected NotClientHello, got %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTLSExtServerNameCallback(t *testing.T) {
+	default_ctx := newTestServerCtx(t)
+	key := generateTestRSAKey(t)
+	vhost_cert := issueTestCert(t, key, testCert{})
+	vhost_ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vhost_ctx.UsePrivateKey(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := vhost_ctx.UseCertificate(vhost_cert); err != nil {
+		t.Fatal(err)
+	}
+	vhost_der, err := vhost_cert.MarshalDER()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var seen []string
+	default_ctx.SetTLSExtServerNameCallback(func(name string) *Ctx {
+		seen = append(seen, name)
+		if name == "vhost.test" {
+			return vhost_ctx
+		}
+		return nil
+	})
+
+	connect := func(name string) ([]byte, string) {
+		client_ctx, err := NewCtx()
+		if err != nil {
+			t.Fatal(err)
+		}
+		server_conn, client_conn := NetPipe(t)
+		defer server_conn.Close()
+		defer client_conn.Close()
+		server, err := Server(server_conn, default_ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+		client, err := Client(client_conn, client_ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		if name != "" {
+			if err := client.SetTlsExtHostName(name); err != nil {
+				t.Fatal(err)
+			}
+		}
+		errs := make(chan error, 1)
+		go func() { errs <- server.Handshake() }()
+		if err := client.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+		cert, err := client.PeerCertificate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := cert.MarshalDER()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return der, server.ServerName()
+	}
+
+	der, name := connect("vhost.test")
+	if !bytes.Equal(der, vhost_der) {
+		t.Fatal("expected the vhost certificate")
+	}
+	if name != "vhost.test" {
+		t.Fatalf("unexpected server name %q", name)
+	}
+	der, name = connect("other.test")
+	if bytes.Equal(der, vhost_der) {
+		t.Fatal("expected the default certificate")
+	}
+	if name != "other.test" {
+		t.Fatalf("unexpected server name %q", name)
+	}
+	der, name = connect("")
+	if bytes.Equal(der, vhost_der) {
+		t.Fatal("expected the default certificate")
+	}
+	if name != "" {
+		t.Fatalf("unexpected server name %q", name)
+	}
+	if len(seen) != 3 || seen[0] != "vhost.test" || seen[2] != "" {
+		t.Fatalf("unexpected names seen %q", seen)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package openssl
+
+import (
+	"syscall"
+)
+
+const (
+	// from the Linux headers, as older syscall packages lack some
+	tcpFastOpen        = 23
+	tcpFastOpenConnect = 30
+	soReusePort        = 15
+
+	// fastOpenQueueLen bounds the pending fast open requests per listener
+	fastOpenQueueLen = 256
+
+	reusePortSupported = true
+)
+
+func listenControl(flags ListenFlags) func(network, address string,
+	c syscall.RawConn) error {
+	if flags&(ListenTCPFastOpen|ListenReusePort) == 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		control_err := c.Control(func(fd uintptr) {
+			if flags&ListenTCPFastOpen != 0 {
+				// best effort: kernels without support just don't do it
+				syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP,
+					tcpFastOpen, fastOpenQueueLen)
+			}
+			if flags&ListenReusePort != 0 {
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET,
+					soReusePort, 1)
+			}
+		})
+		if control_err != nil {
+			return control_err
+		}
+		return err
+	}
+}
+
+func dialControl(flags DialFlags) func(network, address string,
+	c syscall.RawConn) error {
+	if flags&TCPFastOpen == 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		return c.Control(func(fd uintptr) {
+			// defers the connect until the first write, which then goes out
+			// with the SYN
+			syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP,
+				tcpFastOpenConnect, 1)
+		})
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+// +build cgo
+
+package openssl
+
+import (
+	"io"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func tcpSockopt(t *testing.T, c syscall.Conn, opt int) int {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value int
+	var opt_err error
+	err = raw.Control(func(fd uintptr) {
+		value, opt_err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP,
+			opt)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opt_err != nil {
+		t.Skipf("kernel lacks TCP fast open: %v", opt_err)
+	}
+	return value
+}
+
+func TestTCPFastOpen(t *testing.T) {
+	l, err := ListenWithFlags("tcp", "127.0.0.1:0", newTestServerCtx(t),
+		ListenTCPFastOpen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	inner := l.(*listener).Listener.(*net.TCPListener)
+	if qlen := tcpSockopt(t, inner, tcpFastOpen); qlen != fastOpenQueueLen {
+		t.Fatalf("expected a fast open queue of %d, got %d",
+			fastOpenQueueLen, qlen)
+	}
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.WriteString(c, "hi")
+	}()
+
+	conn, err := Dial("tcp", l.Addr().String(), nil,
+		InsecureSkipHostVerification|TCPFastOpen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	tcp := conn.UnderlyingConn().(*net.TCPConn)
+	if tcpSockopt(t, tcp, tcpFastOpenConnect) != 1 {
+		t.Fatal("expected fast open connect to be enabled")
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListenMulti(t *testing.T) {
+	listeners, err := ListenMulti("tcp", "127.0.0.1:0",
+		newTestServerCtx(t), 4, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listeners[0].Addr().String()
+	const conns = 32
+	accepted := make(chan int, conns)
+	for i, l := range listeners {
+		defer l.Close()
+		if l.Addr().String() != addr {
+			t.Fatalf("expected all listeners on %s, got %s", addr, l.Addr())
+		}
+		go func(i int, l net.Listener) {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				accepted <- i
+				io.WriteString(c, "hi")
+				c.Close()
+			}
+		}(i, l)
+	}
+	counts := make(map[int]int)
+	for i := 0; i < conns; i++ {
+		conn, err := Dial("tcp", addr, nil, InsecureSkipHostVerification)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 2)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		counts[<-accepted]++
+	}
+	// the kernel hashes connections across the listeners, so they all
+	// landing on one is vanishingly unlikely
+	if len(counts) < 2 {
+		t.Fatalf("expected connections to be spread across listeners, "+
+			"got %v", counts)
+	}
+}
+
+func TestSyscallConn(t *testing.T) {
+	l, err := Listen("tcp", "127.0.0.1:0", newTestServerCtx(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	raw, err := l.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var opt_err error
+	err = raw.Control(func(fd uintptr) {
+		opt_err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET,
+			soReusePort, 1)
+	})
+	if err != nil || opt_err != nil {
+		t.Fatal(err, opt_err)
+	}
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.WriteString(c, "hi")
+	}()
+
+	conn, err := Dial("tcp", l.Addr().String(), nil,
+		InsecureSkipHostVerification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.UnderlyingConn().(*net.TCPConn).SetNoDelay(false); err != nil {
+		t.Fatal(err)
+	}
+	raw, err = conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = raw.Control(func(fd uintptr) {
+		opt_err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP,
+			syscall.TCP_NODELAY, 1)
+	})
+	if err != nil || opt_err != nil {
+		t.Fatal(err, opt_err)
+	}
+	if tcpSockopt(t, conn, syscall.TCP_NODELAY) != 1 {
+		t.Fatal("expected TCP_NODELAY to be set through the raw connection")
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := (&Conn{conn: memoryTransport{}}).SyscallConn(); err == nil {
+		t.Fatal("expected an error from a connection without a socket")
+	}
+}
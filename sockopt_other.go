@@ -0,0 +1,33 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !linux
+
+package openssl
+
+import (
+	"syscall"
+)
+
+const reusePortSupported = false
+
+func listenControl(flags ListenFlags) func(network, address string,
+	c syscall.RawConn) error {
+	return nil
+}
+
+func dialControl(flags DialFlags) func(network, address string,
+	c syscall.RawConn) error {
+	return nil
+}
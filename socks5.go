@@ -0,0 +1,221 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openssl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	socks5Version = 5
+
+	socks5NoAuth       = 0x00
+	socks5UserPassAuth = 0x02
+	socks5NoAcceptable = 0xff
+
+	socks5Connect = 0x01
+
+	socks5IPv4   = 0x01
+	socks5Domain = 0x03
+	socks5IPv6   = 0x04
+)
+
+var socks5Replies = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// SOCKS5Proxy describes a SOCKS5 proxy (RFC 1928) for a Dialer to tunnel
+// connections through. Host names are resolved by the proxy.
+type SOCKS5Proxy struct {
+	// Addr is the proxy's host:port.
+	Addr string
+	// Username and Password, if Username is set, are used for
+	// username/password authentication (RFC 1929).
+	Username string
+	Password string
+}
+
+func (p *SOCKS5Proxy) dial(ctx context.Context, network, addr string) (
+	net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("socks5: unsupported network %q", network)
+	}
+	c, err := dialHappyEyeballs(ctx, "tcp", p.Addr, 0)
+	if err != nil {
+		return nil, err
+	}
+	return negotiateProxy(ctx, c, func() error {
+		return p.connect(c, addr)
+	})
+}
+
+// negotiateProxy runs negotiate on the connection c to a proxy, bounded by
+// ctx like the connection itself, and closes c if it fails.
+func negotiateProxy(ctx context.Context, c net.Conn,
+	negotiate func() error) (net.Conn, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	err := negotiate()
+	close(done)
+	if err == nil {
+		err = c.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		c.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+func (p *SOCKS5Proxy) connect(c net.Conn, addr string) error {
+	host, port_str, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(port_str, 10, 16)
+	if err != nil {
+		return fmt.Errorf("socks5: invalid port %q", port_str)
+	}
+
+	methods := []byte{socks5NoAuth}
+	if p.Username != "" {
+		methods = append(methods, socks5UserPassAuth)
+	}
+	req := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err := c.Write(req); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(c, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return errors.New("socks5: unexpected proxy version")
+	}
+	switch reply[1] {
+	case socks5NoAuth:
+	case socks5UserPassAuth:
+		if p.Username == "" {
+			return errors.New("socks5: proxy requires authentication")
+		}
+		if err := p.authenticate(c); err != nil {
+			return err
+		}
+	case socks5NoAcceptable:
+		return errors.New("socks5: no acceptable authentication methods")
+	default:
+		return errors.New("socks5: proxy chose an unoffered method")
+	}
+
+	req = []byte{socks5Version, socks5Connect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("socks5: host name too long")
+		}
+		req = append(req, socks5Domain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socks5IPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socks5IPv6)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := c.Write(req); err != nil {
+		return err
+	}
+
+	var head [4]byte
+	if _, err := io.ReadFull(c, head[:]); err != nil {
+		return err
+	}
+	if head[0] != socks5Version {
+		return errors.New("socks5: unexpected proxy version")
+	}
+	if head[1] != 0 {
+		if msg, ok := socks5Replies[head[1]]; ok {
+			return errors.New("socks5: " + msg)
+		}
+		return fmt.Errorf("socks5: connect failed with code %d", head[1])
+	}
+	// skip the bound address, which is of no use to us
+	var skip int
+	switch head[3] {
+	case socks5IPv4:
+		skip = net.IPv4len
+	case socks5IPv6:
+		skip = net.IPv6len
+	case socks5Domain:
+		var n [1]byte
+		if _, err := io.ReadFull(c, n[:]); err != nil {
+			return err
+		}
+		skip = int(n[0])
+	default:
+		return errors.New("socks5: unexpected bound address type")
+	}
+	bound := make([]byte, skip+2)
+	_, err = io.ReadFull(c, bound)
+	return err
+}
+
+func (p *SOCKS5Proxy) authenticate(c net.Conn) error {
+	if len(p.Username) > 255 || len(p.Password) > 255 {
+		return errors.New("socks5: credentials too long")
+	}
+	req := []byte{1, byte(len(p.Username))}
+	req = append(req, p.Username...)
+	req = append(req, byte(len(p.Password)))
+	req = append(req, p.Password...)
+	if _, err := c.Write(req); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(c, reply[:]); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return errors.New("socks5: authentication failed")
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+)
+
+// socks5Server is a single-connection SOCKS5 proxy requiring the given
+// credentials. It connects "target" to target_addr and reports the
+// requested destination on dests.
+func socks5Server(t *testing.T, user, pass, target_addr string) (
+	addr string, dests chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dests = make(chan string, 1)
+	go func() {
+		defer l.Close()
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		if err := serveSOCKS5(c, user, pass, target_addr, dests); err != nil {
+			t.Log(err)
+		}
+	}()
+	return l.Addr().String(), dests
+}
+
+func serveSOCKS5(c net.Conn, user, pass, target_addr string,
+	dests chan string) error {
+	buf := make([]byte, 512)
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(c, buf[:buf[1]]); err != nil {
+		return err
+	}
+	c.Write([]byte{5, 2})
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return err
+	}
+	got_user := make([]byte, buf[1])
+	io.ReadFull(c, got_user)
+	io.ReadFull(c, buf[:1])
+	got_pass := make([]byte, buf[0])
+	io.ReadFull(c, got_pass)
+	if string(got_user) != user || string(got_pass) != pass {
+		c.Write([]byte{1, 1})
+		return errors.New("bad credentials")
+	}
+	c.Write([]byte{1, 0})
+
+	if _, err := io.ReadFull(c, buf[:5]); err != nil {
+		return err
+	}
+	if buf[3] != 3 {
+		return errors.New("expected a domain name")
+	}
+	host := make([]byte, buf[4])
+	io.ReadFull(c, host)
+	io.ReadFull(c, buf[:2])
+	port := int(buf[0])<<8 | int(buf[1])
+	dests <- net.JoinHostPort(string(host), strconv.Itoa(port))
+
+	target, err := net.Dial("tcp", target_addr)
+	if err != nil {
+		c.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return err
+	}
+	defer target.Close()
+	c.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+	go io.Copy(target, c)
+	io.Copy(c, target)
+	return nil
+}
+
+func TestDialerSOCKS5(t *testing.T) {
+	l, err := Listen("tcp", "127.0.0.1:0", newTestServerCtx(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.Write([]byte("hi"))
+	}()
+
+	proxy_addr, dests := socks5Server(t, "user", "secret", l.Addr().String())
+	d := Dialer{
+		Flags: InsecureSkipHostVerification,
+		Proxy: &SOCKS5Proxy{
+			Addr:     proxy_addr,
+			Username: "user",
+			Password: "secret"}}
+	conn, err := d.Dial("tcp", "target.example:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if dest := <-dests; dest != "target.example:443" {
+		t.Fatalf("unexpected destination %q", dest)
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hi" {
+		t.Fatalf("unexpected data %q", buf)
+	}
+}
+
+func TestDialerSOCKS5BadCredentials(t *testing.T) {
+	proxy_addr, _ := socks5Server(t, "user", "secret", "127.0.0.1:1")
+	d := Dialer{Proxy: &SOCKS5Proxy{
+		Addr:     proxy_addr,
+		Username: "user",
+		Password: "wrong"}}
+	_, err := d.Dial("tcp", "target.example:443")
+	if err == nil || err.Error() != "socks5: authentication failed" {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <stdlib.h>
+#include <openssl/ssl.h>
+
+// returns 0 on success, as SSL_CTX_set_tlsext_use_srtp does
+static int OUR_SSL_CTX_set_tlsext_use_srtp(SSL_CTX *ctx, const char *profiles) {
+#ifndef OPENSSL_NO_SRTP
+    return SSL_CTX_set_tlsext_use_srtp(ctx, profiles);
+#else
+    return -1;
+#endif
+}
+
+// returns the id of the negotiated profile, or 0 if there is none
+static unsigned long OUR_SSL_get_selected_srtp_profile(SSL *ssl) {
+#ifndef OPENSSL_NO_SRTP
+    SRTP_PROTECTION_PROFILE *profile = SSL_get_selected_srtp_profile(ssl);
+    return profile == NULL ? 0 : profile->id;
+#else
+    return 0;
+#endif
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unsafe"
+)
+
+// SRTPProfile is a DTLS-SRTP protection profile (RFC 5764), which says how
+// the media streams of a DTLS-SRTP session are protected.
+type SRTPProfile uint16
+
+const (
+	SRTP_AES128_CM_SHA1_80 SRTPProfile = 0x0001
+	SRTP_AES128_CM_SHA1_32 SRTPProfile = 0x0002
+	SRTP_AEAD_AES_128_GCM  SRTPProfile = 0x0007
+	SRTP_AEAD_AES_256_GCM  SRTPProfile = 0x0008
+)
+
+var srtpProfileInfo = map[SRTPProfile]struct {
+	name     string
+	key_len  int
+	salt_len int
+}{
+	SRTP_AES128_CM_SHA1_80: {"SRTP_AES128_CM_SHA1_80", 16, 14},
+	SRTP_AES128_CM_SHA1_32: {"SRTP_AES128_CM_SHA1_32", 16, 14},
+	SRTP_AEAD_AES_128_GCM:  {"SRTP_AEAD_AES_128_GCM", 16, 12},
+	SRTP_AEAD_AES_256_GCM:  {"SRTP_AEAD_AES_256_GCM", 32, 12},
+}
+
+func (p SRTPProfile) String() string {
+	if info, ok := srtpProfileInfo[p]; ok {
+		return info.name
+	}
+	return fmt.Sprintf("SRTPProfile(%#04x)", uint16(p))
+}
+
+// SetSRTPProfiles makes DTLS connections using the context negotiate one of
+// profiles with the use_srtp extension, in order of preference, for the
+// media streams keyed with DTLSConn.ExportSRTPKeyingMaterial. Clients offer
+// them, servers pick the first of the client's they also have.
+func (c *Ctx) SetSRTPProfiles(profiles []SRTPProfile) error {
+	if len(profiles) == 0 {
+		return errors.New("no SRTP profiles given")
+	}
+	names := make([]string, 0, len(profiles))
+	for _, profile := range profiles {
+		info, ok := srtpProfileInfo[profile]
+		if !ok {
+			return fmt.Errorf("unknown SRTP profile %v", profile)
+		}
+		names = append(names, info.name)
+	}
+	cprofiles := C.CString(strings.Join(names, ":"))
+	defer C.free(unsafe.Pointer(cprofiles))
+	switch C.OUR_SSL_CTX_set_tlsext_use_srtp(c.ctx, cprofiles) {
+	case 0:
+		return nil
+	case -1:
+		return errors.New("OpenSSL was built without SRTP support")
+	default:
+		return errorFromErrorQueue()
+	}
+}
+
+// SelectedSRTPProfile returns the SRTP profile negotiated in the handshake.
+// ok is false if the peers agreed on none.
+func (c *DTLSConn) SelectedSRTPProfile() (profile SRTPProfile, ok bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.is_shutdown {
+		return 0, false
+	}
+	id := C.OUR_SSL_get_selected_srtp_profile(c.ssl)
+	return SRTPProfile(id), id != 0
+}
+
+// SRTPKeyingMaterial holds the master keys and salts of the SRTP streams
+// each side of a DTLS-SRTP session sends. The client protects what it sends
+// with ClientKey and ClientSalt, and the server with ServerKey and
+// ServerSalt.
+type SRTPKeyingMaterial struct {
+	Profile    SRTPProfile
+	ClientKey  []byte
+	ClientSalt []byte
+	ServerKey  []byte
+	ServerSalt []byte
+}
+
+// ExportSRTPKeyingMaterial derives the SRTP master keys and salts for the
+// negotiated profile, as described by RFC 5764 section 4.2. Only valid after
+// a handshake that negotiated a profile.
+func (c *DTLSConn) ExportSRTPKeyingMaterial() (*SRTPKeyingMaterial, error) {
+	profile, ok := c.SelectedSRTPProfile()
+	if !ok {
+		return nil, errors.New("no SRTP profile negotiated")
+	}
+	info, ok := srtpProfileInfo[profile]
+	if !ok {
+		return nil, fmt.Errorf("unknown SRTP profile %v", profile)
+	}
+	km, err := c.ExportKeyingMaterial("EXTRACTOR-dtls_srtp", nil,
+		2*(info.key_len+info.salt_len))
+	if err != nil {
+		return nil, err
+	}
+	// client key, server key, client salt, server salt
+	keys, salts := km[:2*info.key_len], km[2*info.key_len:]
+	return &SRTPKeyingMaterial{
+		Profile:    profile,
+		ClientKey:  keys[:info.key_len],
+		ServerKey:  keys[info.key_len:],
+		ClientSalt: salts[:info.salt_len],
+		ServerSalt: salts[info.salt_len:],
+	}, nil
+}
+
+// ExportKeyingMaterial is Conn.ExportKeyingMaterial for DTLS.
+func (c *DTLSConn) ExportKeyingMaterial(label string, context []byte,
+	length int) ([]byte, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.is_shutdown {
+		return nil, dtlsClosed
+	}
+	return exportKeyingMaterial(c.ssl, label, context, length)
+}
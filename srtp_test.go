@@ -0,0 +1,109 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestDTLSSRTP(t *testing.T) {
+	server_ctx, err := NewDTLSCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	useTestCertificate(t, server_ctx)
+	if err := server_ctx.SetSRTPProfiles([]SRTPProfile{
+		SRTP_AES128_CM_SHA1_80, SRTP_AEAD_AES_128_GCM}); err != nil {
+		t.Skip(err)
+	}
+	l, err := ListenDTLS("udp", "127.0.0.1:0", server_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	type result struct {
+		km  *SRTPKeyingMaterial
+		err error
+	}
+	results := make(chan result, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer conn.Close()
+		dtls := conn.(*DTLSConn)
+		dtls.SetDeadline(time.Now().Add(10 * time.Second))
+		if err := dtls.Handshake(); err != nil {
+			results <- result{err: err}
+			return
+		}
+		km, err := dtls.ExportSRTPKeyingMaterial()
+		results <- result{km: km, err: err}
+		// wait for the client to hang up
+		dtls.Read(make([]byte, 1))
+	}()
+
+	client_ctx, err := NewDTLSCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client_ctx.SetSRTPProfiles([]SRTPProfile{
+		SRTP_AEAD_AES_128_GCM, SRTP_AES128_CM_SHA1_80}); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := DialDTLS("udp", l.Addr().String(), client_ctx,
+		InsecureSkipHostVerification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	profile, ok := conn.SelectedSRTPProfile()
+	if !ok || profile != SRTP_AES128_CM_SHA1_80 {
+		t.Fatalf("expected the server's preference, got %v", profile)
+	}
+	km, err := conn.ExportSRTPKeyingMaterial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(km.ClientKey) != 16 || len(km.ServerKey) != 16 ||
+		len(km.ClientSalt) != 14 || len(km.ServerSalt) != 14 {
+		t.Fatalf("unexpected keying material lengths %+v", km)
+	}
+	if bytes.Equal(km.ClientKey, km.ServerKey) {
+		t.Fatal("expected distinct client and server keys")
+	}
+	res := <-results
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if res.km.Profile != km.Profile ||
+		!bytes.Equal(res.km.ClientKey, km.ClientKey) ||
+		!bytes.Equal(res.km.ServerKey, km.ServerKey) ||
+		!bytes.Equal(res.km.ClientSalt, km.ClientSalt) ||
+		!bytes.Equal(res.km.ServerSalt, km.ServerSalt) {
+		t.Fatal("client and server derived different keying material")
+	}
+
+	if err := client_ctx.SetSRTPProfiles(
+		[]SRTPProfile{SRTPProfile(0x1234)}); err == nil {
+		t.Fatal("expected an error for an unknown profile")
+	}
+}
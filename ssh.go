@@ -0,0 +1,440 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+const openSSHKeyMagic = "openssh-key-v1\x00"
+
+var errMalformedSSHKey = errors.New("malformed ssh key")
+
+var sshCurves = []struct {
+	name  string
+	curve elliptic.Curve
+}{
+	{"nistp256", elliptic.P256()},
+	{"nistp384", elliptic.P384()},
+	{"nistp521", elliptic.P521()},
+}
+
+// LoadPublicKeyFromSSH loads a public key in OpenSSH's authorized_keys
+// format, as found in id_rsa.pub and the like: the key type, the base64
+// encoded key and an optional comment. RSA, ECDSA and Ed25519 keys are
+// supported.
+func LoadPublicKeyFromSSH(line []byte) (PublicKey, error) {
+	fields := bytes.Fields(line)
+	if len(fields) < 2 {
+		return nil, errMalformedSSHKey
+	}
+	blob, err := base64.StdEncoding.DecodeString(string(fields[1]))
+	if err != nil {
+		return nil, err
+	}
+	r := &sshReader{buf: blob}
+	key_type, pub := parseSSHPublicKey(r)
+	if r.err == nil && len(r.buf) != 0 {
+		r.err = errMalformedSSHKey
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if key_type != string(fields[0]) {
+		return nil, fmt.Errorf("ssh key type %s doesn't match its %s key",
+			fields[0], key_type)
+	}
+	return FromStdlibPublicKey(pub)
+}
+
+// MarshalSSHPublicKey encodes key in OpenSSH's authorized_keys format,
+// followed by comment unless it is empty.
+func MarshalSSHPublicKey(key PublicKey, comment string) ([]byte, error) {
+	der, err := key.MarshalPKIXPublicKeyDER()
+	if err != nil {
+		return nil, err
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	key_type, blob, err := marshalSSHPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	line := key_type + " " + base64.StdEncoding.EncodeToString(blob)
+	if comment != "" {
+		line += " " + comment
+	}
+	return []byte(line + "\n"), nil
+}
+
+// LoadPrivateKeyFromOpenSSH loads a private key in the openssh-key-v1 format
+// that ssh-keygen writes by default, a PEM block of type OPENSSH PRIVATE KEY.
+// Keys protected by a passphrase are not supported: their key derivation,
+// bcrypt_pbkdf, is provided by neither OpenSSL nor the Go standard library.
+func LoadPrivateKeyFromOpenSSH(pem_block []byte) (PrivateKey, error) {
+	block, _ := pem.Decode(pem_block)
+	if block == nil || block.Type != "OPENSSH PRIVATE KEY" {
+		return nil, errors.New("no OPENSSH PRIVATE KEY block found")
+	}
+	if !bytes.HasPrefix(block.Bytes, []byte(openSSHKeyMagic)) {
+		return nil, errMalformedSSHKey
+	}
+	r := &sshReader{buf: block.Bytes[len(openSSHKeyMagic):]}
+	cipher, kdf := string(r.bytes()), string(r.bytes())
+	r.bytes() // kdf options
+	count := r.uint32()
+	pub_blob, section := r.bytes(), r.bytes()
+	if r.err == nil && (count != 1 || len(r.buf) != 0) {
+		r.err = errMalformedSSHKey
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if cipher != "none" || kdf != "none" {
+		return nil, errors.New("encrypted OpenSSH private keys are not " +
+			"supported")
+	}
+
+	r = &sshReader{buf: section}
+	if r.uint32() != r.uint32() {
+		return nil, errMalformedSSHKey
+	}
+	priv := parseSSHPrivateKey(r)
+	r.bytes() // comment
+	for i, b := range r.buf {
+		if b != byte(i+1) {
+			return nil, errMalformedSSHKey
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	// the public key stored alongside must be the private key's
+	_, expected, err := marshalSSHPublicKey(priv.(crypto.Signer).Public())
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(pub_blob, expected) {
+		return nil, errors.New("ssh private key doesn't match its public key")
+	}
+	return FromStdlibPrivateKey(priv)
+}
+
+// MarshalOpenSSHPrivateKey encodes key, without a passphrase, in the
+// openssh-key-v1 format ssh-keygen uses, labeled with comment.
+func MarshalOpenSSHPrivateKey(key PrivateKey, comment string) ([]byte,
+	error) {
+	priv, err := ToStdlibPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	_, pub_blob, err := marshalSSHPublicKey(priv.(crypto.Signer).Public())
+	if err != nil {
+		return nil, err
+	}
+	var check [4]byte
+	if _, err := rand.Read(check[:]); err != nil {
+		return nil, err
+	}
+	section := &sshWriter{}
+	section.Write(check[:])
+	section.Write(check[:])
+	switch k := priv.(type) {
+	case *rsa.PrivateKey:
+		if len(k.Primes) != 2 {
+			return nil, errors.New("multi-prime RSA keys can't be encoded " +
+				"for ssh")
+		}
+		p, q := k.Primes[0], k.Primes[1]
+		section.string([]byte("ssh-rsa"))
+		section.mpint(k.N)
+		section.mpint(big.NewInt(int64(k.E)))
+		section.mpint(k.D)
+		section.mpint(new(big.Int).ModInverse(q, p))
+		section.mpint(p)
+		section.mpint(q)
+	case *ecdsa.PrivateKey:
+		name, err := sshCurveName(k.Curve)
+		if err != nil {
+			return nil, err
+		}
+		section.string([]byte("ecdsa-sha2-" + name))
+		section.string([]byte(name))
+		section.string(elliptic.Marshal(k.Curve, k.X, k.Y))
+		section.mpint(k.D)
+	case ed25519.PrivateKey:
+		section.string([]byte("ssh-ed25519"))
+		section.string(k.Public().(ed25519.PublicKey))
+		section.string(k)
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", priv)
+	}
+	section.string([]byte(comment))
+	for i := 1; section.Len()%8 != 0; i++ {
+		section.WriteByte(byte(i))
+	}
+
+	out := &sshWriter{}
+	out.WriteString(openSSHKeyMagic)
+	out.string([]byte("none"))
+	out.string([]byte("none"))
+	out.string(nil)
+	out.uint32(1)
+	out.string(pub_blob)
+	out.string(section.Bytes())
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "OPENSSH PRIVATE KEY",
+		Bytes: out.Bytes()}), nil
+}
+
+// parseSSHPublicKey reads a public key in the ssh wire format.
+func parseSSHPublicKey(r *sshReader) (string, crypto.PublicKey) {
+	key_type := string(r.bytes())
+	switch key_type {
+	case "ssh-rsa":
+		e, n := r.mpint(), r.mpint()
+		if r.err != nil {
+			return "", nil
+		}
+		if n.Sign() <= 0 || !e.IsInt64() || e.Int64() <= 1 ||
+			e.Int64() > 1<<31-1 {
+			r.err = errMalformedSSHKey
+			return "", nil
+		}
+		return key_type, &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case "ssh-ed25519":
+		pub := r.bytes()
+		if r.err == nil && len(pub) != ed25519.PublicKeySize {
+			r.err = errMalformedSSHKey
+		}
+		if r.err != nil {
+			return "", nil
+		}
+		return key_type, ed25519.PublicKey(pub)
+	}
+	curve := sshCurve(r, key_type)
+	x, y := sshPoint(r, curve)
+	if r.err != nil {
+		return "", nil
+	}
+	return key_type, &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+}
+
+// parseSSHPrivateKey reads a private key as stored in openssh-key-v1.
+func parseSSHPrivateKey(r *sshReader) crypto.PrivateKey {
+	key_type := string(r.bytes())
+	switch key_type {
+	case "ssh-rsa":
+		n, e, d, _, p, q := r.mpint(), r.mpint(), r.mpint(), r.mpint(),
+			r.mpint(), r.mpint()
+		if r.err != nil {
+			return nil
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			r.err = errMalformedSSHKey
+			return nil
+		}
+		key := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: n, E: int(e.Int64())},
+			D:         d,
+			Primes:    []*big.Int{p, q}}
+		if err := key.Validate(); err != nil {
+			r.err = err
+			return nil
+		}
+		key.Precompute()
+		return key
+	case "ssh-ed25519":
+		pub, priv := r.bytes(), r.bytes()
+		if r.err != nil {
+			return nil
+		}
+		if len(pub) != ed25519.PublicKeySize ||
+			len(priv) != ed25519.PrivateKeySize ||
+			!bytes.Equal(ed25519.NewKeyFromSeed(
+				priv[:ed25519.SeedSize])[ed25519.SeedSize:], pub) {
+			r.err = errMalformedSSHKey
+			return nil
+		}
+		return ed25519.NewKeyFromSeed(priv[:ed25519.SeedSize])
+	}
+	curve := sshCurve(r, key_type)
+	x, y := sshPoint(r, curve)
+	d := r.mpint()
+	if r.err != nil {
+		return nil
+	}
+	dx, dy := curve.ScalarBaseMult(d.Bytes())
+	if d.Sign() <= 0 || d.Cmp(curve.Params().N) >= 0 || dx.Cmp(x) != 0 ||
+		dy.Cmp(y) != 0 {
+		r.err = errMalformedSSHKey
+		return nil
+	}
+	return &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{Curve: curve, X: x, Y: y},
+		D:         d}
+}
+
+func marshalSSHPublicKey(pub crypto.PublicKey) (string, []byte, error) {
+	w := &sshWriter{}
+	var key_type string
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		key_type = "ssh-rsa"
+		w.string([]byte(key_type))
+		w.mpint(big.NewInt(int64(k.E)))
+		w.mpint(k.N)
+	case *ecdsa.PublicKey:
+		name, err := sshCurveName(k.Curve)
+		if err != nil {
+			return "", nil, err
+		}
+		key_type = "ecdsa-sha2-" + name
+		w.string([]byte(key_type))
+		w.string([]byte(name))
+		w.string(elliptic.Marshal(k.Curve, k.X, k.Y))
+	case ed25519.PublicKey:
+		key_type = "ssh-ed25519"
+		w.string([]byte(key_type))
+		w.string(k)
+	default:
+		return "", nil, fmt.Errorf("unsupported public key type %T", pub)
+	}
+	return key_type, w.Bytes(), nil
+}
+
+// sshCurve reads the curve name of an ECDSA key of type key_type.
+func sshCurve(r *sshReader, key_type string) elliptic.Curve {
+	name := string(r.bytes())
+	if r.err != nil {
+		return nil
+	}
+	for _, c := range sshCurves {
+		if c.name == name && key_type == "ecdsa-sha2-"+name {
+			return c.curve
+		}
+	}
+	r.err = fmt.Errorf("unsupported ssh key type %s", key_type)
+	return nil
+}
+
+func sshCurveName(curve elliptic.Curve) (string, error) {
+	for _, c := range sshCurves {
+		if c.curve == curve {
+			return c.name, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported curve %s", curve.Params().Name)
+}
+
+func sshPoint(r *sshReader, curve elliptic.Curve) (x, y *big.Int) {
+	point := r.bytes()
+	if r.err != nil {
+		return nil, nil
+	}
+	x, y = elliptic.Unmarshal(curve, point)
+	if x == nil {
+		r.err = errMalformedSSHKey
+	}
+	return x, y
+}
+
+// sshReader decodes the ssh wire format, remembering the first error so
+// that fields can be read without checking each one.
+type sshReader struct {
+	buf []byte
+	err error
+}
+
+func (r *sshReader) uint32() uint32 {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.buf) < 4 {
+		r.err = errMalformedSSHKey
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.buf)
+	r.buf = r.buf[4:]
+	return v
+}
+
+func (r *sshReader) bytes() []byte {
+	n := r.uint32()
+	if r.err != nil {
+		return nil
+	}
+	if uint64(n) > uint64(len(r.buf)) {
+		r.err = errMalformedSSHKey
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+// mpint reads a non-negative multiple precision integer.
+func (r *sshReader) mpint() *big.Int {
+	b := r.bytes()
+	if r.err != nil {
+		return nil
+	}
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		r.err = errMalformedSSHKey
+		return nil
+	}
+	return new(big.Int).SetBytes(b)
+}
+
+type sshWriter struct {
+	bytes.Buffer
+}
+
+func (w *sshWriter) uint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	w.Write(b[:])
+}
+
+func (w *sshWriter) string(b []byte) {
+	w.uint32(uint32(len(b)))
+	w.Write(b)
+}
+
+// mpint writes a non-negative multiple precision integer.
+func (w *sshWriter) mpint(n *big.Int) {
+	b := n.Bytes()
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	w.string(b)
+}
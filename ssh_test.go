@@ -0,0 +1,126 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenSSHKeys(t *testing.T) {
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen not found")
+	}
+	dir, err := ioutil.TempDir("", "openssl-ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, args := range [][]string{
+		{"-t", "rsa", "-b", "2048"},
+		{"-t", "ecdsa", "-b", "384"},
+		{"-t", "ed25519"},
+	} {
+		path := filepath.Join(dir, args[1])
+		out, err := exec.Command("ssh-keygen", append(args, "-q", "-N", "",
+			"-C", "test", "-f", path)...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("ssh-keygen failed: %v: %s", err, out)
+		}
+		priv_block, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub_line, err := ioutil.ReadFile(path + ".pub")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		priv, err := LoadPrivateKeyFromOpenSSH(priv_block)
+		if err != nil {
+			t.Fatalf("%s: %v", args[1], err)
+		}
+		pub, err := LoadPublicKeyFromSSH(pub_line)
+		if err != nil {
+			t.Fatalf("%s: %v", args[1], err)
+		}
+		priv_der, err := priv.MarshalPKIXPublicKeyDER()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub_der, err := pub.MarshalPKIXPublicKeyDER()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(priv_der, pub_der) {
+			t.Fatalf("%s: private and public keys differ", args[1])
+		}
+		line, err := MarshalSSHPublicKey(pub, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(line, pub_line) {
+			t.Fatalf("%s: expected %q, got %q", args[1], pub_line, line)
+		}
+
+		// ssh-keygen must be able to read the key back
+		priv_block, err = MarshalOpenSSHPrivateKey(priv, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, priv_block, 0600); err != nil {
+			t.Fatal(err)
+		}
+		out, err = exec.Command("ssh-keygen", "-y", "-f", path).Output()
+		if err != nil {
+			t.Fatalf("%s: ssh-keygen failed to read key: %v", args[1], err)
+		}
+		if !bytes.Equal(bytes.Fields(out)[1], bytes.Fields(pub_line)[1]) {
+			t.Fatalf("%s: ssh-keygen derived a different public key",
+				args[1])
+		}
+	}
+}
+
+func TestOpenSSHEncryptedKey(t *testing.T) {
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen not found")
+	}
+	dir, err := ioutil.TempDir("", "openssl-ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "key")
+	out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N",
+		"secret", "-f", path).CombinedOutput()
+	if err != nil {
+		t.Fatalf("ssh-keygen failed: %v: %s", err, out)
+	}
+	priv_block, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadPrivateKeyFromOpenSSH(priv_block); err == nil {
+		t.Fatal("expected encrypted key to be refused")
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openssl
+
+import (
+	"runtime"
+	"sync/atomic"
+)
+
+var (
+	statActiveConns  int64
+	statHandshakes   int64
+	statContexts     int64
+	statSSLs         int64
+	statCertificates int64
+	statKeys         int64
+)
+
+// Stats are package-wide counters of the wrapper's resource usage. See the
+// expvars subpackage to publish them.
+type Stats struct {
+	// ActiveConns is the number of Conns created and not yet closed.
+	ActiveConns int64
+	// Handshakes is the number of handshakes Conns have completed.
+	Handshakes int64
+	// CgoCalls is the number of cgo calls the process has made, including
+	// those outside this package, as reported by runtime.NumCgoCall.
+	// Without cgo, only ActiveConns and Handshakes are counted.
+	CgoCalls int64
+	// Contexts, SSLs, Certificates and Keys count the OpenSSL objects held
+	// by Ctx, Conn, Certificate and key values that haven't yet been freed,
+	// either explicitly or by their finalizers.
+	Contexts     int64
+	SSLs         int64
+	Certificates int64
+	Keys         int64
+}
+
+// GetStats returns the current values of the package's counters. They are
+// read one at a time, so they may be slightly inconsistent with each other.
+func GetStats() Stats {
+	return Stats{
+		ActiveConns:  atomic.LoadInt64(&statActiveConns),
+		Handshakes:   atomic.LoadInt64(&statHandshakes),
+		CgoCalls:     runtime.NumCgoCall(),
+		Contexts:     atomic.LoadInt64(&statContexts),
+		SSLs:         atomic.LoadInt64(&statSSLs),
+		Certificates: atomic.LoadInt64(&statCertificates),
+		Keys:         atomic.LoadInt64(&statKeys),
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	before := GetStats()
+	server_conn, client_conn := NetPipe(t)
+	server, err := Server(server_conn, newTestServerCtx(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client_ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := Client(client_conn, client_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 1)
+	go func() { errs <- server.Handshake() }()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	during := GetStats()
+	if during.Handshakes-before.Handshakes < 2 {
+		t.Fatalf("expected two more handshakes, got %d",
+			during.Handshakes-before.Handshakes)
+	}
+	if during.SSLs < 2 || during.Contexts < 2 || during.ActiveConns < 2 {
+		t.Fatalf("unexpected stats %+v", during)
+	}
+
+	go server.Close()
+	client.Close()
+	// leaked connections may be finalized meanwhile, so only an upper bound
+	// can be checked
+	after := GetStats()
+	if after.ActiveConns > during.ActiveConns-1 {
+		t.Fatalf("expected fewer active connections, got %d then %d",
+			during.ActiveConns, after.ActiveConns)
+	}
+
+	cert := issueTestCert(t, generateTestRSAKey(t), testCert{})
+	certs := GetStats().Certificates
+	cert.Free()
+	if GetStats().Certificates > certs-1 {
+		t.Fatal("expected freeing the certificate to be counted")
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <stdlib.h>
+#include <openssl/err.h>
+#include <openssl/x509_vfy.h>
+#include <openssl/x509v3.h>
+
+extern int OUR_X509_up_ref(X509 *x);
+extern int sk_X509_num_not_a_macro(STACK_OF(X509) *sk);
+extern X509 *sk_X509_value_not_a_macro(STACK_OF(X509)* sk, int i);
+
+static void sk_X509_pop_free_verified_chain(STACK_OF(X509) *sk) {
+    sk_X509_pop_free(sk, X509_free);
+}
+
+static X509_VERIFY_PARAM *OUR_X509_STORE_get0_param(X509_STORE *store) {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+    return X509_STORE_get0_param(store);
+#else
+    return store->param;
+#endif
+}
+
+static void OUR_X509_STORE_set_time(X509_STORE *store, time_t t) {
+    X509_VERIFY_PARAM_set_time(OUR_X509_STORE_get0_param(store), t);
+}
+
+// returns 1 with the verified chain, 0 with the failed check, its depth and
+// the certificate that failed it, or -1 if verification couldn't be run
+static int OUR_X509_verify(X509_STORE *store, X509 *leaf, X509 **pool,
+        int n, STACK_OF(X509) **chain, int *err, int *depth, X509 **failed) {
+    STACK_OF(X509) *untrusted = sk_X509_new_null();
+    X509_STORE_CTX *ctx = X509_STORE_CTX_new();
+    int rv = -1;
+    int i;
+    *chain = NULL;
+    *failed = NULL;
+    if (untrusted == NULL || ctx == NULL)
+        goto done;
+    for (i = 0; i < n; i++) {
+        if (sk_X509_push(untrusted, pool[i]) <= 0)
+            goto done;
+    }
+    if (X509_STORE_CTX_init(ctx, store, leaf, untrusted) != 1)
+        goto done;
+    if (X509_verify_cert(ctx) == 1) {
+        *chain = X509_STORE_CTX_get1_chain(ctx);
+        rv = *chain == NULL ? -1 : 1;
+        goto done;
+    }
+    *err = X509_STORE_CTX_get_error(ctx);
+    if (*err == X509_V_OK)
+        goto done;
+    *depth = X509_STORE_CTX_get_error_depth(ctx);
+    *failed = X509_STORE_CTX_get_current_cert(ctx);
+    if (*failed != NULL)
+        OUR_X509_up_ref(*failed);
+    rv = 0;
+done:
+    X509_STORE_CTX_free(ctx);
+    sk_X509_free(untrusted);
+    return rv;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"runtime"
+	"time"
+	"unsafe"
+)
+
+// VerifyPurpose is what a certificate is verified for, which its key usage,
+// extended key usage and those of its issuers must allow.
+type VerifyPurpose int
+
+const (
+	PurposeSSLClient    VerifyPurpose = C.X509_PURPOSE_SSL_CLIENT
+	PurposeSSLServer    VerifyPurpose = C.X509_PURPOSE_SSL_SERVER
+	PurposeNSSSLServer  VerifyPurpose = C.X509_PURPOSE_NS_SSL_SERVER
+	PurposeSMIMESign    VerifyPurpose = C.X509_PURPOSE_SMIME_SIGN
+	PurposeSMIMEEncrypt VerifyPurpose = C.X509_PURPOSE_SMIME_ENCRYPT
+	PurposeCRLSign      VerifyPurpose = C.X509_PURPOSE_CRL_SIGN
+	PurposeAny          VerifyPurpose = C.X509_PURPOSE_ANY
+	PurposeOCSPHelper   VerifyPurpose = C.X509_PURPOSE_OCSP_HELPER
+	PurposeTimestamp    VerifyPurpose = C.X509_PURPOSE_TIMESTAMP_SIGN
+)
+
+// NewCertificateStore returns an empty certificate store of its own, for
+// verifying certificates with Verify outside of any connection.
+func NewCertificateStore() (*CertificateStore, error) {
+	store := C.X509_STORE_new()
+	if store == nil {
+		return nil, errors.New("failed to allocate certificate store")
+	}
+	s := &CertificateStore{store: store}
+	runtime.SetFinalizer(s, func(s *CertificateStore) {
+		C.X509_STORE_free(s.store)
+	})
+	return s, nil
+}
+
+// LoadVerifyLocations adds the certificates and CRLs in ca_file, a PEM
+// bundle, and those in ca_path, a directory of hashed names as made by
+// openssl rehash, to the store. Either may be empty.
+func (s *CertificateStore) LoadVerifyLocations(ca_file string,
+	ca_path string) error {
+	defer runtime.KeepAlive(s)
+	var c_ca_file, c_ca_path *C.char
+	if ca_file != "" {
+		c_ca_file = C.CString(ca_file)
+		defer C.free(unsafe.Pointer(c_ca_file))
+	}
+	if ca_path != "" {
+		c_ca_path = C.CString(ca_path)
+		defer C.free(unsafe.Pointer(c_ca_path))
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.X509_STORE_load_locations(s.store, c_ca_file, c_ca_path) != 1 {
+		return errorFromErrorQueue()
+	}
+	return nil
+}
+
+// SetDefaultVerifyPaths makes the store trust the certificate authorities
+// in the locations the linked OpenSSL was configured with, as
+// Ctx.SetDefaultVerifyPaths does.
+func (s *CertificateStore) SetDefaultVerifyPaths() error {
+	defer runtime.KeepAlive(s)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.X509_STORE_set_default_paths(s.store) != 1 {
+		return errorFromErrorQueue()
+	}
+	return nil
+}
+
+// SetTime makes Verify check validity periods at t rather than now, such as
+// to check a signature made at a known time in the past.
+func (s *CertificateStore) SetTime(t time.Time) {
+	defer runtime.KeepAlive(s)
+	C.OUR_X509_STORE_set_time(s.store, C.time_t(t.Unix()))
+}
+
+// SetPurpose makes Verify check that the chain may be used for purpose.
+// Without one, any purpose is accepted.
+func (s *CertificateStore) SetPurpose(purpose VerifyPurpose) error {
+	defer runtime.KeepAlive(s)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.X509_STORE_set_purpose(s.store, C.int(purpose)) != 1 {
+		return errorFromErrorQueue()
+	}
+	return nil
+}
+
+// Verify verifies leaf against the certificates trusted by the store, with
+// intermediates as untrusted candidates for building the chain, checking
+// it as the store's flags, time and purpose say. It returns the verified
+// chain, from leaf to a trusted certificate, or a VerifyError for the check
+// that failed.
+func (s *CertificateStore) Verify(leaf *Certificate,
+	intermediates []*Certificate) ([]*Certificate, error) {
+	defer runtime.KeepAlive(s)
+	x := leaf.acquireX509()
+	if x == nil {
+		return nil, certificateFreed
+	}
+	defer C.X509_free(x)
+	xs := make([]*C.X509, 0, len(intermediates))
+	defer func() {
+		for _, x := range xs {
+			C.X509_free(x)
+		}
+	}()
+	for _, cert := range intermediates {
+		x := cert.acquireX509()
+		if x == nil {
+			return nil, certificateFreed
+		}
+		xs = append(xs, x)
+	}
+	var xs_ptr **C.X509
+	if len(xs) > 0 {
+		xs_ptr = &xs[0]
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	var sk *C.struct_stack_st_X509
+	var code, depth C.int
+	var failed *C.X509
+	switch C.OUR_X509_verify(s.store, x, xs_ptr, C.int(len(xs)), &sk, &code,
+		&depth, &failed) {
+	case 1:
+	case 0:
+		// the error queue holds nothing about a failed check
+		C.ERR_clear_error()
+		verify_err := VerifyError{Result: VerifyResult(code),
+			Depth: int(depth)}
+		if failed != nil {
+			verify_err.Certificate = newCertificate(failed)
+		}
+		return nil, verify_err
+	default:
+		return nil, errorFromErrorQueue()
+	}
+	defer C.sk_X509_pop_free_verified_chain(sk)
+	n := int(C.sk_X509_num_not_a_macro(sk))
+	chain := make([]*Certificate, 0, n)
+	for i := 0; i < n; i++ {
+		chain = append(chain, refCertificate(
+			C.sk_X509_value_not_a_macro(sk, C.int(i))))
+	}
+	return chain, nil
+}
@@ -0,0 +1,111 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCertificateStoreVerify(t *testing.T) {
+	root_key := generateTestRSAKey(t)
+	root := issueTestCert(t, root_key, testCert{CA: true})
+	inter_key := generateTestRSAKey(t)
+	inter := issueTestCert(t, inter_key, testCert{Serial: 2,
+		Name: "Intermediate", Issuer: root, IssuerKey: root_key, CA: true})
+	key := generateTestRSAKey(t)
+	leaf := issueTestCert(t, key, testCert{Serial: 3, Name: "client",
+		Issuer: inter, IssuerKey: inter_key,
+		ExtKeyUsage: []ExtKeyUsage{ExtKeyUsageClientAuth}})
+
+	root_pem, err := root.MarshalPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "store_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Write(root_pem)
+	f.Close()
+
+	newStore := func() *CertificateStore {
+		store, err := NewCertificateStore()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.LoadVerifyLocations(f.Name(), ""); err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}
+	expectFailure := func(store *CertificateStore, intermediates []*Certificate,
+		result VerifyResult) {
+		_, err := store.Verify(leaf, intermediates)
+		verify_err, ok := err.(VerifyError)
+		if !ok || verify_err.Result != result {
+			t.Fatalf("expected result %d, got %v", result, err)
+		}
+	}
+
+	store := newStore()
+	chain, err := store.Verify(leaf, []*Certificate{inter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 3 || !sameCertificate(t, chain[0], leaf) ||
+		!sameCertificate(t, chain[2], root) {
+		t.Fatalf("unexpected chain of %d certificates", len(chain))
+	}
+	expectFailure(store, nil, UnableToGetIssuerCertLocally)
+
+	store = newStore()
+	store.SetTime(time.Now().Add(2 * time.Hour))
+	expectFailure(store, []*Certificate{inter}, CertHasExpired)
+
+	store = newStore()
+	if err := store.SetPurpose(PurposeSSLServer); err != nil {
+		t.Fatal(err)
+	}
+	expectFailure(store, []*Certificate{inter}, InvalidPurpose)
+	store = newStore()
+	if err := store.SetPurpose(PurposeSSLClient); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Verify(leaf, []*Certificate{inter}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the system's roots don't know this one
+	store, err = NewCertificateStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetDefaultVerifyPaths(); err != nil {
+		t.Fatal(err)
+	}
+	expectFailure(store, []*Certificate{inter}, UnableToGetIssuerCertLocally)
+	if err := store.AddCertificate(root); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Verify(leaf, []*Certificate{inter}); err != nil {
+		t.Fatal(err)
+	}
+}
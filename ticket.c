@@ -0,0 +1,92 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include <string.h>
+#include <openssl/evp.h>
+#include <openssl/rand.h>
+#include <openssl/ssl.h>
+#if OPENSSL_VERSION_NUMBER >= 0x30000000L
+#include <openssl/core_names.h>
+#else
+#include <openssl/hmac.h>
+#endif
+#include "_cgo_export.h"
+
+// keys are laid out as for SSL_CTX_set_tlsext_ticket_keys: a 16 byte name,
+// then a 16 byte HMAC secret, then a 16 byte AES key
+
+static int ticket_cipher_init(SSL *ssl, unsigned char *name,
+		unsigned char *iv, EVP_CIPHER_CTX *cipher, int enc,
+		unsigned char *key) {
+	int rv = ticket_key_cb_thunk(
+		SSL_CTX_get_ex_data(SSL_get_SSL_CTX(ssl), get_ssl_ctx_idx()),
+		name, enc, key);
+	if (rv <= 0)
+		return rv;
+	if (enc) {
+		memcpy(name, key, 16);
+		if (RAND_bytes(iv, EVP_CIPHER_iv_length(EVP_aes_128_cbc())) != 1)
+			return -1;
+		if (EVP_EncryptInit_ex(cipher, EVP_aes_128_cbc(), NULL,
+				key + 32, iv) != 1)
+			return -1;
+	} else {
+		if (EVP_DecryptInit_ex(cipher, EVP_aes_128_cbc(), NULL,
+				key + 32, iv) != 1)
+			return -1;
+	}
+	return rv;
+}
+
+#if OPENSSL_VERSION_NUMBER >= 0x30000000L
+
+static int ticket_key_cb(SSL *ssl, unsigned char *name, unsigned char *iv,
+		EVP_CIPHER_CTX *cipher, EVP_MAC_CTX *mac, int enc) {
+	unsigned char key[48];
+	OSSL_PARAM params[2];
+	int rv = ticket_cipher_init(ssl, name, iv, cipher, enc, key);
+	if (rv > 0) {
+		params[0] = OSSL_PARAM_construct_utf8_string(
+			OSSL_MAC_PARAM_DIGEST, "SHA256", 0);
+		params[1] = OSSL_PARAM_construct_end();
+		if (EVP_MAC_init(mac, key + 16, 16, params) != 1)
+			rv = -1;
+	}
+	OPENSSL_cleanse(key, sizeof(key));
+	return rv;
+}
+
+long SSL_CTX_set_ticket_key_cb(SSL_CTX *ctx, int enabled) {
+	return SSL_CTX_set_tlsext_ticket_key_evp_cb(ctx,
+		enabled ? ticket_key_cb : NULL);
+}
+
+#else
+
+static int ticket_key_cb(SSL *ssl, unsigned char *name, unsigned char *iv,
+		EVP_CIPHER_CTX *cipher, HMAC_CTX *mac, int enc) {
+	unsigned char key[48];
+	int rv = ticket_cipher_init(ssl, name, iv, cipher, enc, key);
+	if (rv > 0 && HMAC_Init_ex(mac, key + 16, 16, EVP_sha256(), NULL) != 1)
+		rv = -1;
+	OPENSSL_cleanse(key, sizeof(key));
+	return rv;
+}
+
+long SSL_CTX_set_ticket_key_cb(SSL_CTX *ctx, int enabled) {
+	return SSL_CTX_set_tlsext_ticket_key_cb(ctx,
+		(enabled ? ticket_key_cb : NULL));
+}
+
+#endif
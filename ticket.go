@@ -0,0 +1,268 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <openssl/ssl.h>
+
+extern long SSL_CTX_set_ticket_key_cb(SSL_CTX *ctx, int enabled);
+
+// return -1 before OpenSSL 1.1.1, which has no TLS 1.3 tickets to count
+static int OUR_SSL_CTX_set_num_tickets(SSL_CTX *ctx, size_t n) {
+#if OPENSSL_VERSION_NUMBER >= 0x10101000L && !defined(LIBRESSL_VERSION_NUMBER)
+    return SSL_CTX_set_num_tickets(ctx, n);
+#else
+    return -1;
+#endif
+}
+
+static long OUR_SSL_CTX_get_num_tickets(SSL_CTX *ctx) {
+#if OPENSSL_VERSION_NUMBER >= 0x10101000L && !defined(LIBRESSL_VERSION_NUMBER)
+    return SSL_CTX_get_num_tickets(ctx);
+#else
+    return -1;
+#endif
+}
+*/
+import "C"
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"os"
+	"time"
+	"unsafe"
+)
+
+// NewTicketKey returns a random session ticket key, for SetTicketKeys. A key
+// is a 16 byte name, which tickets carry to say which key sealed them, then a
+// 16 byte HMAC-SHA256 secret and a 16 byte AES-128 key, as for OpenSSL's
+// SSL_CTX_set_tlsext_ticket_keys.
+func NewTicketKey() (key [48]byte, err error) {
+	_, err = rand.Read(key[:])
+	return key, err
+}
+
+// SetTicketKeys sets the keys a server seals its session tickets with.
+// Tickets are sealed with the first key, and accepted if sealed with any of
+// them; clients resuming with a ticket sealed by a later key are handed a
+// fresh one. Servers sharing the same keys resume each other's sessions,
+// and replacing the keys over time, ahead of the oldest in the list, keeps a
+// key that leaks from exposing sessions from far beyond its own lifetime.
+// Keys must have distinct names. SetTicketKeys stops any rotation set up with
+// RotateTicketKeys. An empty list reverts to OpenSSL's own key.
+//
+// With SetTLSExtServerNameCallback, the keys of the context a connection
+// switches to are used, so give each context the same keys.
+func (c *Ctx) SetTicketKeys(keys [][48]byte) error {
+	for i := range keys {
+		for j := 0; j < i; j++ {
+			if bytes.Equal(keys[i][:16], keys[j][:16]) {
+				return errors.New("ticket keys must have distinct names")
+			}
+		}
+	}
+	c.ticket_mtx.Lock()
+	defer c.ticket_mtx.Unlock()
+	c.ticket_rotation = 0
+	c.setTicketKeys(append([][48]byte(nil), keys...))
+	return nil
+}
+
+// RotateTicketKeys makes a server seal its session tickets with a random key
+// of its own that is replaced every interval, keeping the keep keys before it
+// to accept tickets sealed with them. Keys are rotated as handshakes use
+// them, but on schedule, so an idle server doesn't hang on to old keys.
+// Tickets don't resume once their key is dropped, after an interval times
+// keep+1 has passed, so that should be no shorter than the session timeout
+// for resumption to be reliable. An interval of 0 stops rotation, reverting
+// to OpenSSL's own key.
+func (c *Ctx) RotateTicketKeys(interval time.Duration, keep int) error {
+	if interval < 0 || keep < 0 {
+		return errors.New("invalid ticket key rotation")
+	}
+	c.ticket_mtx.Lock()
+	defer c.ticket_mtx.Unlock()
+	c.ticket_rotation = interval
+	c.ticket_keep = keep
+	if interval == 0 {
+		c.setTicketKeys(nil)
+		return nil
+	}
+	key, err := NewTicketKey()
+	if err != nil {
+		return err
+	}
+	c.setTicketKeys([][48]byte{key})
+	c.ticket_rotated = time.Now()
+	return nil
+}
+
+// rotateTicketKeys brings the rotating keys up to date, taking account of
+// every interval that has passed since the last rotation. The caller must
+// hold c.ticket_mtx.
+func (c *Ctx) rotateTicketKeys() {
+	if c.ticket_rotation == 0 {
+		return
+	}
+	steps := int(time.Since(c.ticket_rotated) / c.ticket_rotation)
+	if steps == 0 {
+		return
+	}
+	key, err := NewTicketKey()
+	if err != nil {
+		logger.Errorf("openssl: failed to rotate ticket key: %v", err)
+		return
+	}
+	keys := [][48]byte{key}
+	for i, old := range c.ticket_keys {
+		if i+steps <= c.ticket_keep {
+			keys = append(keys, old)
+		}
+	}
+	c.setTicketKeys(keys)
+	c.ticket_rotated = c.ticket_rotated.Add(
+		time.Duration(steps) * c.ticket_rotation)
+}
+
+// setTicketKeys installs keys, wiping those no longer used. The caller must
+// hold c.ticket_mtx.
+func (c *Ctx) setTicketKeys(keys [][48]byte) {
+	for i := range c.ticket_keys {
+		if i >= len(keys) || keys[i] != c.ticket_keys[i] {
+			c.ticket_keys[i] = [48]byte{}
+		}
+	}
+	c.ticket_keys = keys
+	var enabled C.int
+	if len(keys) > 0 {
+		enabled = 1
+	}
+	C.SSL_CTX_set_ticket_key_cb(c.ctx, enabled)
+}
+
+// SetNumTickets sets how many session tickets TLS 1.3 servers using the
+// context issue after a full handshake, 2 by default so that a client can
+// resume twice without reusing a ticket; after a resumption they issue at
+// most one. 0 issues none, turning TLS 1.3 resumption off. It requires
+// OpenSSL 1.1.1 or newer.
+func (c *Ctx) SetNumTickets(n int) error {
+	if n < 0 {
+		return errors.New("negative number of tickets")
+	}
+	switch C.OUR_SSL_CTX_set_num_tickets(c.ctx, C.size_t(n)) {
+	case 1:
+		return nil
+	case -1:
+		return tls13Unsupported
+	default:
+		return errorFromErrorQueue()
+	}
+}
+
+// NumTickets returns the number of tickets set with SetNumTickets, or -1
+// before OpenSSL 1.1.1.
+func (c *Ctx) NumTickets() int {
+	return int(C.OUR_SSL_CTX_get_num_tickets(c.ctx))
+}
+
+// ResumptionPolicy says how servers let clients resume their sessions.
+type ResumptionPolicy int
+
+const (
+	// ResumeStateless hands clients their session sealed in a ticket, so
+	// that the server needn't keep it; see SetTicketKeys for sharing tickets
+	// between servers. It is OpenSSL's default.
+	ResumeStateless ResumptionPolicy = iota
+	// ResumeStateful keeps sessions in the server's session cache, or a
+	// SessionStore, and only hands clients their IDs: TLS 1.2 clients resume
+	// by session ID, and TLS 1.3 tickets merely name a cached session.
+	// Session keys then never leave the server, and a session can be
+	// revoked by removing it, but servers need a shared SessionStore to
+	// resume each other's sessions. It is the NoTicket option.
+	ResumeStateful
+	// ResumeNever turns resumption off, so that every handshake is a full
+	// one: servers issue no tickets, and neither cache sessions nor look
+	// them up in their internal cache. Sessions a SessionStore already
+	// holds may still be resumed.
+	ResumeNever
+)
+
+// SetResumptionPolicy sets how servers using the context let clients resume
+// sessions, through the NoTicket option and the SessionCacheServer mode.
+// ResumeNever also sets the NoInternalLookup mode and, where SetNumTickets
+// is supported, the number of TLS 1.3 tickets to 0, which the other
+// policies leave alone, so restore them when moving away from
+// ResumeNever.
+func (c *Ctx) SetResumptionPolicy(policy ResumptionPolicy) error {
+	modes := c.SessionCacheMode()
+	switch policy {
+	case ResumeStateless:
+		c.ClearOptions(NoTicket)
+		c.SetSessionCacheMode(modes | SessionCacheServer)
+	case ResumeStateful:
+		c.SetOptions(NoTicket)
+		c.SetSessionCacheMode(modes | SessionCacheServer)
+	case ResumeNever:
+		err := c.SetNumTickets(0)
+		if err != nil && err != tls13Unsupported {
+			return err
+		}
+		c.SetOptions(NoTicket)
+		c.SetSessionCacheMode(modes&^SessionCacheServer | NoInternalLookup)
+	default:
+		return errors.New("unknown resumption policy")
+	}
+	return nil
+}
+
+//export ticket_key_cb_thunk
+func ticket_key_cb_thunk(p unsafe.Pointer, name *C.uchar, enc C.int,
+	key *C.uchar) C.int {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Critf("openssl: ticket key callback panic'd: %v", err)
+			os.Exit(1)
+		}
+	}()
+	ctx := (*Ctx)(p)
+	ctx.ticket_mtx.Lock()
+	defer ctx.ticket_mtx.Unlock()
+	ctx.rotateTicketKeys()
+	out := (*[48]byte)(unsafe.Pointer(key))
+	if enc == 1 {
+		if len(ctx.ticket_keys) == 0 {
+			// no ticket for this session
+			return 0
+		}
+		*out = ctx.ticket_keys[0]
+		return 1
+	}
+	ticket_name := C.GoBytes(unsafe.Pointer(name), 16)
+	for i, ticket_key := range ctx.ticket_keys {
+		if bytes.Equal(ticket_key[:16], ticket_name) {
+			*out = ticket_key
+			if i == 0 {
+				return 1
+			}
+			// still good, but should be resealed with the current key
+			return 2
+		}
+	}
+	return 0
+}
@@ -0,0 +1,202 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"testing"
+	"time"
+)
+
+func newTicketClientCtx(t *testing.T) *Ctx {
+	ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx.SetSessionStore(NewMemorySessionStore(0))
+	return ctx
+}
+
+func TestSetTicketKeys(t *testing.T) {
+	var keys [3][48]byte
+	for i := range keys {
+		key, err := NewTicketKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = key
+	}
+	server_ctx := newTestServerCtx(t)
+	if err := server_ctx.SetTicketKeys(keys[:1]); err != nil {
+		t.Fatal(err)
+	}
+	client_ctx := newTicketClientCtx(t)
+	resume := func(ctx *Ctx) Resumption {
+		client_res, _, _ := resumptionRound(t, ctx, client_ctx)
+		return client_res
+	}
+	if res := resume(server_ctx); res != NotResumed {
+		t.Fatalf("expected a full handshake, got %v", res)
+	}
+	if res := resume(server_ctx); res != ResumedTicket {
+		t.Fatalf("expected ticket resumption, got %v", res)
+	}
+
+	// another server with the same keys takes the ticket
+	other_ctx := newTestServerCtx(t)
+	if err := other_ctx.SetTicketKeys(keys[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if res := resume(other_ctx); res != ResumedTicket {
+		t.Fatalf("expected the fleet to share tickets, got %v", res)
+	}
+
+	// a retired key is still accepted, and the ticket resealed
+	if err := server_ctx.SetTicketKeys(
+		[][48]byte{keys[1], keys[0]}); err != nil {
+		t.Fatal(err)
+	}
+	if res := resume(server_ctx); res != ResumedTicket {
+		t.Fatalf("expected the retired key to be accepted, got %v", res)
+	}
+	if err := server_ctx.SetTicketKeys(keys[1:2]); err != nil {
+		t.Fatal(err)
+	}
+	if res := resume(server_ctx); res != ResumedTicket {
+		t.Fatalf("expected a resealed ticket, got %v", res)
+	}
+	// but not once it is dropped
+	if err := server_ctx.SetTicketKeys(keys[2:]); err != nil {
+		t.Fatal(err)
+	}
+	if res := resume(server_ctx); res != NotResumed {
+		t.Fatalf("expected an unknown key to be refused, got %v", res)
+	}
+
+	if err := server_ctx.SetTicketKeys(
+		[][48]byte{keys[0], keys[0]}); err == nil {
+		t.Fatal("expected an error for keys with the same name")
+	}
+}
+
+func TestRotateTicketKeys(t *testing.T) {
+	const interval = 200 * time.Millisecond
+	server_ctx := newTestServerCtx(t)
+	if err := server_ctx.RotateTicketKeys(interval, 1); err != nil {
+		t.Fatal(err)
+	}
+	client_ctx := newTicketClientCtx(t)
+	resume := func() Resumption {
+		client_res, _, _ := resumptionRound(t, server_ctx, client_ctx)
+		return client_res
+	}
+	if res := resume(); res != NotResumed {
+		t.Fatalf("expected a full handshake, got %v", res)
+	}
+	server_ctx.ticket_mtx.Lock()
+	first := server_ctx.ticket_keys[0]
+	server_ctx.ticket_mtx.Unlock()
+
+	// one interval on, the key has been retired but is still accepted
+	time.Sleep(interval)
+	if res := resume(); res != ResumedTicket {
+		t.Fatalf("expected ticket resumption, got %v", res)
+	}
+	server_ctx.ticket_mtx.Lock()
+	if len(server_ctx.ticket_keys) != 2 ||
+		server_ctx.ticket_keys[0] == first ||
+		server_ctx.ticket_keys[1] != first {
+		t.Fatal("expected the key to have been rotated")
+	}
+	server_ctx.ticket_mtx.Unlock()
+
+	// after keep+1 idle intervals, every key the client could hold is gone
+	time.Sleep(2 * interval)
+	if res := resume(); res != NotResumed {
+		t.Fatalf("expected stale tickets to be refused, got %v", res)
+	}
+
+	if err := server_ctx.RotateTicketKeys(-interval, 1); err == nil {
+		t.Fatal("expected an error for a negative interval")
+	}
+}
+
+func TestNumTickets(t *testing.T) {
+	server_ctx := newTestServerCtx(t)
+	err := server_ctx.SetNumTickets(0)
+	if err == tls13Unsupported {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := server_ctx.NumTickets(); n != 0 {
+		t.Fatalf("expected no tickets, got %d", n)
+	}
+	client_ctx := newTicketClientCtx(t)
+	for i := 0; i < 2; i++ {
+		client_res, _, _ := resumptionRound(t, server_ctx, client_ctx)
+		if client_res != NotResumed {
+			t.Fatalf("expected no resumption without tickets, got %v",
+				client_res)
+		}
+	}
+	if err := server_ctx.SetNumTickets(1); err != nil {
+		t.Fatal(err)
+	}
+	resumptionRound(t, server_ctx, client_ctx)
+	if client_res, _, _ := resumptionRound(t, server_ctx,
+		client_ctx); client_res != ResumedTicket {
+		t.Fatalf("expected ticket resumption, got %v", client_res)
+	}
+}
+
+func TestResumptionPolicy(t *testing.T) {
+	server_ctx := newTestServerCtx(t)
+	if err := server_ctx.SetResumptionPolicy(ResumeStateful); err != nil {
+		t.Fatal(err)
+	}
+	// TLS 1.2 tells session IDs from tickets
+	client_ctx, err := NewCtxWithVersion(TLSv1_2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client_ctx.SetSessionStore(NewMemorySessionStore(0))
+	resumptionRound(t, server_ctx, client_ctx)
+	client_res, server_res, _ := resumptionRound(t, server_ctx, client_ctx)
+	if client_res != ResumedSessionID || server_res != ResumedSessionID {
+		t.Fatalf("expected session id resumption, got %v and %v",
+			client_res, server_res)
+	}
+
+	if err := server_ctx.SetResumptionPolicy(ResumeNever); err != nil {
+		t.Fatal(err)
+	}
+	for _, client_ctx := range []*Ctx{client_ctx, newTicketClientCtx(t)} {
+		for i := 0; i < 2; i++ {
+			client_res, server_res, _ := resumptionRound(t, server_ctx,
+				client_ctx)
+			if client_res != NotResumed || server_res != NotResumed {
+				t.Fatalf("expected no resumption, got %v and %v",
+					client_res, server_res)
+			}
+		}
+	}
+
+	if err := server_ctx.SetResumptionPolicy(-1); err == nil {
+		t.Fatal("expected an error for an unknown policy")
+	}
+}
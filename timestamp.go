@@ -0,0 +1,533 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <stdlib.h>
+#include <string.h>
+#include <openssl/err.h>
+#include <openssl/ts.h>
+
+extern const unsigned char *ASN1_STRING_get0_data_not_a_macro(
+    const ASN1_STRING *s);
+extern int OUR_EVP_MD_size(const EVP_MD *md);
+
+static TS_REQ *OUR_TS_REQ_new(const EVP_MD *md, unsigned char *hashed,
+        int len, ASN1_INTEGER *nonce) {
+    TS_REQ *req = TS_REQ_new();
+    TS_MSG_IMPRINT *imprint = TS_MSG_IMPRINT_new();
+    X509_ALGOR *algo = X509_ALGOR_new();
+    int ok = 0;
+    if (req == NULL || imprint == NULL || algo == NULL)
+        goto done;
+    if (!X509_ALGOR_set0(algo, OBJ_nid2obj(EVP_MD_type(md)), V_ASN1_NULL,
+            NULL))
+        goto done;
+    // the setters take copies
+    ok = TS_REQ_set_version(req, 1) &&
+        TS_MSG_IMPRINT_set_algo(imprint, algo) &&
+        TS_MSG_IMPRINT_set_msg(imprint, hashed, len) &&
+        TS_REQ_set_msg_imprint(req, imprint) &&
+        TS_REQ_set_nonce(req, nonce) &&
+        TS_REQ_set_cert_req(req, 1);
+done:
+    X509_ALGOR_free(algo);
+    TS_MSG_IMPRINT_free(imprint);
+    if (!ok) {
+        TS_REQ_free(req);
+        return NULL;
+    }
+    return req;
+}
+
+static int OUR_TS_REQ_set_policy(TS_REQ *req, const char *oid) {
+    ASN1_OBJECT *obj = OBJ_txt2obj(oid, 1);
+    int rv;
+    if (obj == NULL)
+        return 0;
+    rv = TS_REQ_set_policy_id(req, obj);
+    ASN1_OBJECT_free(obj);
+    return rv;
+}
+
+static TS_RESP *OUR_d2i_TS_RESP(const unsigned char *der, long len) {
+    return d2i_TS_RESP(NULL, &der, len);
+}
+
+static PKCS7 *OUR_d2i_PKCS7(const unsigned char *der, long len) {
+    return d2i_PKCS7(NULL, &der, len);
+}
+
+static long OUR_TS_RESP_get_status(TS_RESP *resp) {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+    return ASN1_INTEGER_get(
+        TS_STATUS_INFO_get0_status(TS_RESP_get_status_info(resp)));
+#else
+    return ASN1_INTEGER_get(TS_RESP_get_status_info(resp)->status);
+#endif
+}
+
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+// the context takes references to store and pool, which it frees
+static int OUR_TS_VERIFY_CTX_set_trust(TS_VERIFY_CTX *ctx, X509_STORE *store,
+        X509 **pool, int n) {
+    STACK_OF(X509) *certs = sk_X509_new_null();
+    int i;
+    if (certs == NULL)
+        return 0;
+    for (i = 0; i < n; i++) {
+        if (sk_X509_push(certs, pool[i]) <= 0) {
+            sk_X509_pop_free(certs, X509_free);
+            return 0;
+        }
+        X509_up_ref(pool[i]);
+    }
+    X509_STORE_up_ref(store);
+    TS_VERIFY_CTX_set_store(ctx, store);
+    TS_VERIFY_CTX_set_certs(ctx, certs);
+    return 1;
+}
+#endif
+
+// returns 1 if resp grants req a timestamp signed by a TSA store trusts, 0
+// if not, or -2 if the OpenSSL version can't check
+static int OUR_TS_RESP_verify(TS_RESP *resp, TS_REQ *req, X509_STORE *store,
+        X509 **pool, int n) {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+    TS_VERIFY_CTX *ctx = TS_REQ_to_TS_VERIFY_CTX(req, NULL);
+    int rv = 0;
+    if (ctx == NULL)
+        return 0;
+    // made from a request, the context only checks the response matches it
+    TS_VERIFY_CTX_add_flags(ctx, TS_VFY_SIGNATURE);
+    if (OUR_TS_VERIFY_CTX_set_trust(ctx, store, pool, n))
+        rv = TS_RESP_verify_response(ctx, resp);
+    TS_VERIFY_CTX_free(ctx);
+    return rv;
+#else
+    return -2;
+#endif
+}
+
+// returns 1 if token timestamps hashed, the digest of a message computed
+// with md, and is signed by a TSA store trusts, 0 if not, -1 if it is for a
+// digest computed with another hash, or -2 if the OpenSSL version can't
+// check
+static int OUR_TS_verify_token(PKCS7 *token, const EVP_MD *md,
+        const unsigned char *hashed, int len, X509_STORE *store,
+        X509 **pool, int n) {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+    TS_VERIFY_CTX *ctx = TS_VERIFY_CTX_new();
+    unsigned char *imprint = OPENSSL_malloc(len);
+    TS_TST_INFO *info = NULL;
+    const ASN1_OBJECT *algo;
+    int rv = 0;
+    if (ctx == NULL || imprint == NULL) {
+        OPENSSL_free(imprint);
+        goto done;
+    }
+    memcpy(imprint, hashed, len);
+    TS_VERIFY_CTX_set_flags(ctx,
+        TS_VFY_VERSION | TS_VFY_SIGNATURE | TS_VFY_IMPRINT);
+    TS_VERIFY_CTX_set_imprint(ctx, imprint, len);
+    if (!OUR_TS_VERIFY_CTX_set_trust(ctx, store, pool, n) ||
+            TS_RESP_verify_token(ctx, token) != 1)
+        goto done;
+    // OpenSSL only compares the digests themselves
+    info = PKCS7_to_TS_TST_INFO(token);
+    if (info == NULL)
+        goto done;
+    X509_ALGOR_get0(&algo, NULL, NULL, TS_MSG_IMPRINT_get_algo(
+        TS_TST_INFO_get_msg_imprint(info)));
+    rv = OBJ_obj2nid(algo) == EVP_MD_type(md) ? 1 : -1;
+done:
+    TS_TST_INFO_free(info);
+    TS_VERIFY_CTX_free(ctx);
+    return rv;
+#else
+    return -2;
+#endif
+}
+*/
+import "C"
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"runtime"
+	"time"
+	"unsafe"
+)
+
+// maxTimestampResponseSize bounds the responses we are willing to read.
+const maxTimestampResponseSize = 1 << 20
+
+var timestampVerifyUnsupported = errors.New(
+	"timestamp verification requires OpenSSL 1.1.0 or newer")
+
+// TimestampStatus is the PKIStatus of a time-stamping authority's response
+// (RFC 3161).
+type TimestampStatus int
+
+const (
+	TimestampGranted                TimestampStatus = 0
+	TimestampGrantedWithMods        TimestampStatus = 1
+	TimestampRejection              TimestampStatus = 2
+	TimestampWaiting                TimestampStatus = 3
+	TimestampRevocationWarning      TimestampStatus = 4
+	TimestampRevocationNotification TimestampStatus = 5
+)
+
+func (s TimestampStatus) String() string {
+	switch s {
+	case TimestampGranted:
+		return "granted"
+	case TimestampGrantedWithMods:
+		return "granted with modifications"
+	case TimestampRejection:
+		return "rejection"
+	case TimestampWaiting:
+		return "waiting"
+	case TimestampRevocationWarning:
+		return "revocation warning"
+	case TimestampRevocationNotification:
+		return "revocation notification"
+	default:
+		return fmt.Sprintf("unknown status %d", int(s))
+	}
+}
+
+// TimestampRequest asks a time-stamping authority to timestamp a digest.
+type TimestampRequest struct {
+	req *C.TS_REQ
+}
+
+// NewTimestampRequest returns a request for a timestamp of hashed, the
+// digest of a message computed with method, e.g. SHA256_Method. It carries
+// a random nonce and asks for the authority's certificate to be included
+// in the token, so that it can be verified without having it.
+func NewTimestampRequest(method Method,
+	hashed []byte) (*TimestampRequest, error) {
+	if len(hashed) == 0 {
+		return nil, errors.New("empty digest")
+	}
+	if len(hashed) != int(C.OUR_EVP_MD_size(method)) {
+		return nil, errors.New("digest length doesn't match the hash")
+	}
+	nonce, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+	asn1_nonce, err := newASN1Integer(nonce)
+	if err != nil {
+		return nil, err
+	}
+	defer C.ASN1_INTEGER_free(asn1_nonce)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	req := C.OUR_TS_REQ_new(method, (*C.uchar)(unsafe.Pointer(&hashed[0])),
+		C.int(len(hashed)), asn1_nonce)
+	if req == nil {
+		return nil, errorFromErrorQueue()
+	}
+	r := &TimestampRequest{req: req}
+	runtime.SetFinalizer(r, func(r *TimestampRequest) {
+		C.TS_REQ_free(r.req)
+	})
+	return r, nil
+}
+
+// SetPolicy asks for the timestamp to be issued under the policy identified
+// by the dotted OID string, rather than the authority's default.
+func (r *TimestampRequest) SetPolicy(oid string) error {
+	defer runtime.KeepAlive(r)
+	c_oid := C.CString(oid)
+	defer C.free(unsafe.Pointer(c_oid))
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.OUR_TS_REQ_set_policy(r.req, c_oid) != 1 {
+		return errorFromErrorQueue()
+	}
+	return nil
+}
+
+// MarshalDER converts the request to DER-encoded format, to be sent with a
+// Content-Type of application/timestamp-query.
+func (r *TimestampRequest) MarshalDER() (der_block []byte, err error) {
+	defer runtime.KeepAlive(r)
+	bio := C.BIO_new(C.BIO_s_mem())
+	if bio == nil {
+		return nil, errors.New("failed to allocate memory BIO")
+	}
+	defer C.BIO_free(bio)
+	if C.i2d_TS_REQ_bio(bio, r.req) != 1 {
+		return nil, errors.New("failed dumping timestamp request der")
+	}
+	return ioutil.ReadAll(asAnyBio(bio))
+}
+
+// RequestTimestamp sends req to the time-stamping authority at url with
+// client, or http.DefaultClient if it is nil, and returns its response,
+// which must still be checked with Verify.
+func RequestTimestamp(client *http.Client, url string,
+	req *TimestampRequest) (*TimestampResponse, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	der, err := req.MarshalDER()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Post(url, "application/timestamp-query",
+		bytes.NewReader(der))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("time-stamping authority returned %s",
+			resp.Status)
+	}
+	der, err = ioutil.ReadAll(io.LimitReader(resp.Body,
+		maxTimestampResponseSize))
+	if err != nil {
+		return nil, err
+	}
+	return LoadTimestampResponseFromDER(der)
+}
+
+// TimestampResponse is a time-stamping authority's answer to a
+// TimestampRequest.
+type TimestampResponse struct {
+	resp *C.TS_RESP
+}
+
+// LoadTimestampResponseFromDER loads a DER-encoded response.
+func LoadTimestampResponseFromDER(der_block []byte) (*TimestampResponse,
+	error) {
+	if len(der_block) == 0 {
+		return nil, errors.New("empty der block")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	resp := C.OUR_d2i_TS_RESP((*C.uchar)(unsafe.Pointer(&der_block[0])),
+		C.long(len(der_block)))
+	if resp == nil {
+		return nil, errorFromErrorQueue()
+	}
+	r := &TimestampResponse{resp: resp}
+	runtime.SetFinalizer(r, func(r *TimestampResponse) {
+		C.TS_RESP_free(r.resp)
+	})
+	return r, nil
+}
+
+// MarshalDER converts the response to DER-encoded format.
+func (r *TimestampResponse) MarshalDER() (der_block []byte, err error) {
+	defer runtime.KeepAlive(r)
+	bio := C.BIO_new(C.BIO_s_mem())
+	if bio == nil {
+		return nil, errors.New("failed to allocate memory BIO")
+	}
+	defer C.BIO_free(bio)
+	if C.i2d_TS_RESP_bio(bio, r.resp) != 1 {
+		return nil, errors.New("failed dumping timestamp response der")
+	}
+	return ioutil.ReadAll(asAnyBio(bio))
+}
+
+// Status returns whether the authority granted the request.
+func (r *TimestampResponse) Status() TimestampStatus {
+	defer runtime.KeepAlive(r)
+	return TimestampStatus(C.OUR_TS_RESP_get_status(r.resp))
+}
+
+// Verify checks that the response grants req a timestamp for its digest and
+// nonce, signed by a time-stamping authority whose certificate verifies
+// against store, with intermediates, as well as any certificates in the
+// token, as untrusted candidates for building its chain. The authority's
+// certificate must be for time stamping only.
+func (r *TimestampResponse) Verify(req *TimestampRequest,
+	store *CertificateStore, intermediates []*Certificate) error {
+	defer runtime.KeepAlive(r)
+	defer runtime.KeepAlive(req)
+	defer runtime.KeepAlive(store)
+	xs, err := acquireX509Array(intermediates)
+	if err != nil {
+		return err
+	}
+	defer xs.free()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	switch C.OUR_TS_RESP_verify(r.resp, req.req, store.store, xs.ptr(),
+		C.int(len(xs))) {
+	case 1:
+		return nil
+	case -2:
+		return timestampVerifyUnsupported
+	default:
+		return errorFromErrorQueue()
+	}
+}
+
+// Token returns the timestamp token the response carries, which is what is
+// kept alongside the timestamped data.
+func (r *TimestampResponse) Token() (*TimestampToken, error) {
+	defer runtime.KeepAlive(r)
+	p7 := C.TS_RESP_get_token(r.resp)
+	if p7 == nil {
+		return nil, fmt.Errorf("timestamp response has no token: %s",
+			r.Status())
+	}
+	p7 = C.PKCS7_dup(p7)
+	if p7 == nil {
+		return nil, errors.New("failed to copy timestamp token")
+	}
+	return newTimestampToken(p7), nil
+}
+
+// TimestampToken is a time-stamping authority's signed statement that a
+// digest existed at a time: a CMS SignedData message over its TSTInfo.
+type TimestampToken struct {
+	p7 *C.PKCS7
+}
+
+func newTimestampToken(p7 *C.PKCS7) *TimestampToken {
+	t := &TimestampToken{p7: p7}
+	runtime.SetFinalizer(t, func(t *TimestampToken) {
+		C.PKCS7_free(t.p7)
+	})
+	return t
+}
+
+// LoadTimestampTokenFromDER loads a DER-encoded token.
+func LoadTimestampTokenFromDER(der_block []byte) (*TimestampToken, error) {
+	if len(der_block) == 0 {
+		return nil, errors.New("empty der block")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	p7 := C.OUR_d2i_PKCS7((*C.uchar)(unsafe.Pointer(&der_block[0])),
+		C.long(len(der_block)))
+	if p7 == nil {
+		return nil, errorFromErrorQueue()
+	}
+	return newTimestampToken(p7), nil
+}
+
+// MarshalDER converts the token to DER-encoded format.
+func (t *TimestampToken) MarshalDER() (der_block []byte, err error) {
+	defer runtime.KeepAlive(t)
+	bio := C.BIO_new(C.BIO_s_mem())
+	if bio == nil {
+		return nil, errors.New("failed to allocate memory BIO")
+	}
+	defer C.BIO_free(bio)
+	if C.i2d_PKCS7_bio(bio, t.p7) != 1 {
+		return nil, errors.New("failed dumping timestamp token der")
+	}
+	return ioutil.ReadAll(asAnyBio(bio))
+}
+
+// TimestampInfo is what a timestamp token states.
+type TimestampInfo struct {
+	// Time is when the authority timestamped the digest.
+	Time         time.Time
+	SerialNumber *big.Int
+	// Policy is the dotted OID of the policy the token was issued under.
+	Policy string
+	// HashedMessage is the digest timestamped.
+	HashedMessage []byte
+}
+
+// Info returns what the token states. It isn't to be trusted before the
+// token is verified.
+func (t *TimestampToken) Info() (*TimestampInfo, error) {
+	defer runtime.KeepAlive(t)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	tst := C.PKCS7_to_TS_TST_INFO(t.p7)
+	if tst == nil {
+		return nil, errorFromErrorQueue()
+	}
+	defer C.TS_TST_INFO_free(tst)
+	gen_time, err := asn1TimeToTime((*C.ASN1_TIME)(unsafe.Pointer(
+		C.TS_TST_INFO_get_time(tst))))
+	if err != nil {
+		return nil, err
+	}
+	serial, err := asn1IntegerToBig(C.TS_TST_INFO_get_serial(tst))
+	if err != nil {
+		return nil, err
+	}
+	var buf [128]C.char
+	length := C.OBJ_obj2txt(&buf[0], C.int(len(buf)),
+		C.TS_TST_INFO_get_policy_id(tst), 1)
+	if length <= 0 || int(length) >= len(buf) {
+		return nil, errors.New("failed to read policy oid")
+	}
+	msg := (*C.ASN1_STRING)(C.TS_MSG_IMPRINT_get_msg(
+		C.TS_TST_INFO_get_msg_imprint(tst)))
+	return &TimestampInfo{
+		Time:         gen_time,
+		SerialNumber: serial,
+		Policy:       C.GoStringN(&buf[0], length),
+		HashedMessage: C.GoBytes(unsafe.Pointer(
+			C.ASN1_STRING_get0_data_not_a_macro(msg)),
+			C.ASN1_STRING_length(msg)),
+	}, nil
+}
+
+// Verify checks that the token timestamps hashed, the digest of a message
+// computed with method, and is signed by a time-stamping authority whose
+// certificate verifies against store as TimestampResponse.Verify does. As
+// a token outlives the authority's certificate, the store's time may need
+// setting to that of the token.
+func (t *TimestampToken) Verify(method Method, hashed []byte,
+	store *CertificateStore, intermediates []*Certificate) error {
+	defer runtime.KeepAlive(t)
+	defer runtime.KeepAlive(store)
+	if len(hashed) == 0 {
+		return errors.New("empty digest")
+	}
+	xs, err := acquireX509Array(intermediates)
+	if err != nil {
+		return err
+	}
+	defer xs.free()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	switch C.OUR_TS_verify_token(t.p7, method,
+		(*C.uchar)(unsafe.Pointer(&hashed[0])), C.int(len(hashed)),
+		store.store, xs.ptr(), C.int(len(xs))) {
+	case 1:
+		return nil
+	case -1:
+		return errors.New("timestamp is for a digest computed with " +
+			"another hash")
+	case -2:
+		return timestampVerifyUnsupported
+	default:
+		return errorFromErrorQueue()
+	}
+}
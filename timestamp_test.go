@@ -0,0 +1,218 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+const testTSAConfig = `[ tsa ]
+default_tsa = tsa_config
+[ tsa_config ]
+serial = %DIR%/serial
+signer_digest = sha256
+default_policy = 1.2.3.4.1
+other_policies = 1.2.3.4.5
+digests = sha256, sha384
+ess_cert_id_alg = sha1
+`
+
+// newTestTSA starts a time-stamping authority answering with the openssl
+// command line tool, signing with cert and its key.
+func newTestTSA(t *testing.T, key PrivateKey, cert *Certificate) (
+	*httptest.Server, func()) {
+	if _, err := exec.LookPath("openssl"); err != nil {
+		t.Skip("openssl command line tool not available")
+	}
+	dir, err := ioutil.TempDir("", "openssl-tsa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert_pem, err := cert.MarshalPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key_pem, err := key.MarshalPKCS1PrivateKeyPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := bytes.Replace([]byte(testTSAConfig), []byte("%DIR%"),
+		[]byte(dir), -1)
+	for name, data := range map[string][]byte{
+		"tsa.pem": cert_pem, "tsa.key": key_pem, "serial": []byte("01\n"),
+		"tsa.cnf": config} {
+		err := ioutil.WriteFile(dir+"/"+name, data, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			body, err := ioutil.ReadAll(req.Body)
+			if err == nil {
+				err = ioutil.WriteFile(dir+"/req.tsq", body, 0600)
+			}
+			if err == nil {
+				err = exec.Command("openssl", "ts", "-reply",
+					"-config", dir+"/tsa.cnf", "-queryfile", dir+"/req.tsq",
+					"-signer", dir+"/tsa.pem", "-inkey", dir+"/tsa.key",
+					"-out", dir+"/resp.tsr").Run()
+			}
+			var resp []byte
+			if err == nil {
+				resp, err = ioutil.ReadFile(dir + "/resp.tsr")
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/timestamp-reply")
+			w.Write(resp)
+		}))
+	return server, func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestTimestamp(t *testing.T) {
+	ca_key := generateTestRSAKey(t)
+	ca := issueTestCert(t, ca_key, testCert{CA: true})
+	tsa_key := generateTestRSAKey(t)
+	tsa := issueTestCert(t, tsa_key, testCert{Serial: 5, Name: "Test TSA",
+		Issuer: ca, IssuerKey: ca_key, Modify: func(c *Certificate) {
+			// RFC 3161 requires a critical extended key usage of time
+			// stamping only
+			eku, err := asn1.Marshal([]asn1.ObjectIdentifier{
+				{1, 3, 6, 1, 5, 5, 7, 3, 8}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = c.AddExtensionDER("2.5.29.37", true, eku)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}})
+	server, closer := newTestTSA(t, tsa_key, tsa)
+	defer closer()
+	store, err := NewCertificateStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddCertificate(ca); err != nil {
+		t.Fatal(err)
+	}
+	hashed, err := SHA256([]byte("release-1.2.3.tar.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := NewTimestampRequest(SHA256_Method, hashed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := req.SetPolicy("1.2.3.4.5"); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := RequestTimestamp(nil, server.URL, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status() != TimestampGranted {
+		t.Fatalf("unexpected status %s", resp.Status())
+	}
+	if err := resp.Verify(req, store, nil); err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewTimestampRequest(SHA256_Method, hashed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := resp.Verify(other, store, nil); err == nil {
+		t.Fatal("expected a response to another request to fail")
+	}
+	empty_store, err := NewCertificateStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := resp.Verify(req, empty_store, nil); err == nil {
+		t.Fatal("expected an untrusted authority to fail verification")
+	}
+
+	token, err := resp.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := token.MarshalDER()
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err = LoadTimestampTokenFromDER(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := token.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Policy != "1.2.3.4.5" || info.SerialNumber.Sign() <= 0 ||
+		!bytes.Equal(info.HashedMessage, hashed[:]) ||
+		time.Since(info.Time) > time.Minute {
+		t.Fatalf("unexpected token info %+v", info)
+	}
+	if err := token.Verify(SHA256_Method, hashed[:], store,
+		nil); err != nil {
+		t.Fatal(err)
+	}
+	tampered := hashed
+	tampered[0] ^= 1
+	if err := token.Verify(SHA256_Method, tampered[:], store,
+		nil); err == nil {
+		t.Fatal("expected another digest to fail verification")
+	}
+
+	// the authority refuses hashes it isn't configured for
+	sha1_hashed, err := SHA1([]byte("release-1.2.3.tar.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err = NewTimestampRequest(SHA1_Method, sha1_hashed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = RequestTimestamp(nil, server.URL, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status() != TimestampRejection {
+		t.Fatalf("unexpected status %s", resp.Status())
+	}
+	if err := resp.Verify(req, store, nil); err == nil {
+		t.Fatal("expected a rejection to fail verification")
+	}
+	if _, err := resp.Token(); err == nil {
+		t.Fatal("expected a rejection to carry no token")
+	}
+}
@@ -0,0 +1,375 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <stdlib.h>
+#include <openssl/ssl.h>
+#include <openssl/x509.h>
+
+extern int sk_X509_num_not_a_macro(STACK_OF(X509) *sk);
+extern X509 *sk_X509_value_not_a_macro(STACK_OF(X509)* sk, int i);
+
+// the certificates the peer sent, its own first
+static STACK_OF(X509) *OUR_X509_STORE_CTX_get0_untrusted(
+        X509_STORE_CTX *ctx) {
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+    return X509_STORE_CTX_get0_untrusted(ctx);
+#else
+    return ctx->untrusted;
+#endif
+}
+
+static SSL *X509_STORE_CTX_get_tls_config_ssl(X509_STORE_CTX *ctx) {
+    return X509_STORE_CTX_get_ex_data(ctx,
+        SSL_get_ex_data_X509_STORE_CTX_idx());
+}
+
+static int tls_config_ssl_is_server(SSL *ssl) {
+#if OPENSSL_VERSION_NUMBER >= 0x10002000L
+    return SSL_is_server(ssl);
+#else
+    return ssl->server;
+#endif
+}
+
+static int SSL_CTX_set_client_CA_name_ders(SSL_CTX *ctx,
+        const unsigned char **ders, long *lens, int n) {
+    STACK_OF(X509_NAME) *names = sk_X509_NAME_new_null();
+    X509_NAME *name;
+    int i;
+    if (names == NULL)
+        return 0;
+    for (i = 0; i < n; i++) {
+        name = d2i_X509_NAME(NULL, &ders[i], lens[i]);
+        if (name == NULL || !sk_X509_NAME_push(names, name)) {
+            X509_NAME_free(name);
+            sk_X509_NAME_pop_free(names, X509_NAME_free);
+            return 0;
+        }
+    }
+    SSL_CTX_set_client_CA_list(ctx, names);
+    return 1;
+}
+*/
+import "C"
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+	"unsafe"
+)
+
+// NewCtxFromTLSConfig creates a context configured like config, to ease
+// moving code from crypto/tls. Like config, it can be used by clients and
+// servers alike. It translates
+//
+//   - Certificates, with AddKeyPair. OpenSSL keeps one certificate per key
+//     type and picks between them by what the client supports rather than by
+//     server name, so at most one certificate of each key type is accepted.
+//   - RootCAs, ClientCAs, ClientAuth, InsecureSkipVerify, ServerName and
+//     VerifyPeerCertificate. Peers are verified by crypto/x509, as crypto/tls
+//     would, from the context's verify callback, rather than against the
+//     context's certificate store; see SetVerifyCallback. Clients check the
+//     name they send with SNI, which ServerName sets for Client and Dial
+//     replaces with the host dialed. VerifyPeerCertificate is only called if
+//     the peer presents a certificate.
+//   - CipherSuites, PreferServerCipherSuites, MinVersion and MaxVersion. As
+//     with crypto/tls, TLS 1.3 suites aren't configurable this way.
+//   - NextProtos, SessionTicketsDisabled and KeyLogWriter.
+//
+// Other fields are ignored, except for the callbacks GetCertificate,
+// GetClientCertificate, GetConfigForClient and VerifyConnection, which have
+// no translation and are refused.
+func NewCtxFromTLSConfig(config *tls.Config) (*Ctx, error) {
+	if config == nil {
+		return nil, errors.New("nil tls.Config")
+	}
+	switch {
+	case config.GetCertificate != nil:
+		return nil, errors.New("tls.Config.GetCertificate isn't supported")
+	case config.GetClientCertificate != nil:
+		return nil, errors.New(
+			"tls.Config.GetClientCertificate isn't supported")
+	case config.GetConfigForClient != nil:
+		return nil, errors.New(
+			"tls.Config.GetConfigForClient isn't supported")
+	case config.VerifyConnection != nil:
+		return nil, errors.New("tls.Config.VerifyConnection isn't supported")
+	}
+	config = config.Clone()
+	c, err := NewCtx()
+	if err != nil {
+		return nil, err
+	}
+	err = c.useTLSConfigCertificates(config.Certificates)
+	if err != nil {
+		return nil, err
+	}
+	err = c.useTLSConfigVersions(config.MinVersion, config.MaxVersion)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.CipherSuites) > 0 {
+		err = c.useTLSConfigCipherSuites(config.CipherSuites)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.PreferServerCipherSuites {
+		c.SetOptions(CipherServerPreference)
+	}
+	if config.SessionTicketsDisabled {
+		c.SetOptions(NoTicket)
+	}
+	if len(config.NextProtos) > 0 {
+		err = c.SetAlpnProtos(config.NextProtos)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.KeyLogWriter != nil {
+		c.SetKeyLogWriter(config.KeyLogWriter)
+	}
+	if config.ClientCAs != nil && config.ClientAuth != tls.NoClientCert {
+		err = c.setClientCANames(config.ClientCAs.Subjects())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var mode VerifyOptions
+	switch config.ClientAuth {
+	case tls.NoClientCert:
+		mode = VerifyNone
+	case tls.RequestClientCert, tls.VerifyClientCertIfGiven:
+		mode = VerifyPeer
+	case tls.RequireAnyClientCert, tls.RequireAndVerifyClientCert:
+		mode = VerifyPeer | VerifyFailIfNoPeerCert
+	default:
+		return nil, fmt.Errorf("unknown tls.ClientAuthType %d",
+			config.ClientAuth)
+	}
+	// clients always run the callback, which looks at InsecureSkipVerify
+	c.verify_servers = true
+	c.server_name = config.ServerName
+	c.SetVerify(mode, func(ok bool, store *CertificateStoreCtx) bool {
+		return verifyTLSConfigPeer(config, ok, store)
+	})
+	return c, nil
+}
+
+func (c *Ctx) useTLSConfigCertificates(certs []tls.Certificate) error {
+	key_types := make(map[KeyType]bool)
+	for i, tls_cert := range certs {
+		if len(tls_cert.Certificate) == 0 {
+			return fmt.Errorf("tls.Config.Certificates[%d] is empty", i)
+		}
+		chain := make([]*Certificate, 0, len(tls_cert.Certificate))
+		for _, der := range tls_cert.Certificate {
+			cert, err := LoadCertificateFromDER(der)
+			if err != nil {
+				return err
+			}
+			chain = append(chain, cert)
+		}
+		key, err := FromStdlibPrivateKey(tls_cert.PrivateKey)
+		if err != nil {
+			return err
+		}
+		key_type, err := key.KeyType()
+		if err != nil {
+			return err
+		}
+		if key_types[key_type] {
+			return fmt.Errorf("tls.Config.Certificates[%d] has the same "+
+				"key type as an earlier certificate", i)
+		}
+		key_types[key_type] = true
+		err = c.AddKeyPair(chain[0], key, chain[1:])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Ctx) useTLSConfigVersions(min, max uint16) error {
+	versions := []struct {
+		version uint16
+		option  Options
+	}{
+		{tls.VersionTLS10, NoTLSv1},
+		{tls.VersionTLS11, NoTLSv1_1},
+		{tls.VersionTLS12, NoTLSv1_2},
+		{tls.VersionTLS13, NoTLSv1_3},
+	}
+	if max != 0 && max < min {
+		return errors.New("tls.Config.MaxVersion is below MinVersion")
+	}
+	if min == tls.VersionTLS13 && NoTLSv1_3 == 0 {
+		return tls13Unsupported
+	}
+	for _, v := range versions {
+		if v.version < min || (max != 0 && v.version > max) {
+			c.SetOptions(v.option)
+		}
+	}
+	return nil
+}
+
+func (c *Ctx) useTLSConfigCipherSuites(ids []uint16) error {
+	all, err := ParseCipherList("ALL:COMPLEMENTOFALL", "")
+	if err != nil {
+		return err
+	}
+	names := make(map[uint16]string, len(all))
+	for _, suite := range all {
+		names[suite.ID] = suite.Name
+	}
+	var list []string
+	for _, id := range ids {
+		if id>>8 == 0x13 {
+			// TLS 1.3 suites, which crypto/tls ignores here too
+			continue
+		}
+		name, ok := names[id]
+		if !ok {
+			return fmt.Errorf("cipher suite %#04x isn't supported", id)
+		}
+		list = append(list, name)
+	}
+	if len(list) == 0 {
+		return errors.New("tls.Config.CipherSuites has no TLS 1.2 suites")
+	}
+	return c.SetCipherList(strings.Join(list, ":"))
+}
+
+func (c *Ctx) setClientCANames(subjects [][]byte) error {
+	if len(subjects) == 0 {
+		return nil
+	}
+	// cgo won't pass Go memory holding pointers to Go memory
+	ders := make([]*C.uchar, len(subjects))
+	lens := make([]C.long, len(subjects))
+	for i, subject := range subjects {
+		ders[i] = (*C.uchar)(C.CBytes(subject))
+		defer C.free(unsafe.Pointer(ders[i]))
+		lens[i] = C.long(len(subject))
+	}
+	if C.SSL_CTX_set_client_CA_name_ders(c.ctx, &ders[0], &lens[0],
+		C.int(len(subjects))) != 1 {
+		return errorFromErrorQueue()
+	}
+	return nil
+}
+
+// verifyTLSConfigPeer decides on the peer's certificate as crypto/tls would
+// with config. Failures OpenSSL reports on the way are let through, so that
+// verification carries on to its final, successful callback for the peer's
+// own certificate, where the chain the peer sent is checked as a whole.
+func verifyTLSConfigPeer(config *tls.Config, ok bool,
+	store *CertificateStoreCtx) bool {
+	if !ok || store.Depth() > 0 {
+		return true
+	}
+	ssl := C.X509_STORE_CTX_get_tls_config_ssl(store.ctx)
+	if ssl == nil {
+		return false
+	}
+	sk := C.OUR_X509_STORE_CTX_get0_untrusted(store.ctx)
+	if sk == nil {
+		return false
+	}
+	raw := make([][]byte, 0, int(C.sk_X509_num_not_a_macro(sk)))
+	for i := 0; i < int(C.sk_X509_num_not_a_macro(sk)); i++ {
+		der, err := refCertificate(C.sk_X509_value_not_a_macro(sk,
+			C.int(i))).MarshalDER()
+		if err != nil {
+			store.SetErrorCode(ApplicationVerification)
+			return false
+		}
+		raw = append(raw, der)
+	}
+	err := checkTLSConfigPeer(config, raw,
+		C.tls_config_ssl_is_server(ssl) != 0, sslServerName(ssl))
+	if err != nil {
+		logger.Warnf("openssl: peer certificate refused: %v", err)
+		store.SetErrorCode(ApplicationVerification)
+		return false
+	}
+	store.SetErrorCode(Ok)
+	return true
+}
+
+func sslServerName(ssl *C.SSL) string {
+	name := C.SSL_get_servername(ssl, C.TLSEXT_NAMETYPE_host_name)
+	if name == nil {
+		return ""
+	}
+	return C.GoString(name)
+}
+
+// checkTLSConfigPeer verifies the chain raw the peer sent, its own
+// certificate first, as crypto/tls would with config.
+func checkTLSConfigPeer(config *tls.Config, raw [][]byte, is_server bool,
+	server_name string) error {
+	certs := make([]*x509.Certificate, 0, len(raw))
+	for _, der := range raw {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return errors.New("no peer certificate")
+	}
+	verify := !config.InsecureSkipVerify
+	opts := x509.VerifyOptions{
+		Roots:         config.RootCAs,
+		DNSName:       server_name,
+		Intermediates: x509.NewCertPool()}
+	if is_server {
+		verify = config.ClientAuth >= tls.VerifyClientCertIfGiven
+		opts = x509.VerifyOptions{
+			Roots:         config.ClientCAs,
+			Intermediates: x509.NewCertPool(),
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}
+	}
+	if config.Time != nil {
+		opts.CurrentTime = config.Time()
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	var chains [][]*x509.Certificate
+	if verify {
+		var err error
+		chains, err = certs[0].Verify(opts)
+		if err != nil {
+			return err
+		}
+	}
+	if config.VerifyPeerCertificate != nil {
+		return config.VerifyPeerCertificate(raw, chains)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+)
+
+// generateTestECKey generates a P-256 key, also returning it as crypto/tls
+// takes it.
+func generateTestECKey(t testing.TB) (PrivateKey, crypto.PrivateKey) {
+	key, err := GenerateECKey(Prime256v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	std, err := ToStdlibPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, std
+}
+
+func TestNewCtxFromTLSConfig(t *testing.T) {
+	ca_key, _ := generateTestECKey(t)
+	ca_cert := issueTestCert(t, ca_key, testCert{Serial: 1, Name: "Test CA",
+		CA: true})
+	ca := parseWithStdlib(t, ca_cert)
+	key, server_key := generateTestECKey(t)
+	server_cert := parseWithStdlib(t, issueTestCert(t, key, testCert{
+		Serial: 2, Name: "server", Issuer: ca_cert, IssuerKey: ca_key,
+		DNSNames:    []string{"example.com"},
+		ExtKeyUsage: []ExtKeyUsage{ExtKeyUsageServerAuth}}))
+	key, client_key := generateTestECKey(t)
+	client_cert := parseWithStdlib(t, issueTestCert(t, key, testCert{
+		Serial: 3, Name: "client", Issuer: ca_cert, IssuerKey: ca_key,
+		ExtKeyUsage: []ExtKeyUsage{ExtKeyUsageClientAuth}}))
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	var server_chains [][]*x509.Certificate
+	server_ctx, err := NewCtxFromTLSConfig(&tls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{server_cert.Raw, ca.Raw},
+			PrivateKey:  server_key}},
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  pool,
+		MinVersion: tls.VersionTLS12,
+		VerifyPeerCertificate: func(raw [][]byte,
+			chains [][]*x509.Certificate) error {
+			server_chains = chains
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var server_done chan struct{}
+	handshake := func(server_name string) (*Conn, error) {
+		client_ctx, err := NewCtxFromTLSConfig(&tls.Config{
+			Certificates: []tls.Certificate{{
+				Certificate: [][]byte{client_cert.Raw},
+				PrivateKey:  client_key}},
+			RootCAs:    pool,
+			ServerName: server_name,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		server_conn, client_conn := NetPipe(t)
+		server, err := Server(server_conn, server_ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server_done = make(chan struct{})
+		go func() {
+			defer close(server_done)
+			server.Handshake()
+			server.Close()
+		}()
+		client, err := Client(client_conn, client_ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client, client.Handshake()
+	}
+
+	client, err := handshake("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.VerifyResult() != Ok {
+		t.Fatalf("unexpected verify result %d", client.VerifyResult())
+	}
+	client.Close()
+	// with TLS 1.3 the server checks the client's certificate after the
+	// client is done
+	<-server_done
+	if len(server_chains) != 1 || len(server_chains[0]) != 2 ||
+		!server_chains[0][0].Equal(client_cert) {
+		t.Fatalf("unexpected verified client chains %v", server_chains)
+	}
+
+	client, err = handshake("other.example.com")
+	if err == nil {
+		t.Fatal("expected a server name mismatch to fail")
+	}
+	if client.VerifyResult() != ApplicationVerification {
+		t.Fatalf("unexpected verify result %d", client.VerifyResult())
+	}
+	client.Close()
+
+	_, err = NewCtxFromTLSConfig(&tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate,
+			error) {
+			return nil, nil
+		},
+	})
+	if err == nil {
+		t.Fatal("expected GetCertificate to be refused")
+	}
+}
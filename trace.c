@@ -0,0 +1,56 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include <openssl/ssl.h>
+#include "_cgo_export.h"
+
+extern void renegotiation_info_cb(const SSL *ssl, int where, int ret);
+
+// info_cb is the info callback of contexts with an InfoCallback and of
+// connections with Metrics. A connection's own callback stands in for its
+// context's, so each callback this package installs runs the renegotiation
+// checks before anything else.
+static void info_cb(const SSL *ssl, int where, int ret) {
+	renegotiation_info_cb(ssl, where, ret);
+	info_cb_thunk(
+		SSL_CTX_get_ex_data(SSL_get_SSL_CTX(ssl), get_ssl_ctx_idx()),
+		SSL_get_ex_data(ssl, get_ssl_idx()), (SSL *)ssl, where, ret);
+}
+
+// Without an InfoCallback, the context keeps the renegotiation checks, which
+// do nothing unless a RenegotiationPolicy or limit was set.
+void SSL_CTX_set_info(SSL_CTX *ctx, int enabled) {
+	SSL_CTX_set_info_callback(ctx,
+		(enabled ? info_cb : renegotiation_info_cb));
+}
+
+void SSL_set_info(SSL *ssl, int enabled) {
+	SSL_set_info_callback(ssl, (enabled ? info_cb : NULL));
+}
+
+static void msg_cb(int write_p, int version, int content_type,
+		const void *buf, size_t len, SSL *ssl, void *arg) {
+	msg_cb_thunk(
+		SSL_CTX_get_ex_data(SSL_get_SSL_CTX(ssl), get_ssl_ctx_idx()),
+		SSL_get_ex_data(ssl, get_ssl_idx()), write_p, version,
+		content_type, (void *)buf, len);
+}
+
+void SSL_CTX_set_msg(SSL_CTX *ctx, int enabled) {
+	SSL_CTX_set_msg_callback(ctx, (enabled ? msg_cb : NULL));
+}
+
+void SSL_set_msg(SSL *ssl, int enabled) {
+	SSL_set_msg_callback(ssl, (enabled ? msg_cb : NULL));
+}
@@ -0,0 +1,217 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+/*
+#include <openssl/ssl.h>
+
+#ifndef SSL3_RT_HEADER
+#define SSL3_RT_HEADER 0x100
+#endif
+
+#ifndef SSL3_RT_INNER_CONTENT_TYPE
+#define SSL3_RT_INNER_CONTENT_TYPE 0x101
+#endif
+
+extern void SSL_CTX_set_info(SSL_CTX *ctx, int enabled);
+extern void SSL_set_info(SSL *ssl, int enabled);
+extern void SSL_CTX_set_msg(SSL_CTX *ctx, int enabled);
+extern void SSL_set_msg(SSL *ssl, int enabled);
+*/
+import "C"
+
+import (
+	"os"
+	"unsafe"
+)
+
+// InfoWhere is a set of flags telling what an InfoCallback is called about.
+type InfoWhere int
+
+const (
+	// InfoHandshakeStart and InfoHandshakeDone mark the ends of a
+	// handshake, including renegotiations and TLS 1.3 post-handshake
+	// messages.
+	InfoHandshakeStart InfoWhere = C.SSL_CB_HANDSHAKE_START
+	InfoHandshakeDone  InfoWhere = C.SSL_CB_HANDSHAKE_DONE
+	// InfoLoop reports each move to a new handshake state.
+	InfoLoop InfoWhere = C.SSL_CB_LOOP
+	// InfoExit reports the handshake returning, with Ret 0 on failure and
+	// below 0 when it is waiting for I/O.
+	InfoExit InfoWhere = C.SSL_CB_EXIT
+	// InfoAlert reports an alert, along with InfoRead for one received or
+	// InfoWrite for one sent.
+	InfoAlert InfoWhere = C.SSL_CB_ALERT
+	InfoRead  InfoWhere = C.SSL_CB_READ
+	InfoWrite InfoWhere = C.SSL_CB_WRITE
+	// InfoConnect and InfoAccept tell client and server connections apart.
+	InfoConnect InfoWhere = C.SSL_ST_CONNECT
+	InfoAccept  InfoWhere = C.SSL_ST_ACCEPT
+)
+
+// Info is a handshake state change or alert reported to an InfoCallback.
+type Info struct {
+	Where InfoWhere
+	// State describes the handshake state, e.g. "SSLv3/TLS write client
+	// hello".
+	State string
+	// Ret is the handshake's return value for InfoExit, and the alert's
+	// level and description for InfoAlert.
+	Ret int
+	// AlertLevel and AlertDescription spell out an alert, e.g. "fatal" and
+	// "handshake failure". They are empty unless Where has InfoAlert.
+	AlertLevel       string
+	AlertDescription string
+}
+
+// InfoCallback is called as connections change handshake state and send or
+// receive alerts. The connection's lock is held while it runs, so it must
+// not call conn's methods; conn only tells connections apart.
+type InfoCallback func(conn *Conn, info Info)
+
+// SetInfoCallback makes connections using the context report handshake
+// state changes and alerts to cb, for tracing handshakes that fail to
+// interoperate. Connections a server name callback moves to another context
+// report to that context's callback instead. A nil cb removes the callback.
+// The checks SetRenegotiationPolicy and SetMaxRenegotiations set up keep
+// running either way.
+func (c *Ctx) SetInfoCallback(cb InfoCallback) {
+	c.info_cb = cb
+	var enabled C.int
+	if cb != nil {
+		enabled = 1
+	}
+	C.SSL_CTX_set_info(c.ctx, enabled)
+}
+
+//export info_cb_thunk
+func info_cb_thunk(p unsafe.Pointer, conn_p unsafe.Pointer, ssl *C.SSL,
+	where C.int, ret C.int) {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Critf("openssl: info callback panic'd: %v", err)
+			os.Exit(1)
+		}
+	}()
+	conn := (*Conn)(conn_p)
+	if conn != nil && conn.metrics != nil {
+		conn.reportInfo(InfoWhere(where), int(ret))
+	}
+	cb := (*Ctx)(p).info_cb
+	if cb == nil {
+		return
+	}
+	info := Info{
+		Where: InfoWhere(where),
+		State: C.GoString(C.SSL_state_string_long(ssl)),
+		Ret:   int(ret)}
+	if info.Where&InfoAlert != 0 {
+		info.AlertLevel = C.GoString(C.SSL_alert_type_string_long(ret))
+		info.AlertDescription = C.GoString(
+			C.SSL_alert_desc_string_long(ret))
+	}
+	cb(conn, info)
+}
+
+// RecordType is the content type of a TLS record.
+type RecordType int
+
+const (
+	RecordChangeCipherSpec RecordType = C.SSL3_RT_CHANGE_CIPHER_SPEC
+	RecordAlert            RecordType = C.SSL3_RT_ALERT
+	RecordHandshake        RecordType = C.SSL3_RT_HANDSHAKE
+	RecordApplicationData  RecordType = C.SSL3_RT_APPLICATION_DATA
+	// RecordHeader messages hold the header of each record, from OpenSSL
+	// 1.0.2 on.
+	RecordHeader RecordType = C.SSL3_RT_HEADER
+	// RecordInnerContentType messages hold the real content type of an
+	// encrypted TLS 1.3 record, from OpenSSL 1.1.1 on.
+	RecordInnerContentType RecordType = C.SSL3_RT_INNER_CONTENT_TYPE
+)
+
+// Message is a protocol message sent or received, reported to a
+// MessageCallback.
+type Message struct {
+	// Sent tells messages sent from those received.
+	Sent bool
+	// Version is the protocol version of the record, e.g. 0x0303 for TLS
+	// 1.2.
+	Version int
+	Type    RecordType
+	// Data is the message. Handshake messages start with their type, and
+	// alerts are their level and description. Application data is not
+	// reported.
+	Data []byte
+}
+
+// MessageCallback is called with each protocol message a connection sends
+// or receives. The connection's lock is held while it runs, so it must not
+// call conn's methods; conn only tells connections apart.
+type MessageCallback func(conn *Conn, msg Message)
+
+// SetMessageCallback makes connections created with the context from now on
+// report the messages they send and receive to cb, like openssl s_client's
+// -msg flag. A nil cb removes the callback.
+func (c *Ctx) SetMessageCallback(cb MessageCallback) {
+	c.msg_cb = cb
+	var enabled C.int
+	if cb != nil {
+		enabled = 1
+	}
+	C.SSL_CTX_set_msg(c.ctx, enabled)
+}
+
+// SetMessageCallback makes the connection report the messages it sends and
+// receives to cb instead of its context's MessageCallback. A nil cb goes
+// back to the context's.
+func (c *Conn) SetMessageCallback(cb MessageCallback) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.msg_cb = cb
+	var enabled C.int
+	if cb != nil || c.ctx.msg_cb != nil {
+		enabled = 1
+	}
+	C.SSL_set_msg(c.ssl, enabled)
+}
+
+//export msg_cb_thunk
+func msg_cb_thunk(p unsafe.Pointer, conn_p unsafe.Pointer, write_p C.int,
+	version C.int, content_type C.int, buf unsafe.Pointer, length C.size_t) {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Critf("openssl: message callback panic'd: %v", err)
+			os.Exit(1)
+		}
+	}()
+	conn := (*Conn)(conn_p)
+	var cb MessageCallback
+	if conn != nil {
+		cb = conn.msg_cb
+	}
+	if cb == nil {
+		cb = (*Ctx)(p).msg_cb
+	}
+	if cb == nil {
+		return
+	}
+	cb(conn, Message{
+		Sent:    write_p != 0,
+		Version: int(version),
+		Type:    RecordType(content_type),
+		Data:    C.GoBytes(buf, C.int(length))})
+}
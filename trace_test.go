@@ -0,0 +1,103 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestInfoAndMessageCallbacks(t *testing.T) {
+	ctx := newTestServerCtx(t)
+	var mtx sync.Mutex
+	var infos []Info
+	ctx.SetInfoCallback(func(conn *Conn, info Info) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		infos = append(infos, info)
+	})
+	var ctx_msgs int
+	ctx.SetMessageCallback(func(conn *Conn, msg Message) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		ctx_msgs++
+	})
+
+	server_conn, client_conn := NetPipe(t)
+	defer server_conn.Close()
+	defer client_conn.Close()
+	server, err := Server(server_conn, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	var msgs []Message
+	server.SetMessageCallback(func(conn *Conn, msg Message) {
+		if conn != server {
+			t.Errorf("unexpected connection")
+		}
+		mtx.Lock()
+		defer mtx.Unlock()
+		msgs = append(msgs, msg)
+	})
+	client_ctx, err := NewCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := Client(client_conn, client_ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	errs := make(chan error, 1)
+	go func() { errs <- server.Handshake() }()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	var started, done bool
+	for _, info := range infos {
+		if info.Where&InfoConnect != 0 {
+			t.Fatalf("unexpected client info %+v", info)
+		}
+		started = started || info.Where&InfoHandshakeStart != 0
+		done = done || info.Where&InfoHandshakeDone != 0
+	}
+	if !started || !done || infos[0].State == "" {
+		t.Fatalf("unexpected infos %+v", infos)
+	}
+	if ctx_msgs != 0 {
+		t.Fatalf("the context's callback got %d messages", ctx_msgs)
+	}
+	var client_hello, server_hello bool
+	for _, msg := range msgs {
+		if msg.Type != RecordHandshake || len(msg.Data) == 0 {
+			continue
+		}
+		// ClientHello and ServerHello are handshake types 1 and 2
+		client_hello = client_hello || !msg.Sent && msg.Data[0] == 1
+		server_hello = server_hello || msg.Sent && msg.Data[0] == 2
+	}
+	if !client_hello || !server_hello {
+		t.Fatalf("missing hellos in %d messages", len(msgs))
+	}
+}
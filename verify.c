@@ -16,10 +16,15 @@
 #include "_cgo_export.h"
 #include <stdio.h>
 
+extern void OUR_record_verify_failure(int ok, X509_STORE_CTX *store);
+
 int verify_cb(int ok, X509_STORE_CTX* store) {
-	SSL* ssl = (SSL *)X509_STORE_CTX_get_app_data(store);
+	SSL* ssl = (SSL *)X509_STORE_CTX_get_ex_data(store,
+		SSL_get_ex_data_X509_STORE_CTX_idx());
 	SSL_CTX* ssl_ctx = ssl_ctx = SSL_get_SSL_CTX(ssl);
 	void* p = SSL_CTX_get_ex_data(ssl_ctx, get_ssl_ctx_idx());
 	// get the pointer to the go Ctx object and pass it back into the thunk
-	return verify_cb_thunk(p, ok, store);
+	ok = verify_cb_thunk(p, ok, store);
+	OUR_record_verify_failure(ok, store);
+	return ok;
 }